@@ -0,0 +1,154 @@
+package app_context
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// AdminServer serves operational endpoints on ADMIN_PORT, separate from
+// the service's own port. Handlers may be added whether or not the server
+// is listening.
+type AdminServer interface {
+	Handle(pattern string, handler http.Handler)
+	HandleFunc(pattern string, handler func(http.ResponseWriter, *http.Request))
+	// Addr is the address the server is listening on, or "" if
+	// ADMIN_PORT isn't set
+	Addr() string
+}
+
+type adminServer struct {
+	name     string
+	lock     sync.Mutex
+	mux      *http.ServeMux
+	server   *http.Server
+	listener net.Listener
+}
+
+func (self *adminServer) Handle(pattern string, handler http.Handler) {
+	self.mux.Handle(pattern, handler)
+}
+
+func (self *adminServer) HandleFunc(pattern string, handler func(http.ResponseWriter, *http.Request)) {
+	self.mux.HandleFunc(pattern, handler)
+}
+
+func (self *adminServer) Addr() string {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.listener == nil {
+		return ""
+	}
+	return self.listener.Addr().String()
+}
+
+func (self *adminServer) listen(addr string, appctx *baseAppContext) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	server := &http.Server{Handler: self.mux}
+
+	self.lock.Lock()
+	self.listener = listener
+	self.server = server
+	self.lock.Unlock()
+
+	goLabeled(self.name, func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			appctx.Logger().LogErrorf(context.Background(), "Server %s on %s stopped: %s", self.name, addr, err)
+		}
+	})
+
+	return nil
+}
+
+func (self *adminServer) stop() error {
+	self.lock.Lock()
+	server, listener := self.server, self.listener
+	self.server = nil
+	self.lock.Unlock()
+
+	if server == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err := server.Shutdown(ctx)
+	// Shutdown only closes it once Serve has started, so the port is
+	// released even when stopping right after listen
+	listener.Close()
+	return err
+}
+
+func (self *baseAppContext) Admin() AdminServer {
+	return self.admin
+}
+
+// adminOnly wraps handler so it needs ADMIN_TOKEN as a bearer token
+func (self *baseAppContext) adminOnly(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !self.adminAuthorized(r) {
+			writeAdminError(w, http.StatusUnauthorized, "A valid ADMIN_TOKEN bearer token is required")
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// ADMIN_PORT enables the admin server, listening on ADMIN_BIND (all
+// interfaces by default, for health checks). It serves /healthz, /scaling
+// and /version to anyone, and with ADMIN_TOKEN set, /admin/consumers,
+// /admin/datasets, /admin/templates, /admin/tunables, /debug/appcontext,
+// /debug/config, /debug/goroutines and /debug/logs, since those show
+// config and recent logs.
+func (self *baseAppContext) setAdminServerFromEnv() error {
+	self.adminToken = self.getEnv("ADMIN_TOKEN")
+	self.tunablesMaxTTL = 4 * time.Hour
+	if d, found, err := self.getDurationFromEnv("TUNABLES_ADMIN_MAX_TTL"); err != nil {
+		return err
+	} else if found && d > 0 {
+		self.tunablesMaxTTL = d
+	}
+
+	self.admin.Handle("/admin/consumers", self.consumersAdminHandler())
+	self.admin.Handle("/admin/datasets", self.datasetsAdminHandler())
+	self.admin.Handle("/admin/templates", self.notificationTemplatesAdminHandler())
+	self.admin.Handle("/admin/tunables", self.tunablesAdminHandler())
+	self.admin.Handle("/healthz", self.Health().Handler())
+	self.admin.Handle("/scaling", self.scaling.handler())
+	self.admin.Handle("/debug/appcontext", self.adminOnly(self.introspectionHandler()))
+	self.admin.Handle("/debug/config", self.adminOnly(self.configHandler()))
+	self.admin.Handle("/debug/goroutines", self.adminOnly(goroutinesHandler()))
+	self.admin.Handle("/debug/logs", self.adminOnly(self.logRingHandler()))
+	self.admin.Handle("/version", self.VersionHandler())
+
+	if self.getEnv("ADMIN_PORT") == "" {
+		return nil
+	}
+
+	// 0 picks a free port
+	port, _, err := self.getIntFromEnv("ADMIN_PORT")
+	if err != nil {
+		return err
+	}
+	if port < 0 {
+		return fmt.Errorf("ADMIN_PORT must be >= 0")
+	}
+
+	addr := net.JoinHostPort(self.getEnv("ADMIN_BIND"), strconv.Itoa(port))
+	if err := self.admin.listen(addr, self); err != nil {
+		return err
+	}
+
+	self.logger.LogInfof(context.Background(), "Admin server listening on %s", self.admin.Addr())
+
+	return nil
+}
@@ -0,0 +1,98 @@
+package app_context
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"testing"
+)
+
+func TestAdminIntrospection(t *testing.T) {
+	os.Setenv("ADMIN_PORT", "0")
+	defer os.Unsetenv("ADMIN_PORT")
+	os.Setenv("ADMIN_BIND", "127.0.0.1")
+	defer os.Unsetenv("ADMIN_BIND")
+	os.Setenv("METRICS_DISABLE", "true")
+	defer os.Unsetenv("METRICS_DISABLE")
+	os.Setenv("ADMIN_TOKEN", "secret")
+	defer os.Unsetenv("ADMIN_TOKEN")
+
+	app_ctx, err := NewAppContext("admin_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer app_ctx.Close()
+
+	addr := app_ctx.Admin().Addr()
+	if addr == "" {
+		t.Fatal("Admin server isn't listening")
+	}
+
+	app_ctx.Health().SetStatus("metrics", nil)
+
+	// Debug endpoints need the admin token
+	resp, err := http.Get("http://" + addr + "/debug/logs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected /debug/logs to need ADMIN_TOKEN, got %d", resp.StatusCode)
+	}
+
+	req, _ := http.NewRequest("GET", "http://"+addr+"/debug/appcontext", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := struct {
+		AppName    string           `json:"app_name"`
+		Subsystems []*SubsystemInfo `json:"subsystems"`
+	}{}
+	err = json.NewDecoder(resp.Body).Decode(&body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if body.AppName != "admin_test" {
+		t.Errorf("Unexpected app name: %s", body.AppName)
+	}
+
+	found := map[string]*SubsystemInfo{}
+	for _, info := range body.Subsystems {
+		found[info.Name] = info
+	}
+
+	if m := found["metrics"]; m == nil || !m.NOOP || m.Source != "disabled" || m.Health == nil {
+		t.Errorf("Unexpected metrics info: %+v", m)
+	}
+	if l := found["logger"]; l == nil || l.NOOP || l.Source != "profile" {
+		t.Errorf("Unexpected logger info: %+v", l)
+	}
+	if db := found["db"]; db == nil || !db.NOOP {
+		t.Errorf("Unexpected db info: %+v", db)
+	}
+
+	resp, err = http.Get("http://" + addr + "/healthz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("/healthz returned %d", resp.StatusCode)
+	}
+
+	// The client may have dialed a spare connection that never sent a
+	// request, which Shutdown would wait on
+	http.DefaultClient.CloseIdleConnections()
+	if err := app_ctx.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := http.Get("http://" + addr + "/healthz"); err == nil {
+		t.Error("Admin server still serving after Close")
+	}
+}
@@ -0,0 +1,279 @@
+package app_context
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+type PriorityClass int
+
+const (
+	PriorityBackground PriorityClass = iota
+	PriorityNormal
+	PriorityCritical
+)
+
+const numPriorityClasses = 3
+
+// Percentage of max concurrency each class may occupy before it has to
+// queue. Critical traffic can use every slot.
+var defaultAdmissionClassLimits = [numPriorityClasses]int{
+	PriorityBackground: 50,
+	PriorityNormal:     90,
+	PriorityCritical:   100,
+}
+
+var ErrAdmissionShed = errors.New("Request shed by admission control")
+
+func (self PriorityClass) String() string {
+	switch self {
+	case PriorityBackground:
+		return "background"
+	case PriorityNormal:
+		return "normal"
+	case PriorityCritical:
+		return "critical"
+	}
+	return fmt.Sprintf("PriorityClass(%d)", int(self))
+}
+
+func ParsePriorityClass(s string) (PriorityClass, error) {
+	switch strings.ToLower(s) {
+	case "background":
+		return PriorityBackground, nil
+	case "normal", "":
+		return PriorityNormal, nil
+	case "critical":
+		return PriorityCritical, nil
+	}
+	return PriorityNormal, fmt.Errorf("Unknown priority class: %s", s)
+}
+
+type AdmissionController interface {
+	// Admit blocks until the request may proceed, returning a release func
+	// that must be called when done, or ErrAdmissionShed.
+	Admit(ctx context.Context, class PriorityClass) (func(), error)
+	InFlight() int
+	// Middleware classifies requests with classifier (nil uses the
+	// X-Request-Priority header) and responds 503 to shed requests.
+	Middleware(classifier func(*http.Request) PriorityClass, next http.Handler) http.Handler
+}
+
+type admissionWaiter struct {
+	ready   chan struct{}
+	granted bool
+}
+
+type admissionController struct {
+	lock          sync.Mutex
+	maxConcurrent int
+	maxQueue      int
+	queueTimeout  time.Duration
+	classLimits   [numPriorityClasses]int
+	inFlight      int
+	queues        [numPriorityClasses][]*admissionWaiter
+	appctx        *baseAppContext
+}
+
+func (self *admissionController) classTags(class PriorityClass) map[string]string {
+	return map[string]string{"class": class.String()}
+}
+
+func (self *admissionController) canAdmit(class PriorityClass) bool {
+	if self.maxConcurrent <= 0 {
+		return true
+	}
+	limit := self.maxConcurrent * self.classLimits[class] / 100
+	if limit < 1 {
+		limit = 1
+	}
+	return self.inFlight < limit
+}
+
+func (self *admissionController) InFlight() int {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.inFlight
+}
+
+func (self *admissionController) release() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	self.inFlight--
+	self.grantWaiters()
+}
+
+// must be called with lock held
+func (self *admissionController) grantWaiters() {
+	for class := PriorityCritical; class >= PriorityBackground; class-- {
+		for len(self.queues[class]) > 0 && self.canAdmit(class) {
+			waiter := self.queues[class][0]
+			self.queues[class] = self.queues[class][1:]
+			waiter.granted = true
+			self.inFlight++
+			close(waiter.ready)
+		}
+	}
+}
+
+func (self *admissionController) removeWaiter(class PriorityClass, waiter *admissionWaiter) {
+	queue := self.queues[class]
+	for i, w := range queue {
+		if w == waiter {
+			self.queues[class] = append(queue[:i], queue[i+1:]...)
+			return
+		}
+	}
+}
+
+func (self *admissionController) releaseFunc() func() {
+	var once sync.Once
+	return func() { once.Do(self.release) }
+}
+
+func (self *admissionController) Admit(ctx context.Context, class PriorityClass) (func(), error) {
+	if class < PriorityBackground || class > PriorityCritical {
+		class = PriorityNormal
+	}
+
+	tags := self.classTags(class)
+
+	self.lock.Lock()
+
+	if self.canAdmit(class) {
+		self.inFlight++
+		self.lock.Unlock()
+		self.appctx.MetricsClient().Incr("admission.admitted", 1.0, tags)
+		return self.releaseFunc(), nil
+	}
+
+	if len(self.queues[class]) >= self.maxQueue {
+		self.lock.Unlock()
+		self.appctx.MetricsClient().Incr("admission.shed", 1.0, tags)
+		return nil, ErrAdmissionShed
+	}
+
+	waiter := &admissionWaiter{ready: make(chan struct{})}
+	self.queues[class] = append(self.queues[class], waiter)
+	queue_timeout := self.queueTimeout
+	self.lock.Unlock()
+
+	self.appctx.MetricsClient().Incr("admission.queued", 1.0, tags)
+
+	start := time.Now()
+	timer := self.appctx.Clock().NewTimer(queue_timeout)
+	defer timer.Stop()
+
+	select {
+	case <-waiter.ready:
+	case <-ctx.Done():
+	case <-timer.C():
+	}
+
+	self.lock.Lock()
+	granted := waiter.granted
+	if !granted {
+		self.removeWaiter(class, waiter)
+	}
+	self.lock.Unlock()
+
+	self.appctx.MetricsClient().TimingMS(
+		"admission.queue_wait_ms",
+		float64(time.Since(start))/float64(time.Millisecond),
+		1.0,
+		tags,
+	)
+
+	if !granted {
+		self.appctx.MetricsClient().Incr("admission.shed", 1.0, tags)
+		return nil, ErrAdmissionShed
+	}
+
+	self.appctx.MetricsClient().Incr("admission.admitted", 1.0, tags)
+
+	return self.releaseFunc(), nil
+}
+
+func priorityClassFromHeader(r *http.Request) PriorityClass {
+	class, _ := ParsePriorityClass(r.Header.Get("X-Request-Priority"))
+	return class
+}
+
+func (self *admissionController) Middleware(classifier func(*http.Request) PriorityClass, next http.Handler) http.Handler {
+	if classifier == nil {
+		classifier = priorityClassFromHeader
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		release, err := self.Admit(r.Context(), classifier(r))
+		if err != nil {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "Service overloaded", http.StatusServiceUnavailable)
+			return
+		}
+		defer release()
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (self *baseAppContext) Admission() AdmissionController {
+	return self.admission
+}
+
+func (self *baseAppContext) setAdmissionFromEnv() error {
+	ctrl := &admissionController{
+		maxQueue:     100,
+		queueTimeout: time.Second,
+		classLimits:  defaultAdmissionClassLimits,
+		appctx:       self,
+	}
+
+	if max_conc, _, err := self.getIntFromEnv("ADMISSION_MAX_CONCURRENCY"); err != nil {
+		return err
+	} else if max_conc < 0 {
+		return errors.New("ADMISSION_MAX_CONCURRENCY must be >= 0")
+	} else {
+		ctrl.maxConcurrent = max_conc
+	}
+
+	if max_queue, found, err := self.getIntFromEnv("ADMISSION_MAX_QUEUE"); err != nil {
+		return err
+	} else if found {
+		if max_queue < 0 {
+			return errors.New("ADMISSION_MAX_QUEUE must be >= 0")
+		}
+		ctrl.maxQueue = max_queue
+	}
+
+	if timeout, found, err := self.getDurationFromEnv("ADMISSION_QUEUE_TIMEOUT"); err != nil {
+		return err
+	} else if found {
+		ctrl.queueTimeout = timeout
+	}
+
+	self.admission = ctrl
+
+	// Both can be tuned at runtime, reverting to the values above
+	max_conc, queue_timeout := ctrl.maxConcurrent, ctrl.queueTimeout
+
+	self.tunables.Declare("ADMISSION_MAX_CONCURRENCY", func() {
+		ctrl.lock.Lock()
+		defer ctrl.lock.Unlock()
+		ctrl.maxConcurrent = self.tunables.Int("ADMISSION_MAX_CONCURRENCY", max_conc)
+		ctrl.grantWaiters()
+	})
+
+	self.tunables.Declare("ADMISSION_QUEUE_TIMEOUT", func() {
+		ctrl.lock.Lock()
+		defer ctrl.lock.Unlock()
+		ctrl.queueTimeout = self.tunables.Duration("ADMISSION_QUEUE_TIMEOUT", queue_timeout)
+	})
+
+	return nil
+}
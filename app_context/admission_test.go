@@ -0,0 +1,118 @@
+package app_context
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestAdmissionUnlimited(t *testing.T) {
+	os.Unsetenv("ADMISSION_MAX_CONCURRENCY")
+
+	app_ctx, err := NewAppContext("admission_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for i := 0; i < 10; i++ {
+		if _, err := app_ctx.Admission().Admit(context.Background(), PriorityBackground); err != nil {
+			t.Fatalf("Unlimited admission controller shed a request: %s", err)
+		}
+	}
+}
+
+func TestAdmissionShedsLowerClassesFirst(t *testing.T) {
+	os.Setenv("ADMISSION_MAX_CONCURRENCY", "4")
+	os.Setenv("ADMISSION_MAX_QUEUE", "1")
+	os.Setenv("ADMISSION_QUEUE_TIMEOUT", "20ms")
+	defer func() {
+		os.Unsetenv("ADMISSION_MAX_CONCURRENCY")
+		os.Unsetenv("ADMISSION_MAX_QUEUE")
+		os.Unsetenv("ADMISSION_QUEUE_TIMEOUT")
+	}()
+
+	app_ctx, err := NewAppContext("admission_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	adm := app_ctx.Admission()
+	ctx := context.Background()
+
+	// Background may use 50% of 4 slots
+	for i := 0; i < 2; i++ {
+		if _, err := adm.Admit(ctx, PriorityBackground); err != nil {
+			t.Fatalf("Background request %d was shed: %s", i, err)
+		}
+	}
+
+	if _, err := adm.Admit(ctx, PriorityBackground); err != ErrAdmissionShed {
+		t.Errorf("3rd background request should have been shed: %v", err)
+	}
+
+	release, err := adm.Admit(ctx, PriorityNormal)
+	if err != nil {
+		t.Fatalf("Normal request was shed: %s", err)
+	}
+
+	if _, err := adm.Admit(ctx, PriorityCritical); err != nil {
+		t.Fatalf("Critical request was shed: %s", err)
+	}
+
+	if n := adm.InFlight(); n != 4 {
+		t.Errorf("InFlight is not 4: %d", n)
+	}
+
+	done := make(chan error)
+	go func() {
+		_, err := adm.Admit(ctx, PriorityCritical)
+		done <- err
+	}()
+
+	time.Sleep(5 * time.Millisecond)
+	release()
+	release()
+
+	if err := <-done; err != nil {
+		t.Errorf("Queued critical request wasn't admitted after release: %s", err)
+	}
+
+	if n := adm.InFlight(); n != 4 {
+		t.Errorf("InFlight is not 4 after handoff: %d", n)
+	}
+}
+
+func TestAdmissionMiddleware(t *testing.T) {
+	os.Setenv("ADMISSION_MAX_CONCURRENCY", "1")
+	os.Setenv("ADMISSION_MAX_QUEUE", "0")
+	defer func() {
+		os.Unsetenv("ADMISSION_MAX_CONCURRENCY")
+		os.Unsetenv("ADMISSION_MAX_QUEUE")
+	}()
+
+	app_ctx, err := NewAppContext("admission_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	handler := app_ctx.Admission().Middleware(nil, http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {},
+	))
+
+	if _, err := app_ctx.Admission().Admit(context.Background(), PriorityCritical); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Request-Priority", "background")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("Overloaded middleware didn't return 503: %d", rec.Code)
+	}
+}
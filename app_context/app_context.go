@@ -1,9 +1,15 @@
 package app_context
 
 import (
+	"context"
+	"crypto/tls"
+	"database/sql"
 	"errors"
 	"fmt"
+	"io"
 	"log"
+	"math/rand"
+	"net/http"
 	"os"
 	"strconv"
 	"strings"
@@ -18,45 +24,253 @@ import (
 	"github.com/tilteng/go-s3-config/s3config"
 )
 
+// AppContext is everything a service gets from its context. Libraries
+// that only need a part of it should accept one of the Has interfaces
+// instead, which are easier to satisfy in tests.
 type AppContext interface {
+	HasDB
+	HasErrorReporter
+	HasLogger
+	HasMetrics
+
+	Admin() AdminServer
+	Admission() AdmissionController
 	AppName() string
+	As(interface{}) bool
+	AuditLogger() AuditLogger
+	AuthKeys() AuthKeys
 	BaseExternalURL() string
+	BuildInfo() BuildInfo
+	Cache() Cache
+	CachedQuery(context.Context, string, time.Duration, []string, interface{}, func(context.Context) error) error
+	CDC() CDCConsumer
+	Checkpoint(string) Checkpoint
+	CircuitBreakers() CircuitBreakerRegistry
+	Clock() Clock
+	Close() error
 	CodeVersion() string
-	DB() *sqlx.DB
+	ConfigFingerprint() string
+	ConfigSummary(bool) *ConfigSummary
+	ConfigValue(string) (string, bool)
+	Consumers() ConsumerControls
+	CostCenter(context.Context) string
+	Crypto() Crypto
+	DataSampler() DataSampler
+	Datasets() DatasetRegistry
+	DBX() *sqlx.DB
+	DebugServer() AdminServer
+	Degraded() map[string]string
+	DumpConfig(io.Writer, bool) error
+	EnvPrefix() string
+	ErrorCodes() ErrorRegistry
+	FieldPropagation() FieldPropagation
+	ForRequest(*http.Request) RequestAppContext
+	GoldenSignals() GoldenSignals
+	HandleCrash()
+	Health() HealthRegistry
 	Hostname() string
+	HTTPClient() *http.Client
+	HTTPMiddleware() func(http.Handler) http.Handler
+	IDGenerator() IDGenerator
+	InvalidateTag(context.Context, string) error
+	Jobs() JobQueue
 	JSONSchemaFilePath() string
-	Logger() logger.CtxLogger
-	MetricsClient() metrics.MetricsClient
+	KafkaConsumerGroup() KafkaConsumerGroup
+	KafkaEnabled() bool
+	KafkaProducer() KafkaProducer
+	Kubernetes() *KubernetesInfo
+	LeaderElection() LeaderElection
+	Localizer() Localizer
+	Locks() LockManager
+	LogLevel() LogLevel
+	LogRing() *LogRing
+	Mailer() Mailer
+	MatViews() MatViewRegistry
+	MessageBus() MessageBus
 	MetricsEnabled() bool
+	MigrateDB(string) error
+	MigrationVersion() (int64, error)
+	NewGraphQLServer(GraphQLSchema) *GraphQLServer
+	NotificationTemplates() NotificationTemplateCatalog
+	ObjectStore() ObjectStore
+	OfflineMode() bool
+	OnConfigReload(ConfigReloadFunc)
+	OnTrafficRoleChange(TrafficRoleCallback)
+	OpenAPI() OpenAPI
+	Outbox() Outbox
+	Partitions() PartitionManager
+	QueryTracer() QueryTracer
+	Rand() *rand.Rand
+	RateLimiter(string) RateLimiter
+	RegisterSelfTest(string, SelfTestFunc)
+	ReportError(error, map[string]interface{})
+	RequestMiddleware(http.Handler) http.Handler
 	RollbarClient() rollbar.Client
 	RollbarEnabled() bool
+	Saga(string) *Saga
+	ScalingSignals() ScalingSignals
+	SchemaRegistry() SchemaRegistry
+	Scheduler() Scheduler
+	SelfTest(context.Context) error
+	Profile() EnvProfile
 	ServicePort() int
+	Services() ServiceRegistry
+	SetCache(Cache) AppContext
+	SetClock(Clock) AppContext
+	SetDB(*sqlx.DB) AppContext
+	SetIDGenerator(IDGenerator) AppContext
+	SetLogLevel(LogLevel) error
 	SetLogger(logger.CtxLogger) AppContext
+	SetMessageBus(MessageBus) AppContext
+	SetMetricsClient(metrics.MetricsClient) AppContext
+	SetObjectStore(ObjectStore) AppContext
+	SetQueryTracer(QueryTracer) AppContext
+	SetRollbarClient(rollbar.Client) AppContext
+	SetTrafficRole(TrafficRole)
+	SSE() SSEBroadcaster
 	StartStatsSender() error
+	StateMachine(string) *StateMachine
 	StopStatsSender() error
+	StrictConfig() bool
+	Suppressions() SuppressionList
+	SyntheticChecks() SyntheticCheckRunner
 	TiltEnv() string
+	Templates() Templates
+	TLSConfig(string) (*tls.Config, error)
+	TrafficRole() TrafficRole
+	Tunables() Tunables
+	VersionHandler() http.Handler
+	Watchdog() Watchdog
+	WebSockets() WebSocketHub
+	WithComponent(string) AppContext
+	WithFields(map[string]interface{}) AppContext
+	WithTx(context.Context, func(*sql.Tx) error) error
+	Workers() WorkerManager
+	WriteHTTPError(http.ResponseWriter, *http.Request, error)
 }
 
 type baseAppContext struct {
-	appName            string
-	baseExternalURL    string
-	codeVersion        string
-	db                 *sqlx.DB
-	dbMaxIdleConns     int
-	dbMaxOpenConns     int
-	hostname           string
-	jsonSchemaFilePath string
-	logger             logger.CtxLogger
-	metricsClient      metrics.MetricsClient
-	metricsEnabled     bool
-	rollbarClient      rollbar.Client
-	rollbarEnabled     bool
-	servicePort        int
-	statsLock          sync.Mutex
-	statsSignalChan    chan bool
-	statsDoneChan      chan bool
-	statsRunning       bool
-	tiltEnv            string
+	accessLogDisabled    bool
+	admin                *adminServer
+	adminToken           string
+	admission            *admissionController
+	appName              string
+	auditLogger          *auditLogger
+	authKeys             *authKeys
+	baseExternalURL      string
+	buildInfo            *BuildInfo
+	cache                Cache
+	cdc                  *cdcConsumer
+	checkpoints          *checkpoints
+	circuitBreakers      *circuitBreakerRegistry
+	clock                Clock
+	closeLock            sync.Mutex
+	closed               bool
+	codeVersion          string
+	componentsGen        uint64
+	componentsLock       sync.RWMutex
+	configFile           map[string]string
+	consumers            *consumerControls
+	crashReportDir       string
+	crashReportS3        *s3Location
+	crypto               Crypto
+	datasets             *datasetRegistry
+	db                   *sqlx.DB
+	dbMaxIdleConns       int
+	dbMaxOpenConns       int
+	dbReplica            *dbReplica
+	dbSessionSettings    []*dbSessionSetting
+	deadlineHeader       string
+	deadlineMax          time.Duration
+	debug                *adminServer
+	decryptedEnv         map[string]string
+	degraded             map[string]string
+	dotEnv               map[string]string
+	dotEnvDir            string
+	encryptedNames       map[string]bool
+	env                  map[string]string
+	envPrefix            string
+	envLookups           sync.Map
+	errorCodes           *errorRegistry
+	fieldPropagation     *fieldPropagation
+	fingerprinter        Fingerprinter
+	golden               *goldenSignals
+	graphql              *graphqlConfig
+	health               HealthRegistry
+	hostname             string
+	httpClient           *http.Client
+	httpErrorDetails     bool
+	idGenerator          IDGenerator
+	initDurations        map[string]time.Duration
+	initFailed           string
+	initOrder            []string
+	jobs                 *jobQueue
+	jsonSchemaFilePath   string
+	kafkaConfig          *KafkaConfig
+	kafkaConsumerGroup   KafkaConsumerGroup
+	kafkaEnabled         bool
+	kafkaProducer        KafkaProducer
+	kubernetes           *KubernetesInfo
+	lambda               bool
+	leaderElection       *leaderElection
+	lifecycle            *lifecycleMetrics
+	localizer            *localizer
+	locks                *lockManager
+	logRing              *LogRing
+	logRingReportEntries int
+	logger               logger.CtxLogger
+	mailer               *mailer
+	matViews             *matViewRegistry
+	messageBus           MessageBus
+	metricsClient        metrics.MetricsClient
+	metricsEnabled       bool
+	notifyTemplates      *notificationTemplateCatalog
+	objectStore          ObjectStore
+	offlineMode          bool
+	openAPI              *openAPI
+	outbox               *outbox
+	partitions           *partitionManager
+	profile              EnvProfile
+	queryCache           *queryCache
+	queryTracer          QueryTracer
+	random               *rand.Rand
+	randomSeed           *int64
+	rateLimiters         *rateLimiters
+	remoteConfig         *remoteConfig
+	requestIDHeader      string
+	rollbarClient        rollbar.Client
+	rollbarEnabled       bool
+	rollbarPayload       *rollbarPayload
+	sagas                sagaStore
+	sampler              *dataSampler
+	scaling              *scalingSignals
+	scheduler            *scheduler
+	schemaRegistry       *schemaRegistry
+	selfTests            selfTests
+	serviceDiscovery     *serviceDiscovery
+	servicePort          int
+	services             *serviceRegistry
+	sse                  *sseBroadcaster
+	startedAt            time.Time
+	statsLock            sync.Mutex
+	statsSignalChan      chan bool
+	statsDoneChan        chan bool
+	statsInterval        time.Duration
+	statsRunning         bool
+	strictConfig         bool
+	suppressions         *suppressionList
+	syntheticChecks      *syntheticCheckRunner
+	templateFuncs        map[string]interface{}
+	templates            *templates
+	tiltEnv              string
+	tlsConfigs           *tlsConfigs
+	trafficRole          *trafficRoleWatcher
+	tunables             *tunables
+	tunablesMaxTTL       time.Duration
+	txMaxRetries         int
+	watchdog             *watchdog
+	webSockets           *webSocketHub
+	workers              *workerManager
 }
 
 func (self *baseAppContext) AppName() string {
@@ -72,9 +286,18 @@ func (self *baseAppContext) CodeVersion() string {
 }
 
 func (self *baseAppContext) DB() *sqlx.DB {
+	self.componentsLock.RLock()
+	defer self.componentsLock.RUnlock()
 	return self.db
 }
 
+// DBX returns the same handle as DB. The database has always been opened
+// with sqlx, so named parameters and struct scanning are available from
+// either; DBX exists for code that expects the sqlx accessor by name.
+func (self *baseAppContext) DBX() *sqlx.DB {
+	return self.DB()
+}
+
 func (self *baseAppContext) DBMaxIdleConns() int {
 	return self.dbMaxIdleConns
 }
@@ -92,10 +315,14 @@ func (self *baseAppContext) JSONSchemaFilePath() string {
 }
 
 func (self *baseAppContext) Logger() logger.CtxLogger {
+	self.componentsLock.RLock()
+	defer self.componentsLock.RUnlock()
 	return self.logger
 }
 
 func (self *baseAppContext) MetricsClient() metrics.MetricsClient {
+	self.componentsLock.RLock()
+	defer self.componentsLock.RUnlock()
 	return self.metricsClient
 }
 
@@ -104,6 +331,8 @@ func (self *baseAppContext) MetricsEnabled() bool {
 }
 
 func (self *baseAppContext) RollbarClient() rollbar.Client {
+	self.componentsLock.RLock()
+	defer self.componentsLock.RUnlock()
 	return self.rollbarClient
 }
 
@@ -119,14 +348,53 @@ func (self *baseAppContext) TiltEnv() string {
 	return self.tiltEnv
 }
 
+// The Set* methods below may be called at runtime, eg. to replace a client
+// after reconnecting. Callers holding the old value keep a working
+// reference and are responsible for closing it if needed.
+
+func (self *baseAppContext) SetDB(db *sqlx.DB) AppContext {
+	self.componentsLock.Lock()
+	defer self.componentsLock.Unlock()
+	self.db = db
+	self.componentsGen++
+	return self
+}
+
 func (self *baseAppContext) SetLogger(logger logger.CtxLogger) AppContext {
+	self.componentsLock.Lock()
+	defer self.componentsLock.Unlock()
 	self.logger = logger
+	self.componentsGen++
 	return self
 }
 
+func (self *baseAppContext) SetMetricsClient(client metrics.MetricsClient) AppContext {
+	self.componentsLock.Lock()
+	defer self.componentsLock.Unlock()
+	self.metricsClient = client
+	self.componentsGen++
+	return self
+}
+
+func (self *baseAppContext) SetRollbarClient(client rollbar.Client) AppContext {
+	self.componentsLock.Lock()
+	defer self.componentsLock.Unlock()
+	self.rollbarClient = client
+	self.componentsGen++
+	return self
+}
+
+// generation is bumped each time a component is swapped, so derived
+// contexts know to rebuild their wrappers.
+func (self *baseAppContext) generation() uint64 {
+	self.componentsLock.RLock()
+	defer self.componentsLock.RUnlock()
+	return self.componentsGen
+}
+
 func (self *baseAppContext) isDisabled(s string) (bool, error) {
 	s += "_DISABLE"
-	if disable, ok := os.LookupEnv(s); ok {
+	if disable, ok := self.lookupEnv(s); ok {
 		if disable == "true" {
 			return true, nil
 		}
@@ -142,7 +410,7 @@ func (self *baseAppContext) setRollbarClientFromEnv() error {
 		return err
 	}
 
-	api_key := os.Getenv("ROLLBAR_API_KEY")
+	api_key := self.getEnv("ROLLBAR_API_KEY")
 	if api_key == "" {
 		return nil
 	}
@@ -155,33 +423,52 @@ func (self *baseAppContext) setRollbarClientFromEnv() error {
 
 		opts := self.rollbarClient.Options()
 
-		env := os.Getenv("ROLLBAR_ENVIRONMENT")
+		env := self.getEnv("ROLLBAR_ENVIRONMENT")
 		if env == "development" || env == "staging" || env == "production" {
 			opts.Environment = env
+		} else if env != "" && self.strictConfig {
+			return fmt.Errorf("Unknown ROLLBAR_ENVIRONMENT: %s", env)
 		}
 
 		if len(self.codeVersion) != 0 {
 			opts.NotifierServer.CodeVersion = self.codeVersion
 		}
+
+		custom, err := self.setRollbarPayloadFromEnv()
+		if err != nil {
+			return err
+		}
+		if self.kubernetes != nil {
+			custom["kubernetes"] = self.kubernetes
+		}
+		if len(custom) != 0 {
+			self.rollbarClient = &customRollbarClient{Client: rcli, custom: custom}
+		}
 	}
 
 	return nil
 }
 
+// reportError is for errors the app context notices itself, in background
+// work
+func (self *baseAppContext) reportError(err error, custom rollbar.CustomInfo) {
+	self.ErrorReporter().Report(context.Background(), err, custom)
+}
+
 func (self *baseAppContext) setMetricsClientFromEnv() error {
 	if disabled, err := self.isDisabled("METRICS"); disabled {
 		return err
 	}
 
-	metrics_addr := os.Getenv("METRICS_ADDR")
-	metrics_tags := os.Getenv("METRICS_TAGS")
+	metrics_addr := self.getEnv("METRICS_ADDR")
+	metrics_tags := self.getEnv("METRICS_TAGS")
 
-	metrics_namespace, ok := os.LookupEnv("METRICS_NAMESPACE")
+	metrics_namespace, ok := self.lookupEnv("METRICS_NAMESPACE")
 	if !ok {
 		metrics_namespace = self.appName + "."
 	}
 
-	metrics_hostname, ok := os.LookupEnv("METRICS_HOSTNAME")
+	metrics_hostname, ok := self.lookupEnv("METRICS_HOSTNAME")
 	if !ok {
 		metrics_hostname = self.hostname
 	}
@@ -194,11 +481,26 @@ func (self *baseAppContext) setMetricsClientFromEnv() error {
 		tags_map["host"] = metrics_hostname
 	}
 
+	if cost_center := self.getEnv("COST_CENTER"); len(cost_center) > 0 {
+		tags_map["cost_center"] = cost_center
+	}
+
+	if self.kubernetes != nil {
+		for k, v := range self.kubernetes.metricsTags() {
+			if v != "" {
+				tags_map[k] = v
+			}
+		}
+	}
+
 	for _, kv := range strings.Split(metrics_tags, ",") {
 		if len(kv) == 0 {
 			continue
 		}
 		if !strings.Contains(kv, "=") {
+			if self.strictConfig {
+				return fmt.Errorf("METRICS_TAGS entry '%s' should be key=value", kv)
+			}
 			kv += "="
 		}
 		parts := strings.SplitN(kv, "=", 2)
@@ -225,12 +527,12 @@ func (self *baseAppContext) setMetricsClientFromEnv() error {
 }
 
 func (self *baseAppContext) setDBFromEnv() error {
-	db_string := os.Getenv("DB_DSN")
+	db_string := self.getEnv("DB_DSN")
 	if len(db_string) == 0 {
 		return nil
 	}
 
-	db, err := sqlx.Open("postgres", db_string)
+	db, err := self.openDB("postgres", db_string, "primary")
 	if err != nil {
 		return errors.New("Couldn't open the database. Check that DB_DSN is correct.")
 	}
@@ -241,7 +543,7 @@ func (self *baseAppContext) setDBFromEnv() error {
 }
 
 func (self *baseAppContext) setDBMaxIdleConnsFromEnv() error {
-	if max_conns, found, err := getIntFromEnv("DB_MAX_IDLE_CONNS"); !found {
+	if max_conns, found, err := self.getIntFromEnv("DB_MAX_IDLE_CONNS"); !found {
 		return nil
 	} else if err != nil {
 		return err
@@ -254,7 +556,7 @@ func (self *baseAppContext) setDBMaxIdleConnsFromEnv() error {
 }
 
 func (self *baseAppContext) setDBMaxOpenConnsFromEnv() error {
-	if max_conns, found, err := getIntFromEnv("DB_MAX_OPEN_CONNS"); !found {
+	if max_conns, found, err := self.getIntFromEnv("DB_MAX_OPEN_CONNS"); !found {
 		return nil
 	} else if err != nil {
 		return err
@@ -266,8 +568,8 @@ func (self *baseAppContext) setDBMaxOpenConnsFromEnv() error {
 	}
 }
 
-func getIntFromEnv(name string) (int, bool, error) {
-	str, found := os.LookupEnv(name)
+func (self *baseAppContext) getIntFromEnv(name string) (int, bool, error) {
+	str, found := self.lookupEnv(name)
 	if !found || str == "" {
 		return 0, found, nil
 	}
@@ -280,8 +582,42 @@ func getIntFromEnv(name string) (int, bool, error) {
 	return num, true, nil
 }
 
+func (self *baseAppContext) getBoolFromEnv(name string) (bool, bool, error) {
+	str, found := self.lookupEnv(name)
+	if !found || str == "" {
+		return false, found, nil
+	}
+
+	if str == "true" {
+		return true, true, nil
+	}
+	if str != "false" {
+		return false, true, errors.New(name + " must be 'true' or 'false'")
+	}
+
+	return false, true, nil
+}
+
+func (self *baseAppContext) getDurationFromEnv(name string) (time.Duration, bool, error) {
+	str, found := self.lookupEnv(name)
+	if !found || str == "" {
+		return 0, found, nil
+	}
+
+	dur, err := time.ParseDuration(str)
+	if err != nil {
+		return 0, true, fmt.Errorf("Env '%s' is not a duration: %s", name, err)
+	}
+
+	if dur < 0 {
+		return 0, true, fmt.Errorf("Env '%s' must not be negative", name)
+	}
+
+	return dur, true, nil
+}
+
 func (self *baseAppContext) setServicePortFromEnv() error {
-	if port, _, err := getIntFromEnv("SERVICE_PORT"); err != nil {
+	if port, _, err := self.getIntFromEnv("SERVICE_PORT"); err != nil {
 		return err
 	} else if port < 0 {
 		return errors.New("SERVICE_PORT must be >= 0")
@@ -298,21 +634,21 @@ func (self *baseAppContext) StartStatsSender() error {
 		return errors.New("Stats sender is already running")
 	}
 
-	go func() {
+	goLabeled("metrics", func() {
 		previous := metrics.GetProcStats()
 		for {
 			select {
 			case <-self.statsSignalChan:
 				self.statsDoneChan <- true
 				return
-			case <-time.After(time.Second * 1):
+			case <-self.Clock().After(self.statsInterval):
 				current := metrics.GetProcStats()
 				self.SendStats(previous, current)
 				previous = current
 			}
 
 		}
-	}()
+	})
 
 	self.statsRunning = true
 
@@ -334,19 +670,193 @@ func (self *baseAppContext) StopStatsSender() error {
 	return nil
 }
 
-func NewAppContext(app_name string) (AppContext, error) {
+// Close also tears down an app context whose setup failed partway, so
+// anything not set up yet is skipped.
+func (self *baseAppContext) Close() error {
+	self.closeLock.Lock()
+	defer self.closeLock.Unlock()
+
+	if self.closed {
+		return nil
+	}
+	self.closed = true
+
+	var first_err error
+
+	// Out of discovery first, so nothing new is sent here while the rest
+	// shuts down
+	self.serviceDiscovery.deregister()
+
+	if err := self.admin.stop(); err != nil {
+		first_err = fmt.Errorf("Error stopping admin server: %s", err)
+	}
+
+	if err := self.debug.stop(); err != nil && first_err == nil {
+		first_err = fmt.Errorf("Error stopping debug server: %s", err)
+	}
+
+	if err := self.workers.Stop(); err != nil && first_err == nil {
+		first_err = err
+	}
+
+	if err := self.scheduler.Stop(); err != nil && first_err == nil {
+		first_err = err
+	}
+
+	self.watchdog.stop()
+
+	self.lifecycle.stop()
+
+	self.checkpoints.stop()
+
+	self.consumers.stop()
+
+	self.scaling.stop()
+
+	self.golden.stop()
+
+	self.jobs.close()
+
+	self.webSockets.close()
+	self.sse.close()
+
+	// Before the database is closed, for advisory locks. Stepping down
+	// first lets another replica take over at once.
+	self.leaderElection.stop()
+	self.locks.close()
+
+	// These only error if not running, which is fine here.
+	self.StopStatsSender()
+	self.syntheticChecks.Stop()
+	self.trafficRole.stop()
+	self.tunables.stop()
+	self.authKeys.stop()
+	self.tlsConfigs.stop()
+	self.remoteConfig.stop()
+
+	if err := self.auditLogger.close(); err != nil && first_err == nil {
+		first_err = fmt.Errorf("Error closing audit log: %s", err)
+	}
+
+	if err := self.closeKafka(); err != nil && first_err == nil {
+		first_err = err
+	}
+
+	if err := self.MessageBus().Close(); err != nil && first_err == nil {
+		first_err = fmt.Errorf("Error closing message bus: %s", err)
+	}
+
+	if err := self.Cache().Close(); err != nil && first_err == nil {
+		first_err = fmt.Errorf("Error closing cache: %s", err)
+	}
+
+	if self.httpClient != nil {
+		self.httpClient.CloseIdleConnections()
+	}
+	self.rateLimiters.close()
+	self.suppressions.close()
+
+	if self.dbReplica != nil {
+		self.dbReplica.stop()
+		if err := self.dbReplica.db.Close(); err != nil && first_err == nil {
+			first_err = fmt.Errorf("Error closing DB replica: %s", err)
+		}
+	}
+
+	if db := self.DB(); db != nil {
+		if err := db.Close(); err != nil && first_err == nil {
+			first_err = fmt.Errorf("Error closing DB: %s", err)
+		}
+	}
+
+	return first_err
+}
+
+// NewAppContext sets everything up from the environment. Errors are
+// *StartupError.
+func NewAppContext(app_name string, opts ...Option) (AppContext, error) {
+	appctx, err := newAppContext(app_name, opts...)
+	if err != nil {
+		// Stops whatever had already started, like the admin server
+		appctx.Close()
+		return nil, appctx.startupError(err)
+	}
+	return appctx, nil
+}
+
+// NewAppContextFromEnv is NewAppContext with settings from env rather than
+// the process environment, and without .env files unless opts has
+// WithDotEnv, so the result only depends on its arguments and any
+// APPCTX_CONFIG_FILE in env.
+func NewAppContextFromEnv(app_name string, env map[string]string, opts ...Option) (AppContext, error) {
+	return NewAppContext(app_name, append([]Option{WithEnv(env), WithDotEnv("")}, opts...)...)
+}
+
+// newEnvAppContext is the start of newAppContext: an app context that can
+// read settings, with nothing from the settings set up yet
+func newEnvAppContext(app_name string, opts ...Option) (*baseAppContext, error) {
 	appctx := &baseAppContext{
-		logger:          logger.DefaultStdoutCtxLogger(),
-		appName:         app_name,
-		rollbarEnabled:  false,
-		rollbarClient:   rollbar.NewNOOPClient(),
-		metricsEnabled:  false,
-		metricsClient:   metrics.NewNOOPClient(),
-		statsDoneChan:   make(chan bool),
-		statsSignalChan: make(chan bool),
+		logger:             logger.DefaultStdoutCtxLogger(),
+		appName:            app_name,
+		rollbarEnabled:     false,
+		rollbarClient:      rollbar.NewNOOPClient(),
+		metricsEnabled:     false,
+		metricsClient:      metrics.NewNOOPClient(),
+		kafkaProducer:      NewNOOPKafkaProducer(),
+		kafkaConsumerGroup: NewNOOPKafkaConsumerGroup(),
+		messageBus:         NewNOOPMessageBus(),
+		cache:              NewNOOPCache(),
+		clock:              NewRealClock(),
+		dotEnvDir:          ".",
+		objectStore:        NewNOOPObjectStore(),
+		admin:              &adminServer{name: "admin", mux: http.NewServeMux()},
+		debug:              &adminServer{name: "debug", mux: http.NewServeMux()},
+		initDurations:      make(map[string]time.Duration),
+		startedAt:          time.Now(),
+		statsDoneChan:      make(chan bool),
+		statsInterval:      time.Second,
+		statsSignalChan:    make(chan bool),
+	}
+	appctx.errorCodes = newErrorRegistry()
+	appctx.schemaRegistry = newSchemaRegistry()
+	appctx.health = newHealthRegistry(appctx.now)
+	appctx.circuitBreakers = newCircuitBreakerRegistry(appctx)
+	appctx.services = newServiceRegistry(appctx)
+	appctx.suppressions = newSuppressionList(appctx)
+	appctx.notifyTemplates = newNotificationTemplateCatalog(appctx)
+	appctx.templates = newTemplates(appctx)
+	appctx.localizer = newLocalizer(appctx)
+	appctx.auditLogger = newAuditLogger(appctx)
+	appctx.consumers = newConsumerControls(appctx)
+	appctx.scaling = newScalingSignals(appctx)
+	appctx.locks = newLockManager(appctx)
+	appctx.leaderElection = newLeaderElection(appctx)
+	appctx.datasets = newDatasetRegistry(appctx)
+	appctx.sampler = newDataSampler(appctx)
+	appctx.outbox = newOutbox(appctx)
+	appctx.golden = newGoldenSignals(appctx)
+	appctx.jobs = newJobQueue(appctx)
+	appctx.webSockets = newWebSocketHub(appctx)
+	appctx.sse = newSSEBroadcaster(appctx)
+	appctx.graphql = newGraphQLConfig()
+	appctx.openAPI = newOpenAPI(appctx)
+	appctx.sagas = &pgSagaStore{appctx: appctx}
+	appctx.checkpoints = newCheckpoints(appctx)
+	appctx.queryCache = newQueryCache(appctx)
+	appctx.matViews = newMatViewRegistry(appctx)
+	appctx.partitions = newPartitionManager(appctx)
+	appctx.remoteConfig = newRemoteConfig(appctx)
+	appctx.tlsConfigs = newTLSConfigs(appctx)
+
+	for _, opt := range opts {
+		opt(appctx)
 	}
 
-	appctx.tiltEnv = os.Getenv("TILT_ENVIRONMENT")
+	if err := appctx.loadDotEnv(); err != nil {
+		return appctx, fmt.Errorf("Error loading .env: %s", err)
+	}
+
+	appctx.tiltEnv = appctx.osGetenv("TILT_ENVIRONMENT")
 	if appctx.tiltEnv == "" {
 		appctx.tiltEnv = "development"
 	}
@@ -355,10 +865,10 @@ func NewAppContext(app_name string) (AppContext, error) {
 		appctx.tiltEnv != "testing" &&
 		appctx.tiltEnv != "staging" &&
 		appctx.tiltEnv != "production" {
-		return nil, fmt.Errorf("Unknown TILT_ENVIRONMENT: %s", appctx.tiltEnv)
+		return appctx, fmt.Errorf("Unknown TILT_ENVIRONMENT: %s", appctx.tiltEnv)
 	}
 
-	s3loc := os.Getenv("APPCTX_S3_CONFIG")
+	s3loc := appctx.osGetenv("APPCTX_S3_CONFIG")
 	if s3loc != "" {
 		locparts := strings.Split(s3loc, "::")
 		if len(locparts) != 3 {
@@ -371,50 +881,302 @@ func NewAppContext(app_name string) (AppContext, error) {
 		}
 	}
 
+	if err := appctx.timeInit("config", appctx.setConfigFromEnv); err != nil {
+		return appctx, fmt.Errorf("Error loading config: %s", err)
+	}
+
+	return appctx, nil
+}
+
+func newAppContext(app_name string, opts ...Option) (*baseAppContext, error) {
+	appctx, err := newEnvAppContext(app_name, opts...)
+	if err != nil {
+		return appctx, err
+	}
+
+	if err := appctx.timeInit("remote_config", appctx.setRemoteConfigFromEnv); err != nil {
+		return appctx, fmt.Errorf("Error loading remote config: %s", err)
+	}
+
+	if err := appctx.timeInit("profile", appctx.setProfileFromEnv); err != nil {
+		return appctx, fmt.Errorf("Error setting defaults profile: %s", err)
+	}
+
+	if err := appctx.timeInit("crypto", appctx.setCryptoFromEnv); err != nil {
+		return appctx, fmt.Errorf("Error setting crypto keys: %s", err)
+	}
+
+	if err := appctx.setLogRingFromEnv(); err != nil {
+		return appctx, fmt.Errorf("Error setting log ring: %s", err)
+	}
+
+	if err := appctx.timeInit("kubernetes", appctx.setKubernetesFromEnv); err != nil {
+		return appctx, fmt.Errorf("Error detecting kubernetes: %s", err)
+	}
+
+	if err := appctx.timeInit("logger", appctx.setLoggerFromEnv); err != nil {
+		return appctx, fmt.Errorf("Error setting logger: %s", err)
+	}
+
 	if host, err := os.Hostname(); err != nil {
-		return nil, fmt.Errorf("Couldn't figure out hostname: %s", err)
+		return appctx, fmt.Errorf("Couldn't figure out hostname: %s", err)
 	} else {
 		appctx.hostname = host
 	}
 
 	// Set this before we setup rollbarClient
-	appctx.codeVersion = os.Getenv("CODE_VERSION")
+	appctx.codeVersion = appctx.getEnv("CODE_VERSION")
 
-	appctx.jsonSchemaFilePath = os.Getenv("JSON_SCHEMA_FILEPATH")
-	appctx.baseExternalURL = os.Getenv("BASE_URL")
+	if err := appctx.setBuildInfoFromEnv(); err != nil {
+		return appctx, fmt.Errorf("Error reading build info: %s", err)
+	}
+
+	appctx.jsonSchemaFilePath = appctx.getEnv("JSON_SCHEMA_FILEPATH")
+	appctx.baseExternalURL = appctx.getEnv("BASE_URL")
+
+	if err := appctx.timeInit("json_schemas", appctx.setSchemaRegistryFromEnv); err != nil {
+		return appctx, fmt.Errorf("Error loading JSON schemas: %s", err)
+	}
+
+	if err := appctx.timeInit("field_propagation", appctx.setFieldPropagationFromEnv); err != nil {
+		return appctx, fmt.Errorf("Error setting field propagation: %s", err)
+	}
+
+	if err := appctx.setRequestIDHeaderFromEnv(); err != nil {
+		return appctx, fmt.Errorf("Error setting request ID header: %s", err)
+	}
+
+	if err := appctx.setRequestDeadlineFromEnv(); err != nil {
+		return appctx, fmt.Errorf("Error setting request deadlines: %s", err)
+	}
+
+	if err := appctx.setHTTPMiddlewareFromEnv(); err != nil {
+		return appctx, fmt.Errorf("Error setting HTTP middleware: %s", err)
+	}
+
+	if err := appctx.setIDsFromEnv(); err != nil {
+		return appctx, fmt.Errorf("Error setting ID generation: %s", err)
+	}
 
 	if err := appctx.setServicePortFromEnv(); err != nil {
-		return nil, fmt.Errorf("Error setting service port: %s", err)
+		return appctx, fmt.Errorf("Error setting service port: %s", err)
+	}
+
+	if err := appctx.optionalInit("metrics", appctx.setMetricsClientFromEnv, appctx.resetMetricsClient); err != nil {
+		return appctx, fmt.Errorf("Error setting metrics client: %s", err)
+	}
+
+	if err := appctx.setHTTPClientFromEnv(); err != nil {
+		return appctx, fmt.Errorf("Error setting HTTP client: %s", err)
+	}
+
+	if err := appctx.setRateLimitsFromEnv(); err != nil {
+		return appctx, fmt.Errorf("Error setting rate limits: %s", err)
+	}
+
+	if err := appctx.optionalInit("cache", appctx.setCacheFromEnv, appctx.resetCache); err != nil {
+		return appctx, fmt.Errorf("Error setting cache: %s", err)
+	}
+
+	if err := appctx.timeInit("object_store", appctx.setObjectStoreFromEnv); err != nil {
+		return appctx, fmt.Errorf("Error setting object store: %s", err)
+	}
+
+	if err := appctx.timeInit("suppressions", appctx.setSuppressionsFromEnv); err != nil {
+		return appctx, fmt.Errorf("Error setting suppressions: %s", err)
+	}
+
+	if err := appctx.timeInit("mailer", appctx.setMailerFromEnv); err != nil {
+		return appctx, fmt.Errorf("Error setting mailer: %s", err)
+	}
+
+	if err := appctx.optionalInit("auth_keys", appctx.setAuthKeysFromEnv, appctx.resetAuthKeys); err != nil {
+		return appctx, fmt.Errorf("Error setting auth keys: %s", err)
+	}
+
+	if err := appctx.timeInit("tunables", appctx.setTunablesFromEnv); err != nil {
+		return appctx, fmt.Errorf("Error setting tunables: %s", err)
+	}
+
+	if err := appctx.timeInit("admission", appctx.setAdmissionFromEnv); err != nil {
+		return appctx, fmt.Errorf("Error setting admission control: %s", err)
+	}
+
+	if err := appctx.timeInit("synthetic_checks", appctx.setSyntheticChecksFromEnv); err != nil {
+		return appctx, fmt.Errorf("Error setting synthetic checks: %s", err)
+	}
+
+	if err := appctx.optionalInit("rollbar", appctx.setRollbarClientFromEnv, appctx.resetRollbarClient); err != nil {
+		return appctx, fmt.Errorf("Error setting rollbar client: %s", err)
+	}
+
+	if err := appctx.timeInit("crash_reports", appctx.setCrashReportsFromEnv); err != nil {
+		return appctx, fmt.Errorf("Error setting crash reports: %s", err)
+	}
+
+	if err := appctx.timeInit("kafka", appctx.setKafkaFromEnv); err != nil {
+		return appctx, fmt.Errorf("Error setting kafka clients: %s", err)
+	}
+
+	if err := appctx.timeInit("audit", appctx.setAuditLoggerFromEnv); err != nil {
+		return appctx, fmt.Errorf("Error setting audit logger: %s", err)
+	}
+
+	if err := appctx.optionalInit("message_bus", appctx.setMessageBusFromEnv, appctx.resetMessageBus); err != nil {
+		return appctx, fmt.Errorf("Error setting message bus: %s", err)
+	}
+
+	if err := appctx.timeInit("traffic_role", appctx.setTrafficRoleFromEnv); err != nil {
+		return appctx, fmt.Errorf("Error setting traffic role: %s", err)
+	}
+
+	if err := appctx.timeInit("watchdog", appctx.setWatchdogFromEnv); err != nil {
+		return appctx, fmt.Errorf("Error setting watchdog: %s", err)
+	}
+
+	if err := appctx.timeInit("workers", appctx.setWorkersFromEnv); err != nil {
+		return appctx, fmt.Errorf("Error setting workers: %s", err)
+	}
+
+	if err := appctx.timeInit("scheduler", appctx.setSchedulerFromEnv); err != nil {
+		return appctx, fmt.Errorf("Error setting scheduler: %s", err)
+	}
+
+	if err := appctx.timeInit("checkpoints", appctx.setCheckpointsFromEnv); err != nil {
+		return appctx, fmt.Errorf("Error setting checkpoints: %s", err)
+	}
+
+	if err := appctx.timeInit("consumers", appctx.setConsumersFromEnv); err != nil {
+		return appctx, fmt.Errorf("Error loading paused consumers: %s", err)
+	}
+
+	if err := appctx.timeInit("scaling_signals", appctx.setScalingSignalsFromEnv); err != nil {
+		return appctx, fmt.Errorf("Error setting scaling signals: %s", err)
+	}
+
+	if err := appctx.timeInit("locks", appctx.setLocksFromEnv); err != nil {
+		return appctx, fmt.Errorf("Error setting locks: %s", err)
+	}
+
+	if err := appctx.timeInit("leader_election", appctx.setLeaderElectionFromEnv); err != nil {
+		return appctx, fmt.Errorf("Error setting leader election: %s", err)
+	}
+
+	if err := appctx.timeInit("datasets", appctx.setDatasetsFromEnv); err != nil {
+		return appctx, fmt.Errorf("Error setting datasets: %s", err)
+	}
+
+	if err := appctx.timeInit("data_sampler", appctx.setDataSamplerFromEnv); err != nil {
+		return appctx, fmt.Errorf("Error setting data sampler: %s", err)
+	}
+
+	if err := appctx.timeInit("outbox", appctx.setOutboxFromEnv); err != nil {
+		return appctx, fmt.Errorf("Error setting outbox: %s", err)
+	}
+
+	if err := appctx.timeInit("golden_signals", appctx.setGoldenSignalsFromEnv); err != nil {
+		return appctx, fmt.Errorf("Error setting golden signals: %s", err)
+	}
+
+	if err := appctx.timeInit("jobs", appctx.setJobsFromEnv); err != nil {
+		return appctx, fmt.Errorf("Error setting jobs: %s", err)
+	}
+
+	if err := appctx.timeInit("websockets", appctx.setWebSocketsFromEnv); err != nil {
+		return appctx, fmt.Errorf("Error setting WebSockets: %s", err)
+	}
+
+	if err := appctx.timeInit("sse", appctx.setSSEFromEnv); err != nil {
+		return appctx, fmt.Errorf("Error setting SSE: %s", err)
 	}
 
-	if err := appctx.setMetricsClientFromEnv(); err != nil {
-		return nil, fmt.Errorf("Error setting metrics client: %s", err)
+	if err := appctx.timeInit("graphql", appctx.setGraphQLFromEnv); err != nil {
+		return appctx, fmt.Errorf("Error setting GraphQL: %s", err)
 	}
 
-	if err := appctx.setRollbarClientFromEnv(); err != nil {
-		return nil, fmt.Errorf("Error setting rollbar client: %s", err)
+	if err := appctx.timeInit("openapi", appctx.setOpenAPIFromEnv); err != nil {
+		return appctx, fmt.Errorf("Error setting OpenAPI: %s", err)
 	}
 
 	if err := appctx.setDBMaxIdleConnsFromEnv(); err != nil {
-		return nil, fmt.Errorf("Error setting DB max idle connections: %s", err)
+		return appctx, fmt.Errorf("Error setting DB max idle connections: %s", err)
 	}
 
 	if err := appctx.setDBMaxOpenConnsFromEnv(); err != nil {
-		return nil, fmt.Errorf("Error setting DB max open connections: %s", err)
+		return appctx, fmt.Errorf("Error setting DB max open connections: %s", err)
 	}
 
-	if err := appctx.setDBFromEnv(); err != nil {
-		return nil, fmt.Errorf("Error setting DB object: %s", err)
+	if err := appctx.setTxMaxRetriesFromEnv(); err != nil {
+		return appctx, fmt.Errorf("Error setting DB transaction retries: %s", err)
 	}
 
+	if err := appctx.setDBSessionSettingsFromEnv(); err != nil {
+		return appctx, fmt.Errorf("Error setting DB session settings: %s", err)
+	}
+
+	if err := appctx.timeInit("db", appctx.setDBFromEnv); err != nil {
+		return appctx, fmt.Errorf("Error setting DB object: %s", err)
+	}
+
+	if err := appctx.timeInit("db_replica", appctx.setDBReplicaFromEnv); err != nil {
+		return appctx, fmt.Errorf("Error setting DB replica: %s", err)
+	}
+
+	if err := appctx.timeInit("templates", appctx.setTemplatesFromEnv); err != nil {
+		return appctx, fmt.Errorf("Error loading templates: %s", err)
+	}
+
+	if err := appctx.timeInit("localizer", appctx.setLocalizerFromEnv); err != nil {
+		return appctx, fmt.Errorf("Error loading translations: %s", err)
+	}
+
+	if err := appctx.timeInit("notification_templates", appctx.setNotificationTemplatesFromEnv); err != nil {
+		return appctx, fmt.Errorf("Error loading notification templates: %s", err)
+	}
+
+	if err := appctx.timeInit("cdc", appctx.setCDCFromEnv); err != nil {
+		return appctx, fmt.Errorf("Error setting CDC consumer: %s", err)
+	}
+
+	pools := []*sqlx.DB{}
 	if appctx.db != nil {
+		pools = append(pools, appctx.db)
+	}
+	if appctx.dbReplica != nil {
+		pools = append(pools, appctx.dbReplica.db)
+	}
+	for _, db := range pools {
 		if appctx.dbMaxIdleConns > 0 {
-			appctx.db.SetMaxIdleConns(appctx.dbMaxIdleConns)
+			db.SetMaxIdleConns(appctx.dbMaxIdleConns)
 		}
 		if appctx.dbMaxOpenConns > 0 {
-			appctx.db.SetMaxOpenConns(appctx.dbMaxOpenConns)
+			db.SetMaxOpenConns(appctx.dbMaxOpenConns)
 		}
 	}
 
+	if err := appctx.timeInit("migrations", appctx.runMigrationsFromEnv); err != nil {
+		return appctx, fmt.Errorf("Error running migrations: %s", err)
+	}
+
+	if err := appctx.timeInit("admin", appctx.setAdminServerFromEnv); err != nil {
+		return appctx, fmt.Errorf("Error starting admin server: %s", err)
+	}
+
+	if err := appctx.timeInit("debug", appctx.setDebugServerFromEnv); err != nil {
+		return appctx, fmt.Errorf("Error starting debug server: %s", err)
+	}
+
+	if err := appctx.timeInit("runtime_metrics", appctx.setRuntimeMetricsFromEnv); err != nil {
+		return appctx, fmt.Errorf("Error starting runtime metrics: %s", err)
+	}
+
+	if err := appctx.timeInit("lifecycle_metrics", appctx.setLifecycleMetricsFromEnv); err != nil {
+		return appctx, fmt.Errorf("Error starting lifecycle metrics: %s", err)
+	}
+
+	if err := appctx.optionalInit("service_discovery", appctx.setServiceDiscoveryFromEnv, appctx.resetServiceDiscovery); err != nil {
+		return appctx, fmt.Errorf("Error registering with service discovery: %s", err)
+	}
+
 	return appctx, nil
 }
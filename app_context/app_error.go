@@ -0,0 +1,120 @@
+package app_context
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// AppError is an error meant for API clients: Status, Code and Message are
+// what WriteHTTPError and HTTPMiddleware respond with. Err, the cause, is
+// only logged, or included in responses where HTTP_ERROR_DETAILS is on.
+// Without Status or Message, those registered for Code in ErrorCodes() are
+// used.
+type AppError struct {
+	Status  int
+	Code    string
+	Message string
+	Err     error
+}
+
+// NewAppError returns an AppError without a cause; use Wrap to add one
+func NewAppError(status int, code, message string) *AppError {
+	return &AppError{Status: status, Code: code, Message: message}
+}
+
+func (self *AppError) Error() string {
+	if self.Err != nil {
+		return fmt.Sprintf("%s: %s", self.Message, self.Err)
+	}
+	return self.Message
+}
+
+func (self *AppError) Unwrap() error {
+	return self.Err
+}
+
+// Wrap returns a copy of the error with err as the cause, so package level
+// AppErrors can be reused
+func (self *AppError) Wrap(err error) *AppError {
+	wrapped := *self
+	wrapped.Err = err
+	return &wrapped
+}
+
+var errInternal = &AppError{
+	Status:  http.StatusInternalServerError,
+	Code:    "internal_error",
+	Message: "Internal server error",
+}
+
+// panicError is a panic recovered by HTTPMiddleware. A panic with an
+// AppError still responds with it.
+type panicError struct {
+	method string
+	path   string
+	value  interface{}
+}
+
+func (self *panicError) Error() string {
+	return fmt.Sprintf("Panic handling %s %s: %v", self.method, self.path, self.value)
+}
+
+func (self *panicError) Unwrap() error {
+	err, _ := self.value.(error)
+	return err
+}
+
+type errorResponse struct {
+	Error errorBody     `json:"error"`
+	Meta  *responseMeta `json:"meta,omitempty"`
+}
+
+type errorBody struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	RequestID string `json:"request_id,omitempty"`
+	Detail    string `json:"detail,omitempty"`
+}
+
+// WriteHTTPError responds to r with err as JSON:
+//
+//	{"error": {"code": "not_found", "message": "...", "request_id": "..."},
+//	 "meta": {"request_id": "...", "code_version": "..."}}
+//
+// ErrorCodes() picks the status, code and message: from an AppError, an
+// error registered with RegisterError, or a 500 internal_error. Server
+// errors are logged and reported with the request. The error text is only
+// in the response with HTTP_ERROR_DETAILS=true, the default in development
+// and testing.
+func (self *baseAppContext) WriteHTTPError(w http.ResponseWriter, r *http.Request, err error) {
+	writeHTTPError(self, self.ForRequest(r), w, err)
+}
+
+func (self *childAppContext) WriteHTTPError(w http.ResponseWriter, r *http.Request, err error) {
+	writeHTTPError(self.baseAppContext, self.ForRequest(r), w, err)
+}
+
+func writeHTTPError(base *baseAppContext, reqctx RequestAppContext, w http.ResponseWriter, err error) {
+	app_err := base.errorCodes.AppError(err)
+	status := app_err.Status
+	if status < 400 || status > 599 {
+		status = http.StatusInternalServerError
+	}
+
+	if status >= 500 {
+		reqctx.ReportError(err, nil)
+	}
+
+	body := errorBody{
+		Code:      app_err.Code,
+		Message:   app_err.Message,
+		RequestID: reqctx.RequestID(),
+	}
+	if base.httpErrorDetails {
+		body.Detail = err.Error()
+	}
+
+	data, _ := json.Marshal(&errorResponse{Error: body, Meta: newResponseMeta(base, reqctx)})
+	writeEnvelope(reqctx.Request(), w, status, data)
+}
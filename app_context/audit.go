@@ -0,0 +1,232 @@
+package app_context
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/syslog"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+type AuditOutcome string
+
+const (
+	AuditSuccess AuditOutcome = "success"
+	AuditFailure AuditOutcome = "failure"
+	AuditDenied  AuditOutcome = "denied"
+)
+
+// AuditEvent is the fixed schema of audit events. Actor, Action, Resource
+// and Outcome are required; Log fills in Time, App, RequestID and Tenant.
+type AuditEvent struct {
+	Time      time.Time              `json:"time"`
+	App       string                 `json:"app"`
+	Actor     string                 `json:"actor"`
+	Action    string                 `json:"action"`
+	Resource  string                 `json:"resource"`
+	Outcome   AuditOutcome           `json:"outcome"`
+	RequestID string                 `json:"request_id,omitempty"`
+	Tenant    string                 `json:"tenant,omitempty"`
+	Details   map[string]interface{} `json:"details,omitempty"`
+}
+
+var ErrInvalidAuditEvent = errors.New("Audit events need an actor, action, resource and outcome")
+
+// AuditLogger writes audit events to their own output, separate from the
+// app's logs, chosen by AUDIT_OUTPUT. Log waits for the write, so a caller
+// can refuse to go ahead with an action it couldn't audit.
+type AuditLogger interface {
+	Log(ctx context.Context, event *AuditEvent) error
+}
+
+type auditSink interface {
+	name() string
+	write(ctx context.Context, event *AuditEvent, line []byte) error
+	close() error
+}
+
+type noopAuditSink struct{}
+
+func (noopAuditSink) name() string { return "noop" }
+
+func (noopAuditSink) write(ctx context.Context, event *AuditEvent, line []byte) error {
+	return nil
+}
+
+func (noopAuditSink) close() error { return nil }
+
+// fileAuditSink appends one JSON event per line
+type fileAuditSink struct {
+	lock sync.Mutex
+	file *os.File
+}
+
+func (self *fileAuditSink) name() string { return "file" }
+
+func (self *fileAuditSink) write(ctx context.Context, event *AuditEvent, line []byte) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	_, err := self.file.Write(append(line, '\n'))
+	return err
+}
+
+func (self *fileAuditSink) close() error {
+	return self.file.Close()
+}
+
+type syslogAuditSink struct {
+	writer *syslog.Writer
+}
+
+func (self *syslogAuditSink) name() string { return "syslog" }
+
+func (self *syslogAuditSink) write(ctx context.Context, event *AuditEvent, line []byte) error {
+	if event.Outcome == AuditSuccess {
+		return self.writer.Info(string(line))
+	}
+	return self.writer.Notice(string(line))
+}
+
+func (self *syslogAuditSink) close() error {
+	return self.writer.Close()
+}
+
+// kafkaAuditSink produces events keyed by actor, so each actor's events
+// stay in order
+type kafkaAuditSink struct {
+	appctx *baseAppContext
+	topic  string
+}
+
+func (self *kafkaAuditSink) name() string { return "kafka" }
+
+func (self *kafkaAuditSink) write(ctx context.Context, event *AuditEvent, line []byte) error {
+	return self.appctx.KafkaProducer().Produce(ctx, &KafkaMessage{
+		Topic: self.topic,
+		Key:   []byte(event.Actor),
+		Value: line,
+	})
+}
+
+func (self *kafkaAuditSink) close() error { return nil }
+
+type auditLogger struct {
+	appctx *baseAppContext
+	sink   auditSink
+	target string
+}
+
+func newAuditLogger(appctx *baseAppContext) *auditLogger {
+	return &auditLogger{appctx: appctx, sink: noopAuditSink{}}
+}
+
+func (self *auditLogger) Log(ctx context.Context, event *AuditEvent) error {
+	if event.Actor == "" || event.Action == "" || event.Resource == "" || event.Outcome == "" {
+		return ErrInvalidAuditEvent
+	}
+
+	e := *event
+	if e.Time.IsZero() {
+		e.Time = self.appctx.now().UTC()
+	}
+	e.App = self.appctx.appName
+	if e.RequestID == "" {
+		e.RequestID = RequestIDFromContext(ctx)
+	}
+	if e.Tenant == "" {
+		e.Tenant = TenantFromContext(ctx)
+	}
+
+	line, err := json.Marshal(&e)
+	if err != nil {
+		return fmt.Errorf("Error encoding audit event: %s", err)
+	}
+
+	mcli := self.appctx.MetricsClient()
+	tags := map[string]string{"action": e.Action, "outcome": string(e.Outcome)}
+	if err := self.sink.write(ctx, &e, line); err != nil {
+		mcli.Incr("audit.errors", 1.0, tags)
+		self.appctx.Logger().LogErrorf(ctx, "Error writing audit event '%s' by '%s': %s", e.Action, e.Actor, err)
+		return fmt.Errorf("Error writing audit event: %s", err)
+	}
+	mcli.Incr("audit.events", 1.0, tags)
+	return nil
+}
+
+func (self *auditLogger) close() error {
+	return self.sink.close()
+}
+
+func (self *auditLogger) status() map[string]interface{} {
+	return map[string]interface{}{
+		"output": self.sink.name(),
+		"target": self.target,
+	}
+}
+
+func (self *baseAppContext) AuditLogger() AuditLogger {
+	return self.auditLogger
+}
+
+// AUDIT_OUTPUT is where audit events go:
+//
+//	file    appended to AUDIT_FILE as JSON lines
+//	syslog  sent to AUDIT_SYSLOG_ADDR, eg. udp://host:514, or the local
+//	        syslog if unset, tagged AUDIT_SYSLOG_TAG (the app name)
+//	kafka   produced to AUDIT_KAFKA_TOPIC, which needs KAFKA_BROKERS
+//
+// Without it, audit events are dropped.
+func (self *baseAppContext) setAuditLoggerFromEnv() error {
+	output := self.getEnv("AUDIT_OUTPUT")
+	switch output {
+	case "":
+		return nil
+	case "file":
+		path := self.getEnv("AUDIT_FILE")
+		if path == "" {
+			return errors.New("AUDIT_FILE is required when AUDIT_OUTPUT is 'file'")
+		}
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return fmt.Errorf("Error opening AUDIT_FILE: %s", err)
+		}
+		self.auditLogger.sink = &fileAuditSink{file: file}
+		self.auditLogger.target = path
+	case "syslog":
+		var network, addr string
+		if addr_str := self.getEnv("AUDIT_SYSLOG_ADDR"); addr_str != "" {
+			u, err := url.Parse(addr_str)
+			if err != nil || (u.Scheme != "udp" && u.Scheme != "tcp") || u.Host == "" {
+				return fmt.Errorf("AUDIT_SYSLOG_ADDR must be udp://host:port or tcp://host:port, not '%s'", addr_str)
+			}
+			network, addr = u.Scheme, u.Host
+		}
+		tag := self.getEnv("AUDIT_SYSLOG_TAG")
+		if tag == "" {
+			tag = self.appName
+		}
+		writer, err := syslog.Dial(network, addr, syslog.LOG_AUTHPRIV|syslog.LOG_INFO, tag)
+		if err != nil {
+			return fmt.Errorf("Error connecting to syslog: %s", err)
+		}
+		self.auditLogger.sink = &syslogAuditSink{writer: writer}
+		self.auditLogger.target = addr
+	case "kafka":
+		topic := self.getEnv("AUDIT_KAFKA_TOPIC")
+		if topic == "" {
+			return errors.New("AUDIT_KAFKA_TOPIC is required when AUDIT_OUTPUT is 'kafka'")
+		}
+		if !self.kafkaEnabled {
+			return errors.New("AUDIT_OUTPUT 'kafka' needs KAFKA_BROKERS")
+		}
+		self.auditLogger.sink = &kafkaAuditSink{appctx: self, topic: topic}
+		self.auditLogger.target = topic
+	default:
+		return fmt.Errorf("Unknown AUDIT_OUTPUT: %s", output)
+	}
+	return nil
+}
@@ -0,0 +1,170 @@
+package app_context
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type recordingKafkaProducer struct {
+	testKafkaProducer
+	messages []*KafkaMessage
+}
+
+func (self *recordingKafkaProducer) Produce(ctx context.Context, msg *KafkaMessage) error {
+	self.messages = append(self.messages, msg)
+	return nil
+}
+
+func TestAuditLoggerFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	os.Setenv("AUDIT_OUTPUT", "file")
+	os.Setenv("AUDIT_FILE", path)
+	defer os.Unsetenv("AUDIT_OUTPUT")
+	defer os.Unsetenv("AUDIT_FILE")
+
+	app_ctx, err := NewAppContext("audit_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer app_ctx.Close()
+
+	mcli := newCountingMetricsClient()
+	app_ctx.SetMetricsClient(mcli)
+
+	ctx := WithRequestID(context.Background(), "req-1")
+	err = app_ctx.AuditLogger().Log(ctx, &AuditEvent{
+		Actor:    "user:42",
+		Action:   "invoice.refund",
+		Resource: "invoice:7",
+		Outcome:  AuditDenied,
+		Details:  map[string]interface{}{"amount": 10},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := app_ctx.AuditLogger().Log(ctx, &AuditEvent{Actor: "user:42", Action: "login"}); err != ErrInvalidAuditEvent {
+		t.Errorf("Expected ErrInvalidAuditEvent, got %v", err)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("Expected 1 event, got %q", data)
+	}
+	var event AuditEvent
+	if err := json.Unmarshal([]byte(lines[0]), &event); err != nil {
+		t.Fatal(err)
+	}
+	if event.App != "audit_test" || event.RequestID != "req-1" || event.Outcome != AuditDenied || event.Time.IsZero() || event.Details["amount"] != 10.0 {
+		t.Errorf("Unexpected event: %+v", event)
+	}
+	if mcli.count("audit.events") != 1 {
+		t.Errorf("Expected the event to be counted, got %v", mcli.counts)
+	}
+}
+
+func TestAuditLoggerSyslog(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	os.Setenv("AUDIT_OUTPUT", "syslog")
+	os.Setenv("AUDIT_SYSLOG_ADDR", "udp://"+conn.LocalAddr().String())
+	defer os.Unsetenv("AUDIT_OUTPUT")
+	defer os.Unsetenv("AUDIT_SYSLOG_ADDR")
+
+	app_ctx, err := NewAppContext("audit_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer app_ctx.Close()
+
+	err = app_ctx.AuditLogger().Log(context.Background(), &AuditEvent{
+		Actor:    "admin",
+		Action:   "user.delete",
+		Resource: "user:1",
+		Outcome:  AuditSuccess,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 4096)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// authpriv.info is 10*8+6
+	msg := string(buf[:n])
+	if !strings.HasPrefix(msg, "<86>") || !strings.Contains(msg, "audit_test") || !strings.Contains(msg, `"action":"user.delete"`) {
+		t.Errorf("Unexpected syslog message: %s", msg)
+	}
+}
+
+func TestAuditLoggerKafka(t *testing.T) {
+	os.Setenv("KAFKA_BROKERS", "k1:9092")
+	os.Setenv("KAFKA_DRIVER", "kafka_test")
+	os.Setenv("AUDIT_OUTPUT", "kafka")
+	defer os.Unsetenv("KAFKA_BROKERS")
+	defer os.Unsetenv("KAFKA_DRIVER")
+	defer os.Unsetenv("AUDIT_OUTPUT")
+
+	if _, err := NewAppContext("audit_test"); err == nil {
+		t.Error("Expected an error without AUDIT_KAFKA_TOPIC")
+	}
+
+	os.Setenv("AUDIT_KAFKA_TOPIC", "audit")
+	defer os.Unsetenv("AUDIT_KAFKA_TOPIC")
+
+	app_ctx, err := NewAppContext("audit_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer app_ctx.Close()
+
+	producer := &recordingKafkaProducer{}
+	app_ctx.(*baseAppContext).kafkaProducer = producer
+
+	err = app_ctx.AuditLogger().Log(context.Background(), &AuditEvent{
+		Actor:    "svc:billing",
+		Action:   "plan.change",
+		Resource: "account:3",
+		Outcome:  AuditFailure,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(producer.messages) != 1 || producer.messages[0].Topic != "audit" || string(producer.messages[0].Key) != "svc:billing" {
+		t.Errorf("Unexpected messages: %+v", producer.messages)
+	}
+}
+
+func TestAuditLoggerFromEnv(t *testing.T) {
+	os.Setenv("AUDIT_OUTPUT", "splunk")
+	defer os.Unsetenv("AUDIT_OUTPUT")
+
+	if _, err := NewAppContext("audit_test"); err == nil {
+		t.Error("Expected an error for an unknown AUDIT_OUTPUT")
+	}
+
+	os.Setenv("AUDIT_OUTPUT", "kafka")
+	os.Setenv("AUDIT_KAFKA_TOPIC", "audit")
+	defer os.Unsetenv("AUDIT_KAFKA_TOPIC")
+	if _, err := NewAppContext("audit_test"); err == nil {
+		t.Error("Expected an error for kafka without KAFKA_BROKERS")
+	}
+}
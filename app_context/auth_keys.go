@@ -0,0 +1,752 @@
+package app_context
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	crypto_rand "crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrNoSigningKey is returned by Sign without JWT_PRIVATE_KEY_PATH
+	ErrNoSigningKey = errors.New("No JWT signing key configured")
+	// ErrTokenExpired is returned by Verify for a token past its exp
+	ErrTokenExpired = errors.New("Token has expired")
+)
+
+// jwtLeeway allows for clock skew between the signer and verifier
+const jwtLeeway = 30 * time.Second
+
+// jwksMinRefresh limits refreshes triggered by tokens with an unknown kid
+const jwksMinRefresh = time.Minute
+
+// JWK is a public key in a JWKS document. Only RSA and EC keys are
+// supported.
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid,omitempty"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// AuthKeys signs and verifies JWTs. Only asymmetric algorithms are
+// accepted (RS256, ES256, ES384 and ES512), picked from the key, so there's
+// no "none" or HMAC confusion to get wrong.
+type AuthKeys interface {
+	// Sign returns a JWT for claims signed with the private key. iss
+	// (JWT_ISSUER), iat and exp (JWT_TTL from now) are added unless
+	// claims has them.
+	Sign(claims map[string]interface{}) (string, error)
+	// Verify checks token's signature, exp (which it must have) and nbf,
+	// and iss and aud if JWT_ISSUER and JWT_AUDIENCE are set, and returns
+	// its claims.
+	Verify(token string) (map[string]interface{}, error)
+	// JWKS is the public half of the signing key and JWT_PUBLIC_KEY_PATHS,
+	// for serving to other services at eg. /.well-known/jwks.json
+	JWKS() *JWKS
+	// Refresh reloads JWKS_URL now
+	Refresh(ctx context.Context) error
+}
+
+type verifyKey struct {
+	kid string
+	alg string
+	key crypto.PublicKey
+}
+
+type authKeys struct {
+	appctx   *baseAppContext
+	lock     sync.RWMutex
+	signer   crypto.Signer
+	signKey  *verifyKey
+	local    []*verifyKey
+	remote   []*verifyKey
+	issuer   string
+	audience string
+	ttl      time.Duration
+	jwksURL  string
+	interval time.Duration
+	// Refreshes that succeeded and the last error, for Introspect
+	refreshes   int
+	lastRefresh time.Time
+	lastError   string
+	// refreshing is closed when the refresh in progress, if any, finishes
+	refreshing chan struct{}
+	stopChan   chan struct{}
+	doneChan   chan struct{}
+}
+
+var b64 = base64.RawURLEncoding
+
+// keyAlg is the JWS algorithm for key, which is the only one tokens using
+// it may claim
+func keyAlg(key crypto.PublicKey) (string, error) {
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		return "RS256", nil
+	case *ecdsa.PublicKey:
+		switch k.Curve {
+		case elliptic.P256():
+			return "ES256", nil
+		case elliptic.P384():
+			return "ES384", nil
+		case elliptic.P521():
+			return "ES512", nil
+		}
+		return "", fmt.Errorf("Unsupported curve %s", k.Curve.Params().Name)
+	}
+	return "", fmt.Errorf("Unsupported key type %T", key)
+}
+
+func algHash(alg string) hash.Hash {
+	switch alg {
+	case "ES384":
+		return sha512.New384()
+	case "ES512":
+		return sha512.New()
+	}
+	return sha256.New()
+}
+
+// ecSize is how many bytes each of r and s take in an ES signature
+func ecSize(curve elliptic.Curve) int {
+	return (curve.Params().BitSize + 7) / 8
+}
+
+func keyToJWK(kid string, key crypto.PublicKey) JWK {
+	alg, _ := keyAlg(key)
+	jwk := JWK{Kid: kid, Use: "sig", Alg: alg}
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		jwk.Kty = "RSA"
+		jwk.N = b64.EncodeToString(k.N.Bytes())
+		jwk.E = b64.EncodeToString(big.NewInt(int64(k.E)).Bytes())
+	case *ecdsa.PublicKey:
+		size := ecSize(k.Curve)
+		jwk.Kty = "EC"
+		jwk.Crv = k.Curve.Params().Name
+		jwk.X = b64.EncodeToString(k.X.FillBytes(make([]byte, size)))
+		jwk.Y = b64.EncodeToString(k.Y.FillBytes(make([]byte, size)))
+	}
+	return jwk
+}
+
+// thumbprint is RFC 7638's key ID: a hash of the required members only,
+// in lexical order
+func thumbprint(key crypto.PublicKey) string {
+	jwk := keyToJWK("", key)
+	var doc string
+	switch jwk.Kty {
+	case "RSA":
+		doc = fmt.Sprintf(`{"e":"%s","kty":"RSA","n":"%s"}`, jwk.E, jwk.N)
+	case "EC":
+		doc = fmt.Sprintf(`{"crv":"%s","kty":"EC","x":"%s","y":"%s"}`, jwk.Crv, jwk.X, jwk.Y)
+	}
+	sum := sha256.Sum256([]byte(doc))
+	return b64.EncodeToString(sum[:])
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := b64.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+func jwkToKey(jwk JWK) (crypto.PublicKey, error) {
+	switch jwk.Kty {
+	case "RSA":
+		n, err := decodeBigInt(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("Unsupported curve '%s'", jwk.Crv)
+		}
+		x, err := decodeBigInt(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("Point isn't on the curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("Unsupported key type '%s'", jwk.Kty)
+}
+
+// minRSAKeyBits is the smallest RSA key that's accepted, to sign or verify
+const minRSAKeyBits = 2048
+
+func newVerifyKey(kid string, key crypto.PublicKey) (*verifyKey, error) {
+	alg, err := keyAlg(key)
+	if err != nil {
+		return nil, err
+	}
+	if k, ok := key.(*rsa.PublicKey); ok && k.N.BitLen() < minRSAKeyBits {
+		return nil, fmt.Errorf("RSA key is %d bits, less than %d", k.N.BitLen(), minRSAKeyBits)
+	}
+	if kid == "" {
+		kid = thumbprint(key)
+	}
+	return &verifyKey{kid: kid, alg: alg, key: key}, nil
+}
+
+func parsePrivateKeyPEM(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("No PEM data found")
+	}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		if signer, ok := key.(crypto.Signer); ok {
+			return signer, nil
+		}
+		return nil, fmt.Errorf("Unsupported private key type %T", key)
+	}
+	return nil, fmt.Errorf("Unsupported PEM block '%s'", block.Type)
+}
+
+func parsePublicKeyPEM(data []byte) (crypto.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("No PEM data found")
+	}
+	switch block.Type {
+	case "PUBLIC KEY":
+		return x509.ParsePKIXPublicKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	case "CERTIFICATE":
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return cert.PublicKey, nil
+	}
+	return nil, fmt.Errorf("Unsupported PEM block '%s'", block.Type)
+}
+
+func (self *authKeys) Sign(claims map[string]interface{}) (string, error) {
+	if self.signer == nil {
+		return "", ErrNoSigningKey
+	}
+
+	now := self.appctx.Clock().Now()
+	payload := make(map[string]interface{}, len(claims)+3)
+	if self.issuer != "" {
+		payload["iss"] = self.issuer
+	}
+	payload["iat"] = now.Unix()
+	payload["exp"] = now.Add(self.ttl).Unix()
+	for k, v := range claims {
+		payload[k] = v
+	}
+	return self.sign(payload)
+}
+
+// sign encodes and signs payload as it is
+func (self *authKeys) sign(payload map[string]interface{}) (string, error) {
+	header, err := json.Marshal(map[string]string{
+		"alg": self.signKey.alg,
+		"kid": self.signKey.kid,
+		"typ": "JWT",
+	})
+	if err != nil {
+		return "", err
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return "", fmt.Errorf("Error encoding claims: %s", err)
+	}
+
+	signing_input := b64.EncodeToString(header) + "." + b64.EncodeToString(body)
+	h := algHash(self.signKey.alg)
+	h.Write([]byte(signing_input))
+	digest := h.Sum(nil)
+
+	var sig []byte
+	switch key := self.signer.(type) {
+	case *rsa.PrivateKey:
+		sig, err = rsa.SignPKCS1v15(crypto_rand.Reader, key, crypto.SHA256, digest)
+	case *ecdsa.PrivateKey:
+		var r, s *big.Int
+		if r, s, err = ecdsa.Sign(crypto_rand.Reader, key, digest); err == nil {
+			size := ecSize(key.Curve)
+			sig = make([]byte, 2*size)
+			r.FillBytes(sig[:size])
+			s.FillBytes(sig[size:])
+		}
+	default:
+		err = fmt.Errorf("Unsupported signing key type %T", self.signer)
+	}
+	if err != nil {
+		return "", fmt.Errorf("Error signing token: %s", err)
+	}
+
+	return signing_input + "." + b64.EncodeToString(sig), nil
+}
+
+func verifySignature(key *verifyKey, signing_input string, sig []byte) bool {
+	h := algHash(key.alg)
+	h.Write([]byte(signing_input))
+	digest := h.Sum(nil)
+
+	switch k := key.key.(type) {
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(k, crypto.SHA256, digest, sig) == nil
+	case *ecdsa.PublicKey:
+		size := ecSize(k.Curve)
+		if len(sig) != 2*size {
+			return false
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		return ecdsa.Verify(k, digest, r, s)
+	}
+	return false
+}
+
+// candidates are the keys a token with kid and alg could be signed with
+func (self *authKeys) candidates(kid, alg string) []*verifyKey {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+
+	var keys []*verifyKey
+	for _, set := range [][]*verifyKey{self.local, self.remote} {
+		for _, key := range set {
+			if key.alg == alg && (kid == "" || key.kid == kid) {
+				keys = append(keys, key)
+			}
+		}
+	}
+	return keys
+}
+
+func invalidToken(reason string) error {
+	return errors.New("Invalid token: " + reason)
+}
+
+func numericClaim(claims map[string]interface{}, name string) (time.Time, bool, error) {
+	v, ok := claims[name]
+	if !ok {
+		return time.Time{}, false, nil
+	}
+	n, ok := v.(float64)
+	if !ok {
+		return time.Time{}, false, invalidToken(name + " isn't a number")
+	}
+	return time.Unix(int64(n), 0), true, nil
+}
+
+func hasAudience(claims map[string]interface{}, audience string) bool {
+	switch aud := claims["aud"].(type) {
+	case string:
+		return aud == audience
+	case []interface{}:
+		for _, a := range aud {
+			if a == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (self *authKeys) Verify(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, invalidToken("expected 3 parts")
+	}
+
+	header_json, err := b64.DecodeString(parts[0])
+	if err != nil {
+		return nil, invalidToken("bad header encoding")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := json.Unmarshal(header_json, &header); err != nil {
+		return nil, invalidToken("bad header")
+	}
+	sig, err := b64.DecodeString(parts[2])
+	if err != nil {
+		return nil, invalidToken("bad signature encoding")
+	}
+
+	keys := self.candidates(header.Kid, header.Alg)
+	if len(keys) == 0 && header.Kid != "" && self.jwksURL != "" {
+		// The issuer may have rotated its keys since the last refresh
+		if self.refreshIfStale(jwksMinRefresh) {
+			keys = self.candidates(header.Kid, header.Alg)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, invalidToken(fmt.Sprintf("no %s key with kid '%s'", header.Alg, header.Kid))
+	}
+
+	verified := false
+	for _, key := range keys {
+		if verifySignature(key, parts[0]+"."+parts[1], sig) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, invalidToken("bad signature")
+	}
+
+	body, err := b64.DecodeString(parts[1])
+	if err != nil {
+		return nil, invalidToken("bad payload encoding")
+	}
+	var claims map[string]interface{}
+	if err := json.Unmarshal(body, &claims); err != nil {
+		return nil, invalidToken("bad payload")
+	}
+
+	now := self.appctx.Clock().Now()
+	if exp, found, err := numericClaim(claims, "exp"); err != nil {
+		return nil, err
+	} else if !found {
+		// Sign always sets it, and a token without one never expires
+		return nil, invalidToken("no exp")
+	} else if now.After(exp.Add(jwtLeeway)) {
+		return nil, ErrTokenExpired
+	}
+	if nbf, found, err := numericClaim(claims, "nbf"); err != nil {
+		return nil, err
+	} else if found && now.Add(jwtLeeway).Before(nbf) {
+		return nil, invalidToken("not valid yet")
+	}
+	if self.issuer != "" && claims["iss"] != self.issuer {
+		return nil, invalidToken(fmt.Sprintf("issuer '%v' isn't '%s'", claims["iss"], self.issuer))
+	}
+	if self.audience != "" && !hasAudience(claims, self.audience) {
+		return nil, invalidToken(fmt.Sprintf("audience isn't '%s'", self.audience))
+	}
+
+	return claims, nil
+}
+
+func (self *authKeys) JWKS() *JWKS {
+	jwks := &JWKS{Keys: make([]JWK, 0, len(self.local))}
+	for _, key := range self.local {
+		jwks.Keys = append(jwks.Keys, keyToJWK(key.kid, key.key))
+	}
+	return jwks
+}
+
+func (self *authKeys) fetchJWKS(ctx context.Context) ([]*verifyKey, error) {
+	req, err := http.NewRequest("GET", self.jwksURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := self.appctx.HTTPClient().Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Got status %d", resp.StatusCode)
+	}
+
+	var jwks JWKS
+	if err := json.NewDecoder(resp.Body).Decode(&jwks); err != nil {
+		return nil, fmt.Errorf("Error decoding JWKS: %s", err)
+	}
+
+	keys := make([]*verifyKey, 0, len(jwks.Keys))
+	for _, jwk := range jwks.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		pub, err := jwkToKey(jwk)
+		if err == nil {
+			var key *verifyKey
+			if key, err = newVerifyKey(jwk.Kid, pub); err == nil {
+				// Tokens can only claim the alg the key is for, so one
+				// declared for another alg is never used
+				if jwk.Alg == "" || jwk.Alg == key.alg {
+					keys = append(keys, key)
+					continue
+				}
+				err = fmt.Errorf("alg '%s' isn't supported for it, only %s", jwk.Alg, key.alg)
+			}
+		}
+		// One key we can't use shouldn't stop the others working
+		self.appctx.Logger().LogWarnf(ctx, "Skipping JWKS key '%s': %s", jwk.Kid, err)
+	}
+	return keys, nil
+}
+
+func (self *authKeys) Refresh(ctx context.Context) error {
+	if self.jwksURL == "" {
+		return nil
+	}
+
+	keys, err := self.fetchJWKS(ctx)
+
+	self.lock.Lock()
+	self.lastRefresh = self.appctx.Clock().Now()
+	if err != nil {
+		self.lastError = err.Error()
+	} else {
+		self.remote = keys
+		self.refreshes++
+		self.lastError = ""
+	}
+	self.lock.Unlock()
+
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	self.appctx.MetricsClient().Incr("auth_keys.jwks_refresh", 1.0, map[string]string{"result": result})
+
+	if err != nil {
+		return fmt.Errorf("Error fetching %s: %s", self.jwksURL, err)
+	}
+	return nil
+}
+
+// refreshIfStale refreshes if the last attempt was at least min ago,
+// returning whether it did. Callers that find a refresh in progress wait
+// for it rather than each fetching JWKS_URL.
+func (self *authKeys) refreshIfStale(min time.Duration) bool {
+	self.lock.Lock()
+	if done := self.refreshing; done != nil {
+		self.lock.Unlock()
+		<-done
+		return true
+	}
+	now := self.appctx.Clock().Now()
+	if now.Sub(self.lastRefresh) < min {
+		self.lock.Unlock()
+		return false
+	}
+	done := make(chan struct{})
+	self.refreshing = done
+	self.lastRefresh = now
+	self.lock.Unlock()
+
+	err := self.Refresh(context.Background())
+
+	self.lock.Lock()
+	self.refreshing = nil
+	self.lock.Unlock()
+	close(done)
+
+	if err != nil {
+		self.appctx.Logger().LogWarnf(context.Background(), "%s", err)
+	}
+	return true
+}
+
+func (self *authKeys) start() {
+	self.stopChan = make(chan struct{})
+	self.doneChan = make(chan struct{})
+
+	goLabeled("auth_keys", func() {
+		defer close(self.doneChan)
+
+		ticker := self.appctx.Clock().NewTicker(self.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-self.stopChan:
+				return
+			case <-ticker.C():
+				// Keep the current keys until JWKS_URL is back
+				self.refreshIfStale(0)
+			}
+		}
+	})
+}
+
+func (self *authKeys) stop() {
+	if self == nil || self.stopChan == nil {
+		return
+	}
+	close(self.stopChan)
+	<-self.doneChan
+	self.stopChan = nil
+}
+
+func (self *authKeys) status() map[string]interface{} {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	status := map[string]interface{}{
+		"signing":     self.signer != nil,
+		"local_keys":  len(self.local),
+		"remote_keys": len(self.remote),
+	}
+	if self.jwksURL != "" {
+		status["refreshes"] = self.refreshes
+		status["last_refresh"] = self.lastRefresh
+		status["last_error"] = self.lastError
+	}
+	return status
+}
+
+func (self *baseAppContext) AuthKeys() AuthKeys {
+	return self.authKeys
+}
+
+// readKeySetting is the PEM in <name> or, failing that, the file named by
+// <name>_PATH
+func (self *baseAppContext) readKeySetting(name string) ([]byte, error) {
+	if pem_data := self.getEnv(name); pem_data != "" {
+		return []byte(pem_data), nil
+	}
+	if path := self.getEnv(name + "_PATH"); path != "" {
+		return ioutil.ReadFile(path)
+	}
+	return nil, nil
+}
+
+func (self *baseAppContext) resetAuthKeys() {
+	self.authKeys.stop()
+	self.authKeys = &authKeys{appctx: self, ttl: time.Hour}
+}
+
+// JWT_PRIVATE_KEY_PATH (or JWT_PRIVATE_KEY, the PEM itself, which can be
+// encrypted) is the key Sign uses, with JWT_KEY_ID as its kid (RFC 7638's
+// thumbprint by default). Verify trusts it, the PEM public keys or
+// certificates in the comma separated JWT_PUBLIC_KEY_PATHS, and the keys
+// at JWKS_URL, refreshed every JWKS_REFRESH_INTERVAL (default 15m) or
+// sooner for a token with a kid it doesn't know. JWT_ISSUER and
+// JWT_AUDIENCE are checked if set; JWT_TTL (default 1h) is how long signed
+// tokens are valid.
+func (self *baseAppContext) setAuthKeysFromEnv() error {
+	keys := &authKeys{
+		appctx:   self,
+		issuer:   self.getEnv("JWT_ISSUER"),
+		audience: self.getEnv("JWT_AUDIENCE"),
+		ttl:      time.Hour,
+		jwksURL:  self.getEnv("JWKS_URL"),
+		interval: 15 * time.Minute,
+	}
+	self.authKeys = keys
+
+	if ttl, found, err := self.getDurationFromEnv("JWT_TTL"); err != nil {
+		return err
+	} else if found {
+		if ttl <= 0 {
+			return errors.New("JWT_TTL must be > 0")
+		}
+		keys.ttl = ttl
+	}
+
+	pem_data, err := self.readKeySetting("JWT_PRIVATE_KEY")
+	if err != nil {
+		return fmt.Errorf("Error reading JWT private key: %s", err)
+	}
+	if pem_data != nil {
+		signer, err := parsePrivateKeyPEM(pem_data)
+		if err != nil {
+			return fmt.Errorf("Error parsing JWT private key: %s", err)
+		}
+		sign_key, err := newVerifyKey(self.getEnv("JWT_KEY_ID"), signer.Public())
+		if err != nil {
+			return fmt.Errorf("Error parsing JWT private key: %s", err)
+		}
+		keys.signer = signer
+		keys.signKey = sign_key
+		keys.local = append(keys.local, sign_key)
+	}
+
+	for _, path := range strings.Split(self.getEnv("JWT_PUBLIC_KEY_PATHS"), ",") {
+		if path = strings.TrimSpace(path); path == "" {
+			continue
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("Error reading JWT public key: %s", err)
+		}
+		pub, err := parsePublicKeyPEM(data)
+		if err != nil {
+			return fmt.Errorf("Error parsing JWT public key %s: %s", path, err)
+		}
+		key, err := newVerifyKey("", pub)
+		if err != nil {
+			return fmt.Errorf("Error parsing JWT public key %s: %s", path, err)
+		}
+		keys.local = append(keys.local, key)
+	}
+
+	if keys.jwksURL == "" {
+		return nil
+	}
+
+	if interval, found, err := self.getDurationFromEnv("JWKS_REFRESH_INTERVAL"); err != nil {
+		return err
+	} else if found {
+		if interval <= 0 {
+			return errors.New("JWKS_REFRESH_INTERVAL must be > 0")
+		}
+		keys.interval = interval
+	}
+
+	if err := keys.Refresh(context.Background()); err != nil {
+		return err
+	}
+	keys.start()
+
+	return nil
+}
@@ -0,0 +1,251 @@
+package app_context
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	crypto_rand "crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAuthKeysSignVerify(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), crypto_rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "jwt.pem")
+	if err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	os.Setenv("JWT_PRIVATE_KEY_PATH", path)
+	os.Setenv("JWT_ISSUER", "auth_keys_test")
+	os.Setenv("JWT_AUDIENCE", "api")
+	defer os.Unsetenv("JWT_PRIVATE_KEY_PATH")
+	defer os.Unsetenv("JWT_ISSUER")
+	defer os.Unsetenv("JWT_AUDIENCE")
+
+	clock := NewFakeClock(time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC))
+	app_ctx, err := NewAppContext("auth_keys_test", WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app_ctx.Close()
+
+	keys := app_ctx.AuthKeys()
+	token, err := keys.Sign(map[string]interface{}{"sub": "user1", "aud": "api"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims, err := keys.Verify(token)
+	if err != nil {
+		t.Fatalf("Verify failed: %s", err)
+	}
+	if claims["sub"] != "user1" || claims["iss"] != "auth_keys_test" {
+		t.Errorf("Unexpected claims: %+v", claims)
+	}
+
+	parts := strings.Split(token, ".")
+	other, _ := keys.Sign(map[string]interface{}{"sub": "admin", "aud": "api"})
+	forged := parts[0] + "." + strings.Split(other, ".")[1] + "." + parts[2]
+	if _, err := keys.Verify(forged); err == nil {
+		t.Error("Verify accepted a token with a swapped payload")
+	}
+
+	none := b64.EncodeToString([]byte(`{"alg":"none"}`)) + "." + parts[1] + "."
+	if _, err := keys.Verify(none); err == nil {
+		t.Error("Verify accepted alg none")
+	}
+
+	wrong_aud, _ := keys.Sign(map[string]interface{}{"aud": "other"})
+	if _, err := keys.Verify(wrong_aud); err == nil {
+		t.Error("Verify accepted the wrong audience")
+	}
+
+	no_exp, err := keys.(*authKeys).sign(map[string]interface{}{"sub": "user1", "aud": "api", "iss": "auth_keys_test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := keys.Verify(no_exp); err == nil || !strings.Contains(err.Error(), "no exp") {
+		t.Errorf("Expected a token without exp to be refused, got %v", err)
+	}
+
+	clock.Advance(2 * time.Hour)
+	if _, err := keys.Verify(token); err != ErrTokenExpired {
+		t.Errorf("Expected ErrTokenExpired, got %v", err)
+	}
+
+	jwks := keys.JWKS()
+	if len(jwks.Keys) != 1 || jwks.Keys[0].Alg != "ES256" || jwks.Keys[0].Kid != thumbprint(&key.PublicKey) {
+		t.Errorf("Unexpected JWKS: %+v", jwks)
+	}
+}
+
+func TestAuthKeysSmallRSAKey(t *testing.T) {
+	key, err := rsa.GenerateKey(crypto_rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newVerifyKey("small", &key.PublicKey); err == nil {
+		t.Error("Expected a 1024 bit RSA key to be refused")
+	}
+}
+
+func TestAuthKeysUnconfigured(t *testing.T) {
+	app_ctx, err := NewAppContext("auth_keys_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app_ctx.Close()
+
+	if _, err := app_ctx.AuthKeys().Sign(nil); err != ErrNoSigningKey {
+		t.Errorf("Expected ErrNoSigningKey, got %v", err)
+	}
+	if _, err := app_ctx.AuthKeys().Verify("a.b.c"); err == nil {
+		t.Error("Verify without keys should fail")
+	}
+}
+
+type fakeJWKS struct {
+	lock     sync.Mutex
+	jwks     JWKS
+	requests int
+	// delay slows each response
+	delay time.Duration
+}
+
+func (self *fakeJWKS) set(keys ...JWK) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.jwks = JWKS{Keys: keys}
+}
+
+func (self *fakeJWKS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.requests++
+	time.Sleep(self.delay)
+	json.NewEncoder(w).Encode(self.jwks)
+}
+
+func TestAuthKeysJWKS(t *testing.T) {
+	first, err := rsa.GenerateKey(crypto_rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := rsa.GenerateKey(crypto_rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jwks := &fakeJWKS{}
+	jwks.set(keyToJWK("first", &first.PublicKey))
+	srv := httptest.NewServer(jwks)
+	defer srv.Close()
+
+	os.Setenv("JWKS_URL", srv.URL)
+	os.Setenv("JWKS_REFRESH_INTERVAL", "1h")
+	defer os.Unsetenv("JWKS_URL")
+	defer os.Unsetenv("JWKS_REFRESH_INTERVAL")
+
+	clock := NewFakeClock(time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC))
+	app_ctx, err := NewAppContext("auth_keys_test", WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app_ctx.Close()
+
+	// An issuer with each key, as another service would have
+	issuer := func(kid string, key *rsa.PrivateKey) *authKeys {
+		vk, err := newVerifyKey(kid, &key.PublicKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &authKeys{appctx: app_ctx.(*baseAppContext), signer: key, signKey: vk, ttl: time.Hour}
+	}
+
+	token, err := issuer("first", first).Sign(map[string]interface{}{"sub": "user1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := app_ctx.AuthKeys().Verify(token); err != nil {
+		t.Fatalf("Verify with the JWKS key failed: %s", err)
+	}
+
+	// The issuer rotates; a token with the new kid triggers a refresh,
+	// but not more than once a minute
+	jwks.set(keyToJWK("second", &second.PublicKey))
+	rotated, _ := issuer("second", second).Sign(map[string]interface{}{"sub": "user1"})
+	if _, err := app_ctx.AuthKeys().Verify(rotated); err == nil {
+		t.Error("Expected the unknown kid to fail straight after a refresh")
+	}
+
+	clock.Advance(2 * time.Minute)
+	if _, err := app_ctx.AuthKeys().Verify(rotated); err != nil {
+		t.Errorf("Expected the refreshed JWKS to verify the new key: %s", err)
+	}
+	if _, err := app_ctx.AuthKeys().Verify(token); err == nil {
+		t.Error("The removed key still verifies")
+	}
+
+	if err := app_ctx.AuthKeys().Refresh(context.Background()); err != nil {
+		t.Error(err)
+	}
+	if jwks.requests != 3 {
+		t.Errorf("Expected 3 JWKS requests, got %d", jwks.requests)
+	}
+
+	// Requests that find the keys stale at once share one refresh
+	third, err := rsa.GenerateKey(crypto_rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwks.set(keyToJWK("third", &third.PublicKey))
+	jwks.lock.Lock()
+	jwks.requests, jwks.delay = 0, 50*time.Millisecond
+	jwks.lock.Unlock()
+	clock.Advance(2 * time.Minute)
+
+	token, _ = issuer("third", third).Sign(map[string]interface{}{"sub": "user1"})
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := app_ctx.AuthKeys().Verify(token); err != nil {
+				t.Errorf("Verify while refreshing failed: %s", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if jwks.requests != 1 {
+		t.Errorf("Expected 1 JWKS request, got %d", jwks.requests)
+	}
+
+	// A key is only used for the alg it declares
+	jwk := keyToJWK("fourth", &first.PublicKey)
+	jwk.Alg = "RS384"
+	jwks.set(jwk)
+	clock.Advance(2 * time.Minute)
+	token, _ = issuer("fourth", first).Sign(map[string]interface{}{"sub": "user1"})
+	if _, err := app_ctx.AuthKeys().Verify(token); err == nil {
+		t.Error("Expected an RS256 token to fail with a key declared for RS384")
+	}
+}
@@ -0,0 +1,95 @@
+package app_context
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"time"
+)
+
+// BuildTime is when the binary was built, for builds that set it with
+//
+//	go build -ldflags "-X github.com/tilteng/go-app-context/app_context.BuildTime=$(date -u +%FT%TZ)"
+//
+// BUILD_TIME in the environment overrides it. Without either, it's the
+// VCS commit time go build recorded, if any.
+var BuildTime string
+
+// BuildInfo is what's running: the code version from CODE_VERSION, and
+// what the Go toolchain stamped into the binary
+type BuildInfo struct {
+	AppName     string    `json:"app_name"`
+	CodeVersion string    `json:"code_version,omitempty"`
+	GoVersion   string    `json:"go_version"`
+	Module      string    `json:"module,omitempty"`
+	BuildTime   string    `json:"build_time,omitempty"`
+	VCS         string    `json:"vcs,omitempty"`
+	VCSRevision string    `json:"vcs_revision,omitempty"`
+	VCSTime     string    `json:"vcs_time,omitempty"`
+	VCSModified bool      `json:"vcs_modified,omitempty"`
+	StartedAt   time.Time `json:"started_at"`
+}
+
+type versionResponse struct {
+	*BuildInfo
+	Uptime        string  `json:"uptime"`
+	UptimeSeconds float64 `json:"uptime_seconds"`
+}
+
+func (self *baseAppContext) setBuildInfoFromEnv() error {
+	info := &BuildInfo{
+		AppName:     self.appName,
+		CodeVersion: self.codeVersion,
+		GoVersion:   runtime.Version(),
+		BuildTime:   BuildTime,
+		StartedAt:   self.startedAt,
+	}
+
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		if bi.Main.Path != "" {
+			info.Module = bi.Main.Path + "@" + bi.Main.Version
+		}
+		for _, setting := range bi.Settings {
+			switch setting.Key {
+			case "vcs":
+				info.VCS = setting.Value
+			case "vcs.revision":
+				info.VCSRevision = setting.Value
+			case "vcs.time":
+				info.VCSTime = setting.Value
+			case "vcs.modified":
+				info.VCSModified = setting.Value == "true"
+			}
+		}
+	}
+
+	if build_time := self.getEnv("BUILD_TIME"); build_time != "" {
+		info.BuildTime = build_time
+	}
+	if info.BuildTime == "" {
+		info.BuildTime = info.VCSTime
+	}
+
+	self.buildInfo = info
+	return nil
+}
+
+// BuildInfo returns a copy of the build information
+func (self *baseAppContext) BuildInfo() BuildInfo {
+	return *self.buildInfo
+}
+
+// VersionHandler serves BuildInfo as JSON, with the uptime. The admin
+// server has it at /version.
+func (self *baseAppContext) VersionHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		uptime := time.Since(self.startedAt)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(&versionResponse{
+			BuildInfo:     self.buildInfo,
+			Uptime:        uptime.Truncate(time.Second).String(),
+			UptimeSeconds: uptime.Seconds(),
+		})
+	})
+}
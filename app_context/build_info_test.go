@@ -0,0 +1,43 @@
+package app_context
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"testing"
+)
+
+func TestBuildInfo(t *testing.T) {
+	os.Setenv("CODE_VERSION", "v1.2.3")
+	os.Setenv("BUILD_TIME", "2026-10-14T09:00:00Z")
+	defer os.Unsetenv("CODE_VERSION")
+	defer os.Unsetenv("BUILD_TIME")
+
+	app_ctx, err := NewAppContext("build_info_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app_ctx.Close()
+
+	info := app_ctx.BuildInfo()
+	if info.AppName != "build_info_test" || info.CodeVersion != "v1.2.3" || info.GoVersion != runtime.Version() {
+		t.Errorf("Unexpected build info: %+v", info)
+	}
+	if info.BuildTime != "2026-10-14T09:00:00Z" {
+		t.Errorf("Expected BUILD_TIME to set the build time, got '%s'", info.BuildTime)
+	}
+
+	w := httptest.NewRecorder()
+	app_ctx.(*baseAppContext).admin.mux.ServeHTTP(w, httptest.NewRequest("GET", "/version", nil))
+	var resp map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Invalid /version response: %s", err)
+	}
+	if resp["code_version"] != "v1.2.3" || resp["go_version"] != runtime.Version() {
+		t.Errorf("Unexpected /version response: %s", w.Body.String())
+	}
+	if _, ok := resp["uptime_seconds"].(float64); !ok {
+		t.Errorf("Expected the uptime: %s", w.Body.String())
+	}
+}
@@ -0,0 +1,277 @@
+package app_context
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Cache is a key/value cache shared by the app. Cache() reports
+// cache.hits, cache.misses and cache.errors for whichever backend is set.
+type Cache interface {
+	// Get returns ErrCacheMiss if key isn't cached or has expired
+	Get(ctx context.Context, key string) ([]byte, error)
+	// Set caches value for ttl, or until evicted if ttl is 0
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+	Delete(ctx context.Context, key string) error
+	Close() error
+}
+
+var ErrCacheMiss = errors.New("Cache miss")
+
+type noopCache struct{}
+
+func (self *noopCache) Get(ctx context.Context, key string) ([]byte, error) {
+	return nil, ErrCacheMiss
+}
+
+func (self *noopCache) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	return nil
+}
+
+func (self *noopCache) Delete(ctx context.Context, key string) error {
+	return nil
+}
+
+func (self *noopCache) Close() error {
+	return nil
+}
+
+func NewNOOPCache() Cache {
+	return &noopCache{}
+}
+
+type memoryCacheEntry struct {
+	key     string
+	value   []byte
+	expires time.Time
+}
+
+// memoryCache evicts the least recently used entry once it's full
+type memoryCache struct {
+	lock    sync.Mutex
+	size    int
+	order   *list.List
+	entries map[string]*list.Element
+	now     func() time.Time
+}
+
+func (self *memoryCache) Get(ctx context.Context, key string) ([]byte, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	elem, ok := self.entries[key]
+	if !ok {
+		return nil, ErrCacheMiss
+	}
+	entry := elem.Value.(*memoryCacheEntry)
+	if !entry.expires.IsZero() && !self.now().Before(entry.expires) {
+		self.order.Remove(elem)
+		delete(self.entries, key)
+		return nil, ErrCacheMiss
+	}
+	self.order.MoveToFront(elem)
+	return entry.value, nil
+}
+
+func (self *memoryCache) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	entry := &memoryCacheEntry{key: key, value: value}
+	if ttl > 0 {
+		entry.expires = self.now().Add(ttl)
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if elem, ok := self.entries[key]; ok {
+		elem.Value = entry
+		self.order.MoveToFront(elem)
+		return nil
+	}
+
+	self.entries[key] = self.order.PushFront(entry)
+	if self.order.Len() > self.size {
+		oldest := self.order.Back()
+		self.order.Remove(oldest)
+		delete(self.entries, oldest.Value.(*memoryCacheEntry).key)
+	}
+	return nil
+}
+
+func (self *memoryCache) Delete(ctx context.Context, key string) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if elem, ok := self.entries[key]; ok {
+		self.order.Remove(elem)
+		delete(self.entries, key)
+	}
+	return nil
+}
+
+func (self *memoryCache) Close() error {
+	return nil
+}
+
+// NewMemoryCache returns an in-process LRU cache holding up to size entries
+func NewMemoryCache(size int) Cache {
+	return &memoryCache{
+		size:    size,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+		now:     time.Now,
+	}
+}
+
+type redisCache struct {
+	client *redisClient
+	prefix string
+}
+
+func (self *redisCache) Get(ctx context.Context, key string) ([]byte, error) {
+	reply, err := self.client.do(ctx, "GET", self.prefix+key)
+	if err != nil {
+		return nil, err
+	}
+	if reply == nil {
+		return nil, ErrCacheMiss
+	}
+	value, ok := reply.(string)
+	if !ok {
+		return nil, fmt.Errorf("Unexpected reply to GET: %v", reply)
+	}
+	return []byte(value), nil
+}
+
+func (self *redisCache) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	args := []string{"SET", self.prefix + key, string(value)}
+	if ttl > 0 {
+		ms := int64(ttl / time.Millisecond)
+		if ms < 1 {
+			ms = 1
+		}
+		args = append(args, "PX", strconv.FormatInt(ms, 10))
+	}
+	_, err := self.client.do(ctx, args...)
+	return err
+}
+
+func (self *redisCache) Delete(ctx context.Context, key string) error {
+	_, err := self.client.do(ctx, "DEL", self.prefix+key)
+	return err
+}
+
+func (self *redisCache) Close() error {
+	self.client.close()
+	return nil
+}
+
+// instrumentedCache reports hits and misses for the cache it wraps
+type instrumentedCache struct {
+	Cache
+	appctx *baseAppContext
+}
+
+func (self *instrumentedCache) Get(ctx context.Context, key string) ([]byte, error) {
+	value, err := self.Cache.Get(ctx, key)
+	switch err {
+	case nil:
+		self.appctx.MetricsClient().Incr("cache.hits", 1.0, nil)
+	case ErrCacheMiss:
+		self.appctx.MetricsClient().Incr("cache.misses", 1.0, nil)
+	default:
+		self.appctx.MetricsClient().Incr("cache.errors", 1.0, map[string]string{"op": "get"})
+	}
+	return value, err
+}
+
+func (self *instrumentedCache) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	err := self.Cache.Set(ctx, key, value, ttl)
+	if err != nil {
+		self.appctx.MetricsClient().Incr("cache.errors", 1.0, map[string]string{"op": "set"})
+	}
+	return err
+}
+
+func (self *instrumentedCache) Delete(ctx context.Context, key string) error {
+	err := self.Cache.Delete(ctx, key)
+	if err != nil {
+		self.appctx.MetricsClient().Incr("cache.errors", 1.0, map[string]string{"op": "delete"})
+	}
+	return err
+}
+
+func (self *baseAppContext) Cache() Cache {
+	self.componentsLock.RLock()
+	defer self.componentsLock.RUnlock()
+	return &instrumentedCache{Cache: self.cache, appctx: self}
+}
+
+func (self *baseAppContext) SetCache(cache Cache) AppContext {
+	self.componentsLock.Lock()
+	defer self.componentsLock.Unlock()
+	self.cache = cache
+	return self
+}
+
+// CACHE_BACKEND is memory (the default), redis or none. The memory cache
+// holds CACHE_SIZE entries (default 10000). The redis cache connects to
+// CACHE_REDIS_URL, times calls out after CACHE_REDIS_TIMEOUT (default 1s)
+// and prefixes keys with CACHE_KEY_PREFIX, the app name and a ':' by
+// default.
+func (self *baseAppContext) setCacheFromEnv() error {
+	switch backend := self.getEnv("CACHE_BACKEND"); backend {
+	case "", "memory":
+		size := 10000
+		if n, found, err := self.getIntFromEnv("CACHE_SIZE"); err != nil {
+			return err
+		} else if found {
+			if n < 1 {
+				return fmt.Errorf("CACHE_SIZE must be > 0")
+			}
+			size = n
+		}
+		cache := NewMemoryCache(size).(*memoryCache)
+		cache.now = self.now
+		self.cache = cache
+
+	case "redis":
+		redis_url := self.getEnv("CACHE_REDIS_URL")
+		if redis_url == "" {
+			return fmt.Errorf("CACHE_REDIS_URL is required with CACHE_BACKEND=redis")
+		}
+
+		timeout := time.Second
+		if d, found, err := self.getDurationFromEnv("CACHE_REDIS_TIMEOUT"); err != nil {
+			return err
+		} else if found {
+			if d <= 0 {
+				return fmt.Errorf("CACHE_REDIS_TIMEOUT must be > 0")
+			}
+			timeout = d
+		}
+
+		client, err := newRedisClient(redis_url, timeout)
+		if err != nil {
+			return fmt.Errorf("Invalid CACHE_REDIS_URL: %s", err)
+		}
+
+		prefix := self.appName + ":"
+		if val, found := self.lookupEnv("CACHE_KEY_PREFIX"); found {
+			prefix = val
+		}
+		self.cache = &redisCache{client: client, prefix: prefix}
+
+	case "none":
+		self.cache = NewNOOPCache()
+
+	default:
+		return fmt.Errorf("Unknown CACHE_BACKEND '%s'", backend)
+	}
+
+	return nil
+}
@@ -0,0 +1,119 @@
+package app_context
+
+import (
+	"context"
+	"log"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestMemoryCache(t *testing.T) {
+	os.Setenv("CACHE_SIZE", "2")
+	defer os.Unsetenv("CACHE_SIZE")
+
+	app_ctx, err := NewAppContext("cache_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer app_ctx.Close()
+
+	mcli := newCountingMetricsClient()
+	app_ctx.SetMetricsClient(mcli)
+
+	now := time.Now()
+	app_ctx.(*baseAppContext).cache.(*memoryCache).now = func() time.Time { return now }
+
+	ctx := context.Background()
+	cache := app_ctx.Cache()
+
+	cache.Set(ctx, "a", []byte("1"), 0)
+	cache.Set(ctx, "b", []byte("2"), time.Minute)
+	if value, err := cache.Get(ctx, "a"); err != nil || string(value) != "1" {
+		t.Errorf("Expected a hit for a, got %v", err)
+	}
+
+	// b is now the least recently used
+	cache.Set(ctx, "c", []byte("3"), 0)
+	if _, err := cache.Get(ctx, "b"); err != ErrCacheMiss {
+		t.Errorf("Expected b to be evicted, got %v", err)
+	}
+
+	cache.Set(ctx, "c", []byte("3"), time.Minute)
+	now = now.Add(time.Minute)
+	if _, err := cache.Get(ctx, "c"); err != ErrCacheMiss {
+		t.Errorf("Expected c to expire, got %v", err)
+	}
+
+	cache.Delete(ctx, "a")
+	if _, err := cache.Get(ctx, "a"); err != ErrCacheMiss {
+		t.Errorf("Expected a to be deleted, got %v", err)
+	}
+
+	if hits, misses := mcli.count("cache.hits"), mcli.count("cache.misses"); hits != 1 || misses != 3 {
+		t.Errorf("Expected 1 hit and 3 misses, got %d and %d", hits, misses)
+	}
+}
+
+func TestRedisCache(t *testing.T) {
+	server := newFakeRedis(t, "+OK", "$5\r\nhello", "$-1", ":1")
+	defer server.listener.Close()
+
+	os.Setenv("CACHE_BACKEND", "redis")
+	os.Setenv("CACHE_REDIS_URL", "redis://"+server.listener.Addr().String())
+	defer os.Unsetenv("CACHE_BACKEND")
+	defer os.Unsetenv("CACHE_REDIS_URL")
+
+	app_ctx, err := NewAppContext("cache_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer app_ctx.Close()
+
+	ctx := context.Background()
+	cache := app_ctx.Cache()
+
+	if err := cache.Set(ctx, "greeting", []byte("hello"), 1500*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := cache.Get(ctx, "greeting"); err != nil || string(value) != "hello" {
+		t.Errorf("Expected a hit, got %q, %v", value, err)
+	}
+	if _, err := cache.Get(ctx, "other"); err != ErrCacheMiss {
+		t.Errorf("Expected a miss, got %v", err)
+	}
+	if err := cache.Delete(ctx, "greeting"); err != nil {
+		t.Fatal(err)
+	}
+
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	set := server.commands[0]
+	if len(set) != 5 || set[1] != "cache_test:greeting" || set[3] != "PX" || set[4] != "1500" {
+		t.Errorf("Unexpected SET: %v", set)
+	}
+	if del := server.commands[3]; del[0] != "DEL" || del[1] != "cache_test:greeting" {
+		t.Errorf("Unexpected DEL: %v", del)
+	}
+}
+
+func TestCacheBackendFromEnv(t *testing.T) {
+	os.Setenv("CACHE_BACKEND", "none")
+	app_ctx, err := NewAppContext("cache_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	app_ctx.Cache().Set(context.Background(), "a", []byte("1"), 0)
+	if _, err := app_ctx.Cache().Get(context.Background(), "a"); err != ErrCacheMiss {
+		t.Errorf("Expected the none backend to always miss, got %v", err)
+	}
+	app_ctx.Close()
+
+	for _, backend := range []string{"memcached", "redis"} {
+		os.Setenv("CACHE_BACKEND", backend)
+		if _, err := NewAppContext("cache_test"); err == nil {
+			t.Errorf("Expected CACHE_BACKEND=%s without a URL to fail", backend)
+		}
+	}
+	os.Unsetenv("CACHE_BACKEND")
+}
@@ -0,0 +1,82 @@
+package app_context
+
+import (
+	"context"
+	"reflect"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/tilteng/go-logger/logger"
+	"github.com/tilteng/go-metrics/metrics"
+)
+
+// HasDB is the part of AppContext for code that only uses the database.
+// DBRead and DBReadContext may return a replica.
+type HasDB interface {
+	DB() *sqlx.DB
+	DBRead() *sqlx.DB
+	DBReadContext(context.Context) *sqlx.DB
+	DBWrite() *sqlx.DB
+}
+
+// HasErrorReporter is the part of AppContext for code that reports errors
+type HasErrorReporter interface {
+	ErrorReporter() ErrorReporter
+}
+
+// HasLogger is the part of AppContext for code that only logs, eg. a
+// library that takes a HasLogger so its tests can pass a stub
+type HasLogger interface {
+	Logger() logger.CtxLogger
+}
+
+// HasMetrics is the part of AppContext for code that only sends metrics
+type HasMetrics interface {
+	MetricsClient() metrics.MetricsClient
+}
+
+// asTarget sets *target to v if v is assignable to it. Like errors.As, it
+// panics if target isn't a non-nil pointer.
+func asTarget(v interface{}, target interface{}) bool {
+	rv := reflect.ValueOf(target)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		panic("app_context: As target must be a non-nil pointer")
+	}
+	elem := rv.Elem()
+	if reflect.TypeOf(v).AssignableTo(elem.Type()) {
+		elem.Set(reflect.ValueOf(v))
+		return true
+	}
+	return false
+}
+
+// As finds a capability of appctx that isn't part of AppContext, the way
+// errors.As finds an error: target is a pointer to an interface (or
+// type), eg. a *TracerProvider the app defines, and As sets it and
+// returns true if appctx implements it, or if appctx.As does. Type
+// assertions on an app context miss methods of whatever a wrapper embeds
+// as an AppContext, so code looking for optional interfaces should go
+// through As.
+func As(appctx AppContext, target interface{}) bool {
+	if appctx == nil {
+		return false
+	}
+	if asTarget(appctx, target) {
+		return true
+	}
+	return appctx.As(target)
+}
+
+// As is the base of the chain that wrappers extend: a wrapper embedding an
+// AppContext overrides As to offer its own capabilities, then calls the
+// embedded As for the rest. Here it only matches the context itself.
+func (self *baseAppContext) As(target interface{}) bool {
+	return asTarget(self, target)
+}
+
+func (self *childAppContext) As(target interface{}) bool {
+	return asTarget(self, target)
+}
+
+func (self *requestAppContext) As(target interface{}) bool {
+	return asTarget(self, target)
+}
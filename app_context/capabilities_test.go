@@ -0,0 +1,137 @@
+package app_context
+
+import (
+	"log"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/tilteng/go-metrics/metrics"
+)
+
+type tracerProvider interface {
+	TracerName() string
+}
+
+type redisProvider interface {
+	RedisAddr() string
+}
+
+// tracingAppContext offers tracerProvider itself
+type tracingAppContext struct {
+	AppContext
+}
+
+func (self *tracingAppContext) TracerName() string {
+	return "tracer"
+}
+
+// redisAppContext offers redisProvider through As, as a wrapper whose
+// capability lives in another value would
+type redisAppContext struct {
+	AppContext
+	redis redisProvider
+}
+
+func (self *redisAppContext) As(target interface{}) bool {
+	if rp, ok := target.(*redisProvider); ok {
+		*rp = self.redis
+		return true
+	}
+	return self.AppContext.As(target)
+}
+
+type stubRedis struct{}
+
+func (stubRedis) RedisAddr() string {
+	return "localhost:6379"
+}
+
+func TestAs(t *testing.T) {
+	app_ctx, err := NewAppContext("capabilities_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer app_ctx.Close()
+
+	// The redis wrapper embeds the tracing one as an AppContext, hiding
+	// TracerName from type assertions
+	wrapped := &redisAppContext{
+		AppContext: &tracingAppContext{AppContext: app_ctx},
+		redis:      stubRedis{},
+	}
+	if _, ok := interface{}(wrapped).(tracerProvider); ok {
+		t.Fatal("Type assertion shouldn't see through the embedded AppContext")
+	}
+
+	var rp redisProvider
+	if !As(wrapped, &rp) || rp.RedisAddr() != "localhost:6379" {
+		t.Error("Expected As to find the redis provider")
+	}
+
+	var base *baseAppContext
+	if !As(wrapped, &base) || base != app_ctx {
+		t.Error("Expected As to find the base app context")
+	}
+
+	var tp tracerProvider
+	if As(wrapped, &tp) {
+		t.Error("Tracing wrapper doesn't override As, so it shouldn't be found")
+	}
+	if !As(wrapped.AppContext, &tp) || tp.TracerName() != "tracer" {
+		t.Error("Expected As to match the tracing wrapper itself")
+	}
+
+	reqctx := app_ctx.WithComponent("capabilities").ForRequest(httptest.NewRequest("GET", "/", nil))
+	var found RequestAppContext
+	if !As(reqctx, &found) || found != reqctx {
+		t.Error("Expected As to find the request context")
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("Expected a non-pointer target to panic")
+		}
+	}()
+	As(app_ctx, rp)
+}
+
+// countRequests wants just metrics, so a test can pass anything with a
+// MetricsClient
+func countRequests(m HasMetrics, n int) {
+	for i := 0; i < n; i++ {
+		m.MetricsClient().Incr("requests", 1.0, nil)
+	}
+}
+
+type metricsOnly struct {
+	mcli *countingMetricsClient
+}
+
+func (self *metricsOnly) MetricsClient() metrics.MetricsClient {
+	return self.mcli
+}
+
+func TestHasInterfaces(t *testing.T) {
+	var _ HasDB = AppContext(nil)
+	var _ HasErrorReporter = RequestAppContext(nil)
+	var _ HasLogger = &AppContextWrapper{}
+
+	stub := &metricsOnly{mcli: newCountingMetricsClient()}
+	countRequests(stub, 2)
+	if stub.mcli.count("requests") != 2 {
+		t.Errorf("Expected 2 requests counted, got %d", stub.mcli.count("requests"))
+	}
+
+	app_ctx, err := NewAppContext("capabilities_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app_ctx.Close()
+
+	mcli := newCountingMetricsClient()
+	app_ctx.SetMetricsClient(mcli)
+	countRequests(app_ctx, 1)
+	if mcli.count("requests") != 1 {
+		t.Errorf("Expected 1 request counted, got %d", mcli.count("requests"))
+	}
+}
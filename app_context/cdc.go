@@ -0,0 +1,445 @@
+package app_context
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/comstud/go-rollbar/rollbar"
+)
+
+const (
+	ChangeInsert   = "insert"
+	ChangeUpdate   = "update"
+	ChangeDelete   = "delete"
+	ChangeSnapshot = "snapshot"
+	ChangeTruncate = "truncate"
+)
+
+// ChangeEvent is a change to one row of another system's table
+type ChangeEvent struct {
+	Op     string
+	Schema string
+	Table  string
+	// Before is unset for inserts, and for updates unless the table's
+	// replica identity includes the old row
+	Before map[string]interface{}
+	After  map[string]interface{}
+	// Position is where the change is in the source: topic/partition/offset
+	// for kafka or the LSN for postgres
+	Position  string
+	Timestamp time.Time
+}
+
+// Decode fills dest from the row after the change, or before it for
+// deletes, as if the row were a JSON object
+func (self *ChangeEvent) Decode(dest interface{}) error {
+	row := self.After
+	if self.Op == ChangeDelete {
+		row = self.Before
+	}
+	return decodeChangeRow(row, dest)
+}
+
+// DecodeBefore fills dest from the row before the change
+func (self *ChangeEvent) DecodeBefore(dest interface{}) error {
+	return decodeChangeRow(self.Before, dest)
+}
+
+func decodeChangeRow(row map[string]interface{}, dest interface{}) error {
+	if row == nil {
+		return errors.New("The change event doesn't include that row")
+	}
+	data, err := json.Marshal(row)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, dest)
+}
+
+type ChangeHandler func(ctx context.Context, event *ChangeEvent) error
+
+type CDCStatus struct {
+	Source    string
+	Events    int
+	Errors    int
+	Position  string
+	LastEvent time.Time
+	LastError string
+}
+
+// CDCConsumer delivers change events from CDC_SOURCE to handlers.
+// Changes are delivered at least once: the kafka source's consumer group
+// commits a message once its handler returns nil, and the postgres source
+// advances REPLICATION_SLOT past a batch once every change in it has been
+// handled. It's meant to be run as a worker:
+//
+//	appctx.Workers().Register("cdc", appctx.CDC().Run, WorkerOptions{ActiveOnly: true})
+type CDCConsumer interface {
+	// Handle registers handler for changes to table, as schema.table or
+	// just the table's name. "*" gets changes without another handler.
+	Handle(table string, handler ChangeHandler)
+	// Run delivers changes until ctx is done or a handler fails
+	Run(ctx context.Context) error
+	Status() CDCStatus
+}
+
+type cdcConsumer struct {
+	appctx *baseAppContext
+	source string
+
+	// kafka
+	topics []string
+
+	// postgres
+	slot         string
+	pollInterval time.Duration
+	batchSize    int
+
+	lock     sync.Mutex
+	handlers map[string]ChangeHandler
+	status   CDCStatus
+}
+
+func (self *cdcConsumer) Handle(table string, handler ChangeHandler) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if _, ok := self.handlers[table]; ok {
+		panic(fmt.Sprintf("Duplicate registration for CDC table '%s'", table))
+	}
+	self.handlers[table] = handler
+}
+
+func (self *cdcConsumer) handler(event *ChangeEvent) ChangeHandler {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for _, name := range []string{event.Schema + "." + event.Table, event.Table, "*"} {
+		if handler, ok := self.handlers[name]; ok {
+			return handler
+		}
+	}
+	return nil
+}
+
+func (self *cdcConsumer) deliver(ctx context.Context, event *ChangeEvent) error {
+	handler := self.handler(event)
+	if handler == nil {
+		return nil
+	}
+
+	tags := map[string]string{"source": self.source, "table": event.Schema + "." + event.Table, "op": event.Op}
+	err := handler(ctx, event)
+
+	self.lock.Lock()
+	self.status.Events++
+	self.status.Position = event.Position
+	self.status.LastEvent = self.appctx.Clock().Now()
+	if err != nil {
+		self.status.Errors++
+		self.status.LastError = err.Error()
+	}
+	self.lock.Unlock()
+
+	if err != nil {
+		self.appctx.MetricsClient().Incr("cdc.errors", 1.0, tags)
+		err = fmt.Errorf("Error handling %s of %s.%s at %s: %s", event.Op, event.Schema, event.Table, event.Position, err)
+		self.appctx.reportError(err, rollbar.CustomInfo{"cdc_source": self.source, "cdc_position": event.Position})
+		return err
+	}
+	self.appctx.MetricsClient().Incr("cdc.events", 1.0, tags)
+	return nil
+}
+
+func (self *cdcConsumer) Status() CDCStatus {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	status := self.status
+	status.Source = self.source
+	return status
+}
+
+func (self *cdcConsumer) Run(ctx context.Context) error {
+	switch self.source {
+	case "kafka":
+		return self.runKafka(ctx)
+	case "postgres":
+		return self.runPostgres(ctx)
+	default:
+		return errors.New("No CDC_SOURCE is configured")
+	}
+}
+
+var debeziumOps = map[string]string{
+	"c": ChangeInsert,
+	"u": ChangeUpdate,
+	"d": ChangeDelete,
+	"r": ChangeSnapshot,
+	"t": ChangeTruncate,
+}
+
+type debeziumPayload struct {
+	Op     string                 `json:"op"`
+	Before map[string]interface{} `json:"before"`
+	After  map[string]interface{} `json:"after"`
+	TsMS   int64                  `json:"ts_ms"`
+	Source struct {
+		Schema string `json:"schema"`
+		Table  string `json:"table"`
+	} `json:"source"`
+}
+
+// parseDebeziumMessage handles messages with and without the schema
+// envelope. Tombstones, which follow deletes for log compaction, are nil.
+func parseDebeziumMessage(msg *KafkaMessage) (*ChangeEvent, error) {
+	if len(msg.Value) == 0 {
+		return nil, nil
+	}
+
+	var envelope struct {
+		Payload *debeziumPayload `json:"payload"`
+	}
+	if err := json.Unmarshal(msg.Value, &envelope); err != nil {
+		return nil, err
+	}
+	payload := envelope.Payload
+	if payload == nil || payload.Op == "" {
+		payload = &debeziumPayload{}
+		if err := json.Unmarshal(msg.Value, payload); err != nil {
+			return nil, err
+		}
+	}
+
+	op, ok := debeziumOps[payload.Op]
+	if !ok {
+		return nil, fmt.Errorf("Unknown debezium op '%s'", payload.Op)
+	}
+
+	event := &ChangeEvent{
+		Op:       op,
+		Schema:   payload.Source.Schema,
+		Table:    payload.Source.Table,
+		Before:   payload.Before,
+		After:    payload.After,
+		Position: fmt.Sprintf("%s/%d/%d", msg.Topic, msg.Partition, msg.Offset),
+	}
+	if payload.TsMS > 0 {
+		event.Timestamp = time.Unix(0, payload.TsMS*int64(time.Millisecond))
+	}
+	return event, nil
+}
+
+func (self *cdcConsumer) runKafka(ctx context.Context) error {
+	if !self.appctx.KafkaEnabled() {
+		return errors.New("CDC_SOURCE=kafka needs KAFKA_BROKERS")
+	}
+	return self.appctx.KafkaConsumerGroup().Consume(ctx, self.topics, func(ctx context.Context, msg *KafkaMessage) error {
+		event, err := parseDebeziumMessage(msg)
+		if err != nil {
+			return fmt.Errorf("Error parsing change event at %s/%d/%d: %s", msg.Topic, msg.Partition, msg.Offset, err)
+		}
+		if event == nil {
+			return nil
+		}
+		return self.deliver(ctx, event)
+	})
+}
+
+var wal2jsonActions = map[string]string{
+	"I": ChangeInsert,
+	"U": ChangeUpdate,
+	"D": ChangeDelete,
+	"T": ChangeTruncate,
+}
+
+type wal2jsonColumn struct {
+	Name  string      `json:"name"`
+	Value interface{} `json:"value"`
+}
+
+type wal2jsonChange struct {
+	Action   string           `json:"action"`
+	Schema   string           `json:"schema"`
+	Table    string           `json:"table"`
+	Columns  []wal2jsonColumn `json:"columns"`
+	Identity []wal2jsonColumn `json:"identity"`
+}
+
+func wal2jsonRow(columns []wal2jsonColumn) map[string]interface{} {
+	if columns == nil {
+		return nil
+	}
+	row := make(map[string]interface{}, len(columns))
+	for _, col := range columns {
+		row[col.Name] = col.Value
+	}
+	return row
+}
+
+// parseWal2jsonChange parses a wal2json format-version 2 change.
+// Transaction begins and commits, and messages, are nil.
+func parseWal2jsonChange(lsn string, data []byte) (*ChangeEvent, error) {
+	var change wal2jsonChange
+	if err := json.Unmarshal(data, &change); err != nil {
+		return nil, err
+	}
+	op, ok := wal2jsonActions[change.Action]
+	if !ok {
+		return nil, nil
+	}
+	return &ChangeEvent{
+		Op:       op,
+		Schema:   change.Schema,
+		Table:    change.Table,
+		Before:   wal2jsonRow(change.Identity),
+		After:    wal2jsonRow(change.Columns),
+		Position: lsn,
+	}, nil
+}
+
+type slotChange struct {
+	lsn  string
+	data []byte
+}
+
+// pollSlot peeks at up to batchSize changes, delivers them and then
+// advances the slot past them. Peeking rather than getting means a
+// failure leaves the changes in the slot to be delivered again.
+func (self *cdcConsumer) pollSlot(ctx context.Context) (int, error) {
+	db := self.appctx.DBWrite()
+	if db == nil {
+		return 0, errors.New("CDC_SOURCE=postgres needs a database")
+	}
+
+	rows, err := db.QueryContext(
+		ctx,
+		"SELECT lsn::text, data FROM pg_logical_slot_peek_changes($1, NULL, $2, 'format-version', '2')",
+		self.slot,
+		self.batchSize,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("Error reading REPLICATION_SLOT '%s': %s", self.slot, err)
+	}
+	var changes []slotChange
+	for rows.Next() {
+		var change slotChange
+		if err := rows.Scan(&change.lsn, &change.data); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		changes = append(changes, change)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	if len(changes) == 0 {
+		return 0, nil
+	}
+
+	for _, change := range changes {
+		event, err := parseWal2jsonChange(change.lsn, change.data)
+		if err != nil {
+			return 0, fmt.Errorf("Error parsing change event at %s: %s", change.lsn, err)
+		}
+		if event == nil {
+			continue
+		}
+		if err := self.deliver(ctx, event); err != nil {
+			return 0, err
+		}
+	}
+
+	last := changes[len(changes)-1].lsn
+	if _, err := db.ExecContext(ctx, "SELECT pg_replication_slot_advance($1, $2::pg_lsn)", self.slot, last); err != nil {
+		return 0, fmt.Errorf("Error advancing REPLICATION_SLOT '%s' to %s: %s", self.slot, last, err)
+	}
+	return len(changes), nil
+}
+
+func (self *cdcConsumer) runPostgres(ctx context.Context) error {
+	for {
+		n, err := self.pollSlot(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		if n >= self.batchSize {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-self.appctx.Clock().After(self.pollInterval):
+		}
+	}
+}
+
+// CDC returns the consumer of change events from CDC_SOURCE
+func (self *baseAppContext) CDC() CDCConsumer {
+	return self.cdc
+}
+
+// CDC_SOURCE is kafka, reading Debezium change events from CDC_TOPICS, or
+// postgres, reading REPLICATION_SLOT (created with the wal2json plugin)
+// every CDC_POLL_INTERVAL, CDC_BATCH_SIZE changes at a time. Setting
+// REPLICATION_SLOT alone implies postgres.
+func (self *baseAppContext) setCDCFromEnv() error {
+	self.cdc = &cdcConsumer{
+		appctx:       self,
+		handlers:     make(map[string]ChangeHandler),
+		pollInterval: time.Second,
+		batchSize:    100,
+	}
+
+	source := strings.ToLower(self.getEnv("CDC_SOURCE"))
+	slot := self.getEnv("REPLICATION_SLOT")
+	if source == "" && slot != "" {
+		source = "postgres"
+	}
+
+	switch source {
+	case "":
+		return nil
+	case "kafka":
+		for _, topic := range strings.Split(self.getEnv("CDC_TOPICS"), ",") {
+			if topic = strings.TrimSpace(topic); topic != "" {
+				self.cdc.topics = append(self.cdc.topics, topic)
+			}
+		}
+		if len(self.cdc.topics) == 0 {
+			return errors.New("CDC_SOURCE=kafka needs CDC_TOPICS")
+		}
+	case "postgres":
+		if slot == "" {
+			return errors.New("CDC_SOURCE=postgres needs REPLICATION_SLOT")
+		}
+		self.cdc.slot = slot
+		if interval, found, err := self.getDurationFromEnv("CDC_POLL_INTERVAL"); err != nil {
+			return err
+		} else if found {
+			if interval <= 0 {
+				return errors.New("CDC_POLL_INTERVAL must be > 0")
+			}
+			self.cdc.pollInterval = interval
+		}
+		if size, found, err := self.getIntFromEnv("CDC_BATCH_SIZE"); err != nil {
+			return err
+		} else if found {
+			if size <= 0 {
+				return errors.New("CDC_BATCH_SIZE must be > 0")
+			}
+			self.cdc.batchSize = size
+		}
+	default:
+		return fmt.Errorf("Unknown CDC_SOURCE: %s", source)
+	}
+
+	self.cdc.source = source
+	return nil
+}
@@ -0,0 +1,195 @@
+package app_context
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type cdcUser struct {
+	ID    float64 `json:"id"`
+	Email string  `json:"email"`
+}
+
+// cdcKafkaConsumerGroup delivers msgs and stops at the first error
+type cdcKafkaConsumerGroup struct {
+	msgs   []*KafkaMessage
+	topics []string
+}
+
+func (self *cdcKafkaConsumerGroup) Consume(ctx context.Context, topics []string, handler KafkaConsumerHandler) error {
+	self.topics = topics
+	for _, msg := range self.msgs {
+		if err := handler(ctx, msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (self *cdcKafkaConsumerGroup) Close() error {
+	return nil
+}
+
+func TestCDCKafka(t *testing.T) {
+	os.Setenv("CDC_SOURCE", "kafka")
+	os.Setenv("CDC_TOPICS", "db.public.users")
+	defer os.Unsetenv("CDC_SOURCE")
+	defer os.Unsetenv("CDC_TOPICS")
+
+	app_ctx, err := NewAppContext("cdc_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer app_ctx.Close()
+
+	if err := app_ctx.CDC().Run(context.Background()); err == nil {
+		t.Error("Expected Run to fail without kafka")
+	}
+
+	group := &cdcKafkaConsumerGroup{msgs: []*KafkaMessage{
+		{Topic: "db.public.users", Offset: 1, Value: []byte(`{"schema":{},"payload":{"op":"c","after":{"id":1,"email":"a@example.com"},"source":{"schema":"public","table":"users"},"ts_ms":1700000000000}}`)},
+		// Without the schema envelope
+		{Topic: "db.public.users", Offset: 2, Value: []byte(`{"op":"d","before":{"id":1,"email":"a@example.com"},"source":{"schema":"public","table":"users"}}`)},
+		// A tombstone
+		{Topic: "db.public.users", Offset: 3},
+		{Topic: "db.public.other", Offset: 4, Value: []byte(`{"op":"u","after":{"id":2},"source":{"schema":"public","table":"other"}}`)},
+	}}
+	base := app_ctx.(*baseAppContext)
+	base.kafkaConsumerGroup = group
+	base.kafkaEnabled = true
+
+	var events []*ChangeEvent
+	var users []cdcUser
+	app_ctx.CDC().Handle("public.users", func(ctx context.Context, event *ChangeEvent) error {
+		var user cdcUser
+		if err := event.Decode(&user); err != nil {
+			return err
+		}
+		events = append(events, event)
+		users = append(users, user)
+		return nil
+	})
+
+	if err := app_ctx.CDC().Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(group.topics) != 1 || group.topics[0] != "db.public.users" {
+		t.Errorf("Unexpected topics: %v", group.topics)
+	}
+	if len(events) != 2 || events[0].Op != ChangeInsert || events[1].Op != ChangeDelete {
+		t.Fatalf("Unexpected events: %+v", events)
+	}
+	if users[0].Email != "a@example.com" || users[1].ID != 1 {
+		t.Errorf("Unexpected users: %+v", users)
+	}
+	if events[0].Position != "db.public.users/0/1" || events[0].Timestamp.IsZero() {
+		t.Errorf("Unexpected event: %+v", events[0])
+	}
+
+	// Handler errors stop the consumer so the message isn't committed
+	app_ctx.CDC().Handle("*", func(ctx context.Context, event *ChangeEvent) error {
+		return errors.New("index down")
+	})
+	if err := app_ctx.CDC().Run(context.Background()); err == nil || !strings.Contains(err.Error(), "index down") {
+		t.Errorf("Expected the handler's error, got %v", err)
+	}
+	if status := app_ctx.CDC().Status(); status.Errors != 1 || status.Position != "db.public.other/0/4" {
+		t.Errorf("Unexpected status: %+v", status)
+	}
+}
+
+func TestCDCPostgres(t *testing.T) {
+	os.Setenv("REPLICATION_SLOT", "search_indexer")
+	defer os.Unsetenv("REPLICATION_SLOT")
+
+	app_ctx, err := NewAppContext("cdc_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer app_ctx.Close()
+
+	db, err := app_ctx.(*baseAppContext).openDB("appctx_fake", "", "primary")
+	if err != nil {
+		t.Fatal(err)
+	}
+	app_ctx.SetDB(db)
+	defer app_ctx.SetDB(nil)
+
+	fakeQueryHook = func(query string, args []driver.Value) [][]driver.Value {
+		if !strings.Contains(query, "pg_logical_slot_peek_changes") {
+			return nil
+		}
+		return [][]driver.Value{
+			{"0/16B3748", []byte(`{"action":"B"}`)},
+			{"0/16B3748", []byte(`{"action":"I","schema":"public","table":"users","columns":[{"name":"id","type":"integer","value":7},{"name":"email","type":"text","value":"b@example.com"}]}`)},
+			{"0/16B3800", []byte(`{"action":"C"}`)},
+		}
+	}
+	defer func() { fakeQueryHook = nil }()
+
+	var lock sync.Mutex
+	var advanced []driver.Value
+	fakeExecHook = func(query string, args []driver.Value) error {
+		lock.Lock()
+		defer lock.Unlock()
+		if strings.Contains(query, "pg_replication_slot_advance") {
+			advanced = args
+		}
+		return nil
+	}
+	defer func() { fakeExecHook = nil }()
+
+	fail := true
+	var users []cdcUser
+	app_ctx.CDC().Handle("users", func(ctx context.Context, event *ChangeEvent) error {
+		if fail {
+			return errors.New("index down")
+		}
+		var user cdcUser
+		if err := event.Decode(&user); err != nil {
+			return err
+		}
+		users = append(users, user)
+		return nil
+	})
+
+	cdc := app_ctx.(*baseAppContext).cdc
+	if _, err := cdc.pollSlot(context.Background()); err == nil {
+		t.Error("Expected the handler's error")
+	}
+	if advanced != nil {
+		t.Error("The slot shouldn't advance past a failed change")
+	}
+
+	fail = false
+	if n, err := cdc.pollSlot(context.Background()); err != nil || n != 3 {
+		t.Fatalf("Unexpected poll: %d, %v", n, err)
+	}
+	if len(users) != 1 || users[0].ID != 7 || users[0].Email != "b@example.com" {
+		t.Errorf("Unexpected users: %+v", users)
+	}
+	lock.Lock()
+	if len(advanced) != 2 || advanced[0] != "search_indexer" || advanced[1] != "0/16B3800" {
+		t.Errorf("Expected the slot to advance to the commit, got %v", advanced)
+	}
+	lock.Unlock()
+}
+
+func TestCDCFromEnv(t *testing.T) {
+	os.Setenv("CDC_SOURCE", "kafka")
+	defer os.Unsetenv("CDC_SOURCE")
+	if _, err := NewAppContext("cdc_test"); err == nil {
+		t.Error("Expected CDC_SOURCE=kafka without CDC_TOPICS to fail")
+	}
+
+	os.Setenv("CDC_SOURCE", "mysql")
+	if _, err := NewAppContext("cdc_test"); err == nil {
+		t.Error("Expected an unknown CDC_SOURCE to fail")
+	}
+}
@@ -0,0 +1,424 @@
+package app_context
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// ErrCheckpointConflict is returned by Checkpoint.Advance when the
+// checkpoint isn't where the caller last saw it
+var ErrCheckpointConflict = errors.New("Checkpoint was advanced concurrently")
+
+// CheckpointState is a checkpoint's saved position
+type CheckpointState struct {
+	Name      string    `json:"name"`
+	Value     string    `json:"value"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Checkpoint is the saved progress of a resumable batch job or poller, eg.
+// the last ID or timestamp it processed, so a restart picks up where the
+// previous run left off. Values are opaque to the checkpoint.
+type Checkpoint interface {
+	Name() string
+	// Get returns nil when nothing has been saved yet
+	Get(ctx context.Context) (*CheckpointState, error)
+	Set(ctx context.Context, value string) error
+	// Advance moves the checkpoint from the value the caller last saw
+	// ("" for never saved) to to, returning ErrCheckpointConflict if it
+	// was moved by someone else in the meantime
+	Advance(ctx context.Context, from, to string) error
+}
+
+// checkpointStore keeps checkpoint states. set with a nil from sets value
+// unconditionally; otherwise it returns false without changing anything
+// if the saved value isn't *from.
+type checkpointStore interface {
+	get(ctx context.Context, name string) (*CheckpointState, error)
+	set(ctx context.Context, name, value string, from *string, at time.Time) (bool, error)
+}
+
+// pgCheckpointStore keeps checkpoints in the checkpoints table, created on
+// first use, so every instance shares them
+type pgCheckpointStore struct {
+	appctx *baseAppContext
+	lock   sync.Mutex
+	ready  bool
+}
+
+func (self *pgCheckpointStore) db(ctx context.Context) (*sqlx.DB, error) {
+	db := self.appctx.DBWrite()
+	if db == nil {
+		return nil, errors.New("No database for checkpoints")
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if !self.ready {
+		if _, err := db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS checkpoints (
+			name text NOT NULL PRIMARY KEY,
+			value text NOT NULL,
+			updated_at timestamptz NOT NULL
+		)`); err != nil {
+			return nil, fmt.Errorf("Error creating checkpoints: %s", err)
+		}
+		self.ready = true
+	}
+	return db, nil
+}
+
+func (self *pgCheckpointStore) get(ctx context.Context, name string) (*CheckpointState, error) {
+	db, err := self.db(ctx)
+	if err != nil {
+		return nil, err
+	}
+	state := &CheckpointState{Name: name}
+	err = db.QueryRowContext(
+		ctx,
+		`SELECT value, updated_at FROM checkpoints WHERE name = $1`,
+		name,
+	).Scan(&state.Value, &state.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+func (self *pgCheckpointStore) set(ctx context.Context, name, value string, from *string, at time.Time) (bool, error) {
+	db, err := self.db(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	var res sql.Result
+	switch {
+	case from == nil:
+		res, err = db.ExecContext(
+			ctx,
+			`INSERT INTO checkpoints (name, value, updated_at) VALUES ($1, $2, $3)
+			ON CONFLICT (name) DO UPDATE SET value = $2, updated_at = $3`,
+			name, value, at,
+		)
+	case *from == "":
+		res, err = db.ExecContext(
+			ctx,
+			`INSERT INTO checkpoints (name, value, updated_at) VALUES ($1, $2, $3)
+			ON CONFLICT (name) DO NOTHING`,
+			name, value, at,
+		)
+	default:
+		res, err = db.ExecContext(
+			ctx,
+			`UPDATE checkpoints SET value = $2, updated_at = $3 WHERE name = $1 AND value = $4`,
+			name, value, at, *from,
+		)
+	}
+	if err != nil {
+		return false, err
+	}
+	rows, err := res.RowsAffected()
+	return rows == 1, err
+}
+
+// localCheckpointStore keeps checkpoints in memory and, with a file, in
+// that file as JSON. It's for a single process: other instances don't see
+// its checkpoints.
+type localCheckpointStore struct {
+	file   string
+	lock   sync.Mutex
+	states map[string]*CheckpointState
+	loaded bool
+}
+
+func (self *localCheckpointStore) load() error {
+	if self.loaded {
+		return nil
+	}
+	self.states = make(map[string]*CheckpointState)
+	if self.file != "" {
+		data, err := ioutil.ReadFile(self.file)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if len(data) > 0 {
+			if err := json.Unmarshal(data, &self.states); err != nil {
+				return fmt.Errorf("Error reading checkpoints from '%s': %s", self.file, err)
+			}
+		}
+	}
+	self.loaded = true
+	return nil
+}
+
+// save writes the file by renaming a temporary one over it, so a crash
+// never leaves it half written
+func (self *localCheckpointStore) save() error {
+	if self.file == "" {
+		return nil
+	}
+	data, err := json.Marshal(self.states)
+	if err != nil {
+		return err
+	}
+	tmp := self.file + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, self.file)
+}
+
+func (self *localCheckpointStore) get(ctx context.Context, name string) (*CheckpointState, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if err := self.load(); err != nil {
+		return nil, err
+	}
+	if state, ok := self.states[name]; ok {
+		copied := *state
+		return &copied, nil
+	}
+	return nil, nil
+}
+
+func (self *localCheckpointStore) set(ctx context.Context, name, value string, from *string, at time.Time) (bool, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if err := self.load(); err != nil {
+		return false, err
+	}
+	if from != nil {
+		current := ""
+		if state, ok := self.states[name]; ok {
+			current = state.Value
+		}
+		if current != *from {
+			return false, nil
+		}
+	}
+
+	previous := self.states[name]
+	self.states[name] = &CheckpointState{Name: name, Value: value, UpdatedAt: at}
+	if err := self.save(); err != nil {
+		if previous != nil {
+			self.states[name] = previous
+		} else {
+			delete(self.states, name)
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// checkpoints is the store checkpoints use and what's been seen of each,
+// for the staleness metrics
+type checkpoints struct {
+	appctx   *baseAppContext
+	dir      string
+	interval time.Duration
+
+	lock     sync.Mutex
+	store    checkpointStore
+	updated  map[string]time.Time
+	stopChan chan struct{}
+	doneChan chan struct{}
+}
+
+func newCheckpoints(appctx *baseAppContext) *checkpoints {
+	return &checkpoints{
+		appctx:   appctx,
+		interval: 30 * time.Second,
+		updated:  make(map[string]time.Time),
+	}
+}
+
+// storeLocked picks the store the first time a checkpoint is used, since a
+// database may be given with SetDB after startup: a file in CHECKPOINT_DIR
+// if set, otherwise Postgres, otherwise memory.
+func (self *checkpoints) storeLocked() checkpointStore {
+	if self.store == nil {
+		switch {
+		case self.dir != "":
+			self.store = &localCheckpointStore{file: filepath.Join(self.dir, "checkpoints.json")}
+		case self.appctx.DBWrite() != nil:
+			self.store = &pgCheckpointStore{appctx: self.appctx}
+		default:
+			self.store = &localCheckpointStore{}
+		}
+	}
+	return self.store
+}
+
+// seen records name's last update, starting the staleness metrics on the
+// first one
+func (self *checkpoints) seen(name string, updated time.Time) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	self.updated[name] = updated
+	if self.stopChan != nil || self.interval == 0 {
+		return
+	}
+	stop_chan, done_chan := make(chan struct{}), make(chan struct{})
+	self.stopChan, self.doneChan = stop_chan, done_chan
+	// Like the lifecycle heartbeats, this runs on the real clock so it
+	// isn't a FakeClock waiter
+	ticker := NewRealClock().NewTicker(self.interval)
+	goLabeled("checkpoints", func() {
+		defer close(done_chan)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop_chan:
+				return
+			case <-ticker.C():
+				self.sendStaleness()
+			}
+		}
+	})
+}
+
+// sendStaleness sends checkpoint.age_seconds, the time since each
+// checkpoint this process has seen was last moved. An age that keeps
+// growing is a job that's stuck.
+func (self *checkpoints) sendStaleness() {
+	self.lock.Lock()
+	ages := make(map[string]float64, len(self.updated))
+	now := self.appctx.now()
+	for name, updated := range self.updated {
+		ages[name] = now.Sub(updated).Seconds()
+	}
+	self.lock.Unlock()
+
+	mcli := self.appctx.MetricsClient()
+	for name, age := range ages {
+		mcli.Gauge("checkpoint.age_seconds", age, 1.0, map[string]string{"checkpoint": name})
+	}
+}
+
+func (self *checkpoints) stop() {
+	self.lock.Lock()
+	stop_chan, done_chan := self.stopChan, self.doneChan
+	// Nothing restarts the loop once closed
+	self.stopChan, self.interval = nil, 0
+	self.lock.Unlock()
+
+	if stop_chan != nil {
+		close(stop_chan)
+		<-done_chan
+	}
+}
+
+func (self *checkpoints) status() map[string]interface{} {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	names := make([]string, 0, len(self.updated))
+	for name := range self.updated {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return map[string]interface{}{
+		"store":       typeName(self.store),
+		"checkpoints": names,
+	}
+}
+
+type checkpoint struct {
+	cps  *checkpoints
+	name string
+}
+
+func (self *checkpoint) Name() string {
+	return self.name
+}
+
+func (self *checkpoint) store() checkpointStore {
+	self.cps.lock.Lock()
+	defer self.cps.lock.Unlock()
+	return self.cps.storeLocked()
+}
+
+func (self *checkpoint) Get(ctx context.Context) (*CheckpointState, error) {
+	state, err := self.store().get(ctx, self.name)
+	if err != nil {
+		return nil, fmt.Errorf("Error getting checkpoint '%s': %s", self.name, err)
+	}
+	if state != nil {
+		self.cps.seen(self.name, state.UpdatedAt)
+	}
+	return state, nil
+}
+
+func (self *checkpoint) set(ctx context.Context, value string, from *string) error {
+	now := self.cps.appctx.now()
+	ok, err := self.store().set(ctx, self.name, value, from, now)
+	if err != nil {
+		return fmt.Errorf("Error saving checkpoint '%s': %s", self.name, err)
+	}
+	if !ok {
+		self.cps.appctx.MetricsClient().Incr("checkpoint.conflicts", 1.0, map[string]string{"checkpoint": self.name})
+		return ErrCheckpointConflict
+	}
+	self.cps.appctx.MetricsClient().Incr("checkpoint.advances", 1.0, map[string]string{"checkpoint": self.name})
+	self.cps.seen(self.name, now)
+	return nil
+}
+
+func (self *checkpoint) Set(ctx context.Context, value string) error {
+	return self.set(ctx, value, nil)
+}
+
+func (self *checkpoint) Advance(ctx context.Context, from, to string) error {
+	return self.set(ctx, to, &from)
+}
+
+// Checkpoint returns the checkpoint called name. Checkpoints are shared by
+// every instance through the database when there is one;
+// CHECKPOINT_DIR=<dir> keeps them in <dir>/checkpoints.json instead, for
+// jobs without one. Without either they only last as long as the process.
+func (self *baseAppContext) Checkpoint(name string) Checkpoint {
+	return &checkpoint{cps: self.checkpoints, name: name}
+}
+
+// CHECKPOINT_DIR sets where checkpoints are kept without a database, and
+// CHECKPOINT_STALENESS_INTERVAL (default 30s) how often checkpoint ages
+// are sent
+func (self *baseAppContext) setCheckpointsFromEnv() error {
+	if dir := self.getEnv("CHECKPOINT_DIR"); dir != "" {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return fmt.Errorf("Error creating CHECKPOINT_DIR: %s", err)
+		}
+		self.checkpoints.dir = dir
+	}
+
+	interval, found, err := self.getDurationFromEnv("CHECKPOINT_STALENESS_INTERVAL")
+	if err != nil {
+		return err
+	}
+	if found {
+		if interval <= 0 {
+			return errors.New("CHECKPOINT_STALENESS_INTERVAL must be > 0")
+		}
+		self.checkpoints.interval = interval
+	}
+	if self.lambda {
+		self.checkpoints.interval = 0
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package app_context
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestCheckpoint(t *testing.T) {
+	app_ctx, err := NewAppContext("checkpoint_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer app_ctx.Close()
+
+	clock := NewFakeClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	app_ctx.SetClock(clock)
+	mcli := newCountingMetricsClient()
+	app_ctx.SetMetricsClient(mcli)
+	ctx := context.Background()
+
+	cp := app_ctx.Checkpoint("orders")
+	if state, err := cp.Get(ctx); err != nil || state != nil {
+		t.Fatalf("Expected nothing saved, got %+v, %v", state, err)
+	}
+
+	if err := cp.Advance(ctx, "", "10"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cp.Advance(ctx, "", "20"); err != ErrCheckpointConflict {
+		t.Errorf("Expected a conflict advancing from nothing again, got %v", err)
+	}
+	clock.Advance(time.Minute)
+	if err := cp.Advance(ctx, "10", "20"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cp.Advance(ctx, "10", "30"); !errors.Is(err, ErrCheckpointConflict) {
+		t.Errorf("Expected a conflict advancing from a stale value, got %v", err)
+	}
+
+	state, err := app_ctx.Checkpoint("orders").Get(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Value != "20" || !state.UpdatedAt.Equal(clock.Now()) {
+		t.Errorf("Unexpected state: %+v", state)
+	}
+	if mcli.count("checkpoint.advances") != 2 || mcli.count("checkpoint.conflicts") != 2 {
+		t.Errorf("Unexpected metrics: %v", mcli.counts)
+	}
+	if code := app_ctx.ErrorCodes().AppError(ErrCheckpointConflict).Code; code != "aborted" {
+		t.Errorf("Expected aborted, got %s", code)
+	}
+
+	if err := cp.Set(ctx, "5"); err != nil {
+		t.Fatal(err)
+	}
+	if state, _ := cp.Get(ctx); state.Value != "5" {
+		t.Errorf("Expected Set to overwrite, got %+v", state)
+	}
+
+	clock.Advance(5 * time.Minute)
+	app_ctx.(*baseAppContext).checkpoints.sendStaleness()
+	if mcli.count("checkpoint.age_seconds") != 1 {
+		t.Errorf("Expected an age for the one checkpoint, got %v", mcli.counts)
+	}
+}
+
+func TestCheckpointDir(t *testing.T) {
+	dir := t.TempDir()
+	os.Setenv("CHECKPOINT_DIR", dir)
+	defer os.Unsetenv("CHECKPOINT_DIR")
+
+	app_ctx, err := NewAppContext("checkpoint_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := app_ctx.Checkpoint("poller").Set(context.Background(), "cursor-1"); err != nil {
+		t.Fatal(err)
+	}
+	app_ctx.Close()
+
+	// A new process picks up where the last one left off
+	app_ctx, err = NewAppContext("checkpoint_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer app_ctx.Close()
+
+	state, err := app_ctx.Checkpoint("poller").Get(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state == nil || state.Value != "cursor-1" {
+		t.Errorf("Expected the saved cursor, got %+v", state)
+	}
+}
+
+func TestCheckpointStalenessIntervalFromEnv(t *testing.T) {
+	os.Setenv("CHECKPOINT_STALENESS_INTERVAL", "0s")
+	defer os.Unsetenv("CHECKPOINT_STALENESS_INTERVAL")
+
+	if _, err := NewAppContext("checkpoint_test"); err == nil {
+		t.Error("Expected an error for a 0 interval")
+	}
+}
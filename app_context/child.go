@@ -0,0 +1,348 @@
+package app_context
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/comstud/go-rollbar/rollbar"
+	"github.com/tilteng/go-logger/logger"
+	"github.com/tilteng/go-metrics/metrics"
+)
+
+// fieldsCtxLogger prefixes messages with formatted fields. It's used when
+// the underlying logger can't attach fields itself.
+type fieldsCtxLogger struct {
+	base   logger.CtxLogger
+	prefix string
+}
+
+func (self *fieldsCtxLogger) LogDebug(ctx context.Context, v ...interface{}) {
+	self.base.LogDebug(ctx, prependValue(self.prefix, v)...)
+}
+
+func (self *fieldsCtxLogger) LogDebugf(ctx context.Context, f string, v ...interface{}) {
+	self.base.LogDebugf(ctx, "%s "+f, prependValue(self.prefix, v)...)
+}
+
+func (self *fieldsCtxLogger) LogError(ctx context.Context, v ...interface{}) {
+	self.base.LogError(ctx, prependValue(self.prefix, v)...)
+}
+
+func (self *fieldsCtxLogger) LogErrorf(ctx context.Context, f string, v ...interface{}) {
+	self.base.LogErrorf(ctx, "%s "+f, prependValue(self.prefix, v)...)
+}
+
+func (self *fieldsCtxLogger) LogInfo(ctx context.Context, v ...interface{}) {
+	self.base.LogInfo(ctx, prependValue(self.prefix, v)...)
+}
+
+func (self *fieldsCtxLogger) LogInfof(ctx context.Context, f string, v ...interface{}) {
+	self.base.LogInfof(ctx, "%s "+f, prependValue(self.prefix, v)...)
+}
+
+func (self *fieldsCtxLogger) LogWarn(ctx context.Context, v ...interface{}) {
+	self.base.LogWarn(ctx, prependValue(self.prefix, v)...)
+}
+
+func (self *fieldsCtxLogger) LogWarnf(ctx context.Context, f string, v ...interface{}) {
+	self.base.LogWarnf(ctx, "%s "+f, prependValue(self.prefix, v)...)
+}
+
+func (self *fieldsCtxLogger) BaseLogger() logger.Logger {
+	return self.base.BaseLogger()
+}
+
+func prependValue(s interface{}, v []interface{}) []interface{} {
+	nv := make([]interface{}, 1+len(v))
+	nv[0] = s
+	copy(nv[1:], v)
+	return nv
+}
+
+// CtxLoggerWithFields returns a logger that attaches fields to every entry,
+// natively if the base logger is a FieldsLogger.
+func CtxLoggerWithFields(base logger.CtxLogger, fields map[string]interface{}) logger.CtxLogger {
+	if len(fields) == 0 {
+		return base
+	}
+	if fl, ok := base.BaseLogger().(FieldsLogger); ok {
+		return logger.NewDefaultCtxLogger(fl.WithFields(fields))
+	}
+	return &fieldsCtxLogger{
+		base:   base,
+		prefix: "[" + formatFields(fields) + "]",
+	}
+}
+
+// prefixedMetricsClient shares an underlying client, adding a name prefix
+// and extra tags to everything it sends.
+type prefixedMetricsClient struct {
+	inner  metrics.MetricsClient
+	prefix string
+	tags   map[string]string
+}
+
+func (self *prefixedMetricsClient) mergeTags(tags map[string]string) map[string]string {
+	if len(self.tags) == 0 {
+		return tags
+	}
+	merged := make(map[string]string, len(self.tags)+len(tags))
+	for k, v := range self.tags {
+		merged[k] = v
+	}
+	for k, v := range tags {
+		merged[k] = v
+	}
+	return merged
+}
+
+func (self *prefixedMetricsClient) GetAddr() string {
+	return self.inner.GetAddr()
+}
+
+func (self *prefixedMetricsClient) GetNamespace() string {
+	return self.inner.GetNamespace() + self.prefix
+}
+
+func (self *prefixedMetricsClient) SetNamespace(namespace string) {
+	self.prefix = namespace
+}
+
+func (self *prefixedMetricsClient) GetTags() map[string]string {
+	return self.mergeTags(self.inner.GetTags())
+}
+
+func (self *prefixedMetricsClient) SetTags(tags map[string]string) {
+	self.tags = tags
+}
+
+func (self *prefixedMetricsClient) Init() error {
+	return errors.New("Client has already been initialized")
+}
+
+func (self *prefixedMetricsClient) Gauge(name string, value float64, rate float64, tags map[string]string) error {
+	return self.inner.Gauge(self.prefix+name, value, rate, self.mergeTags(tags))
+}
+
+func (self *prefixedMetricsClient) Count(name string, value int64, rate float64, tags map[string]string) error {
+	return self.inner.Count(self.prefix+name, value, rate, self.mergeTags(tags))
+}
+
+func (self *prefixedMetricsClient) Histogram(name string, value float64, rate float64, tags map[string]string) error {
+	return self.inner.Histogram(self.prefix+name, value, rate, self.mergeTags(tags))
+}
+
+func (self *prefixedMetricsClient) Decr(name string, rate float64, tags map[string]string) error {
+	return self.inner.Decr(self.prefix+name, rate, self.mergeTags(tags))
+}
+
+func (self *prefixedMetricsClient) Incr(name string, rate float64, tags map[string]string) error {
+	return self.inner.Incr(self.prefix+name, rate, self.mergeTags(tags))
+}
+
+func (self *prefixedMetricsClient) Set(name string, value string, rate float64, tags map[string]string) error {
+	return self.inner.Set(self.prefix+name, value, rate, self.mergeTags(tags))
+}
+
+func (self *prefixedMetricsClient) Timing(name string, value time.Duration, rate float64, tags map[string]string) error {
+	return self.inner.Timing(self.prefix+name, value, rate, self.mergeTags(tags))
+}
+
+func (self *prefixedMetricsClient) TimingMS(name string, value float64, rate float64, tags map[string]string) error {
+	return self.inner.TimingMS(self.prefix+name, value, rate, self.mergeTags(tags))
+}
+
+// customRollbarClient adds custom data to every notification it creates
+type customRollbarClient struct {
+	rollbar.Client
+	custom rollbar.CustomInfo
+}
+
+func (self *customRollbarClient) mergeCustom(custom rollbar.CustomInfo) rollbar.CustomInfo {
+	merged := make(rollbar.CustomInfo, len(self.custom)+len(custom))
+	for k, v := range self.custom {
+		merged[k] = v
+	}
+	for k, v := range custom {
+		merged[k] = v
+	}
+	return merged
+}
+
+func (self *customRollbarClient) NewMessageNotification(level rollbar.NotificationLevel, message string, custom rollbar.CustomInfo) *rollbar.MessageNotification {
+	return self.Client.NewMessageNotification(level, message, self.mergeCustom(custom))
+}
+
+func (self *customRollbarClient) NewTraceNotification(level rollbar.NotificationLevel, message string, custom rollbar.CustomInfo) *rollbar.TraceNotification {
+	return self.Client.NewTraceNotification(level, message, self.mergeCustom(custom))
+}
+
+func (self *customRollbarClient) NewTraceChainNotification(level rollbar.NotificationLevel, message string, custom rollbar.CustomInfo) *rollbar.TraceChainNotification {
+	return self.Client.NewTraceChainNotification(level, message, self.mergeCustom(custom))
+}
+
+func (self *customRollbarClient) NewCrashReportNotification(level rollbar.NotificationLevel, message string, custom rollbar.CustomInfo) *rollbar.CrashReportNotification {
+	return self.Client.NewCrashReportNotification(level, message, self.mergeCustom(custom))
+}
+
+// childAppContext is a view of a baseAppContext with extra logger fields,
+// metrics namespace/tags and rollbar custom data. Everything else,
+// including the underlying clients, is shared with the parent. The
+// wrappers are rebuilt whenever a component is swapped on the parent.
+//
+// SetLogger, SetMetricsClient and SetRollbarClient only change the child.
+// The other setters, such as SetDB, change the parent and every other
+// child of it. A child can't be closed; only the parent can.
+type childAppContext struct {
+	*baseAppContext
+	component      string
+	fields         map[string]interface{}
+	lock           sync.Mutex
+	built          bool
+	gen            uint64
+	loggerOverride logger.CtxLogger
+	logger         logger.CtxLogger
+	metricsClient  metrics.MetricsClient
+	rollbarClient  rollbar.Client
+	// set by SetMetricsClient and SetRollbarClient
+	metricsOverride metrics.MetricsClient
+	rollbarOverride rollbar.Client
+}
+
+var errChildClose = errors.New("Only the parent app context can be closed, not one from WithFields or WithComponent")
+
+func newChildAppContext(base *baseAppContext, component string, fields map[string]interface{}) *childAppContext {
+	return &childAppContext{
+		baseAppContext: base,
+		component:      component,
+		fields:         fields,
+	}
+}
+
+// must be called with lock held
+func (self *childAppContext) refresh() {
+	gen := self.baseAppContext.generation()
+	if self.built && gen == self.gen {
+		return
+	}
+
+	self.built = true
+	self.gen = gen
+	self.logger = CtxLoggerWithFields(self.baseAppContext.Logger(), self.fields)
+	self.metricsClient = self.baseAppContext.MetricsClient()
+	self.rollbarClient = self.baseAppContext.RollbarClient()
+
+	if self.component != "" {
+		self.metricsClient = &prefixedMetricsClient{
+			inner:  self.metricsClient,
+			prefix: self.component + ".",
+			tags:   map[string]string{"component": self.component},
+		}
+	}
+
+	if len(self.fields) > 0 {
+		self.rollbarClient = &customRollbarClient{
+			Client: self.rollbarClient,
+			custom: rollbar.CustomInfo(self.fields),
+		}
+	}
+}
+
+func (self *childAppContext) Logger() logger.CtxLogger {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.loggerOverride != nil {
+		return self.loggerOverride
+	}
+	self.refresh()
+	return self.logger
+}
+
+// SetLogger replaces the logger for this child only
+func (self *childAppContext) SetLogger(logger logger.CtxLogger) AppContext {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.loggerOverride = logger
+	return self
+}
+
+func (self *childAppContext) MetricsClient() metrics.MetricsClient {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.metricsOverride != nil {
+		return self.metricsOverride
+	}
+	self.refresh()
+	return self.metricsClient
+}
+
+// SetMetricsClient replaces the metrics client for this child only
+func (self *childAppContext) SetMetricsClient(client metrics.MetricsClient) AppContext {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.metricsOverride = client
+	return self
+}
+
+func (self *childAppContext) RollbarClient() rollbar.Client {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.rollbarOverride != nil {
+		return self.rollbarOverride
+	}
+	self.refresh()
+	return self.rollbarClient
+}
+
+// SetRollbarClient replaces the rollbar client for this child only
+func (self *childAppContext) SetRollbarClient(client rollbar.Client) AppContext {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.rollbarOverride = client
+	return self
+}
+
+// Close doesn't close anything: the parent's subsystems are shared with
+// every other child
+func (self *childAppContext) Close() error {
+	return errChildClose
+}
+
+func (self *childAppContext) WithFields(fields map[string]interface{}) AppContext {
+	return newChildAppContext(
+		self.baseAppContext,
+		self.component,
+		mergeFields(self.fields, fields),
+	)
+}
+
+func (self *childAppContext) WithComponent(component string) AppContext {
+	if self.component != "" {
+		component = self.component + "." + component
+	}
+	return newChildAppContext(
+		self.baseAppContext,
+		component,
+		mergeFields(self.fields, map[string]interface{}{"component": component}),
+	)
+}
+
+// WithFields returns a derived context whose logger and rollbar
+// notifications carry fields. Metrics are unchanged, to keep tag
+// cardinality under control.
+func (self *baseAppContext) WithFields(fields map[string]interface{}) AppContext {
+	return newChildAppContext(self, "", mergeFields(nil, fields))
+}
+
+// WithComponent returns a derived context for a component of the app: logs
+// and rollbar notifications get a component field, and metrics are
+// namespaced under the component and tagged with it.
+func (self *baseAppContext) WithComponent(component string) AppContext {
+	return newChildAppContext(
+		self,
+		component,
+		map[string]interface{}{"component": component},
+	)
+}
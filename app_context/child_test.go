@@ -0,0 +1,158 @@
+package app_context
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/comstud/go-rollbar/rollbar"
+	"github.com/tilteng/go-logger/logger"
+	"github.com/tilteng/go-metrics/metrics"
+)
+
+func TestWithFieldsLogger(t *testing.T) {
+	app_ctx, err := NewAppContext("child_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	buf := &bytes.Buffer{}
+	app_ctx.SetLogger(logger.NewDefaultCtxLogger(NewLevelLogger(buf, LogLevelDebug, true)))
+
+	child := app_ctx.WithComponent("worker").WithFields(map[string]interface{}{"queue": "emails"})
+	child.Logger().LogInfo(context.Background(), "started")
+
+	entry := map[string]interface{}{}
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("Log line isn't JSON: %s: %s", err, buf.String())
+	}
+
+	if entry["component"] != "worker" || entry["queue"] != "emails" || entry["msg"] != "started" {
+		t.Errorf("Fields missing from log entry: %+v", entry)
+	}
+
+	if err := child.SetLogLevel(LogLevelError); err != nil {
+		t.Fatal(err)
+	}
+
+	buf.Reset()
+	child.Logger().LogInfo(context.Background(), "hidden")
+	app_ctx.Logger().LogInfo(context.Background(), "hidden")
+	if buf.Len() != 0 {
+		t.Errorf("Level change isn't shared between parent and child: %s", buf.String())
+	}
+}
+
+func TestWithFieldsFallbackLogger(t *testing.T) {
+	app_ctx, err := NewAppContext("child_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	buf := &bytes.Buffer{}
+	app_ctx.SetLogger(logger.NewDefaultCtxLogger(logger.NewDefaultLogger(buf, "")))
+
+	app_ctx.WithFields(map[string]interface{}{"a": 1}).Logger().LogInfof(context.Background(), "n=%d", 2)
+
+	if !strings.HasSuffix(buf.String(), "[INFO] [a=1] n=2\n") {
+		t.Errorf("Unexpected log line: %s", buf.String())
+	}
+}
+
+func TestWithComponentMetricsAndRollbar(t *testing.T) {
+	app_ctx, err := NewAppContext("child_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	child := app_ctx.WithComponent("worker")
+
+	ns := app_ctx.MetricsClient().GetNamespace()
+	if s := child.MetricsClient().GetNamespace(); s != ns+"worker." {
+		t.Errorf("Child namespace is not %sworker.: %s", ns, s)
+	}
+
+	if tags := child.MetricsClient().GetTags(); tags["component"] != "worker" {
+		t.Errorf("Child metrics missing component tag: %+v", tags)
+	}
+
+	if _, ok := app_ctx.MetricsClient().GetTags()["component"]; ok {
+		t.Error("Parent metrics tags were modified")
+	}
+
+	notif := child.RollbarClient().NewMessageNotification(rollbar.LV_INFO, "hi", nil)
+	if notif.GetCustom()["component"] != "worker" {
+		t.Errorf("Rollbar custom data missing component: %+v", notif.GetCustom())
+	}
+
+	if nested := child.WithComponent("emails"); nested.MetricsClient().GetNamespace() != ns+"worker.emails." {
+		t.Errorf("Nested component namespace is wrong: %s", nested.MetricsClient().GetNamespace())
+	}
+
+	if child.AppName() != "child_test" {
+		t.Error("Child doesn't share the parent's settings")
+	}
+}
+
+func TestChildFollowsComponentSwap(t *testing.T) {
+	app_ctx, err := NewAppContext("child_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	child := app_ctx.WithComponent("worker")
+	child.MetricsClient()
+
+	new_client := metrics.NewNOOPClient()
+	new_client.SetNamespace("swapped.")
+	app_ctx.SetMetricsClient(new_client)
+
+	if ns := child.MetricsClient().GetNamespace(); ns != "swapped.worker." {
+		t.Errorf("Child didn't pick up swapped metrics client: %s", ns)
+	}
+}
+
+func TestChildSettersAndClose(t *testing.T) {
+	app_ctx, err := NewAppContext("child_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer app_ctx.Close()
+
+	child := app_ctx.WithComponent("worker")
+	if err := child.Close(); err == nil {
+		t.Error("Expected closing a child to fail")
+	}
+	if app_ctx.Scheduler().Every("still_running", time.Hour, func(context.Context) error { return nil }) != nil {
+		t.Error("Closing a child stopped the parent's scheduler")
+	}
+
+	// Only this child's clients change
+	mcli := newCountingMetricsClient()
+	child.SetMetricsClient(mcli)
+	child.MetricsClient().Incr("runs", 1.0, nil)
+	app_ctx.MetricsClient().Incr("runs", 1.0, nil)
+	app_ctx.WithComponent("other").MetricsClient().Incr("runs", 1.0, nil)
+	if mcli.count("runs") != 1 {
+		t.Errorf("Expected only the child to use its metrics client, got %v", mcli.counts)
+	}
+	rcli := &capturingRollbarClient{Client: rollbar.NewNOOPClient()}
+	if child.SetRollbarClient(rcli); child.RollbarClient() != rcli || app_ctx.RollbarClient() == rcli {
+		t.Error("Expected only the child to use its rollbar client")
+	}
+
+	// Everything else is shared with the parent
+	db, err := app_ctx.(*baseAppContext).openDB("appctx_fake", "", "primary")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	child.SetDB(db)
+	if app_ctx.DB() != db {
+		t.Error("Expected SetDB on a child to set the parent's database")
+	}
+}
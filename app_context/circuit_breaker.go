@@ -0,0 +1,364 @@
+package app_context
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type BreakerState int
+
+const (
+	BreakerClosed BreakerState = iota
+	BreakerHalfOpen
+	BreakerOpen
+)
+
+func (self BreakerState) String() string {
+	switch self {
+	case BreakerClosed:
+		return "closed"
+	case BreakerHalfOpen:
+		return "half_open"
+	case BreakerOpen:
+		return "open"
+	}
+	return fmt.Sprintf("BreakerState(%d)", int(self))
+}
+
+var ErrBreakerOpen = errors.New("Circuit breaker is open")
+
+// CircuitBreaker stops calls to a dependency after a run of consecutive
+// errors. Once the open timeout has passed, a few trial calls are let
+// through: if they all succeed the breaker closes, and any failure opens it
+// again.
+type CircuitBreaker interface {
+	Name() string
+	State() BreakerState
+	// Allow returns ErrBreakerOpen if the call shouldn't be made.
+	// Otherwise done must be called with the call's result.
+	Allow() (done func(err error), err error)
+	// Do calls fn if the breaker allows it and records its result
+	Do(fn func() error) error
+}
+
+type BreakerStatus struct {
+	Name        string        `json:"name"`
+	State       string        `json:"state"`
+	Failures    int           `json:"failures"`
+	OpenedAt    time.Time     `json:"opened_at,omitempty"`
+	Threshold   int           `json:"threshold"`
+	OpenTimeout time.Duration `json:"open_timeout"`
+}
+
+// CircuitBreakerRegistry hands out one breaker per downstream dependency.
+// Thresholds come from CIRCUIT_BREAKER_FAILURES, CIRCUIT_BREAKER_OPEN_TIMEOUT
+// and CIRCUIT_BREAKER_HALF_OPEN_REQUESTS, each of which can be overridden
+// per breaker as CIRCUIT_BREAKER_<NAME>_FAILURES and so on, where <NAME> is
+// the breaker name uppercased with anything other than letters and digits
+// replaced by _.
+type CircuitBreakerRegistry interface {
+	Get(name string) CircuitBreaker
+	Status() []*BreakerStatus
+}
+
+type circuitBreaker struct {
+	registry         *circuitBreakerRegistry
+	name             string
+	threshold        int
+	openTimeout      time.Duration
+	halfOpenRequests int
+
+	lock     sync.Mutex
+	state    BreakerState
+	failures int
+	openedAt time.Time
+	// trials in flight and succeeded while half open
+	trials    int
+	successes int
+}
+
+func (self *circuitBreaker) Name() string {
+	return self.name
+}
+
+func (self *circuitBreaker) State() BreakerState {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.maybeHalfOpen()
+	return self.state
+}
+
+// must be called with lock held
+func (self *circuitBreaker) setState(state BreakerState) {
+	if state == self.state {
+		return
+	}
+	old := self.state
+	self.state = state
+	self.trials = 0
+	self.successes = 0
+	if state == BreakerOpen {
+		self.openedAt = self.registry.now()
+	}
+	if state == BreakerClosed {
+		self.failures = 0
+	}
+	self.registry.stateChanged(self, old, state)
+}
+
+// must be called with lock held
+func (self *circuitBreaker) maybeHalfOpen() {
+	if self.state == BreakerOpen && self.registry.now().Sub(self.openedAt) >= self.openTimeout {
+		self.setState(BreakerHalfOpen)
+	}
+}
+
+func (self *circuitBreaker) Allow() (func(err error), error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	self.maybeHalfOpen()
+
+	switch self.state {
+	case BreakerOpen:
+		return nil, ErrBreakerOpen
+	case BreakerHalfOpen:
+		if self.trials >= self.halfOpenRequests {
+			return nil, ErrBreakerOpen
+		}
+		self.trials++
+	}
+
+	state := self.state
+	return func(err error) {
+		self.record(state, err)
+	}, nil
+}
+
+func (self *circuitBreaker) record(allowed_in BreakerState, err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	// The breaker has moved on since this call was allowed
+	if allowed_in != self.state {
+		return
+	}
+
+	if err != nil {
+		self.failures++
+		if self.state == BreakerHalfOpen || self.failures >= self.threshold {
+			self.setState(BreakerOpen)
+		}
+		return
+	}
+
+	if self.state == BreakerHalfOpen {
+		self.successes++
+		if self.successes >= self.halfOpenRequests {
+			self.setState(BreakerClosed)
+		}
+		return
+	}
+	self.failures = 0
+}
+
+func (self *circuitBreaker) Do(fn func() error) error {
+	done, err := self.Allow()
+	if err != nil {
+		return err
+	}
+	err = fn()
+	done(err)
+	return err
+}
+
+func (self *circuitBreaker) status() *BreakerStatus {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.maybeHalfOpen()
+	return &BreakerStatus{
+		Name:        self.name,
+		State:       self.state.String(),
+		Failures:    self.failures,
+		OpenedAt:    self.openedAt,
+		Threshold:   self.threshold,
+		OpenTimeout: self.openTimeout,
+	}
+}
+
+type circuitBreakerRegistry struct {
+	appctx   *baseAppContext
+	now      func() time.Time
+	lock     sync.Mutex
+	breakers map[string]*circuitBreaker
+}
+
+func (self *circuitBreakerRegistry) stateChanged(breaker *circuitBreaker, old, state BreakerState) {
+	log := self.appctx.Logger().LogInfof
+	if state == BreakerOpen {
+		log = self.appctx.Logger().LogWarnf
+	}
+	log(context.Background(), "Circuit breaker '%s' changed from %s to %s", breaker.name, old, state)
+
+	self.appctx.MetricsClient().Gauge(
+		"circuit_breaker.state",
+		float64(state),
+		1.0,
+		map[string]string{"breaker": breaker.name},
+	)
+}
+
+// envName turns a breaker or limiter name into the part of an env var name
+// that identifies it
+func envName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' {
+			return r - 'a' + 'A'
+		}
+		if (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// breakerSetting looks up CIRCUIT_BREAKER_<NAME>_<setting>, then
+// CIRCUIT_BREAKER_<setting>
+func (self *circuitBreakerRegistry) breakerSetting(name, setting string) string {
+	if val, found := self.appctx.lookupEnv("CIRCUIT_BREAKER_" + envName(name) + "_" + setting); found {
+		return val
+	}
+	return self.appctx.getEnv("CIRCUIT_BREAKER_" + setting)
+}
+
+func (self *circuitBreakerRegistry) newBreaker(name string) *circuitBreaker {
+	breaker := &circuitBreaker{
+		registry:         self,
+		name:             name,
+		threshold:        5,
+		openTimeout:      30 * time.Second,
+		halfOpenRequests: 1,
+	}
+
+	// Bad values are logged rather than failing the caller, which has no
+	// way to handle them
+	log_invalid := func(setting, val string) {
+		self.appctx.Logger().LogErrorf(
+			context.Background(),
+			"Ignoring invalid %s '%s' for circuit breaker '%s'",
+			setting, val, name,
+		)
+	}
+	if val := self.breakerSetting(name, "FAILURES"); val != "" {
+		if n, err := parsePositiveInt(val); err != nil {
+			log_invalid("FAILURES", val)
+		} else {
+			breaker.threshold = n
+		}
+	}
+	if val := self.breakerSetting(name, "OPEN_TIMEOUT"); val != "" {
+		if d, err := time.ParseDuration(val); err != nil || d <= 0 {
+			log_invalid("OPEN_TIMEOUT", val)
+		} else {
+			breaker.openTimeout = d
+		}
+	}
+	if val := self.breakerSetting(name, "HALF_OPEN_REQUESTS"); val != "" {
+		if n, err := parsePositiveInt(val); err != nil {
+			log_invalid("HALF_OPEN_REQUESTS", val)
+		} else {
+			breaker.halfOpenRequests = n
+		}
+	}
+
+	// FAILURES and OPEN_TIMEOUT can be tuned at runtime per breaker,
+	// reverting to the values above
+	if tun := self.appctx.tunables; tun != nil {
+		threshold, open_timeout := breaker.threshold, breaker.openTimeout
+		failures_param := "CIRCUIT_BREAKER_" + envName(name) + "_FAILURES"
+		timeout_param := "CIRCUIT_BREAKER_" + envName(name) + "_OPEN_TIMEOUT"
+		tun.Declare(failures_param, func() {
+			n := tun.Int(failures_param, threshold)
+			breaker.lock.Lock()
+			defer breaker.lock.Unlock()
+			if breaker.threshold = threshold; n > 0 {
+				breaker.threshold = n
+			}
+		})
+		tun.Declare(timeout_param, func() {
+			d := tun.Duration(timeout_param, open_timeout)
+			breaker.lock.Lock()
+			defer breaker.lock.Unlock()
+			if breaker.openTimeout = open_timeout; d > 0 {
+				breaker.openTimeout = d
+			}
+		})
+	}
+
+	return breaker
+}
+
+func parsePositiveInt(val string) (int, error) {
+	n, err := strconv.Atoi(val)
+	if err != nil {
+		return 0, err
+	}
+	if n < 1 {
+		return 0, errors.New("Must be > 0")
+	}
+	return n, nil
+}
+
+func (self *circuitBreakerRegistry) Get(name string) CircuitBreaker {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	breaker, ok := self.breakers[name]
+	if !ok {
+		breaker = self.newBreaker(name)
+		self.breakers[name] = breaker
+		self.appctx.MetricsClient().Gauge(
+			"circuit_breaker.state",
+			float64(BreakerClosed),
+			1.0,
+			map[string]string{"breaker": name},
+		)
+	}
+	return breaker
+}
+
+func (self *circuitBreakerRegistry) Status() []*BreakerStatus {
+	self.lock.Lock()
+	breakers := make([]*circuitBreaker, 0, len(self.breakers))
+	for _, breaker := range self.breakers {
+		breakers = append(breakers, breaker)
+	}
+	self.lock.Unlock()
+
+	statuses := make([]*BreakerStatus, len(breakers))
+	for i, breaker := range breakers {
+		statuses[i] = breaker.status()
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Name < statuses[j].Name
+	})
+	return statuses
+}
+
+func (self *baseAppContext) CircuitBreakers() CircuitBreakerRegistry {
+	return self.circuitBreakers
+}
+
+func newCircuitBreakerRegistry(appctx *baseAppContext) *circuitBreakerRegistry {
+	return &circuitBreakerRegistry{
+		appctx:   appctx,
+		now:      appctx.now,
+		breakers: make(map[string]*circuitBreaker),
+	}
+}
@@ -0,0 +1,89 @@
+package app_context
+
+import (
+	"errors"
+	"log"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	os.Setenv("CIRCUIT_BREAKER_FAILURES", "2")
+	os.Setenv("CIRCUIT_BREAKER_PAYMENTS_API_OPEN_TIMEOUT", "1m")
+	defer os.Unsetenv("CIRCUIT_BREAKER_FAILURES")
+	defer os.Unsetenv("CIRCUIT_BREAKER_PAYMENTS_API_OPEN_TIMEOUT")
+
+	app_ctx, err := NewAppContext("circuit_breaker_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer app_ctx.Close()
+
+	now := time.Now()
+	registry := app_ctx.CircuitBreakers().(*circuitBreakerRegistry)
+	registry.now = func() time.Time { return now }
+
+	breaker := registry.Get("payments-api")
+	if registry.Get("payments-api") != breaker {
+		t.Errorf("Expected Get to return the same breaker")
+	}
+
+	fail := errors.New("down")
+	failing := func() error { return fail }
+	calls := 0
+	succeeding := func() error {
+		calls++
+		return nil
+	}
+
+	if err := breaker.Do(failing); err != fail {
+		t.Errorf("Expected the call's error, got %v", err)
+	}
+	if breaker.State() != BreakerClosed {
+		t.Errorf("Expected closed after 1 failure, got %s", breaker.State())
+	}
+	breaker.Do(failing)
+	if breaker.State() != BreakerOpen {
+		t.Errorf("Expected open after 2 failures, got %s", breaker.State())
+	}
+	if err := breaker.Do(succeeding); err != ErrBreakerOpen || calls != 0 {
+		t.Errorf("Expected ErrBreakerOpen without calling, got %v", err)
+	}
+
+	// Only one trial at a time while half open
+	now = now.Add(time.Minute)
+	if breaker.State() != BreakerHalfOpen {
+		t.Errorf("Expected half_open after the timeout, got %s", breaker.State())
+	}
+	done, err := breaker.Allow()
+	if err != nil {
+		t.Fatalf("Expected a trial call to be allowed: %s", err)
+	}
+	if _, err := breaker.Allow(); err != ErrBreakerOpen {
+		t.Errorf("Expected a second trial to be refused, got %v", err)
+	}
+	done(fail)
+	if breaker.State() != BreakerOpen {
+		t.Errorf("Expected a failed trial to reopen, got %s", breaker.State())
+	}
+
+	now = now.Add(time.Minute)
+	if err := breaker.Do(succeeding); err != nil || calls != 1 {
+		t.Errorf("Expected the trial call to run, got %v", err)
+	}
+	if breaker.State() != BreakerClosed {
+		t.Errorf("Expected a successful trial to close, got %s", breaker.State())
+	}
+
+	// The per-breaker override only applies to payments-api
+	other := registry.Get("search").(*circuitBreaker)
+	if other.threshold != 2 || other.openTimeout != 30*time.Second {
+		t.Errorf("Unexpected settings for search: %d, %s", other.threshold, other.openTimeout)
+	}
+
+	statuses := registry.Status()
+	if len(statuses) != 2 || statuses[0].Name != "payments-api" || statuses[0].OpenTimeout != time.Minute {
+		t.Errorf("Unexpected status: %+v", statuses)
+	}
+}
@@ -0,0 +1,300 @@
+package app_context
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// CLIFunc is a command's action, given the arguments after its name
+type CLIFunc func(ctx context.Context, appctx AppContext, args []string) error
+
+// CLICommand is a node in a CLI's command tree. A command with Subcommands
+// and no Run only groups them, like "jobs".
+type CLICommand struct {
+	Name string
+	// Args is shown after the name in the usage, eg. "<name>"
+	Args        string
+	Usage       string
+	Run         CLIFunc
+	Subcommands []*CLICommand
+	// NoAppContext commands are run without creating the app context,
+	// with a nil AppContext
+	NoAppContext bool
+}
+
+func (self *CLICommand) find(name string) *CLICommand {
+	for _, cmd := range self.Subcommands {
+		if cmd.Name == name {
+			return cmd
+		}
+	}
+	return nil
+}
+
+// CLIJobFunc is a job or seed function. It's given the app context because
+// it's only created once the command runs.
+type CLIJobFunc func(ctx context.Context, appctx AppContext) error
+
+type cliJob struct {
+	spec string
+	fn   CLIJobFunc
+}
+
+// CLI is a service's command line, replacing a main.go switch on os.Args
+// with the same operational commands everywhere:
+//
+//	serve            runs the service, the default without a command
+//	migrate [dir]    applies migrations from dir, MIGRATIONS_DIR or "migrations"
+//	selftest         runs SelfTest
+//	preflight        checks the configured dependencies can be reached
+//	seed             runs the function given to Seed
+//	jobs list        lists the jobs given to Job
+//	jobs run <name>  runs one of them once, now
+//
+// Usage:
+//
+//	cli := app_context.NewCLI("myapp").Serve(serve)
+//	cli.Job("cleanup", "0 3 * * *", cleanup)
+//	os.Exit(cli.Main(os.Args[1:]))
+//
+// Each command creates the app context, runs and closes it like Run.
+type CLI struct {
+	Stdout io.Writer
+	Stderr io.Writer
+
+	appName string
+	opts    []Option
+	root    *CLICommand
+	serve   RunFunc
+	seed    CLIJobFunc
+	jobs    map[string]cliJob
+}
+
+func NewCLI(app_name string, opts ...Option) *CLI {
+	cli := &CLI{
+		Stdout:  os.Stdout,
+		Stderr:  os.Stderr,
+		appName: app_name,
+		opts:    opts,
+		root:    &CLICommand{Name: app_name},
+		jobs:    make(map[string]cliJob),
+	}
+	cli.root.Subcommands = []*CLICommand{
+		{Name: "serve", Usage: "Run the service", Run: cli.runServe},
+		{Name: "migrate", Args: "[dir]", Usage: "Apply database migrations", Run: cli.runMigrate},
+		{Name: "selftest", Usage: "Check the service works end to end", Run: cli.runSelfTest},
+		{Name: "preflight", Usage: "Check the configured dependencies can be reached", Run: cli.runPreflight, NoAppContext: true},
+		{Name: "seed", Usage: "Load seed data", Run: cli.runSeed},
+		{Name: "jobs", Usage: "Run jobs by hand", Subcommands: []*CLICommand{
+			{Name: "list", Usage: "List jobs", Run: cli.runJobsList, NoAppContext: true},
+			{Name: "run", Args: "<name>", Usage: "Run a job once", Run: cli.runJobsRun},
+		}},
+	}
+	return cli
+}
+
+// Serve sets what the serve command runs
+func (self *CLI) Serve(fn RunFunc) *CLI {
+	self.serve = fn
+	return self
+}
+
+// Seed sets what the seed command runs
+func (self *CLI) Seed(fn CLIJobFunc) *CLI {
+	self.seed = fn
+	return self
+}
+
+// Job adds a job "jobs run" can run. With a cron spec, serve also adds it
+// to the Scheduler.
+func (self *CLI) Job(name, spec string, fn CLIJobFunc) *CLI {
+	self.jobs[name] = cliJob{spec: spec, fn: fn}
+	return self
+}
+
+// Command adds cmd to the top of the tree, replacing a built in command
+// with the same name
+func (self *CLI) Command(cmd *CLICommand) *CLI {
+	for i, existing := range self.root.Subcommands {
+		if existing.Name == cmd.Name {
+			self.root.Subcommands[i] = cmd
+			return self
+		}
+	}
+	self.root.Subcommands = append(self.root.Subcommands, cmd)
+	return self
+}
+
+func (self *CLI) usage(path []string, cmd *CLICommand) {
+	fmt.Fprintf(self.Stderr, "Usage: %s <command> [args]\n\nCommands:\n", strings.Join(path, " "))
+	var lines [][2]string
+	var walk func(prefix string, cmds []*CLICommand)
+	walk = func(prefix string, cmds []*CLICommand) {
+		for _, sub := range cmds {
+			name := strings.TrimSpace(prefix + " " + sub.Name)
+			if sub.Run != nil {
+				lines = append(lines, [2]string{strings.TrimSpace(name + " " + sub.Args), sub.Usage})
+			}
+			walk(name, sub.Subcommands)
+		}
+	}
+	walk("", cmd.Subcommands)
+
+	width := 0
+	for _, line := range lines {
+		if len(line[0]) > width {
+			width = len(line[0])
+		}
+	}
+	for _, line := range lines {
+		fmt.Fprintf(self.Stderr, "  %-*s  %s\n", width, line[0], line[1])
+	}
+}
+
+// Main runs the command named by args, returning a process exit code
+func (self *CLI) Main(args []string) int {
+	if len(args) == 0 {
+		args = []string{"serve"}
+	}
+
+	path := []string{self.appName}
+	cmd := self.root
+	for len(args) > 0 && len(cmd.Subcommands) > 0 {
+		if args[0] == "help" || args[0] == "-h" || args[0] == "--help" {
+			self.usage(path, cmd)
+			return 0
+		}
+		sub := cmd.find(args[0])
+		if sub == nil {
+			fmt.Fprintf(self.Stderr, "Unknown command: %s\n", strings.Join(append(path[1:], args[0]), " "))
+			self.usage(path, cmd)
+			return 2
+		}
+		path = append(path, sub.Name)
+		cmd, args = sub, args[1:]
+	}
+	if cmd.Run == nil {
+		self.usage(path, cmd)
+		return 2
+	}
+
+	ctx := context.Background()
+	if cmd.NoAppContext {
+		if err := cmd.Run(ctx, nil, args); err != nil {
+			fmt.Fprintf(self.Stderr, "%s\n", err)
+			return 1
+		}
+		return 0
+	}
+
+	appctx, err := NewAppContext(self.appName, self.opts...)
+	if err != nil {
+		fmt.Fprintf(self.Stderr, "Error creating app context: %s\n", err)
+		return 1
+	}
+
+	defer appctx.Close()
+	defer appctx.HandleCrash()
+
+	if err := cmd.Run(ctx, appctx, args); err != nil {
+		appctx.Logger().LogError(ctx, err)
+		return 1
+	}
+	return 0
+}
+
+func (self *CLI) runServe(ctx context.Context, appctx AppContext, args []string) error {
+	if self.serve == nil {
+		return fmt.Errorf("%s has nothing to serve", self.appName)
+	}
+	names := make([]string, 0, len(self.jobs))
+	for name := range self.jobs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		job := self.jobs[name]
+		if job.spec == "" {
+			continue
+		}
+		fn := func(ctx context.Context) error { return job.fn(ctx, appctx) }
+		if err := appctx.Scheduler().Cron(name, job.spec, fn); err != nil {
+			return fmt.Errorf("Error scheduling job '%s': %s", name, err)
+		}
+	}
+	return self.serve(appctx)
+}
+
+func (self *CLI) runMigrate(ctx context.Context, appctx AppContext, args []string) error {
+	dir := appctx.(*baseAppContext).migrationsDir()
+	if len(args) > 0 {
+		dir = args[0]
+	}
+	if err := appctx.MigrateDB(dir); err != nil {
+		return err
+	}
+	version, err := appctx.MigrationVersion()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(self.Stdout, "Database is at version %d\n", version)
+	return nil
+}
+
+func (self *CLI) runSelfTest(ctx context.Context, appctx AppContext, args []string) error {
+	return appctx.SelfTest(ctx)
+}
+
+func (self *CLI) runPreflight(ctx context.Context, appctx AppContext, args []string) error {
+	if code := runPreflight(self.appName, self.Stdout, self.opts...); code != 0 {
+		return errors.New("Preflight failed")
+	}
+	return nil
+}
+
+func (self *CLI) runSeed(ctx context.Context, appctx AppContext, args []string) error {
+	if self.seed == nil {
+		return fmt.Errorf("%s has no seed data", self.appName)
+	}
+	return self.seed(ctx, appctx)
+}
+
+func (self *CLI) runJobsList(ctx context.Context, appctx AppContext, args []string) error {
+	names := make([]string, 0, len(self.jobs))
+	for name := range self.jobs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		spec := self.jobs[name].spec
+		if spec == "" {
+			spec = "-"
+		}
+		fmt.Fprintf(self.Stdout, "%s\t%s\n", name, spec)
+	}
+	return nil
+}
+
+func (self *CLI) runJobsRun(ctx context.Context, appctx AppContext, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("Usage: %s jobs run <name>", self.appName)
+	}
+	job, ok := self.jobs[args[0]]
+	if !ok {
+		return fmt.Errorf("Unknown job '%s'", args[0])
+	}
+
+	start := time.Now()
+	appctx.Logger().LogInfof(ctx, "Running job '%s'", args[0])
+	if err := job.fn(ctx, appctx); err != nil {
+		return fmt.Errorf("Job '%s' failed after %s: %s", args[0], time.Since(start), err)
+	}
+	appctx.Logger().LogInfof(ctx, "Job '%s' finished in %s", args[0], time.Since(start))
+	return nil
+}
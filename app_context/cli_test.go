@@ -0,0 +1,83 @@
+package app_context
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestCLI(t *testing.T) {
+	var ran []string
+	var stdout, stderr bytes.Buffer
+
+	cli := NewCLI("cli_test").Serve(func(appctx AppContext) error {
+		ran = append(ran, "serve")
+		for _, job := range appctx.Scheduler().Jobs() {
+			ran = append(ran, "scheduled "+job.Name)
+		}
+		return nil
+	})
+	cli.Stdout, cli.Stderr = &stdout, &stderr
+	cli.Job("cleanup", "0 3 * * *", func(ctx context.Context, appctx AppContext) error {
+		ran = append(ran, "cleanup")
+		return nil
+	})
+	cli.Job("reindex", "", func(ctx context.Context, appctx AppContext) error {
+		return errors.New("reindex failed")
+	})
+	cli.Seed(func(ctx context.Context, appctx AppContext) error {
+		ran = append(ran, "seed")
+		return nil
+	})
+	cli.Command(&CLICommand{
+		Name: "users",
+		Subcommands: []*CLICommand{{
+			Name: "count",
+			Run: func(ctx context.Context, appctx AppContext, args []string) error {
+				ran = append(ran, "users count "+strings.Join(args, " "))
+				return nil
+			},
+		}},
+	})
+
+	if code := cli.Main(nil); code != 0 {
+		t.Errorf("Expected serve to succeed, got %d", code)
+	}
+	if code := cli.Main([]string{"jobs", "run", "cleanup"}); code != 0 {
+		t.Errorf("Expected the job to succeed, got %d", code)
+	}
+	if code := cli.Main([]string{"seed"}); code != 0 {
+		t.Errorf("Expected seed to succeed, got %d", code)
+	}
+	if code := cli.Main([]string{"users", "count", "--active"}); code != 0 {
+		t.Errorf("Expected the custom command to succeed, got %d", code)
+	}
+	if joined := strings.Join(ran, ","); joined != "serve,scheduled cleanup,cleanup,seed,users count --active" {
+		t.Errorf("Unexpected runs: %s", joined)
+	}
+
+	if code := cli.Main([]string{"jobs", "run", "reindex"}); code != 1 {
+		t.Errorf("Expected a failed job to exit 1, got %d", code)
+	}
+	if code := cli.Main([]string{"jobs", "run", "missing"}); code != 1 {
+		t.Errorf("Expected an unknown job to exit 1, got %d", code)
+	}
+
+	if code := cli.Main([]string{"jobs", "list"}); code != 0 || stdout.String() != "cleanup\t0 3 * * *\nreindex\t-\n" {
+		t.Errorf("Unexpected jobs list: %d %q", code, stdout.String())
+	}
+
+	if code := cli.Main([]string{"deploy"}); code != 2 || !strings.Contains(stderr.String(), "Unknown command: deploy") {
+		t.Errorf("Expected an unknown command to exit 2, got %d: %s", code, stderr.String())
+	}
+	stderr.Reset()
+	if code := cli.Main([]string{"help"}); code != 0 || !strings.Contains(stderr.String(), "  jobs run <name>  ") || !strings.Contains(stderr.String(), "users count") {
+		t.Errorf("Unexpected usage: %s", stderr.String())
+	}
+	stderr.Reset()
+	if code := cli.Main([]string{"jobs"}); code != 2 || !strings.Contains(stderr.String(), "Usage: cli_test jobs <command>") {
+		t.Errorf("Expected the jobs usage, got %d: %s", code, stderr.String())
+	}
+}
@@ -0,0 +1,264 @@
+package app_context
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock is where the package's schedules, tickers, retry backoffs and
+// expiries get the time from. It's the real clock unless SetClock swaps
+// in another, like a FakeClock in tests.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+	AfterFunc(d time.Duration, fn func()) Timer
+	NewTimer(d time.Duration) Timer
+	NewTicker(d time.Duration) Ticker
+}
+
+type Timer interface {
+	// C is nil for timers from AfterFunc
+	C() <-chan time.Time
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+type realClock struct{}
+
+type realTimer struct {
+	*time.Timer
+}
+
+func (self realTimer) C() <-chan time.Time {
+	return self.Timer.C
+}
+
+type realTicker struct {
+	*time.Ticker
+}
+
+func (self realTicker) C() <-chan time.Time {
+	return self.Ticker.C
+}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func (realClock) AfterFunc(d time.Duration, fn func()) Timer {
+	return realTimer{time.AfterFunc(d, fn)}
+}
+
+func (realClock) NewTimer(d time.Duration) Timer {
+	return realTimer{time.NewTimer(d)}
+}
+
+func (realClock) NewTicker(d time.Duration) Ticker {
+	return realTicker{time.NewTicker(d)}
+}
+
+func NewRealClock() Clock {
+	return realClock{}
+}
+
+// FakeClock only moves when Advance or Set is called, firing whatever
+// timers and tickers came due in order. Like the real ones, channels hold
+// one pending tick and drop the rest.
+type FakeClock struct {
+	lock    sync.Mutex
+	cond    *sync.Cond
+	now     time.Time
+	waiters []*fakeWaiter
+}
+
+type fakeWaiter struct {
+	at     time.Time
+	period time.Duration
+	ch     chan time.Time
+	fn     func()
+}
+
+func NewFakeClock(now time.Time) *FakeClock {
+	clock := &FakeClock{now: now}
+	clock.cond = sync.NewCond(&clock.lock)
+	return clock
+}
+
+func (self *FakeClock) Now() time.Time {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.now
+}
+
+// Advance moves the clock forward by d
+func (self *FakeClock) Advance(d time.Duration) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.setLocked(self.now.Add(d))
+}
+
+// Set moves the clock to now, which shouldn't be before the current time
+func (self *FakeClock) Set(now time.Time) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.setLocked(now)
+}
+
+func (self *FakeClock) setLocked(now time.Time) {
+	for {
+		sort.SliceStable(self.waiters, func(i, j int) bool {
+			return self.waiters[i].at.Before(self.waiters[j].at)
+		})
+		if len(self.waiters) == 0 || self.waiters[0].at.After(now) {
+			break
+		}
+
+		w := self.waiters[0]
+		self.now = w.at
+		if w.period > 0 {
+			w.at = w.at.Add(w.period)
+		} else {
+			self.waiters = self.waiters[1:]
+		}
+
+		if w.fn != nil {
+			go w.fn()
+		} else {
+			select {
+			case w.ch <- self.now:
+			default:
+			}
+		}
+	}
+	self.now = now
+	self.cond.Broadcast()
+}
+
+// BlockUntil waits until at least n timers and tickers are waiting on the
+// clock, so a test can be sure a goroutine is asleep before advancing.
+func (self *FakeClock) BlockUntil(n int) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for len(self.waiters) < n {
+		self.cond.Wait()
+	}
+}
+
+func (self *FakeClock) addLocked(w *fakeWaiter) {
+	self.waiters = append(self.waiters, w)
+	self.cond.Broadcast()
+}
+
+func (self *FakeClock) removeLocked(w *fakeWaiter) bool {
+	for i, other := range self.waiters {
+		if other == w {
+			self.waiters = append(self.waiters[:i], self.waiters[i+1:]...)
+			self.cond.Broadcast()
+			return true
+		}
+	}
+	return false
+}
+
+func (self *FakeClock) newWaiter(d time.Duration, period time.Duration, fn func()) *fakeWaiter {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	w := &fakeWaiter{at: self.now.Add(d), period: period, fn: fn}
+	if fn == nil {
+		w.ch = make(chan time.Time, 1)
+	}
+	self.addLocked(w)
+	// Fires it now if d <= 0
+	self.setLocked(self.now)
+	return w
+}
+
+func (self *FakeClock) After(d time.Duration) <-chan time.Time {
+	return self.newWaiter(d, 0, nil).ch
+}
+
+func (self *FakeClock) AfterFunc(d time.Duration, fn func()) Timer {
+	return &fakeTimer{clock: self, w: self.newWaiter(d, 0, fn)}
+}
+
+func (self *FakeClock) NewTimer(d time.Duration) Timer {
+	return &fakeTimer{clock: self, w: self.newWaiter(d, 0, nil)}
+}
+
+func (self *FakeClock) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("NewTicker needs a positive interval")
+	}
+	return &fakeTicker{clock: self, w: self.newWaiter(d, d, nil)}
+}
+
+type fakeTimer struct {
+	clock *FakeClock
+	w     *fakeWaiter
+}
+
+func (self *fakeTimer) C() <-chan time.Time {
+	return self.w.ch
+}
+
+func (self *fakeTimer) Stop() bool {
+	self.clock.lock.Lock()
+	defer self.clock.lock.Unlock()
+	return self.clock.removeLocked(self.w)
+}
+
+func (self *fakeTimer) Reset(d time.Duration) bool {
+	self.clock.lock.Lock()
+	defer self.clock.lock.Unlock()
+	active := self.clock.removeLocked(self.w)
+	self.w.at = self.clock.now.Add(d)
+	self.clock.addLocked(self.w)
+	self.clock.setLocked(self.clock.now)
+	return active
+}
+
+type fakeTicker struct {
+	clock *FakeClock
+	w     *fakeWaiter
+}
+
+func (self *fakeTicker) C() <-chan time.Time {
+	return self.w.ch
+}
+
+func (self *fakeTicker) Stop() {
+	self.clock.lock.Lock()
+	defer self.clock.lock.Unlock()
+	self.clock.removeLocked(self.w)
+}
+
+// now is Clock().Now, for the components that take a func
+func (self *baseAppContext) now() time.Time {
+	return self.Clock().Now()
+}
+
+func (self *baseAppContext) Clock() Clock {
+	self.componentsLock.RLock()
+	defer self.componentsLock.RUnlock()
+	return self.clock
+}
+
+// SetClock replaces the clock. Timers already waiting keep using the old
+// one, so set it before starting anything that schedules.
+func (self *baseAppContext) SetClock(clock Clock) AppContext {
+	self.componentsLock.Lock()
+	defer self.componentsLock.Unlock()
+	self.clock = clock
+	return self
+}
@@ -0,0 +1,104 @@
+package app_context
+
+import (
+	"context"
+	"log"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFakeClock(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(start)
+
+	after := clock.After(time.Second)
+	timer := clock.NewTimer(time.Minute)
+	ticker := clock.NewTicker(10 * time.Second)
+	var fired int32
+	clock.AfterFunc(5*time.Second, func() { atomic.StoreInt32(&fired, 1) })
+
+	clock.Advance(999 * time.Millisecond)
+	select {
+	case <-after:
+		t.Error("After fired early")
+	default:
+	}
+
+	clock.Advance(time.Millisecond)
+	select {
+	case at := <-after:
+		if !at.Equal(start.Add(time.Second)) {
+			t.Errorf("Unexpected After time: %s", at)
+		}
+	default:
+		t.Error("After didn't fire")
+	}
+
+	// Ticks that aren't read are dropped, one stays pending
+	clock.Advance(25 * time.Second)
+	if at := <-ticker.C(); !at.Equal(start.Add(10 * time.Second)) {
+		t.Errorf("Unexpected tick: %s", at)
+	}
+	select {
+	case <-ticker.C():
+		t.Error("Expected the second tick to be dropped")
+	default:
+	}
+	waitFor(t, "AfterFunc", func() bool { return atomic.LoadInt32(&fired) == 1 })
+
+	if !timer.Stop() {
+		t.Error("Expected the timer to still be active")
+	}
+	clock.Advance(time.Hour)
+	select {
+	case <-timer.C():
+		t.Error("Stopped timer fired")
+	default:
+	}
+
+	timer.Reset(time.Second)
+	clock.Advance(time.Second)
+	<-timer.C()
+
+	ticker.Stop()
+	if !clock.Now().Equal(start.Add(26*time.Second + time.Hour + time.Second)) {
+		t.Errorf("Unexpected time: %s", clock.Now())
+	}
+}
+
+func TestClockDrivesScheduler(t *testing.T) {
+	app_ctx, err := NewAppContext("clock_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer app_ctx.Close()
+
+	if _, ok := app_ctx.Clock().(realClock); !ok {
+		t.Errorf("Expected the real clock by default")
+	}
+
+	clock := NewFakeClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	app_ctx.SetClock(clock)
+
+	var runs int32
+	err = app_ctx.Scheduler().Every("hourly", time.Hour, func(ctx context.Context) error {
+		atomic.AddInt32(&runs, 1)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clock.BlockUntil(1)
+	if atomic.LoadInt32(&runs) != 0 {
+		t.Error("Job ran before its time")
+	}
+	clock.Advance(time.Hour)
+	waitFor(t, "the job to run", func() bool { return atomic.LoadInt32(&runs) == 1 })
+
+	jobs := app_ctx.Scheduler().Jobs()
+	if !jobs[0].LastRun.Equal(clock.Now()) {
+		t.Errorf("Expected LastRun from the fake clock, got %s", jobs[0].LastRun)
+	}
+}
@@ -0,0 +1,64 @@
+package app_context
+
+import (
+	"database/sql"
+	"log"
+	"sync"
+	"testing"
+
+	"github.com/comstud/go-rollbar/rollbar"
+	"github.com/jmoiron/sqlx"
+	"github.com/tilteng/go-logger/logger"
+	"github.com/tilteng/go-metrics/metrics"
+)
+
+func TestComponentSwapping(t *testing.T) {
+	app_ctx, err := NewAppContext("components_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				app_ctx.Logger()
+				app_ctx.MetricsClient().GetNamespace()
+				app_ctx.RollbarClient()
+				app_ctx.DB()
+			}
+		}()
+	}
+
+	for i := 0; i < 100; i++ {
+		app_ctx.SetLogger(logger.DefaultStdoutCtxLogger())
+		app_ctx.SetMetricsClient(metrics.NewNOOPClient())
+		app_ctx.SetRollbarClient(rollbar.NewNOOPClient())
+		app_ctx.SetDB(nil)
+	}
+
+	close(stop)
+	wg.Wait()
+
+	db := sqlx.NewDb(&sql.DB{}, "postgres")
+	app_ctx.SetDB(db)
+	if app_ctx.DB() != db || app_ctx.DBX() != db {
+		t.Error("SetDB didn't replace the handle returned by DB and DBX")
+	}
+	app_ctx.SetDB(nil)
+
+	client := metrics.NewNOOPClient()
+	app_ctx.SetMetricsClient(client)
+	if app_ctx.MetricsClient() != client {
+		t.Error("SetMetricsClient didn't replace the client")
+	}
+}
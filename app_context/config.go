@@ -0,0 +1,235 @@
+package app_context
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+)
+
+// Values starting with this prefix, in the environment or the config file,
+// are decrypted when the app context is created. The rest of the value is
+// base64 of a 12 byte nonce followed by AES-256-GCM ciphertext, as created
+// by EncryptConfigValue.
+const EncryptedValuePrefix = "enc:"
+
+// A ConfigKeyProvider returns the 32 byte key for encrypted config values,
+// eg. by decrypting a data key with a KMS.
+type ConfigKeyProvider func() ([]byte, error)
+
+var configKeyProvidersLock sync.Mutex
+var configKeyProviders = make(map[string]ConfigKeyProvider)
+
+// RegisterConfigKeyProvider makes a key provider available by name for
+// APPCTX_CONFIG_KEY_PROVIDER. It should be called from an init function.
+func RegisterConfigKeyProvider(name string, provider ConfigKeyProvider) {
+	configKeyProvidersLock.Lock()
+	defer configKeyProvidersLock.Unlock()
+
+	if provider == nil {
+		panic("app_context: RegisterConfigKeyProvider provider is nil")
+	}
+	if _, ok := configKeyProviders[name]; ok {
+		panic("app_context: RegisterConfigKeyProvider called twice for provider " + name)
+	}
+	configKeyProviders[name] = provider
+}
+
+func getConfigKeyProvider(name string) (ConfigKeyProvider, error) {
+	configKeyProvidersLock.Lock()
+	defer configKeyProvidersLock.Unlock()
+
+	if provider, ok := configKeyProviders[name]; ok {
+		return provider, nil
+	}
+	return nil, fmt.Errorf("Unknown config key provider '%s'", name)
+}
+
+func newConfigCipher(key []byte) (cipher.AEAD, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("Config key must be 32 bytes, not %d", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func EncryptConfigValue(key []byte, value string) (string, error) {
+	aead, err := newConfigCipher(key)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	sealed := aead.Seal(nonce, nonce, []byte(value), nil)
+
+	return EncryptedValuePrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func DecryptConfigValue(key []byte, value string) (string, error) {
+	if !strings.HasPrefix(value, EncryptedValuePrefix) {
+		return "", errors.New("Value isn't encrypted")
+	}
+
+	aead, err := newConfigCipher(key)
+	if err != nil {
+		return "", err
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(value[len(EncryptedValuePrefix):])
+	if err != nil {
+		return "", fmt.Errorf("Encrypted value isn't valid base64: %s", err)
+	}
+	if len(sealed) < aead.NonceSize() {
+		return "", errors.New("Encrypted value is too short")
+	}
+
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	plain, err := aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return "", errors.New("Couldn't decrypt value, check the config key")
+	}
+
+	return string(plain), nil
+}
+
+// parseConfigFile reads KEY=VALUE lines. Blank lines and lines starting
+// with '#' are skipped, and values may be wrapped in single or double
+// quotes.
+func parseConfigFile(data []byte) (map[string]string, error) {
+	values := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+
+	for line_num := 1; scanner.Scan(); line_num++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+
+		parts := strings.SplitN(line, "=", 2)
+		name := strings.TrimSpace(parts[0])
+		if len(parts) != 2 || name == "" {
+			return nil, fmt.Errorf("Line %d should be KEY=VALUE", line_num)
+		}
+
+		value := strings.TrimSpace(parts[1])
+		if len(value) >= 2 {
+			if q := value[0]; (q == '"' || q == '\'') && value[len(value)-1] == q {
+				value = value[1 : len(value)-1]
+			}
+		}
+		values[name] = value
+	}
+
+	return values, scanner.Err()
+}
+
+func (self *baseAppContext) loadConfigKey() ([]byte, error) {
+	if key_str := self.osGetenv("APPCTX_CONFIG_KEY"); key_str != "" {
+		key, err := base64.StdEncoding.DecodeString(key_str)
+		if err != nil {
+			return nil, fmt.Errorf("APPCTX_CONFIG_KEY isn't valid base64: %s", err)
+		}
+		return key, nil
+	}
+
+	if name := self.osGetenv("APPCTX_CONFIG_KEY_PROVIDER"); name != "" {
+		provider, err := getConfigKeyProvider(name)
+		if err != nil {
+			return nil, err
+		}
+		key, err := provider()
+		if err != nil {
+			return nil, fmt.Errorf("Error getting key from provider '%s': %s", name, err)
+		}
+		return key, nil
+	}
+
+	return nil, errors.New("Found encrypted values but neither APPCTX_CONFIG_KEY nor APPCTX_CONFIG_KEY_PROVIDER is set")
+}
+
+// decryptValues decrypts any encrypted values in place. The key is only
+// loaded if there is something to decrypt.
+func (self *baseAppContext) decryptValues(values map[string]string, key *[]byte) error {
+	for name, value := range values {
+		if !strings.HasPrefix(value, EncryptedValuePrefix) {
+			continue
+		}
+		if *key == nil {
+			var err error
+			if *key, err = self.loadConfigKey(); err != nil {
+				return err
+			}
+		}
+		plain, err := DecryptConfigValue(*key, value)
+		if err != nil {
+			return fmt.Errorf("Error decrypting %s: %s", name, err)
+		}
+		values[name] = plain
+	}
+	return nil
+}
+
+// APPCTX_CONFIG_FILE names a file of KEY=VALUE settings. They're used for
+// anything not set in the environment or the .env files.
+func (self *baseAppContext) setConfigFromEnv() error {
+	self.configFile = make(map[string]string)
+	self.decryptedEnv = make(map[string]string)
+
+	if path := self.osGetenv("APPCTX_CONFIG_FILE"); path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("Couldn't read APPCTX_CONFIG_FILE: %s", err)
+		}
+		if self.configFile, err = parseConfigFile(data); err != nil {
+			return fmt.Errorf("Error parsing %s: %s", path, err)
+		}
+	}
+
+	for _, kv := range self.processEnviron() {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) == 2 && strings.HasPrefix(parts[1], EncryptedValuePrefix) &&
+			strings.HasPrefix(parts[0], self.envPrefix) {
+			self.decryptedEnv[parts[0]] = parts[1]
+		}
+	}
+
+	// Remembered so DumpConfig can mask them once they're decrypted
+	self.encryptedNames = make(map[string]bool)
+	for name := range self.decryptedEnv {
+		self.encryptedNames[strings.TrimPrefix(name, self.envPrefix)] = true
+	}
+	for _, values := range []map[string]string{self.dotEnv, self.configFile} {
+		for name, value := range values {
+			if strings.HasPrefix(value, EncryptedValuePrefix) {
+				self.encryptedNames[strings.TrimPrefix(name, self.envPrefix)] = true
+			}
+		}
+	}
+
+	var key []byte
+
+	if err := self.decryptValues(self.decryptedEnv, &key); err != nil {
+		return err
+	}
+
+	if err := self.decryptValues(self.dotEnv, &key); err != nil {
+		return err
+	}
+
+	return self.decryptValues(self.configFile, &key)
+}
@@ -0,0 +1,181 @@
+package app_context
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+const redactedValue = "****"
+
+// ConfigSetting is one setting the app context read while starting up.
+// Source is env, dotenv, config_file, profile or default, the last
+// meaning it isn't set and the built in default is in use.
+type ConfigSetting struct {
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	Set    bool   `json:"set"`
+	Source string `json:"source"`
+	Secret bool   `json:"secret,omitempty"`
+}
+
+type ConfigComponent struct {
+	Name    string `json:"name"`
+	Type    string `json:"type"`
+	Enabled bool   `json:"enabled"`
+	Source  string `json:"source"`
+}
+
+// ConfigSummary is what the process actually loaded
+type ConfigSummary struct {
+	AppName     string             `json:"app_name"`
+	Environment string             `json:"environment"`
+	CodeVersion string             `json:"code_version"`
+	EnvPrefix   string             `json:"env_prefix,omitempty"`
+	Fingerprint string             `json:"config_fingerprint"`
+	Degraded    map[string]string  `json:"degraded,omitempty"`
+	Components  []*ConfigComponent `json:"components"`
+	Settings    []*ConfigSetting   `json:"settings"`
+}
+
+var secretSettingWords = []string{"PASSWORD", "PASSWD", "SECRET", "TOKEN", "CREDENTIALS", "PRIVATE", "_KEY"}
+
+var dsnPasswordRE = regexp.MustCompile(`(?i)(password\s*=\s*)('[^']*'|\S+)`)
+
+func isSecretSetting(name string) bool {
+	upper := strings.ToUpper(name)
+	for _, word := range secretSettingWords {
+		if strings.Contains(upper, word) {
+			return true
+		}
+	}
+	return false
+}
+
+// redactURLPassword masks passwords in URLs and key=value DSNs, which is
+// how DB_DSN, REDIS_URL, NATS_URL and SMTP_URL carry them
+func redactURLPassword(value string) (string, bool) {
+	if u, err := url.Parse(value); err == nil && u.User != nil {
+		if _, has_password := u.User.Password(); has_password {
+			// url escapes the *s in a password, so put the mask in after
+			u.User = url.UserPassword(u.User.Username(), "REDACTED")
+			return strings.Replace(u.String(), ":REDACTED@", ":"+redactedValue+"@", 1), true
+		}
+	}
+	if dsnPasswordRE.MatchString(value) {
+		return dsnPasswordRE.ReplaceAllString(value, "${1}"+redactedValue), true
+	}
+	return value, false
+}
+
+func (self *baseAppContext) configSetting(name string, redact_secrets bool) *ConfigSetting {
+	value, set := self.lookupEnv(name)
+	setting := &ConfigSetting{
+		Name:   name,
+		Value:  value,
+		Set:    set,
+		Source: self.envSource(name),
+		Secret: self.encryptedNames[name] || self.remoteConfig.wasEncrypted(name) || isSecretSetting(name),
+	}
+	if set && setting.Secret && redact_secrets {
+		setting.Value = redactedValue
+	} else if set && redact_secrets {
+		var has_password bool
+		if setting.Value, has_password = redactURLPassword(value); has_password {
+			setting.Secret = true
+		}
+	}
+	return setting
+}
+
+// ConfigSummary lists every setting the app context has read and which
+// components are enabled. With redact_secrets, values of settings that
+// look like secrets, were encrypted, or are URLs with passwords are
+// masked.
+func (self *baseAppContext) ConfigSummary(redact_secrets bool) *ConfigSummary {
+	names := make([]string, 0)
+	self.envLookups.Range(func(name, _ interface{}) bool {
+		names = append(names, name.(string))
+		return true
+	})
+	sort.Strings(names)
+
+	summary := &ConfigSummary{
+		AppName:     self.appName,
+		Environment: self.tiltEnv,
+		CodeVersion: self.codeVersion,
+		EnvPrefix:   self.envPrefix,
+		Fingerprint: self.ConfigFingerprint(),
+		Degraded:    self.Degraded(),
+		Settings:    make([]*ConfigSetting, 0, len(names)),
+	}
+	for _, name := range names {
+		summary.Settings = append(summary.Settings, self.configSetting(name, redact_secrets))
+	}
+	for _, info := range self.describeSubsystems() {
+		summary.Components = append(summary.Components, &ConfigComponent{
+			Name:    info.Name,
+			Type:    info.Type,
+			Enabled: !info.NOOP && info.Source != "disabled" && info.Source != "degraded",
+			Source:  info.Source,
+		})
+	}
+	return summary
+}
+
+// DumpConfig writes ConfigSummary to w as a table for people to read,
+// followed by the same summary as JSON
+func (self *baseAppContext) DumpConfig(w io.Writer, redact_secrets bool) error {
+	summary := self.ConfigSummary(redact_secrets)
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "App:\t%s\n", summary.AppName)
+	fmt.Fprintf(tw, "Environment:\t%s\n", summary.Environment)
+	fmt.Fprintf(tw, "Code version:\t%s\n", summary.CodeVersion)
+	if summary.EnvPrefix != "" {
+		fmt.Fprintf(tw, "Env prefix:\t%s\n", summary.EnvPrefix)
+	}
+	fmt.Fprintf(tw, "Config fingerprint:\t%s\n", summary.Fingerprint)
+
+	fmt.Fprintf(tw, "\nComponents:\n")
+	for _, comp := range summary.Components {
+		state := "enabled"
+		if err, ok := summary.Degraded[comp.Name]; ok {
+			state = "degraded: " + err
+		} else if !comp.Enabled {
+			state = "disabled"
+		}
+		fmt.Fprintf(tw, "  %s\t%s\t%s\t%s\n", comp.Name, state, comp.Source, comp.Type)
+	}
+
+	fmt.Fprintf(tw, "\nSettings:\n")
+	for _, setting := range summary.Settings {
+		value := setting.Value
+		if !setting.Set {
+			value = "<unset>"
+		}
+		fmt.Fprintf(tw, "  %s\t%s\t%s\n", setting.Name, value, setting.Source)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "\n")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(summary)
+}
+
+// configHandler serves ConfigSummary as JSON, always redacted
+func (self *baseAppContext) configHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(self.ConfigSummary(true))
+	})
+}
@@ -0,0 +1,104 @@
+package app_context
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEncryptedConfigValues(t *testing.T) {
+	key := make([]byte, 32)
+	for i := range key {
+		key[i] = byte(i)
+	}
+
+	enc_version, err := EncryptConfigValue(key, "v1.2.3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc_url, err := EncryptConfigValue(key, "https://example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "config_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "app.env")
+	contents := "# committed config\nBASE_URL=\"" + enc_url + "\"\nJSON_SCHEMA_FILEPATH=/schemas\nCODE_VERSION=from-file\n"
+	if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	os.Setenv("APPCTX_CONFIG_FILE", path)
+	defer os.Unsetenv("APPCTX_CONFIG_FILE")
+	os.Setenv("CODE_VERSION", enc_version)
+	defer os.Unsetenv("CODE_VERSION")
+
+	if _, err := NewAppContext("config_test"); err == nil {
+		t.Error("app context should fail without a config key")
+	}
+
+	os.Setenv("APPCTX_CONFIG_KEY", base64.StdEncoding.EncodeToString(key))
+	defer os.Unsetenv("APPCTX_CONFIG_KEY")
+
+	app_ctx, err := NewAppContext("config_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if v := app_ctx.CodeVersion(); v != "v1.2.3" {
+		t.Errorf("Encrypted env value not decrypted, or file took precedence: %s", v)
+	}
+	if u := app_ctx.BaseExternalURL(); u != "https://example.com" {
+		t.Errorf("Encrypted file value not decrypted: %s", u)
+	}
+	if p := app_ctx.JSONSchemaFilePath(); p != "/schemas" {
+		t.Errorf("Plain file value not used: %s", p)
+	}
+
+	other_key := make([]byte, 32)
+	os.Setenv("APPCTX_CONFIG_KEY", base64.StdEncoding.EncodeToString(other_key))
+
+	if _, err := NewAppContext("config_test"); err == nil {
+		t.Error("app context should fail with the wrong config key")
+	}
+}
+
+// configTestKey is what the "config_test" provider returns. Providers
+// can only be registered once, so it's done here rather than per run.
+var configTestKey = make([]byte, 32)
+
+func init() {
+	RegisterConfigKeyProvider("config_test", func() ([]byte, error) {
+		return configTestKey, nil
+	})
+}
+
+func TestConfigKeyProvider(t *testing.T) {
+	enc, err := EncryptConfigValue(configTestKey, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	os.Setenv("CODE_VERSION", enc)
+	defer os.Unsetenv("CODE_VERSION")
+	os.Setenv("APPCTX_CONFIG_KEY_PROVIDER", "config_test")
+	defer os.Unsetenv("APPCTX_CONFIG_KEY_PROVIDER")
+
+	app_ctx, err := NewAppContext("config_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer app_ctx.Close()
+
+	if v := app_ctx.CodeVersion(); v != "secret" {
+		t.Errorf("Value not decrypted with provider key: %s", v)
+	}
+}
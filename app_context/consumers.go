@@ -0,0 +1,347 @@
+package app_context
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+var ErrUnknownConsumer = errors.New("No worker or scheduled job has that name")
+
+// consumerPausesName is the checkpoint store entry pauses are kept in
+const consumerPausesName = "_consumers.paused"
+
+// ConsumerState is a worker or scheduled job and whether it's paused
+type ConsumerState struct {
+	Name     string    `json:"name"`
+	Kinds    []string  `json:"kinds"`
+	Paused   bool      `json:"paused"`
+	PausedAt time.Time `json:"paused_at"`
+}
+
+// ConsumerControls pauses and resumes workers and scheduled jobs by name,
+// eg. to stop draining a queue into a struggling dependency during an
+// incident. A paused worker is cancelled like an ActiveOnly worker on
+// standby and started again on Resume; a paused job's runs are skipped.
+//
+// Pauses are kept where checkpoints are, so they last across restarts and
+// with a database are shared by every instance, which pick up changes
+// every CONSUMER_PAUSE_POLL_INTERVAL.
+type ConsumerControls interface {
+	Pause(name string) error
+	Resume(name string) error
+	Paused(name string) bool
+	List() []ConsumerState
+}
+
+type consumerControls struct {
+	appctx   *baseAppContext
+	interval time.Duration
+
+	lock     sync.Mutex
+	paused   map[string]time.Time
+	stopChan chan struct{}
+	doneChan chan struct{}
+}
+
+func newConsumerControls(appctx *baseAppContext) *consumerControls {
+	return &consumerControls{
+		appctx:   appctx,
+		interval: 10 * time.Second,
+		paused:   make(map[string]time.Time),
+	}
+}
+
+func (self *consumerControls) store() checkpointStore {
+	self.appctx.checkpoints.lock.Lock()
+	defer self.appctx.checkpoints.lock.Unlock()
+	return self.appctx.checkpoints.storeLocked()
+}
+
+func (self *consumerControls) load(ctx context.Context) (map[string]time.Time, string, error) {
+	paused := make(map[string]time.Time)
+	state, err := self.store().get(ctx, consumerPausesName)
+	if err != nil || state == nil {
+		return paused, "", err
+	}
+	if err := json.Unmarshal([]byte(state.Value), &paused); err != nil {
+		return nil, "", fmt.Errorf("Error reading paused consumers: %s", err)
+	}
+	return paused, state.Value, nil
+}
+
+// apply makes paused the current pauses, waking workers so they stop or
+// start
+func (self *consumerControls) apply(paused map[string]time.Time) {
+	self.lock.Lock()
+	changed := len(paused) != len(self.paused)
+	for name := range paused {
+		if _, ok := self.paused[name]; !ok {
+			changed = true
+		}
+	}
+	self.paused = paused
+	self.lock.Unlock()
+
+	if changed && self.appctx.workers != nil {
+		self.appctx.workers.wake()
+	}
+}
+
+func (self *consumerControls) refresh() error {
+	// Without anywhere to keep them there's nothing saved, and checking
+	// would settle on the memory store before a SetDB
+	cps := self.appctx.checkpoints
+	cps.lock.Lock()
+	nowhere := cps.store == nil && cps.dir == "" && self.appctx.DBWrite() == nil
+	cps.lock.Unlock()
+	if nowhere {
+		return nil
+	}
+
+	paused, _, err := self.load(context.Background())
+	if err != nil {
+		return err
+	}
+	self.apply(paused)
+	return nil
+}
+
+// update changes the saved pauses with fn, retrying if another instance
+// changed them at the same time
+func (self *consumerControls) update(fn func(map[string]time.Time)) error {
+	ctx := context.Background()
+	for {
+		paused, from, err := self.load(ctx)
+		if err != nil {
+			return err
+		}
+		fn(paused)
+		data, err := json.Marshal(paused)
+		if err != nil {
+			return err
+		}
+		ok, err := self.store().set(ctx, consumerPausesName, string(data), &from, self.appctx.now())
+		if err != nil {
+			return fmt.Errorf("Error saving paused consumers: %s", err)
+		}
+		if ok {
+			self.apply(paused)
+			return nil
+		}
+	}
+}
+
+// known is the kinds of consumer called name
+func (self *consumerControls) known(name string) []string {
+	var kinds []string
+	if self.appctx.workers != nil {
+		self.appctx.workers.lock.Lock()
+		if _, ok := self.appctx.workers.workers[name]; ok {
+			kinds = append(kinds, "worker")
+		}
+		self.appctx.workers.lock.Unlock()
+	}
+	if self.appctx.scheduler != nil {
+		self.appctx.scheduler.lock.Lock()
+		if _, ok := self.appctx.scheduler.jobs[name]; ok {
+			kinds = append(kinds, "job")
+		}
+		self.appctx.scheduler.lock.Unlock()
+	}
+	return kinds
+}
+
+func (self *consumerControls) Pause(name string) error {
+	if len(self.known(name)) == 0 {
+		return ErrUnknownConsumer
+	}
+	err := self.update(func(paused map[string]time.Time) {
+		if _, ok := paused[name]; !ok {
+			paused[name] = self.appctx.now().UTC()
+		}
+	})
+	if err != nil {
+		return err
+	}
+	self.appctx.Logger().LogInfof(context.Background(), "Paused consumer '%s'", name)
+	self.appctx.MetricsClient().Incr("consumer.pauses", 1.0, map[string]string{"consumer": name})
+	return nil
+}
+
+func (self *consumerControls) Resume(name string) error {
+	err := self.update(func(paused map[string]time.Time) {
+		delete(paused, name)
+	})
+	if err != nil {
+		return err
+	}
+	self.appctx.Logger().LogInfof(context.Background(), "Resumed consumer '%s'", name)
+	self.appctx.MetricsClient().Incr("consumer.resumes", 1.0, map[string]string{"consumer": name})
+	return nil
+}
+
+func (self *consumerControls) Paused(name string) bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	_, ok := self.paused[name]
+	return ok
+}
+
+// List is every worker and scheduled job, and anything paused that isn't
+// registered (yet)
+func (self *consumerControls) List() []ConsumerState {
+	names := make(map[string]bool)
+	for _, w := range self.appctx.workers.Status() {
+		names[w.Name] = true
+	}
+	for _, job := range self.appctx.scheduler.Jobs() {
+		names[job.Name] = true
+	}
+	self.lock.Lock()
+	paused := self.paused
+	self.lock.Unlock()
+	for name := range paused {
+		names[name] = true
+	}
+
+	states := make([]ConsumerState, 0, len(names))
+	for name := range names {
+		paused_at, ok := paused[name]
+		states = append(states, ConsumerState{
+			Name:     name,
+			Kinds:    self.known(name),
+			Paused:   ok,
+			PausedAt: paused_at,
+		})
+	}
+	sort.Slice(states, func(i, j int) bool {
+		return states[i].Name < states[j].Name
+	})
+	return states
+}
+
+func (self *consumerControls) start() {
+	stop_chan, done_chan := make(chan struct{}), make(chan struct{})
+	self.stopChan, self.doneChan = stop_chan, done_chan
+	// Real time, so polling isn't a FakeClock waiter
+	ticker := NewRealClock().NewTicker(self.interval)
+	goLabeled("consumers", func() {
+		defer close(done_chan)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop_chan:
+				return
+			case <-ticker.C():
+				if err := self.refresh(); err != nil {
+					self.appctx.Logger().LogWarnf(context.Background(), "Error refreshing paused consumers: %s", err)
+				}
+			}
+		}
+	})
+}
+
+func (self *consumerControls) stop() {
+	if self.stopChan != nil {
+		close(self.stopChan)
+		<-self.doneChan
+		self.stopChan = nil
+	}
+}
+
+type consumerAdminRequest struct {
+	Name   string `json:"name"`
+	Action string `json:"action"`
+	Reason string `json:"reason"`
+}
+
+// consumersAdminHandler serves /admin/consumers:
+//
+//	GET                                  every consumer and whether it's paused
+//	POST {"name", "action", "reason"}    "pause" or "resume" name
+//
+// Every request needs ADMIN_TOKEN as a bearer token.
+func (self *baseAppContext) consumersAdminHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !self.adminAuthorized(r) {
+			writeAdminError(w, http.StatusUnauthorized, "A valid ADMIN_TOKEN bearer token is required")
+			return
+		}
+
+		switch r.Method {
+		case "GET":
+		case "POST":
+			var req consumerAdminRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				writeAdminError(w, http.StatusBadRequest, "Invalid JSON: "+err.Error())
+				return
+			}
+			var err error
+			switch req.Action {
+			case "pause":
+				err = self.consumers.Pause(req.Name)
+			case "resume":
+				err = self.consumers.Resume(req.Name)
+			default:
+				writeAdminError(w, http.StatusBadRequest, "action must be 'pause' or 'resume'")
+				return
+			}
+			if err == ErrUnknownConsumer {
+				writeAdminError(w, http.StatusNotFound, err.Error())
+				return
+			}
+			if err != nil {
+				writeAdminError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			self.Logger().LogInfof(r.Context(), "Consumer '%s' %s from the admin port: %s", req.Name, req.Action, req.Reason)
+		default:
+			writeAdminError(w, http.StatusMethodNotAllowed, "Use GET or POST")
+			return
+		}
+		writeAdminJSON(w, http.StatusOK, self.consumers.List())
+	})
+}
+
+func (self *consumerControls) status() map[string]interface{} {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	names := make([]string, 0, len(self.paused))
+	for name := range self.paused {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return map[string]interface{}{
+		"paused":        names,
+		"poll_interval": self.interval.String(),
+	}
+}
+
+func (self *baseAppContext) Consumers() ConsumerControls {
+	return self.consumers
+}
+
+// Pauses saved before a restart are loaded before anything's registered.
+// CONSUMER_PAUSE_POLL_INTERVAL (default 10s) is how often they're checked
+// for changes made by other instances; 0 turns that off.
+func (self *baseAppContext) setConsumersFromEnv() error {
+	if interval, found, err := self.getDurationFromEnv("CONSUMER_PAUSE_POLL_INTERVAL"); err != nil {
+		return err
+	} else if found {
+		self.consumers.interval = interval
+	}
+
+	if err := self.consumers.refresh(); err != nil {
+		return err
+	}
+	if self.consumers.interval > 0 && !self.lambda {
+		self.consumers.start()
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package app_context
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestConsumersPauseResume(t *testing.T) {
+	os.Setenv("CHECKPOINT_DIR", t.TempDir())
+	defer os.Unsetenv("CHECKPOINT_DIR")
+
+	app_ctx, err := NewAppContext("consumers_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer app_ctx.Close()
+
+	mcli := newCountingMetricsClient()
+	app_ctx.SetMetricsClient(mcli)
+
+	var running, runs int32
+	app_ctx.Workers().Register("orders", func(ctx context.Context) error {
+		atomic.StoreInt32(&running, 1)
+		<-ctx.Done()
+		atomic.StoreInt32(&running, 0)
+		return nil
+	}, WorkerOptions{Restart: RestartAlways})
+	app_ctx.Scheduler().Every("sweep", 5*time.Millisecond, func(ctx context.Context) error {
+		atomic.AddInt32(&runs, 1)
+		return nil
+	})
+	waitFor(t, "worker start", func() bool { return atomic.LoadInt32(&running) == 1 })
+
+	consumers := app_ctx.Consumers()
+	if err := consumers.Pause("payments"); err != ErrUnknownConsumer {
+		t.Errorf("Expected ErrUnknownConsumer, got %v", err)
+	}
+	if err := consumers.Pause("orders"); err != nil {
+		t.Fatal(err)
+	}
+	if err := consumers.Pause("sweep"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "worker pause", func() bool { return atomic.LoadInt32(&running) == 0 })
+	waitFor(t, "skipped run", func() bool { return mcli.count("scheduler.skipped") > 0 })
+
+	paused_runs := atomic.LoadInt32(&runs)
+	time.Sleep(30 * time.Millisecond)
+	if atomic.LoadInt32(&running) != 0 || atomic.LoadInt32(&runs) > paused_runs+1 {
+		t.Error("Expected paused consumers not to run")
+	}
+	if s := app_ctx.Workers().Status(); s[0].Failures != 0 {
+		t.Errorf("Pausing shouldn't count as a failure: %+v", s)
+	}
+
+	states := consumers.List()
+	if len(states) != 2 || !states[0].Paused || states[0].Kinds[0] != "worker" || states[1].Kinds[0] != "job" {
+		t.Errorf("Unexpected consumers: %+v", states)
+	}
+
+	// A restart starts paused
+	restarted, err := NewAppContext("consumers_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if !restarted.Consumers().Paused("orders") || !restarted.Consumers().Paused("sweep") {
+		t.Error("Expected the pauses to be kept across a restart")
+	}
+	restarted.Close()
+
+	if err := consumers.Resume("orders"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "worker resume", func() bool { return atomic.LoadInt32(&running) == 1 })
+	if consumers.Paused("orders") || !consumers.Paused("sweep") {
+		t.Error("Expected only orders to be resumed")
+	}
+}
+
+func TestConsumersAdmin(t *testing.T) {
+	os.Setenv("ADMIN_TOKEN", "admin-secret")
+	defer os.Unsetenv("ADMIN_TOKEN")
+
+	app_ctx, err := NewAppContext("consumers_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer app_ctx.Close()
+
+	app_ctx.Scheduler().Every("sweep", time.Hour, func(ctx context.Context) error { return nil })
+
+	handler := app_ctx.(*baseAppContext).consumersAdminHandler()
+	post := func(token, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/admin/consumers", strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := post("wrong", `{}`); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without the admin token, got %d", w.Code)
+	}
+	if w := post("admin-secret", `{"name": "sweep", "action": "stop"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an unknown action, got %d", w.Code)
+	}
+	if w := post("admin-secret", `{"name": "nightly", "action": "pause"}`); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown consumer, got %d", w.Code)
+	}
+
+	w := post("admin-secret", `{"name": "sweep", "action": "pause", "reason": "incident"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body)
+	}
+	var states []ConsumerState
+	json.NewDecoder(w.Body).Decode(&states)
+	if len(states) != 1 || !states[0].Paused || !app_ctx.Consumers().Paused("sweep") {
+		t.Errorf("Unexpected consumers: %+v", states)
+	}
+}
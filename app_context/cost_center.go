@@ -0,0 +1,13 @@
+package app_context
+
+import "context"
+
+func WithCostCenter(ctx context.Context, cost_center string) context.Context {
+	return WithField(ctx, "cost_center", cost_center)
+}
+
+// CostCenter returns the cost center propagated in ctx, falling back to
+// COST_CENTER for this service.
+func (self *baseAppContext) CostCenter(ctx context.Context) string {
+	return self.fieldPropagation.Field(ctx, "cost_center")
+}
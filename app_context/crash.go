@@ -0,0 +1,228 @@
+package app_context
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/comstud/go-rollbar/rollbar"
+)
+
+// CrashReport is written by HandleCrash when the process panics
+type CrashReport struct {
+	AppName           string            `json:"app_name"`
+	Hostname          string            `json:"hostname"`
+	Environment       string            `json:"environment"`
+	CodeVersion       string            `json:"code_version"`
+	Time              time.Time         `json:"time"`
+	Panic             string            `json:"panic"`
+	Stack             string            `json:"stack"`
+	ConfigFingerprint string            `json:"config_fingerprint"`
+	Build             map[string]string `json:"build,omitempty"`
+	Logs              []LogEntry        `json:"logs,omitempty"`
+}
+
+const crashReportSuffix = ".crash.json"
+
+func buildInfo() map[string]string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return nil
+	}
+
+	build := map[string]string{
+		"go_version": info.GoVersion,
+		"path":       info.Path,
+		"version":    info.Main.Version,
+	}
+	for _, setting := range info.Settings {
+		if strings.HasPrefix(setting.Key, "vcs.") {
+			build[setting.Key] = setting.Value
+		}
+	}
+	return build
+}
+
+func (self *baseAppContext) newCrashReport(r interface{}, stack []byte) *CrashReport {
+	return &CrashReport{
+		AppName:           self.appName,
+		Hostname:          self.hostname,
+		Environment:       self.tiltEnv,
+		CodeVersion:       self.codeVersion,
+		Time:              self.Clock().Now().UTC(),
+		Panic:             fmt.Sprint(r),
+		Stack:             string(stack),
+		ConfigFingerprint: self.ConfigFingerprint(),
+		Build:             buildInfo(),
+		Logs:              self.recentLogs(),
+	}
+}
+
+func (self *CrashReport) name() string {
+	return fmt.Sprintf("%s-%s-%s%s", self.AppName, self.Hostname, self.Time.Format("20060102T150405.000Z"), crashReportSuffix)
+}
+
+func (self *baseAppContext) saveCrashReport(report *CrashReport) {
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Couldn't encode crash report: %s\n", err)
+		return
+	}
+
+	if self.crashReportDir != "" {
+		path := filepath.Join(self.crashReportDir, report.name())
+		if err := ioutil.WriteFile(path, data, 0600); err != nil {
+			fmt.Fprintf(os.Stderr, "Couldn't write crash report: %s\n", err)
+		} else {
+			fmt.Fprintf(os.Stderr, "Crash report written to %s\n", path)
+		}
+	}
+
+	if self.crashReportS3 != nil {
+		loc := self.crashReportS3
+		key := strings.TrimSuffix(loc.prefix, "/") + "/" + report.name()
+		if err := putS3Object(loc.region, loc.bucket, strings.TrimPrefix(key, "/"), data); err != nil {
+			fmt.Fprintf(os.Stderr, "Couldn't upload crash report: %s\n", err)
+		}
+	}
+}
+
+func putS3Object(region, bucket, key string, data []byte) error {
+	sess, err := session.NewSession()
+	if err != nil {
+		return fmt.Errorf("Error creating new aws session: %s", err)
+	}
+
+	svc := s3.New(sess, (&aws.Config{}).WithRegion(region))
+	_, err = svc.PutObject(
+		(&s3.PutObjectInput{}).
+			SetBucket(bucket).
+			SetKey(key).
+			SetContentType("application/json").
+			SetBody(bytes.NewReader(data)),
+	)
+	return err
+}
+
+// HandleCrash saves a crash report for a panic and then re-panics, so the
+// process still dies with the usual traceback. Defer it first thing in main
+// and in long-lived goroutines:
+//
+//	defer app_ctx.HandleCrash()
+//
+// Reports go to CRASH_REPORT_DIR and/or APPCTX_S3_CRASH_REPORTS
+// (region::bucket::prefix). Reports left in CRASH_REPORT_DIR are sent to
+// rollbar when the app next starts.
+func (self *baseAppContext) HandleCrash() {
+	r := recover()
+	if r == nil {
+		return
+	}
+
+	if self.crashReportDir != "" || self.crashReportS3 != nil {
+		self.saveCrashReport(self.newCrashReport(r, debug.Stack()))
+	}
+
+	panic(r)
+}
+
+// reportPreviousCrashes sends reports left by earlier runs to rollbar,
+// renaming each to .reported once sent
+func (self *baseAppContext) reportPreviousCrashes() {
+	paths, err := filepath.Glob(filepath.Join(self.crashReportDir, "*"+crashReportSuffix))
+	if err != nil || len(paths) == 0 {
+		return
+	}
+
+	ctx := context.Background()
+
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			self.Logger().LogErrorf(ctx, "Couldn't read crash report %s: %s", path, err)
+			continue
+		}
+
+		report := &CrashReport{}
+		if err := json.Unmarshal(data, report); err != nil {
+			self.Logger().LogErrorf(ctx, "Invalid crash report %s: %s", path, err)
+			continue
+		}
+
+		self.Logger().LogWarnf(ctx, "Previous run crashed at %s: %s", report.Time, report.Panic)
+
+		if !self.rollbarEnabled {
+			continue
+		}
+
+		rcli := self.RollbarClient()
+		notif := rcli.NewMessageNotification(
+			rollbar.LV_CRITICAL,
+			fmt.Sprintf("Crashed at %s: %s", report.Time.Format(time.RFC3339), report.Panic),
+			rollbar.CustomInfo{
+				"crash_report": report,
+				"crash_file":   filepath.Base(path),
+			},
+		)
+
+		if _, err := rcli.SendNotification(notif); err != nil {
+			self.Logger().LogErrorf(ctx, "Error sending crash report to rollbar: %s", err)
+			continue
+		}
+
+		os.Rename(path, path+".reported")
+	}
+}
+
+type s3Location struct {
+	region string
+	bucket string
+	prefix string
+}
+
+// CRASH_TRACEBACK (default "all") raises the runtime's GOTRACEBACK level
+// while crash reports are enabled.
+func (self *baseAppContext) setCrashReportsFromEnv() error {
+	self.crashReportDir = self.getEnv("CRASH_REPORT_DIR")
+
+	if loc := self.getEnv("APPCTX_S3_CRASH_REPORTS"); loc != "" {
+		locparts := strings.SplitN(loc, "::", 3)
+		if len(locparts) != 3 {
+			return fmt.Errorf("APPCTX_S3_CRASH_REPORTS should be in format: region::bucket::prefix")
+		}
+		self.crashReportS3 = &s3Location{
+			region: locparts[0],
+			bucket: locparts[1],
+			prefix: locparts[2],
+		}
+	}
+
+	if self.crashReportDir == "" && self.crashReportS3 == nil {
+		return nil
+	}
+
+	traceback := self.getEnv("CRASH_TRACEBACK")
+	if traceback == "" {
+		traceback = "all"
+	}
+	debug.SetTraceback(traceback)
+
+	if self.crashReportDir != "" {
+		if err := os.MkdirAll(self.crashReportDir, 0700); err != nil {
+			return fmt.Errorf("Couldn't create CRASH_REPORT_DIR: %s", err)
+		}
+		self.reportPreviousCrashes()
+	}
+
+	return nil
+}
@@ -0,0 +1,88 @@
+package app_context
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestHandleCrash(t *testing.T) {
+	dir, err := ioutil.TempDir("", "crash_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	os.Setenv("CRASH_REPORT_DIR", dir)
+	defer os.Unsetenv("CRASH_REPORT_DIR")
+	os.Unsetenv("ROLLBAR_API_KEY")
+
+	app_ctx, err := NewAppContext("crash_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer app_ctx.Close()
+
+	func() {
+		defer func() {
+			if r := recover(); r != "kaboom" {
+				t.Errorf("HandleCrash should re-panic, got %v", r)
+			}
+		}()
+		defer app_ctx.HandleCrash()
+		panic("kaboom")
+	}()
+
+	paths, _ := filepath.Glob(filepath.Join(dir, "*"+crashReportSuffix))
+	if len(paths) != 1 {
+		t.Fatalf("Expected 1 crash report, found %v", paths)
+	}
+
+	data, err := ioutil.ReadFile(paths[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	report := &CrashReport{}
+	if err := json.Unmarshal(data, report); err != nil {
+		t.Fatal(err)
+	}
+	if report.Panic != "kaboom" || report.AppName != "crash_test" {
+		t.Errorf("Unexpected crash report: %+v", report)
+	}
+	if !strings.Contains(report.Stack, "TestHandleCrash") {
+		t.Errorf("Stack doesn't include the panicking function: %s", report.Stack)
+	}
+	if report.ConfigFingerprint != app_ctx.ConfigFingerprint() {
+		t.Errorf("Unexpected fingerprint: %s", report.ConfigFingerprint)
+	}
+
+	// Without rollbar the report is left for the next start
+	if _, err := NewAppContext("crash_test"); err != nil {
+		log.Fatal(err)
+	}
+	if _, err := os.Stat(paths[0]); err != nil {
+		t.Errorf("Unsent crash report was moved: %s", err)
+	}
+}
+
+func TestConfigFingerprint(t *testing.T) {
+	app_ctx, err := NewAppContext("crash_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	before := app_ctx.ConfigFingerprint()
+	if len(before) != 16 || before != app_ctx.ConfigFingerprint() {
+		t.Errorf("Unexpected fingerprint: %s", before)
+	}
+
+	os.Setenv("BASE_URL", "http://example.com")
+	defer os.Unsetenv("BASE_URL")
+	if app_ctx.ConfigFingerprint() == before {
+		t.Error("Fingerprint should change with a setting")
+	}
+}
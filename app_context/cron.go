@@ -0,0 +1,226 @@
+package app_context
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A Schedule returns the next time a job should run after t
+type Schedule interface {
+	Next(t time.Time) time.Time
+	String() string
+}
+
+type intervalSchedule struct {
+	interval time.Duration
+}
+
+func (self *intervalSchedule) Next(t time.Time) time.Time {
+	return t.Add(self.interval)
+}
+
+func (self *intervalSchedule) String() string {
+	return "@every " + self.interval.String()
+}
+
+// cronSchedule has a bit set for each matching value of each field
+type cronSchedule struct {
+	spec                          string
+	minute, hour, dom, month, dow uint64
+	domRestricted, dowRestricted  bool
+	location                      *time.Location
+}
+
+type cronField struct {
+	name     string
+	min, max int
+	names    map[string]int
+}
+
+var cronFields = []cronField{
+	{name: "minute", min: 0, max: 59},
+	{name: "hour", min: 0, max: 23},
+	{name: "day of month", min: 1, max: 31},
+	{name: "month", min: 1, max: 12, names: map[string]int{
+		"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+		"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+	}},
+	{name: "day of week", min: 0, max: 7, names: map[string]int{
+		"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+	}},
+}
+
+var cronShorthands = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+func (self *cronField) value(s string) (int, error) {
+	if n, ok := self.names[strings.ToLower(s)]; ok {
+		return n, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < self.min || n > self.max {
+		return 0, fmt.Errorf("Invalid %s '%s'", self.name, s)
+	}
+	return n, nil
+}
+
+// parse handles '*', single values, ranges (a-b), lists (a,b) and steps
+// (*/n or a-b/n). It returns whether the field was anything but '*'.
+func (self *cronField) parse(s string) (uint64, bool, error) {
+	var bits uint64
+
+	for _, part := range strings.Split(s, ",") {
+		step := 1
+		if idx := strings.Index(part, "/"); idx >= 0 {
+			var err error
+			if step, err = strconv.Atoi(part[idx+1:]); err != nil || step < 1 {
+				return 0, false, fmt.Errorf("Invalid step in %s '%s'", self.name, part)
+			}
+			part = part[:idx]
+		}
+
+		lo, hi := self.min, self.max
+		switch {
+		case part == "*":
+		case strings.Contains(part, "-"):
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if lo, err = self.value(bounds[0]); err != nil {
+				return 0, false, err
+			}
+			if hi, err = self.value(bounds[1]); err != nil {
+				return 0, false, err
+			}
+			if lo > hi {
+				return 0, false, fmt.Errorf("Invalid range in %s '%s'", self.name, part)
+			}
+		default:
+			var err error
+			if lo, err = self.value(part); err != nil {
+				return 0, false, err
+			}
+			if step == 1 {
+				hi = lo
+			}
+		}
+
+		for i := lo; i <= hi; i += step {
+			bits |= 1 << uint(i)
+		}
+	}
+
+	return bits, s != "*", nil
+}
+
+// ParseCron parses a standard 5 field cron expression (minute, hour, day of
+// month, month, day of week), one of the @hourly style shorthands, or
+// "@every <duration>". Times are evaluated in loc.
+func ParseCron(spec string, loc *time.Location) (Schedule, error) {
+	spec = strings.TrimSpace(spec)
+
+	if strings.HasPrefix(spec, "@every ") {
+		interval, err := time.ParseDuration(strings.TrimSpace(spec[len("@every "):]))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid interval in '%s': %s", spec, err)
+		}
+		if interval <= 0 {
+			return nil, fmt.Errorf("Interval in '%s' must be > 0", spec)
+		}
+		return &intervalSchedule{interval: interval}, nil
+	}
+
+	expr := spec
+	if shorthand, ok := cronShorthands[spec]; ok {
+		expr = shorthand
+	}
+
+	fields := strings.Fields(expr)
+	if len(fields) != len(cronFields) {
+		return nil, fmt.Errorf("Cron expression '%s' should have %d fields", spec, len(cronFields))
+	}
+
+	bits := make([]uint64, len(fields))
+	restricted := make([]bool, len(fields))
+	for i, f := range fields {
+		var err error
+		if bits[i], restricted[i], err = cronFields[i].parse(f); err != nil {
+			return nil, fmt.Errorf("Error parsing '%s': %s", spec, err)
+		}
+	}
+
+	// 7 is also sunday
+	if bits[4]&(1<<7) != 0 {
+		bits[4] |= 1
+	}
+
+	if loc == nil {
+		loc = time.Local
+	}
+
+	return &cronSchedule{
+		spec:          spec,
+		minute:        bits[0],
+		hour:          bits[1],
+		dom:           bits[2],
+		month:         bits[3],
+		dow:           bits[4],
+		domRestricted: restricted[2],
+		dowRestricted: restricted[4],
+		location:      loc,
+	}, nil
+}
+
+func (self *cronSchedule) String() string {
+	return self.spec
+}
+
+// dayMatches follows cron: if both day fields are restricted, either may
+// match.
+func (self *cronSchedule) dayMatches(t time.Time) bool {
+	dom := self.dom&(1<<uint(t.Day())) != 0
+	dow := self.dow&(1<<uint(t.Weekday())) != 0
+	if self.domRestricted && self.dowRestricted {
+		return dom || dow
+	}
+	return dom && dow
+}
+
+func (self *cronSchedule) Next(t time.Time) time.Time {
+	orig_loc := t.Location()
+	t = t.In(self.location)
+	t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute()+1, 0, 0, self.location)
+
+	// Give up if nothing matches within 5 years, eg. "0 0 30 2 *"
+	limit := t.AddDate(5, 0, 0)
+
+	for t.Before(limit) {
+		if self.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, self.location)
+			continue
+		}
+		if !self.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, self.location)
+			continue
+		}
+		if self.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, self.location)
+			continue
+		}
+		if self.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t.In(orig_loc)
+	}
+
+	return time.Time{}
+}
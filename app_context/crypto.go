@@ -0,0 +1,266 @@
+package app_context
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ErrNoCryptoKeys is returned by Crypto().Encrypt without CRYPTO_KEYS or
+// CRYPTO_KEY_PROVIDER
+var ErrNoCryptoKeys = errors.New("No encryption keys configured")
+
+// cryptoFormat is the first byte of a ciphertext, so the layout can change
+// later: format, 4 byte key version, 12 byte nonce, AES-256-GCM sealed data
+const cryptoFormat = 1
+
+const cryptoHeaderSize = 1 + 4
+
+// Crypto encrypts values the app stores, eg. sensitive columns, with
+// AES-256-GCM. Ciphertexts record the key version they were sealed with,
+// so old keys keep decrypting after a new one becomes current.
+type Crypto interface {
+	// Encrypt seals plaintext with the current key. aad, eg. the table and
+	// row ID, isn't stored but must be passed to Decrypt, so a ciphertext
+	// copied elsewhere doesn't decrypt.
+	Encrypt(plaintext, aad []byte) ([]byte, error)
+	Decrypt(ciphertext, aad []byte) ([]byte, error)
+	// EncryptString and DecryptString are Encrypt and Decrypt with base64
+	// ciphertexts, for text columns
+	EncryptString(plaintext string, aad []byte) (string, error)
+	DecryptString(ciphertext string, aad []byte) (string, error)
+	// NeedsRotation is true for a ciphertext sealed with a key other than
+	// the current one, which should be decrypted and encrypted again
+	NeedsRotation(ciphertext []byte) bool
+	// KeyVersion is the version Encrypt uses, or 0 without keys
+	KeyVersion() uint32
+}
+
+// A CryptoKeyProvider returns the 32 byte keys for Crypto by version, eg.
+// data keys decrypted with a KMS.
+type CryptoKeyProvider func() (map[uint32][]byte, error)
+
+var cryptoKeyProvidersLock sync.Mutex
+var cryptoKeyProviders = make(map[string]CryptoKeyProvider)
+
+// RegisterCryptoKeyProvider makes a key provider available by name for
+// CRYPTO_KEY_PROVIDER. It should be called from an init function.
+func RegisterCryptoKeyProvider(name string, provider CryptoKeyProvider) {
+	cryptoKeyProvidersLock.Lock()
+	defer cryptoKeyProvidersLock.Unlock()
+
+	if provider == nil {
+		panic("app_context: RegisterCryptoKeyProvider provider is nil")
+	}
+	if _, ok := cryptoKeyProviders[name]; ok {
+		panic("app_context: RegisterCryptoKeyProvider called twice for provider " + name)
+	}
+	cryptoKeyProviders[name] = provider
+}
+
+func getCryptoKeyProvider(name string) (CryptoKeyProvider, error) {
+	cryptoKeyProvidersLock.Lock()
+	defer cryptoKeyProvidersLock.Unlock()
+
+	if provider, ok := cryptoKeyProviders[name]; ok {
+		return provider, nil
+	}
+	return nil, fmt.Errorf("Unknown crypto key provider '%s'", name)
+}
+
+type aeadCrypto struct {
+	ciphers map[uint32]cipher.AEAD
+	current uint32
+}
+
+// NewCrypto returns a Crypto using keys, by version, encrypting with the
+// current version
+func NewCrypto(keys map[uint32][]byte, current uint32) (Crypto, error) {
+	self := &aeadCrypto{ciphers: make(map[uint32]cipher.AEAD, len(keys)), current: current}
+	for version, key := range keys {
+		if version == 0 {
+			return nil, errors.New("Key versions start at 1")
+		}
+		if len(key) != 32 {
+			return nil, fmt.Errorf("Key version %d must be 32 bytes, not %d", version, len(key))
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		if self.ciphers[version], err = cipher.NewGCM(block); err != nil {
+			return nil, err
+		}
+	}
+	if len(keys) > 0 {
+		if _, ok := self.ciphers[current]; !ok {
+			return nil, fmt.Errorf("No key for current version %d", current)
+		}
+	}
+	return self, nil
+}
+
+func (self *aeadCrypto) KeyVersion() uint32 {
+	return self.current
+}
+
+func (self *aeadCrypto) Encrypt(plaintext, aad []byte) ([]byte, error) {
+	aead, ok := self.ciphers[self.current]
+	if !ok {
+		return nil, ErrNoCryptoKeys
+	}
+
+	out := make([]byte, cryptoHeaderSize+aead.NonceSize(), cryptoHeaderSize+aead.NonceSize()+len(plaintext)+aead.Overhead())
+	out[0] = cryptoFormat
+	binary.BigEndian.PutUint32(out[1:cryptoHeaderSize], self.current)
+	nonce := out[cryptoHeaderSize:]
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(out, nonce, plaintext, aad), nil
+}
+
+// keyVersion is the version a ciphertext was sealed with
+func keyVersion(ciphertext []byte) (uint32, error) {
+	if len(ciphertext) < cryptoHeaderSize || ciphertext[0] != cryptoFormat {
+		return 0, errors.New("Not a ciphertext from Encrypt")
+	}
+	return binary.BigEndian.Uint32(ciphertext[1:cryptoHeaderSize]), nil
+}
+
+func (self *aeadCrypto) Decrypt(ciphertext, aad []byte) ([]byte, error) {
+	version, err := keyVersion(ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	aead, ok := self.ciphers[version]
+	if !ok {
+		return nil, fmt.Errorf("No key for version %d", version)
+	}
+
+	sealed := ciphertext[cryptoHeaderSize:]
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("Ciphertext is too short")
+	}
+	plain, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], aad)
+	if err != nil {
+		return nil, errors.New("Couldn't decrypt, the ciphertext or aad is wrong")
+	}
+	return plain, nil
+}
+
+func (self *aeadCrypto) EncryptString(plaintext string, aad []byte) (string, error) {
+	sealed, err := self.Encrypt([]byte(plaintext), aad)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func (self *aeadCrypto) DecryptString(ciphertext string, aad []byte) (string, error) {
+	sealed, err := base64.StdEncoding.DecodeString(ciphertext)
+	if err != nil {
+		return "", fmt.Errorf("Ciphertext isn't valid base64: %s", err)
+	}
+	plain, err := self.Decrypt(sealed, aad)
+	if err != nil {
+		return "", err
+	}
+	return string(plain), nil
+}
+
+func (self *aeadCrypto) NeedsRotation(ciphertext []byte) bool {
+	version, err := keyVersion(ciphertext)
+	return err == nil && version != self.current
+}
+
+func (self *aeadCrypto) versions() []uint32 {
+	versions := make([]uint32, 0, len(self.ciphers))
+	for version := range self.ciphers {
+		versions = append(versions, version)
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i] < versions[j] })
+	return versions
+}
+
+func (self *baseAppContext) Crypto() Crypto {
+	return self.crypto
+}
+
+// parseCryptoKeys reads "1:<base64 key>,2:<base64 key>"
+func parseCryptoKeys(val string) (map[uint32][]byte, error) {
+	keys := make(map[uint32][]byte)
+	for _, entry := range strings.Split(val, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, ":", 2)
+		if len(parts) != 2 {
+			return nil, errors.New("CRYPTO_KEYS should be version:base64key, comma separated")
+		}
+		version, err := strconv.ParseUint(parts[0], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid CRYPTO_KEYS version '%s'", parts[0])
+		}
+		key, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("CRYPTO_KEYS version %d isn't valid base64: %s", version, err)
+		}
+		keys[uint32(version)] = key
+	}
+	return keys, nil
+}
+
+// CRYPTO_KEYS (version:base64 key pairs, comma separated; best set
+// encrypted) or CRYPTO_KEY_PROVIDER, a name registered with
+// RegisterCryptoKeyProvider, give Crypto its keys. New values are encrypted
+// with CRYPTO_KEY_VERSION, the highest version by default, so a key is
+// rotated by adding it, then dropping the old one once NeedsRotation
+// values have been re-encrypted.
+func (self *baseAppContext) setCryptoFromEnv() error {
+	var keys map[uint32][]byte
+
+	if val := self.getEnv("CRYPTO_KEYS"); val != "" {
+		var err error
+		if keys, err = parseCryptoKeys(val); err != nil {
+			return err
+		}
+	} else if name := self.getEnv("CRYPTO_KEY_PROVIDER"); name != "" {
+		provider, err := getCryptoKeyProvider(name)
+		if err != nil {
+			return err
+		}
+		if keys, err = provider(); err != nil {
+			return fmt.Errorf("Error getting keys from provider '%s': %s", name, err)
+		}
+	}
+
+	var current uint32
+	for version := range keys {
+		if version > current {
+			current = version
+		}
+	}
+	if val := self.getEnv("CRYPTO_KEY_VERSION"); val != "" {
+		version, err := strconv.ParseUint(val, 10, 32)
+		if err != nil {
+			return fmt.Errorf("Invalid CRYPTO_KEY_VERSION '%s'", val)
+		}
+		current = uint32(version)
+	}
+
+	crypto, err := NewCrypto(keys, current)
+	if err != nil {
+		return err
+	}
+	self.crypto = crypto
+	return nil
+}
@@ -0,0 +1,108 @@
+package app_context
+
+import (
+	"bytes"
+	"encoding/base64"
+	"log"
+	"os"
+	"testing"
+)
+
+func TestCrypto(t *testing.T) {
+	old_key := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))
+	new_key := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{2}, 32))
+
+	os.Setenv("CRYPTO_KEYS", "1:"+old_key)
+	defer os.Unsetenv("CRYPTO_KEYS")
+
+	app_ctx, err := NewAppContext("crypto_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer app_ctx.Close()
+
+	aad := []byte("users:42:ssn")
+	sealed, err := app_ctx.Crypto().Encrypt([]byte("123-45-6789"), aad)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plain, err := app_ctx.Crypto().Decrypt(sealed, aad); err != nil || string(plain) != "123-45-6789" {
+		t.Errorf("Round trip failed: '%s', %v", plain, err)
+	}
+	if _, err := app_ctx.Crypto().Decrypt(sealed, []byte("users:43:ssn")); err == nil {
+		t.Error("Decrypt succeeded with the wrong aad")
+	}
+	if app_ctx.Crypto().NeedsRotation(sealed) {
+		t.Error("Ciphertext with the current key shouldn't need rotation")
+	}
+
+	// Rotate: version 2 becomes current, version 1 still decrypts
+	os.Setenv("CRYPTO_KEYS", "1:"+old_key+",2:"+new_key)
+	rotated, err := NewAppContext("crypto_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer rotated.Close()
+
+	if rotated.Crypto().KeyVersion() != 2 {
+		t.Errorf("Expected key version 2, got %d", rotated.Crypto().KeyVersion())
+	}
+	if !rotated.Crypto().NeedsRotation(sealed) {
+		t.Error("Ciphertext with the old key should need rotation")
+	}
+	if plain, err := rotated.Crypto().Decrypt(sealed, aad); err != nil || string(plain) != "123-45-6789" {
+		t.Errorf("Old key didn't decrypt after rotation: '%s', %v", plain, err)
+	}
+
+	str, err := rotated.Crypto().EncryptString("secret", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plain, err := rotated.Crypto().DecryptString(str, nil); err != nil || plain != "secret" {
+		t.Errorf("String round trip failed: '%s', %v", plain, err)
+	}
+	if _, err := app_ctx.Crypto().DecryptString(str, nil); err == nil {
+		t.Error("Decrypt succeeded without the key version")
+	}
+
+	os.Setenv("CRYPTO_KEY_VERSION", "3")
+	defer os.Unsetenv("CRYPTO_KEY_VERSION")
+	if _, err := NewAppContext("crypto_test"); err == nil {
+		t.Error("Expected a missing current key version to fail")
+	}
+}
+
+// Providers can only be registered once, so it's done here rather than
+// per run
+func init() {
+	RegisterCryptoKeyProvider("crypto_test", func() (map[uint32][]byte, error) {
+		return map[uint32][]byte{7: bytes.Repeat([]byte{7}, 32)}, nil
+	})
+}
+
+func TestCryptoKeyProvider(t *testing.T) {
+	os.Setenv("CRYPTO_KEY_PROVIDER", "crypto_test")
+	defer os.Unsetenv("CRYPTO_KEY_PROVIDER")
+
+	app_ctx, err := NewAppContext("crypto_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer app_ctx.Close()
+
+	if app_ctx.Crypto().KeyVersion() != 7 {
+		t.Errorf("Expected the provider's key version 7, got %d", app_ctx.Crypto().KeyVersion())
+	}
+}
+
+func TestCryptoUnconfigured(t *testing.T) {
+	app_ctx, err := NewAppContext("crypto_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer app_ctx.Close()
+
+	if _, err := app_ctx.Crypto().Encrypt([]byte("x"), nil); err != ErrNoCryptoKeys {
+		t.Errorf("Expected ErrNoCryptoKeys, got %v", err)
+	}
+}
@@ -0,0 +1,743 @@
+package app_context
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrUnknownDataset = errors.New("No dataset has that name")
+
+// DataFormat is how an export is written and an import read
+type DataFormat string
+
+const (
+	// DataFormatCSV has a header row of field names
+	DataFormatCSV DataFormat = "csv"
+	// DataFormatJSONL is a JSON object per line
+	DataFormatJSONL DataFormat = "jsonl"
+)
+
+// DatasetField is a column of a Dataset. Type is string, integer, number,
+// boolean or time (RFC 3339).
+type DatasetField struct {
+	Name     string
+	Type     string
+	Required bool
+}
+
+// Dataset is data ops and analytics can export and import. Exports run
+// Query with Args on DBRead and write the Fields of each row; imports
+// check each record has the Fields, of their types, and matches Schema if
+// one is named in SchemaRegistry(), then pass them in batches to Import in
+// a WithTx transaction.
+type Dataset struct {
+	Name   string
+	Fields []DatasetField
+	Query  string
+	Args   []interface{}
+	Schema string
+	Import func(ctx context.Context, tx *sql.Tx, records []map[string]interface{}) error
+}
+
+type DataTransferState string
+
+const (
+	DataTransferRunning   DataTransferState = "running"
+	DataTransferSucceeded DataTransferState = "succeeded"
+	DataTransferFailed    DataTransferState = "failed"
+)
+
+// DataTransfer is an export or import and how far it's got. Rejected
+// counts import records that didn't validate; Rejections are the first
+// of them.
+type DataTransfer struct {
+	ID         string            `json:"id"`
+	Kind       string            `json:"kind"`
+	Dataset    string            `json:"dataset"`
+	Format     DataFormat        `json:"format"`
+	Key        string            `json:"key"`
+	State      DataTransferState `json:"state"`
+	Rows       int               `json:"rows"`
+	Rejected   int               `json:"rejected"`
+	Rejections []string          `json:"rejections,omitempty"`
+	Error      string            `json:"error,omitempty"`
+	StartedAt  time.Time         `json:"started_at"`
+	FinishedAt time.Time         `json:"finished_at,omitempty"`
+}
+
+// DatasetRegistry streams registered datasets to and from ObjectStore().
+// Exports are written to DATA_EXPORT_PREFIX<dataset>/<transfer id>.<format>.
+// The last transfers can be followed with Transfer, or on the admin port
+// at /admin/datasets.
+type DatasetRegistry interface {
+	Register(ds Dataset) error
+	Names() []string
+	// Export writes name to the object store, returning once it's done
+	Export(ctx context.Context, name string, format DataFormat) (*DataTransfer, error)
+	// Import reads name from key in the object store, returning once it's
+	// done. Rejected records don't fail it.
+	Import(ctx context.Context, name string, key string, format DataFormat) (*DataTransfer, error)
+	Transfer(id string) (DataTransfer, bool)
+	Transfers() []DataTransfer
+}
+
+// maxDataTransfers is how many finished transfers are remembered, and
+// maxRejections how many rejections each keeps
+const (
+	maxDataTransfers = 50
+	maxRejections    = 100
+)
+
+type datasetRegistry struct {
+	appctx    *baseAppContext
+	prefix    string
+	batchSize int
+
+	lock      sync.Mutex
+	datasets  map[string]*Dataset
+	transfers []*DataTransfer
+}
+
+func newDatasetRegistry(appctx *baseAppContext) *datasetRegistry {
+	return &datasetRegistry{
+		appctx:    appctx,
+		prefix:    "exports/",
+		batchSize: 500,
+		datasets:  make(map[string]*Dataset),
+	}
+}
+
+func (self *datasetRegistry) Register(ds Dataset) error {
+	if ds.Name == "" {
+		return errors.New("Dataset name is required")
+	}
+	if len(ds.Fields) == 0 {
+		return fmt.Errorf("Dataset '%s' needs fields", ds.Name)
+	}
+	for _, field := range ds.Fields {
+		switch field.Type {
+		case "string", "integer", "number", "boolean", "time":
+		default:
+			return fmt.Errorf("Dataset '%s' field '%s' has unknown type '%s'", ds.Name, field.Name, field.Type)
+		}
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if _, ok := self.datasets[ds.Name]; ok {
+		return fmt.Errorf("Dataset '%s' is already registered", ds.Name)
+	}
+	self.datasets[ds.Name] = &ds
+	return nil
+}
+
+func (self *datasetRegistry) Names() []string {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	names := make([]string, 0, len(self.datasets))
+	for name := range self.datasets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (self *datasetRegistry) dataset(name string) (*Dataset, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	ds, ok := self.datasets[name]
+	if !ok {
+		return nil, ErrUnknownDataset
+	}
+	return ds, nil
+}
+
+// begin starts tracking a transfer, forgetting the oldest finished one if
+// there are too many. Transfers written to the store are given a key
+// under prefix.
+func (self *datasetRegistry) begin(kind string, ds *Dataset, format DataFormat, key string, prefix string) *DataTransfer {
+	transfer := &DataTransfer{
+		ID:        self.appctx.IDGenerator().NewID(),
+		Kind:      kind,
+		Dataset:   ds.Name,
+		Format:    format,
+		Key:       key,
+		State:     DataTransferRunning,
+		StartedAt: self.appctx.now(),
+	}
+	if prefix != "" {
+		transfer.Key = fmt.Sprintf("%s%s/%s.%s", prefix, ds.Name, transfer.ID, format)
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for i := 0; len(self.transfers) >= maxDataTransfers && i < len(self.transfers); i++ {
+		if self.transfers[i].State != DataTransferRunning {
+			self.transfers = append(self.transfers[:i], self.transfers[i+1:]...)
+			break
+		}
+	}
+	self.transfers = append(self.transfers, transfer)
+	return transfer
+}
+
+func (self *datasetRegistry) progress(transfer *DataTransfer, fn func(*DataTransfer)) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	fn(transfer)
+}
+
+func (self *datasetRegistry) finish(transfer *DataTransfer, err error) (*DataTransfer, error) {
+	tags := map[string]string{"dataset": transfer.Dataset, "kind": transfer.Kind}
+	mcli := self.appctx.MetricsClient()
+
+	self.lock.Lock()
+	transfer.FinishedAt = self.appctx.now()
+	transfer.State = DataTransferSucceeded
+	if err != nil {
+		transfer.State = DataTransferFailed
+		transfer.Error = err.Error()
+	}
+	result := *transfer
+	self.lock.Unlock()
+
+	mcli.Incr("data_transfer.rows", float64(result.Rows), tags)
+	if result.Rejected > 0 {
+		mcli.Incr("data_transfer.rejected", float64(result.Rejected), tags)
+	}
+	if err != nil {
+		mcli.Incr("data_transfer.failed", 1.0, tags)
+		self.appctx.Logger().LogErrorf(context.Background(), "Dataset %s of '%s' failed after %d rows: %s", result.Kind, result.Dataset, result.Rows, err)
+		return &result, err
+	}
+	self.appctx.Logger().LogInfof(context.Background(), "Dataset %s of '%s' (%s): %d rows, %d rejected", result.Kind, result.Dataset, result.Key, result.Rows, result.Rejected)
+	return &result, nil
+}
+
+func (self *datasetRegistry) Transfer(id string) (DataTransfer, bool) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for _, transfer := range self.transfers {
+		if transfer.ID == id {
+			return *transfer, true
+		}
+	}
+	return DataTransfer{}, false
+}
+
+// Transfers is the latest transfers, newest first
+func (self *datasetRegistry) Transfers() []DataTransfer {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	transfers := make([]DataTransfer, len(self.transfers))
+	for i, transfer := range self.transfers {
+		transfers[len(transfers)-1-i] = *transfer
+	}
+	return transfers
+}
+
+func checkDataFormat(format DataFormat) error {
+	if format != DataFormatCSV && format != DataFormatJSONL {
+		return fmt.Errorf("Unknown data format '%s'", format)
+	}
+	return nil
+}
+
+// exportValue is v from a row as it's written to JSON
+func exportValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case []byte:
+		return string(v)
+	case time.Time:
+		return v.UTC().Format(time.RFC3339Nano)
+	}
+	return v
+}
+
+func (self *datasetRegistry) Export(ctx context.Context, name string, format DataFormat) (*DataTransfer, error) {
+	ds, err := self.dataset(name)
+	if err != nil {
+		return nil, err
+	}
+	return self.export(ctx, "export", ds, format, self.prefix, ds.Fields, nil)
+}
+
+// errEnoughRows stops an export early without failing it
+var errEnoughRows = errors.New("Enough rows")
+
+// rowFilter changes or, returning nil, skips a row about to be exported
+type rowFilter func(row map[string]interface{}) (map[string]interface{}, error)
+
+// export writes fields of the rows of ds under prefix, through filter if
+// it's not nil
+func (self *datasetRegistry) export(ctx context.Context, kind string, ds *Dataset, format DataFormat, prefix string, fields []DatasetField, filter rowFilter) (*DataTransfer, error) {
+	if err := checkDataFormat(format); err != nil {
+		return nil, err
+	}
+	db := self.appctx.DBRead()
+	if db == nil {
+		return nil, errors.New("No database is configured")
+	}
+	transfer := self.begin(kind, ds, format, "", prefix)
+
+	// Rows are written to the store as they're read
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	pr, pw := io.Pipe()
+	put_err := make(chan error, 1)
+	go func() {
+		content_type := "text/csv"
+		if format == DataFormatJSONL {
+			content_type = "application/x-ndjson"
+		}
+		err := self.appctx.ObjectStore().Put(ctx, transfer.Key, pr, content_type)
+		pr.CloseWithError(err)
+		put_err <- err
+	}()
+
+	err := self.writeRows(ctx, ds, format, fields, filter, pw, transfer)
+	pw.CloseWithError(err)
+	if err == nil {
+		err = <-put_err
+	} else {
+		cancel()
+		<-put_err
+	}
+	return self.finish(transfer, err)
+}
+
+func (self *datasetRegistry) writeRows(ctx context.Context, ds *Dataset, format DataFormat, fields []DatasetField, filter rowFilter, w io.Writer, transfer *DataTransfer) error {
+	rows, err := self.appctx.DBRead().QueryContext(ctx, ds.Query, ds.Args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+	values := make([]interface{}, len(columns))
+	dest := make([]interface{}, len(columns))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+
+	bw := bufio.NewWriter(w)
+	csv_w := csv.NewWriter(bw)
+	enc := json.NewEncoder(bw)
+	if format == DataFormatCSV {
+		header := make([]string, len(fields))
+		for i, field := range fields {
+			header[i] = field.Name
+		}
+		csv_w.Write(header)
+	}
+
+	record := make([]string, len(fields))
+	for rows.Next() {
+		if err := rows.Scan(dest...); err != nil {
+			return err
+		}
+		row := make(map[string]interface{}, len(columns))
+		for i, column := range columns {
+			row[column] = values[i]
+		}
+		if filter != nil {
+			if row, err = filter(row); err == errEnoughRows {
+				break
+			} else if err != nil {
+				return err
+			} else if row == nil {
+				continue
+			}
+		}
+		if format == DataFormatCSV {
+			for i, field := range fields {
+				record[i] = ""
+				if v := exportValue(row[field.Name]); v != nil {
+					record[i] = fmt.Sprint(v)
+				}
+			}
+			if err := csv_w.Write(record); err != nil {
+				return err
+			}
+		} else {
+			doc := make(map[string]interface{}, len(fields))
+			for _, field := range fields {
+				doc[field.Name] = exportValue(row[field.Name])
+			}
+			if err := enc.Encode(doc); err != nil {
+				return err
+			}
+		}
+		self.progress(transfer, func(t *DataTransfer) { t.Rows++ })
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	csv_w.Flush()
+	if err := csv_w.Error(); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// csvValue marks strings read from CSV, which are parsed as any type.
+// Empty ones are missing.
+type csvValue string
+
+// importValue converts v, a string from CSV or a value from JSON, to
+// field's type
+func importValue(field DatasetField, v interface{}) (interface{}, error) {
+	if s, ok := v.(csvValue); ok {
+		if s == "" {
+			v = nil
+		} else {
+			return parseImportValue(field, string(s))
+		}
+	}
+	if v == nil {
+		if field.Required {
+			return nil, fmt.Errorf("%s is required", field.Name)
+		}
+		return nil, nil
+	}
+
+	// JSON values must have the right JSON type
+	switch v := v.(type) {
+	case string:
+		if field.Type == "string" || field.Type == "time" {
+			return parseImportValue(field, v)
+		}
+	case json.Number:
+		if field.Type == "integer" || field.Type == "number" {
+			return parseImportValue(field, v.String())
+		}
+	case bool:
+		if field.Type == "boolean" {
+			return v, nil
+		}
+	}
+	return nil, fmt.Errorf("%s must be a %s", field.Name, field.Type)
+}
+
+func parseImportValue(field DatasetField, s string) (interface{}, error) {
+	var (
+		value interface{}
+		err   error
+	)
+	switch field.Type {
+	case "string":
+		value = s
+	case "integer":
+		value, err = strconv.ParseInt(s, 10, 64)
+	case "number":
+		value, err = strconv.ParseFloat(s, 64)
+	case "boolean":
+		value, err = strconv.ParseBool(s)
+	case "time":
+		value, err = time.Parse(time.RFC3339Nano, s)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s must be a %s: '%s'", field.Name, field.Type, s)
+	}
+	return value, nil
+}
+
+func (self *datasetRegistry) Import(ctx context.Context, name string, key string, format DataFormat) (*DataTransfer, error) {
+	ds, err := self.dataset(name)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkDataFormat(format); err != nil {
+		return nil, err
+	}
+	if ds.Import == nil {
+		return nil, fmt.Errorf("Dataset '%s' can't be imported", name)
+	}
+	body, err := self.appctx.ObjectStore().Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	transfer := self.begin("import", ds, format, key, "")
+	return self.finish(transfer, self.readRecords(ctx, ds, format, body, transfer))
+}
+
+func (self *datasetRegistry) readRecords(ctx context.Context, ds *Dataset, format DataFormat, r io.Reader, transfer *DataTransfer) error {
+	fields := make(map[string]DatasetField, len(ds.Fields))
+	for _, field := range ds.Fields {
+		fields[field.Name] = field
+	}
+
+	// next returns the next record as read, and its line
+	var next func() (map[string]interface{}, int, error)
+	if format == DataFormatCSV {
+		csv_r := csv.NewReader(bufio.NewReader(r))
+		header, err := csv_r.Read()
+		if err != nil {
+			return fmt.Errorf("Error reading CSV header: %s", err)
+		}
+		for _, name := range header {
+			if _, ok := fields[name]; !ok {
+				return fmt.Errorf("Unknown column '%s'", name)
+			}
+		}
+		line := 1
+		next = func() (map[string]interface{}, int, error) {
+			row, err := csv_r.Read()
+			if err != nil {
+				return nil, 0, err
+			}
+			line++
+			raw := make(map[string]interface{}, len(header))
+			for i, name := range header {
+				raw[name] = csvValue(row[i])
+			}
+			return raw, line, nil
+		}
+	} else {
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+		line := 0
+		next = func() (map[string]interface{}, int, error) {
+			for scanner.Scan() {
+				line++
+				if strings.TrimSpace(scanner.Text()) == "" {
+					continue
+				}
+				raw := make(map[string]interface{})
+				dec := json.NewDecoder(strings.NewReader(scanner.Text()))
+				dec.UseNumber()
+				if err := dec.Decode(&raw); err != nil {
+					return nil, line, &datasetRejection{fmt.Sprintf("Invalid JSON: %s", err)}
+				}
+				return raw, line, nil
+			}
+			if err := scanner.Err(); err != nil {
+				return nil, 0, err
+			}
+			return nil, 0, io.EOF
+		}
+	}
+
+	var batch []map[string]interface{}
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		err := self.appctx.WithTx(ctx, func(tx *sql.Tx) error {
+			return ds.Import(ctx, tx, batch)
+		})
+		if err != nil {
+			return err
+		}
+		count := len(batch)
+		self.progress(transfer, func(t *DataTransfer) { t.Rows += count })
+		batch = nil
+		return nil
+	}
+
+	for {
+		raw, line, err := next()
+		if err == io.EOF {
+			break
+		}
+		if err == nil {
+			raw, err = self.validate(ds, fields, raw)
+		}
+		if rejection, ok := err.(*datasetRejection); ok {
+			self.progress(transfer, func(t *DataTransfer) {
+				t.Rejected++
+				if len(t.Rejections) < maxRejections {
+					t.Rejections = append(t.Rejections, fmt.Sprintf("line %d: %s", line, rejection.msg))
+				}
+			})
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		batch = append(batch, raw)
+		if len(batch) >= self.batchSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	return flush()
+}
+
+// datasetRejection is an import record that isn't valid
+type datasetRejection struct {
+	msg string
+}
+
+func (self *datasetRejection) Error() string {
+	return self.msg
+}
+
+func (self *datasetRegistry) validate(ds *Dataset, fields map[string]DatasetField, raw map[string]interface{}) (map[string]interface{}, error) {
+	record := make(map[string]interface{}, len(ds.Fields))
+	for name := range raw {
+		if _, ok := fields[name]; !ok {
+			return nil, &datasetRejection{fmt.Sprintf("Unknown field '%s'", name)}
+		}
+	}
+	for _, field := range ds.Fields {
+		value, err := importValue(field, raw[field.Name])
+		if err != nil {
+			return nil, &datasetRejection{err.Error()}
+		}
+		record[field.Name] = value
+	}
+
+	if ds.Schema != "" {
+		data, err := json.Marshal(record)
+		if err != nil {
+			return nil, err
+		}
+		if err := self.appctx.SchemaRegistry().ValidateDocument(ds.Schema, data); err != nil {
+			if _, ok := err.(*SchemaValidationError); !ok {
+				return nil, err
+			}
+			return nil, &datasetRejection{err.Error()}
+		}
+	}
+	return record, nil
+}
+
+type datasetAdminRequest struct {
+	Dataset string     `json:"dataset"`
+	Action  string     `json:"action"`
+	Format  DataFormat `json:"format"`
+	Key     string     `json:"key"`
+}
+
+// datasetsAdminHandler serves /admin/datasets:
+//
+//	GET                                         datasets and the latest transfers
+//	GET ?id=<transfer id>                       one transfer
+//	POST {"dataset", "action", "format", "key"} starts an "export" or "import"
+//
+// Transfers started here run in the background. Every request needs
+// ADMIN_TOKEN as a bearer token.
+func (self *baseAppContext) datasetsAdminHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !self.adminAuthorized(r) {
+			writeAdminError(w, http.StatusUnauthorized, "A valid ADMIN_TOKEN bearer token is required")
+			return
+		}
+
+		switch r.Method {
+		case "GET":
+			if id := r.URL.Query().Get("id"); id != "" {
+				transfer, ok := self.datasets.Transfer(id)
+				if !ok {
+					writeAdminError(w, http.StatusNotFound, "No such transfer: "+id)
+					return
+				}
+				writeAdminJSON(w, http.StatusOK, transfer)
+				return
+			}
+			writeAdminJSON(w, http.StatusOK, map[string]interface{}{
+				"datasets":  self.datasets.Names(),
+				"transfers": self.datasets.Transfers(),
+			})
+		case "POST":
+			var req datasetAdminRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				writeAdminError(w, http.StatusBadRequest, "Invalid JSON: "+err.Error())
+				return
+			}
+			if req.Format == "" {
+				req.Format = DataFormatCSV
+			}
+			if _, err := self.datasets.dataset(req.Dataset); err != nil {
+				writeAdminError(w, http.StatusNotFound, err.Error())
+				return
+			}
+			if err := checkDataFormat(req.Format); err != nil {
+				writeAdminError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			var run func(ctx context.Context) (*DataTransfer, error)
+			switch req.Action {
+			case "export":
+				run = func(ctx context.Context) (*DataTransfer, error) {
+					return self.datasets.Export(ctx, req.Dataset, req.Format)
+				}
+			case "import":
+				if req.Key == "" {
+					writeAdminError(w, http.StatusBadRequest, "key is required to import")
+					return
+				}
+				run = func(ctx context.Context) (*DataTransfer, error) {
+					return self.datasets.Import(ctx, req.Dataset, req.Key, req.Format)
+				}
+			default:
+				writeAdminError(w, http.StatusBadRequest, "action must be 'export' or 'import'")
+				return
+			}
+			self.Logger().LogInfof(r.Context(), "Dataset %s of '%s' started from the admin port", req.Action, req.Dataset)
+			goLabeled("datasets", func() {
+				run(context.Background())
+			}, "dataset", req.Dataset)
+			writeAdminJSON(w, http.StatusAccepted, map[string]interface{}{"started": req.Action, "dataset": req.Dataset})
+		default:
+			writeAdminError(w, http.StatusMethodNotAllowed, "Use GET or POST")
+		}
+	})
+}
+
+func (self *datasetRegistry) status() map[string]interface{} {
+	self.lock.Lock()
+	running := 0
+	for _, transfer := range self.transfers {
+		if transfer.State == DataTransferRunning {
+			running++
+		}
+	}
+	self.lock.Unlock()
+	return map[string]interface{}{
+		"datasets":   self.Names(),
+		"prefix":     self.prefix,
+		"batch_size": self.batchSize,
+		"running":    running,
+	}
+}
+
+func (self *baseAppContext) Datasets() DatasetRegistry {
+	return self.datasets
+}
+
+// DATA_EXPORT_PREFIX (default exports/) is where in the object store
+// exports go, and DATA_IMPORT_BATCH_SIZE (default 500) how many imported
+// records are passed to a dataset's Import at a time.
+func (self *baseAppContext) setDatasetsFromEnv() error {
+	if prefix, found := self.lookupEnv("DATA_EXPORT_PREFIX"); found {
+		self.datasets.prefix = prefix
+	}
+	if size, found, err := self.getIntFromEnv("DATA_IMPORT_BATCH_SIZE"); err != nil {
+		return err
+	} else if found {
+		if size <= 0 {
+			return errors.New("DATA_IMPORT_BATCH_SIZE must be > 0")
+		}
+		self.datasets.batchSize = size
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package app_context
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"io/ioutil"
+	"log"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDatasets(t *testing.T) {
+	app_ctx, err := NewAppContext("datasets_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer app_ctx.Close()
+
+	mcli := newCountingMetricsClient()
+	app_ctx.SetMetricsClient(mcli)
+	store := &fileObjectStore{root: t.TempDir()}
+	app_ctx.SetObjectStore(store)
+
+	db, err := app_ctx.(*baseAppContext).openDB("appctx_fake", "", "primary")
+	if err != nil {
+		t.Fatal(err)
+	}
+	app_ctx.SetDB(db)
+	defer app_ctx.SetDB(nil)
+
+	fakeQueryHook = func(query string, args []driver.Value) [][]driver.Value {
+		if query != "SELECT id, name, created FROM accounts" {
+			return nil
+		}
+		created := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+		return [][]driver.Value{
+			{int64(1), []byte("Ada, Countess"), created},
+			{int64(2), nil, created},
+		}
+	}
+	defer func() { fakeQueryHook = nil }()
+
+	var imported []map[string]interface{}
+	datasets := app_ctx.Datasets()
+	err = datasets.Register(Dataset{
+		Name: "accounts",
+		// fakeRows names its columns n, n1, ...
+		Fields: []DatasetField{
+			{Name: "n", Type: "integer", Required: true},
+			{Name: "n1", Type: "string"},
+			{Name: "n2", Type: "time"},
+		},
+		Query: "SELECT id, name, created FROM accounts",
+		Import: func(ctx context.Context, tx *sql.Tx, records []map[string]interface{}) error {
+			imported = append(imported, records...)
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := datasets.Register(Dataset{Name: "bad", Fields: []DatasetField{{Name: "n", Type: "uuid"}}}); err == nil {
+		t.Error("Expected an unknown field type to be refused")
+	}
+
+	ctx := context.Background()
+	read := func(key string) string {
+		body, err := store.Get(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer body.Close()
+		data, _ := ioutil.ReadAll(body)
+		return string(data)
+	}
+
+	transfer, err := datasets.Export(ctx, "accounts", DataFormatCSV)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if transfer.Rows != 2 || transfer.State != DataTransferSucceeded || !strings.HasPrefix(transfer.Key, "exports/accounts/") {
+		t.Errorf("Unexpected transfer: %+v", transfer)
+	}
+	if csv := read(transfer.Key); csv != "n,n1,n2\n1,\"Ada, Countess\",2026-10-01T12:00:00Z\n2,,2026-10-01T12:00:00Z\n" {
+		t.Errorf("Unexpected CSV: %q", csv)
+	}
+
+	transfer, err = datasets.Export(ctx, "accounts", DataFormatJSONL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if jsonl := read(transfer.Key); !strings.HasPrefix(jsonl, `{"n":1,"n1":"Ada, Countess","n2":"2026-10-01T12:00:00Z"}`+"\n") {
+		t.Errorf("Unexpected JSONL: %q", jsonl)
+	}
+
+	store.Put(ctx, "imports/accounts.csv", strings.NewReader("n,n1\n3,Grace\n,Nobody\nfour,Alan\n5,\n"), "text/csv")
+	transfer, err = datasets.Import(ctx, "accounts", "imports/accounts.csv", DataFormatCSV)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if transfer.Rows != 2 || transfer.Rejected != 2 || len(imported) != 2 {
+		t.Fatalf("Unexpected import: %+v %v", transfer, imported)
+	}
+	if imported[0]["n"] != int64(3) || imported[0]["n1"] != "Grace" || imported[1]["n1"] != nil {
+		t.Errorf("Unexpected records: %v", imported)
+	}
+	if transfer.Rejections[0] != "line 3: n is required" {
+		t.Errorf("Unexpected rejections: %v", transfer.Rejections)
+	}
+
+	imported = nil
+	store.Put(ctx, "imports/accounts.jsonl", strings.NewReader(`{"n": 6, "n2": "2026-10-02T00:00:00Z"}
+{"n": "7"}
+{"n": 8, "email": "x@example.com"}
+`), "application/x-ndjson")
+	transfer, err = datasets.Import(ctx, "accounts", "imports/accounts.jsonl", DataFormatJSONL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if transfer.Rows != 1 || transfer.Rejected != 2 || imported[0]["n"] != int64(6) {
+		t.Errorf("Unexpected import: %+v %v", transfer, imported)
+	}
+
+	if _, err := datasets.Export(ctx, "missing", DataFormatCSV); err != ErrUnknownDataset {
+		t.Errorf("Expected ErrUnknownDataset, got %v", err)
+	}
+	if transfers := datasets.Transfers(); len(transfers) != 4 || transfers[0].Kind != "import" {
+		t.Errorf("Unexpected transfers: %+v", transfers)
+	}
+	if mcli.count("data_transfer.rejected") != 2 {
+		t.Errorf("Expected rejections to be counted, got %v", mcli.counts)
+	}
+}
@@ -0,0 +1,424 @@
+package app_context
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// A QueryTracer wraps each database call in a span. StartQuery returns the
+// context to run the call with and a function to end the span with the
+// call's error, if any. op is one of exec, query, prepare, begin, commit,
+// rollback or ping; query is "" for the ones that don't have SQL.
+type QueryTracer interface {
+	StartQuery(ctx context.Context, op string, query string) (context.Context, func(err error))
+}
+
+func (self *baseAppContext) QueryTracer() QueryTracer {
+	self.componentsLock.RLock()
+	defer self.componentsLock.RUnlock()
+	return self.queryTracer
+}
+
+func (self *baseAppContext) SetQueryTracer(tracer QueryTracer) AppContext {
+	self.componentsLock.Lock()
+	defer self.componentsLock.Unlock()
+	self.queryTracer = tracer
+	return self
+}
+
+// instrumentedConnector opens connections with drv and wraps them so
+// every call reports db.query_duration_ms and db.errors, tagged with db
+// (the role) and op, and goes through the QueryTracer if one is set. The
+// app context's clients are looked up on each call, so swapping them
+// later still takes effect.
+type instrumentedConnector struct {
+	obs *dbObserver
+	dsn string
+	drv driver.Driver
+	// connector is drv's own, if it has one, so connecting honours ctx
+	connector driver.Connector
+}
+
+func (self *instrumentedConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	var conn driver.Conn
+	var err error
+	if self.connector != nil {
+		conn, err = self.connector.Connect(ctx)
+	} else {
+		conn, err = self.drv.Open(self.dsn)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &instrumentedConn{obs: self.obs, conn: conn}, nil
+}
+
+func (self *instrumentedConnector) Driver() driver.Driver {
+	return self.drv
+}
+
+// openDB opens dsn with the registered driver_name, instrumented unless
+// DB_INSTRUMENTATION_DISABLE=true. role tags its metrics. The wrapper is
+// also what applies DB_SESSION_SETTINGS, so the two can't be combined.
+func (self *baseAppContext) openDB(driver_name string, dsn string, role string) (*sqlx.DB, error) {
+	raw, err := sql.Open(driver_name, dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	disabled, err := self.isDisabled("DB_INSTRUMENTATION")
+	if err != nil {
+		raw.Close()
+		return nil, err
+	}
+	if disabled {
+		if len(self.dbSessionSettings) > 0 {
+			raw.Close()
+			return nil, errors.New("DB_SESSION_SETTINGS can't be used with DB_INSTRUMENTATION_DISABLE")
+		}
+		return sqlx.NewDb(raw, driver_name), nil
+	}
+
+	// Nothing has connected yet; raw was only needed to find the driver
+	drv := raw.Driver()
+	raw.Close()
+
+	connector := &instrumentedConnector{
+		obs: &dbObserver{appctx: self, role: role},
+		dsn: dsn,
+		drv: drv,
+	}
+	if dc, ok := drv.(driver.DriverContext); ok {
+		if connector.connector, err = dc.OpenConnector(dsn); err != nil {
+			return nil, err
+		}
+	}
+	db := sql.OpenDB(connector)
+	return sqlx.NewDb(db, driver_name), nil
+}
+
+type dbObserver struct {
+	appctx *baseAppContext
+	role   string
+}
+
+func (self *dbObserver) observe(ctx context.Context, op string, query string, fn func(ctx context.Context) error) error {
+	var finish func(error)
+	if tracer := self.appctx.QueryTracer(); tracer != nil {
+		ctx, finish = tracer.StartQuery(ctx, op, query)
+	}
+
+	start := time.Now()
+	err := fn(ctx)
+
+	if finish != nil {
+		finish(err)
+	}
+
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	prop := self.appctx.FieldPropagation()
+	tags := prop.MetricTags(ctx, map[string]string{"db": self.role, "op": op, "result": result})
+
+	elapsed := time.Since(start)
+	self.appctx.golden.observeQuery(elapsed, err)
+
+	mcli := self.appctx.MetricsClient()
+	mcli.TimingMS("db.query_duration_ms", float64(elapsed)/float64(time.Millisecond), 1.0, tags)
+	if err != nil {
+		mcli.Incr("db.errors", 1.0, prop.MetricTags(ctx, map[string]string{"db": self.role, "op": op}))
+	} else if self.role == "primary" && (op == "exec" || (op == "query" && isWriteQuery(query))) {
+		self.appctx.noteDBWrite(ctx)
+	}
+
+	return err
+}
+
+// comment prepends the propagated fields' SQL comment from ctx to query,
+// so they show up in the database's logs and pg_stat_activity
+func (self *dbObserver) comment(ctx context.Context, query string) string {
+	if comment := self.appctx.FieldPropagation().SQLComment(ctx); comment != "" {
+		return comment + " " + query
+	}
+	return query
+}
+
+func namedValuesToValues(named []driver.NamedValue) ([]driver.Value, error) {
+	args := make([]driver.Value, len(named))
+	for i, nv := range named {
+		if nv.Name != "" {
+			return nil, errors.New("Driver doesn't support named parameters")
+		}
+		args[i] = nv.Value
+	}
+	return args, nil
+}
+
+type instrumentedConn struct {
+	obs  *dbObserver
+	conn driver.Conn
+	// DB_SESSION_SETTINGS values last set on conn
+	session map[string]string
+}
+
+func (self *instrumentedConn) Prepare(query string) (driver.Stmt, error) {
+	return self.PrepareContext(context.Background(), query)
+}
+
+func (self *instrumentedConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	var stmt driver.Stmt
+	commented := self.obs.comment(ctx, query)
+	err := self.obs.observe(ctx, "prepare", query, func(ctx context.Context) (err error) {
+		if p, ok := self.conn.(driver.ConnPrepareContext); ok {
+			stmt, err = p.PrepareContext(ctx, commented)
+		} else {
+			stmt, err = self.conn.Prepare(commented)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &instrumentedStmt{obs: self.obs, conn: self, stmt: stmt, query: query}, nil
+}
+
+func (self *instrumentedConn) Close() error {
+	return self.conn.Close()
+}
+
+func (self *instrumentedConn) Begin() (driver.Tx, error) {
+	return self.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+func (self *instrumentedConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if err := self.applySession(ctx); err != nil {
+		return nil, err
+	}
+
+	var tx driver.Tx
+	err := self.obs.observe(ctx, "begin", "", func(ctx context.Context) (err error) {
+		if b, ok := self.conn.(driver.ConnBeginTx); ok {
+			tx, err = b.BeginTx(ctx, opts)
+		} else if opts.Isolation != 0 || opts.ReadOnly {
+			err = errors.New("Driver doesn't support transaction options")
+		} else {
+			tx, err = self.conn.Begin()
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &instrumentedTx{obs: self.obs, conn: self, tx: tx, ctx: ctx, readOnly: opts.ReadOnly}, nil
+}
+
+func (self *instrumentedConn) ExecContext(ctx context.Context, query string, named []driver.NamedValue) (driver.Result, error) {
+	// Without either, database/sql falls back to a prepared statement
+	if _, ok := self.conn.(driver.ExecerContext); !ok {
+		if _, ok := self.conn.(driver.Execer); !ok {
+			return nil, driver.ErrSkip
+		}
+	}
+	if err := self.applySession(ctx); err != nil {
+		return nil, err
+	}
+
+	var res driver.Result
+	commented := self.obs.comment(ctx, query)
+	err := self.obs.observe(ctx, "exec", query, func(ctx context.Context) (err error) {
+		if e, ok := self.conn.(driver.ExecerContext); ok {
+			res, err = e.ExecContext(ctx, commented, named)
+			return err
+		}
+		args, err := namedValuesToValues(named)
+		if err != nil {
+			return err
+		}
+		res, err = self.conn.(driver.Execer).Exec(commented, args)
+		return err
+	})
+	return res, err
+}
+
+func (self *instrumentedConn) QueryContext(ctx context.Context, query string, named []driver.NamedValue) (driver.Rows, error) {
+	if _, ok := self.conn.(driver.QueryerContext); !ok {
+		if _, ok := self.conn.(driver.Queryer); !ok {
+			return nil, driver.ErrSkip
+		}
+	}
+	if err := self.applySession(ctx); err != nil {
+		return nil, err
+	}
+
+	var rows driver.Rows
+	commented := self.obs.comment(ctx, query)
+	err := self.obs.observe(ctx, "query", query, func(ctx context.Context) (err error) {
+		if q, ok := self.conn.(driver.QueryerContext); ok {
+			rows, err = q.QueryContext(ctx, commented, named)
+			return err
+		}
+		args, err := namedValuesToValues(named)
+		if err != nil {
+			return err
+		}
+		rows, err = self.conn.(driver.Queryer).Query(commented, args)
+		return err
+	})
+	return rows, err
+}
+
+func (self *instrumentedConn) Ping(ctx context.Context) error {
+	p, ok := self.conn.(driver.Pinger)
+	if !ok {
+		return nil
+	}
+	return self.obs.observe(ctx, "ping", "", p.Ping)
+}
+
+func (self *instrumentedConn) CheckNamedValue(nv *driver.NamedValue) error {
+	if c, ok := self.conn.(driver.NamedValueChecker); ok {
+		return c.CheckNamedValue(nv)
+	}
+	return driver.ErrSkip
+}
+
+func (self *instrumentedConn) ResetSession(ctx context.Context) error {
+	if r, ok := self.conn.(driver.SessionResetter); ok {
+		return r.ResetSession(ctx)
+	}
+	return nil
+}
+
+func (self *instrumentedConn) IsValid() bool {
+	if v, ok := self.conn.(driver.Validator); ok {
+		return v.IsValid()
+	}
+	return true
+}
+
+type instrumentedTx struct {
+	obs  *dbObserver
+	conn *instrumentedConn
+	tx   driver.Tx
+	// ctx the transaction began with, for noting its writes on commit
+	ctx      context.Context
+	readOnly bool
+}
+
+func (self *instrumentedTx) Commit() error {
+	err := self.obs.observe(context.Background(), "commit", "", func(context.Context) error {
+		return self.tx.Commit()
+	})
+	if err != nil {
+		// A failed commit may have rolled back
+		self.conn.session = nil
+	} else if !self.readOnly && self.obs.role == "primary" {
+		self.obs.appctx.noteDBWrite(self.ctx)
+	}
+	return err
+}
+
+func (self *instrumentedTx) Rollback() error {
+	// Settings changed in the transaction are reverted with it
+	self.conn.session = nil
+	return self.obs.observe(context.Background(), "rollback", "", func(context.Context) error {
+		return self.tx.Rollback()
+	})
+}
+
+type instrumentedStmt struct {
+	obs   *dbObserver
+	conn  *instrumentedConn
+	stmt  driver.Stmt
+	query string
+}
+
+func (self *instrumentedStmt) Close() error {
+	return self.stmt.Close()
+}
+
+func (self *instrumentedStmt) NumInput() int {
+	return self.stmt.NumInput()
+}
+
+func (self *instrumentedStmt) Exec(args []driver.Value) (driver.Result, error) {
+	if err := self.conn.applySession(context.Background()); err != nil {
+		return nil, err
+	}
+
+	var res driver.Result
+	err := self.obs.observe(context.Background(), "exec", self.query, func(context.Context) (err error) {
+		res, err = self.stmt.Exec(args)
+		return err
+	})
+	return res, err
+}
+
+func (self *instrumentedStmt) Query(args []driver.Value) (driver.Rows, error) {
+	if err := self.conn.applySession(context.Background()); err != nil {
+		return nil, err
+	}
+
+	var rows driver.Rows
+	err := self.obs.observe(context.Background(), "query", self.query, func(context.Context) (err error) {
+		rows, err = self.stmt.Query(args)
+		return err
+	})
+	return rows, err
+}
+
+func (self *instrumentedStmt) ExecContext(ctx context.Context, named []driver.NamedValue) (driver.Result, error) {
+	if err := self.conn.applySession(ctx); err != nil {
+		return nil, err
+	}
+
+	var res driver.Result
+	err := self.obs.observe(ctx, "exec", self.query, func(ctx context.Context) (err error) {
+		if e, ok := self.stmt.(driver.StmtExecContext); ok {
+			res, err = e.ExecContext(ctx, named)
+			return err
+		}
+		args, err := namedValuesToValues(named)
+		if err != nil {
+			return err
+		}
+		res, err = self.stmt.Exec(args)
+		return err
+	})
+	return res, err
+}
+
+func (self *instrumentedStmt) QueryContext(ctx context.Context, named []driver.NamedValue) (driver.Rows, error) {
+	if err := self.conn.applySession(ctx); err != nil {
+		return nil, err
+	}
+
+	var rows driver.Rows
+	err := self.obs.observe(ctx, "query", self.query, func(ctx context.Context) (err error) {
+		if q, ok := self.stmt.(driver.StmtQueryContext); ok {
+			rows, err = q.QueryContext(ctx, named)
+			return err
+		}
+		args, err := namedValuesToValues(named)
+		if err != nil {
+			return err
+		}
+		rows, err = self.stmt.Query(args)
+		return err
+	})
+	return rows, err
+}
+
+func (self *instrumentedStmt) CheckNamedValue(nv *driver.NamedValue) error {
+	if c, ok := self.stmt.(driver.NamedValueChecker); ok {
+		return c.CheckNamedValue(nv)
+	}
+	return driver.ErrSkip
+}
@@ -0,0 +1,361 @@
+package app_context
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"testing"
+)
+
+// fakeDriver only implements the pre-context driver interfaces, like the
+// vendored lib/pq
+type fakeDriver struct{}
+
+// fakeDown holds DSNs that fail to connect
+var fakeDown sync.Map
+
+func (fakeDriver) Open(dsn string) (driver.Conn, error) {
+	if _, down := fakeDown.Load(dsn); down {
+		return nil, errors.New("Connection refused")
+	}
+	return &fakeConn{}, nil
+}
+
+type fakeConn struct{}
+
+func (self *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeStmt{query: query}, nil
+}
+
+func (self *fakeConn) Close() error {
+	return nil
+}
+
+func (self *fakeConn) Begin() (driver.Tx, error) {
+	if fakeTxHook != nil {
+		fakeTxHook("begin")
+	}
+	return &fakeTx{}, nil
+}
+
+// fakeTxHook, if set, is called with begin, commit and rollback
+var fakeTxHook func(op string)
+
+// fakeExecHook, if set, can fail fakeConn.Exec calls
+var fakeExecHook func(query string, args []driver.Value) error
+
+func (self *fakeConn) Exec(query string, args []driver.Value) (driver.Result, error) {
+	if query == "FAIL" {
+		return nil, errors.New("Failed")
+	}
+	if fakeExecHook != nil {
+		if err := fakeExecHook(query, args); err != nil {
+			return nil, err
+		}
+	}
+	return driver.RowsAffected(len(args)), nil
+}
+
+type fakeTx struct{}
+
+func (self *fakeTx) Commit() error {
+	if fakeTxHook != nil {
+		fakeTxHook("commit")
+	}
+	return nil
+}
+
+func (self *fakeTx) Rollback() error {
+	if fakeTxHook != nil {
+		fakeTxHook("rollback")
+	}
+	return nil
+}
+
+type fakeStmt struct {
+	query string
+}
+
+func (self *fakeStmt) Close() error {
+	return nil
+}
+
+func (self *fakeStmt) NumInput() int {
+	return -1
+}
+
+func (self *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return driver.RowsAffected(0), nil
+}
+
+// fakeQueryHook, if set, can return the rows for fakeStmt.Query calls. A
+// nil result is the usual single row.
+var fakeQueryHook func(query string, args []driver.Value) [][]driver.Value
+
+func (self *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	if fakeQueryHook != nil {
+		if rows := fakeQueryHook(self.query, args); rows != nil {
+			return &fakeRows{rows: rows}, nil
+		}
+	}
+	return &fakeRows{rows: [][]driver.Value{{int64(1)}}}, nil
+}
+
+type fakeRows struct {
+	rows [][]driver.Value
+}
+
+func (self *fakeRows) Columns() []string {
+	columns := []string{"n"}
+	if len(self.rows) > 0 {
+		for i := 1; i < len(self.rows[0]); i++ {
+			columns = append(columns, fmt.Sprintf("n%d", i))
+		}
+	}
+	return columns
+}
+
+func (self *fakeRows) Close() error {
+	return nil
+}
+
+func (self *fakeRows) Next(dest []driver.Value) error {
+	if len(self.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, self.rows[0])
+	self.rows = self.rows[1:]
+	return nil
+}
+
+type recordingTracer struct {
+	lock sync.Mutex
+	ops  []string
+	errs int
+}
+
+func (self *recordingTracer) StartQuery(ctx context.Context, op string, query string) (context.Context, func(error)) {
+	return ctx, func(err error) {
+		self.lock.Lock()
+		defer self.lock.Unlock()
+		self.ops = append(self.ops, op)
+		if err != nil {
+			self.errs++
+		}
+	}
+}
+
+// fakeContextDriver has its own Connector, like newer drivers, which
+// records the contexts it connects with
+type fakeContextDriver struct {
+	fakeDriver
+}
+
+type fakeConnector struct {
+	lock sync.Mutex
+	ctxs []context.Context
+}
+
+// fakeConnectors are the connectors fakeContextDriver has opened, by DSN
+var fakeConnectors sync.Map
+
+func (fakeContextDriver) OpenConnector(dsn string) (driver.Connector, error) {
+	connector := &fakeConnector{}
+	fakeConnectors.Store(dsn, connector)
+	return connector, nil
+}
+
+func (self *fakeConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.ctxs = append(self.ctxs, ctx)
+	return &fakeConn{}, nil
+}
+
+func (self *fakeConnector) Driver() driver.Driver {
+	return fakeContextDriver{}
+}
+
+func init() {
+	sql.Register("appctx_fake", fakeDriver{})
+	sql.Register("appctx_fake_ctx", fakeContextDriver{})
+}
+
+func TestInstrumentedDB(t *testing.T) {
+	app_ctx, err := NewAppContext("db_driver_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer app_ctx.Close()
+
+	mcli := newCountingMetricsClient()
+	app_ctx.SetMetricsClient(mcli)
+	tracer := &recordingTracer{}
+	app_ctx.SetQueryTracer(tracer)
+
+	db, err := app_ctx.(*baseAppContext).openDB("appctx_fake", "", "primary")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if _, err := db.Exec("UPDATE things SET x = $1", 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("FAIL"); err == nil {
+		t.Error("Expected exec to fail")
+	}
+
+	var n int
+	if err := db.QueryRow("SELECT 1").Scan(&n); err != nil || n != 1 {
+		t.Errorf("Query through the wrapper failed: %v, %d", err, n)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	if c := mcli.counts["db.errors"]; c != 1 {
+		t.Errorf("Expected 1 db.errors, got %d", c)
+	}
+	if tags := mcli.tags["db.errors"]; tags["op"] != "exec" {
+		t.Errorf("Unexpected db.errors tags: %v", tags)
+	}
+	// exec, exec, prepare + query (the fake has no Queryer), begin, commit
+	if c := mcli.counts["db.query_duration_ms"]; c != 6 {
+		t.Errorf("Expected 6 timings, got %d", c)
+	}
+
+	expected := []string{"exec", "exec", "prepare", "query", "begin", "commit"}
+	if len(tracer.ops) != len(expected) || tracer.errs != 1 {
+		t.Fatalf("Unexpected traced ops: %v (%d errors)", tracer.ops, tracer.errs)
+	}
+	for i, op := range expected {
+		if tracer.ops[i] != op {
+			t.Errorf("Traced op %d was %s, expected %s", i, tracer.ops[i], op)
+		}
+	}
+}
+
+func TestInstrumentedDBPropagation(t *testing.T) {
+	app_ctx, err := NewAppContext("db_driver_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer app_ctx.Close()
+
+	mcli := newCountingMetricsClient()
+	app_ctx.SetMetricsClient(mcli)
+
+	db, err := app_ctx.(*baseAppContext).openDB("appctx_fake", "", "primary")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var lock sync.Mutex
+	var queries []string
+	fakeExecHook = func(query string, args []driver.Value) error {
+		lock.Lock()
+		defer lock.Unlock()
+		queries = append(queries, query)
+		return nil
+	}
+	defer func() { fakeExecHook = nil }()
+	fakeQueryHook = func(query string, args []driver.Value) [][]driver.Value {
+		lock.Lock()
+		defer lock.Unlock()
+		queries = append(queries, query)
+		return nil
+	}
+	defer func() { fakeQueryHook = nil }()
+
+	ctx := WithCostCenter(context.Background(), "payments")
+	if _, err := db.ExecContext(ctx, "UPDATE things SET x = 1"); err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	if err := db.QueryRowContext(ctx, "SELECT 1").Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	expected := []string{
+		"/*cost_center='payments'*/ UPDATE things SET x = 1",
+		"/*cost_center='payments'*/ SELECT 1",
+	}
+	if len(queries) != 2 || queries[0] != expected[0] || queries[1] != expected[1] {
+		t.Errorf("Expected the SQL comment on each query, got %q", queries)
+	}
+	if tags := mcli.tags["db.query_duration_ms"]; tags["cost_center"] != "payments" || tags["db"] != "primary" {
+		t.Errorf("Unexpected db.query_duration_ms tags: %v", tags)
+	}
+}
+
+func TestInstrumentedDBConnector(t *testing.T) {
+	app_ctx, err := NewAppContext("db_driver_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer app_ctx.Close()
+
+	db, err := app_ctx.(*baseAppContext).openDB("appctx_fake_ctx", "connector_test", "primary")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	type key struct{}
+	if err := db.PingContext(context.WithValue(context.Background(), key{}, "ping")); err != nil {
+		t.Fatal(err)
+	}
+	connector, _ := fakeConnectors.Load("connector_test")
+	if connector == nil {
+		t.Fatal("Expected the driver's connector to be opened")
+	}
+	fc := connector.(*fakeConnector)
+	fc.lock.Lock()
+	defer fc.lock.Unlock()
+	if len(fc.ctxs) != 1 || fc.ctxs[0].Value(key{}) != "ping" {
+		t.Errorf("Expected the connector to get the caller's context, got %v", fc.ctxs)
+	}
+}
+
+func TestInstrumentationDisable(t *testing.T) {
+	os.Setenv("DB_INSTRUMENTATION_DISABLE", "true")
+	defer os.Unsetenv("DB_INSTRUMENTATION_DISABLE")
+
+	app_ctx, err := NewAppContext("db_driver_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer app_ctx.Close()
+
+	db, err := app_ctx.(*baseAppContext).openDB("appctx_fake", "", "primary")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if _, ok := db.Driver().(fakeDriver); !ok {
+		t.Errorf("Unexpected driver: %T", db.Driver())
+	}
+
+	mcli := newCountingMetricsClient()
+	app_ctx.SetMetricsClient(mcli)
+	db.Exec("SELECT 1")
+	if len(mcli.counts) != 0 {
+		t.Errorf("Disabled instrumentation still emitted metrics: %v", mcli.counts)
+	}
+}
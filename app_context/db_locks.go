@@ -0,0 +1,30 @@
+package app_context
+
+import (
+	"context"
+	"database/sql"
+	"hash/fnv"
+)
+
+// advisoryLockID is the Postgres advisory lock key for name, scoped to
+// the app so apps sharing a database don't block each other
+func (self *baseAppContext) advisoryLockID(kind, name string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte(kind + ":" + self.appName + ":" + name))
+	return int64(h.Sum64())
+}
+
+// tryAdvisoryLock takes a session advisory lock on conn without waiting
+// for it. If it's taken, unlock releases it.
+func tryAdvisoryLock(ctx context.Context, conn *sql.Conn, lock_id int64) (bool, func(), error) {
+	var locked bool
+	if err := conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", lock_id).Scan(&locked); err != nil {
+		return false, nil, err
+	}
+	if !locked {
+		return false, nil, nil
+	}
+	return true, func() {
+		conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", lock_id)
+	}, nil
+}
@@ -0,0 +1,150 @@
+package app_context
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// dbReplica pings the read replica in the background. Reads only go to it
+// while the last ping succeeded; until the first one does, and whenever it
+// fails, DBRead returns the primary.
+type dbReplica struct {
+	appctx   *baseAppContext
+	db       *sqlx.DB
+	interval time.Duration
+	timeout  time.Duration
+	healthy  int32
+	checked  bool
+	sticky   *dbSticky
+	stopChan chan struct{}
+	doneChan chan struct{}
+}
+
+func (self *dbReplica) isHealthy() bool {
+	return atomic.LoadInt32(&self.healthy) == 1
+}
+
+func (self *dbReplica) check() {
+	ctx, cancel := context.WithTimeout(context.Background(), self.timeout)
+	defer cancel()
+
+	err := self.db.PingContext(ctx)
+	self.appctx.Health().SetStatus("db_replica", err)
+
+	var healthy int32
+	if err == nil {
+		healthy = 1
+	}
+	self.appctx.MetricsClient().Gauge("db.replica_healthy", float64(healthy), 1.0, nil)
+
+	// Only log changes, and the first result either way
+	if atomic.SwapInt32(&self.healthy, healthy) == healthy && self.checked {
+		return
+	}
+	self.checked = true
+
+	if err != nil {
+		self.appctx.Logger().LogErrorf(context.Background(), "DB replica is down, reading from the primary: %s", err)
+	} else {
+		self.appctx.Logger().LogInfof(context.Background(), "DB replica is up, reading from it")
+	}
+}
+
+func (self *dbReplica) start() {
+	self.stopChan = make(chan struct{})
+	self.doneChan = make(chan struct{})
+
+	goLabeled("db", func() {
+		defer close(self.doneChan)
+		ticker := self.appctx.Clock().NewTicker(self.interval)
+		defer ticker.Stop()
+		for {
+			self.check()
+			select {
+			case <-self.stopChan:
+				return
+			case <-ticker.C():
+			}
+		}
+	}, "db", "replica")
+}
+
+func (self *dbReplica) stop() {
+	if self.stopChan == nil {
+		return
+	}
+	close(self.stopChan)
+	<-self.doneChan
+	self.stopChan = nil
+}
+
+// DBRead returns the replica if DB_REPLICA_DSN is set and the replica is
+// healthy, otherwise the primary. Rows may lag behind writes; see
+// DBReadContext.
+func (self *baseAppContext) DBRead() *sqlx.DB {
+	if self.dbReplica != nil && self.dbReplica.isHealthy() {
+		return self.dbReplica.db
+	}
+	return self.DB()
+}
+
+// DBWrite returns the primary
+func (self *baseAppContext) DBWrite() *sqlx.DB {
+	return self.DB()
+}
+
+// DB_REPLICA_DSN opens a read replica for DBRead. It's pinged every
+// DB_REPLICA_CHECK_INTERVAL (default 5s), each ping timing out after
+// DB_REPLICA_CHECK_TIMEOUT (default 2s).
+func (self *baseAppContext) setDBReplicaFromEnv() error {
+	dsn := self.getEnv("DB_REPLICA_DSN")
+	if dsn == "" {
+		return nil
+	}
+	if self.db == nil {
+		return errors.New("DB_REPLICA_DSN needs DB_DSN to be set")
+	}
+
+	replica := &dbReplica{
+		appctx:   self,
+		interval: 5 * time.Second,
+		timeout:  2 * time.Second,
+	}
+
+	if interval, found, err := self.getDurationFromEnv("DB_REPLICA_CHECK_INTERVAL"); err != nil {
+		return err
+	} else if found {
+		if interval <= 0 {
+			return errors.New("DB_REPLICA_CHECK_INTERVAL must be > 0")
+		}
+		replica.interval = interval
+	}
+
+	if timeout, found, err := self.getDurationFromEnv("DB_REPLICA_CHECK_TIMEOUT"); err != nil {
+		return err
+	} else if found {
+		if timeout <= 0 {
+			return errors.New("DB_REPLICA_CHECK_TIMEOUT must be > 0")
+		}
+		replica.timeout = timeout
+	}
+
+	if err := self.setDBStickyFromEnv(replica); err != nil {
+		return err
+	}
+
+	db, err := self.openDB("postgres", dsn, "replica")
+	if err != nil {
+		return errors.New("Couldn't open the replica database. Check that DB_REPLICA_DSN is correct.")
+	}
+
+	replica.db = db
+	self.dbReplica = replica
+	replica.start()
+
+	return nil
+}
@@ -0,0 +1,161 @@
+package app_context
+
+import (
+	"context"
+	"log"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestDBReplicaFallback(t *testing.T) {
+	app_ctx, err := NewAppContext("db_replica_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer app_ctx.Close()
+
+	base := app_ctx.(*baseAppContext)
+
+	primary, err := base.openDB("appctx_fake", "primary", "primary")
+	if err != nil {
+		t.Fatal(err)
+	}
+	app_ctx.SetDB(primary)
+	defer app_ctx.SetDB(nil)
+
+	if app_ctx.DBRead() != primary || app_ctx.DBWrite() != primary {
+		t.Error("Without a replica reads and writes should use the primary")
+	}
+
+	fakeDown.Store("replica", true)
+	defer fakeDown.Delete("replica")
+
+	replica_db, err := base.openDB("appctx_fake", "replica", "replica")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// No idle connections, so every ping has to reconnect
+	replica_db.SetMaxIdleConns(0)
+
+	base.dbReplica = &dbReplica{
+		appctx:   base,
+		db:       replica_db,
+		interval: 10 * time.Millisecond,
+		timeout:  time.Second,
+	}
+	base.dbReplica.start()
+
+	ctx := context.Background()
+	replicaHealth := func() *HealthResult {
+		for _, res := range app_ctx.Health().Check(ctx) {
+			if res.Name == "db_replica" {
+				return res
+			}
+		}
+		return nil
+	}
+
+	waitFor(t, "replica health check", func() bool {
+		return replicaHealth() != nil
+	})
+	if app_ctx.DBRead() != primary {
+		t.Error("Reads should fall back to the primary while the replica is down")
+	}
+	if replicaHealth().Healthy {
+		t.Error("Replica should be unhealthy")
+	}
+
+	fakeDown.Delete("replica")
+	waitFor(t, "replica to come up", func() bool {
+		return app_ctx.DBRead() == replica_db
+	})
+	if app_ctx.DBWrite() != primary {
+		t.Error("Writes should always use the primary")
+	}
+
+	fakeDown.Store("replica", true)
+	waitFor(t, "fallback to the primary", func() bool {
+		return app_ctx.DBRead() == primary
+	})
+}
+
+func TestDBReplicaStickyReads(t *testing.T) {
+	os.Setenv("DB_REPLICA_STICKY_WINDOW", "200ms")
+	os.Setenv("DB_REPLICA_STICKY_FIELD", "user_id")
+	defer os.Unsetenv("DB_REPLICA_STICKY_WINDOW")
+	defer os.Unsetenv("DB_REPLICA_STICKY_FIELD")
+
+	app_ctx, err := NewAppContext("db_replica_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer app_ctx.Close()
+
+	base := app_ctx.(*baseAppContext)
+
+	primary, err := base.openDB("appctx_fake", "primary", "primary")
+	if err != nil {
+		t.Fatal(err)
+	}
+	app_ctx.SetDB(primary)
+	defer app_ctx.SetDB(nil)
+
+	replica_db, err := base.openDB("appctx_fake", "replica", "replica")
+	if err != nil {
+		t.Fatal(err)
+	}
+	replica := &dbReplica{appctx: base, db: replica_db, healthy: 1}
+	if err := base.setDBStickyFromEnv(replica); err != nil {
+		t.Fatal(err)
+	}
+	base.dbReplica = replica
+	defer func() { base.dbReplica = nil }()
+
+	session := WithReadYourWrites(context.Background())
+	other := WithReadYourWrites(context.Background())
+	if app_ctx.DBReadContext(session) != replica_db {
+		t.Error("Reads should use the replica before any writes")
+	}
+
+	// Reads on the replica don't count as writes
+	replica_db.ExecContext(session, "UPDATE things")
+	if app_ctx.DBReadContext(session) != replica_db {
+		t.Error("Writes to the replica shouldn't make reads sticky")
+	}
+
+	if _, err := primary.ExecContext(session, "UPDATE things"); err != nil {
+		t.Fatal(err)
+	}
+	if app_ctx.DBReadContext(session) != primary {
+		t.Error("Reads should use the primary right after a write")
+	}
+	if app_ctx.DBReadContext(other) != replica_db {
+		t.Error("Other sessions should still use the replica")
+	}
+
+	// Requests for the same user share a session
+	user_ctx := WithField(context.Background(), "user_id", "42")
+	tx, err := primary.BeginTx(user_ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if app_ctx.DBReadContext(WithField(context.Background(), "user_id", "42")) != primary {
+		t.Error("Reads should use the primary after the same user committed")
+	}
+
+	waitFor(t, "the sticky window to pass", func() bool {
+		return app_ctx.DBReadContext(session) == replica_db
+	})
+	if app_ctx.DBRead() != replica_db {
+		t.Error("DBRead should ignore sessions")
+	}
+
+	os.Setenv("DB_REPLICA_STICKY_WINDOW", "0")
+	if err := base.setDBStickyFromEnv(&dbReplica{}); err == nil {
+		t.Error("Expected DB_REPLICA_STICKY_FIELD without a window to fail")
+	}
+}
@@ -0,0 +1,111 @@
+package app_context
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"strings"
+)
+
+// TenantField is the propagated field WithTenant sets. Map it to a
+// Postgres setting with DB_SESSION_SETTINGS=app.tenant_id=tenant_id and
+// row-level security policies can use current_setting('app.tenant_id').
+const TenantField = "tenant_id"
+
+func WithTenant(ctx context.Context, tenant_id string) context.Context {
+	return WithField(ctx, TenantField, tenant_id)
+}
+
+func TenantFromContext(ctx context.Context) string {
+	return FieldFromContext(ctx, TenantField)
+}
+
+type dbSessionSetting struct {
+	setting string
+	field   string
+}
+
+// applySession sets each DB_SESSION_SETTINGS setting on the connection to
+// its field's value in ctx, or an empty string if ctx doesn't have one, so
+// a pooled connection never runs a query with a previous caller's tenant.
+// Settings already at the right value aren't sent again, until a rollback
+// may have reverted them.
+func (self *instrumentedConn) applySession(ctx context.Context) error {
+	settings := self.obs.appctx.dbSessionSettings
+	if len(settings) == 0 {
+		return nil
+	}
+
+	for _, s := range settings {
+		value := self.obs.appctx.FieldPropagation().Field(ctx, s.field)
+		if self.session[s.setting] == value {
+			continue
+		}
+		if err := self.execRaw(ctx, "SELECT set_config($1, $2, false)", s.setting, value); err != nil {
+			return fmt.Errorf("Error setting %s: %s", s.setting, err)
+		}
+		if self.session == nil {
+			self.session = make(map[string]string)
+		}
+		self.session[s.setting] = value
+	}
+	return nil
+}
+
+// execRaw runs query on the underlying connection, skipping metrics and
+// tracing
+func (self *instrumentedConn) execRaw(ctx context.Context, query string, args ...string) error {
+	values := make([]driver.Value, len(args))
+	named := make([]driver.NamedValue, len(args))
+	for i, arg := range args {
+		values[i] = arg
+		named[i] = driver.NamedValue{Ordinal: i + 1, Value: arg}
+	}
+
+	if e, ok := self.conn.(driver.ExecerContext); ok {
+		_, err := e.ExecContext(ctx, query, named)
+		return err
+	}
+	if e, ok := self.conn.(driver.Execer); ok {
+		_, err := e.Exec(query, values)
+		if err != driver.ErrSkip {
+			return err
+		}
+	}
+
+	stmt, err := self.conn.Prepare(query)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	_, err = stmt.Exec(values)
+	return err
+}
+
+// DB_SESSION_SETTINGS maps Postgres settings to propagated fields, as a
+// comma separated list of setting=field. Each connection has the settings
+// applied from the context of whatever is using it.
+func (self *baseAppContext) setDBSessionSettingsFromEnv() error {
+	val := self.getEnv("DB_SESSION_SETTINGS")
+	if val == "" {
+		return nil
+	}
+
+	settings := make([]*dbSessionSetting, 0)
+	for _, part := range strings.Split(val, ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return fmt.Errorf("DB_SESSION_SETTINGS should be in format: setting=field,...")
+		}
+		// Custom settings need a prefix, which also keeps this from
+		// changing built-in ones like search_path
+		if !strings.Contains(kv[0], ".") {
+			return fmt.Errorf("DB_SESSION_SETTINGS setting '%s' must be namespaced, like app.%s", kv[0], kv[0])
+		}
+		settings = append(settings, &dbSessionSetting{setting: kv[0], field: kv[1]})
+	}
+
+	self.dbSessionSettings = settings
+
+	return nil
+}
@@ -0,0 +1,168 @@
+package app_context
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"log"
+	"os"
+	"testing"
+)
+
+func TestDBSessionSettings(t *testing.T) {
+	os.Setenv("DB_SESSION_SETTINGS", "app.tenant_id=tenant_id, app.user_id=user_id")
+	defer os.Unsetenv("DB_SESSION_SETTINGS")
+
+	app_ctx, err := NewAppContext("db_session_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer app_ctx.Close()
+
+	db, err := app_ctx.(*baseAppContext).openDB("appctx_fake", "", "primary")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	var queries []string
+	fail_settings := false
+	fakeExecHook = func(query string, args []driver.Value) error {
+		if query == "SELECT set_config($1, $2, false)" {
+			if fail_settings {
+				return errors.New("Failed")
+			}
+			query = args[0].(string) + "=" + args[1].(string)
+		}
+		queries = append(queries, query)
+		return nil
+	}
+	defer func() { fakeExecHook = nil }()
+
+	ctx := WithField(WithTenant(context.Background(), "t1"), "user_id", "u1")
+	if TenantFromContext(ctx) != "t1" {
+		t.Errorf("Expected tenant t1, got '%s'", TenantFromContext(ctx))
+	}
+
+	db.ExecContext(ctx, "UPDATE a")
+	db.ExecContext(ctx, "UPDATE b")
+	db.ExecContext(WithTenant(context.Background(), "t2"), "UPDATE c")
+
+	expected := []string{
+		"app.tenant_id=t1", "app.user_id=u1", "UPDATE a",
+		"UPDATE b",
+		"app.tenant_id=t2", "app.user_id=", "UPDATE c",
+	}
+	if len(queries) != len(expected) {
+		t.Fatalf("Unexpected queries: %v", queries)
+	}
+	for i, query := range expected {
+		if queries[i] != query {
+			t.Errorf("Query %d was '%s', expected '%s'", i, queries[i], query)
+		}
+	}
+
+	// A query never runs without its settings
+	queries = nil
+	fail_settings = true
+	if _, err := db.ExecContext(ctx, "UPDATE d"); err == nil {
+		t.Error("Expected the exec to fail")
+	}
+	if len(queries) != 0 {
+		t.Errorf("Query ran without its settings: %v", queries)
+	}
+}
+
+func TestDBSessionSettingsRollback(t *testing.T) {
+	os.Setenv("DB_SESSION_SETTINGS", "app.tenant_id=tenant_id")
+	defer os.Unsetenv("DB_SESSION_SETTINGS")
+
+	app_ctx, err := NewAppContext("db_session_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer app_ctx.Close()
+
+	db, err := app_ctx.(*baseAppContext).openDB("appctx_fake", "", "primary")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	// Plays the server: the setting is reverted when a transaction rolls
+	// back, and each query notes the tenant it ran as
+	var tenant, saved string
+	var queries []string
+	fakeTxHook = func(op string) {
+		switch op {
+		case "begin":
+			saved = tenant
+		case "rollback":
+			tenant = saved
+		}
+	}
+	fakeExecHook = func(query string, args []driver.Value) error {
+		if query == "SELECT set_config($1, $2, false)" {
+			tenant = args[1].(string)
+		} else {
+			queries = append(queries, query+"@"+tenant)
+		}
+		return nil
+	}
+	defer func() { fakeExecHook, fakeTxHook = nil, nil }()
+
+	ctx_a := WithTenant(context.Background(), "a")
+	ctx_b := WithTenant(context.Background(), "b")
+
+	tx, err := db.BeginTx(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx.ExecContext(ctx_a, "UPDATE a")
+	tx.Rollback()
+	db.ExecContext(ctx_a, "UPDATE b")
+
+	tx, err = db.BeginTx(ctx_a, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx.ExecContext(ctx_b, "UPDATE c")
+	tx.Rollback()
+	db.ExecContext(ctx_b, "UPDATE d")
+	db.ExecContext(ctx_a, "UPDATE e")
+
+	expected := []string{"UPDATE a@a", "UPDATE b@a", "UPDATE c@b", "UPDATE d@b", "UPDATE e@a"}
+	if len(queries) != len(expected) {
+		t.Fatalf("Unexpected queries: %v", queries)
+	}
+	for i, query := range expected {
+		if queries[i] != query {
+			t.Errorf("Query %d was '%s', expected '%s'", i, queries[i], query)
+		}
+	}
+}
+
+func TestDBSessionSettingsFromEnv(t *testing.T) {
+	for _, val := range []string{"tenant_id", "app.tenant_id=", "tenant_id=tenant_id"} {
+		os.Setenv("DB_SESSION_SETTINGS", val)
+		if _, err := NewAppContext("db_session_test"); err == nil {
+			t.Errorf("Expected DB_SESSION_SETTINGS=%s to fail", val)
+		}
+	}
+
+	os.Setenv("DB_SESSION_SETTINGS", "app.tenant_id=tenant_id")
+	os.Setenv("DB_INSTRUMENTATION_DISABLE", "true")
+	defer os.Unsetenv("DB_SESSION_SETTINGS")
+	defer os.Unsetenv("DB_INSTRUMENTATION_DISABLE")
+
+	app_ctx, err := NewAppContext("db_session_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer app_ctx.Close()
+	if _, err := app_ctx.(*baseAppContext).openDB("appctx_fake", "", "primary"); err == nil {
+		t.Error("Expected session settings without instrumentation to fail")
+	}
+}
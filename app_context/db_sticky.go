@@ -0,0 +1,173 @@
+package app_context
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// dbSticky remembers recent writes to the primary so DBReadContext can
+// keep the same session off the replica until it has likely caught up. A
+// session is a context from WithReadYourWrites, and optionally every
+// context with the same value for the DB_REPLICA_STICKY_FIELD field.
+type dbSticky struct {
+	window  time.Duration
+	field   string
+	lock    sync.Mutex
+	writes  map[string]time.Time
+	sweepAt int
+}
+
+type dbWriteMarkerKey struct{}
+
+// dbWriteMarker holds the UnixNano of the last write made with a context
+type dbWriteMarker struct {
+	last int64
+}
+
+// WithReadYourWrites starts a session in ctx: once anything using the
+// returned context writes to the primary, DBReadContext returns the primary
+// for it until DB_REPLICA_STICKY_WINDOW has passed. ForRequest starts one
+// for each request.
+func WithReadYourWrites(ctx context.Context) context.Context {
+	if _, ok := ctx.Value(dbWriteMarkerKey{}).(*dbWriteMarker); ok {
+		return ctx
+	}
+	return context.WithValue(ctx, dbWriteMarkerKey{}, &dbWriteMarker{})
+}
+
+const dbStickySweepMin = 1024
+
+func (self *dbSticky) noteWrite(ctx context.Context, appctx *baseAppContext) {
+	now := appctx.Clock().Now()
+	if marker, ok := ctx.Value(dbWriteMarkerKey{}).(*dbWriteMarker); ok {
+		atomic.StoreInt64(&marker.last, now.UnixNano())
+	}
+	if self.field == "" {
+		return
+	}
+	value := appctx.FieldPropagation().Field(ctx, self.field)
+	if value == "" {
+		return
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.writes[value] = now
+
+	// Forget sessions whose window has passed once the map has doubled
+	// since the last sweep
+	if len(self.writes) >= self.sweepAt {
+		for k, t := range self.writes {
+			if now.Sub(t) >= self.window {
+				delete(self.writes, k)
+			}
+		}
+		self.sweepAt = 2 * len(self.writes)
+		if self.sweepAt < dbStickySweepMin {
+			self.sweepAt = dbStickySweepMin
+		}
+	}
+}
+
+func (self *dbSticky) wroteRecently(ctx context.Context, appctx *baseAppContext) bool {
+	now := appctx.Clock().Now()
+	if marker, ok := ctx.Value(dbWriteMarkerKey{}).(*dbWriteMarker); ok {
+		if last := atomic.LoadInt64(&marker.last); last != 0 && now.Sub(time.Unix(0, last)) < self.window {
+			return true
+		}
+	}
+	if self.field == "" {
+		return false
+	}
+	value := appctx.FieldPropagation().Field(ctx, self.field)
+	if value == "" {
+		return false
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	last, ok := self.writes[value]
+	return ok && now.Sub(last) < self.window
+}
+
+// isWriteQuery is for queries that come through QueryContext, which are
+// writes when they return rows, like INSERT ... RETURNING
+func isWriteQuery(query string) bool {
+	fields := strings.Fields(query)
+	if len(fields) == 0 {
+		return false
+	}
+	switch strings.ToUpper(fields[0]) {
+	case "INSERT", "UPDATE", "DELETE", "MERGE", "UPSERT":
+		return true
+	}
+	return false
+}
+
+// noteDBWrite is called by the primary's driver wrapper after a
+// successful write
+func (self *baseAppContext) noteDBWrite(ctx context.Context) {
+	if self.dbReplica == nil || self.dbReplica.sticky == nil {
+		return
+	}
+	self.dbReplica.sticky.noteWrite(ctx, self)
+}
+
+// DBReadContext is DBRead for ctx's session: it returns the primary if
+// the session wrote within DB_REPLICA_STICKY_WINDOW, so a user doesn't
+// read back a stale row right after changing it.
+func (self *baseAppContext) DBReadContext(ctx context.Context) *sqlx.DB {
+	if self.dbReplica != nil && self.dbReplica.sticky != nil && self.dbReplica.isHealthy() {
+		if self.dbReplica.sticky.wroteRecently(ctx, self) {
+			self.MetricsClient().Incr("db.replica_sticky_reads", 1.0, nil)
+			return self.DB()
+		}
+	}
+	return self.DBRead()
+}
+
+// DB_REPLICA_STICKY_WINDOW (default 0, off) is how long reads through
+// DBReadContext stay on the primary after a session writes; set it to
+// about the replica's worst normal lag. DB_REPLICA_STICKY_FIELD names a
+// propagated field, like a user or session ID, that also ties together
+// separate requests into one session.
+func (self *baseAppContext) setDBStickyFromEnv(replica *dbReplica) error {
+	window, found, err := self.getDurationFromEnv("DB_REPLICA_STICKY_WINDOW")
+	if err != nil {
+		return err
+	}
+	field := self.getEnv("DB_REPLICA_STICKY_FIELD")
+	if !found || window == 0 {
+		if field != "" {
+			return errors.New("DB_REPLICA_STICKY_FIELD needs DB_REPLICA_STICKY_WINDOW to be set")
+		}
+		return nil
+	}
+	if window < 0 {
+		return errors.New("DB_REPLICA_STICKY_WINDOW must be >= 0")
+	}
+
+	// Writes are only seen through the driver wrapper
+	disabled, err := self.isDisabled("DB_INSTRUMENTATION")
+	if err != nil {
+		return err
+	}
+	if disabled {
+		return errors.New("DB_REPLICA_STICKY_WINDOW can't be used with DB_INSTRUMENTATION_DISABLE")
+	}
+
+	replica.sticky = &dbSticky{
+		window:  window,
+		field:   field,
+		writes:  make(map[string]time.Time),
+		sweepAt: dbStickySweepMin,
+	}
+
+	return nil
+}
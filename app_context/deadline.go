@@ -0,0 +1,109 @@
+package app_context
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var grpcTimeoutUnits = map[byte]time.Duration{
+	'H': time.Hour,
+	'M': time.Minute,
+	'S': time.Second,
+	'm': time.Millisecond,
+	'u': time.Microsecond,
+	'n': time.Nanosecond,
+}
+
+// parseRequestTimeout reads a remaining budget the way grpc-timeout writes
+// it if grpc is set, eg. "1500m" for 1.5s, and as a Go duration like
+// "1.5s" otherwise. The two can't be mixed, as "5m" means something
+// different to each.
+func parseRequestTimeout(val string, grpc bool) (time.Duration, error) {
+	if grpc {
+		if n := len(val); n > 1 {
+			if unit, ok := grpcTimeoutUnits[val[n-1]]; ok {
+				if amount, err := strconv.ParseInt(val[:n-1], 10, 64); err == nil && amount >= 0 {
+					return time.Duration(amount) * unit, nil
+				}
+			}
+		}
+		return 0, fmt.Errorf("Invalid grpc-timeout '%s'", val)
+	}
+	d, err := time.ParseDuration(val)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("Invalid request timeout '%s'", val)
+	}
+	return d, nil
+}
+
+// formatRequestTimeout writes d in milliseconds, rounded up so a tight
+// budget isn't sent as 0, in grpc-timeout format if grpc is set
+func formatRequestTimeout(d time.Duration, grpc bool) string {
+	ms := (d + time.Millisecond - 1) / time.Millisecond
+	if grpc {
+		return strconv.FormatInt(int64(ms), 10) + "m"
+	}
+	return (ms * time.Millisecond).String()
+}
+
+func isGRPCTimeoutHeader(header string) bool {
+	return strings.EqualFold(header, "grpc-timeout")
+}
+
+// requestTimeout is the budget the caller of r gave it, capped at
+// REQUEST_DEADLINE_MAX. An unparseable header is ignored.
+func (self *baseAppContext) requestTimeout(r *http.Request) (time.Duration, bool) {
+	val := r.Header.Get(self.deadlineHeader)
+	grpc := isGRPCTimeoutHeader(self.deadlineHeader)
+	if val == "" {
+		if val = r.Header.Get("grpc-timeout"); val == "" {
+			return 0, false
+		}
+		grpc = true
+	}
+	timeout, err := parseRequestTimeout(val, grpc)
+	if err != nil {
+		return 0, false
+	}
+	if self.deadlineMax > 0 && timeout > self.deadlineMax {
+		timeout = self.deadlineMax
+	}
+	return timeout, true
+}
+
+// setRequestDeadline sets the deadline header on an outbound request to
+// what's left of ctx's deadline
+func (self *baseAppContext) setRequestDeadline(ctx context.Context, req *http.Request) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return
+	}
+	if remaining := time.Until(deadline); remaining > 0 {
+		req.Header.Set(self.deadlineHeader, formatRequestTimeout(remaining, isGRPCTimeoutHeader(self.deadlineHeader)))
+	}
+}
+
+// REQUEST_DEADLINE_HEADER (default X-Request-Deadline, with grpc-timeout
+// also accepted) carries a request's remaining time budget as a Go
+// duration, eg. "250ms", or as "250m" in grpc-timeout's own header.
+// RequestMiddleware turns it into the context deadline, capped
+// at REQUEST_DEADLINE_MAX if set, and HTTPClient sends what's left of a
+// context's deadline downstream the same way.
+func (self *baseAppContext) setRequestDeadlineFromEnv() error {
+	header, ok := self.lookupEnv("REQUEST_DEADLINE_HEADER")
+	if !ok || header == "" {
+		header = "X-Request-Deadline"
+	}
+	self.deadlineHeader = header
+
+	max, _, err := self.getDurationFromEnv("REQUEST_DEADLINE_MAX")
+	if err != nil {
+		return err
+	}
+	self.deadlineMax = max
+	return nil
+}
@@ -0,0 +1,144 @@
+package app_context
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseRequestTimeout(t *testing.T) {
+	for val, expected := range map[string]time.Duration{
+		"1500m": 1500 * time.Millisecond,
+		"2S":    2 * time.Second,
+		"1H":    time.Hour,
+		"0m":    0,
+	} {
+		if d, err := parseRequestTimeout(val, true); err != nil || d != expected {
+			t.Errorf("%s: expected %s, got %s (%v)", val, expected, d, err)
+		}
+	}
+	for val, expected := range map[string]time.Duration{
+		"250ms": 250 * time.Millisecond,
+		"1.5s":  1500 * time.Millisecond,
+		"5m":    5 * time.Minute,
+	} {
+		if d, err := parseRequestTimeout(val, false); err != nil || d != expected {
+			t.Errorf("%s: expected %s, got %s (%v)", val, expected, d, err)
+		}
+	}
+	for _, val := range []string{"", "soon", "-5m", "-1s", "1.5s"} {
+		if _, err := parseRequestTimeout(val, true); err == nil {
+			t.Errorf("Expected grpc-timeout '%s' to be invalid", val)
+		}
+	}
+	for _, val := range []string{"", "soon", "-1s", "2S"} {
+		if _, err := parseRequestTimeout(val, false); err == nil {
+			t.Errorf("Expected '%s' to be invalid", val)
+		}
+	}
+	if s := formatRequestTimeout(1500*time.Microsecond+1, true); s != "2m" {
+		t.Errorf("Expected the budget to round up to 2m, got %s", s)
+	}
+	if s := formatRequestTimeout(1500*time.Microsecond+1, false); s != "2ms" {
+		t.Errorf("Expected the budget to round up to 2ms, got %s", s)
+	}
+}
+
+func TestRequestDeadline(t *testing.T) {
+	os.Setenv("REQUEST_DEADLINE_MAX", "10s")
+	defer os.Unsetenv("REQUEST_DEADLINE_MAX")
+
+	app_ctx, err := NewAppContext("deadline_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app_ctx.Close()
+
+	var lock sync.Mutex
+	var downstream_header string
+	downstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		downstream_header = r.Header.Get("X-Request-Deadline")
+	}))
+	defer downstream.Close()
+
+	var remaining time.Duration
+	var has_deadline bool
+	handler := app_ctx.RequestMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var deadline time.Time
+		if deadline, has_deadline = r.Context().Deadline(); has_deadline {
+			remaining = time.Until(deadline)
+		}
+		req, _ := http.NewRequestWithContext(r.Context(), "GET", downstream.URL, nil)
+		if resp, err := app_ctx.HTTPClient().Do(req); err == nil {
+			resp.Body.Close()
+		}
+	}))
+
+	serve := func(hdr, val string) {
+		req := httptest.NewRequest("GET", "/", nil)
+		if hdr != "" {
+			req.Header.Set(hdr, val)
+		}
+		lock.Lock()
+		has_deadline, remaining, downstream_header = false, 0, ""
+		lock.Unlock()
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+		// Synchronizes with the downstream handler
+		lock.Lock()
+		lock.Unlock()
+	}
+
+	serve("X-Request-Deadline", "2s")
+	if !has_deadline || remaining > 2*time.Second || remaining < time.Second {
+		t.Errorf("Expected a 2s deadline, got %v with %s left", has_deadline, remaining)
+	}
+	if d, err := parseRequestTimeout(downstream_header, false); err != nil || d > 2*time.Second || d < time.Second {
+		t.Errorf("Expected the remaining budget downstream, got '%s'", downstream_header)
+	}
+
+	serve("grpc-timeout", "1M")
+	if !has_deadline || remaining > 10*time.Second {
+		t.Errorf("Expected the deadline to be capped at 10s, got %s", remaining)
+	}
+
+	// Minutes, not milliseconds, as a Go duration
+	serve("X-Request-Deadline", "5m")
+	if !has_deadline || remaining < 9*time.Second {
+		t.Errorf("Expected 5m to be capped at 10s, got %s", remaining)
+	}
+
+	// Without a deadline of its own, the request's budget downstream is
+	// HTTP_CLIENT_TIMEOUT
+	serve("X-Request-Deadline", "whenever")
+	if has_deadline {
+		t.Error("An invalid header should be ignored")
+	}
+	if d, err := parseRequestTimeout(downstream_header, false); err != nil || d > 30*time.Second || d < 29*time.Second {
+		t.Errorf("Expected the client timeout downstream, got '%s'", downstream_header)
+	}
+
+	serve("", "")
+	if has_deadline {
+		t.Error("Expected no deadline without the header")
+	}
+
+	// A caller's own header isn't replaced
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", downstream.URL, nil)
+	req.Header.Set("X-Request-Deadline", "5s")
+	if resp, err := app_ctx.HTTPClient().Do(req); err == nil {
+		resp.Body.Close()
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if downstream_header != "5s" {
+		t.Errorf("Expected the caller's deadline header, got '%s'", downstream_header)
+	}
+}
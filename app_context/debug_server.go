@@ -0,0 +1,156 @@
+package app_context
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"html"
+	"net"
+	"net/http"
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"runtime/trace"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// pprofSeconds is how long /debug/pprof/profile and /debug/pprof/trace
+// record for when ?seconds isn't given
+const pprofSeconds = 30
+
+func pprofDuration(r *http.Request) time.Duration {
+	seconds, err := strconv.Atoi(r.FormValue("seconds"))
+	if err != nil || seconds <= 0 {
+		seconds = pprofSeconds
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// waitOrDone sleeps for d, or until the client goes away
+func waitOrDone(r *http.Request, d time.Duration) {
+	select {
+	case <-time.After(d):
+	case <-r.Context().Done():
+	}
+}
+
+func setProfileHeaders(w http.ResponseWriter, name string) {
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, name))
+}
+
+// pprofHandler serves the same paths as net/http/pprof, which can't be
+// imported without registering them on http.DefaultServeMux
+func pprofHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, "/debug/pprof/")
+
+		switch name {
+		case "":
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			fmt.Fprint(w, "<html><body><h1>/debug/pprof/</h1><ul>\n")
+			for _, p := range pprof.Profiles() {
+				fmt.Fprintf(w, "<li><a href=\"%s?debug=1\">%s</a> (%d)</li>\n", html.EscapeString(p.Name()), html.EscapeString(p.Name()), p.Count())
+			}
+			fmt.Fprint(w, "<li><a href=\"profile\">profile</a> (CPU, ?seconds=30)</li>\n")
+			fmt.Fprint(w, "<li><a href=\"trace\">trace</a> (?seconds=30)</li>\n")
+			fmt.Fprint(w, "</ul></body></html>\n")
+		case "cmdline":
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			fmt.Fprint(w, strings.Join(os.Args, "\x00"))
+		case "profile":
+			setProfileHeaders(w, "profile")
+			if err := pprof.StartCPUProfile(w); err != nil {
+				w.Header().Del("Content-Disposition")
+				http.Error(w, "Couldn't start CPU profile: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			waitOrDone(r, pprofDuration(r))
+			pprof.StopCPUProfile()
+		case "trace":
+			setProfileHeaders(w, "trace")
+			if err := trace.Start(w); err != nil {
+				w.Header().Del("Content-Disposition")
+				http.Error(w, "Couldn't start trace: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			waitOrDone(r, pprofDuration(r))
+			trace.Stop()
+		default:
+			p := pprof.Lookup(name)
+			if p == nil {
+				http.Error(w, "Unknown profile: "+name, http.StatusNotFound)
+				return
+			}
+			if name == "heap" && r.FormValue("gc") != "" {
+				runtime.GC()
+			}
+			debug, _ := strconv.Atoi(r.FormValue("debug"))
+			if debug > 0 {
+				w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			} else {
+				setProfileHeaders(w, name)
+			}
+			p.WriteTo(w, debug)
+		}
+	})
+}
+
+// DebugServer serves profiling endpoints on DEBUG_PORT. Like Admin, it
+// takes extra handlers whether or not it's listening.
+func (self *baseAppContext) DebugServer() AdminServer {
+	return self.debug
+}
+
+// DEBUG_PORT enables the debug server, listening on DEBUG_BIND, localhost
+// by default since profiles include memory contents. It serves
+// /debug/pprof/ unless DEBUG_PPROF=false, /debug/vars (expvar) unless
+// DEBUG_EXPVAR=false and /debug/config unless DEBUG_CONFIG=false.
+func (self *baseAppContext) setDebugServerFromEnv() error {
+	for _, endpoint := range []struct {
+		flag    string
+		pattern string
+		handler http.Handler
+	}{
+		{"DEBUG_PPROF", "/debug/pprof/", pprofHandler()},
+		{"DEBUG_EXPVAR", "/debug/vars", expvar.Handler()},
+		{"DEBUG_CONFIG", "/debug/config", self.configHandler()},
+	} {
+		enabled, found, err := self.getBoolFromEnv(endpoint.flag)
+		if err != nil {
+			return err
+		}
+		if enabled || !found {
+			self.debug.Handle(endpoint.pattern, endpoint.handler)
+		}
+	}
+
+	if self.getEnv("DEBUG_PORT") == "" {
+		return nil
+	}
+
+	// 0 picks a free port
+	port, _, err := self.getIntFromEnv("DEBUG_PORT")
+	if err != nil {
+		return err
+	}
+	if port < 0 {
+		return fmt.Errorf("DEBUG_PORT must be >= 0")
+	}
+
+	bind, found := self.lookupEnv("DEBUG_BIND")
+	if !found {
+		bind = "127.0.0.1"
+	}
+
+	addr := net.JoinHostPort(bind, strconv.Itoa(port))
+	if err := self.debug.listen(addr, self); err != nil {
+		return err
+	}
+
+	self.logger.LogInfof(context.Background(), "Debug server listening on %s", self.debug.Addr())
+
+	return nil
+}
@@ -0,0 +1,63 @@
+package app_context
+
+import (
+	"encoding/json"
+	"expvar"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+)
+
+var debugTestVar = expvar.NewInt("debug_server_test")
+
+func TestDebugServer(t *testing.T) {
+	os.Setenv("DEBUG_PORT", "0")
+	defer os.Unsetenv("DEBUG_PORT")
+	os.Setenv("DEBUG_CONFIG", "false")
+	defer os.Unsetenv("DEBUG_CONFIG")
+
+	app_ctx, err := NewAppContext("debug_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer app_ctx.Close()
+
+	addr := app_ctx.DebugServer().Addr()
+	if !strings.HasPrefix(addr, "127.0.0.1:") {
+		t.Fatalf("Expected the debug server on localhost, got '%s'", addr)
+	}
+
+	get := func(path string) (int, string) {
+		resp, err := http.Get("http://" + addr + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	if status, body := get("/debug/pprof/"); status != 200 || !strings.Contains(body, "goroutine") {
+		t.Errorf("Unexpected pprof index: %d %s", status, body)
+	}
+	if status, body := get("/debug/pprof/goroutine?debug=1"); status != 200 || !strings.Contains(body, "goroutine profile") {
+		t.Errorf("Unexpected goroutine profile: %d %.100s", status, body)
+	}
+	if status, _ := get("/debug/pprof/nonexistent"); status != 404 {
+		t.Errorf("Expected 404 for an unknown profile, got %d", status)
+	}
+
+	debugTestVar.Set(42)
+	status, body := get("/debug/vars")
+	vars := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(body), &vars); status != 200 || err != nil || vars["debug_server_test"] != 42.0 {
+		t.Errorf("Unexpected expvars: %d %v %.100s", status, err, body)
+	}
+
+	if status, _ := get("/debug/config"); status != 404 {
+		t.Errorf("Expected /debug/config to be off with DEBUG_CONFIG=false, got %d", status)
+	}
+}
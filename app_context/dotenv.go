@@ -0,0 +1,63 @@
+package app_context
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// WithDotEnv sets the directory .env files are loaded from, the working
+// directory by default. An empty dir turns them off.
+func WithDotEnv(dir string) Option {
+	return func(appctx *baseAppContext) {
+		appctx.dotEnvDir = dir
+	}
+}
+
+func readDotEnv(path string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	values, err := parseConfigFile(data)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing %s: %s", path, err)
+	}
+	return values, nil
+}
+
+// loadDotEnv reads .env and then .env.<TILT_ENVIRONMENT> over it, for
+// local development. They're settings exported by hand, so the real
+// environment overrides them, they're read with the env prefix, and
+// TILT_ENVIRONMENT can come from .env. Missing files are skipped.
+func (self *baseAppContext) loadDotEnv() error {
+	self.dotEnv = make(map[string]string)
+	if self.dotEnvDir == "" {
+		return nil
+	}
+
+	values, err := readDotEnv(filepath.Join(self.dotEnvDir, ".env"))
+	if err != nil {
+		return err
+	}
+	for name, value := range values {
+		self.dotEnv[name] = value
+	}
+
+	tilt_env := self.osGetenv("TILT_ENVIRONMENT")
+	if tilt_env == "" {
+		tilt_env = "development"
+	}
+	values, err = readDotEnv(filepath.Join(self.dotEnvDir, ".env."+tilt_env))
+	if err != nil {
+		return err
+	}
+	for name, value := range values {
+		self.dotEnv[name] = value
+	}
+
+	return nil
+}
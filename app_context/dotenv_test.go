@@ -0,0 +1,73 @@
+package app_context
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDotEnv(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dotenv_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	dotenv := "# Local settings\nTILT_ENVIRONMENT=testing\nexport BASE_URL=http://localhost:8000\nCODE_VERSION='dev'\nJSON_SCHEMA_FILEPATH=/tmp/schemas\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, ".env"), []byte(dotenv), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, ".env.testing"), []byte("CODE_VERSION=testing\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	os.Setenv("JSON_SCHEMA_FILEPATH", "/etc/schemas")
+	defer os.Unsetenv("JSON_SCHEMA_FILEPATH")
+	// The environment wins over .env, so a CODE_VERSION left by another
+	// test would hide .env.testing's
+	if version, ok := os.LookupEnv("CODE_VERSION"); ok {
+		os.Unsetenv("CODE_VERSION")
+		defer os.Setenv("CODE_VERSION", version)
+	}
+
+	app_ctx, err := NewAppContext("dotenv_test", WithDotEnv(dir))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer app_ctx.Close()
+
+	if env := app_ctx.TiltEnv(); env != "testing" {
+		t.Errorf("Expected TILT_ENVIRONMENT from .env, got %s", env)
+	}
+	if url := app_ctx.BaseExternalURL(); url != "http://localhost:8000" {
+		t.Errorf("Expected BASE_URL from .env, got %s", url)
+	}
+	if version := app_ctx.CodeVersion(); version != "testing" {
+		t.Errorf("Expected .env.testing to override .env, got %s", version)
+	}
+	if path := app_ctx.JSONSchemaFilePath(); path != "/etc/schemas" {
+		t.Errorf("Expected the environment to override .env, got %s", path)
+	}
+	if source := app_ctx.(*baseAppContext).envSource("BASE_URL"); source != "dotenv" {
+		t.Errorf("Expected BASE_URL's source to be dotenv, got %s", source)
+	}
+
+	// Turned off
+	app_ctx, err = NewAppContext("dotenv_test", WithDotEnv(""))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer app_ctx.Close()
+	if url := app_ctx.BaseExternalURL(); url != "" {
+		t.Errorf("Expected no .env without a directory, got %s", url)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, ".env"), []byte("not a setting\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewAppContext("dotenv_test", WithDotEnv(dir)); err == nil {
+		t.Error("Expected a bad .env to fail")
+	}
+}
@@ -0,0 +1,321 @@
+package app_context
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+)
+
+// GRPCCode is a gRPC status code. The values are those of
+// google.golang.org/grpc/codes, so codes.Code(c) converts.
+type GRPCCode uint32
+
+const (
+	GRPCOK GRPCCode = iota
+	GRPCCanceled
+	GRPCUnknown
+	GRPCInvalidArgument
+	GRPCDeadlineExceeded
+	GRPCNotFound
+	GRPCAlreadyExists
+	GRPCPermissionDenied
+	GRPCResourceExhausted
+	GRPCFailedPrecondition
+	GRPCAborted
+	GRPCOutOfRange
+	GRPCUnimplemented
+	GRPCInternal
+	GRPCUnavailable
+	GRPCDataLoss
+	GRPCUnauthenticated
+)
+
+// ErrorCode is how errors with Code render: the HTTP status and gRPC code,
+// and Message for errors that don't have their own
+type ErrorCode struct {
+	Code       string   `json:"code"`
+	HTTPStatus int      `json:"http_status"`
+	GRPCCode   GRPCCode `json:"grpc_code"`
+	Message    string   `json:"message"`
+}
+
+// defaultErrorCodes are registered with every ErrorCodes(). For the
+// reverse lookups, the first code with a status wins, eg. a 409 is
+// already_exists.
+var defaultErrorCodes = []ErrorCode{
+	{"invalid_argument", http.StatusBadRequest, GRPCInvalidArgument, "Invalid request"},
+	{"failed_precondition", http.StatusBadRequest, GRPCFailedPrecondition, "Request can't be done in the current state"},
+	{"out_of_range", http.StatusBadRequest, GRPCOutOfRange, "Out of range"},
+	{"unauthenticated", http.StatusUnauthorized, GRPCUnauthenticated, "Authentication required"},
+	{"permission_denied", http.StatusForbidden, GRPCPermissionDenied, "Permission denied"},
+	{"not_found", http.StatusNotFound, GRPCNotFound, "Not found"},
+	{"already_exists", http.StatusConflict, GRPCAlreadyExists, "Already exists"},
+	{"aborted", http.StatusConflict, GRPCAborted, "Conflict, try again"},
+	{"resource_exhausted", http.StatusTooManyRequests, GRPCResourceExhausted, "Too many requests"},
+	{"cancelled", 499, GRPCCanceled, "Request cancelled"},
+	{"internal_error", http.StatusInternalServerError, GRPCInternal, "Internal server error"},
+	{"data_loss", http.StatusInternalServerError, GRPCDataLoss, "Internal server error"},
+	{"unknown", http.StatusInternalServerError, GRPCUnknown, "Unknown error"},
+	{"unimplemented", http.StatusNotImplemented, GRPCUnimplemented, "Not implemented"},
+	{"unavailable", http.StatusServiceUnavailable, GRPCUnavailable, "Service unavailable"},
+	{"deadline_exceeded", http.StatusGatewayTimeout, GRPCDeadlineExceeded, "Request timed out"},
+}
+
+// defaultErrorTargets are the sentinels of this package, and context's,
+// that render as something other than internal_error
+var defaultErrorTargets = []errorTarget{
+	{context.Canceled, "cancelled"},
+	{context.DeadlineExceeded, "deadline_exceeded"},
+	{ErrAdmissionShed, "unavailable"},
+	{ErrBreakerOpen, "unavailable"},
+	{ErrCheckpointConflict, "aborted"},
+	{ErrInvalidDocument, "invalid_argument"},
+	{ErrObjectNotFound, "not_found"},
+	{ErrStateConflict, "aborted"},
+	{ErrTokenExpired, "unauthenticated"},
+}
+
+type errorTarget struct {
+	target error
+	code   string
+}
+
+// ErrorRegistry maps error codes to HTTP statuses and gRPC codes, so a
+// domain error renders the same whichever protocol it's returned over.
+// WriteHTTPError and HTTPMiddleware resolve errors with it; clients turn
+// responses back into AppErrors with FromHTTPResponse and FromGRPC.
+type ErrorRegistry interface {
+	// Register adds code, or replaces one with the same Code
+	Register(code ErrorCode)
+	// RegisterError renders errors matching target with errors.Is, eg.
+	// sql.ErrNoRows, as code. Targets are checked in the order they were
+	// registered.
+	RegisterError(target error, code string)
+	Lookup(code string) (ErrorCode, bool)
+	Codes() []ErrorCode
+	// AppError is what err renders as: the AppError in its chain, with
+	// Status and Message from its code when they're unset, or one for a
+	// registered target, or internal_error. The result wraps err.
+	AppError(err error) *AppError
+	HTTPStatus(err error) int
+	GRPCCode(err error) GRPCCode
+	// FromHTTPResponse returns an AppError for a response with a 4xx or 5xx
+	// status, or nil. The body is read for a WriteHTTPError style code and
+	// message and left readable for the caller.
+	FromHTTPResponse(resp *http.Response) *AppError
+	FromGRPC(code GRPCCode, message string) *AppError
+}
+
+type errorRegistry struct {
+	lock    sync.RWMutex
+	codes   []ErrorCode
+	byCode  map[string]int
+	targets []errorTarget
+}
+
+func newErrorRegistry() *errorRegistry {
+	self := &errorRegistry{byCode: make(map[string]int)}
+	for _, code := range defaultErrorCodes {
+		self.Register(code)
+	}
+	for _, target := range defaultErrorTargets {
+		self.RegisterError(target.target, target.code)
+	}
+	return self
+}
+
+func (self *errorRegistry) Register(code ErrorCode) {
+	if code.Code == "" {
+		panic("app_context: ErrorRegistry.Register without a Code")
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if idx, ok := self.byCode[code.Code]; ok {
+		self.codes[idx] = code
+		return
+	}
+	self.byCode[code.Code] = len(self.codes)
+	self.codes = append(self.codes, code)
+}
+
+func (self *errorRegistry) RegisterError(target error, code string) {
+	if target == nil {
+		panic("app_context: ErrorRegistry.RegisterError target is nil")
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.targets = append(self.targets, errorTarget{target: target, code: code})
+}
+
+func (self *errorRegistry) Lookup(code string) (ErrorCode, bool) {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+
+	if idx, ok := self.byCode[code]; ok {
+		return self.codes[idx], true
+	}
+	return ErrorCode{}, false
+}
+
+func (self *errorRegistry) Codes() []ErrorCode {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	return append([]ErrorCode(nil), self.codes...)
+}
+
+// internal is the internal_error code, which can be replaced but not
+// removed
+func (self *errorRegistry) internal() ErrorCode {
+	if code, ok := self.Lookup(errInternal.Code); ok {
+		return code
+	}
+	return ErrorCode{errInternal.Code, errInternal.Status, GRPCInternal, errInternal.Message}
+}
+
+func (self *errorRegistry) AppError(err error) *AppError {
+	if err == nil {
+		return nil
+	}
+
+	var target *AppError
+	if errors.As(err, &target) {
+		app_err := *target
+		app_err.Err = err
+		code, ok := self.Lookup(app_err.Code)
+		if !ok {
+			code = self.internal()
+		}
+		if app_err.Status == 0 {
+			app_err.Status = code.HTTPStatus
+		}
+		if app_err.Message == "" {
+			app_err.Message = code.Message
+		}
+		return &app_err
+	}
+
+	self.lock.RLock()
+	targets := self.targets
+	self.lock.RUnlock()
+
+	for _, target := range targets {
+		if !errors.Is(err, target.target) {
+			continue
+		}
+		if code, ok := self.Lookup(target.code); ok {
+			return &AppError{Status: code.HTTPStatus, Code: code.Code, Message: code.Message, Err: err}
+		}
+	}
+
+	code := self.internal()
+	return &AppError{Status: code.HTTPStatus, Code: code.Code, Message: code.Message, Err: err}
+}
+
+func (self *errorRegistry) HTTPStatus(err error) int {
+	if err == nil {
+		return http.StatusOK
+	}
+	return self.AppError(err).Status
+}
+
+func (self *errorRegistry) GRPCCode(err error) GRPCCode {
+	if err == nil {
+		return GRPCOK
+	}
+	if code, ok := self.Lookup(self.AppError(err).Code); ok {
+		return code.GRPCCode
+	}
+	return self.internal().GRPCCode
+}
+
+// find returns the first code matching
+func (self *errorRegistry) find(match func(ErrorCode) bool) (ErrorCode, bool) {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+
+	for _, code := range self.codes {
+		if match(code) {
+			return code, true
+		}
+	}
+	return ErrorCode{}, false
+}
+
+// maxErrorBody bounds how much of a response FromHTTPResponse reads
+const maxErrorBody = 64 * 1024
+
+func (self *errorRegistry) FromHTTPResponse(resp *http.Response) *AppError {
+	if resp == nil || resp.StatusCode < 400 {
+		return nil
+	}
+
+	var body errorBody
+	if resp.Body != nil {
+		data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(data), resp.Body), resp.Body}
+
+		var decoded errorResponse
+		if json.Unmarshal(data, &decoded) == nil {
+			body = decoded.Error
+		}
+	}
+
+	app_err := &AppError{
+		Status:  resp.StatusCode,
+		Code:    body.Code,
+		Message: body.Message,
+		Err:     fmt.Errorf("Response status %d", resp.StatusCode),
+	}
+	if req := resp.Request; req != nil {
+		app_err.Err = fmt.Errorf("%s %s returned %d", req.Method, req.URL.Redacted(), resp.StatusCode)
+	}
+	if app_err.Code == "" {
+		app_err.Code = "unknown"
+		if code, ok := self.find(func(c ErrorCode) bool { return c.HTTPStatus == resp.StatusCode }); ok {
+			app_err.Code = code.Code
+		}
+	}
+	if app_err.Message == "" {
+		app_err.Message = http.StatusText(resp.StatusCode)
+	}
+	return app_err
+}
+
+func (self *errorRegistry) FromGRPC(grpc_code GRPCCode, message string) *AppError {
+	if grpc_code == GRPCOK {
+		return nil
+	}
+
+	code, ok := self.find(func(c ErrorCode) bool { return c.GRPCCode == grpc_code })
+	if !ok {
+		code, _ = self.Lookup("unknown")
+		if code.Code == "" {
+			code = self.internal()
+		}
+	}
+	if message == "" {
+		message = code.Message
+	}
+	return &AppError{
+		Status:  code.HTTPStatus,
+		Code:    code.Code,
+		Message: message,
+		Err:     fmt.Errorf("gRPC code %d", grpc_code),
+	}
+}
+
+func (self *baseAppContext) ErrorCodes() ErrorRegistry {
+	return self.errorCodes
+}
@@ -0,0 +1,120 @@
+package app_context
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestErrorCodes(t *testing.T) {
+	app_ctx, err := NewAppContext("error_codes_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app_ctx.Close()
+
+	codes := app_ctx.ErrorCodes()
+	codes.Register(ErrorCode{Code: "payment_required", HTTPStatus: http.StatusPaymentRequired, GRPCCode: GRPCFailedPrecondition, Message: "Payment required"})
+	codes.RegisterError(sql.ErrNoRows, "not_found")
+
+	tests := []struct {
+		err     error
+		status  int
+		grpc    GRPCCode
+		code    string
+		message string
+	}{
+		{NewAppError(0, "payment_required", ""), http.StatusPaymentRequired, GRPCFailedPrecondition, "payment_required", "Payment required"},
+		{NewAppError(http.StatusTeapot, "not_found", "Order not found"), http.StatusTeapot, GRPCNotFound, "not_found", "Order not found"},
+		{&panicError{method: "GET", path: "/orders/1", value: sql.ErrNoRows}, http.StatusNotFound, GRPCNotFound, "not_found", "Not found"},
+		{context.DeadlineExceeded, http.StatusGatewayTimeout, GRPCDeadlineExceeded, "deadline_exceeded", "Request timed out"},
+		{ErrBreakerOpen, http.StatusServiceUnavailable, GRPCUnavailable, "unavailable", "Service unavailable"},
+		{NewAppError(0, "unregistered", "Unregistered"), http.StatusInternalServerError, GRPCInternal, "unregistered", "Unregistered"},
+		{errors.New("boom"), http.StatusInternalServerError, GRPCInternal, "internal_error", "Internal server error"},
+	}
+	for _, test := range tests {
+		app_err := codes.AppError(test.err)
+		if app_err.Status != test.status || app_err.Code != test.code || app_err.Message != test.message {
+			t.Errorf("%v: unexpected %+v", test.err, app_err)
+		}
+		if !errors.Is(app_err, test.err) {
+			t.Errorf("%v: AppError should wrap the error", test.err)
+		}
+		if status := codes.HTTPStatus(test.err); status != test.status {
+			t.Errorf("%v: expected HTTP %d, got %d", test.err, test.status, status)
+		}
+		if grpc := codes.GRPCCode(test.err); grpc != test.grpc {
+			t.Errorf("%v: expected gRPC %d, got %d", test.err, test.grpc, grpc)
+		}
+	}
+	if codes.AppError(nil) != nil || codes.GRPCCode(nil) != GRPCOK {
+		t.Error("A nil error should be OK")
+	}
+
+	if app_err := codes.FromGRPC(GRPCAlreadyExists, ""); app_err.Status != http.StatusConflict || app_err.Code != "already_exists" {
+		t.Errorf("Unexpected %+v", app_err)
+	}
+	if codes.FromGRPC(GRPCOK, "") != nil {
+		t.Error("OK shouldn't be an error")
+	}
+}
+
+func TestErrorCodesFromHTTPResponse(t *testing.T) {
+	app_ctx, err := NewAppContext("error_codes_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app_ctx.Close()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/ok":
+			w.WriteHeader(http.StatusNoContent)
+		case "/plain":
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte("slow down"))
+		default:
+			app_ctx.WriteHTTPError(w, r, ErrObjectNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	get := func(path string) *http.Response {
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	resp := get("/ok")
+	resp.Body.Close()
+	if app_err := app_ctx.ErrorCodes().FromHTTPResponse(resp); app_err != nil {
+		t.Errorf("Expected no error, got %s", app_err)
+	}
+
+	resp = get("/order")
+	app_err := app_ctx.ErrorCodes().FromHTTPResponse(resp)
+	resp.Body.Close()
+	if app_err == nil || app_err.Status != http.StatusNotFound || app_err.Code != "not_found" || app_err.Message != "Not found" {
+		t.Errorf("Unexpected %+v", app_err)
+	}
+	if grpc := app_ctx.ErrorCodes().GRPCCode(app_err); grpc != GRPCNotFound {
+		t.Errorf("Expected the response to map to gRPC NotFound, got %d", grpc)
+	}
+
+	resp = get("/plain")
+	app_err = app_ctx.ErrorCodes().FromHTTPResponse(resp)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if app_err == nil || app_err.Code != "resource_exhausted" || app_err.Message != "Too Many Requests" {
+		t.Errorf("Unexpected %+v", app_err)
+	}
+	if string(body) != "slow down" {
+		t.Errorf("The body should still be readable, got '%s'", body)
+	}
+}
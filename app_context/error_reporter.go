@@ -0,0 +1,127 @@
+package app_context
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+
+	"github.com/comstud/go-rollbar/rollbar"
+)
+
+// A Fingerprinter decides which rollbar item an error is grouped under.
+// Errors with the same fingerprint are one item; "" leaves grouping to
+// rollbar.
+type Fingerprinter func(err error) string
+
+// ErrorReporter sends errors to rollbar, with the caller's stack and the
+// recent log entries. Reporting from a derived context includes its fields.
+type ErrorReporter interface {
+	Report(ctx context.Context, err error, custom map[string]interface{})
+	// SetFingerprinter replaces DefaultFingerprint for the app context and
+	// everything derived from it. nil restores the default.
+	SetFingerprinter(fp Fingerprinter)
+	Fingerprint(err error) string
+}
+
+// Variable parts of error messages, most specific first
+var fingerprintScrubbers = []struct {
+	re   *regexp.Regexp
+	repl string
+}{
+	{regexp.MustCompile(`(?i)\b[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}\b`), "<uuid>"},
+	{regexp.MustCompile(`(?i)\b0x[0-9a-f]+\b`), "<addr>"},
+	{regexp.MustCompile(`\b(?:[0-9]{1,3}\.){3}[0-9]{1,3}(?::[0-9]+)?\b`), "<ip>"},
+	{regexp.MustCompile(`(?i)\b[0-9a-f]{8,}\b`), "<hex>"},
+	{regexp.MustCompile(`[0-9]+`), "<n>"},
+}
+
+// NormalizeErrorMessage replaces the parts of msg that usually differ
+// between occurrences of the same error (UUIDs, addresses, IPs, hex IDs and
+// numbers) with placeholders.
+func NormalizeErrorMessage(msg string) string {
+	for _, scrubber := range fingerprintScrubbers {
+		msg = scrubber.re.ReplaceAllString(msg, scrubber.repl)
+	}
+	return msg
+}
+
+// DefaultFingerprint groups errors by their type and normalized message
+func DefaultFingerprint(err error) string {
+	h := sha1.New()
+	fmt.Fprintf(h, "%T: %s", err, NormalizeErrorMessage(err.Error()))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+type errorReporter struct {
+	base   *baseAppContext
+	appctx AppContext
+}
+
+func (self *errorReporter) SetFingerprinter(fp Fingerprinter) {
+	self.base.componentsLock.Lock()
+	defer self.base.componentsLock.Unlock()
+	self.base.fingerprinter = fp
+}
+
+func (self *errorReporter) Fingerprint(err error) string {
+	self.base.componentsLock.RLock()
+	fp := self.base.fingerprinter
+	self.base.componentsLock.RUnlock()
+
+	if fp == nil {
+		fp = DefaultFingerprint
+	}
+	return fp(err)
+}
+
+func (self *errorReporter) Report(ctx context.Context, err error, custom map[string]interface{}) {
+	self.report(ctx, err, custom, nil)
+}
+
+// report is Report with the HTTP request being handled, if any
+func (self *errorReporter) report(ctx context.Context, err error, custom map[string]interface{}, req *rollbar.NotifierRequest) {
+	if !self.base.rollbarEnabled {
+		return
+	}
+	payload := self.base.rollbarPayload
+	if !payload.allow(self.appctx.Clock().Now()) {
+		self.appctx.MetricsClient().Incr("rollbar.dropped", 1.0, nil)
+		return
+	}
+
+	info := rollbar.CustomInfo{}
+	if logs := self.base.recentLogs(); logs != nil {
+		info["recent_logs"] = logs
+	}
+	for k, v := range payload.scrubCustom(custom) {
+		info[k] = v
+	}
+
+	rcli := self.appctx.RollbarClient()
+	notif := rcli.NewTraceNotification(rollbar.LV_ERROR, err.Error(), info)
+	notif.Trace.AddExceptionFromError(err)
+	notif.Trace.AddRuntimeFrames(nil)
+	if fingerprint := self.Fingerprint(err); fingerprint != "" {
+		notif.SetFingerprint(fingerprint)
+	}
+	if req != nil {
+		notif.SetRequest(req)
+	}
+	if person := payload.person(ctx); person != nil {
+		notif.SetPerson(person)
+	}
+
+	if _, send_err := rcli.SendNotification(notif); send_err != nil {
+		self.appctx.Logger().LogErrorf(ctx, "Error sending error to rollbar: %s", send_err)
+	}
+}
+
+func (self *baseAppContext) ErrorReporter() ErrorReporter {
+	return &errorReporter{base: self, appctx: self}
+}
+
+func (self *childAppContext) ErrorReporter() ErrorReporter {
+	return &errorReporter{base: self.baseAppContext, appctx: self}
+}
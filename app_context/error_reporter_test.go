@@ -0,0 +1,165 @@
+package app_context
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/comstud/go-rollbar/rollbar"
+)
+
+type capturingRollbarClient struct {
+	rollbar.Client
+	lock   sync.Mutex
+	notifs []rollbar.Notification
+}
+
+func (self *capturingRollbarClient) SendNotification(notif rollbar.Notification) (*rollbar.NotificationResponse, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.notifs = append(self.notifs, notif)
+	return &rollbar.NotificationResponse{}, nil
+}
+
+type otherError struct{}
+
+func (otherError) Error() string {
+	return "User 123 not found"
+}
+
+func TestDefaultFingerprint(t *testing.T) {
+	same := [][2]string{
+		{"User 123 not found", "User 4567 not found"},
+		{"Order 0b6f9c1e-2d4a-4c3b-9e1f-1a2b3c4d5e6f failed", "Order 7f9c1e2d-4a4c-3b9e-1f1a-2b3c4d5e6f7a failed"},
+		{"dial tcp 10.0.0.1:5432: connection refused", "dial tcp 10.0.0.2:5433: connection refused"},
+		{"Bad pointer 0xc000123456", "Bad pointer 0xc000abcdef"},
+		{"Object deadbeef12 missing", "Object 0123abcdef missing"},
+	}
+	for _, pair := range same {
+		if DefaultFingerprint(errors.New(pair[0])) != DefaultFingerprint(errors.New(pair[1])) {
+			t.Errorf("'%s' and '%s' should group together: '%s'", pair[0], pair[1], NormalizeErrorMessage(pair[0]))
+		}
+	}
+
+	if DefaultFingerprint(errors.New("User 1 not found")) == DefaultFingerprint(errors.New("User 1 was deleted")) {
+		t.Error("Different messages shouldn't group together")
+	}
+	if DefaultFingerprint(errors.New("User 123 not found")) == DefaultFingerprint(otherError{}) {
+		t.Error("Different error types shouldn't group together")
+	}
+}
+
+func TestErrorReporter(t *testing.T) {
+	app_ctx, err := NewAppContext("error_reporter_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer app_ctx.Close()
+
+	rcli := &capturingRollbarClient{Client: rollbar.NewNOOPClient()}
+	app_ctx.SetRollbarClient(rcli)
+	app_ctx.(*baseAppContext).rollbarEnabled = true
+
+	ctx := context.Background()
+	child := app_ctx.WithFields(map[string]interface{}{"order": "abc"})
+	child.ErrorReporter().Report(ctx, errors.New("Order 12 failed"), map[string]interface{}{"attempt": 1})
+
+	app_ctx.ErrorReporter().SetFingerprinter(func(err error) string {
+		return "custom"
+	})
+	app_ctx.ErrorReporter().Report(ctx, errors.New("Order 13 failed"), nil)
+
+	app_ctx.ErrorReporter().SetFingerprinter(nil)
+
+	if len(rcli.notifs) != 2 {
+		t.Fatalf("Expected 2 notifications, got %d", len(rcli.notifs))
+	}
+
+	first := rcli.notifs[0]
+	if first.GetFingerprint() != DefaultFingerprint(errors.New("Order 1 failed")) {
+		t.Errorf("Unexpected default fingerprint: %s", first.GetFingerprint())
+	}
+	if custom := first.GetCustom(); custom["order"] != "abc" || custom["attempt"] != 1 {
+		t.Errorf("Child fields and custom info missing: %+v", custom)
+	}
+	if fp := rcli.notifs[1].GetFingerprint(); fp != "custom" {
+		t.Errorf("Fingerprinter wasn't used: %s", fp)
+	}
+}
+
+func TestReportError(t *testing.T) {
+	os.Setenv("ROLLBAR_API_KEY", "test")
+	os.Setenv("ROLLBAR_SCRUB_FIELDS", "token, X-Session")
+	os.Setenv("ROLLBAR_MAX_ITEMS", "2")
+	os.Setenv("ROLLBAR_PERSON_FIELD", "user_id")
+	os.Setenv("ROLLBAR_CUSTOM_FIELDS", "team=payments")
+	defer func() {
+		for _, name := range []string{"ROLLBAR_API_KEY", "ROLLBAR_SCRUB_FIELDS", "ROLLBAR_MAX_ITEMS", "ROLLBAR_PERSON_FIELD", "ROLLBAR_CUSTOM_FIELDS"} {
+			os.Unsetenv(name)
+		}
+	}()
+
+	clock := NewFakeClock(time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC))
+	mcli := newCountingMetricsClient()
+	app_ctx, err := NewAppContext("error_reporter_test", WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app_ctx.Close()
+	app_ctx.SetMetricsClient(mcli)
+
+	// Keep the ROLLBAR_CUSTOM_FIELDS wrapper, but capture what it sends
+	custom_cli, ok := app_ctx.RollbarClient().(*customRollbarClient)
+	if !ok {
+		t.Fatalf("Expected ROLLBAR_CUSTOM_FIELDS to wrap the client, got %T", app_ctx.RollbarClient())
+	}
+	rcli := &capturingRollbarClient{Client: rollbar.NewNOOPClient()}
+	custom_cli.Client = rcli
+
+	r := httptest.NewRequest("GET", "/orders?id=1&token=secret", nil)
+	r.Header.Set("X-Session", "abc")
+	r = r.WithContext(WithField(r.Context(), "user_id", "u1"))
+	app_ctx.ForRequest(r).ReportError(errors.New("Order 1 failed"), map[string]interface{}{
+		"order": map[string]interface{}{"id": 1, "token": "secret"},
+	})
+	app_ctx.ReportError(errors.New("Order 2 failed"), nil)
+	app_ctx.ReportError(errors.New("Order 3 failed"), nil)
+	app_ctx.ReportError(nil, nil)
+
+	if len(rcli.notifs) != 2 {
+		t.Fatalf("Expected ROLLBAR_MAX_ITEMS to allow 2 notifications, got %d", len(rcli.notifs))
+	}
+	if n := mcli.count("rollbar.dropped"); n != 1 {
+		t.Errorf("Expected 1 dropped notification, got %d", n)
+	}
+
+	first := rcli.notifs[0]
+	custom := first.GetCustom()
+	if custom["team"] != "payments" {
+		t.Errorf("Missing ROLLBAR_CUSTOM_FIELDS: %+v", custom)
+	}
+	if order, _ := custom["order"].(map[string]interface{}); order["token"] != "[scrubbed]" || order["id"] != 1 {
+		t.Errorf("Expected the token to be scrubbed: %+v", custom["order"])
+	}
+	req := first.GetRequest()
+	if req == nil || req.Headers["X-Session"] != "[scrubbed]" || req.QueryString != "id=1&token=%5Bscrubbed%5D" {
+		t.Errorf("Expected the request, scrubbed: %+v", req)
+	}
+	if person := first.GetPerson(); person == nil || person.ID != "u1" {
+		t.Errorf("Expected the person from user_id: %+v", person)
+	}
+	if rcli.notifs[1].GetRequest() != nil || rcli.notifs[1].GetPerson() != nil {
+		t.Error("Reports outside a request shouldn't have request or person data")
+	}
+
+	clock.Advance(time.Minute)
+	app_ctx.ReportError(errors.New("Order 4 failed"), nil)
+	if len(rcli.notifs) != 3 {
+		t.Errorf("Expected ROLLBAR_MAX_ITEMS to reset after a minute, got %d notifications", len(rcli.notifs))
+	}
+}
@@ -0,0 +1,337 @@
+package app_context
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+)
+
+// maxLatencySamples bounds the durations kept per window; past it, a
+// random sample of them is kept
+const maxLatencySamples = 10000
+
+// GoldenSignalSummary is one GOLDEN_SIGNALS_INTERVAL of HTTPMiddleware
+// requests and queries on the DB. Apdex counts requests as satisfied
+// within APDEX_THRESHOLD, tolerating within 4 times it, and frustrated
+// when slower or a 5xx.
+type GoldenSignalSummary struct {
+	Start    time.Time `json:"start"`
+	Duration float64   `json:"duration_seconds"`
+
+	Requests      int     `json:"requests"`
+	RequestRate   float64 `json:"request_rate"`
+	ErrorRate     float64 `json:"error_rate"`
+	LatencyP50MS  float64 `json:"latency_p50_ms"`
+	LatencyP95MS  float64 `json:"latency_p95_ms"`
+	LatencyP99MS  float64 `json:"latency_p99_ms"`
+	Apdex         float64 `json:"apdex"`
+	InFlightMax   int     `json:"in_flight_max"`
+	Queries       int     `json:"queries"`
+	QueryRate     float64 `json:"query_rate"`
+	QueryErrors   int     `json:"query_errors"`
+	QueryP95MS    float64 `json:"query_p95_ms"`
+	DBPoolInUse   int     `json:"db_pool_in_use"`
+	DBPoolMaxOpen int     `json:"db_pool_max_open"`
+	DBPoolWaits   int64   `json:"db_pool_waits"`
+	Goroutines    int     `json:"goroutines"`
+}
+
+// GoldenSignals are baseline SLIs every service gets without a
+// dashboard. At the end of each GOLDEN_SIGNALS_INTERVAL a summary is
+// logged as one line and sent as gauges:
+//
+//	golden.request_rate, golden.error_rate      requests/s, fraction 5xx
+//	golden.latency_ms                           tagged quantile:p50/p95/p99
+//	golden.apdex                                0 to 1
+//	golden.query_rate, golden.query_error_rate  DB queries/s, fraction failed
+//	golden.query_latency_ms                     tagged quantile:p95
+//	golden.in_flight_max, golden.db_pool_in_use,
+//	golden.db_pool_waits, golden.goroutines     saturation
+//
+// Windows with no requests or queries aren't logged.
+type GoldenSignals interface {
+	// Last is the last complete window, nil before there is one
+	Last() *GoldenSignalSummary
+}
+
+type goldenWindow struct {
+	start       time.Time
+	requests    int
+	errors      int
+	satisfied   int
+	tolerating  int
+	latencies   []float64
+	seen        int
+	inFlightMax int
+	queries     int
+	queryErrors int
+	queryTimes  []float64
+	queriesSeen int
+}
+
+type goldenSignals struct {
+	appctx    *baseAppContext
+	interval  time.Duration
+	threshold time.Duration
+
+	lock      sync.Mutex
+	window    *goldenWindow
+	inFlight  int
+	last      *GoldenSignalSummary
+	poolWaits int64
+	stopChan  chan struct{}
+	doneChan  chan struct{}
+}
+
+func newGoldenSignals(appctx *baseAppContext) *goldenSignals {
+	return &goldenSignals{
+		appctx:    appctx,
+		interval:  time.Minute,
+		threshold: 500 * time.Millisecond,
+		window:    &goldenWindow{start: time.Now()},
+	}
+}
+
+// sample adds v to samples, keeping at most maxLatencySamples of the seen
+// values by reservoir sampling
+func (self *goldenSignals) sample(samples []float64, seen int, v float64) []float64 {
+	if len(samples) < maxLatencySamples {
+		return append(samples, v)
+	}
+	if i := self.appctx.Rand().Intn(seen); i < maxLatencySamples {
+		samples[i] = v
+	}
+	return samples
+}
+
+// startRequest counts a request as in flight until the returned func is
+// called with its status. Streamed responses, WebSockets and server-sent
+// events, last as long as the client stays, so they aren't timed.
+func (self *goldenSignals) startRequest() func(status int, streamed bool) {
+	start := time.Now()
+	self.lock.Lock()
+	self.inFlight++
+	if self.inFlight > self.window.inFlightMax {
+		self.window.inFlightMax = self.inFlight
+	}
+	self.lock.Unlock()
+
+	return func(status int, streamed bool) {
+		elapsed := time.Since(start)
+		self.lock.Lock()
+		defer self.lock.Unlock()
+		self.inFlight--
+		if streamed {
+			return
+		}
+		w := self.window
+		w.requests++
+		w.seen++
+		w.latencies = self.sample(w.latencies, w.seen, float64(elapsed)/float64(time.Millisecond))
+		switch {
+		case status >= 500:
+			w.errors++
+		case elapsed <= self.threshold:
+			w.satisfied++
+		case elapsed <= 4*self.threshold:
+			w.tolerating++
+		}
+	}
+}
+
+func (self *goldenSignals) observeQuery(elapsed time.Duration, err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	w := self.window
+	w.queries++
+	w.queriesSeen++
+	w.queryTimes = self.sample(w.queryTimes, w.queriesSeen, float64(elapsed)/float64(time.Millisecond))
+	if err != nil {
+		w.queryErrors++
+	}
+}
+
+// percentile is the pth percentile of sorted values
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(p/100*float64(len(sorted)) + 0.5)
+	if i > 0 {
+		i--
+	}
+	if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+	return sorted[i]
+}
+
+// rotate starts a new window, returning the summary of the one that ended
+func (self *goldenSignals) rotate() *GoldenSignalSummary {
+	now := time.Now()
+	self.lock.Lock()
+	w := self.window
+	self.window = &goldenWindow{start: now, inFlightMax: self.inFlight}
+	self.lock.Unlock()
+
+	secs := now.Sub(w.start).Seconds()
+	if secs <= 0 {
+		secs = 1
+	}
+	sort.Float64s(w.latencies)
+	sort.Float64s(w.queryTimes)
+	summary := &GoldenSignalSummary{
+		Start:        w.start,
+		Duration:     secs,
+		Requests:     w.requests,
+		RequestRate:  float64(w.requests) / secs,
+		LatencyP50MS: percentile(w.latencies, 50),
+		LatencyP95MS: percentile(w.latencies, 95),
+		LatencyP99MS: percentile(w.latencies, 99),
+		Apdex:        1,
+		InFlightMax:  w.inFlightMax,
+		Queries:      w.queries,
+		QueryRate:    float64(w.queries) / secs,
+		QueryErrors:  w.queryErrors,
+		QueryP95MS:   percentile(w.queryTimes, 95),
+		Goroutines:   runtime.NumGoroutine(),
+	}
+	if w.requests > 0 {
+		summary.ErrorRate = float64(w.errors) / float64(w.requests)
+		summary.Apdex = (float64(w.satisfied) + float64(w.tolerating)/2) / float64(w.requests)
+	}
+	if db := self.appctx.DBWrite(); db != nil {
+		stats := db.Stats()
+		summary.DBPoolInUse = stats.InUse
+		summary.DBPoolMaxOpen = stats.MaxOpenConnections
+		self.lock.Lock()
+		summary.DBPoolWaits = stats.WaitCount - self.poolWaits
+		self.poolWaits = stats.WaitCount
+		self.lock.Unlock()
+	}
+
+	self.lock.Lock()
+	self.last = summary
+	self.lock.Unlock()
+	return summary
+}
+
+func (self *goldenSignals) Last() *GoldenSignalSummary {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.last
+}
+
+func (self *goldenSignals) report() {
+	s := self.rotate()
+	if s.Requests == 0 && s.Queries == 0 {
+		return
+	}
+
+	mcli := self.appctx.MetricsClient()
+	mcli.Gauge("golden.request_rate", s.RequestRate, 1.0, nil)
+	mcli.Gauge("golden.error_rate", s.ErrorRate, 1.0, nil)
+	mcli.Gauge("golden.latency_ms", s.LatencyP50MS, 1.0, map[string]string{"quantile": "p50"})
+	mcli.Gauge("golden.latency_ms", s.LatencyP95MS, 1.0, map[string]string{"quantile": "p95"})
+	mcli.Gauge("golden.latency_ms", s.LatencyP99MS, 1.0, map[string]string{"quantile": "p99"})
+	mcli.Gauge("golden.apdex", s.Apdex, 1.0, nil)
+	mcli.Gauge("golden.query_rate", s.QueryRate, 1.0, nil)
+	query_error_rate := 0.0
+	if s.Queries > 0 {
+		query_error_rate = float64(s.QueryErrors) / float64(s.Queries)
+	}
+	mcli.Gauge("golden.query_error_rate", query_error_rate, 1.0, nil)
+	mcli.Gauge("golden.query_latency_ms", s.QueryP95MS, 1.0, map[string]string{"quantile": "p95"})
+	mcli.Gauge("golden.in_flight_max", float64(s.InFlightMax), 1.0, nil)
+	mcli.Gauge("golden.db_pool_in_use", float64(s.DBPoolInUse), 1.0, nil)
+	mcli.Gauge("golden.db_pool_waits", float64(s.DBPoolWaits), 1.0, nil)
+	mcli.Gauge("golden.goroutines", float64(s.Goroutines), 1.0, nil)
+
+	self.appctx.Logger().LogInfof(
+		context.Background(),
+		"Golden signals: %.1f req/s, %.2f%% errors, p50 %s p95 %s p99 %s, apdex %.2f, %d in flight; db %.1f q/s, %d errors, p95 %s, pool %d/%d, %d waits; %d goroutines",
+		s.RequestRate,
+		s.ErrorRate*100,
+		formatMS(s.LatencyP50MS),
+		formatMS(s.LatencyP95MS),
+		formatMS(s.LatencyP99MS),
+		s.Apdex,
+		s.InFlightMax,
+		s.QueryRate,
+		s.QueryErrors,
+		formatMS(s.QueryP95MS),
+		s.DBPoolInUse,
+		s.DBPoolMaxOpen,
+		s.DBPoolWaits,
+		s.Goroutines,
+	)
+}
+
+func formatMS(ms float64) string {
+	return fmt.Sprint(time.Duration(ms * float64(time.Millisecond)).Round(100 * time.Microsecond))
+}
+
+func (self *goldenSignals) start() {
+	stop_chan, done_chan := make(chan struct{}), make(chan struct{})
+	self.stopChan, self.doneChan = stop_chan, done_chan
+	// Real time, like the lifecycle heartbeats
+	ticker := NewRealClock().NewTicker(self.interval)
+	goLabeled("golden_signals", func() {
+		defer close(done_chan)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop_chan:
+				return
+			case <-ticker.C():
+				self.report()
+			}
+		}
+	})
+}
+
+func (self *goldenSignals) stop() {
+	if self.stopChan != nil {
+		close(self.stopChan)
+		<-self.doneChan
+		self.stopChan = nil
+	}
+}
+
+func (self *goldenSignals) status() map[string]interface{} {
+	return map[string]interface{}{
+		"interval":        self.interval.String(),
+		"apdex_threshold": self.threshold.String(),
+		"last":            self.Last(),
+	}
+}
+
+func (self *baseAppContext) GoldenSignals() GoldenSignals {
+	return self.golden
+}
+
+// GOLDEN_SIGNALS_INTERVAL (default 1m) is how often golden signals are
+// summarized; 0 turns the summaries off. APDEX_THRESHOLD (default 500ms)
+// is how fast a request must be to satisfy.
+func (self *baseAppContext) setGoldenSignalsFromEnv() error {
+	if interval, found, err := self.getDurationFromEnv("GOLDEN_SIGNALS_INTERVAL"); err != nil {
+		return err
+	} else if found {
+		self.golden.interval = interval
+	}
+	if threshold, found, err := self.getDurationFromEnv("APDEX_THRESHOLD"); err != nil {
+		return err
+	} else if found {
+		if threshold <= 0 {
+			return fmt.Errorf("APDEX_THRESHOLD must be > 0")
+		}
+		self.golden.threshold = threshold
+	}
+	if self.golden.interval > 0 && !self.lambda {
+		self.golden.start()
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package app_context
+
+import (
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestGoldenSignals(t *testing.T) {
+	os.Setenv("GOLDEN_SIGNALS_INTERVAL", "0")
+	os.Setenv("APDEX_THRESHOLD", "30ms")
+	defer os.Unsetenv("GOLDEN_SIGNALS_INTERVAL")
+	defer os.Unsetenv("APDEX_THRESHOLD")
+
+	app_ctx, err := NewAppContext("golden_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer app_ctx.Close()
+
+	mcli := newCountingMetricsClient()
+	app_ctx.SetMetricsClient(mcli)
+	db, err := app_ctx.(*baseAppContext).openDB("appctx_fake", "", "primary")
+	if err != nil {
+		t.Fatal(err)
+	}
+	app_ctx.SetDB(db)
+	defer app_ctx.SetDB(nil)
+
+	handler := app_ctx.HTTPMiddleware()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/slow":
+			time.Sleep(40 * time.Millisecond)
+		case "/broken":
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	for _, path := range []string{"/fast", "/slow", "/broken"} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+	if _, err := db.Exec("SELECT 1"); err != nil {
+		t.Fatal(err)
+	}
+
+	golden := app_ctx.(*baseAppContext).golden
+	if app_ctx.GoldenSignals().Last() != nil {
+		t.Error("Expected no summary before the first window ends")
+	}
+	golden.report()
+
+	s := app_ctx.GoldenSignals().Last()
+	if s.Requests != 3 || s.ErrorRate != 1.0/3 || s.InFlightMax != 1 {
+		t.Errorf("Unexpected request signals: %+v", s)
+	}
+	// One satisfied, one tolerating, one error
+	if s.Apdex != 0.5 {
+		t.Errorf("Expected apdex 0.5, got %v", s.Apdex)
+	}
+	if s.LatencyP99MS < 40 || s.LatencyP50MS > s.LatencyP99MS {
+		t.Errorf("Unexpected latencies: %+v", s)
+	}
+	if s.Queries != 1 || s.QueryErrors != 0 || s.DBPoolMaxOpen != db.Stats().MaxOpenConnections {
+		t.Errorf("Unexpected DB signals: %+v", s)
+	}
+	if mcli.count("golden.apdex") != 1 || mcli.count("golden.latency_ms") != 3 {
+		t.Errorf("Expected the summary to be sent, got %v", mcli.counts)
+	}
+
+	// Quiet windows aren't sent
+	golden.report()
+	if s := app_ctx.GoldenSignals().Last(); s.Requests != 0 || mcli.count("golden.apdex") != 1 {
+		t.Errorf("Expected an empty window not to be sent, got %+v", s)
+	}
+}
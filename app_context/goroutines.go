@@ -0,0 +1,122 @@
+package app_context
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"runtime/pprof"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// SubsystemLabel is the pprof label set on every goroutine the app context
+// starts, so profiles and goroutine dumps show which subsystem owns them.
+// Goroutines started from a labeled goroutine inherit its labels.
+const SubsystemLabel = "appctx_subsystem"
+
+// goLabeled runs fn in a new goroutine labeled with subsystem plus any
+// extra key, value pairs in labels
+func goLabeled(subsystem string, fn func(), labels ...string) {
+	labelset := pprof.Labels(append([]string{SubsystemLabel, subsystem}, labels...)...)
+	go pprof.Do(context.Background(), labelset, func(context.Context) {
+		fn()
+	})
+}
+
+// GoroutineGroup counts goroutines sharing the same set of labels
+type GoroutineGroup struct {
+	Subsystem string            `json:"subsystem"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	Count     int               `json:"count"`
+}
+
+// GoroutineSummary groups the process's goroutines by label. Goroutines
+// without a subsystem label are grouped under "unlabeled".
+type GoroutineSummary struct {
+	Total      int               `json:"total"`
+	Subsystems map[string]int    `json:"subsystems"`
+	Groups     []*GoroutineGroup `json:"groups"`
+}
+
+func parseGoroutineProfile(data []byte) *GoroutineSummary {
+	summary := &GoroutineSummary{Subsystems: make(map[string]int)}
+	groups := make(map[string]*GoroutineGroup)
+
+	var count int
+	var labels map[string]string
+
+	flush := func() {
+		if count == 0 {
+			return
+		}
+		subsystem := labels[SubsystemLabel]
+		if subsystem == "" {
+			subsystem = "unlabeled"
+		}
+		delete(labels, SubsystemLabel)
+		if len(labels) == 0 {
+			labels = nil
+		}
+
+		key, _ := json.Marshal(labels)
+		key = append([]byte(subsystem+" "), key...)
+		group, ok := groups[string(key)]
+		if !ok {
+			group = &GoroutineGroup{Subsystem: subsystem, Labels: labels}
+			groups[string(key)] = group
+			summary.Groups = append(summary.Groups, group)
+		}
+		group.Count += count
+		summary.Subsystems[subsystem] += count
+		summary.Total += count
+
+		count = 0
+		labels = nil
+	}
+
+	// debug=1 output is a header, then one block per unique stack:
+	// "<count> @ <pcs>", an optional "# labels: {...}" line and frames.
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "# labels: ") {
+			labels = make(map[string]string)
+			json.Unmarshal([]byte(strings.TrimPrefix(line, "# labels: ")), &labels)
+			continue
+		}
+		if idx := strings.Index(line, " @ "); idx > 0 {
+			if n, err := strconv.Atoi(line[:idx]); err == nil {
+				flush()
+				count = n
+			}
+		}
+	}
+	flush()
+
+	sort.Slice(summary.Groups, func(i, j int) bool {
+		if summary.Groups[i].Count != summary.Groups[j].Count {
+			return summary.Groups[i].Count > summary.Groups[j].Count
+		}
+		return summary.Groups[i].Subsystem < summary.Groups[j].Subsystem
+	})
+
+	return summary
+}
+
+// Goroutines summarizes the process's current goroutines by label
+func Goroutines() *GoroutineSummary {
+	var buf bytes.Buffer
+	pprof.Lookup("goroutine").WriteTo(&buf, 1)
+	return parseGoroutineProfile(buf.Bytes())
+}
+
+func goroutinesHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(Goroutines())
+	})
+}
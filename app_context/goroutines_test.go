@@ -0,0 +1,73 @@
+package app_context
+
+import (
+	"context"
+	"log"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestGoroutineLabels(t *testing.T) {
+	os.Setenv("METRICS_DISABLE", "true")
+	defer os.Unsetenv("METRICS_DISABLE")
+
+	app_ctx, err := NewAppContext("goroutines_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer app_ctx.Close()
+
+	if err := app_ctx.Workers().Register("labeled", func(ctx context.Context) error {
+		<-ctx.Done()
+		return nil
+	}, WorkerOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := app_ctx.Scheduler().Every("labeled", time.Hour, func(ctx context.Context) error {
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	var summary *GoroutineSummary
+	waitFor(t, "labeled goroutines", func() bool {
+		summary = Goroutines()
+		return summary.Subsystems["workers"] > 0 && summary.Subsystems["scheduler"] > 0
+	})
+
+	found := false
+	for _, group := range summary.Groups {
+		if group.Subsystem == "workers" && group.Labels["worker"] == "labeled" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("No goroutine labeled with the worker name: %+v", summary.Groups)
+	}
+	if summary.Subsystems["unlabeled"] == 0 || summary.Total < summary.Subsystems["unlabeled"]+2 {
+		t.Errorf("Unexpected totals: %+v", summary)
+	}
+}
+
+func TestParseGoroutineProfile(t *testing.T) {
+	profile := `goroutine profile: total 6
+3 @ 0x1 0x2
+# labels: {"appctx_subsystem":"workers", "worker":"a"}
+#	0x1	runtime.gopark+0x1	/go/src/runtime/proc.go:1
+
+2 @ 0x3
+#	0x3	main.main+0x1	/main.go:1
+
+1 @ 0x4
+# labels: {"appctx_subsystem":"workers", "worker":"a"}
+#	0x4	foo+0x1	/foo.go:1
+`
+	summary := parseGoroutineProfile([]byte(profile))
+	if summary.Total != 6 || summary.Subsystems["workers"] != 4 || summary.Subsystems["unlabeled"] != 2 {
+		t.Errorf("Unexpected summary: %+v", summary)
+	}
+	if len(summary.Groups) != 2 || summary.Groups[0].Count != 4 || summary.Groups[0].Labels["worker"] != "a" {
+		t.Errorf("Unexpected groups: %+v", summary.Groups)
+	}
+}
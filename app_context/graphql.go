@@ -0,0 +1,380 @@
+package app_context
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+)
+
+type GraphQLRequest struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName,omitempty"`
+	Variables     map[string]interface{} `json:"variables,omitempty"`
+	Extensions    map[string]interface{} `json:"extensions,omitempty"`
+}
+
+// GraphQLError is an error in a response. Err is what a resolver returned,
+// which is mapped through ErrorCodes() for the message and code the client
+// sees, and reported if it's a 5xx.
+type GraphQLError struct {
+	Message    string                 `json:"message"`
+	Path       []interface{}          `json:"path,omitempty"`
+	Extensions map[string]interface{} `json:"extensions,omitempty"`
+	Err        error                  `json:"-"`
+}
+
+type GraphQLResponse struct {
+	Data   json.RawMessage `json:"data,omitempty"`
+	Errors []*GraphQLError `json:"errors,omitempty"`
+}
+
+// GraphQLSchema executes requests; it adapts whichever GraphQL library the
+// app uses. Resolvers, or the library's tracing hooks, can time themselves
+// with TraceGraphQLResolver.
+type GraphQLSchema interface {
+	Exec(ctx context.Context, req *GraphQLRequest) *GraphQLResponse
+}
+
+type GraphQLSchemaFunc func(ctx context.Context, req *GraphQLRequest) *GraphQLResponse
+
+func (self GraphQLSchemaFunc) Exec(ctx context.Context, req *GraphQLRequest) *GraphQLResponse {
+	return self(ctx, req)
+}
+
+type graphqlOperationKey struct{}
+
+type graphqlOperation struct {
+	server *GraphQLServer
+	name   string
+}
+
+// TraceGraphQLResolver times a resolver for field, such as "Query.user",
+// until the returned func is called with its error. It does nothing
+// outside of a GraphQLServer request.
+func TraceGraphQLResolver(ctx context.Context, field string) func(err error) {
+	op, _ := ctx.Value(graphqlOperationKey{}).(*graphqlOperation)
+	if op == nil {
+		return func(error) {}
+	}
+	start := time.Now()
+	return func(err error) {
+		outcome := "ok"
+		if err != nil {
+			outcome = "error"
+		}
+		op.server.appctx.MetricsClient().TimingMS(
+			"graphql.resolver_ms",
+			float64(time.Since(start))/float64(time.Millisecond),
+			1.0,
+			map[string]string{"field": field, "operation": op.name, "outcome": outcome},
+		)
+	}
+}
+
+type graphqlConfig struct {
+	persistedOnly bool
+	persistedTTL  time.Duration
+	maxQuerySize  int
+	slowThreshold time.Duration
+}
+
+func newGraphQLConfig() *graphqlConfig {
+	return &graphqlConfig{
+		persistedTTL:  24 * time.Hour,
+		maxQuerySize:  100000,
+		slowThreshold: time.Second,
+	}
+}
+
+// GraphQLServer serves a schema over HTTP POSTs of JSON, with Apollo's
+// automatic persisted queries: clients may send the SHA-256 of a query
+// instead of the query, once it has been sent. With
+// GRAPHQL_PERSISTED_QUERIES_ONLY, only queries added with Persist may
+// run.
+//
+// Metrics: graphql.requests and graphql.duration_ms (tagged operation
+// and outcome), graphql.errors (tagged code), graphql.resolver_ms and
+// graphql.persisted_queries (tagged result hit, miss or registered).
+// Since clients pick the operation name, it's only used as a tag if it's
+// the name of an operation in a query given to Persist; others are tagged
+// unknown, or anonymous without a name.
+type GraphQLServer struct {
+	appctx *baseAppContext
+	schema GraphQLSchema
+	config graphqlConfig
+
+	lock      sync.RWMutex
+	persisted map[string]string
+	// operations are the names of operations in Persist's queries
+	operations map[string]bool
+}
+
+// persistedQueryLimit bounds the queries kept in memory, past which
+// they're only in Cache()
+const persistedQueryLimit = 1000
+
+func (self *baseAppContext) NewGraphQLServer(schema GraphQLSchema) *GraphQLServer {
+	return &GraphQLServer{
+		appctx:     self,
+		schema:     schema,
+		config:     *self.graphql,
+		persisted:  make(map[string]string),
+		operations: make(map[string]bool),
+	}
+}
+
+// graphqlOperationName finds the names of a query's operations
+var graphqlOperationName = regexp.MustCompile(`(?:^|[^_0-9A-Za-z])(?:query|mutation|subscription)\s+([_A-Za-z][_0-9A-Za-z]*)`)
+
+// maxGraphQLOperationTag bounds the operation names used as tags
+const maxGraphQLOperationTag = 64
+
+func graphqlQueryHash(query string) string {
+	sum := sha256.Sum256([]byte(query))
+	return hex.EncodeToString(sum[:])
+}
+
+// Persist adds trusted queries, the only ones that run with
+// GRAPHQL_PERSISTED_QUERIES_ONLY
+func (self *GraphQLServer) Persist(queries ...string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for _, query := range queries {
+		self.persisted[graphqlQueryHash(query)] = query
+		for _, match := range graphqlOperationName.FindAllStringSubmatch(query, -1) {
+			self.operations[match[1]] = true
+		}
+	}
+}
+
+// operationTag is the operation tag for a request naming operation
+func (self *GraphQLServer) operationTag(operation string) string {
+	if operation == "" {
+		return "anonymous"
+	}
+	self.lock.RLock()
+	known := self.operations[operation]
+	self.lock.RUnlock()
+	if !known {
+		return "unknown"
+	}
+	if len(operation) > maxGraphQLOperationTag {
+		return operation[:maxGraphQLOperationTag]
+	}
+	return operation
+}
+
+func (self *GraphQLServer) lookup(ctx context.Context, hash string) (string, bool) {
+	self.lock.RLock()
+	query, ok := self.persisted[hash]
+	self.lock.RUnlock()
+	if ok || self.config.persistedOnly {
+		return query, ok
+	}
+	if data, err := self.appctx.Cache().Get(ctx, "graphql:pq:"+hash); err == nil {
+		return string(data), true
+	}
+	return "", false
+}
+
+func (self *GraphQLServer) register(ctx context.Context, hash string, query string) {
+	self.lock.Lock()
+	if len(self.persisted) < persistedQueryLimit {
+		self.persisted[hash] = query
+	}
+	self.lock.Unlock()
+	if err := self.appctx.Cache().Set(ctx, "graphql:pq:"+hash, []byte(query), self.config.persistedTTL); err != nil {
+		self.appctx.Logger().LogWarnf(ctx, "Error caching persisted GraphQL query: %s", err)
+	}
+}
+
+// persistedHash is the hash from the request's persistedQuery extension,
+// if it has one
+func persistedHash(req *GraphQLRequest) string {
+	pq, _ := req.Extensions["persistedQuery"].(map[string]interface{})
+	hash, _ := pq["sha256Hash"].(string)
+	return hash
+}
+
+func graphqlErrorResponse(code string, message string) *GraphQLResponse {
+	return &GraphQLResponse{Errors: []*GraphQLError{{
+		Message:    message,
+		Extensions: map[string]interface{}{"code": code},
+	}}}
+}
+
+// resolveQuery fills in the query of a persisted query request, or
+// returns the response to send instead
+func (self *GraphQLServer) resolveQuery(ctx context.Context, req *GraphQLRequest) *GraphQLResponse {
+	mcli := self.appctx.MetricsClient()
+	hash := persistedHash(req)
+	if hash == "" {
+		if self.config.persistedOnly {
+			return graphqlErrorResponse("PERSISTED_QUERY_REQUIRED", "Only persisted queries are allowed")
+		}
+		return nil
+	}
+	if req.Query != "" {
+		if graphqlQueryHash(req.Query) != hash {
+			return graphqlErrorResponse("BAD_REQUEST", "provided sha does not match query")
+		}
+		if self.config.persistedOnly {
+			if _, ok := self.lookup(ctx, hash); !ok {
+				return graphqlErrorResponse("PERSISTED_QUERY_REQUIRED", "Only persisted queries are allowed")
+			}
+			return nil
+		}
+		self.register(ctx, hash, req.Query)
+		mcli.Incr("graphql.persisted_queries", 1.0, map[string]string{"result": "registered"})
+		return nil
+	}
+	query, ok := self.lookup(ctx, hash)
+	if !ok {
+		mcli.Incr("graphql.persisted_queries", 1.0, map[string]string{"result": "miss"})
+		return graphqlErrorResponse("PERSISTED_QUERY_NOT_FOUND", "PersistedQueryNotFound")
+	}
+	mcli.Incr("graphql.persisted_queries", 1.0, map[string]string{"result": "hit"})
+	req.Query = query
+	return nil
+}
+
+// mapErrors gives resolver errors their ErrorCodes() code and message,
+// reporting the internal ones
+func (self *GraphQLServer) mapErrors(reqctx RequestAppContext, operation string, resp *GraphQLResponse) {
+	mcli := self.appctx.MetricsClient()
+	for _, gql_err := range resp.Errors {
+		if gql_err.Extensions == nil {
+			gql_err.Extensions = make(map[string]interface{})
+		}
+		if gql_err.Err != nil {
+			app_err := self.appctx.errorCodes.AppError(gql_err.Err)
+			if app_err.Status >= 500 || app_err.Status < 400 {
+				reqctx.ReportError(gql_err.Err, map[string]interface{}{
+					"graphql_operation": operation,
+					"graphql_path":      gql_err.Path,
+				})
+			}
+			gql_err.Message = app_err.Message
+			gql_err.Extensions["code"] = app_err.Code
+			if self.appctx.httpErrorDetails {
+				gql_err.Extensions["detail"] = gql_err.Err.Error()
+			}
+		}
+		code, _ := gql_err.Extensions["code"].(string)
+		if code == "" {
+			code = "GRAPHQL_ERROR"
+		}
+		mcli.Incr("graphql.errors", 1.0, map[string]string{"operation": operation, "code": code})
+	}
+}
+
+func (self *GraphQLServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	reqctx := self.appctx.ForRequest(r)
+	ctx := reqctx.Context()
+	write := func(status int, resp *GraphQLResponse) {
+		data, _ := json.Marshal(resp)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		w.Write(data)
+	}
+
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		write(http.StatusMethodNotAllowed, graphqlErrorResponse("BAD_REQUEST", "Use POST"))
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, int64(self.config.maxQuerySize)))
+	if err != nil {
+		write(http.StatusRequestEntityTooLarge, graphqlErrorResponse("BAD_REQUEST", "Request too large"))
+		return
+	}
+	var req GraphQLRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		write(http.StatusBadRequest, graphqlErrorResponse("BAD_REQUEST", "Invalid JSON: "+err.Error()))
+		return
+	}
+	if resp := self.resolveQuery(ctx, &req); resp != nil {
+		write(http.StatusOK, resp)
+		return
+	}
+	if req.Query == "" {
+		write(http.StatusBadRequest, graphqlErrorResponse("BAD_REQUEST", "A query is required"))
+		return
+	}
+
+	operation := self.operationTag(req.OperationName)
+	start := time.Now()
+	resp := self.schema.Exec(context.WithValue(ctx, graphqlOperationKey{}, &graphqlOperation{server: self, name: operation}), &req)
+	elapsed := time.Since(start)
+	if resp == nil {
+		resp = &GraphQLResponse{}
+	}
+	self.mapErrors(reqctx, operation, resp)
+
+	outcome := "ok"
+	if len(resp.Errors) > 0 {
+		outcome = "error"
+	}
+	tags := map[string]string{"operation": operation, "outcome": outcome}
+	mcli := self.appctx.MetricsClient()
+	mcli.Incr("graphql.requests", 1.0, tags)
+	mcli.TimingMS("graphql.duration_ms", float64(elapsed)/float64(time.Millisecond), 1.0, tags)
+	if elapsed >= self.config.slowThreshold {
+		reqctx.Logger().LogWarnf(ctx, "Slow GraphQL operation %s took %s with %d errors", operation, elapsed, len(resp.Errors))
+	}
+	write(http.StatusOK, resp)
+}
+
+func (self *graphqlConfig) status() map[string]interface{} {
+	return map[string]interface{}{
+		"persisted_only": self.persistedOnly,
+		"persisted_ttl":  self.persistedTTL.String(),
+		"max_query_size": self.maxQuerySize,
+		"slow_threshold": self.slowThreshold.String(),
+	}
+}
+
+// GRAPHQL_PERSISTED_QUERY_TTL (default 24h) is how long persisted queries
+// are cached, and GRAPHQL_PERSISTED_QUERIES_ONLY limits servers to
+// queries they've been given. GRAPHQL_MAX_QUERY_SIZE (default 100000)
+// bounds request bodies in bytes, and operations slower than
+// GRAPHQL_SLOW_THRESHOLD (default 1s) are logged.
+func (self *baseAppContext) setGraphQLFromEnv() error {
+	config := self.graphql
+	var err error
+	if config.persistedOnly, _, err = self.getBoolFromEnv("GRAPHQL_PERSISTED_QUERIES_ONLY"); err != nil {
+		return err
+	}
+	if ttl, found, err := self.getDurationFromEnv("GRAPHQL_PERSISTED_QUERY_TTL"); err != nil {
+		return err
+	} else if found {
+		if ttl < 0 {
+			return errors.New("GRAPHQL_PERSISTED_QUERY_TTL must be >= 0")
+		}
+		config.persistedTTL = ttl
+	}
+	if size, found, err := self.getIntFromEnv("GRAPHQL_MAX_QUERY_SIZE"); err != nil {
+		return err
+	} else if found {
+		if size <= 0 {
+			return errors.New("GRAPHQL_MAX_QUERY_SIZE must be > 0")
+		}
+		config.maxQuerySize = size
+	}
+	if threshold, found, err := self.getDurationFromEnv("GRAPHQL_SLOW_THRESHOLD"); err != nil {
+		return err
+	} else if found {
+		if threshold <= 0 {
+			return errors.New("GRAPHQL_SLOW_THRESHOLD must be > 0")
+		}
+		config.slowThreshold = threshold
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+package app_context
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func postGraphQL(t *testing.T, handler http.Handler, req map[string]interface{}) (int, *GraphQLResponse) {
+	body, _ := json.Marshal(req)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("POST", "/graphql", bytes.NewReader(body)))
+	var resp GraphQLResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Invalid response %q: %s", rec.Body.String(), err)
+	}
+	return rec.Code, &resp
+}
+
+func persistedQueryExtension(query string) map[string]interface{} {
+	return map[string]interface{}{
+		"persistedQuery": map[string]interface{}{"version": 1, "sha256Hash": graphqlQueryHash(query)},
+	}
+}
+
+func graphqlErrorCode(resp *GraphQLResponse) string {
+	if len(resp.Errors) != 1 {
+		return ""
+	}
+	code, _ := resp.Errors[0].Extensions["code"].(string)
+	return code
+}
+
+func TestGraphQLServer(t *testing.T) {
+	app_ctx, err := NewAppContext("graphql_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer app_ctx.Close()
+
+	mcli := newCountingMetricsClient()
+	app_ctx.SetMetricsClient(mcli)
+
+	var queries []string
+	server := app_ctx.NewGraphQLServer(GraphQLSchemaFunc(func(ctx context.Context, req *GraphQLRequest) *GraphQLResponse {
+		queries = append(queries, req.Query)
+		done := TraceGraphQLResolver(ctx, "Query.user")
+		defer done(nil)
+		switch req.OperationName {
+		case "Missing":
+			return &GraphQLResponse{
+				Data:   json.RawMessage(`{"user": null}`),
+				Errors: []*GraphQLError{{Path: []interface{}{"user"}, Err: NewAppError(0, "not_found", "")}},
+			}
+		case "Broken":
+			return &GraphQLResponse{Errors: []*GraphQLError{{Err: errors.New("connection refused")}}}
+		}
+		return &GraphQLResponse{Data: json.RawMessage(`{"user":{"id":"1"}}`)}
+	}))
+
+	query := "query User { user(id: 1) { id } }"
+	server.Persist(query)
+	status, resp := postGraphQL(t, server, map[string]interface{}{"query": query, "operationName": "User"})
+	if status != http.StatusOK || string(resp.Data) != `{"user":{"id":"1"}}` || len(resp.Errors) != 0 {
+		t.Errorf("Unexpected response: %d %+v", status, resp)
+	}
+	if op := mcli.tags["graphql.requests"]["operation"]; op != "User" {
+		t.Errorf("Expected the persisted operation as a tag, got '%s'", op)
+	}
+	if op := mcli.tags["graphql.resolver_ms"]["operation"]; op != "User" {
+		t.Errorf("Expected the resolver to be tagged with the operation, got '%s'", op)
+	}
+
+	// Errors are given codes, and internal ones don't leak
+	if _, resp := postGraphQL(t, server, map[string]interface{}{"query": query, "operationName": "Missing"}); graphqlErrorCode(resp) != "not_found" || resp.Errors[0].Message != "Not found" {
+		t.Errorf("Unexpected errors: %+v", resp.Errors[0])
+	}
+	if _, resp := postGraphQL(t, server, map[string]interface{}{"query": query, "operationName": "Broken"}); graphqlErrorCode(resp) != "internal_error" || resp.Errors[0].Message != "Internal server error" {
+		t.Errorf("Unexpected errors: %+v", resp.Errors[0])
+	}
+
+	// Automatic persisted queries
+	apq := "query Persisted { user(id: 2) { id } }"
+	if _, resp := postGraphQL(t, server, map[string]interface{}{"extensions": persistedQueryExtension(apq)}); graphqlErrorCode(resp) != "PERSISTED_QUERY_NOT_FOUND" {
+		t.Errorf("Expected the query not to be found, got %+v", resp)
+	}
+	if _, resp := postGraphQL(t, server, map[string]interface{}{"query": query, "extensions": persistedQueryExtension(apq)}); graphqlErrorCode(resp) != "BAD_REQUEST" {
+		t.Errorf("Expected a mismatched hash to fail, got %+v", resp)
+	}
+	postGraphQL(t, server, map[string]interface{}{"query": apq, "extensions": persistedQueryExtension(apq)})
+	queries = nil
+	if _, resp := postGraphQL(t, server, map[string]interface{}{"extensions": persistedQueryExtension(apq)}); len(resp.Errors) != 0 || len(queries) != 1 || queries[0] != apq {
+		t.Errorf("Expected the persisted query to run, got %+v %v", resp, queries)
+	}
+
+	if status, _ := postGraphQL(t, server, map[string]interface{}{}); status != http.StatusBadRequest {
+		t.Errorf("Expected 400 without a query, got %d", status)
+	}
+
+	// Names that aren't in a persisted query aren't tags
+	postGraphQL(t, server, map[string]interface{}{"query": "query Random123 { user(id: 1) { id } }", "operationName": "Random123"})
+	if op := mcli.tags["graphql.requests"]["operation"]; op != "unknown" {
+		t.Errorf("Expected an unknown operation, got '%s'", op)
+	}
+	postGraphQL(t, server, map[string]interface{}{"query": query})
+	if op := mcli.tags["graphql.requests"]["operation"]; op != "anonymous" {
+		t.Errorf("Expected an anonymous operation, got '%s'", op)
+	}
+	long_name := strings.Repeat("Long", 25)
+	server.Persist("query " + long_name + " { user(id: 1) { id } }")
+	postGraphQL(t, server, map[string]interface{}{"query": query, "operationName": long_name})
+	if op := mcli.tags["graphql.requests"]["operation"]; op != long_name[:maxGraphQLOperationTag] {
+		t.Errorf("Expected the operation tag to be capped, got '%s'", op)
+	}
+
+	if mcli.count("graphql.requests") != 8 || mcli.count("graphql.resolver_ms") != 8 || mcli.count("graphql.errors") != 2 {
+		t.Errorf("Unexpected metrics: %v", mcli.counts)
+	}
+	if mcli.count("graphql.persisted_queries") != 3 {
+		t.Errorf("Expected a miss, a registration and a hit, got %v", mcli.counts)
+	}
+}
+
+func TestGraphQLPersistedQueriesOnly(t *testing.T) {
+	os.Setenv("GRAPHQL_PERSISTED_QUERIES_ONLY", "true")
+	defer os.Unsetenv("GRAPHQL_PERSISTED_QUERIES_ONLY")
+
+	app_ctx, err := NewAppContext("graphql_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer app_ctx.Close()
+
+	server := app_ctx.NewGraphQLServer(GraphQLSchemaFunc(func(ctx context.Context, req *GraphQLRequest) *GraphQLResponse {
+		return &GraphQLResponse{Data: json.RawMessage(`{}`)}
+	}))
+	trusted := "query Me { me { id } }"
+	server.Persist(trusted)
+
+	for _, req := range []map[string]interface{}{
+		{"query": "query Other { users { id } }"},
+		{"query": "query Other { users { id } }", "extensions": persistedQueryExtension("query Other { users { id } }")},
+	} {
+		if _, resp := postGraphQL(t, server, req); graphqlErrorCode(resp) != "PERSISTED_QUERY_REQUIRED" {
+			t.Errorf("Expected %v to be refused, got %+v", req, resp)
+		}
+	}
+	if _, resp := postGraphQL(t, server, map[string]interface{}{"extensions": persistedQueryExtension(trusted)}); len(resp.Errors) != 0 {
+		t.Errorf("Expected the trusted query to run, got %+v", resp)
+	}
+}
@@ -0,0 +1,143 @@
+package app_context
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+type HealthCheckFunc func(ctx context.Context) error
+
+type HealthResult struct {
+	Name      string    `json:"name"`
+	Healthy   bool      `json:"healthy"`
+	Error     string    `json:"error,omitempty"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+// HealthRegistry tracks the health of named components. Components either
+// register a check func that's run on demand, or push their status with
+// SetStatus.
+type HealthRegistry interface {
+	Register(name string, check HealthCheckFunc)
+	Unregister(name string)
+	SetStatus(name string, err error)
+	Check(ctx context.Context) []*HealthResult
+	Healthy(ctx context.Context) bool
+	Handler() http.Handler
+}
+
+type healthRegistry struct {
+	lock     sync.Mutex
+	checks   map[string]HealthCheckFunc
+	statuses map[string]*HealthResult
+	now      func() time.Time
+}
+
+func newHealthResult(name string, err error, at time.Time) *HealthResult {
+	res := &HealthResult{
+		Name:      name,
+		Healthy:   err == nil,
+		CheckedAt: at,
+	}
+	if err != nil {
+		res.Error = err.Error()
+	}
+	return res
+}
+
+func (self *healthRegistry) Register(name string, check HealthCheckFunc) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	delete(self.statuses, name)
+	self.checks[name] = check
+}
+
+func (self *healthRegistry) Unregister(name string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	delete(self.checks, name)
+	delete(self.statuses, name)
+}
+
+func (self *healthRegistry) SetStatus(name string, err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	delete(self.checks, name)
+	self.statuses[name] = newHealthResult(name, err, self.now())
+}
+
+func (self *healthRegistry) Check(ctx context.Context) []*HealthResult {
+	self.lock.Lock()
+	checks := make(map[string]HealthCheckFunc, len(self.checks))
+	for name, check := range self.checks {
+		checks[name] = check
+	}
+	results := make([]*HealthResult, 0, len(checks)+len(self.statuses))
+	for _, status := range self.statuses {
+		res := *status
+		results = append(results, &res)
+	}
+	self.lock.Unlock()
+
+	for name, check := range checks {
+		results = append(results, newHealthResult(name, check(ctx), self.now()))
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Name < results[j].Name
+	})
+
+	return results
+}
+
+func (self *healthRegistry) Healthy(ctx context.Context) bool {
+	for _, res := range self.Check(ctx) {
+		if !res.Healthy {
+			return false
+		}
+	}
+	return true
+}
+
+func (self *healthRegistry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		results := self.Check(r.Context())
+
+		healthy := true
+		for _, res := range results {
+			healthy = healthy && res.Healthy
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if healthy {
+			w.WriteHeader(http.StatusOK)
+		} else {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"healthy": healthy,
+			"checks":  results,
+		})
+	})
+}
+
+func NewHealthRegistry() HealthRegistry {
+	return newHealthRegistry(time.Now)
+}
+
+func newHealthRegistry(now func() time.Time) *healthRegistry {
+	return &healthRegistry{
+		checks:   make(map[string]HealthCheckFunc),
+		statuses: make(map[string]*HealthResult),
+		now:      now,
+	}
+}
+
+func (self *baseAppContext) Health() HealthRegistry {
+	return self.health
+}
@@ -0,0 +1,171 @@
+package app_context
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// instrumentedTransport is the RoundTripper behind HTTPClient. It adds the
+// request ID, propagated fields and remaining deadline from the request's
+// context, retries idempotent requests that fail with a connection error
+// or a 502, 503 or 504, and reports http_client.requests,
+// http_client.duration_ms and http_client.retries tagged with host and
+// method, and service for a ServiceClient's requests.
+type instrumentedTransport struct {
+	appctx     *baseAppContext
+	inner      http.RoundTripper
+	service    string
+	maxRetries int
+	minBackoff time.Duration
+}
+
+func isIdempotentRequest(req *http.Request) bool {
+	switch req.Method {
+	case "GET", "HEAD", "OPTIONS", "PUT", "DELETE":
+		return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+	}
+	return false
+}
+
+func isRetryableResponse(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	switch resp.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+func (self *instrumentedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+
+	// RoundTrippers mustn't modify the caller's request
+	req = req.Clone(ctx)
+	if request_id := RequestIDFromContext(ctx); request_id != "" && req.Header.Get(self.appctx.requestIDHeader) == "" {
+		req.Header.Set(self.appctx.requestIDHeader, request_id)
+	}
+	self.appctx.FieldPropagation().ToRequest(ctx, req)
+
+	tags := self.appctx.FieldPropagation().MetricTags(ctx, map[string]string{"host": req.URL.Hostname(), "method": req.Method})
+	if self.service != "" {
+		tags["service"] = self.service
+	}
+	mcli := self.appctx.MetricsClient()
+
+	max_retries := 0
+	if isIdempotentRequest(req) {
+		max_retries = self.maxRetries
+	}
+	backoff := self.minBackoff
+	send_deadline := req.Header.Get(self.appctx.deadlineHeader) == ""
+
+	for attempt := 0; ; attempt++ {
+		if send_deadline {
+			// Refreshed for each attempt, as retries use up the budget
+			self.appctx.setRequestDeadline(ctx, req)
+		}
+		start := time.Now()
+		resp, err := self.inner.RoundTrip(req)
+
+		status := "error"
+		if err == nil {
+			status = strconv.Itoa(resp.StatusCode)
+		}
+		mcli.TimingMS("http_client.duration_ms", float64(time.Since(start))/float64(time.Millisecond), 1.0, tags)
+		req_tags := map[string]string{"status": status}
+		for k, v := range tags {
+			req_tags[k] = v
+		}
+		mcli.Incr("http_client.requests", 1.0, req_tags)
+
+		if attempt >= max_retries || !isRetryableResponse(resp, err) || ctx.Err() != nil {
+			return resp, err
+		}
+
+		if req.GetBody != nil {
+			body, body_err := req.GetBody()
+			if body_err != nil {
+				return resp, err
+			}
+			req.Body = body
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+
+		mcli.Incr("http_client.retries", 1.0, tags)
+
+		sleep := backoff/2 + time.Duration(self.appctx.Rand().Int63n(int64(backoff)))
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-self.appctx.Clock().After(sleep):
+		}
+		backoff *= 2
+	}
+}
+
+func (self *baseAppContext) HTTPClient() *http.Client {
+	return self.httpClient
+}
+
+// HTTP_CLIENT_TIMEOUT (default 30s) bounds each request made with
+// HTTPClient, including retries. HTTP_CLIENT_MAX_RETRIES (default 2) and
+// HTTP_CLIENT_MAX_IDLE_PER_HOST (default 32) tune retries and pooling.
+func (self *baseAppContext) setHTTPClientFromEnv() error {
+	timeout := 30 * time.Second
+	if d, found, err := self.getDurationFromEnv("HTTP_CLIENT_TIMEOUT"); err != nil {
+		return err
+	} else if found {
+		timeout = d
+	}
+
+	max_retries := 2
+	if n, found, err := self.getIntFromEnv("HTTP_CLIENT_MAX_RETRIES"); err != nil {
+		return err
+	} else if found {
+		if n < 0 {
+			return fmt.Errorf("HTTP_CLIENT_MAX_RETRIES must be >= 0")
+		}
+		max_retries = n
+	}
+
+	max_idle := 32
+	if n, found, err := self.getIntFromEnv("HTTP_CLIENT_MAX_IDLE_PER_HOST"); err != nil {
+		return err
+	} else if found {
+		max_idle = n
+	}
+
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   5 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          max_idle * 4,
+		MaxIdleConnsPerHost:   max_idle,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   5 * time.Second,
+		ResponseHeaderTimeout: timeout,
+		ExpectContinueTimeout: time.Second,
+	}
+
+	self.httpClient = &http.Client{
+		Timeout: timeout,
+		Transport: &instrumentedTransport{
+			appctx:     self,
+			inner:      transport,
+			maxRetries: max_retries,
+			minBackoff: 100 * time.Millisecond,
+		},
+	}
+
+	return nil
+}
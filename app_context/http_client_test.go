@@ -0,0 +1,84 @@
+package app_context
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestHTTPClient(t *testing.T) {
+	app_ctx, err := NewAppContext("http_client_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer app_ctx.Close()
+
+	mcli := newCountingMetricsClient()
+	app_ctx.SetMetricsClient(mcli)
+	app_ctx.HTTPClient().Transport.(*instrumentedTransport).minBackoff = 1
+
+	var lock sync.Mutex
+	failures := 0
+	request_ids := []string{}
+	bodies := []string{}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		request_ids = append(request_ids, r.Header.Get("X-Request-ID"))
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+		if failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	ctx := WithCostCenter(WithRequestID(context.Background(), "req-1"), "search")
+
+	failures = 1
+	req, _ := http.NewRequest("PUT", server.URL, strings.NewReader("body"))
+	resp, err := app_ctx.HTTPClient().Do(req.WithContext(ctx))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected a retry to succeed, got %d", resp.StatusCode)
+	}
+	if len(request_ids) != 2 || request_ids[0] != "req-1" || request_ids[1] != "req-1" {
+		t.Errorf("Request ID not propagated on every attempt: %v", request_ids)
+	}
+	if bodies[1] != "body" {
+		t.Errorf("Body not replayed on retry: %v", bodies)
+	}
+	if req.Header.Get("X-Request-ID") != "" {
+		t.Error("The caller's request was modified")
+	}
+	if n := mcli.count("http_client.retries"); n != 1 {
+		t.Errorf("Expected 1 retry, got %d", n)
+	}
+	if n := mcli.count("http_client.requests"); n != 2 {
+		t.Errorf("Expected 2 requests counted, got %d", n)
+	}
+	if tags := mcli.tags["http_client.requests"]; tags["cost_center"] != "search" || tags["method"] != "PUT" {
+		t.Errorf("Unexpected http_client.requests tags: %v", tags)
+	}
+
+	failures = 1
+	resp, err = app_ctx.HTTPClient().Post(server.URL, "text/plain", strings.NewReader("x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("POST shouldn't be retried, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,121 @@
+package app_context
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/comstud/go-rollbar/rollbar"
+)
+
+// scrubbedHeaders aren't sent to rollbar with a request, whatever
+// ROLLBAR_SCRUB_FIELDS says
+var scrubbedHeaders = map[string]bool{
+	"Authorization":       true,
+	"Cookie":              true,
+	"Proxy-Authorization": true,
+	"Set-Cookie":          true,
+	"X-Api-Key":           true,
+}
+
+// notifierRequest is what rollbar is told about r
+func (self *baseAppContext) notifierRequest(r *http.Request) *rollbar.NotifierRequest {
+	headers := make(map[string]string, len(r.Header))
+	for name, vals := range r.Header {
+		if self.rollbarPayload.scrubbed(name) {
+			headers[name] = "[scrubbed]"
+			continue
+		}
+		headers[name] = strings.Join(vals, ", ")
+	}
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+
+	user_ip := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		user_ip = host
+	}
+
+	return &rollbar.NotifierRequest{
+		URL:         scheme + "://" + r.Host + r.URL.Path,
+		Method:      r.Method,
+		Headers:     headers,
+		QueryString: self.scrubQuery(r.URL.RawQuery),
+		UserIP:      user_ip,
+	}
+}
+
+// HTTPMiddleware returns middleware for handlers: RequestMiddleware's
+// request IDs and metrics, plus an access log line for every request
+// (unless ACCESS_LOG_DISABLE=true) and recovering panics. A panic is
+// answered like WriteHTTPError: with the AppError it panicked with, if
+// any, or a 500 that's logged and reported to rollbar with the request.
+func (self *baseAppContext) HTTPMiddleware() func(http.Handler) http.Handler {
+	return httpMiddleware(self, self)
+}
+
+func (self *childAppContext) HTTPMiddleware() func(http.Handler) http.Handler {
+	return httpMiddleware(self.baseAppContext, self)
+}
+
+func httpMiddleware(base *baseAppContext, appctx AppContext) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// Same request ID as the one RequestMiddleware made
+			reqctx := appctx.ForRequest(r)
+			ctx := reqctx.Context()
+			rec := &statusRecorder{ResponseWriter: w}
+			start := time.Now()
+
+			done := base.golden.startRequest()
+			defer func() {
+				streamed := rec.status == http.StatusSwitchingProtocols || rec.Header().Get("Content-Type") == "text/event-stream"
+				done(rec.status, streamed)
+			}()
+			defer func() {
+				if p := recover(); p != nil {
+					if p == http.ErrAbortHandler {
+						panic(p)
+					}
+					err := &panicError{method: r.Method, path: r.URL.Path, value: p}
+					if rec.status == 0 {
+						writeHTTPError(base, reqctx, rec, err)
+					} else {
+						// Too late to change the response, but still
+						// worth knowing about
+						reqctx.ReportError(err, nil)
+					}
+				}
+
+				if rec.status == 0 {
+					rec.status = http.StatusOK
+				}
+				if !base.accessLogDisabled {
+					elapsed := time.Since(start)
+					reqctx.WithFields(map[string]interface{}{
+						"status":      rec.status,
+						"duration_ms": float64(elapsed) / float64(time.Millisecond),
+					}).Logger().LogInfof(ctx, "%s %s %d %s", r.Method, r.URL.RequestURI(), rec.status, elapsed)
+				}
+			}()
+
+			next.ServeHTTP(rec, reqctx.Request())
+		})
+		return requestMiddleware(base, appctx, inner)
+	}
+}
+
+func (self *baseAppContext) setHTTPMiddlewareFromEnv() error {
+	disabled, err := self.isDisabled("ACCESS_LOG")
+	if err != nil {
+		return err
+	}
+	self.accessLogDisabled = disabled
+
+	self.httpErrorDetails, _, err = self.getBoolFromEnv("HTTP_ERROR_DETAILS")
+	return err
+}
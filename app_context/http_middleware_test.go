@@ -0,0 +1,170 @@
+package app_context
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/comstud/go-rollbar/rollbar"
+)
+
+func TestHTTPMiddleware(t *testing.T) {
+	app_ctx, err := NewAppContext("http_middleware_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer app_ctx.Close()
+
+	mcli := newCountingMetricsClient()
+	app_ctx.SetMetricsClient(mcli)
+	rcli := &capturingRollbarClient{Client: rollbar.NewNOOPClient()}
+	app_ctx.SetRollbarClient(rcli)
+	app_ctx.(*baseAppContext).rollbarEnabled = true
+
+	handler := app_ctx.HTTPMiddleware()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/panic" {
+			panic("boom")
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/ok", nil))
+	if w.Code != http.StatusAccepted {
+		t.Errorf("Expected 202, got %d", w.Code)
+	}
+	if len(rcli.notifs) != 0 {
+		t.Errorf("Nothing should be reported without a panic, got %d", len(rcli.notifs))
+	}
+
+	req := httptest.NewRequest("POST", "/panic?q=1", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("Expected a panic to be a 500, got %d", w.Code)
+	}
+	if w.Header().Get("X-Request-ID") == "" {
+		t.Error("Missing request ID header")
+	}
+	if tags := mcli.tags["request.count"]; tags["status"] != "500" {
+		t.Errorf("Panic wasn't recorded as a 500: %+v", tags)
+	}
+	if mcli.count("request.count") != 2 {
+		t.Errorf("Expected 2 requests counted, got %d", mcli.count("request.count"))
+	}
+
+	if len(rcli.notifs) != 1 {
+		t.Fatalf("Expected the panic to be reported, got %d notifications", len(rcli.notifs))
+	}
+	notif_req := rcli.notifs[0].GetRequest()
+	if notif_req == nil || notif_req.Method != "POST" || notif_req.QueryString != "q=1" {
+		t.Fatalf("Request missing from the report: %+v", notif_req)
+	}
+	if auth := notif_req.Headers["Authorization"]; auth != "[scrubbed]" {
+		t.Errorf("Authorization header wasn't scrubbed: %s", auth)
+	}
+	if custom := rcli.notifs[0].GetCustom(); custom["request_id"] != w.Header().Get("X-Request-ID") {
+		t.Errorf("Report should have the request ID: %+v", custom)
+	}
+}
+
+func TestHTTPMiddlewareAbort(t *testing.T) {
+	app_ctx, err := NewAppContext("http_middleware_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer app_ctx.Close()
+
+	handler := app_ctx.HTTPMiddleware()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic(http.ErrAbortHandler)
+	}))
+
+	defer func() {
+		if r := recover(); r != http.ErrAbortHandler {
+			t.Errorf("Expected ErrAbortHandler to be re-panicked, got %v", r)
+		}
+	}()
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+}
+
+func decodeErrorResponse(t *testing.T, w *httptest.ResponseRecorder) errorBody {
+	t.Helper()
+	var resp errorResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("Error response isn't JSON: %s", err)
+	}
+	return resp.Error
+}
+
+func TestHTTPMiddlewareAppError(t *testing.T) {
+	errNotFound := NewAppError(http.StatusNotFound, "not_found", "Order not found")
+
+	for _, details := range []bool{true, false} {
+		if !details {
+			os.Setenv("HTTP_ERROR_DETAILS", "false")
+		}
+		app_ctx, err := NewAppContext("http_middleware_test")
+		os.Unsetenv("HTTP_ERROR_DETAILS")
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer app_ctx.Close()
+
+		rcli := &capturingRollbarClient{Client: rollbar.NewNOOPClient()}
+		app_ctx.SetRollbarClient(rcli)
+		app_ctx.(*baseAppContext).rollbarEnabled = true
+
+		handler := app_ctx.HTTPMiddleware()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/missing":
+				panic(errNotFound.Wrap(errors.New("sql: no rows in result set")))
+			case "/write":
+				app_ctx.WriteHTTPError(w, r, errors.New("connection refused"))
+			default:
+				panic("boom")
+			}
+		}))
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/missing", nil))
+		body := decodeErrorResponse(t, w)
+		if w.Code != http.StatusNotFound || body.Code != "not_found" || body.Message != "Order not found" {
+			t.Errorf("Unexpected response %d: %+v", w.Code, body)
+		}
+		if body.RequestID == "" || body.RequestID != w.Header().Get("X-Request-ID") {
+			t.Errorf("Response should have the request ID: %+v", body)
+		}
+		if has := strings.Contains(body.Detail, "no rows"); has != details {
+			t.Errorf("With HTTP_ERROR_DETAILS=%v, got detail '%s'", details, body.Detail)
+		}
+		if len(rcli.notifs) != 0 {
+			t.Errorf("Client errors shouldn't be reported, got %d", len(rcli.notifs))
+		}
+
+		w = httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/panic", nil))
+		body = decodeErrorResponse(t, w)
+		if w.Code != http.StatusInternalServerError || body.Code != "internal_error" || body.Message != "Internal server error" {
+			t.Errorf("Unexpected response %d: %+v", w.Code, body)
+		}
+		if has := strings.Contains(body.Detail, "boom"); has != details {
+			t.Errorf("With HTTP_ERROR_DETAILS=%v, got detail '%s'", details, body.Detail)
+		}
+
+		w = httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/write", nil))
+		if body = decodeErrorResponse(t, w); w.Code != http.StatusInternalServerError || body.Code != "internal_error" {
+			t.Errorf("Unexpected response %d: %+v", w.Code, body)
+		}
+		if len(rcli.notifs) != 2 {
+			t.Errorf("Expected both server errors to be reported, got %d", len(rcli.notifs))
+		}
+	}
+}
@@ -0,0 +1,256 @@
+package app_context
+
+import (
+	crypto_rand "crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math/rand"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// IDGenerator makes IDs that sort by when they were made. Request, saga
+// and other IDs the package generates come from NewID.
+type IDGenerator interface {
+	// NewID returns an ID in the ID_FORMAT format
+	NewID() string
+	UUIDv7() string
+	ULID() string
+}
+
+const (
+	IDFormatUUIDv7 = "uuidv7"
+	IDFormatULID   = "ulid"
+	// IDFormatHex is 32 random hex digits, the old request ID format
+	IDFormatHex = "hex"
+)
+
+// idGenerator keeps the 80 random bits after the timestamp and increments
+// them for IDs made in the same millisecond, so they still sort in order
+type idGenerator struct {
+	format  string
+	now     func() time.Time
+	lock    sync.Mutex
+	entropy io.Reader
+	lastMS  int64
+	random  [10]byte
+}
+
+// NewIDGenerator returns a generator whose NewID uses format, reading the
+// time from clock and randomness from entropy (crypto/rand if nil). A
+// FakeClock and a seeded math/rand make the IDs deterministic.
+func NewIDGenerator(format string, clock Clock, entropy io.Reader) (IDGenerator, error) {
+	switch format {
+	case IDFormatUUIDv7, IDFormatULID, IDFormatHex:
+	default:
+		return nil, fmt.Errorf("Unknown ID format '%s'", format)
+	}
+	if clock == nil {
+		clock = NewRealClock()
+	}
+	if entropy == nil {
+		entropy = crypto_rand.Reader
+	}
+	return &idGenerator{format: format, now: clock.Now, entropy: entropy}, nil
+}
+
+// next returns the millisecond timestamp and random bits for a new ID
+func (self *idGenerator) next() (int64, [10]byte) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	ms := self.now().UnixNano() / int64(time.Millisecond)
+	if ms <= self.lastMS {
+		ms = self.lastMS
+		for i := len(self.random) - 1; i >= 0; i-- {
+			self.random[i]++
+			if self.random[i] != 0 {
+				return ms, self.random
+			}
+		}
+		// Wrapped around; overflowing into the timestamp keeps the order
+		ms++
+	}
+
+	if _, err := io.ReadFull(self.entropy, self.random[:]); err != nil {
+		// Only if the system's randomness fails; still unique enough
+		// within this process
+		binary.BigEndian.PutUint64(self.random[2:], uint64(time.Now().UnixNano()))
+	}
+	// Leave room to increment before carrying into the bits UUIDv7 drops
+	self.random[0] &= 0x0f
+	self.random[2] &= 0x3f
+	self.lastMS = ms
+	return ms, self.random
+}
+
+// UUIDv7 is RFC 9562's time ordered UUID
+func (self *idGenerator) UUIDv7() string {
+	ms, random := self.next()
+
+	var b [16]byte
+	b[0] = byte(ms >> 40)
+	b[1] = byte(ms >> 32)
+	b[2] = byte(ms >> 24)
+	b[3] = byte(ms >> 16)
+	b[4] = byte(ms >> 8)
+	b[5] = byte(ms)
+	b[6] = 0x70 | random[0]&0x0f
+	b[7] = random[1]
+	b[8] = 0x80 | random[2]&0x3f
+	copy(b[9:], random[3:])
+
+	s := hex.EncodeToString(b[:])
+	return s[0:8] + "-" + s[8:12] + "-" + s[12:16] + "-" + s[16:20] + "-" + s[20:]
+}
+
+const crockfordBase32 = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// ULID is 26 characters of Crockford base32: a 48 bit millisecond
+// timestamp, then 80 random bits
+func (self *idGenerator) ULID() string {
+	ms, random := self.next()
+
+	var b [16]byte
+	b[0] = byte(ms >> 40)
+	b[1] = byte(ms >> 32)
+	b[2] = byte(ms >> 24)
+	b[3] = byte(ms >> 16)
+	b[4] = byte(ms >> 8)
+	b[5] = byte(ms)
+	copy(b[6:], random[:])
+
+	// 26 characters are 130 bits, so the first only holds 3
+	out := make([]byte, 26)
+	for i := range out {
+		bit := i*5 - 2
+		var v int
+		for j := 0; j < 5; j++ {
+			v <<= 1
+			if pos := bit + j; pos >= 0 && b[pos/8]&(0x80>>uint(pos%8)) != 0 {
+				v |= 1
+			}
+		}
+		out[i] = crockfordBase32[v]
+	}
+	return string(out)
+}
+
+func (self *idGenerator) hex() string {
+	b := make([]byte, 16)
+	self.lock.Lock()
+	_, err := io.ReadFull(self.entropy, b)
+	self.lock.Unlock()
+	if err != nil {
+		return newRequestID()
+	}
+	return hex.EncodeToString(b)
+}
+
+func (self *idGenerator) NewID() string {
+	switch self.format {
+	case IDFormatULID:
+		return self.ULID()
+	case IDFormatHex:
+		return self.hex()
+	}
+	return self.UUIDv7()
+}
+
+// lockedSource makes a math/rand source safe to share
+type lockedSource struct {
+	lock sync.Mutex
+	src  rand.Source64
+}
+
+func (self *lockedSource) Int63() int64 {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.src.Int63()
+}
+
+func (self *lockedSource) Uint64() uint64 {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.src.Uint64()
+}
+
+func (self *lockedSource) Seed(seed int64) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.src.Seed(seed)
+}
+
+func newLockedRand(seed int64) *rand.Rand {
+	return rand.New(&lockedSource{src: rand.NewSource(seed).(rand.Source64)})
+}
+
+func (self *baseAppContext) IDGenerator() IDGenerator {
+	self.componentsLock.RLock()
+	defer self.componentsLock.RUnlock()
+	return self.idGenerator
+}
+
+func (self *baseAppContext) SetIDGenerator(gen IDGenerator) AppContext {
+	self.componentsLock.Lock()
+	defer self.componentsLock.Unlock()
+	self.idGenerator = gen
+	return self
+}
+
+// Rand is for jitter, sampling and the like, not secrets. It's safe to
+// share except for Read, which needs its own *rand.Rand.
+func (self *baseAppContext) Rand() *rand.Rand {
+	self.componentsLock.RLock()
+	defer self.componentsLock.RUnlock()
+	return self.random
+}
+
+// ID_FORMAT picks what IDGenerator().NewID returns: uuidv7 (default), ulid
+// or hex. RANDOM_SEED (or WithRandomSeed) seeds Rand and the IDs' random
+// bits, so with a FakeClock a test sees the same IDs, jitter and restart
+// delays every run. It's refused outside testing and development, where
+// IDs would repeat across instances.
+func (self *baseAppContext) setIDsFromEnv() error {
+	format := self.getEnv("ID_FORMAT")
+	if format == "" {
+		format = IDFormatUUIDv7
+	}
+
+	var entropy io.Reader
+	var seed int64
+	if seed_val := self.getEnv("RANDOM_SEED"); seed_val != "" {
+		if self.tiltEnv != "testing" && self.tiltEnv != "development" {
+			return fmt.Errorf("RANDOM_SEED can't be set in %s", self.tiltEnv)
+		}
+		var err error
+		if seed, err = strconv.ParseInt(seed_val, 10, 64); err != nil {
+			return fmt.Errorf("Invalid RANDOM_SEED '%s'", seed_val)
+		}
+		entropy = rand.New(rand.NewSource(seed))
+	} else if self.randomSeed != nil {
+		seed = *self.randomSeed
+		entropy = rand.New(rand.NewSource(seed))
+	} else {
+		var b [8]byte
+		if _, err := crypto_rand.Read(b[:]); err != nil {
+			return fmt.Errorf("Error seeding random numbers: %s", err)
+		}
+		seed = int64(binary.BigEndian.Uint64(b[:]))
+	}
+
+	gen, err := NewIDGenerator(format, self.Clock(), entropy)
+	if err != nil {
+		return fmt.Errorf("Invalid ID_FORMAT: %s", err)
+	}
+	// Follow SetClock rather than keeping the clock at startup
+	gen.(*idGenerator).now = self.now
+
+	self.idGenerator = gen
+	self.random = newLockedRand(seed)
+
+	return nil
+}
@@ -0,0 +1,110 @@
+package app_context
+
+import (
+	"log"
+	"math/rand"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+var uuidv7Re = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-7[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+
+func TestIDGenerator(t *testing.T) {
+	// The ULID spec's example timestamp
+	clock := NewFakeClock(time.Unix(0, 1469918176385*int64(time.Millisecond)))
+	gen, err := NewIDGenerator(IDFormatULID, clock, rand.New(rand.NewSource(1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ulid := gen.ULID()
+	if len(ulid) != 26 || ulid[:10] != "01ARYZ6S41" {
+		t.Errorf("Unexpected ULID: %s", ulid)
+	}
+	if id := gen.UUIDv7(); !uuidv7Re.MatchString(id) {
+		t.Errorf("Unexpected UUIDv7: %s", id)
+	}
+
+	// IDs in the same millisecond, or after the clock goes backwards,
+	// still sort in order
+	ids := make([]string, 0, 100)
+	for i := 0; i < 100; i++ {
+		if i == 50 {
+			clock.Set(clock.Now().Add(-time.Second))
+		}
+		ids = append(ids, gen.NewID())
+	}
+	if !sort.StringsAreSorted(ids) {
+		t.Errorf("Expected IDs in order: %v", ids)
+	}
+
+	// The same seed and clock give the same IDs
+	other, _ := NewIDGenerator(IDFormatULID, NewFakeClock(time.Unix(0, 1469918176385*int64(time.Millisecond))), rand.New(rand.NewSource(1)))
+	if id := other.ULID(); id != ulid {
+		t.Errorf("Expected %s from the same seed, got %s", ulid, id)
+	}
+
+	if _, err := NewIDGenerator("snowflake", nil, nil); err == nil {
+		t.Error("Expected an unknown format to fail")
+	}
+}
+
+func TestIDsFromEnv(t *testing.T) {
+	os.Setenv("RANDOM_SEED", "42")
+	defer os.Unsetenv("RANDOM_SEED")
+
+	app_ctx, err := NewAppContext("ids_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer app_ctx.Close()
+
+	if id := app_ctx.ForRequest(httptest.NewRequest("GET", "/", nil)).RequestID(); !uuidv7Re.MatchString(id) {
+		t.Errorf("Expected a UUIDv7 request ID, got %s", id)
+	}
+
+	other, err := NewAppContext("ids_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer other.Close()
+	if app_ctx.Rand().Int63() != other.Rand().Int63() {
+		t.Error("Expected RANDOM_SEED to make Rand deterministic")
+	}
+
+	os.Setenv("ID_FORMAT", "hex")
+	hex_ctx, err := NewAppContext("ids_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer hex_ctx.Close()
+	if id := hex_ctx.IDGenerator().NewID(); len(id) != 32 {
+		t.Errorf("Expected a hex ID, got %s", id)
+	}
+
+	os.Setenv("ID_FORMAT", "bogus")
+	if _, err := NewAppContext("ids_test"); err == nil {
+		t.Error("Expected an invalid ID_FORMAT to fail")
+	}
+	os.Unsetenv("ID_FORMAT")
+}
+
+func TestRandomSeedInProduction(t *testing.T) {
+	os.Setenv("RANDOM_SEED", "42")
+	os.Setenv("TILT_ENVIRONMENT", "production")
+	defer os.Unsetenv("RANDOM_SEED")
+	defer os.Unsetenv("TILT_ENVIRONMENT")
+
+	app_ctx, err := NewAppContext("ids_test")
+	if err == nil {
+		app_ctx.Close()
+	}
+	if err == nil || !strings.Contains(err.Error(), "RANDOM_SEED can't be set in production") {
+		t.Errorf("Expected RANDOM_SEED to be refused in production, got %v", err)
+	}
+}
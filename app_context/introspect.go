@@ -0,0 +1,492 @@
+package app_context
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// SubsystemInfo describes what a subsystem is wired to. Source says where
+// its main setting came from: env, dotenv, config_file, profile, disabled
+// or default.
+type SubsystemInfo struct {
+	Name         string                 `json:"name"`
+	Type         string                 `json:"type"`
+	NOOP         bool                   `json:"noop"`
+	Source       string                 `json:"source"`
+	InitDuration float64                `json:"init_duration_ms"`
+	Health       *HealthResult          `json:"health,omitempty"`
+	Details      map[string]interface{} `json:"details,omitempty"`
+}
+
+// timeInit runs one setup step of NewAppContext, recording how long it took
+func (self *baseAppContext) timeInit(name string, fn func() error) error {
+	start := time.Now()
+	err := fn()
+	self.initDurations[name] = time.Since(start)
+	self.initOrder = append(self.initOrder, name)
+	if err != nil {
+		self.initFailed = name
+	}
+	return err
+}
+
+func (self *baseAppContext) envSource(name string) string {
+	if _, _, found := self.osLookupEnv(name); found {
+		return "env"
+	}
+	if _, found := self.dotEnvLookup(name); found {
+		return "dotenv"
+	}
+	if _, found := self.remoteConfig.get(name); found {
+		return "remote_config"
+	}
+	if _, found := self.configFile[name]; found {
+		return "config_file"
+	}
+	if _, found := self.profile[name]; found {
+		return "profile"
+	}
+	return "default"
+}
+
+// subsystemSource is the source of the first of names that is set, or
+// "disabled" if <disable_prefix>_DISABLE=true.
+func (self *baseAppContext) subsystemSource(disable_prefix string, names ...string) string {
+	if disable_prefix != "" {
+		if disabled, _ := self.isDisabled(disable_prefix); disabled {
+			return "disabled"
+		}
+	}
+	for _, name := range names {
+		if source := self.envSource(name); source != "default" {
+			return source
+		}
+	}
+	return "default"
+}
+
+func typeName(v interface{}) string {
+	if v == nil {
+		return ""
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+func (self *baseAppContext) describeSubsystems() []*SubsystemInfo {
+	_, noop_bus := self.MessageBus().(*noopMessageBus)
+
+	self.componentsLock.RLock()
+	cache := self.cache
+	self.componentsLock.RUnlock()
+	_, noop_cache := cache.(*noopCache)
+	_, noop_objects := self.ObjectStore().(*noopObjectStore)
+
+	self.admission.lock.Lock()
+	max_concurrent := self.admission.maxConcurrent
+	self.admission.lock.Unlock()
+
+	subsystems := []*SubsystemInfo{
+		{
+			Name:   "logger",
+			Type:   typeName(self.Logger().BaseLogger()),
+			Source: self.subsystemSource("", "LOG_FORMAT", "LOG_LEVEL"),
+			Details: map[string]interface{}{
+				"level": self.LogLevel().String(),
+			},
+		},
+		{
+			Name:   "metrics",
+			Type:   typeName(self.MetricsClient()),
+			NOOP:   !self.metricsEnabled,
+			Source: self.subsystemSource("METRICS", "METRICS_ADDR"),
+			Details: map[string]interface{}{
+				"addr":      self.MetricsClient().GetAddr(),
+				"namespace": self.MetricsClient().GetNamespace(),
+			},
+		},
+		{
+			Name:    "rollbar",
+			Type:    typeName(self.RollbarClient()),
+			NOOP:    !self.rollbarEnabled,
+			Source:  self.subsystemSource("ROLLBAR", "ROLLBAR_API_KEY"),
+			Details: self.rollbarPayload.status(),
+		},
+		{
+			Name:   "kafka",
+			Type:   typeName(self.kafkaProducer),
+			NOOP:   !self.kafkaEnabled,
+			Source: self.subsystemSource("KAFKA", "KAFKA_BROKERS"),
+		},
+		{
+			Name:    "audit",
+			Type:    typeName(self.auditLogger.sink),
+			NOOP:    self.auditLogger.sink.name() == "noop",
+			Source:  self.subsystemSource("", "AUDIT_OUTPUT"),
+			Details: self.auditLogger.status(),
+		},
+		{
+			Name:   "message_bus",
+			Type:   typeName(self.MessageBus()),
+			NOOP:   noop_bus,
+			Source: self.subsystemSource("NATS", "NATS_URL"),
+		},
+		{
+			Name:   "cache",
+			Type:   typeName(cache),
+			NOOP:   noop_cache,
+			Source: self.subsystemSource("", "CACHE_BACKEND"),
+		},
+		{
+			Name:   "object_store",
+			Type:   typeName(self.ObjectStore()),
+			NOOP:   noop_objects,
+			Source: self.subsystemSource("", "OBJECT_STORE_URL"),
+		},
+		{
+			Name:   "mailer",
+			Type:   typeName(self.mailer.transport),
+			NOOP:   self.mailer.transport.name() == "noop",
+			Source: self.subsystemSource("", "SMTP_URL", "SENDGRID_API_KEY", "SES_REGION"),
+		},
+		{
+			Name:   "cdc",
+			Type:   typeName(self.cdc),
+			NOOP:   self.cdc.source == "",
+			Source: self.subsystemSource("", "CDC_SOURCE", "REPLICATION_SLOT"),
+			Details: map[string]interface{}{
+				"status": self.cdc.Status(),
+			},
+		},
+		{
+			Name:   "admission",
+			Type:   typeName(self.admission),
+			NOOP:   max_concurrent <= 0,
+			Source: self.subsystemSource("", "ADMISSION_MAX_CONCURRENCY"),
+			Details: map[string]interface{}{
+				"in_flight": self.admission.InFlight(),
+			},
+		},
+		{
+			Name:   "synthetic_checks",
+			Type:   typeName(self.syntheticChecks),
+			Source: "code",
+			Details: map[string]interface{}{
+				"checks": len(self.syntheticChecks.Results()),
+			},
+		},
+		{
+			Name:   "traffic_role",
+			Type:   typeName(self.trafficRole),
+			Source: self.subsystemSource("", "TRAFFIC_ROLE_FILE", "TRAFFIC_ROLE_URL", "TRAFFIC_ROLE"),
+			Details: map[string]interface{}{
+				"role":   self.TrafficRole(),
+				"polled": self.trafficRole.source,
+			},
+		},
+		{
+			Name:    "remote_config",
+			Type:    typeName(self.remoteConfig),
+			NOOP:    self.remoteConfig.fetch == nil,
+			Source:  self.subsystemSource("", "REMOTE_CONFIG_URL"),
+			Details: self.remoteConfig.status(),
+		},
+		{
+			Name:    "auth_keys",
+			Type:    typeName(self.authKeys),
+			NOOP:    self.authKeys.signer == nil && len(self.authKeys.local) == 0 && self.authKeys.jwksURL == "",
+			Source:  self.subsystemSource("", "JWT_PRIVATE_KEY_PATH", "JWT_PRIVATE_KEY", "JWT_PUBLIC_KEY_PATHS", "JWKS_URL"),
+			Details: self.authKeys.status(),
+		},
+		{
+			Name:   "tunables",
+			Type:   typeName(self.tunables),
+			NOOP:   self.tunables.read == nil,
+			Source: self.subsystemSource("", "APPCTX_S3_TUNABLES", "TUNABLES_FILE"),
+			Details: map[string]interface{}{
+				"active": self.tunables.Active(),
+				"params": self.tunables.Params(),
+			},
+		},
+		{
+			Name:   "circuit_breakers",
+			Type:   typeName(self.circuitBreakers),
+			Source: self.subsystemSource("", "CIRCUIT_BREAKER_FAILURES", "CIRCUIT_BREAKER_OPEN_TIMEOUT"),
+			Details: map[string]interface{}{
+				"breakers": self.circuitBreakers.Status(),
+			},
+		},
+		{
+			Name: "services",
+			Type: typeName(self.services),
+			Details: map[string]interface{}{
+				"services": self.services.Status(),
+			},
+		},
+		{
+			Name:   "crypto",
+			Type:   typeName(self.crypto),
+			NOOP:   self.crypto.KeyVersion() == 0,
+			Source: self.subsystemSource("", "CRYPTO_KEYS", "CRYPTO_KEY_PROVIDER"),
+			Details: map[string]interface{}{
+				"key_version": self.crypto.KeyVersion(),
+				"versions":    self.crypto.(*aeadCrypto).versions(),
+			},
+		},
+		{
+			Name:   "tls",
+			Type:   typeName(self.tlsConfigs),
+			Source: self.subsystemSource("", "TLS_CERT_FILE", "TLS_CA_FILE"),
+			Details: map[string]interface{}{
+				"certs": self.tlsConfigs.Status(),
+			},
+		},
+		{
+			Name:   "json_schemas",
+			Type:   typeName(self.schemaRegistry),
+			NOOP:   len(self.schemaRegistry.schemas) == 0,
+			Source: self.subsystemSource("", "JSON_SCHEMA_FILEPATH"),
+			Details: map[string]interface{}{
+				"path":    self.jsonSchemaFilePath,
+				"schemas": self.schemaRegistry.Names(),
+			},
+		},
+		{
+			Name:   "rate_limits",
+			Type:   typeName(self.rateLimiters),
+			Source: self.subsystemSource("", "RATE_LIMIT_REDIS_URL"),
+			Details: map[string]interface{}{
+				"limiters": self.rateLimiters.Status(),
+			},
+		},
+		{
+			Name:    "lifecycle_metrics",
+			Type:    typeName(self.lifecycle),
+			NOOP:    self.lifecycle == nil,
+			Source:  self.subsystemSource("LIFECYCLE_METRICS", "LIFECYCLE_HEARTBEAT_INTERVAL"),
+			Details: self.lifecycle.status(),
+		},
+		{
+			Name:   "watchdog",
+			Type:   typeName(self.watchdog),
+			Source: self.subsystemSource("", "WATCHDOG_TIMEOUT"),
+			Details: map[string]interface{}{
+				"components": self.watchdog.Status(),
+			},
+		},
+		{
+			Name:   "workers",
+			Type:   typeName(self.workers),
+			Source: "code",
+			Details: map[string]interface{}{
+				"workers": self.workers.Status(),
+			},
+		},
+		{
+			Name:   "scheduler",
+			Type:   typeName(self.scheduler),
+			Source: "code",
+			Details: map[string]interface{}{
+				"jobs": self.scheduler.Jobs(),
+			},
+		},
+		{
+			Name:    "templates",
+			Type:    typeName(self.templates),
+			Source:  self.subsystemSource("", "TEMPLATE_PATH", "TEMPLATE_RELOAD"),
+			Details: self.templates.status(),
+		},
+		{
+			Name:    "localizer",
+			Type:    typeName(self.localizer),
+			Source:  self.subsystemSource("", "LOCALE_PATH", "LOCALE_DEFAULT"),
+			Details: self.localizer.status(),
+		},
+		{
+			Name:    "consumers",
+			Type:    typeName(self.consumers),
+			Source:  self.subsystemSource("", "CONSUMER_PAUSE_POLL_INTERVAL"),
+			Details: self.consumers.status(),
+		},
+		{
+			Name:    "scaling_signals",
+			Type:    typeName(self.scaling),
+			Source:  self.subsystemSource("", "SCALING_SIGNALS_INTERVAL"),
+			Details: self.scaling.status(),
+		},
+		{
+			Name:    "locks",
+			Type:    typeName(self.locks),
+			Source:  self.subsystemSource("", "LOCK_BACKEND", "LOCK_REDIS_URL"),
+			Details: self.locks.status(),
+		},
+		{
+			Name:    "leader_election",
+			Type:    typeName(self.leaderElection),
+			NOOP:    !self.leaderElection.enabled,
+			Source:  self.subsystemSource("", "LEADER_ELECTION", "LEADER_ELECTION_NAME", "LEADER_ELECTION_TTL"),
+			Details: self.leaderElection.status(),
+		},
+		{
+			Name:    "datasets",
+			Type:    typeName(self.datasets),
+			Source:  self.subsystemSource("", "DATA_EXPORT_PREFIX", "DATA_IMPORT_BATCH_SIZE"),
+			Details: self.datasets.status(),
+		},
+		{
+			Name:    "data_sampler",
+			Type:    typeName(self.sampler),
+			Source:  self.subsystemSource("", "DATA_SAMPLE_PREFIX", "DATA_SAMPLE_SECRET"),
+			Details: self.sampler.status(),
+		},
+		{
+			Name:    "outbox",
+			Type:    typeName(self.outbox),
+			Source:  self.subsystemSource("", "OUTBOX_RELAY", "OUTBOX_POLL_INTERVAL", "OUTBOX_BATCH_SIZE", "OUTBOX_MAX_ATTEMPTS"),
+			Details: self.outbox.status(),
+		},
+		{
+			Name:    "golden_signals",
+			Type:    typeName(self.golden),
+			NOOP:    self.golden.interval == 0,
+			Source:  self.subsystemSource("", "GOLDEN_SIGNALS_INTERVAL", "APDEX_THRESHOLD"),
+			Details: self.golden.status(),
+		},
+		{
+			Name:    "jobs",
+			Type:    typeName(self.jobs),
+			Source:  self.subsystemSource("", "JOBS_BACKEND", "JOBS_REDIS_URL", "JOBS_CONCURRENCY", "JOBS_MAX_ATTEMPTS", "JOBS_RETRY_BACKOFF"),
+			Details: self.jobs.status(),
+		},
+		{
+			Name:    "websockets",
+			Type:    typeName(self.webSockets),
+			Source:  self.subsystemSource("", "WEBSOCKET_ALLOWED_ORIGINS", "WEBSOCKET_MAX_CONNECTIONS", "WEBSOCKET_MAX_MESSAGE_SIZE", "WEBSOCKET_SEND_BUFFER", "WEBSOCKET_PING_INTERVAL"),
+			Details: self.webSockets.status(),
+		},
+		{
+			Name:    "sse",
+			Type:    typeName(self.sse),
+			Source:  self.subsystemSource("", "SSE_HEARTBEAT_INTERVAL", "SSE_BUFFER"),
+			Details: self.sse.status(),
+		},
+		{
+			Name:    "graphql",
+			Type:    typeName(self.graphql),
+			Source:  self.subsystemSource("", "GRAPHQL_PERSISTED_QUERIES_ONLY", "GRAPHQL_PERSISTED_QUERY_TTL", "GRAPHQL_MAX_QUERY_SIZE", "GRAPHQL_SLOW_THRESHOLD"),
+			Details: self.graphql.status(),
+		},
+		{
+			Name:    "openapi",
+			Type:    typeName(self.openAPI),
+			NOOP:    self.openAPI.spec == nil,
+			Source:  self.subsystemSource("", "OPENAPI_SPEC_PATH", "JSON_SCHEMA_FILEPATH", "OPENAPI_VALIDATE_REQUESTS", "OPENAPI_VALIDATE_RESPONSES", "OPENAPI_SERVE_SPEC"),
+			Details: self.openAPI.status(),
+		},
+		{
+			Name:    "notification_templates",
+			Type:    typeName(self.notifyTemplates),
+			Source:  self.subsystemSource("", "NOTIFICATION_TEMPLATE_PATH", "NOTIFICATION_TEMPLATE_DB"),
+			Details: self.notifyTemplates.status(),
+		},
+		{
+			Name:    "suppressions",
+			Type:    typeName(self.suppressions),
+			Source:  self.subsystemSource("", "SUPPRESSION_BACKEND"),
+			Details: self.suppressions.status(),
+		},
+		{
+			Name:    "service_discovery",
+			Type:    typeName(self.serviceDiscovery),
+			NOOP:    self.serviceDiscovery == nil,
+			Source:  self.subsystemSource("", "SERVICE_DISCOVERY_URL"),
+			Details: self.serviceDiscovery.status(),
+		},
+		{
+			Name:    "checkpoints",
+			Type:    typeName(self.checkpoints),
+			Source:  self.subsystemSource("", "CHECKPOINT_DIR", "CHECKPOINT_STALENESS_INTERVAL"),
+			Details: self.checkpoints.status(),
+		},
+	}
+
+	db_info := &SubsystemInfo{
+		Name:   "db",
+		NOOP:   true,
+		Source: self.subsystemSource("", "DB_DSN"),
+	}
+	if db := self.DB(); db != nil {
+		stats := db.Stats()
+		db_info.Type = typeName(db.Driver())
+		db_info.NOOP = false
+		db_info.Details = map[string]interface{}{
+			"driver":           db.DriverName(),
+			"open_connections": stats.OpenConnections,
+			"in_use":           stats.InUse,
+			"idle":             stats.Idle,
+		}
+	}
+	subsystems = append(subsystems, db_info)
+
+	if self.dbReplica != nil {
+		stats := self.dbReplica.db.Stats()
+		details := map[string]interface{}{
+			"healthy":          self.dbReplica.isHealthy(),
+			"open_connections": stats.OpenConnections,
+			"in_use":           stats.InUse,
+			"idle":             stats.Idle,
+		}
+		if sticky := self.dbReplica.sticky; sticky != nil {
+			details["sticky_window"] = sticky.window.String()
+			details["sticky_field"] = sticky.field
+		}
+		subsystems = append(subsystems, &SubsystemInfo{
+			Name:    "db_replica",
+			Type:    typeName(self.dbReplica.db.Driver()),
+			Source:  self.subsystemSource("", "DB_REPLICA_DSN"),
+			Details: details,
+		})
+	}
+
+	for _, info := range subsystems {
+		info.InitDuration = float64(self.initDurations[info.Name]) / float64(time.Millisecond)
+		if err, ok := self.degraded[info.Name]; ok {
+			info.Source = "degraded"
+			if info.Details == nil {
+				info.Details = make(map[string]interface{})
+			}
+			info.Details["error"] = err
+		}
+	}
+
+	return subsystems
+}
+
+func (self *baseAppContext) introspectionHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		subsystems := self.describeSubsystems()
+
+		health := self.Health().Check(r.Context())
+		for _, info := range subsystems {
+			for _, res := range health {
+				if res.Name == info.Name {
+					info.Health = res
+				}
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"app_name":     self.appName,
+			"hostname":     self.hostname,
+			"kubernetes":   self.kubernetes,
+			"environment":  self.tiltEnv,
+			"code_version": self.codeVersion,
+			"build":        self.buildInfo,
+			"traffic_role": self.TrafficRole(),
+			"subsystems":   subsystems,
+			"health":       health,
+		})
+	})
+}
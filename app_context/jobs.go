@@ -0,0 +1,823 @@
+package app_context
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+var ErrJobNotFound = errors.New("No dead job has that ID")
+
+// QueueJob is a job from the queue, being run. Attempt counts from 1.
+type QueueJob struct {
+	ID          string          `json:"id"`
+	Type        string          `json:"type"`
+	Payload     json.RawMessage `json:"payload"`
+	Attempt     int             `json:"attempt"`
+	MaxAttempts int             `json:"max_attempts"`
+	RunAt       time.Time       `json:"run_at"`
+	EnqueuedAt  time.Time       `json:"enqueued_at"`
+	LastError   string          `json:"last_error,omitempty"`
+}
+
+// Decode unmarshals the job's payload into dest
+func (self *QueueJob) Decode(dest interface{}) error {
+	return json.Unmarshal(self.Payload, dest)
+}
+
+type JobHandler func(ctx context.Context, job *QueueJob) error
+
+type EnqueueOptions struct {
+	// Delay or RunAt put the job off until later
+	Delay time.Duration
+	RunAt time.Time
+	// MaxAttempts defaults to JOBS_MAX_ATTEMPTS
+	MaxAttempts int
+}
+
+// JobQueue runs jobs in the background, on whichever instance gets to them
+// first. A job that fails is tried again after JOBS_RETRY_BACKOFF,
+// doubling each attempt up to an hour, and after its last attempt is kept
+// as a dead letter until it's retried or deleted by hand. Jobs are run at
+// least once: one whose instance dies running it is run again once
+// JOBS_LEASE has passed.
+//
+// Handlers are run by the jobs worker, JOBS_CONCURRENCY at a time, on
+// active instances.
+type JobQueue interface {
+	// Enqueue adds a job of job_type, with payload as JSON, returning its
+	// ID. []byte and json.RawMessage payloads must already be JSON.
+	Enqueue(ctx context.Context, job_type string, payload interface{}, opts EnqueueOptions) (string, error)
+	Handle(job_type string, handler JobHandler) error
+	// DeadLetters are the most recent jobs that used every attempt
+	DeadLetters(ctx context.Context, limit int) ([]*QueueJob, error)
+	// Retry queues a dead job again with all its attempts
+	Retry(ctx context.Context, id string) error
+}
+
+type jobStore interface {
+	enqueue(ctx context.Context, job *QueueJob) error
+	// claim leases the next due job of one of types until lease, and
+	// counts an attempt. It returns nil if there isn't one.
+	claim(ctx context.Context, types []string, now time.Time, lease time.Time) (*QueueJob, error)
+	complete(ctx context.Context, job *QueueJob) error
+	retry(ctx context.Context, job *QueueJob, at time.Time) error
+	bury(ctx context.Context, job *QueueJob, now time.Time) error
+	dead(ctx context.Context, limit int) ([]*QueueJob, error)
+	requeue(ctx context.Context, id string, now time.Time) error
+}
+
+// pgJobStore keeps jobs in the queue_jobs table, created on first use.
+// Finished jobs are deleted; dead ones are kept with state 'dead'.
+type pgJobStore struct {
+	appctx *baseAppContext
+	lock   sync.Mutex
+	ready  bool
+}
+
+func (self *pgJobStore) db(ctx context.Context) (*sql.DB, error) {
+	db := self.appctx.DBWrite()
+	if db == nil {
+		return nil, errors.New("No database is configured")
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if !self.ready {
+		if _, err := db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS queue_jobs (
+			id text NOT NULL PRIMARY KEY,
+			type text NOT NULL,
+			payload jsonb NOT NULL,
+			state text NOT NULL DEFAULT 'queued',
+			attempts integer NOT NULL DEFAULT 0,
+			max_attempts integer NOT NULL,
+			run_at timestamptz NOT NULL,
+			locked_until timestamptz,
+			last_error text,
+			enqueued_at timestamptz NOT NULL,
+			died_at timestamptz
+		)`); err != nil {
+			return nil, fmt.Errorf("Error creating queue_jobs: %s", err)
+		}
+		if _, err := db.ExecContext(
+			ctx,
+			"CREATE INDEX IF NOT EXISTS queue_jobs_due ON queue_jobs (type, run_at) WHERE state = 'queued'",
+		); err != nil {
+			return nil, fmt.Errorf("Error creating queue_jobs index: %s", err)
+		}
+		self.ready = true
+	}
+	return db.DB, nil
+}
+
+func (self *pgJobStore) enqueue(ctx context.Context, job *QueueJob) error {
+	db, err := self.db(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = db.ExecContext(
+		ctx,
+		"INSERT INTO queue_jobs (id, type, payload, max_attempts, run_at, enqueued_at) VALUES ($1, $2, $3, $4, $5, $6)",
+		job.ID, job.Type, string(job.Payload), job.MaxAttempts, job.RunAt, job.EnqueuedAt,
+	)
+	return err
+}
+
+const pgJobColumns = "id, type, payload, attempts, max_attempts, run_at, enqueued_at, last_error"
+
+func scanQueueJob(scan func(...interface{}) error) (*QueueJob, error) {
+	var job QueueJob
+	var payload string
+	var last_error sql.NullString
+	if err := scan(&job.ID, &job.Type, &payload, &job.Attempt, &job.MaxAttempts, &job.RunAt, &job.EnqueuedAt, &last_error); err != nil {
+		return nil, err
+	}
+	job.Payload = json.RawMessage(payload)
+	job.LastError = last_error.String
+	return &job, nil
+}
+
+func (self *pgJobStore) claim(ctx context.Context, types []string, now time.Time, lease time.Time) (*QueueJob, error) {
+	db, err := self.db(ctx)
+	if err != nil {
+		return nil, err
+	}
+	job, err := scanQueueJob(db.QueryRowContext(
+		ctx,
+		`UPDATE queue_jobs SET attempts = attempts + 1, locked_until = $3
+		WHERE id = (
+			SELECT id FROM queue_jobs
+			WHERE state = 'queued' AND type = ANY($1) AND run_at <= $2 AND (locked_until IS NULL OR locked_until <= $2)
+			ORDER BY run_at LIMIT 1 FOR UPDATE SKIP LOCKED
+		) RETURNING `+pgJobColumns,
+		pq.Array(types), now, lease,
+	).Scan)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return job, err
+}
+
+func (self *pgJobStore) complete(ctx context.Context, job *QueueJob) error {
+	db, err := self.db(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = db.ExecContext(ctx, "DELETE FROM queue_jobs WHERE id = $1", job.ID)
+	return err
+}
+
+func (self *pgJobStore) retry(ctx context.Context, job *QueueJob, at time.Time) error {
+	db, err := self.db(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = db.ExecContext(
+		ctx,
+		"UPDATE queue_jobs SET run_at = $2, locked_until = NULL, last_error = $3 WHERE id = $1",
+		job.ID, at, job.LastError,
+	)
+	return err
+}
+
+func (self *pgJobStore) bury(ctx context.Context, job *QueueJob, now time.Time) error {
+	db, err := self.db(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = db.ExecContext(
+		ctx,
+		"UPDATE queue_jobs SET state = 'dead', locked_until = NULL, last_error = $2, died_at = $3 WHERE id = $1",
+		job.ID, job.LastError, now,
+	)
+	return err
+}
+
+func (self *pgJobStore) dead(ctx context.Context, limit int) ([]*QueueJob, error) {
+	db, err := self.db(ctx)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.QueryContext(
+		ctx,
+		"SELECT "+pgJobColumns+" FROM queue_jobs WHERE state = 'dead' ORDER BY died_at DESC LIMIT $1",
+		limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	jobs := make([]*QueueJob, 0)
+	for rows.Next() {
+		job, err := scanQueueJob(rows.Scan)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, rows.Err()
+}
+
+func (self *pgJobStore) requeue(ctx context.Context, id string, now time.Time) error {
+	db, err := self.db(ctx)
+	if err != nil {
+		return err
+	}
+	res, err := db.ExecContext(
+		ctx,
+		"UPDATE queue_jobs SET state = 'queued', attempts = 0, run_at = $2, died_at = NULL WHERE id = $1 AND state = 'dead'",
+		id, now,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrJobNotFound
+	}
+	return nil
+}
+
+// redisJobStore keeps each job as JSON in <prefix>job:<id>, queued in the
+// sorted set <prefix>queue:<type> scored by when it's due, or by when its
+// lease ends while it's running. Dead jobs are in <prefix>dead, scored by
+// when they died.
+type redisJobStore struct {
+	client *redisClient
+	prefix string
+}
+
+// redisClaimScript takes the first due job in a queue and leases it by
+// moving its score to the end of the lease
+const redisClaimScript = `local ids = redis.call("ZRANGEBYSCORE", KEYS[1], "-inf", ARGV[1], "LIMIT", 0, 1)
+if #ids == 0 then return false end
+redis.call("ZADD", KEYS[1], ARGV[2], ids[1])
+return ids[1]`
+
+func redisMS(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano()/int64(time.Millisecond), 10)
+}
+
+func (self *redisJobStore) save(ctx context.Context, job *QueueJob) error {
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	_, err = self.client.do(ctx, "SET", self.prefix+"job:"+job.ID, string(data))
+	return err
+}
+
+func (self *redisJobStore) load(ctx context.Context, id string) (*QueueJob, error) {
+	reply, err := self.client.do(ctx, "GET", self.prefix+"job:"+id)
+	if err != nil || reply == nil {
+		return nil, err
+	}
+	data, _ := reply.(string)
+	var job QueueJob
+	if err := json.Unmarshal([]byte(data), &job); err != nil {
+		return nil, fmt.Errorf("Error reading job %s: %s", id, err)
+	}
+	return &job, nil
+}
+
+func (self *redisJobStore) enqueue(ctx context.Context, job *QueueJob) error {
+	if err := self.save(ctx, job); err != nil {
+		return err
+	}
+	_, err := self.client.do(ctx, "ZADD", self.prefix+"queue:"+job.Type, redisMS(job.RunAt), job.ID)
+	return err
+}
+
+func (self *redisJobStore) claim(ctx context.Context, types []string, now time.Time, lease time.Time) (*QueueJob, error) {
+	for _, job_type := range types {
+		reply, err := self.client.do(ctx, "EVAL", redisClaimScript, "1", self.prefix+"queue:"+job_type, redisMS(now), redisMS(lease))
+		if err != nil {
+			return nil, err
+		}
+		id, _ := reply.(string)
+		if id == "" {
+			continue
+		}
+		job, err := self.load(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if job == nil {
+			// Deleted by hand
+			self.client.do(ctx, "ZREM", self.prefix+"queue:"+job_type, id)
+			continue
+		}
+		job.Attempt++
+		if err := self.save(ctx, job); err != nil {
+			return nil, err
+		}
+		return job, nil
+	}
+	return nil, nil
+}
+
+func (self *redisJobStore) complete(ctx context.Context, job *QueueJob) error {
+	if _, err := self.client.do(ctx, "ZREM", self.prefix+"queue:"+job.Type, job.ID); err != nil {
+		return err
+	}
+	_, err := self.client.do(ctx, "DEL", self.prefix+"job:"+job.ID)
+	return err
+}
+
+func (self *redisJobStore) retry(ctx context.Context, job *QueueJob, at time.Time) error {
+	job.RunAt = at
+	if err := self.save(ctx, job); err != nil {
+		return err
+	}
+	_, err := self.client.do(ctx, "ZADD", self.prefix+"queue:"+job.Type, redisMS(at), job.ID)
+	return err
+}
+
+func (self *redisJobStore) bury(ctx context.Context, job *QueueJob, now time.Time) error {
+	if err := self.save(ctx, job); err != nil {
+		return err
+	}
+	if _, err := self.client.do(ctx, "ZREM", self.prefix+"queue:"+job.Type, job.ID); err != nil {
+		return err
+	}
+	_, err := self.client.do(ctx, "ZADD", self.prefix+"dead", redisMS(now), job.ID)
+	return err
+}
+
+func (self *redisJobStore) dead(ctx context.Context, limit int) ([]*QueueJob, error) {
+	reply, err := self.client.do(ctx, "ZREVRANGE", self.prefix+"dead", "0", strconv.Itoa(limit-1))
+	if err != nil {
+		return nil, err
+	}
+	ids, _ := reply.([]interface{})
+	jobs := make([]*QueueJob, 0, len(ids))
+	for _, id := range ids {
+		job, err := self.load(ctx, fmt.Sprint(id))
+		if err != nil {
+			return nil, err
+		}
+		if job != nil {
+			jobs = append(jobs, job)
+		}
+	}
+	return jobs, nil
+}
+
+func (self *redisJobStore) requeue(ctx context.Context, id string, now time.Time) error {
+	reply, err := self.client.do(ctx, "ZREM", self.prefix+"dead", id)
+	if err != nil {
+		return err
+	}
+	if n, _ := reply.(int64); n == 0 {
+		return ErrJobNotFound
+	}
+	job, err := self.load(ctx, id)
+	if err != nil {
+		return err
+	}
+	if job == nil {
+		return ErrJobNotFound
+	}
+	job.Attempt = 0
+	job.RunAt = now
+	return self.enqueue(ctx, job)
+}
+
+// memoryJobStore is for a single process, without a database
+type memoryJobStore struct {
+	lock   sync.Mutex
+	jobs   map[string]*QueueJob
+	leases map[string]time.Time
+	died   map[string]time.Time
+}
+
+func newMemoryJobStore() *memoryJobStore {
+	return &memoryJobStore{
+		jobs:   make(map[string]*QueueJob),
+		leases: make(map[string]time.Time),
+		died:   make(map[string]time.Time),
+	}
+}
+
+func (self *memoryJobStore) enqueue(ctx context.Context, job *QueueJob) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	copied := *job
+	self.jobs[job.ID] = &copied
+	return nil
+}
+
+func (self *memoryJobStore) claim(ctx context.Context, types []string, now time.Time, lease time.Time) (*QueueJob, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	wanted := make(map[string]bool, len(types))
+	for _, job_type := range types {
+		wanted[job_type] = true
+	}
+	var next *QueueJob
+	for id, job := range self.jobs {
+		if _, dead := self.died[id]; dead || !wanted[job.Type] || job.RunAt.After(now) || self.leases[id].After(now) {
+			continue
+		}
+		if next == nil || job.RunAt.Before(next.RunAt) {
+			next = job
+		}
+	}
+	if next == nil {
+		return nil, nil
+	}
+	next.Attempt++
+	self.leases[next.ID] = lease
+	copied := *next
+	return &copied, nil
+}
+
+func (self *memoryJobStore) complete(ctx context.Context, job *QueueJob) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	delete(self.jobs, job.ID)
+	delete(self.leases, job.ID)
+	return nil
+}
+
+func (self *memoryJobStore) retry(ctx context.Context, job *QueueJob, at time.Time) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if stored, ok := self.jobs[job.ID]; ok {
+		stored.RunAt = at
+		stored.LastError = job.LastError
+	}
+	delete(self.leases, job.ID)
+	return nil
+}
+
+func (self *memoryJobStore) bury(ctx context.Context, job *QueueJob, now time.Time) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if stored, ok := self.jobs[job.ID]; ok {
+		stored.LastError = job.LastError
+	}
+	delete(self.leases, job.ID)
+	self.died[job.ID] = now
+	return nil
+}
+
+func (self *memoryJobStore) dead(ctx context.Context, limit int) ([]*QueueJob, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	jobs := make([]*QueueJob, 0, len(self.died))
+	for id := range self.died {
+		copied := *self.jobs[id]
+		jobs = append(jobs, &copied)
+	}
+	sort.Slice(jobs, func(i, j int) bool {
+		return self.died[jobs[i].ID].After(self.died[jobs[j].ID])
+	})
+	if len(jobs) > limit {
+		jobs = jobs[:limit]
+	}
+	return jobs, nil
+}
+
+func (self *memoryJobStore) requeue(ctx context.Context, id string, now time.Time) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if _, ok := self.died[id]; !ok {
+		return ErrJobNotFound
+	}
+	delete(self.died, id)
+	self.jobs[id].Attempt = 0
+	self.jobs[id].RunAt = now
+	return nil
+}
+
+type jobQueue struct {
+	appctx       *baseAppContext
+	backend      string
+	concurrency  int
+	maxAttempts  int
+	backoff      time.Duration
+	lease        time.Duration
+	pollInterval time.Duration
+
+	lock     sync.Mutex
+	store    jobStore
+	handlers map[string]JobHandler
+	wakeChan chan struct{}
+}
+
+func newJobQueue(appctx *baseAppContext) *jobQueue {
+	return &jobQueue{
+		appctx:       appctx,
+		concurrency:  4,
+		maxAttempts:  5,
+		backoff:      10 * time.Second,
+		lease:        5 * time.Minute,
+		pollInterval: time.Second,
+		handlers:     make(map[string]JobHandler),
+		wakeChan:     make(chan struct{}, 1),
+	}
+}
+
+// storeFor picks postgres if there's a database the first time it's
+// needed, and memory otherwise, unless JOBS_BACKEND chose one
+func (self *jobQueue) storeFor() jobStore {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.store == nil {
+		if self.appctx.DBWrite() != nil {
+			self.store = &pgJobStore{appctx: self.appctx}
+		} else {
+			self.store = newMemoryJobStore()
+		}
+	}
+	return self.store
+}
+
+func (self *jobQueue) Enqueue(ctx context.Context, job_type string, payload interface{}, opts EnqueueOptions) (string, error) {
+	if job_type == "" {
+		return "", errors.New("Jobs need a type")
+	}
+	var data []byte
+	switch p := payload.(type) {
+	case []byte:
+		data = p
+	case json.RawMessage:
+		data = p
+	default:
+		var err error
+		if data, err = json.Marshal(payload); err != nil {
+			return "", fmt.Errorf("Error encoding job payload: %s", err)
+		}
+	}
+	if !json.Valid(data) {
+		return "", errors.New("Job payload isn't JSON")
+	}
+
+	now := self.appctx.now()
+	job := &QueueJob{
+		ID:          self.appctx.IDGenerator().NewID(),
+		Type:        job_type,
+		Payload:     data,
+		MaxAttempts: opts.MaxAttempts,
+		RunAt:       now.Add(opts.Delay),
+		EnqueuedAt:  now,
+	}
+	if !opts.RunAt.IsZero() {
+		job.RunAt = opts.RunAt
+	}
+	if job.MaxAttempts <= 0 {
+		job.MaxAttempts = self.maxAttempts
+	}
+	if err := self.storeFor().enqueue(ctx, job); err != nil {
+		return "", fmt.Errorf("Error enqueueing '%s' job: %s", job_type, err)
+	}
+	self.appctx.MetricsClient().Incr("jobs.enqueued", 1.0, map[string]string{"type": job_type})
+
+	// Due jobs handled here needn't wait for the next poll
+	if !job.RunAt.After(now) {
+		select {
+		case self.wakeChan <- struct{}{}:
+		default:
+		}
+	}
+	return job.ID, nil
+}
+
+func (self *jobQueue) Handle(job_type string, handler JobHandler) error {
+	self.lock.Lock()
+	if _, ok := self.handlers[job_type]; ok {
+		self.lock.Unlock()
+		return fmt.Errorf("'%s' jobs already have a handler", job_type)
+	}
+	self.handlers[job_type] = handler
+	first := len(self.handlers) == 1
+	self.lock.Unlock()
+
+	if first && !self.appctx.lambda {
+		return self.appctx.Workers().Register("jobs", self.run, WorkerOptions{
+			Restart:    RestartAlways,
+			ActiveOnly: true,
+		})
+	}
+	return nil
+}
+
+func (self *jobQueue) types() []string {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	types := make([]string, 0, len(self.handlers))
+	for job_type := range self.handlers {
+		types = append(types, job_type)
+	}
+	sort.Strings(types)
+	return types
+}
+
+func (self *jobQueue) handler(job_type string) JobHandler {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.handlers[job_type]
+}
+
+// retryDelay is how long to wait after attempt failed: the backoff,
+// doubled for each earlier attempt, up to an hour
+func (self *jobQueue) retryDelay(attempt int) time.Duration {
+	delay := self.backoff
+	for i := 1; i < attempt && delay < time.Hour; i++ {
+		delay *= 2
+	}
+	if delay > time.Hour {
+		delay = time.Hour
+	}
+	return delay
+}
+
+func (self *jobQueue) call(ctx context.Context, handler JobHandler, job *QueueJob) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("Job %s of type '%s' panicked: %v", job.ID, job.Type, r)
+		}
+	}()
+	return handler(ctx, job)
+}
+
+// runOne runs the next due job, returning false if there wasn't one
+func (self *jobQueue) runOne(ctx context.Context) (bool, error) {
+	store := self.storeFor()
+	now := self.appctx.now()
+	job, err := store.claim(ctx, self.types(), now, now.Add(self.lease))
+	if err != nil || job == nil {
+		return false, err
+	}
+
+	tags := map[string]string{"type": job.Type}
+	mcli := self.appctx.MetricsClient()
+	start := time.Now()
+	job_err := self.call(ctx, self.handler(job.Type), job)
+	mcli.TimingMS("jobs.duration_ms", float64(time.Since(start))/float64(time.Millisecond), 1.0, tags)
+
+	if job_err == nil {
+		mcli.Incr("jobs.succeeded", 1.0, tags)
+		return true, store.complete(ctx, job)
+	}
+
+	job.LastError = job_err.Error()
+	if job.Attempt >= job.MaxAttempts {
+		mcli.Incr("jobs.dead", 1.0, tags)
+		self.appctx.Logger().LogErrorf(ctx, "Job %s of type '%s' failed its last attempt, %d of %d: %s", job.ID, job.Type, job.Attempt, job.MaxAttempts, job_err)
+		return true, store.bury(ctx, job, self.appctx.now())
+	}
+	mcli.Incr("jobs.failed", 1.0, tags)
+	delay := self.retryDelay(job.Attempt)
+	self.appctx.Logger().LogWarnf(ctx, "Job %s of type '%s' failed attempt %d of %d, retrying in %s: %s", job.ID, job.Type, job.Attempt, job.MaxAttempts, delay, job_err)
+	return true, store.retry(ctx, job, self.appctx.now().Add(delay))
+}
+
+// run is the jobs worker: JOBS_CONCURRENCY loops running jobs until ctx
+// is done
+func (self *jobQueue) run(ctx context.Context) error {
+	var wg sync.WaitGroup
+	for i := 0; i < self.concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				ran, err := self.runOne(ctx)
+				if err != nil && ctx.Err() == nil {
+					self.appctx.Logger().LogWarnf(ctx, "Error running jobs: %s", err)
+				}
+				if ran && err == nil {
+					continue
+				}
+				select {
+				case <-ctx.Done():
+				case <-self.wakeChan:
+				case <-self.appctx.Clock().After(self.pollInterval):
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return nil
+}
+
+func (self *jobQueue) DeadLetters(ctx context.Context, limit int) ([]*QueueJob, error) {
+	if limit <= 0 {
+		limit = 100
+	}
+	return self.storeFor().dead(ctx, limit)
+}
+
+func (self *jobQueue) Retry(ctx context.Context, id string) error {
+	if err := self.storeFor().requeue(ctx, id, self.appctx.now()); err != nil {
+		return err
+	}
+	self.appctx.Logger().LogInfof(ctx, "Retrying dead job %s", id)
+	return nil
+}
+
+// close closes the redis connections. The jobs worker has already been
+// stopped with the other workers.
+func (self *jobQueue) close() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if store, ok := self.store.(*redisJobStore); ok {
+		store.client.close()
+	}
+}
+
+func (self *jobQueue) status() map[string]interface{} {
+	self.lock.Lock()
+	store := self.store
+	self.lock.Unlock()
+	return map[string]interface{}{
+		"store":        typeName(store),
+		"types":        self.types(),
+		"concurrency":  self.concurrency,
+		"max_attempts": self.maxAttempts,
+		"backoff":      self.backoff.String(),
+		"lease":        self.lease.String(),
+	}
+}
+
+func (self *baseAppContext) Jobs() JobQueue {
+	return self.jobs
+}
+
+// JOBS_BACKEND is postgres, redis (with JOBS_REDIS_URL) or memory; by
+// default jobs are kept in the database if there is one. JOBS_CONCURRENCY
+// (default 4) jobs run at once, checking for due ones every
+// JOBS_POLL_INTERVAL (default 1s). Jobs get JOBS_MAX_ATTEMPTS (default 5)
+// tries, JOBS_RETRY_BACKOFF (default 10s) apart and doubling, and are run
+// again if they haven't finished after JOBS_LEASE (default 5m).
+func (self *baseAppContext) setJobsFromEnv() error {
+	jobs := self.jobs
+	if concurrency, found, err := self.getIntFromEnv("JOBS_CONCURRENCY"); err != nil {
+		return err
+	} else if found {
+		if concurrency <= 0 {
+			return errors.New("JOBS_CONCURRENCY must be > 0")
+		}
+		jobs.concurrency = concurrency
+	}
+	if attempts, found, err := self.getIntFromEnv("JOBS_MAX_ATTEMPTS"); err != nil {
+		return err
+	} else if found {
+		if attempts <= 0 {
+			return errors.New("JOBS_MAX_ATTEMPTS must be > 0")
+		}
+		jobs.maxAttempts = attempts
+	}
+	if interval, found, err := self.getDurationFromEnv("JOBS_POLL_INTERVAL"); err != nil {
+		return err
+	} else if found {
+		if interval <= 0 {
+			return errors.New("JOBS_POLL_INTERVAL must be > 0")
+		}
+		jobs.pollInterval = interval
+	}
+	if backoff, found, err := self.getDurationFromEnv("JOBS_RETRY_BACKOFF"); err != nil {
+		return err
+	} else if found {
+		if backoff <= 0 {
+			return errors.New("JOBS_RETRY_BACKOFF must be > 0")
+		}
+		jobs.backoff = backoff
+	}
+	if lease, found, err := self.getDurationFromEnv("JOBS_LEASE"); err != nil {
+		return err
+	} else if found {
+		if lease <= 0 {
+			return errors.New("JOBS_LEASE must be > 0")
+		}
+		jobs.lease = lease
+	}
+
+	switch jobs.backend = self.getEnv("JOBS_BACKEND"); jobs.backend {
+	case "":
+	case "postgres":
+		jobs.store = &pgJobStore{appctx: self}
+	case "memory":
+		jobs.store = newMemoryJobStore()
+	case "redis":
+		redis_url := self.getEnv("JOBS_REDIS_URL")
+		if redis_url == "" {
+			return errors.New("JOBS_REDIS_URL is required with JOBS_BACKEND=redis")
+		}
+		client, err := newRedisClient(redis_url, time.Second)
+		if err != nil {
+			return fmt.Errorf("Invalid JOBS_REDIS_URL: %s", err)
+		}
+		jobs.store = &redisJobStore{client: client, prefix: "jobs:" + self.appName + ":"}
+	default:
+		return fmt.Errorf("Unknown JOBS_BACKEND '%s'", jobs.backend)
+	}
+	return nil
+}
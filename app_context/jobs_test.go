@@ -0,0 +1,239 @@
+package app_context
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestJobs(t *testing.T) {
+	os.Setenv("JOBS_BACKEND", "memory")
+	os.Setenv("JOBS_POLL_INTERVAL", "10ms")
+	os.Setenv("JOBS_RETRY_BACKOFF", "10ms")
+	defer os.Unsetenv("JOBS_BACKEND")
+	defer os.Unsetenv("JOBS_POLL_INTERVAL")
+	defer os.Unsetenv("JOBS_RETRY_BACKOFF")
+
+	app_ctx, err := NewAppContext("jobs_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer app_ctx.Close()
+
+	mcli := newCountingMetricsClient()
+	app_ctx.SetMetricsClient(mcli)
+
+	var lock sync.Mutex
+	var sent []string
+	jobs := app_ctx.Jobs()
+	err = jobs.Handle("email", func(ctx context.Context, job *QueueJob) error {
+		var payload struct {
+			To string `json:"to"`
+		}
+		if err := job.Decode(&payload); err != nil {
+			return err
+		}
+		if job.Attempt == 1 {
+			return errors.New("SMTP unavailable")
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		sent = append(sent, payload.To)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := jobs.Handle("email", nil); err == nil {
+		t.Error("Expected a second handler for a type to fail")
+	}
+	if err := jobs.Handle("broken", func(ctx context.Context, job *QueueJob) error {
+		panic("bad payload")
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	if _, err := jobs.Enqueue(ctx, "email", map[string]string{"to": "later@example.com"}, EnqueueOptions{Delay: time.Hour}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := jobs.Enqueue(ctx, "email", []byte(`{"to": "now@example.com"}`), EnqueueOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	broken_id, err := jobs.Enqueue(ctx, "broken", nil, EnqueueOptions{MaxAttempts: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := jobs.Enqueue(ctx, "email", []byte("not json"), EnqueueOptions{}); err == nil {
+		t.Error("Expected a payload that isn't JSON to fail")
+	}
+
+	waitFor(t, "jobs to finish", func() bool {
+		return mcli.count("jobs.succeeded") == 1 && mcli.count("jobs.dead") == 1
+	})
+	lock.Lock()
+	if len(sent) != 1 || sent[0] != "now@example.com" {
+		t.Errorf("Expected only the due email to be sent, got %v", sent)
+	}
+	lock.Unlock()
+	if mcli.count("jobs.enqueued") != 3 || mcli.count("jobs.failed") != 2 {
+		t.Errorf("Unexpected metrics: %v", mcli.counts)
+	}
+
+	dead, err := jobs.DeadLetters(ctx, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dead) != 1 || dead[0].ID != broken_id || dead[0].Attempt != 2 || !strings.Contains(dead[0].LastError, "bad payload") {
+		t.Fatalf("Unexpected dead letters: %+v", dead)
+	}
+	if err := jobs.Retry(ctx, "unknown"); err != ErrJobNotFound {
+		t.Errorf("Expected ErrJobNotFound, got %v", err)
+	}
+	if err := jobs.Retry(ctx, broken_id); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the retried job to die again", func() bool {
+		return mcli.count("jobs.dead") == 2
+	})
+}
+
+func TestJobsRetryDelay(t *testing.T) {
+	jobs := &jobQueue{backoff: 10 * time.Second}
+	for attempt, expected := range map[int]time.Duration{
+		1:  10 * time.Second,
+		2:  20 * time.Second,
+		4:  80 * time.Second,
+		20: time.Hour,
+	} {
+		if delay := jobs.retryDelay(attempt); delay != expected {
+			t.Errorf("Expected %s after attempt %d, got %s", expected, attempt, delay)
+		}
+	}
+}
+
+func TestPostgresJobs(t *testing.T) {
+	app_ctx, err := NewAppContext("jobs_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer app_ctx.Close()
+
+	db, err := app_ctx.(*baseAppContext).openDB("appctx_fake", "", "primary")
+	if err != nil {
+		t.Fatal(err)
+	}
+	app_ctx.SetDB(db)
+	defer app_ctx.SetDB(nil)
+
+	var execs []string
+	var exec_args [][]driver.Value
+	fakeExecHook = func(query string, args []driver.Value) error {
+		execs = append(execs, strings.Fields(query)[0])
+		exec_args = append(exec_args, args)
+		return nil
+	}
+	defer func() { fakeExecHook = nil }()
+
+	ctx := context.Background()
+	jobs := app_ctx.(*baseAppContext).jobs
+	id, err := jobs.Enqueue(ctx, "email", map[string]string{"to": "a@example.com"}, EnqueueOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(execs) != 3 || execs[2] != "INSERT" || exec_args[2][0] != id || exec_args[2][2] != `{"to":"a@example.com"}` || exec_args[2][3] != int64(5) {
+		t.Fatalf("Unexpected queries: %v %v", execs, exec_args)
+	}
+
+	now := time.Now()
+	fakeQueryHook = func(query string, args []driver.Value) [][]driver.Value {
+		if !strings.Contains(query, "FOR UPDATE SKIP LOCKED") {
+			return nil
+		}
+		return [][]driver.Value{
+			{id, "email", `{"to":"a@example.com"}`, int64(3), int64(5), now, now, nil},
+		}
+	}
+	defer func() { fakeQueryHook = nil }()
+
+	// Not through Handle, so the jobs worker doesn't run
+	jobs.handlers["email"] = func(ctx context.Context, job *QueueJob) error {
+		return fmt.Errorf("attempt %d failed", job.Attempt)
+	}
+	execs, exec_args = nil, nil
+	if ran, err := jobs.runOne(ctx); !ran || err != nil {
+		t.Fatalf("Expected a job to run, got %v: %v", ran, err)
+	}
+	if len(execs) != 1 || execs[0] != "UPDATE" || exec_args[0][0] != id || exec_args[0][2] != "attempt 3 failed" {
+		t.Fatalf("Expected the job to be retried, got %v %v", execs, exec_args)
+	}
+	if at := exec_args[0][1].(time.Time); at.Sub(now) < 40*time.Second {
+		t.Errorf("Expected the third retry to back off 40s, got %s", at.Sub(now))
+	}
+}
+
+func TestRedisJobs(t *testing.T) {
+	job, _ := json.Marshal(&QueueJob{ID: "job-1", Type: "email", Payload: json.RawMessage(`{}`), MaxAttempts: 5})
+	server := newFakeRedis(
+		t,
+		"+OK", ":1", // enqueue
+		"$5\r\njob-1", fmt.Sprintf("$%d\r\n%s", len(job), job), "+OK", // claim
+		":1", ":1", // complete
+	)
+	defer server.listener.Close()
+
+	os.Setenv("JOBS_BACKEND", "redis")
+	os.Setenv("JOBS_REDIS_URL", "redis://"+server.listener.Addr().String())
+	defer os.Unsetenv("JOBS_BACKEND")
+	defer os.Unsetenv("JOBS_REDIS_URL")
+
+	app_ctx, err := NewAppContext("jobs_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer app_ctx.Close()
+
+	ctx := context.Background()
+	jobs := app_ctx.(*baseAppContext).jobs
+	if _, err := jobs.Enqueue(ctx, "email", map[string]string{}, EnqueueOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	var attempt int
+	jobs.handlers["email"] = func(ctx context.Context, job *QueueJob) error {
+		attempt = job.Attempt
+		return nil
+	}
+	if ran, err := jobs.runOne(ctx); !ran || err != nil {
+		t.Fatalf("Expected a job to run, got %v: %v", ran, err)
+	}
+	if attempt != 1 {
+		t.Errorf("Expected the first attempt, got %d", attempt)
+	}
+
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	var commands []string
+	for _, cmd := range server.commands {
+		commands = append(commands, cmd[0]+" "+cmd[len(cmd)-1])
+	}
+	if len(commands) != 7 {
+		t.Fatalf("Unexpected commands: %v", commands)
+	}
+	if zadd := server.commands[1]; zadd[1] != "jobs:jobs_test:queue:email" {
+		t.Errorf("Unexpected ZADD: %v", zadd)
+	}
+	if eval := server.commands[2]; eval[3] != "jobs:jobs_test:queue:email" {
+		t.Errorf("Unexpected EVAL: %v", eval)
+	}
+	if commands[5] != "ZREM job-1" || commands[6] != "DEL jobs:jobs_test:job:job-1" {
+		t.Errorf("Expected the job to be removed, got %v", commands)
+	}
+}
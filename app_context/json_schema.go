@@ -0,0 +1,695 @@
+package app_context
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// ErrInvalidDocument matches, with errors.Is, the *SchemaValidationError
+// ValidateDocument returns. ErrorCodes() renders it as invalid_argument.
+var ErrInvalidDocument = errors.New("Document doesn't match its JSON schema")
+
+// SchemaError is one way a document doesn't match its schema. Path is a
+// JSON pointer to the value, "" for the document itself.
+type SchemaError struct {
+	Path    string `json:"path"`
+	Message string `json:"message"`
+}
+
+type SchemaValidationError struct {
+	Schema string
+	Errors []SchemaError
+}
+
+func (self *SchemaValidationError) Error() string {
+	msgs := make([]string, len(self.Errors))
+	for i, err := range self.Errors {
+		msgs[i] = err.Message
+		if err.Path != "" {
+			msgs[i] = err.Path + ": " + err.Message
+		}
+	}
+	return fmt.Sprintf("Document doesn't match schema '%s': %s", self.Schema, strings.Join(msgs, "; "))
+}
+
+func (self *SchemaValidationError) Is(target error) bool {
+	return target == ErrInvalidDocument
+}
+
+// SchemaRegistry holds the JSON schemas under JSON_SCHEMA_FILEPATH,
+// compiled at startup. A schema's name is its path below the directory
+// without .json, eg. "orders/create" for orders/create.json.
+//
+// Schemas are draft-07 without formats: type, enum, const, the numeric,
+// string, array and object keywords, allOf, anyOf, oneOf, not and $ref
+// to "#/definitions/..." pointers and other files, eg.
+// "../common.json#/definitions/money".
+type SchemaRegistry interface {
+	// ValidateDocument returns a *SchemaValidationError when data is JSON
+	// that doesn't match schema_name
+	ValidateDocument(schema_name string, data []byte) error
+	Names() []string
+}
+
+type schemaRegistry struct {
+	schemas map[string]*jsonSchema
+}
+
+func newSchemaRegistry() *schemaRegistry {
+	return &schemaRegistry{schemas: make(map[string]*jsonSchema)}
+}
+
+// readSchemaDocs reads every .json file under dir, by its name in the
+// registry
+func readSchemaDocs(dir string) (map[string]interface{}, error) {
+	docs := make(map[string]interface{})
+	err := filepath.Walk(dir, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || filepath.Ext(file) != ".json" {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, file)
+		if err != nil {
+			return err
+		}
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		var doc interface{}
+		if err := json.Unmarshal(data, &doc); err != nil {
+			return fmt.Errorf("%s isn't valid JSON: %s", rel, err)
+		}
+		docs[strings.TrimSuffix(filepath.ToSlash(rel), ".json")] = doc
+		return nil
+	})
+	return docs, err
+}
+
+// loadSchemaRegistry compiles every .json file under dir, failing on the
+// first that isn't a valid schema
+func loadSchemaRegistry(dir string) (*schemaRegistry, error) {
+	docs, err := readSchemaDocs(dir)
+	if err != nil {
+		return nil, err
+	}
+	compiler := &schemaCompiler{
+		docs:     docs,
+		compiled: make(map[string]*jsonSchema),
+	}
+
+	self := newSchemaRegistry()
+	for name := range compiler.docs {
+		schema, err := compiler.compileRef(name, "")
+		if err != nil {
+			return nil, fmt.Errorf("Invalid JSON schema %s.json: %s", name, err)
+		}
+		self.schemas[name] = schema
+	}
+	return self, nil
+}
+
+func (self *schemaRegistry) Names() []string {
+	names := make([]string, 0, len(self.schemas))
+	for name := range self.schemas {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (self *schemaRegistry) ValidateDocument(schema_name string, data []byte) error {
+	schema, ok := self.schemas[schema_name]
+	if !ok {
+		return fmt.Errorf("Unknown JSON schema '%s'", schema_name)
+	}
+
+	var doc interface{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&doc); err != nil {
+		return &SchemaValidationError{
+			Schema: schema_name,
+			Errors: []SchemaError{{Message: "Invalid JSON: " + err.Error()}},
+		}
+	}
+
+	var errs []SchemaError
+	schema.validate("", doc, &errs)
+	if len(errs) > 0 {
+		return &SchemaValidationError{Schema: schema_name, Errors: errs}
+	}
+	return nil
+}
+
+func (self *baseAppContext) SchemaRegistry() SchemaRegistry {
+	return self.schemaRegistry
+}
+
+// Every schema under JSON_SCHEMA_FILEPATH must be valid; startup fails
+// otherwise rather than rejecting requests later. A path that doesn't
+// exist only logs a warning, as some images don't ship their schemas.
+func (self *baseAppContext) setSchemaRegistryFromEnv() error {
+	if self.jsonSchemaFilePath == "" {
+		return nil
+	}
+	if _, err := os.Stat(self.jsonSchemaFilePath); os.IsNotExist(err) {
+		self.Logger().LogWarnf(context.Background(), "JSON_SCHEMA_FILEPATH %s doesn't exist, no schemas loaded", self.jsonSchemaFilePath)
+		return nil
+	}
+	registry, err := loadSchemaRegistry(self.jsonSchemaFilePath)
+	if err != nil {
+		return err
+	}
+	self.schemaRegistry = registry
+	return nil
+}
+
+type jsonSchema struct {
+	// never is the false schema, that nothing matches
+	never bool
+
+	types            []string
+	enum             []interface{}
+	constant         interface{}
+	hasConst         bool
+	minimum          *float64
+	maximum          *float64
+	exclusiveMinimum *float64
+	exclusiveMaximum *float64
+	multipleOf       *float64
+	minLength        *int
+	maxLength        *int
+	pattern          *regexp.Regexp
+	items            *jsonSchema
+	tupleItems       []*jsonSchema
+	minItems         *int
+	maxItems         *int
+	uniqueItems      bool
+	properties       map[string]*jsonSchema
+	required         []string
+	additional       *jsonSchema
+	minProperties    *int
+	maxProperties    *int
+	allOf            []*jsonSchema
+	anyOf            []*jsonSchema
+	oneOf            []*jsonSchema
+	not              *jsonSchema
+	ref              *jsonSchema
+}
+
+var jsonSchemaTypes = map[string]bool{
+	"null": true, "boolean": true, "object": true, "array": true,
+	"number": true, "integer": true, "string": true,
+}
+
+type schemaCompiler struct {
+	docs map[string]interface{}
+	// compiled is by "name#pointer", filled before a schema's keywords are
+	// compiled so recursive refs terminate
+	compiled map[string]*jsonSchema
+}
+
+// resolvePointer follows a JSON pointer, eg. "/definitions/money"
+func resolvePointer(doc interface{}, pointer string) (interface{}, bool) {
+	if pointer == "" {
+		return doc, true
+	}
+	for _, token := range strings.Split(strings.TrimPrefix(pointer, "/"), "/") {
+		token = strings.Replace(strings.Replace(token, "~1", "/", -1), "~0", "~", -1)
+		switch v := doc.(type) {
+		case map[string]interface{}:
+			var ok bool
+			if doc, ok = v[token]; !ok {
+				return nil, false
+			}
+		case []interface{}:
+			idx, err := strconv.Atoi(token)
+			if err != nil || idx < 0 || idx >= len(v) {
+				return nil, false
+			}
+			doc = v[idx]
+		default:
+			return nil, false
+		}
+	}
+	return doc, true
+}
+
+func (self *schemaCompiler) compileRef(name, pointer string) (*jsonSchema, error) {
+	key := name + "#" + pointer
+	if schema, ok := self.compiled[key]; ok {
+		return schema, nil
+	}
+	doc, ok := self.docs[name]
+	if !ok {
+		return nil, fmt.Errorf("No schema %s.json", name)
+	}
+	val, ok := resolvePointer(doc, pointer)
+	if !ok {
+		return nil, fmt.Errorf("Nothing at %s#%s", name, pointer)
+	}
+	schema := &jsonSchema{}
+	self.compiled[key] = schema
+	if err := self.compileInto(schema, name, val); err != nil {
+		return nil, err
+	}
+	return schema, nil
+}
+
+func (self *schemaCompiler) compile(name string, val interface{}) (*jsonSchema, error) {
+	schema := &jsonSchema{}
+	if err := self.compileInto(schema, name, val); err != nil {
+		return nil, err
+	}
+	return schema, nil
+}
+
+func (self *schemaCompiler) compileList(name, keyword string, val interface{}) ([]*jsonSchema, error) {
+	list, ok := val.([]interface{})
+	if !ok || len(list) == 0 {
+		return nil, fmt.Errorf("%s must be a non-empty array", keyword)
+	}
+	schemas := make([]*jsonSchema, len(list))
+	for i, item := range list {
+		var err error
+		if schemas[i], err = self.compile(name, item); err != nil {
+			return nil, err
+		}
+	}
+	return schemas, nil
+}
+
+func schemaNumber(keyword string, val interface{}) (*float64, error) {
+	f, ok := val.(float64)
+	if !ok {
+		return nil, fmt.Errorf("%s must be a number", keyword)
+	}
+	return &f, nil
+}
+
+func schemaCount(keyword string, val interface{}) (*int, error) {
+	f, ok := val.(float64)
+	if !ok || f < 0 || f != math.Trunc(f) {
+		return nil, fmt.Errorf("%s must be a non-negative integer", keyword)
+	}
+	n := int(f)
+	return &n, nil
+}
+
+func (self *schemaCompiler) compileInto(schema *jsonSchema, name string, val interface{}) error {
+	if b, ok := val.(bool); ok {
+		schema.never = !b
+		return nil
+	}
+	obj, ok := val.(map[string]interface{})
+	if !ok {
+		return errors.New("A schema must be an object or boolean")
+	}
+
+	if ref, ok := obj["$ref"]; ok {
+		ref_str, ok := ref.(string)
+		if !ok {
+			return errors.New("$ref must be a string")
+		}
+		parts := strings.SplitN(ref_str, "#", 2)
+		ref_name := name
+		if parts[0] != "" {
+			ref_name = path.Join(path.Dir(name), strings.TrimSuffix(parts[0], ".json"))
+		}
+		pointer := ""
+		if len(parts) == 2 {
+			pointer = parts[1]
+		}
+		var err error
+		if schema.ref, err = self.compileRef(ref_name, pointer); err != nil {
+			return fmt.Errorf("$ref '%s': %s", ref_str, err)
+		}
+		// Siblings of $ref are ignored in draft-07
+		return nil
+	}
+
+	var err error
+	for keyword, v := range obj {
+		switch keyword {
+		case "type":
+			switch t := v.(type) {
+			case string:
+				schema.types = []string{t}
+			case []interface{}:
+				for _, item := range t {
+					s, _ := item.(string)
+					schema.types = append(schema.types, s)
+				}
+			}
+			if len(schema.types) == 0 {
+				return errors.New("type must be a string or array of strings")
+			}
+			for _, t := range schema.types {
+				if !jsonSchemaTypes[t] {
+					return fmt.Errorf("Unknown type '%s'", t)
+				}
+			}
+		case "enum":
+			list, ok := v.([]interface{})
+			if !ok || len(list) == 0 {
+				return errors.New("enum must be a non-empty array")
+			}
+			schema.enum = list
+		case "const":
+			schema.constant, schema.hasConst = v, true
+		case "minimum":
+			schema.minimum, err = schemaNumber(keyword, v)
+		case "maximum":
+			schema.maximum, err = schemaNumber(keyword, v)
+		case "exclusiveMinimum":
+			schema.exclusiveMinimum, err = schemaNumber(keyword, v)
+		case "exclusiveMaximum":
+			schema.exclusiveMaximum, err = schemaNumber(keyword, v)
+		case "multipleOf":
+			if schema.multipleOf, err = schemaNumber(keyword, v); err == nil && *schema.multipleOf <= 0 {
+				err = errors.New("multipleOf must be greater than 0")
+			}
+		case "minLength":
+			schema.minLength, err = schemaCount(keyword, v)
+		case "maxLength":
+			schema.maxLength, err = schemaCount(keyword, v)
+		case "pattern":
+			s, ok := v.(string)
+			if !ok {
+				return errors.New("pattern must be a string")
+			}
+			if schema.pattern, err = regexp.Compile(s); err != nil {
+				return fmt.Errorf("Invalid pattern: %s", err)
+			}
+		case "items":
+			if _, ok := v.([]interface{}); ok {
+				schema.tupleItems, err = self.compileList(name, keyword, v)
+			} else {
+				schema.items, err = self.compile(name, v)
+			}
+		case "minItems":
+			schema.minItems, err = schemaCount(keyword, v)
+		case "maxItems":
+			schema.maxItems, err = schemaCount(keyword, v)
+		case "uniqueItems":
+			if schema.uniqueItems, ok = v.(bool); !ok {
+				return errors.New("uniqueItems must be a boolean")
+			}
+		case "properties":
+			props, ok := v.(map[string]interface{})
+			if !ok {
+				return errors.New("properties must be an object")
+			}
+			schema.properties = make(map[string]*jsonSchema, len(props))
+			for prop, prop_schema := range props {
+				if schema.properties[prop], err = self.compile(name, prop_schema); err != nil {
+					return fmt.Errorf("Property '%s': %s", prop, err)
+				}
+			}
+		case "required":
+			list, ok := v.([]interface{})
+			if !ok {
+				return errors.New("required must be an array of strings")
+			}
+			for _, item := range list {
+				s, ok := item.(string)
+				if !ok {
+					return errors.New("required must be an array of strings")
+				}
+				schema.required = append(schema.required, s)
+			}
+		case "additionalProperties":
+			schema.additional, err = self.compile(name, v)
+		case "minProperties":
+			schema.minProperties, err = schemaCount(keyword, v)
+		case "maxProperties":
+			schema.maxProperties, err = schemaCount(keyword, v)
+		case "allOf":
+			schema.allOf, err = self.compileList(name, keyword, v)
+		case "anyOf":
+			schema.anyOf, err = self.compileList(name, keyword, v)
+		case "oneOf":
+			schema.oneOf, err = self.compileList(name, keyword, v)
+		case "not":
+			schema.not, err = self.compile(name, v)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func jsonType(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	case string:
+		return "string"
+	case json.Number:
+		if f, err := v.Float64(); err == nil && f == math.Trunc(f) {
+			return "integer"
+		}
+		return "number"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+// jsonEqual compares decoded JSON, with numbers by value
+func jsonEqual(a, b interface{}) bool {
+	if n, ok := a.(json.Number); ok {
+		af, _ := n.Float64()
+		switch b := b.(type) {
+		case float64:
+			return af == b
+		case json.Number:
+			bf, _ := b.Float64()
+			return af == bf
+		}
+		return false
+	}
+	if n, ok := b.(json.Number); ok {
+		return jsonEqual(n, a)
+	}
+	switch a := a.(type) {
+	case map[string]interface{}:
+		b, ok := b.(map[string]interface{})
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for k, av := range a {
+			if bv, ok := b[k]; !ok || !jsonEqual(av, bv) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		b, ok := b.([]interface{})
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for i := range a {
+			if !jsonEqual(a[i], b[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+func (self *jsonSchema) matches(v interface{}) bool {
+	var errs []SchemaError
+	self.validate("", v, &errs)
+	return len(errs) == 0
+}
+
+func (self *jsonSchema) validate(ptr string, v interface{}, errs *[]SchemaError) {
+	fail := func(format string, args ...interface{}) {
+		*errs = append(*errs, SchemaError{Path: ptr, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if self.never {
+		fail("Not allowed")
+		return
+	}
+	if self.ref != nil {
+		self.ref.validate(ptr, v, errs)
+		return
+	}
+
+	v_type := jsonType(v)
+	if len(self.types) > 0 {
+		ok := false
+		for _, t := range self.types {
+			if t == v_type || (t == "number" && v_type == "integer") {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			fail("Expected %s, got %s", strings.Join(self.types, " or "), v_type)
+			return
+		}
+	}
+
+	if self.enum != nil {
+		found := false
+		for _, allowed := range self.enum {
+			if jsonEqual(v, allowed) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			fail("Not one of the allowed values")
+		}
+	}
+	if self.hasConst && !jsonEqual(v, self.constant) {
+		fail("Must be %v", self.constant)
+	}
+
+	switch v := v.(type) {
+	case json.Number:
+		f, _ := v.Float64()
+		if self.minimum != nil && f < *self.minimum {
+			fail("Must be at least %v", *self.minimum)
+		}
+		if self.maximum != nil && f > *self.maximum {
+			fail("Must be at most %v", *self.maximum)
+		}
+		if self.exclusiveMinimum != nil && f <= *self.exclusiveMinimum {
+			fail("Must be greater than %v", *self.exclusiveMinimum)
+		}
+		if self.exclusiveMaximum != nil && f >= *self.exclusiveMaximum {
+			fail("Must be less than %v", *self.exclusiveMaximum)
+		}
+		if self.multipleOf != nil {
+			if q := f / *self.multipleOf; q != math.Trunc(q) {
+				fail("Must be a multiple of %v", *self.multipleOf)
+			}
+		}
+	case string:
+		length := utf8.RuneCountInString(v)
+		if self.minLength != nil && length < *self.minLength {
+			fail("Must be at least %d characters", *self.minLength)
+		}
+		if self.maxLength != nil && length > *self.maxLength {
+			fail("Must be at most %d characters", *self.maxLength)
+		}
+		if self.pattern != nil && !self.pattern.MatchString(v) {
+			fail("Must match %s", self.pattern)
+		}
+	case []interface{}:
+		if self.minItems != nil && len(v) < *self.minItems {
+			fail("Must have at least %d items", *self.minItems)
+		}
+		if self.maxItems != nil && len(v) > *self.maxItems {
+			fail("Must have at most %d items", *self.maxItems)
+		}
+		if self.uniqueItems {
+		unique:
+			for i := range v {
+				for j := i + 1; j < len(v); j++ {
+					if jsonEqual(v[i], v[j]) {
+						fail("Items must be unique")
+						break unique
+					}
+				}
+			}
+		}
+		for i, item := range v {
+			item_schema := self.items
+			if self.tupleItems != nil {
+				if item_schema = nil; i < len(self.tupleItems) {
+					item_schema = self.tupleItems[i]
+				}
+			}
+			if item_schema != nil {
+				item_schema.validate(ptr+"/"+strconv.Itoa(i), item, errs)
+			}
+		}
+	case map[string]interface{}:
+		if self.minProperties != nil && len(v) < *self.minProperties {
+			fail("Must have at least %d properties", *self.minProperties)
+		}
+		if self.maxProperties != nil && len(v) > *self.maxProperties {
+			fail("Must have at most %d properties", *self.maxProperties)
+		}
+		for _, prop := range self.required {
+			if _, ok := v[prop]; !ok {
+				fail("Missing required property '%s'", prop)
+			}
+		}
+		props := make([]string, 0, len(v))
+		for prop := range v {
+			props = append(props, prop)
+		}
+		sort.Strings(props)
+		for _, prop := range props {
+			prop_ptr := ptr + "/" + strings.Replace(strings.Replace(prop, "~", "~0", -1), "/", "~1", -1)
+			if prop_schema, ok := self.properties[prop]; ok {
+				prop_schema.validate(prop_ptr, v[prop], errs)
+			} else if self.additional != nil {
+				if self.additional.never {
+					*errs = append(*errs, SchemaError{Path: prop_ptr, Message: "Unknown property"})
+				} else {
+					self.additional.validate(prop_ptr, v[prop], errs)
+				}
+			}
+		}
+	}
+
+	for _, sub := range self.allOf {
+		sub.validate(ptr, v, errs)
+	}
+	if self.anyOf != nil {
+		ok := false
+		for _, sub := range self.anyOf {
+			if sub.matches(v) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			fail("Doesn't match any of anyOf")
+		}
+	}
+	if self.oneOf != nil {
+		matched := 0
+		for _, sub := range self.oneOf {
+			if sub.matches(v) {
+				matched++
+			}
+		}
+		if matched != 1 {
+			fail("Must match exactly one of oneOf, matched %d", matched)
+		}
+	}
+	if self.not != nil && self.not.matches(v) {
+		fail("Must not match not")
+	}
+}
@@ -0,0 +1,116 @@
+package app_context
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeSchemas(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, contents := range files {
+		file := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(file, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestSchemaRegistry(t *testing.T) {
+	dir := writeSchemas(t, map[string]string{
+		"common.json": `{"definitions": {
+			"money": {"type": "object", "required": ["amount", "currency"], "properties": {
+				"amount": {"type": "integer", "minimum": 0},
+				"currency": {"enum": ["USD", "EUR"]}
+			}, "additionalProperties": false}
+		}}`,
+		"orders/create.json": `{
+			"type": "object",
+			"required": ["id", "total"],
+			"properties": {
+				"id": {"type": "string", "pattern": "^ord_[a-z0-9]+$"},
+				"total": {"$ref": "../common.json#/definitions/money"},
+				"tags": {"type": "array", "items": {"type": "string", "maxLength": 8}, "uniqueItems": true},
+				"note": {"oneOf": [{"type": "null"}, {"type": "string", "minLength": 1}]}
+			}
+		}`,
+		"README.md": "not a schema",
+	})
+
+	os.Setenv("JSON_SCHEMA_FILEPATH", dir)
+	defer os.Unsetenv("JSON_SCHEMA_FILEPATH")
+
+	app_ctx, err := NewAppContext("json_schema_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app_ctx.Close()
+
+	schemas := app_ctx.SchemaRegistry()
+	if names := strings.Join(schemas.Names(), ","); names != "common,orders/create" {
+		t.Errorf("Unexpected schemas: %s", names)
+	}
+
+	valid := `{"id": "ord_1", "total": {"amount": 1200, "currency": "USD"}, "tags": ["a", "b"], "note": null}`
+	if err := schemas.ValidateDocument("orders/create", []byte(valid)); err != nil {
+		t.Errorf("Expected a valid document, got %s", err)
+	}
+
+	invalid := `{"id": "order-1", "total": {"amount": 1.5, "currency": "GBP", "extra": 1}, "tags": ["a", "a", "toolongtag"], "note": ""}`
+	err = schemas.ValidateDocument("orders/create", []byte(invalid))
+	var verr *SchemaValidationError
+	if !errors.As(err, &verr) {
+		t.Fatalf("Expected a SchemaValidationError, got %v", err)
+	}
+	paths := make(map[string]bool)
+	for _, e := range verr.Errors {
+		paths[e.Path] = true
+	}
+	for _, path := range []string{"/id", "/total/amount", "/total/currency", "/total/extra", "/tags", "/tags/2", "/note"} {
+		if !paths[path] {
+			t.Errorf("Expected an error at %s, got %+v", path, verr.Errors)
+		}
+	}
+	if !errors.Is(err, ErrInvalidDocument) {
+		t.Error("Validation errors should match ErrInvalidDocument")
+	}
+	if code := app_ctx.ErrorCodes().AppError(err).Code; code != "invalid_argument" {
+		t.Errorf("Expected validation errors to render as invalid_argument, got %s", code)
+	}
+
+	if err := schemas.ValidateDocument("orders/create", []byte(`{"id": "ord_1"}`)); err == nil || !strings.Contains(err.Error(), "'total'") {
+		t.Errorf("Expected a missing property, got %v", err)
+	}
+	if err := schemas.ValidateDocument("orders/create", []byte(`{`)); !errors.Is(err, ErrInvalidDocument) {
+		t.Errorf("Expected invalid JSON to fail validation, got %v", err)
+	}
+	if err := schemas.ValidateDocument("orders/missing", []byte(`{}`)); err == nil || errors.Is(err, ErrInvalidDocument) {
+		t.Errorf("Expected an unknown schema error, got %v", err)
+	}
+}
+
+func TestSchemaRegistryInvalid(t *testing.T) {
+	for name, schema := range map[string]string{
+		"json":    `{"type": "object"`,
+		"type":    `{"type": "float"}`,
+		"pattern": `{"type": "string", "pattern": "("}`,
+		"ref":     `{"properties": {"a": {"$ref": "#/definitions/missing"}}}`,
+		"count":   `{"minLength": -1}`,
+	} {
+		os.Setenv("JSON_SCHEMA_FILEPATH", writeSchemas(t, map[string]string{"bad.json": schema}))
+		app_ctx, err := NewAppContext("json_schema_test")
+		if err == nil {
+			app_ctx.Close()
+			t.Errorf("Expected an invalid %s to fail startup", name)
+		}
+	}
+	os.Unsetenv("JSON_SCHEMA_FILEPATH")
+}
@@ -0,0 +1,236 @@
+package app_context
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+type KafkaMessage struct {
+	Topic     string
+	Key       []byte
+	Value     []byte
+	Headers   map[string][]byte
+	Partition int32
+	Offset    int64
+}
+
+type KafkaConfig struct {
+	Brokers       []string
+	ClientID      string
+	ConsumerGroup string
+	TLSEnabled    bool
+	SASLMechanism string
+	SASLUsername  string
+	SASLPassword  string
+}
+
+type KafkaProducer interface {
+	Produce(ctx context.Context, msg *KafkaMessage) error
+	Close() error
+}
+
+type KafkaConsumerHandler func(ctx context.Context, msg *KafkaMessage) error
+
+type KafkaConsumerGroup interface {
+	// Consume blocks, calling handler for each message on the given
+	// topics, until ctx is done or the group is closed.
+	Consume(ctx context.Context, topics []string, handler KafkaConsumerHandler) error
+	Close() error
+}
+
+// A KafkaDriver creates the real producer and consumer group. This package
+// doesn't link a kafka library itself: services register one (usually from
+// an init() in a small adapter package), the same way lib/pq registers
+// itself with database/sql.
+type KafkaDriver interface {
+	NewProducer(config *KafkaConfig) (KafkaProducer, error)
+	NewConsumerGroup(config *KafkaConfig) (KafkaConsumerGroup, error)
+}
+
+var kafkaDriversLock sync.Mutex
+var kafkaDrivers = make(map[string]KafkaDriver)
+
+func RegisterKafkaDriver(name string, driver KafkaDriver) {
+	kafkaDriversLock.Lock()
+	defer kafkaDriversLock.Unlock()
+
+	if driver == nil {
+		panic("app_context: RegisterKafkaDriver driver is nil")
+	}
+	if _, ok := kafkaDrivers[name]; ok {
+		panic("app_context: RegisterKafkaDriver called twice for driver " + name)
+	}
+	kafkaDrivers[name] = driver
+}
+
+func getKafkaDriver(name string) (KafkaDriver, error) {
+	kafkaDriversLock.Lock()
+	defer kafkaDriversLock.Unlock()
+
+	if name != "" {
+		if driver, ok := kafkaDrivers[name]; ok {
+			return driver, nil
+		}
+		return nil, fmt.Errorf("Unknown kafka driver '%s'", name)
+	}
+
+	if len(kafkaDrivers) == 0 {
+		return nil, errors.New("KAFKA_BROKERS is set but no kafka driver is registered")
+	}
+	if len(kafkaDrivers) > 1 {
+		return nil, errors.New("Multiple kafka drivers are registered, set KAFKA_DRIVER")
+	}
+
+	for _, driver := range kafkaDrivers {
+		return driver, nil
+	}
+
+	return nil, nil
+}
+
+type noopKafkaProducer struct{}
+
+func (self *noopKafkaProducer) Produce(ctx context.Context, msg *KafkaMessage) error {
+	return nil
+}
+
+func (self *noopKafkaProducer) Close() error {
+	return nil
+}
+
+type noopKafkaConsumerGroup struct {
+	closeOnce sync.Once
+	closeChan chan struct{}
+}
+
+func (self *noopKafkaConsumerGroup) Consume(ctx context.Context, topics []string, handler KafkaConsumerHandler) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-self.closeChan:
+		return nil
+	}
+}
+
+func (self *noopKafkaConsumerGroup) Close() error {
+	self.closeOnce.Do(func() { close(self.closeChan) })
+	return nil
+}
+
+func NewNOOPKafkaProducer() KafkaProducer {
+	return &noopKafkaProducer{}
+}
+
+func NewNOOPKafkaConsumerGroup() KafkaConsumerGroup {
+	return &noopKafkaConsumerGroup{closeChan: make(chan struct{})}
+}
+
+func (self *baseAppContext) KafkaProducer() KafkaProducer {
+	return self.kafkaProducer
+}
+
+func (self *baseAppContext) KafkaConsumerGroup() KafkaConsumerGroup {
+	return self.kafkaConsumerGroup
+}
+
+func (self *baseAppContext) KafkaEnabled() bool {
+	return self.kafkaEnabled
+}
+
+func (self *baseAppContext) setKafkaFromEnv() error {
+	if disabled, err := self.isDisabled("KAFKA"); disabled {
+		return err
+	}
+
+	brokers_str := self.getEnv("KAFKA_BROKERS")
+	if brokers_str == "" {
+		return nil
+	}
+
+	config := &KafkaConfig{
+		ClientID:      self.appName,
+		ConsumerGroup: self.appName,
+	}
+
+	for _, broker := range strings.Split(brokers_str, ",") {
+		if broker = strings.TrimSpace(broker); len(broker) > 0 {
+			config.Brokers = append(config.Brokers, broker)
+		}
+	}
+
+	if len(config.Brokers) == 0 {
+		return errors.New("KAFKA_BROKERS contains no brokers")
+	}
+
+	if client_id := self.getEnv("KAFKA_CLIENT_ID"); client_id != "" {
+		config.ClientID = client_id
+	}
+
+	if group := self.getEnv("KAFKA_CONSUMER_GROUP"); group != "" {
+		config.ConsumerGroup = group
+	}
+
+	if tls, _, err := self.getBoolFromEnv("KAFKA_TLS"); err != nil {
+		return err
+	} else {
+		config.TLSEnabled = tls
+	}
+
+	config.SASLMechanism = strings.ToUpper(self.getEnv("KAFKA_SASL_MECHANISM"))
+	config.SASLUsername = self.getEnv("KAFKA_SASL_USERNAME")
+	config.SASLPassword = self.getEnv("KAFKA_SASL_PASSWORD")
+
+	if config.SASLMechanism == "" && config.SASLUsername != "" {
+		config.SASLMechanism = "PLAIN"
+	}
+
+	switch config.SASLMechanism {
+	case "":
+	case "PLAIN", "SCRAM-SHA-256", "SCRAM-SHA-512":
+		if config.SASLUsername == "" {
+			return errors.New("KAFKA_SASL_USERNAME is required when SASL is enabled")
+		}
+	default:
+		return fmt.Errorf("Unknown KAFKA_SASL_MECHANISM: %s", config.SASLMechanism)
+	}
+
+	driver, err := getKafkaDriver(self.getEnv("KAFKA_DRIVER"))
+	if err != nil {
+		return err
+	}
+
+	producer, err := driver.NewProducer(config)
+	if err != nil {
+		return fmt.Errorf("Error creating kafka producer: %s", err)
+	}
+
+	consumer, err := driver.NewConsumerGroup(config)
+	if err != nil {
+		producer.Close()
+		return fmt.Errorf("Error creating kafka consumer group: %s", err)
+	}
+
+	self.kafkaConfig = config
+	self.kafkaProducer = producer
+	self.kafkaConsumerGroup = consumer
+	self.kafkaEnabled = true
+
+	return nil
+}
+
+func (self *baseAppContext) closeKafka() error {
+	var first_err error
+
+	if err := self.kafkaConsumerGroup.Close(); err != nil {
+		first_err = fmt.Errorf("Error closing kafka consumer group: %s", err)
+	}
+
+	if err := self.kafkaProducer.Close(); err != nil && first_err == nil {
+		first_err = fmt.Errorf("Error closing kafka producer: %s", err)
+	}
+
+	return first_err
+}
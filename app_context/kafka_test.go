@@ -0,0 +1,137 @@
+package app_context
+
+import (
+	"context"
+	"log"
+	"os"
+	"testing"
+)
+
+type testKafkaProducer struct {
+	config *KafkaConfig
+	closed bool
+}
+
+func (self *testKafkaProducer) Produce(ctx context.Context, msg *KafkaMessage) error {
+	return nil
+}
+
+func (self *testKafkaProducer) Close() error {
+	self.closed = true
+	return nil
+}
+
+type testKafkaConsumerGroup struct {
+	closed bool
+}
+
+func (self *testKafkaConsumerGroup) Consume(ctx context.Context, topics []string, handler KafkaConsumerHandler) error {
+	return nil
+}
+
+func (self *testKafkaConsumerGroup) Close() error {
+	self.closed = true
+	return nil
+}
+
+type testKafkaDriver struct{}
+
+func (self *testKafkaDriver) NewProducer(config *KafkaConfig) (KafkaProducer, error) {
+	return &testKafkaProducer{config: config}, nil
+}
+
+func (self *testKafkaDriver) NewConsumerGroup(config *KafkaConfig) (KafkaConsumerGroup, error) {
+	return &testKafkaConsumerGroup{}, nil
+}
+
+func init() {
+	RegisterKafkaDriver("kafka_test", &testKafkaDriver{})
+}
+
+func TestKafkaNOOP(t *testing.T) {
+	os.Unsetenv("KAFKA_BROKERS")
+
+	app_ctx, err := NewAppContext("kafka_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if app_ctx.KafkaEnabled() {
+		t.Error("No KAFKA_BROKERS but kafka is enabled")
+	}
+
+	if err := app_ctx.KafkaProducer().Produce(context.Background(), &KafkaMessage{}); err != nil {
+		t.Errorf("NOOP producer returned an error: %s", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := app_ctx.KafkaConsumerGroup().Consume(ctx, nil, nil); err != context.Canceled {
+		t.Errorf("NOOP consumer didn't return on cancel: %v", err)
+	}
+
+	if err := app_ctx.Close(); err != nil {
+		t.Errorf("Close failed: %s", err)
+	}
+}
+
+func TestKafkaFromEnv(t *testing.T) {
+	os.Setenv("KAFKA_BROKERS", "k1:9092, k2:9092")
+	os.Setenv("KAFKA_TLS", "true")
+	os.Setenv("KAFKA_SASL_USERNAME", "user")
+	os.Setenv("KAFKA_SASL_PASSWORD", "pass")
+	defer func() {
+		os.Unsetenv("KAFKA_BROKERS")
+		os.Unsetenv("KAFKA_TLS")
+		os.Unsetenv("KAFKA_SASL_USERNAME")
+		os.Unsetenv("KAFKA_SASL_PASSWORD")
+		os.Unsetenv("KAFKA_SASL_MECHANISM")
+	}()
+
+	app_ctx, err := NewAppContext("kafka_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if !app_ctx.KafkaEnabled() {
+		t.Error("KAFKA_BROKERS set but kafka is disabled")
+	}
+
+	producer, ok := app_ctx.KafkaProducer().(*testKafkaProducer)
+	if !ok {
+		t.Fatalf("producer is not from the registered driver: %T", app_ctx.KafkaProducer())
+	}
+
+	config := producer.config
+	if len(config.Brokers) != 2 || config.Brokers[1] != "k2:9092" {
+		t.Errorf("Brokers not parsed correctly: %+v", config.Brokers)
+	}
+
+	if !config.TLSEnabled {
+		t.Error("KAFKA_TLS=true but TLS is not enabled")
+	}
+
+	if config.SASLMechanism != "PLAIN" {
+		t.Errorf("SASL mechanism did not default to PLAIN: %s", config.SASLMechanism)
+	}
+
+	if config.ConsumerGroup != "kafka_test" {
+		t.Errorf("Consumer group did not default to app name: %s", config.ConsumerGroup)
+	}
+
+	consumer := app_ctx.KafkaConsumerGroup().(*testKafkaConsumerGroup)
+
+	if err := app_ctx.Close(); err != nil {
+		t.Errorf("Close failed: %s", err)
+	}
+
+	if !producer.closed || !consumer.closed {
+		t.Error("Close didn't close the kafka clients")
+	}
+
+	os.Setenv("KAFKA_SASL_MECHANISM", "GSSAPI")
+
+	if _, err := NewAppContext("kafka_test"); err == nil {
+		t.Error("app context should have failed with unknown SASL mechanism")
+	}
+}
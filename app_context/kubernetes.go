@@ -0,0 +1,87 @@
+package app_context
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// KubernetesInfo is where the app is running in a Kubernetes cluster
+type KubernetesInfo struct {
+	PodName        string `json:"pod_name"`
+	Namespace      string `json:"namespace"`
+	NodeName       string `json:"node_name,omitempty"`
+	PodIP          string `json:"pod_ip,omitempty"`
+	ServiceAccount string `json:"service_account,omitempty"`
+}
+
+// serviceAccountDir is where Kubernetes mounts the pod's service account
+var serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// metricsTags are the default tags for metrics, named like the Datadog
+// agent's Kubernetes tags so they line up with its own metrics
+func (self *KubernetesInfo) metricsTags() map[string]string {
+	tags := map[string]string{
+		"pod_name":       self.PodName,
+		"kube_namespace": self.Namespace,
+	}
+	if self.NodeName != "" {
+		tags["kube_node"] = self.NodeName
+	}
+	return tags
+}
+
+func (self *KubernetesInfo) logFields() map[string]interface{} {
+	fields := map[string]interface{}{
+		"pod":       self.PodName,
+		"namespace": self.Namespace,
+	}
+	if self.NodeName != "" {
+		fields["node"] = self.NodeName
+	}
+	return fields
+}
+
+// Kubernetes is the pod the app is running in, or nil outside Kubernetes
+func (self *baseAppContext) Kubernetes() *KubernetesInfo {
+	return self.kubernetes
+}
+
+// Kubernetes is detected from KUBERNETES_SERVICE_HOST, which the kubelet
+// sets in every container. The rest comes from downward API variables the
+// pod spec should set: POD_NAME (metadata.name), POD_NAMESPACE
+// (metadata.namespace), NODE_NAME (spec.nodeName), POD_IP (status.podIP)
+// and POD_SERVICE_ACCOUNT (spec.serviceAccountName). Without them, the pod
+// name falls back to the hostname and the namespace to the service account
+// mount. KUBERNETES_METADATA_DISABLE=true turns this off.
+func (self *baseAppContext) setKubernetesFromEnv() error {
+	if disabled, err := self.isDisabled("KUBERNETES_METADATA"); disabled {
+		return err
+	}
+	if self.getEnv("KUBERNETES_SERVICE_HOST") == "" {
+		return nil
+	}
+
+	info := &KubernetesInfo{
+		PodName:        self.getEnv("POD_NAME"),
+		Namespace:      self.getEnv("POD_NAMESPACE"),
+		NodeName:       self.getEnv("NODE_NAME"),
+		PodIP:          self.getEnv("POD_IP"),
+		ServiceAccount: self.getEnv("POD_SERVICE_ACCOUNT"),
+	}
+
+	if info.PodName == "" {
+		// A pod's hostname is its name unless spec.hostname is set
+		if host, err := os.Hostname(); err == nil {
+			info.PodName = host
+		}
+	}
+	if info.Namespace == "" {
+		if data, err := ioutil.ReadFile(serviceAccountDir + "/namespace"); err == nil {
+			info.Namespace = strings.TrimSpace(string(data))
+		}
+	}
+
+	self.kubernetes = info
+	return nil
+}
@@ -0,0 +1,70 @@
+package app_context
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestKubernetesMetadata(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kubernetes_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "namespace"), []byte("payments\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	old_dir := serviceAccountDir
+	serviceAccountDir = dir
+	defer func() { serviceAccountDir = old_dir }()
+
+	app_ctx, err := NewAppContext("kubernetes_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if app_ctx.Kubernetes() != nil {
+		t.Errorf("Expected no kubernetes info outside kubernetes, got %+v", app_ctx.Kubernetes())
+	}
+	app_ctx.Close()
+
+	for name, val := range map[string]string{
+		"KUBERNETES_SERVICE_HOST": "10.0.0.1",
+		"POD_NAME":                "billing-7d9f-x2k4p",
+		"NODE_NAME":               "ip-10-1-2-3",
+	} {
+		os.Setenv(name, val)
+		defer os.Unsetenv(name)
+	}
+
+	app_ctx, err = NewAppContext("kubernetes_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer app_ctx.Close()
+
+	info := app_ctx.Kubernetes()
+	if info == nil {
+		t.Fatal("Expected kubernetes to be detected")
+	}
+	if info.PodName != "billing-7d9f-x2k4p" || info.NodeName != "ip-10-1-2-3" {
+		t.Errorf("Unexpected pod info: %+v", info)
+	}
+	if info.Namespace != "payments" {
+		t.Errorf("Expected the namespace from the service account, got '%s'", info.Namespace)
+	}
+
+	tags := app_ctx.MetricsClient().GetTags()
+	if tags["pod_name"] != "billing-7d9f-x2k4p" || tags["kube_namespace"] != "payments" || tags["kube_node"] != "ip-10-1-2-3" {
+		t.Errorf("Expected kubernetes metrics tags: %+v", tags)
+	}
+
+	app_ctx.Logger().LogInfo(context.Background(), "kubernetes_test")
+	entries := app_ctx.LogRing().Last(1)
+	if len(entries) != 1 || entries[0].Fields["pod"] != "billing-7d9f-x2k4p" || entries[0].Fields["namespace"] != "payments" {
+		t.Errorf("Expected kubernetes log fields: %+v", entries)
+	}
+}
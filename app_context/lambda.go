@@ -0,0 +1,152 @@
+package app_context
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+)
+
+var lambdaAppContexts = struct {
+	lock     sync.Mutex
+	contexts map[string]AppContext
+}{contexts: make(map[string]AppContext)}
+
+// withLambda is NewLambdaAppContext's setup: nothing connects until it's
+// used and no heartbeats run, since the process is frozen between
+// invocations
+func withLambda() Option {
+	return func(appctx *baseAppContext) {
+		appctx.lambda = true
+	}
+}
+
+// NewLambdaAppContext is NewAppContext for Lambda and other serverless
+// handlers. The app context is created on the first call and returned
+// again on later ones, so warm invocations skip setting it up. The message
+// bus connects the first time it's used rather than during the cold start.
+// Use LambdaHandler for each invocation's request context and flushing.
+func NewLambdaAppContext(app_name string, opts ...Option) (AppContext, error) {
+	lambdaAppContexts.lock.Lock()
+	defer lambdaAppContexts.lock.Unlock()
+
+	if appctx, ok := lambdaAppContexts.contexts[app_name]; ok {
+		return appctx, nil
+	}
+	appctx, err := NewAppContext(app_name, append([]Option{withLambda()}, opts...)...)
+	if err != nil {
+		return nil, err
+	}
+	lambdaAppContexts.contexts[app_name] = appctx
+	return appctx, nil
+}
+
+// A LambdaFunc handles one invocation, with a request context derived from
+// its event
+type LambdaFunc func(reqctx RequestAppContext, event json.RawMessage) (interface{}, error)
+
+// lambdaEvent is the part of API Gateway REST (v1) and HTTP (v2) proxy
+// events a request context needs
+type lambdaEvent struct {
+	HTTPMethod            string            `json:"httpMethod"`
+	Path                  string            `json:"path"`
+	RawPath               string            `json:"rawPath"`
+	RawQueryString        string            `json:"rawQueryString"`
+	Headers               map[string]string `json:"headers"`
+	QueryStringParameters map[string]string `json:"queryStringParameters"`
+	RequestContext        struct {
+		RequestID string `json:"requestId"`
+		HTTP      struct {
+			Method string `json:"method"`
+		} `json:"http"`
+	} `json:"requestContext"`
+}
+
+// lambdaRequest is the request an invocation of event is handled as. An
+// API Gateway event keeps its method, path, query and headers; anything
+// else is a POST to /<function name>.
+func lambdaRequest(ctx context.Context, function_name string, event json.RawMessage) *http.Request {
+	var ev lambdaEvent
+	json.Unmarshal(event, &ev)
+
+	method, path, query := ev.HTTPMethod, ev.Path, ev.RawQueryString
+	if method == "" {
+		method, path = ev.RequestContext.HTTP.Method, ev.RawPath
+	}
+	if method == "" {
+		method, path = "POST", "/"+function_name
+	}
+	if path == "" {
+		path = "/"
+	}
+	if query == "" && len(ev.QueryStringParameters) > 0 {
+		values := url.Values{}
+		for k, v := range ev.QueryStringParameters {
+			values.Set(k, v)
+		}
+		query = values.Encode()
+	}
+
+	if ev.RequestContext.RequestID != "" {
+		ctx = WithRequestID(ctx, ev.RequestContext.RequestID)
+	}
+	r, err := http.NewRequestWithContext(ctx, strings.ToUpper(method), "/", nil)
+	if err != nil {
+		r, _ = http.NewRequestWithContext(ctx, "POST", "/", nil)
+	}
+	r.URL.Path, r.URL.RawQuery = path, query
+	for k, v := range ev.Headers {
+		r.Header.Set(k, v)
+	}
+	if host := r.Header.Get("Host"); host != "" {
+		r.Host = host
+	}
+	return r
+}
+
+// flushClients sends anything the metrics and rollbar clients have
+// buffered, for when the process may not get to exit cleanly
+func flushClients(appctx AppContext) {
+	type flusher interface {
+		Flush() error
+	}
+	for _, client := range []interface{}{appctx.MetricsClient(), appctx.RollbarClient()} {
+		if f, ok := client.(flusher); ok {
+			f.Flush()
+		}
+	}
+}
+
+// LambdaHandler adapts fn to the handler signature aws-lambda-go's
+// lambda.Start takes. Each invocation gets a RequestAppContext for its
+// event, with the API Gateway request ID when there is one, and is
+// finished with the status ErrorCodes gives its error (200 without one).
+// Errors that would be 500s, and panics, are logged and reported. Metrics
+// and rollbar are flushed before the invocation returns, since a frozen
+// or recycled process never gets to Close.
+func LambdaHandler(appctx AppContext, fn LambdaFunc) func(context.Context, json.RawMessage) (interface{}, error) {
+	return func(ctx context.Context, event json.RawMessage) (result interface{}, err error) {
+		r := lambdaRequest(ctx, os.Getenv("AWS_LAMBDA_FUNCTION_NAME"), event)
+		reqctx := appctx.ForRequest(r)
+
+		defer func() {
+			if p := recover(); p != nil {
+				result, err = nil, &panicError{method: r.Method, path: r.URL.Path, value: p}
+			}
+			status := http.StatusOK
+			if err != nil {
+				status = appctx.ErrorCodes().HTTPStatus(err)
+				if status >= 500 {
+					reqctx.ReportError(err, nil)
+				}
+			}
+			reqctx.Finish(status)
+			flushClients(appctx)
+		}()
+
+		return fn(reqctx, event)
+	}
+}
@@ -0,0 +1,120 @@
+package app_context
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"testing"
+)
+
+type flushingMetricsClient struct {
+	*countingMetricsClient
+	flushes int
+}
+
+func (self *flushingMetricsClient) Flush() error {
+	self.flushes++
+	return nil
+}
+
+func TestLambdaRequest(t *testing.T) {
+	for name, test := range map[string]struct {
+		event, method, path, query, request_id string
+	}{
+		"v1": {
+			event:      `{"httpMethod": "get", "path": "/orders/1", "queryStringParameters": {"full": "1"}, "headers": {"x-tenant": "acme"}, "requestContext": {"requestId": "req-1"}}`,
+			method:     "GET",
+			path:       "/orders/1",
+			query:      "full=1",
+			request_id: "req-1",
+		},
+		"v2": {
+			event:      `{"rawPath": "/orders", "rawQueryString": "page=2", "requestContext": {"requestId": "req-2", "http": {"method": "POST"}}}`,
+			method:     "POST",
+			path:       "/orders",
+			query:      "page=2",
+			request_id: "req-2",
+		},
+		"other": {
+			event:  `{"Records": []}`,
+			method: "POST",
+			path:   "/orders-fn",
+		},
+	} {
+		r := lambdaRequest(context.Background(), "orders-fn", json.RawMessage(test.event))
+		if r.Method != test.method || r.URL.Path != test.path || r.URL.RawQuery != test.query {
+			t.Errorf("%s: unexpected request %s %s?%s", name, r.Method, r.URL.Path, r.URL.RawQuery)
+		}
+		if id := RequestIDFromContext(r.Context()); id != test.request_id {
+			t.Errorf("%s: expected request ID '%s', got '%s'", name, test.request_id, id)
+		}
+	}
+	r := lambdaRequest(context.Background(), "fn", json.RawMessage(`{"httpMethod": "GET", "headers": {"x-tenant": "acme"}}`))
+	if r.Header.Get("X-Tenant") != "acme" {
+		t.Errorf("Expected the event's headers, got %v", r.Header)
+	}
+}
+
+func TestLambdaHandler(t *testing.T) {
+	// Nothing listens here, which is only noticed when the bus is used
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	nats_url := "nats://" + l.Addr().String()
+	l.Close()
+	os.Setenv("NATS_URL", nats_url)
+	defer os.Unsetenv("NATS_URL")
+
+	app_ctx, err := NewLambdaAppContext("lambda_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app_ctx.Close()
+	if again, _ := NewLambdaAppContext("lambda_test"); again != app_ctx {
+		t.Error("Expected warm invocations to get the same app context")
+	}
+	if err := app_ctx.MessageBus().Publish("lambda.test", nil); err == nil {
+		t.Error("Expected the message bus to connect on first use")
+	}
+
+	mcli := &flushingMetricsClient{countingMetricsClient: newCountingMetricsClient()}
+	app_ctx.SetMetricsClient(mcli)
+
+	var request_id string
+	handler := LambdaHandler(app_ctx, func(reqctx RequestAppContext, event json.RawMessage) (interface{}, error) {
+		request_id = reqctx.RequestID()
+		switch string(event) {
+		case `"fail"`:
+			return nil, errors.New("Failed")
+		case `"missing"`:
+			return nil, ErrObjectNotFound
+		case `"panic"`:
+			panic("oops")
+		}
+		return "ok", nil
+	})
+
+	result, err := handler(context.Background(), json.RawMessage(`{"httpMethod": "GET", "path": "/", "requestContext": {"requestId": "abc"}}`))
+	if err != nil || result != "ok" || request_id != "abc" {
+		t.Errorf("Unexpected result %v, %v with request ID %s", result, err, request_id)
+	}
+	if _, err := handler(context.Background(), json.RawMessage(`"fail"`)); err == nil {
+		t.Error("Expected the handler's error")
+	}
+	if _, err := handler(context.Background(), json.RawMessage(`"missing"`)); !errors.Is(err, ErrObjectNotFound) {
+		t.Errorf("Expected the handler's error, got %v", err)
+	}
+	if _, err := handler(context.Background(), json.RawMessage(`"panic"`)); err == nil {
+		t.Error("Expected a panic to be returned as an error")
+	}
+
+	if n := mcli.count("request.count"); n != 4 {
+		t.Errorf("Expected every invocation to be finished, got %d", n)
+	}
+	if mcli.flushes != 4 {
+		t.Errorf("Expected metrics flushed after every invocation, got %d", mcli.flushes)
+	}
+}
@@ -0,0 +1,218 @@
+package app_context
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// LeaderElection picks one replica of the app to be the leader, through a
+// lock from Locks(), so it's in Postgres or Redis as LOCK_BACKEND says.
+// Followers try to take over every third of LEADER_ELECTION_TTL; a leader
+// that can't renew its lock steps down. Close steps down, so a follower
+// takes over without waiting for the TTL.
+//
+// Without LEADER_ELECTION every replica is the leader.
+type LeaderElection interface {
+	IsLeader() bool
+	// OnGain is called when this replica becomes the leader, or at once
+	// if it already is
+	OnGain(fn func())
+	// OnLoss is called when this replica stops being the leader
+	OnLoss(fn func())
+}
+
+type leaderElection struct {
+	appctx  *baseAppContext
+	enabled bool
+	name    string
+	ttl     time.Duration
+
+	lock     sync.Mutex
+	leader   bool
+	held     Lock
+	since    time.Time
+	gains    []func()
+	losses   []func()
+	stopChan chan struct{}
+	doneChan chan struct{}
+}
+
+func newLeaderElection(appctx *baseAppContext) *leaderElection {
+	return &leaderElection{
+		appctx: appctx,
+		name:   "leader",
+		ttl:    15 * time.Second,
+	}
+}
+
+func (self *leaderElection) IsLeader() bool {
+	if !self.enabled {
+		return true
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.leader
+}
+
+func (self *leaderElection) OnGain(fn func()) {
+	self.lock.Lock()
+	self.gains = append(self.gains, fn)
+	leader := self.leader || !self.enabled
+	self.lock.Unlock()
+	if leader {
+		fn()
+	}
+}
+
+func (self *leaderElection) OnLoss(fn func()) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.losses = append(self.losses, fn)
+}
+
+// set records whether we're the leader, and calls the callbacks if that
+// changed
+func (self *leaderElection) set(leader bool, held Lock) {
+	self.lock.Lock()
+	if self.leader == leader {
+		self.lock.Unlock()
+		return
+	}
+	self.leader, self.held = leader, held
+	self.since = self.appctx.now()
+	callbacks := self.losses
+	if leader {
+		callbacks = self.gains
+	}
+	callbacks = append([]func(){}, callbacks...)
+	self.lock.Unlock()
+
+	gauge := 0.0
+	if leader {
+		gauge = 1.0
+		self.appctx.Logger().LogInfof(context.Background(), "Became the leader for '%s'", self.name)
+	} else {
+		self.appctx.Logger().LogInfof(context.Background(), "Stopped being the leader for '%s'", self.name)
+	}
+	self.appctx.MetricsClient().Gauge("leader_election.leader", gauge, 1.0, map[string]string{"election": self.name})
+
+	for _, fn := range callbacks {
+		fn()
+	}
+}
+
+// campaign tries to become the leader, returning the lock's Lost channel
+// if it did
+func (self *leaderElection) campaign() <-chan struct{} {
+	ctx, cancel := context.WithTimeout(context.Background(), self.ttl/3)
+	defer cancel()
+
+	held, err := self.appctx.locks.TryLock(ctx, "leader:"+self.name, self.ttl)
+	if err != nil {
+		if err != ErrLockHeld {
+			self.appctx.Logger().LogWarnf(ctx, "Error campaigning for leader of '%s': %s", self.name, err)
+		}
+		return nil
+	}
+	self.set(true, held)
+	return held.Lost()
+}
+
+func (self *leaderElection) start() {
+	stop_chan, done_chan := make(chan struct{}), make(chan struct{})
+	self.stopChan, self.doneChan = stop_chan, done_chan
+	// Real time, since that's what the lock expires by
+	ticker := NewRealClock().NewTicker(self.ttl / 3)
+	goLabeled("leader_election", func() {
+		defer close(done_chan)
+		defer ticker.Stop()
+		lost := self.campaign()
+		for {
+			select {
+			case <-stop_chan:
+				return
+			case <-lost:
+				lost = nil
+				self.stepDown()
+			case <-ticker.C():
+				if lost == nil {
+					lost = self.campaign()
+				}
+			}
+		}
+	})
+}
+
+func (self *leaderElection) stepDown() {
+	self.lock.Lock()
+	held := self.held
+	self.lock.Unlock()
+	if held == nil {
+		return
+	}
+	self.set(false, nil)
+	if err := held.Unlock(); err != nil {
+		self.appctx.Logger().LogWarnf(context.Background(), "%s", err)
+	}
+}
+
+// stop stops campaigning and steps down
+func (self *leaderElection) stop() {
+	if self.stopChan == nil {
+		return
+	}
+	close(self.stopChan)
+	<-self.doneChan
+	self.stopChan = nil
+	self.stepDown()
+}
+
+func (self *leaderElection) status() map[string]interface{} {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	status := map[string]interface{}{
+		"enabled": self.enabled,
+		"leader":  self.leader || !self.enabled,
+	}
+	if self.enabled {
+		status["name"] = self.name
+		status["ttl"] = self.ttl.String()
+		if self.leader {
+			status["since"] = self.since
+		}
+	}
+	return status
+}
+
+func (self *baseAppContext) LeaderElection() LeaderElection {
+	return self.leaderElection
+}
+
+// LEADER_ELECTION turns on electing a leader among the replicas.
+// LEADER_ELECTION_NAME (default leader) names the election, for apps that
+// share a lock backend, and LEADER_ELECTION_TTL (default 15s) is how long
+// a leader that's gone away keeps it.
+func (self *baseAppContext) setLeaderElectionFromEnv() error {
+	election := self.leaderElection
+	var err error
+	if election.enabled, _, err = self.getBoolFromEnv("LEADER_ELECTION"); err != nil {
+		return err
+	}
+	if name := self.getEnv("LEADER_ELECTION_NAME"); name != "" {
+		election.name = name
+	}
+	if ttl, found, err := self.getDurationFromEnv("LEADER_ELECTION_TTL"); err != nil {
+		return err
+	} else if found {
+		if ttl <= 0 {
+			return errors.New("LEADER_ELECTION_TTL must be > 0")
+		}
+		election.ttl = ttl
+	}
+	if election.enabled && !self.lambda {
+		election.start()
+	}
+	return nil
+}
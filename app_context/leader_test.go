@@ -0,0 +1,65 @@
+package app_context
+
+import (
+	"log"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLeaderElectionDisabled(t *testing.T) {
+	app_ctx, err := NewAppContext("leader_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer app_ctx.Close()
+
+	gained := false
+	app_ctx.LeaderElection().OnGain(func() { gained = true })
+	if !app_ctx.LeaderElection().IsLeader() || !gained {
+		t.Error("Expected every replica to lead without LEADER_ELECTION")
+	}
+}
+
+func TestLeaderElection(t *testing.T) {
+	// Two replicas sharing one lock backend
+	replicas := make([]*baseAppContext, 2)
+	gains := make([]int32, 2)
+	losses := make([]int32, 2)
+	for i := range replicas {
+		app_ctx, err := NewAppContext("leader_test")
+		if err != nil {
+			log.Fatal(err)
+		}
+		base := app_ctx.(*baseAppContext)
+		if i > 0 {
+			base.locks.store = replicas[0].locks.backendFor()
+		}
+		i := i
+		base.leaderElection.enabled = true
+		base.leaderElection.ttl = 60 * time.Millisecond
+		base.leaderElection.OnGain(func() { atomic.AddInt32(&gains[i], 1) })
+		base.leaderElection.OnLoss(func() { atomic.AddInt32(&losses[i], 1) })
+		base.leaderElection.start()
+		replicas[i] = base
+		if i == 0 {
+			waitFor(t, "first leader", base.leaderElection.IsLeader)
+		}
+	}
+	defer replicas[1].Close()
+
+	time.Sleep(100 * time.Millisecond)
+	if replicas[1].LeaderElection().IsLeader() || atomic.LoadInt32(&gains[1]) != 0 {
+		t.Fatal("Expected only one leader")
+	}
+
+	// Closing steps down, and the other replica takes over
+	replicas[0].Close()
+	if replicas[0].LeaderElection().IsLeader() || atomic.LoadInt32(&losses[0]) != 1 {
+		t.Error("Expected Close to give up leadership")
+	}
+	waitFor(t, "new leader", replicas[1].leaderElection.IsLeader)
+	if atomic.LoadInt32(&gains[1]) != 1 {
+		t.Errorf("Expected one gain, got %d", gains[1])
+	}
+}
@@ -0,0 +1,131 @@
+package app_context
+
+import (
+	"errors"
+	"time"
+)
+
+// lifecycleMetrics are the metrics every service sends about itself, so
+// fleet dashboards work without any instrumentation of their own:
+//
+//	app.start            once NewAppContext succeeds
+//	app.heartbeat        gauge of 1 every LIFECYCLE_HEARTBEAT_INTERVAL
+//	app.uptime_seconds   gauge with each heartbeat, and at Close
+//	app.stop             at Close
+//
+// All are tagged with code_version when CODE_VERSION is set. They're about
+// the process being alive, so they run on the real clock even when a test
+// gives the app context a FakeClock, and don't count as one of its
+// waiters.
+type lifecycleMetrics struct {
+	appctx   *baseAppContext
+	started  time.Time
+	interval time.Duration
+	stopChan chan struct{}
+	doneChan chan struct{}
+}
+
+func (self *lifecycleMetrics) tags() map[string]string {
+	if self.appctx.codeVersion == "" {
+		return nil
+	}
+	return map[string]string{"code_version": self.appctx.codeVersion}
+}
+
+func (self *lifecycleMetrics) uptime() time.Duration {
+	return time.Since(self.started)
+}
+
+func (self *lifecycleMetrics) sendStart() {
+	self.appctx.MetricsClient().Incr("app.start", 1.0, self.tags())
+}
+
+func (self *lifecycleMetrics) sendHeartbeat() {
+	mcli := self.appctx.MetricsClient()
+	mcli.Gauge("app.heartbeat", 1, 1.0, self.tags())
+	mcli.Gauge("app.uptime_seconds", self.uptime().Seconds(), 1.0, self.tags())
+}
+
+func (self *lifecycleMetrics) sendStop() {
+	mcli := self.appctx.MetricsClient()
+	mcli.Gauge("app.uptime_seconds", self.uptime().Seconds(), 1.0, self.tags())
+	mcli.Incr("app.stop", 1.0, self.tags())
+}
+
+func (self *lifecycleMetrics) start() {
+	self.stopChan = make(chan struct{})
+	self.doneChan = make(chan struct{})
+	self.sendStart()
+
+	if self.interval == 0 {
+		close(self.doneChan)
+		return
+	}
+
+	ticker := NewRealClock().NewTicker(self.interval)
+	goLabeled("lifecycle_metrics", func() {
+		defer close(self.doneChan)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-self.stopChan:
+				return
+			case <-ticker.C():
+				self.sendHeartbeat()
+			}
+		}
+	})
+}
+
+// stop ends the heartbeats and sends app.stop
+func (self *lifecycleMetrics) stop() {
+	if self == nil || self.stopChan == nil {
+		return
+	}
+	close(self.stopChan)
+	<-self.doneChan
+	self.stopChan = nil
+	self.sendStop()
+}
+
+func (self *lifecycleMetrics) status() map[string]interface{} {
+	if self == nil {
+		return nil
+	}
+	return map[string]interface{}{
+		"started":            self.started,
+		"heartbeat_interval": self.interval.String(),
+	}
+}
+
+// The app.* metrics are sent from the end of startup until Close, with a
+// heartbeat every LIFECYCLE_HEARTBEAT_INTERVAL (default 10s), to whatever
+// MetricsClient() is at the time, so a client set later with
+// SetMetricsClient gets them even if METRICS_DISABLE was set.
+// LIFECYCLE_METRICS_DISABLE=true turns them off.
+func (self *baseAppContext) setLifecycleMetricsFromEnv() error {
+	if disabled, err := self.isDisabled("LIFECYCLE_METRICS"); disabled {
+		return err
+	}
+
+	lm := &lifecycleMetrics{
+		appctx:   self,
+		started:  self.startedAt,
+		interval: 10 * time.Second,
+	}
+	if self.lambda {
+		// Heartbeats from a frozen process would be meaningless
+		lm.interval = 0
+	} else if interval, found, err := self.getDurationFromEnv("LIFECYCLE_HEARTBEAT_INTERVAL"); err != nil {
+		return err
+	} else if found {
+		if interval <= 0 {
+			return errors.New("LIFECYCLE_HEARTBEAT_INTERVAL must be > 0")
+		}
+		lm.interval = interval
+	}
+
+	self.lifecycle = lm
+	lm.start()
+	return nil
+}
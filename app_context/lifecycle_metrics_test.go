@@ -0,0 +1,103 @@
+package app_context
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestLifecycleMetrics(t *testing.T) {
+	os.Setenv("CODE_VERSION", "abc123")
+	os.Setenv("LIFECYCLE_HEARTBEAT_INTERVAL", "10ms")
+	// Other tests may leave these set
+	os.Setenv("METRICS_DISABLE", "false")
+	os.Setenv("LIFECYCLE_METRICS_DISABLE", "false")
+	defer os.Unsetenv("CODE_VERSION")
+	defer os.Unsetenv("LIFECYCLE_HEARTBEAT_INTERVAL")
+	defer os.Unsetenv("METRICS_DISABLE")
+	defer os.Unsetenv("LIFECYCLE_METRICS_DISABLE")
+
+	clock := NewFakeClock(time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC))
+	app_ctx, err := NewAppContext("lifecycle_metrics_test", WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := false
+	defer func() {
+		if !closed {
+			app_ctx.Close()
+		}
+	}()
+	mcli := newCountingMetricsClient()
+	app_ctx.SetMetricsClient(mcli)
+
+	// app.start was sent before the client could be swapped
+	app_ctx.(*baseAppContext).lifecycle.sendStart()
+	if tags := mcli.tags["app.start"]; tags["code_version"] != "abc123" {
+		t.Errorf("Expected app.start tagged with the code version, got %v", tags)
+	}
+
+	// Heartbeats don't wait on the fake clock
+	waitFor(t, "a heartbeat", func() bool { return mcli.count("app.heartbeat") > 0 })
+	if mcli.count("app.uptime_seconds") == 0 {
+		t.Error("Expected uptime with the heartbeat")
+	}
+
+	app_ctx.Close()
+	closed = true
+	if n := mcli.count("app.stop"); n != 1 {
+		t.Errorf("Expected app.stop at Close, got %d", n)
+	}
+	if tags := mcli.tags["app.stop"]; tags["code_version"] != "abc123" {
+		t.Errorf("Expected app.stop tagged with the code version, got %v", tags)
+	}
+}
+
+func TestLifecycleMetricsDisabled(t *testing.T) {
+	os.Setenv("LIFECYCLE_METRICS_DISABLE", "true")
+	app_ctx, err := NewAppContext("lifecycle_metrics_test")
+	os.Unsetenv("LIFECYCLE_METRICS_DISABLE")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mcli := newCountingMetricsClient()
+	app_ctx.SetMetricsClient(mcli)
+	app_ctx.Close()
+
+	if n := mcli.count("app.stop"); n != 0 {
+		t.Errorf("Expected no app.stop with LIFECYCLE_METRICS_DISABLE, got %d", n)
+	}
+}
+
+func TestLifecycleMetricsLateClient(t *testing.T) {
+	os.Setenv("METRICS_DISABLE", "true")
+	os.Setenv("LIFECYCLE_HEARTBEAT_INTERVAL", "10ms")
+	defer os.Unsetenv("METRICS_DISABLE")
+	defer os.Unsetenv("LIFECYCLE_HEARTBEAT_INTERVAL")
+	if v, ok := os.LookupEnv("LIFECYCLE_METRICS_DISABLE"); ok {
+		os.Unsetenv("LIFECYCLE_METRICS_DISABLE")
+		defer os.Setenv("LIFECYCLE_METRICS_DISABLE", v)
+	}
+
+	app_ctx, err := NewAppContext("lifecycle_metrics_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := false
+	defer func() {
+		if !closed {
+			app_ctx.Close()
+		}
+	}()
+
+	// A client set after startup still gets the heartbeats and app.stop
+	mcli := newCountingMetricsClient()
+	app_ctx.SetMetricsClient(mcli)
+	waitFor(t, "a heartbeat", func() bool { return mcli.count("app.heartbeat") > 0 })
+
+	app_ctx.Close()
+	closed = true
+	if n := mcli.count("app.stop"); n != 1 {
+		t.Errorf("Expected app.stop at Close, got %d", n)
+	}
+}
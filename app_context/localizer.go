@@ -0,0 +1,207 @@
+package app_context
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Localizer is the translations in LOCALE_PATH, one JSON file per
+// language named for it, eg. en.json and pt-BR.json. Nested objects are
+// flattened into dotted keys, so {"errors": {"not_found": "..."}} is
+// "errors.not_found".
+type Localizer interface {
+	// T is key translated to lang, with {name} placeholders replaced by
+	// args. A key missing from lang falls back to its base language (pt
+	// for pt-BR), then LOCALE_DEFAULT. A key missing from all of them is
+	// logged once and returned as is.
+	T(lang, key string, args map[string]interface{}) string
+	// Match is the best loaded language for an Accept-Language header,
+	// or LOCALE_DEFAULT
+	Match(accept_language string) string
+	Languages() []string
+}
+
+type localizer struct {
+	appctx      *baseAppContext
+	dir         string
+	defaultLang string
+	bundles     map[string]map[string]string
+
+	lock    sync.Mutex
+	missing map[string]bool
+}
+
+func newLocalizer(appctx *baseAppContext) *localizer {
+	return &localizer{
+		appctx:      appctx,
+		defaultLang: "en",
+		bundles:     make(map[string]map[string]string),
+		missing:     make(map[string]bool),
+	}
+}
+
+func flattenTranslations(prefix string, src map[string]interface{}, dst map[string]string) error {
+	for k, v := range src {
+		key := k
+		if prefix != "" {
+			key = prefix + "." + k
+		}
+		switch v := v.(type) {
+		case string:
+			dst[key] = v
+		case map[string]interface{}:
+			if err := flattenTranslations(key, v, dst); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("'%s' is not a string or an object", key)
+		}
+	}
+	return nil
+}
+
+func (self *localizer) load() error {
+	paths, err := filepath.Glob(filepath.Join(self.dir, "*.json"))
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		var src map[string]interface{}
+		if err := json.Unmarshal(data, &src); err != nil {
+			return fmt.Errorf("Error parsing %s: %s", path, err)
+		}
+		bundle := make(map[string]string)
+		if err := flattenTranslations("", src, bundle); err != nil {
+			return fmt.Errorf("Error parsing %s: %s", path, err)
+		}
+		lang := strings.TrimSuffix(filepath.Base(path), ".json")
+		self.bundles[strings.ToLower(lang)] = bundle
+	}
+	if len(self.bundles) > 0 && self.bundles[strings.ToLower(self.defaultLang)] == nil {
+		return fmt.Errorf("No translations for LOCALE_DEFAULT '%s' in %s", self.defaultLang, self.dir)
+	}
+	return nil
+}
+
+// candidates is lang, its base language and the default, in the order
+// they're tried
+func (self *localizer) candidates(lang string) []string {
+	lang = strings.ToLower(strings.Replace(lang, "_", "-", -1))
+	langs := []string{lang}
+	if idx := strings.Index(lang, "-"); idx > 0 {
+		langs = append(langs, lang[:idx])
+	}
+	return append(langs, strings.ToLower(self.defaultLang))
+}
+
+func (self *localizer) T(lang, key string, args map[string]interface{}) string {
+	for _, candidate := range self.candidates(lang) {
+		if msg, ok := self.bundles[candidate][key]; ok {
+			return formatTranslation(msg, args)
+		}
+	}
+
+	self.appctx.MetricsClient().Incr("i18n.missing_keys", 1.0, map[string]string{"lang": lang})
+	self.lock.Lock()
+	logged := self.missing[lang+"\x00"+key]
+	self.missing[lang+"\x00"+key] = true
+	self.lock.Unlock()
+	if !logged {
+		self.appctx.Logger().LogWarnf(context.Background(), "Missing translation for '%s' in '%s'", key, lang)
+	}
+	return formatTranslation(key, args)
+}
+
+func formatTranslation(msg string, args map[string]interface{}) string {
+	if len(args) == 0 {
+		return msg
+	}
+	pairs := make([]string, 0, len(args)*2)
+	for name, value := range args {
+		pairs = append(pairs, "{"+name+"}", fmt.Sprint(value))
+	}
+	return strings.NewReplacer(pairs...).Replace(msg)
+}
+
+func (self *localizer) Match(accept_language string) string {
+	best, best_q := "", 0.0
+	for _, part := range strings.Split(accept_language, ",") {
+		fields := strings.Split(strings.TrimSpace(part), ";")
+		lang := strings.TrimSpace(fields[0])
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		if lang == "" || lang == "*" || q <= best_q {
+			continue
+		}
+		// Only lang itself or its base language, not the default
+		candidates := self.candidates(lang)
+		for _, candidate := range candidates[:len(candidates)-1] {
+			if _, ok := self.bundles[candidate]; ok {
+				best, best_q = candidate, q
+				break
+			}
+		}
+	}
+	if best == "" {
+		return self.defaultLang
+	}
+	return best
+}
+
+func (self *localizer) Languages() []string {
+	langs := make([]string, 0, len(self.bundles))
+	for lang := range self.bundles {
+		langs = append(langs, lang)
+	}
+	sort.Strings(langs)
+	return langs
+}
+
+func (self *localizer) status() map[string]interface{} {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return map[string]interface{}{
+		"path":         self.dir,
+		"default":      self.defaultLang,
+		"languages":    self.Languages(),
+		"missing_keys": len(self.missing),
+	}
+}
+
+func (self *baseAppContext) Localizer() Localizer {
+	return self.localizer
+}
+
+// LOCALE_PATH is the directory of translation files. LOCALE_DEFAULT, "en"
+// if unset, is the language used when one has no translation for a key.
+func (self *baseAppContext) setLocalizerFromEnv() error {
+	self.localizer.dir = self.getEnv("LOCALE_PATH")
+	if lang := self.getEnv("LOCALE_DEFAULT"); lang != "" {
+		self.localizer.defaultLang = lang
+	}
+	if self.localizer.dir == "" {
+		return nil
+	}
+	if err := self.localizer.load(); err != nil {
+		return fmt.Errorf("Error loading LOCALE_PATH: %s", err)
+	}
+	return nil
+}
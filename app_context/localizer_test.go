@@ -0,0 +1,92 @@
+package app_context
+
+import (
+	"log"
+	"os"
+	"testing"
+)
+
+func TestLocalizer(t *testing.T) {
+	dir := t.TempDir()
+	writeTemplateFiles(t, dir, map[string]string{
+		"en.json":    `{"greeting": "Hello, {name}!", "errors": {"not_found": "Not found"}, "bye": "Bye"}`,
+		"pt.json":    `{"greeting": "Olá, {name}!", "errors": {"not_found": "Não encontrado"}}`,
+		"pt-BR.json": `{"greeting": "Oi, {name}!"}`,
+	})
+
+	os.Setenv("LOCALE_PATH", dir)
+	defer os.Unsetenv("LOCALE_PATH")
+
+	app_ctx, err := NewAppContext("localizer_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer app_ctx.Close()
+
+	mcli := newCountingMetricsClient()
+	app_ctx.SetMetricsClient(mcli)
+	l := app_ctx.Localizer()
+
+	args := map[string]interface{}{"name": "Ana"}
+	tests := []struct {
+		lang, key, expected string
+	}{
+		{"pt-BR", "greeting", "Oi, Ana!"},
+		{"pt_br", "greeting", "Oi, Ana!"},
+		{"pt-PT", "greeting", "Olá, Ana!"},
+		{"pt-BR", "errors.not_found", "Não encontrado"},
+		{"pt-BR", "bye", "Bye"},
+		{"fr", "greeting", "Hello, Ana!"},
+		{"fr", "missing.key", "missing.key"},
+	}
+	for _, test := range tests {
+		if msg := l.T(test.lang, test.key, args); msg != test.expected {
+			t.Errorf("T(%s, %s): expected %q, got %q", test.lang, test.key, test.expected, msg)
+		}
+	}
+	l.T("fr", "missing.key", nil)
+	if mcli.count("i18n.missing_keys") != 2 || app_ctx.(*baseAppContext).localizer.status()["missing_keys"] != 1 {
+		t.Errorf("Expected the missing key to be counted, got %v", mcli.counts)
+	}
+
+	matches := map[string]string{
+		"pt-BR,pt;q=0.9,en;q=0.8": "pt-br",
+		"fr-CA, pt-PT;q=0.5":      "pt",
+		"en;q=0.2, pt;q=0.7":      "pt",
+		"de, fr":                  "en",
+		"":                        "en",
+	}
+	for header, expected := range matches {
+		if lang := l.Match(header); lang != expected {
+			t.Errorf("Match(%q): expected %s, got %s", header, expected, lang)
+		}
+	}
+}
+
+func TestLocalizerFromEnv(t *testing.T) {
+	dir := t.TempDir()
+	writeTemplateFiles(t, dir, map[string]string{"pt.json": `{"count": 1}`})
+
+	os.Setenv("LOCALE_PATH", dir)
+	defer os.Unsetenv("LOCALE_PATH")
+
+	if _, err := NewAppContext("localizer_test"); err == nil {
+		t.Error("Expected an error for a translation that isn't a string")
+	}
+
+	writeTemplateFiles(t, dir, map[string]string{"pt.json": `{"count": "Um"}`})
+	if _, err := NewAppContext("localizer_test"); err == nil {
+		t.Error("Expected an error without translations for LOCALE_DEFAULT")
+	}
+
+	os.Setenv("LOCALE_DEFAULT", "pt")
+	defer os.Unsetenv("LOCALE_DEFAULT")
+	app_ctx, err := NewAppContext("localizer_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app_ctx.Close()
+	if msg := app_ctx.Localizer().T("en", "count", nil); msg != "Um" {
+		t.Errorf("Expected the LOCALE_DEFAULT translation, got %q", msg)
+	}
+}
@@ -0,0 +1,444 @@
+package app_context
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ErrLockHeld is returned by TryLock and WithLock when someone else holds
+// the lock
+var ErrLockHeld = errors.New("Lock is held by someone else")
+
+// lockRetryInterval is how often Lock tries again for a held lock
+var lockRetryInterval = 250 * time.Millisecond
+
+// errLockExpired is returned by renew when the lock is no longer ours
+var errLockExpired = errors.New("Lock expired")
+
+// Lock is a held distributed lock. It's renewed every third of its TTL
+// until Unlock. Lost is closed if someone else has taken it, or if
+// renewals keep failing, a sixth of the TTL before it runs out and someone
+// else can. Postgres locks don't expire; they're held as long as their
+// connection is, which is checked every third of the TTL instead, and
+// Lost is closed if the checks fail for as long.
+type Lock interface {
+	Name() string
+	Lost() <-chan struct{}
+	Unlock() error
+}
+
+// LockManager hands out named locks shared by every replica, eg. for a
+// job only one of them should run at a time. Names are scoped to the app.
+type LockManager interface {
+	// TryLock returns ErrLockHeld rather than waiting
+	TryLock(ctx context.Context, name string, ttl time.Duration) (Lock, error)
+	// Lock waits for name until ctx is done
+	Lock(ctx context.Context, name string, ttl time.Duration) (Lock, error)
+	// WithLock runs fn holding name, or returns ErrLockHeld. fn's context
+	// is cancelled if the lock is lost.
+	WithLock(ctx context.Context, name string, ttl time.Duration, fn func(ctx context.Context) error) error
+}
+
+// heldLock is a backend's hold on a lock
+type heldLock interface {
+	renew(ctx context.Context, ttl time.Duration) error
+	release(ctx context.Context) error
+}
+
+// lockBackend returns a nil heldLock if the lock is taken
+type lockBackend interface {
+	tryLock(ctx context.Context, key string, ttl time.Duration) (heldLock, error)
+}
+
+func newLockToken() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// redisLockBackend sets key to a random token with NX and a TTL, and only
+// renews or deletes it while it still has that token
+type redisLockBackend struct {
+	client *redisClient
+}
+
+const redisRenewScript = `if redis.call("GET", KEYS[1]) == ARGV[1] then return redis.call("PEXPIRE", KEYS[1], ARGV[2]) end return 0`
+
+const redisUnlockScript = `if redis.call("GET", KEYS[1]) == ARGV[1] then return redis.call("DEL", KEYS[1]) end return 0`
+
+type redisHeldLock struct {
+	client *redisClient
+	key    string
+	token  string
+}
+
+func (self *redisLockBackend) tryLock(ctx context.Context, key string, ttl time.Duration) (heldLock, error) {
+	token := newLockToken()
+	reply, err := self.client.do(ctx, "SET", key, token, "NX", "PX", fmt.Sprint(ttl.Milliseconds()))
+	if err != nil {
+		return nil, err
+	}
+	if reply == nil {
+		return nil, nil
+	}
+	return &redisHeldLock{client: self.client, key: key, token: token}, nil
+}
+
+func (self *redisHeldLock) renew(ctx context.Context, ttl time.Duration) error {
+	reply, err := self.client.do(ctx, "EVAL", redisRenewScript, "1", self.key, self.token, fmt.Sprint(ttl.Milliseconds()))
+	if err != nil {
+		return err
+	}
+	if n, _ := reply.(int64); n != 1 {
+		return errLockExpired
+	}
+	return nil
+}
+
+func (self *redisHeldLock) release(ctx context.Context) error {
+	_, err := self.client.do(ctx, "EVAL", redisUnlockScript, "1", self.key, self.token)
+	return err
+}
+
+// pgLockBackend takes a session advisory lock, so it's held as long as
+// its connection is. The TTL doesn't expire it; it only sets how often
+// the connection is checked.
+type pgLockBackend struct {
+	appctx *baseAppContext
+}
+
+type pgHeldLock struct {
+	conn   *sql.Conn
+	unlock func()
+}
+
+func (self *pgLockBackend) tryLock(ctx context.Context, key string, ttl time.Duration) (heldLock, error) {
+	db := self.appctx.DBWrite()
+	if db == nil {
+		return nil, errors.New("No database for locks")
+	}
+	conn, err := db.DB.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	locked, unlock, err := tryAdvisoryLock(ctx, conn, self.appctx.advisoryLockID("lock", key))
+	if err != nil || !locked {
+		conn.Close()
+		return nil, err
+	}
+	return &pgHeldLock{conn: conn, unlock: unlock}, nil
+}
+
+func (self *pgHeldLock) renew(ctx context.Context, ttl time.Duration) error {
+	return self.conn.PingContext(ctx)
+}
+
+func (self *pgHeldLock) release(ctx context.Context) error {
+	self.unlock()
+	return self.conn.Close()
+}
+
+// memoryLockBackend is for a single process
+type memoryLockBackend struct {
+	lock    sync.Mutex
+	expires map[string]time.Time
+	tokens  map[string]string
+}
+
+type memoryHeldLock struct {
+	backend *memoryLockBackend
+	key     string
+	token   string
+}
+
+func (self *memoryLockBackend) tryLock(ctx context.Context, key string, ttl time.Duration) (heldLock, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if expires, ok := self.expires[key]; ok && time.Now().Before(expires) {
+		return nil, nil
+	}
+	token := newLockToken()
+	self.expires[key] = time.Now().Add(ttl)
+	self.tokens[key] = token
+	return &memoryHeldLock{backend: self, key: key, token: token}, nil
+}
+
+func (self *memoryHeldLock) renew(ctx context.Context, ttl time.Duration) error {
+	self.backend.lock.Lock()
+	defer self.backend.lock.Unlock()
+	if self.backend.tokens[self.key] != self.token {
+		return errLockExpired
+	}
+	self.backend.expires[self.key] = time.Now().Add(ttl)
+	return nil
+}
+
+func (self *memoryHeldLock) release(ctx context.Context) error {
+	self.backend.lock.Lock()
+	defer self.backend.lock.Unlock()
+	if self.backend.tokens[self.key] == self.token {
+		delete(self.backend.tokens, self.key)
+		delete(self.backend.expires, self.key)
+	}
+	return nil
+}
+
+type lock struct {
+	mgr      *lockManager
+	name     string
+	ttl      time.Duration
+	held     heldLock
+	lost     chan struct{}
+	stopChan chan struct{}
+	doneChan chan struct{}
+	once     sync.Once
+}
+
+func (self *lock) Name() string {
+	return self.name
+}
+
+func (self *lock) Lost() <-chan struct{} {
+	return self.lost
+}
+
+// renewLoop renews the lock until Unlock. The lock is good for the TTL
+// from the start of the last renewal that worked, and is given up as lost
+// a renewal timeout before then, so whoever takes it next doesn't overlap
+// with us. A failed renewal is retried at the next tick if that can still
+// finish in time.
+func (self *lock) renewLoop() {
+	defer close(self.doneChan)
+
+	interval := self.ttl / 3
+	timeout := self.ttl / 6
+
+	// Real time, since that's what the backends expire locks by
+	ticker := NewRealClock().NewTicker(interval)
+	defer ticker.Stop()
+
+	renewed := time.Now()
+	for {
+		select {
+		case <-self.stopChan:
+			return
+		case <-ticker.C():
+		}
+
+		start := time.Now()
+		lost_at := renewed.Add(self.ttl - timeout)
+		deadline := start.Add(timeout)
+		if deadline.After(lost_at) {
+			deadline = lost_at
+		}
+		ctx, cancel := context.WithDeadline(context.Background(), deadline)
+		err := self.held.renew(ctx, self.ttl)
+		cancel()
+		if err == nil {
+			renewed = start
+			continue
+		}
+
+		self.mgr.appctx.Logger().LogWarnf(context.Background(), "Error renewing lock '%s': %s", self.name, err)
+		if err == errLockExpired || !time.Now().Add(interval).Before(lost_at) {
+			self.mgr.appctx.Logger().LogErrorf(context.Background(), "Lost lock '%s'", self.name)
+			self.mgr.appctx.MetricsClient().Incr("lock.lost", 1.0, map[string]string{"lock": self.name})
+			close(self.lost)
+			return
+		}
+	}
+}
+
+func (self *lock) Unlock() error {
+	var err error
+	self.once.Do(func() {
+		close(self.stopChan)
+		<-self.doneChan
+		self.mgr.forget(self)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err = self.held.release(ctx); err != nil {
+			err = fmt.Errorf("Error releasing lock '%s': %s", self.name, err)
+		}
+	})
+	return err
+}
+
+type lockManager struct {
+	appctx  *baseAppContext
+	backend string
+
+	lock  sync.Mutex
+	store lockBackend
+	held  map[*lock]bool
+}
+
+func newLockManager(appctx *baseAppContext) *lockManager {
+	return &lockManager{appctx: appctx, held: make(map[*lock]bool)}
+}
+
+// backendFor picks postgres if there's a database the first time a lock
+// is taken, and memory otherwise, unless LOCK_BACKEND chose one
+func (self *lockManager) backendFor() lockBackend {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.store == nil {
+		if self.appctx.DBWrite() != nil {
+			self.store = &pgLockBackend{appctx: self.appctx}
+		} else {
+			self.store = &memoryLockBackend{expires: make(map[string]time.Time), tokens: make(map[string]string)}
+		}
+	}
+	return self.store
+}
+
+func (self *lockManager) forget(l *lock) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	delete(self.held, l)
+}
+
+func (self *lockManager) TryLock(ctx context.Context, name string, ttl time.Duration) (Lock, error) {
+	if ttl <= 0 {
+		return nil, errors.New("Lock TTL must be > 0")
+	}
+	key := "lock:" + self.appctx.appName + ":" + name
+	held, err := self.backendFor().tryLock(ctx, key, ttl)
+	if err != nil {
+		return nil, fmt.Errorf("Error taking lock '%s': %s", name, err)
+	}
+	tags := map[string]string{"lock": name}
+	if held == nil {
+		self.appctx.MetricsClient().Incr("lock.contended", 1.0, tags)
+		return nil, ErrLockHeld
+	}
+	self.appctx.MetricsClient().Incr("lock.acquired", 1.0, tags)
+
+	l := &lock{
+		mgr:      self,
+		name:     name,
+		ttl:      ttl,
+		held:     held,
+		lost:     make(chan struct{}),
+		stopChan: make(chan struct{}),
+		doneChan: make(chan struct{}),
+	}
+	self.lock.Lock()
+	self.held[l] = true
+	self.lock.Unlock()
+
+	goLabeled("locks", l.renewLoop, "lock", name)
+	return l, nil
+}
+
+func (self *lockManager) Lock(ctx context.Context, name string, ttl time.Duration) (Lock, error) {
+	for {
+		l, err := self.TryLock(ctx, name, ttl)
+		if err != ErrLockHeld {
+			return l, err
+		}
+		timer := time.NewTimer(lockRetryInterval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+func (self *lockManager) WithLock(ctx context.Context, name string, ttl time.Duration, fn func(ctx context.Context) error) error {
+	l, err := self.TryLock(ctx, name, ttl)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	goLabeled("locks", func() {
+		select {
+		case <-l.Lost():
+			cancel()
+		case <-ctx.Done():
+		}
+	}, "lock", name)
+
+	err = fn(ctx)
+	if unlock_err := l.Unlock(); unlock_err != nil && err == nil {
+		err = unlock_err
+	}
+	return err
+}
+
+// close releases the locks still held
+func (self *lockManager) close() {
+	self.lock.Lock()
+	held := make([]*lock, 0, len(self.held))
+	for l := range self.held {
+		held = append(held, l)
+	}
+	self.lock.Unlock()
+
+	for _, l := range held {
+		l.Unlock()
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if redis, ok := self.store.(*redisLockBackend); ok {
+		redis.client.close()
+	}
+}
+
+func (self *lockManager) status() map[string]interface{} {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	names := make([]string, 0, len(self.held))
+	for l := range self.held {
+		names = append(names, l.name)
+	}
+	sort.Strings(names)
+	return map[string]interface{}{
+		"backend": typeName(self.store),
+		"held":    names,
+	}
+}
+
+func (self *baseAppContext) Locks() LockManager {
+	return self.locks
+}
+
+// LOCK_BACKEND is postgres (session advisory locks, which don't expire
+// with the TTL), redis (with LOCK_REDIS_URL) or memory. By default locks
+// are taken in the database if there is one, and otherwise only within
+// this process.
+func (self *baseAppContext) setLocksFromEnv() error {
+	switch self.locks.backend = self.getEnv("LOCK_BACKEND"); self.locks.backend {
+	case "":
+	case "postgres":
+		self.locks.store = &pgLockBackend{appctx: self}
+	case "memory":
+		self.locks.store = &memoryLockBackend{expires: make(map[string]time.Time), tokens: make(map[string]string)}
+	case "redis":
+		redis_url := self.getEnv("LOCK_REDIS_URL")
+		if redis_url == "" {
+			return errors.New("LOCK_REDIS_URL is required with LOCK_BACKEND=redis")
+		}
+		client, err := newRedisClient(redis_url, time.Second)
+		if err != nil {
+			return fmt.Errorf("Invalid LOCK_REDIS_URL: %s", err)
+		}
+		self.locks.store = &redisLockBackend{client: client}
+	default:
+		return fmt.Errorf("Unknown LOCK_BACKEND '%s'", self.locks.backend)
+	}
+	return nil
+}
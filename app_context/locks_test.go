@@ -0,0 +1,247 @@
+package app_context
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLocks(t *testing.T) {
+	app_ctx, err := NewAppContext("locks_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer app_ctx.Close()
+
+	mcli := newCountingMetricsClient()
+	app_ctx.SetMetricsClient(mcli)
+	ctx := context.Background()
+	locks := app_ctx.Locks()
+
+	l, err := locks.TryLock(ctx, "nightly-report", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := locks.TryLock(ctx, "nightly-report", time.Minute); err != ErrLockHeld {
+		t.Errorf("Expected ErrLockHeld, got %v", err)
+	}
+	ran := false
+	err = locks.WithLock(ctx, "nightly-report", time.Minute, func(ctx context.Context) error {
+		ran = true
+		return nil
+	})
+	if err != ErrLockHeld || ran {
+		t.Errorf("Expected WithLock not to run while held, got %v", err)
+	}
+	if mcli.count("lock.acquired") != 1 || mcli.count("lock.contended") != 2 {
+		t.Errorf("Unexpected metrics: %v", mcli.counts)
+	}
+
+	// Lock waits for it to be released
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		l.Unlock()
+	}()
+	wait_ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	l, err = locks.Lock(wait_ctx, "nightly-report", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Unlock()
+
+	err = locks.WithLock(ctx, "nightly-report", time.Minute, func(ctx context.Context) error {
+		ran = true
+		return nil
+	})
+	if err != nil || !ran {
+		t.Errorf("Expected WithLock to run, got %v", err)
+	}
+}
+
+func TestLocksLost(t *testing.T) {
+	app_ctx, err := NewAppContext("locks_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer app_ctx.Close()
+
+	mcli := newCountingMetricsClient()
+	app_ctx.SetMetricsClient(mcli)
+
+	err = app_ctx.Locks().WithLock(context.Background(), "sweep", 30*time.Millisecond, func(ctx context.Context) error {
+		// Someone else takes it over
+		backend := app_ctx.(*baseAppContext).locks.store.(*memoryLockBackend)
+		backend.lock.Lock()
+		backend.tokens["lock:locks_test:sweep"] = "theirs"
+		backend.lock.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(5 * time.Second):
+			return nil
+		}
+	})
+	if err != context.Canceled {
+		t.Errorf("Expected the context to be cancelled, got %v", err)
+	}
+	if mcli.count("lock.lost") != 1 {
+		t.Errorf("Expected lock.lost, got %v", mcli.counts)
+	}
+}
+
+// failingHeldLock can't be renewed, like a backend that's down
+type failingHeldLock struct{}
+
+func (failingHeldLock) renew(ctx context.Context, ttl time.Duration) error {
+	return errors.New("Connection refused")
+}
+
+func (failingHeldLock) release(ctx context.Context) error {
+	return nil
+}
+
+func TestLocksLostBeforeExpiry(t *testing.T) {
+	app_ctx, err := NewAppContext("locks_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer app_ctx.Close()
+
+	ttl := 300 * time.Millisecond
+	l := &lock{
+		mgr:      app_ctx.(*baseAppContext).locks,
+		name:     "sweep",
+		ttl:      ttl,
+		held:     failingHeldLock{},
+		lost:     make(chan struct{}),
+		stopChan: make(chan struct{}),
+		doneChan: make(chan struct{}),
+	}
+	start := time.Now()
+	go l.renewLoop()
+
+	select {
+	case <-l.Lost():
+		if elapsed := time.Since(start); elapsed >= ttl {
+			t.Errorf("Expected the lock to be lost before it expired, took %s", elapsed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the lock to be lost")
+	}
+}
+
+// slowHeldLock renews once after delay, then hangs until the renewal
+// times out, like a backend that's slowing down
+type slowHeldLock struct {
+	delay time.Duration
+	lock  sync.Mutex
+	calls int
+	// lastStart is when the last renewal that worked began
+	lastStart time.Time
+}
+
+func (self *slowHeldLock) renew(ctx context.Context, ttl time.Duration) error {
+	start := time.Now()
+	self.lock.Lock()
+	self.calls++
+	first := self.calls == 1
+	self.lock.Unlock()
+
+	if first {
+		select {
+		case <-time.After(self.delay):
+			self.lock.Lock()
+			self.lastStart = start
+			self.lock.Unlock()
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func (self *slowHeldLock) release(ctx context.Context) error {
+	return nil
+}
+
+func TestLocksLostWithSlowBackend(t *testing.T) {
+	app_ctx, err := NewAppContext("locks_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer app_ctx.Close()
+
+	ttl := 600 * time.Millisecond
+	held := &slowHeldLock{delay: 180 * time.Millisecond, lastStart: time.Now()}
+	l := &lock{
+		mgr:      app_ctx.(*baseAppContext).locks,
+		name:     "sweep",
+		ttl:      ttl,
+		held:     held,
+		lost:     make(chan struct{}),
+		stopChan: make(chan struct{}),
+		doneChan: make(chan struct{}),
+	}
+	go l.renewLoop()
+
+	select {
+	case <-l.Lost():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the lock to be lost")
+	}
+	held.lock.Lock()
+	defer held.lock.Unlock()
+	// The lock expires a TTL after the last renewal that worked began,
+	// and should be given up a renewal timeout before that
+	if left := time.Until(held.lastStart.Add(ttl)); left < ttl/12 {
+		t.Errorf("Expected the lock to be lost well before it expired, %s was left", left)
+	}
+}
+
+func TestRedisLocks(t *testing.T) {
+	server := newFakeRedis(t, "+OK", "$-1", ":1")
+	defer server.listener.Close()
+
+	os.Setenv("LOCK_BACKEND", "redis")
+	os.Setenv("LOCK_REDIS_URL", "redis://"+server.listener.Addr().String())
+	defer os.Unsetenv("LOCK_BACKEND")
+	defer os.Unsetenv("LOCK_REDIS_URL")
+
+	app_ctx, err := NewAppContext("locks_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer app_ctx.Close()
+
+	ctx := context.Background()
+	l, err := app_ctx.Locks().TryLock(ctx, "nightly-report", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := app_ctx.Locks().TryLock(ctx, "nightly-report", time.Minute); err != ErrLockHeld {
+		t.Errorf("Expected ErrLockHeld, got %v", err)
+	}
+	if err := l.Unlock(); err != nil {
+		t.Error(err)
+	}
+
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	if len(server.commands) != 3 {
+		t.Fatalf("Unexpected commands: %v", server.commands)
+	}
+	if set := server.commands[0]; set[0] != "SET" || set[1] != "lock:locks_test:nightly-report" || set[3] != "NX" || set[5] != "60000" {
+		t.Errorf("Unexpected SET: %v", set)
+	}
+	if eval := server.commands[2]; eval[0] != "EVAL" || eval[3] != "lock:locks_test:nightly-report" || eval[4] != server.commands[0][2] {
+		t.Errorf("Expected the release to check the token, got %v", eval)
+	}
+}
@@ -0,0 +1,122 @@
+package app_context
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type LogEntry struct {
+	Time   time.Time              `json:"time"`
+	Level  string                 `json:"level"`
+	Msg    string                 `json:"msg"`
+	Fields map[string]interface{} `json:"fields,omitempty"`
+}
+
+// LogRing keeps the last entries written to the app context's logger at
+// every level, including ones filtered out by LOG_LEVEL, so there's debug
+// context after a rare failure.
+type LogRing struct {
+	lock    sync.Mutex
+	entries []LogEntry
+	next    int
+	full    bool
+}
+
+func NewLogRing(size int) *LogRing {
+	return &LogRing{entries: make([]LogEntry, size)}
+}
+
+func (self *LogRing) Add(entry LogEntry) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if len(self.entries) == 0 {
+		return
+	}
+	self.entries[self.next] = entry
+	self.next = (self.next + 1) % len(self.entries)
+	if self.next == 0 {
+		self.full = true
+	}
+}
+
+// Last returns up to n of the most recent entries, oldest first. n <= 0
+// returns all of them.
+func (self *LogRing) Last(n int) []LogEntry {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	count := self.next
+	if self.full {
+		count = len(self.entries)
+	}
+	if n <= 0 || n > count {
+		n = count
+	}
+
+	entries := make([]LogEntry, n)
+	start := self.next - n
+	for i := range entries {
+		entries[i] = self.entries[(start+i+len(self.entries))%len(self.entries)]
+	}
+	return entries
+}
+
+func (self *baseAppContext) LogRing() *LogRing {
+	return self.logRing
+}
+
+// recentLogs is what's attached to crash and error reports
+func (self *baseAppContext) recentLogs() []LogEntry {
+	if self.logRing == nil || self.logRingReportEntries <= 0 {
+		return nil
+	}
+	return self.logRing.Last(self.logRingReportEntries)
+}
+
+// logRingHandler serves the ring as JSON; ?n= limits the number of entries
+func (self *baseAppContext) logRingHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if self.logRing == nil {
+			http.Error(w, "Log capture is disabled", http.StatusNotFound)
+			return
+		}
+
+		n, _ := strconv.Atoi(r.URL.Query().Get("n"))
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(self.logRing.Last(n))
+	})
+}
+
+// LOG_RING_SIZE (default 1000, 0 disables) is how many entries are kept.
+// The last LOG_RING_REPORT_ENTRIES (default 50, 0 for none) are attached to
+// crash and error reports.
+func (self *baseAppContext) setLogRingFromEnv() error {
+	size := 1000
+	if n, found, err := self.getIntFromEnv("LOG_RING_SIZE"); err != nil {
+		return err
+	} else if found {
+		size = n
+	}
+	if size < 0 {
+		return fmt.Errorf("LOG_RING_SIZE must be >= 0")
+	}
+
+	self.logRingReportEntries = 50
+	if n, found, err := self.getIntFromEnv("LOG_RING_REPORT_ENTRIES"); err != nil {
+		return err
+	} else if found {
+		self.logRingReportEntries = n
+	}
+
+	if size > 0 {
+		self.logRing = NewLogRing(size)
+	}
+
+	return nil
+}
@@ -0,0 +1,72 @@
+package app_context
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+)
+
+func TestLogRing(t *testing.T) {
+	ring := NewLogRing(3)
+	if n := len(ring.Last(0)); n != 0 {
+		t.Errorf("Empty ring returned %d entries", n)
+	}
+
+	for i := 0; i < 5; i++ {
+		ring.Add(LogEntry{Msg: strconv.Itoa(i)})
+	}
+
+	entries := ring.Last(0)
+	if len(entries) != 3 || entries[0].Msg != "2" || entries[2].Msg != "4" {
+		t.Errorf("Unexpected entries after wrapping: %+v", entries)
+	}
+	if entries := ring.Last(2); len(entries) != 2 || entries[0].Msg != "3" {
+		t.Errorf("Unexpected last 2 entries: %+v", entries)
+	}
+}
+
+func TestLogRingCapture(t *testing.T) {
+	os.Setenv("LOG_LEVEL", "error")
+	defer os.Unsetenv("LOG_LEVEL")
+	os.Setenv("LOG_RING_SIZE", "10")
+	defer os.Unsetenv("LOG_RING_SIZE")
+	os.Setenv("LOG_RING_REPORT_ENTRIES", "2")
+	defer os.Unsetenv("LOG_RING_REPORT_ENTRIES")
+
+	app_ctx, err := NewAppContext("log_ring_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer app_ctx.Close()
+
+	ctx := context.Background()
+	app_ctx.Logger().LogDebugf(ctx, "filtered %d", 1)
+	app_ctx.WithFields(map[string]interface{}{"k": "v"}).Logger().LogInfo(ctx, "with fields")
+	app_ctx.Logger().LogError(ctx, "written")
+
+	entries := app_ctx.LogRing().Last(3)
+	if len(entries) != 3 || entries[0].Msg != "filtered 1" || entries[0].Level != "debug" {
+		t.Fatalf("Debug entry wasn't captured: %+v", entries)
+	}
+	if entries[1].Fields["k"] != "v" {
+		t.Errorf("Fields weren't captured: %+v", entries[1])
+	}
+
+	if logs := app_ctx.(*baseAppContext).recentLogs(); len(logs) != 2 || logs[1].Msg != "written" {
+		t.Errorf("Unexpected report entries: %+v", logs)
+	}
+
+	rec := httptest.NewRecorder()
+	app_ctx.(*baseAppContext).logRingHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/debug/logs?n=1", nil))
+	var served []LogEntry
+	if err := json.Unmarshal(rec.Body.Bytes(), &served); err != nil {
+		t.Fatal(err)
+	}
+	if len(served) != 1 || served[0].Msg != "written" {
+		t.Errorf("Unexpected /debug/logs response: %s", rec.Body.String())
+	}
+}
@@ -0,0 +1,267 @@
+package app_context
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tilteng/go-logger/logger"
+)
+
+type LogLevel int32
+
+const (
+	LogLevelDebug LogLevel = iota
+	LogLevelInfo
+	LogLevelWarn
+	LogLevelError
+)
+
+func (self LogLevel) String() string {
+	switch self {
+	case LogLevelDebug:
+		return "debug"
+	case LogLevelInfo:
+		return "info"
+	case LogLevelWarn:
+		return "warn"
+	case LogLevelError:
+		return "error"
+	}
+	return fmt.Sprintf("LogLevel(%d)", int32(self))
+}
+
+func ParseLogLevel(s string) (LogLevel, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return LogLevelDebug, nil
+	case "info":
+		return LogLevelInfo, nil
+	case "warn", "warning":
+		return LogLevelWarn, nil
+	case "error":
+		return LogLevelError, nil
+	}
+	return LogLevelDebug, fmt.Errorf("Unknown log level: %s", s)
+}
+
+type LevelLogger interface {
+	logger.Logger
+	Level() LogLevel
+	SetLevel(LogLevel)
+}
+
+// FieldsLogger is implemented by loggers that can attach structured fields
+// to every entry they write.
+type FieldsLogger interface {
+	logger.Logger
+	WithFields(fields map[string]interface{}) logger.Logger
+}
+
+// leveledLogger is a logger.Logger that filters by level and writes either
+// the same text format as the default go-logger logger or JSON lines.
+// Loggers derived with WithFields share level and output with the parent.
+type leveledLogger struct {
+	level      *int32
+	json       bool
+	out        io.Writer
+	lock       *sync.Mutex
+	textLogger *log.Logger
+	fields     map[string]interface{}
+	ring       *LogRing
+}
+
+func (self *leveledLogger) Level() LogLevel {
+	return LogLevel(atomic.LoadInt32(self.level))
+}
+
+func (self *leveledLogger) SetLevel(level LogLevel) {
+	atomic.StoreInt32(self.level, int32(level))
+}
+
+func (self *leveledLogger) WithFields(fields map[string]interface{}) logger.Logger {
+	new_logger := *self
+	new_logger.fields = mergeFields(self.fields, fields)
+	return &new_logger
+}
+
+func mergeFields(a, b map[string]interface{}) map[string]interface{} {
+	fields := make(map[string]interface{}, len(a)+len(b))
+	for k, v := range a {
+		fields[k] = v
+	}
+	for k, v := range b {
+		fields[k] = v
+	}
+	return fields
+}
+
+// formatFields returns fields as sorted "k=v" pairs separated by spaces
+func formatFields(fields map[string]interface{}) string {
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, len(keys))
+	for i, k := range keys {
+		parts[i] = fmt.Sprintf("%s=%v", k, fields[k])
+	}
+	return strings.Join(parts, " ")
+}
+
+func (self *leveledLogger) write(level LogLevel, msg string) {
+	if self.ring != nil {
+		self.ring.Add(LogEntry{
+			Time:   time.Now().UTC(),
+			Level:  level.String(),
+			Msg:    msg,
+			Fields: self.fields,
+		})
+	}
+
+	if level < self.Level() {
+		return
+	}
+
+	if !self.json {
+		if len(self.fields) > 0 {
+			msg += " " + formatFields(self.fields)
+		}
+		self.textLogger.Print("[" + strings.ToUpper(level.String()) + "] " + msg)
+		return
+	}
+
+	entry := make(map[string]interface{}, len(self.fields)+3)
+	for k, v := range self.fields {
+		entry[k] = v
+	}
+	entry["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	entry["level"] = level.String()
+	entry["msg"] = msg
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.out.Write(append(line, '\n'))
+}
+
+func sprintln(v []interface{}) string {
+	return strings.TrimSuffix(fmt.Sprintln(v...), "\n")
+}
+
+func (self *leveledLogger) LogDebug(v ...interface{}) {
+	self.write(LogLevelDebug, sprintln(v))
+}
+
+func (self *leveledLogger) LogDebugf(f string, v ...interface{}) {
+	self.write(LogLevelDebug, fmt.Sprintf(f, v...))
+}
+
+func (self *leveledLogger) LogError(v ...interface{}) {
+	self.write(LogLevelError, sprintln(v))
+}
+
+func (self *leveledLogger) LogErrorf(f string, v ...interface{}) {
+	self.write(LogLevelError, fmt.Sprintf(f, v...))
+}
+
+func (self *leveledLogger) LogInfo(v ...interface{}) {
+	self.write(LogLevelInfo, sprintln(v))
+}
+
+func (self *leveledLogger) LogInfof(f string, v ...interface{}) {
+	self.write(LogLevelInfo, fmt.Sprintf(f, v...))
+}
+
+func (self *leveledLogger) LogWarn(v ...interface{}) {
+	self.write(LogLevelWarn, sprintln(v))
+}
+
+func (self *leveledLogger) LogWarnf(f string, v ...interface{}) {
+	self.write(LogLevelWarn, fmt.Sprintf(f, v...))
+}
+
+func NewLevelLogger(out io.Writer, level LogLevel, json_format bool) LevelLogger {
+	return newLeveledLogger(out, level, json_format, nil)
+}
+
+// newLeveledLogger also copies every entry, whatever its level, to ring
+// if it isn't nil
+func newLeveledLogger(out io.Writer, level LogLevel, json_format bool, ring *LogRing) *leveledLogger {
+	lvl := int32(level)
+	return &leveledLogger{
+		level:      &lvl,
+		json:       json_format,
+		out:        out,
+		lock:       &sync.Mutex{},
+		textLogger: log.New(out, "", log.LstdFlags|log.Lmicroseconds),
+		ring:       ring,
+	}
+}
+
+func (self *baseAppContext) levelLogger() (LevelLogger, bool) {
+	log := self.Logger()
+	if log == nil {
+		return nil, false
+	}
+	ll, ok := log.BaseLogger().(LevelLogger)
+	return ll, ok
+}
+
+func (self *baseAppContext) LogLevel() LogLevel {
+	if ll, ok := self.levelLogger(); ok {
+		return ll.Level()
+	}
+	return LogLevelDebug
+}
+
+func (self *baseAppContext) SetLogLevel(level LogLevel) error {
+	ll, ok := self.levelLogger()
+	if !ok {
+		return errors.New("Logger doesn't support setting a level")
+	}
+	ll.SetLevel(level)
+	return nil
+}
+
+func (self *baseAppContext) setLoggerFromEnv() error {
+	level := LogLevelDebug
+	if s := self.getEnv("LOG_LEVEL"); s != "" {
+		var err error
+		if level, err = ParseLogLevel(s); err != nil {
+			return err
+		}
+	}
+
+	json_format := false
+	switch format := strings.ToLower(self.getEnv("LOG_FORMAT")); format {
+	case "", "text":
+	case "json":
+		json_format = true
+	default:
+		return fmt.Errorf("Unknown LOG_FORMAT '%s', must be 'json' or 'text'", format)
+	}
+
+	self.logger = logger.NewDefaultCtxLogger(
+		newLeveledLogger(os.Stdout, level, json_format, self.logRing),
+	)
+	if self.kubernetes != nil {
+		self.logger = CtxLoggerWithFields(self.logger, self.kubernetes.logFields())
+	}
+
+	return nil
+}
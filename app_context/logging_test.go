@@ -0,0 +1,88 @@
+package app_context
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/tilteng/go-logger/logger"
+)
+
+func TestLogLevelEnv(t *testing.T) {
+	os.Setenv("LOG_LEVEL", "warn")
+	defer os.Unsetenv("LOG_LEVEL")
+
+	app_ctx, err := NewAppContext("logging_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if lvl := app_ctx.LogLevel(); lvl != LogLevelWarn {
+		t.Errorf("LOG_LEVEL=warn but level is %s", lvl)
+	}
+
+	if err := app_ctx.SetLogLevel(LogLevelDebug); err != nil {
+		t.Errorf("SetLogLevel failed: %s", err)
+	}
+
+	if lvl := app_ctx.LogLevel(); lvl != LogLevelDebug {
+		t.Errorf("SetLogLevel didn't take effect: %s", lvl)
+	}
+
+	os.Setenv("LOG_LEVEL", "loud")
+	if _, err := NewAppContext("logging_test"); err == nil {
+		t.Error("app context should have failed with bad LOG_LEVEL")
+	}
+
+	os.Unsetenv("LOG_LEVEL")
+	os.Setenv("LOG_FORMAT", "xml")
+	defer os.Unsetenv("LOG_FORMAT")
+	if _, err := NewAppContext("logging_test"); err == nil {
+		t.Error("app context should have failed with bad LOG_FORMAT")
+	}
+}
+
+func TestLevelLoggerFiltering(t *testing.T) {
+	buf := &bytes.Buffer{}
+	ll := NewLevelLogger(buf, LogLevelInfo, true)
+
+	ll.LogDebug("hidden")
+	ll.LogInfof("shown %d", 1)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("Expected 1 line, got %d: %s", len(lines), buf.String())
+	}
+
+	entry := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(lines[0]), &entry); err != nil {
+		t.Fatalf("Log line isn't JSON: %s", err)
+	}
+
+	if entry["level"] != "info" || entry["msg"] != "shown 1" {
+		t.Errorf("Unexpected log entry: %+v", entry)
+	}
+
+	buf.Reset()
+	ll = NewLevelLogger(buf, LogLevelDebug, false)
+	ll.LogWarn("a", "b")
+	if !strings.HasSuffix(buf.String(), "[WARN] a b\n") {
+		t.Errorf("Unexpected text log line: %s", buf.String())
+	}
+}
+
+func TestSetLogLevelUnsupported(t *testing.T) {
+	app_ctx, err := NewAppContext("logging_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	app_ctx.SetLogger(logger.DefaultStdoutCtxLogger())
+
+	if err := app_ctx.SetLogLevel(LogLevelInfo); err == nil {
+		t.Error("SetLogLevel should fail for a logger without levels")
+	}
+}
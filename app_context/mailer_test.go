@@ -0,0 +1,232 @@
+package app_context
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeSMTP accepts one message per connection, recording the envelope
+// and the data
+type fakeSMTP struct {
+	listener   net.Listener
+	lock       sync.Mutex
+	from       string
+	recipients []string
+	data       string
+}
+
+func newFakeSMTP(t *testing.T) *fakeSMTP {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &fakeSMTP{listener: listener}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(conn)
+		}
+	}()
+	return server
+}
+
+func (self *fakeSMTP) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	fmt.Fprint(conn, "220 localhost ESMTP\r\n")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		cmd := strings.ToUpper(line)
+		switch {
+		case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+			fmt.Fprint(conn, "250 localhost\r\n")
+		case strings.HasPrefix(cmd, "MAIL FROM:"):
+			self.lock.Lock()
+			self.from = strings.Trim(line[len("MAIL FROM:"):], "<> ")
+			self.lock.Unlock()
+			fmt.Fprint(conn, "250 OK\r\n")
+		case strings.HasPrefix(cmd, "RCPT TO:"):
+			self.lock.Lock()
+			self.recipients = append(self.recipients, strings.Trim(line[len("RCPT TO:"):], "<> "))
+			self.lock.Unlock()
+			fmt.Fprint(conn, "250 OK\r\n")
+		case cmd == "DATA":
+			fmt.Fprint(conn, "354 Go ahead\r\n")
+			var data strings.Builder
+			for {
+				l, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if l == ".\r\n" {
+					break
+				}
+				data.WriteString(l)
+			}
+			self.lock.Lock()
+			self.data = data.String()
+			self.lock.Unlock()
+			fmt.Fprint(conn, "250 Queued\r\n")
+		case cmd == "QUIT":
+			fmt.Fprint(conn, "221 Bye\r\n")
+			return
+		default:
+			fmt.Fprint(conn, "250 OK\r\n")
+		}
+	}
+}
+
+func TestSMTPMailer(t *testing.T) {
+	server := newFakeSMTP(t)
+	defer server.listener.Close()
+
+	os.Setenv("SMTP_URL", "smtp://"+server.listener.Addr().String())
+	os.Setenv("MAIL_FROM", "App <noreply@example.com>")
+	defer os.Unsetenv("SMTP_URL")
+	defer os.Unsetenv("MAIL_FROM")
+
+	app_ctx, err := NewAppContext("mailer_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer app_ctx.Close()
+
+	mcli := newCountingMetricsClient()
+	app_ctx.SetMetricsClient(mcli)
+
+	err = app_ctx.Mailer().Send(context.Background(), &Email{
+		To:      []string{"Someone <a@example.com>"},
+		Bcc:     []string{"hidden@example.com"},
+		Subject: "Hello",
+		Text:    "Plain body",
+		HTML:    "<p>HTML body</p>",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	if server.from != "noreply@example.com" {
+		t.Errorf("Unexpected envelope sender: %s", server.from)
+	}
+	if strings.Join(server.recipients, ",") != "a@example.com,hidden@example.com" {
+		t.Errorf("Unexpected recipients: %v", server.recipients)
+	}
+	if strings.Contains(server.data, "hidden@example.com") {
+		t.Errorf("Expected Bcc to be left out of the message")
+	}
+	if !strings.Contains(server.data, "multipart/alternative") || !strings.Contains(server.data, "<p>HTML body</p>") {
+		t.Errorf("Expected text and HTML parts, got %s", server.data)
+	}
+	if c := mcli.count("mail.sent"); c != 1 {
+		t.Errorf("Expected 1 mail.sent, got %d", c)
+	}
+}
+
+func TestSendGridMailer(t *testing.T) {
+	var payload map[string]interface{}
+	var auth string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+		json.NewDecoder(r.Body).Decode(&payload)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	os.Setenv("SENDGRID_API_KEY", "key")
+	defer os.Unsetenv("SENDGRID_API_KEY")
+
+	app_ctx, err := NewAppContext("mailer_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer app_ctx.Close()
+
+	app_ctx.(*baseAppContext).mailer.transport.(*sendgridMailTransport).apiURL = server.URL
+
+	err = app_ctx.Mailer().Send(context.Background(), &Email{
+		From:    "noreply@example.com",
+		To:      []string{"a@example.com"},
+		Subject: "Hello",
+		Text:    "Plain body",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if auth != "Bearer key" || payload["subject"] != "Hello" {
+		t.Errorf("Unexpected request: %s %v", auth, payload)
+	}
+}
+
+func TestMailerTemplates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mailer_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ioutil.WriteFile(filepath.Join(dir, "welcome.subject.tmpl"), []byte("Welcome, {{.Name}}\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "welcome.txt.tmpl"), []byte("Hi {{.Name}}"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "welcome.html.tmpl"), []byte("<p>Hi {{.Name}}</p>"), 0644)
+
+	os.Setenv("MAIL_TEMPLATE_DIR", dir)
+	os.Setenv("MAIL_FROM", "noreply@example.com")
+	defer os.Unsetenv("MAIL_TEMPLATE_DIR")
+	defer os.Unsetenv("MAIL_FROM")
+
+	app_ctx, err := NewAppContext("mailer_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer app_ctx.Close()
+
+	email := &Email{To: []string{"a@example.com"}}
+	if err := app_ctx.Mailer().SendTemplate(context.Background(), "welcome", map[string]string{"Name": "<Bob>"}, email); err != nil {
+		t.Fatal(err)
+	}
+	if email.Subject != "Welcome, <Bob>" || email.Text != "Hi <Bob>" || email.HTML != "<p>Hi &lt;Bob&gt;</p>" {
+		t.Errorf("Unexpected rendered email: %+v", email)
+	}
+
+	if err := app_ctx.Mailer().SendTemplate(context.Background(), "missing", nil, &Email{}); err == nil {
+		t.Errorf("Expected an unknown template to fail")
+	}
+	if err := app_ctx.Mailer().Send(context.Background(), &Email{Subject: "No one"}); err == nil {
+		t.Errorf("Expected an email without recipients to fail")
+	}
+}
+
+func TestMailerFromEnv(t *testing.T) {
+	os.Setenv("SMTP_URL", "http://localhost")
+	if _, err := NewAppContext("mailer_test"); err == nil {
+		t.Errorf("Expected an unsupported SMTP_URL scheme to fail")
+	}
+
+	os.Setenv("SMTP_URL", "smtp://localhost")
+	os.Setenv("SENDGRID_API_KEY", "key")
+	if _, err := NewAppContext("mailer_test"); err == nil {
+		t.Errorf("Expected more than one provider to fail")
+	}
+	os.Unsetenv("SMTP_URL")
+	os.Unsetenv("SENDGRID_API_KEY")
+}
@@ -0,0 +1,149 @@
+package app_context
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// Manager holds the app contexts of a process that hosts several apps.
+// New gives each one an env prefix from its name by default, eg. BILLING_
+// for "billing", so their metrics namespaces, Rollbar projects, DB pools
+// and admin ports come from separate settings.
+type Manager struct {
+	lock  sync.Mutex
+	apps  []AppContext
+	names map[string]AppContext
+}
+
+func NewManager() *Manager {
+	return &Manager{names: make(map[string]AppContext)}
+}
+
+// New creates an app context and adds it. opts can override the default
+// env prefix.
+func (self *Manager) New(app_name string, opts ...Option) (AppContext, error) {
+	self.lock.Lock()
+	_, exists := self.names[app_name]
+	self.lock.Unlock()
+	if exists {
+		return nil, fmt.Errorf("App context '%s' already exists", app_name)
+	}
+
+	opts = append([]Option{WithEnvPrefix(envName(app_name) + "_")}, opts...)
+	appctx, err := NewAppContext(app_name, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if err := self.Add(appctx); err != nil {
+		appctx.Close()
+		return nil, err
+	}
+	return appctx, nil
+}
+
+// Add adds an app context created elsewhere. Names must be unique.
+func (self *Manager) Add(appctx AppContext) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if _, ok := self.names[appctx.AppName()]; ok {
+		return fmt.Errorf("App context '%s' already exists", appctx.AppName())
+	}
+	self.names[appctx.AppName()] = appctx
+	self.apps = append(self.apps, appctx)
+	return nil
+}
+
+// Get returns the app context named app_name, or nil
+func (self *Manager) Get(app_name string) AppContext {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.names[app_name]
+}
+
+// Apps returns the app contexts in the order they were added
+func (self *Manager) Apps() []AppContext {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return append([]AppContext(nil), self.apps...)
+}
+
+// Each calls fn with each app context, stopping at the first error
+func (self *Manager) Each(fn func(AppContext) error) error {
+	for _, appctx := range self.Apps() {
+		if err := fn(appctx); err != nil {
+			return fmt.Errorf("%s: %s", appctx.AppName(), err)
+		}
+	}
+	return nil
+}
+
+// Check runs every app context's health checks, by app name
+func (self *Manager) Check(ctx context.Context) map[string][]*HealthResult {
+	results := make(map[string][]*HealthResult)
+	for _, appctx := range self.Apps() {
+		results[appctx.AppName()] = appctx.Health().Check(ctx)
+	}
+	return results
+}
+
+func (self *Manager) Healthy(ctx context.Context) bool {
+	for _, results := range self.Check(ctx) {
+		for _, res := range results {
+			if !res.Healthy {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// HealthHandler is Handler from HealthRegistry for every app at once. It
+// returns 503 if any app is unhealthy.
+func (self *Manager) HealthHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		results := self.Check(r.Context())
+
+		healthy := true
+		apps := make(map[string]interface{}, len(results))
+		for name, checks := range results {
+			app_healthy := true
+			for _, res := range checks {
+				app_healthy = app_healthy && res.Healthy
+			}
+			healthy = healthy && app_healthy
+			apps[name] = map[string]interface{}{
+				"healthy": app_healthy,
+				"checks":  checks,
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if healthy {
+			w.WriteHeader(http.StatusOK)
+		} else {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"healthy": healthy,
+			"apps":    apps,
+		})
+	})
+}
+
+// Close closes every app context, the last added first, returning the
+// first error
+func (self *Manager) Close() error {
+	apps := self.Apps()
+
+	var first_err error
+	for i := len(apps) - 1; i >= 0; i-- {
+		if err := apps[i].Close(); err != nil && first_err == nil {
+			first_err = fmt.Errorf("Error closing '%s': %s", apps[i].AppName(), err)
+		}
+	}
+	return first_err
+}
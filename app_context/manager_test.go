@@ -0,0 +1,73 @@
+package app_context
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestManager(t *testing.T) {
+	os.Setenv("BILLING_API_BASE_URL", "https://billing.example.com")
+	os.Setenv("SEARCH_BASE_URL", "https://search.example.com")
+	defer os.Unsetenv("BILLING_API_BASE_URL")
+	defer os.Unsetenv("SEARCH_BASE_URL")
+
+	mgr := NewManager()
+	defer mgr.Close()
+
+	billing, err := mgr.New("billing-api")
+	if err != nil {
+		log.Fatal(err)
+	}
+	search, err := mgr.New("search")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if _, err := mgr.New("search"); err == nil {
+		t.Error("Expected a duplicate app name to fail")
+	}
+
+	if billing.EnvPrefix() != "BILLING_API_" || search.EnvPrefix() != "SEARCH_" {
+		t.Errorf("Unexpected env prefixes: %s, %s", billing.EnvPrefix(), search.EnvPrefix())
+	}
+	if billing.BaseExternalURL() != "https://billing.example.com" || search.BaseExternalURL() != "https://search.example.com" {
+		t.Errorf("Expected separate settings, got %s and %s", billing.BaseExternalURL(), search.BaseExternalURL())
+	}
+	if mgr.Get("search") != search || mgr.Get("other") != nil {
+		t.Error("Unexpected Get results")
+	}
+
+	var names []string
+	mgr.Each(func(appctx AppContext) error {
+		names = append(names, appctx.AppName())
+		return nil
+	})
+	if len(names) != 2 || names[0] != "billing-api" || names[1] != "search" {
+		t.Errorf("Unexpected apps: %v", names)
+	}
+
+	if !mgr.Healthy(context.Background()) {
+		t.Error("Expected every app to be healthy")
+	}
+	search.Health().SetStatus("index", errors.New("Index unreachable"))
+	if mgr.Healthy(context.Background()) {
+		t.Error("Expected an unhealthy app to make the manager unhealthy")
+	}
+	if results := mgr.Check(context.Background()); len(results["search"]) != 1 || len(results["billing-api"]) != 0 {
+		t.Errorf("Unexpected health results: %v", results)
+	}
+
+	rec := httptest.NewRecorder()
+	mgr.HealthHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/healthz", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected a 503, got %d", rec.Code)
+	}
+
+	if err := mgr.Close(); err != nil {
+		t.Errorf("Close failed: %s", err)
+	}
+}
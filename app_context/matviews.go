@@ -0,0 +1,187 @@
+package app_context
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+type MatViewStatus struct {
+	View         string
+	Schedule     string
+	Concurrent   bool
+	Refreshes    int
+	Failures     int
+	LastRefresh  time.Time
+	LastDuration time.Duration
+	LastError    string
+}
+
+// MatViewRegistry refreshes materialized views on a schedule. Refreshes
+// are scheduler jobs named matview:<view>, so they're skipped on standby
+// instances and failures are reported like any other job's. An advisory
+// lock makes sure only one instance refreshes a view at a time; the
+// others skip that run.
+type MatViewRegistry interface {
+	// Register refreshes view, which may be schema qualified, every
+	// schedule: a duration like 15m, or a cron expression. Concurrent
+	// refreshes don't block readers, but need a unique index on the view.
+	Register(view string, schedule string, concurrent bool) error
+	// Refresh refreshes view now
+	Refresh(ctx context.Context, view string) error
+	Views() []MatViewStatus
+}
+
+var errMatViewLocked = errors.New("Another instance is refreshing the view")
+
+type matView struct {
+	status MatViewStatus
+}
+
+type matViewRegistry struct {
+	appctx *baseAppContext
+	lock   sync.Mutex
+	views  map[string]*matView
+}
+
+func newMatViewRegistry(appctx *baseAppContext) *matViewRegistry {
+	return &matViewRegistry{appctx: appctx, views: make(map[string]*matView)}
+}
+
+func quoteQualifiedIdentifier(name string) string {
+	parts := strings.Split(name, ".")
+	for i, part := range parts {
+		parts[i] = pq.QuoteIdentifier(part)
+	}
+	return strings.Join(parts, ".")
+}
+
+func (self *matViewRegistry) Register(view string, schedule string, concurrent bool) error {
+	if view == "" {
+		return errors.New("Materialized view name is required")
+	}
+
+	self.lock.Lock()
+	if _, ok := self.views[view]; ok {
+		self.lock.Unlock()
+		return fmt.Errorf("Materialized view '%s' is already registered", view)
+	}
+	self.views[view] = &matView{status: MatViewStatus{View: view, Schedule: schedule, Concurrent: concurrent}}
+	self.lock.Unlock()
+
+	job := func(ctx context.Context) error {
+		return self.Refresh(ctx, view)
+	}
+
+	sched := self.appctx.Scheduler()
+	var err error
+	if interval, perr := time.ParseDuration(schedule); perr == nil {
+		err = sched.Every("matview:"+view, interval, job)
+	} else {
+		err = sched.Cron("matview:"+view, schedule, job)
+	}
+	if err != nil {
+		self.lock.Lock()
+		delete(self.views, view)
+		self.lock.Unlock()
+		return fmt.Errorf("Error scheduling refreshes of '%s': %s", view, err)
+	}
+	return nil
+}
+
+func (self *matViewRegistry) Refresh(ctx context.Context, view string) error {
+	err := self.refresh(ctx, view)
+	if err == errMatViewLocked {
+		return nil
+	}
+	return err
+}
+
+func (self *matViewRegistry) refresh(ctx context.Context, view string) error {
+	self.lock.Lock()
+	mv, ok := self.views[view]
+	self.lock.Unlock()
+	if !ok {
+		return fmt.Errorf("Unknown materialized view '%s'", view)
+	}
+
+	db := self.appctx.DBWrite()
+	if db == nil {
+		return errors.New("No database is configured")
+	}
+
+	conn, err := db.DB.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	locked, unlock, err := tryAdvisoryLock(ctx, conn, self.appctx.advisoryLockID("matview", view))
+	if err != nil {
+		return fmt.Errorf("Error locking materialized view '%s': %s", view, err)
+	}
+	if !locked {
+		self.appctx.MetricsClient().Incr("matview.skipped", 1.0, map[string]string{"view": view})
+		return errMatViewLocked
+	}
+	defer unlock()
+
+	query := "REFRESH MATERIALIZED VIEW "
+	if mv.status.Concurrent {
+		query += "CONCURRENTLY "
+	}
+	query += quoteQualifiedIdentifier(view)
+
+	start := time.Now()
+	_, err = conn.ExecContext(ctx, query)
+	duration := time.Since(start)
+
+	result := "success"
+	if err != nil {
+		result = "failure"
+		err = fmt.Errorf("Error refreshing materialized view '%s': %s", view, err)
+	}
+	self.appctx.MetricsClient().TimingMS(
+		"matview.refresh_duration_ms",
+		float64(duration)/float64(time.Millisecond),
+		1.0,
+		map[string]string{"view": view, "result": result},
+	)
+
+	self.lock.Lock()
+	mv.status.Refreshes++
+	mv.status.LastRefresh = self.appctx.Clock().Now()
+	mv.status.LastDuration = duration
+	mv.status.LastError = ""
+	if err != nil {
+		mv.status.Failures++
+		mv.status.LastError = err.Error()
+	}
+	self.lock.Unlock()
+
+	return err
+}
+
+func (self *matViewRegistry) Views() []MatViewStatus {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	statuses := make([]MatViewStatus, 0, len(self.views))
+	for _, mv := range self.views {
+		statuses = append(statuses, mv.status)
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].View < statuses[j].View
+	})
+	return statuses
+}
+
+func (self *baseAppContext) MatViews() MatViewRegistry {
+	return self.matViews
+}
@@ -0,0 +1,97 @@
+package app_context
+
+import (
+	"context"
+	"database/sql/driver"
+	"log"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestMatViews(t *testing.T) {
+	app_ctx, err := NewAppContext("matviews_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer app_ctx.Close()
+
+	mv := app_ctx.MatViews()
+	if err := mv.Register("reports.daily_rollup", "15m", true); err != nil {
+		t.Fatal(err)
+	}
+	if err := mv.Register("hourly", "0 * * * *", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := mv.Register("hourly", "1h", false); err == nil {
+		t.Error("Expected registering a view twice to fail")
+	}
+	if err := mv.Register("broken", "whenever", false); err == nil {
+		t.Error("Expected a bad schedule to fail")
+	}
+
+	jobs := map[string]bool{}
+	for _, job := range app_ctx.Scheduler().Jobs() {
+		jobs[job.Name] = true
+	}
+	if !jobs["matview:reports.daily_rollup"] || !jobs["matview:hourly"] || jobs["matview:broken"] {
+		t.Errorf("Unexpected jobs: %v", jobs)
+	}
+
+	ctx := context.Background()
+	if err := mv.Refresh(ctx, "hourly"); err == nil {
+		t.Error("Refresh should fail without a database")
+	}
+
+	db, err := app_ctx.(*baseAppContext).openDB("appctx_fake", "", "primary")
+	if err != nil {
+		t.Fatal(err)
+	}
+	app_ctx.SetDB(db)
+	defer app_ctx.SetDB(nil)
+
+	var lock sync.Mutex
+	var queries []string
+	fail := false
+	fakeExecHook = func(query string, args []driver.Value) error {
+		lock.Lock()
+		defer lock.Unlock()
+		queries = append(queries, query)
+		if fail && strings.HasPrefix(query, "REFRESH") {
+			return driver.ErrBadConn
+		}
+		return nil
+	}
+	defer func() { fakeExecHook = nil }()
+
+	if err := mv.Refresh(ctx, "reports.daily_rollup"); err != nil {
+		t.Fatal(err)
+	}
+	lock.Lock()
+	if len(queries) != 2 ||
+		queries[0] != `REFRESH MATERIALIZED VIEW CONCURRENTLY "reports"."daily_rollup"` ||
+		!strings.Contains(queries[1], "pg_advisory_unlock") {
+		t.Errorf("Unexpected queries: %q", queries)
+	}
+	fail = true
+	lock.Unlock()
+
+	if err := mv.Refresh(ctx, "hourly"); err == nil {
+		t.Error("Expected the refresh's error")
+	}
+
+	statuses := mv.Views()
+	if len(statuses) != 2 || statuses[0].View != "hourly" {
+		t.Fatalf("Unexpected views: %+v", statuses)
+	}
+	if statuses[0].Failures != 1 || statuses[0].LastError == "" {
+		t.Errorf("Expected a failure for hourly: %+v", statuses[0])
+	}
+	if statuses[1].Refreshes != 1 || statuses[1].Failures != 0 {
+		t.Errorf("Expected a refresh of daily_rollup: %+v", statuses[1])
+	}
+
+	if err := mv.Refresh(ctx, "unknown"); err == nil {
+		t.Error("Expected an unknown view to fail")
+	}
+}
@@ -0,0 +1,247 @@
+package app_context
+
+import (
+	"errors"
+	"strings"
+	"sync"
+)
+
+type BusMessage struct {
+	Subject string
+	Reply   string
+	Data    []byte
+}
+
+type BusHandler func(msg *BusMessage)
+
+type BusSubscription interface {
+	Unsubscribe() error
+}
+
+// MessageBus is a minimal pub/sub abstraction. Subjects are '.' separated
+// and subscriptions may use NATS-style wildcards: '*' matches one token and
+// '>' matches one or more trailing tokens.
+type MessageBus interface {
+	Publish(subject string, data []byte) error
+	Subscribe(subject string, handler BusHandler) (BusSubscription, error)
+	Close() error
+}
+
+var ErrMessageBusClosed = errors.New("Message bus is closed")
+
+func matchSubject(pattern, subject string) bool {
+	p_toks := strings.Split(pattern, ".")
+	s_toks := strings.Split(subject, ".")
+
+	for i, p := range p_toks {
+		if p == ">" {
+			return i < len(s_toks)
+		}
+		if i >= len(s_toks) {
+			return false
+		}
+		if p != "*" && p != s_toks[i] {
+			return false
+		}
+	}
+
+	return len(p_toks) == len(s_toks)
+}
+
+type noopMessageBus struct{}
+
+type noopBusSubscription struct{}
+
+func (self *noopBusSubscription) Unsubscribe() error {
+	return nil
+}
+
+func (self *noopMessageBus) Publish(subject string, data []byte) error {
+	return nil
+}
+
+func (self *noopMessageBus) Subscribe(subject string, handler BusHandler) (BusSubscription, error) {
+	return &noopBusSubscription{}, nil
+}
+
+func (self *noopMessageBus) Close() error {
+	return nil
+}
+
+func NewNOOPMessageBus() MessageBus {
+	return &noopMessageBus{}
+}
+
+type memoryBusSubscription struct {
+	bus     *memoryMessageBus
+	subject string
+	handler BusHandler
+}
+
+func (self *memoryBusSubscription) Unsubscribe() error {
+	self.bus.lock.Lock()
+	defer self.bus.lock.Unlock()
+
+	for i, sub := range self.bus.subs {
+		if sub == self {
+			self.bus.subs = append(self.bus.subs[:i], self.bus.subs[i+1:]...)
+			break
+		}
+	}
+
+	return nil
+}
+
+type memoryMessageBus struct {
+	lock   sync.Mutex
+	closed bool
+	subs   []*memoryBusSubscription
+}
+
+// Publish delivers synchronously to every matching subscriber, which keeps
+// tests deterministic.
+func (self *memoryMessageBus) Publish(subject string, data []byte) error {
+	self.lock.Lock()
+	if self.closed {
+		self.lock.Unlock()
+		return ErrMessageBusClosed
+	}
+	subs := make([]*memoryBusSubscription, 0, len(self.subs))
+	for _, sub := range self.subs {
+		if matchSubject(sub.subject, subject) {
+			subs = append(subs, sub)
+		}
+	}
+	self.lock.Unlock()
+
+	for _, sub := range subs {
+		data_copy := make([]byte, len(data))
+		copy(data_copy, data)
+		sub.handler(&BusMessage{Subject: subject, Data: data_copy})
+	}
+
+	return nil
+}
+
+func (self *memoryMessageBus) Subscribe(subject string, handler BusHandler) (BusSubscription, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if self.closed {
+		return nil, ErrMessageBusClosed
+	}
+
+	sub := &memoryBusSubscription{
+		bus:     self,
+		subject: subject,
+		handler: handler,
+	}
+	self.subs = append(self.subs, sub)
+
+	return sub, nil
+}
+
+func (self *memoryMessageBus) Close() error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.closed = true
+	self.subs = nil
+	return nil
+}
+
+func NewMemoryMessageBus() MessageBus {
+	return &memoryMessageBus{}
+}
+
+func (self *baseAppContext) MessageBus() MessageBus {
+	self.componentsLock.RLock()
+	defer self.componentsLock.RUnlock()
+	return self.messageBus
+}
+
+func (self *baseAppContext) SetMessageBus(bus MessageBus) AppContext {
+	self.componentsLock.Lock()
+	defer self.componentsLock.Unlock()
+	self.messageBus = bus
+	return self
+}
+
+func (self *baseAppContext) setMessageBusFromEnv() error {
+	if disabled, err := self.isDisabled("NATS"); disabled {
+		return err
+	}
+
+	nats_url := self.getEnv("NATS_URL")
+	if nats_url == "" {
+		return nil
+	}
+
+	if self.lambda {
+		self.messageBus = &lazyMessageBus{connect: func() (MessageBus, error) {
+			return NewNATSMessageBus(nats_url, self.appName, self.logger)
+		}}
+		return nil
+	}
+
+	bus, err := NewNATSMessageBus(nats_url, self.appName, self.logger)
+	if err != nil {
+		return err
+	}
+
+	self.messageBus = bus
+
+	return nil
+}
+
+// lazyMessageBus connects on first use, for serverless handlers that may
+// never need to. A failed connection is retried by the next call.
+type lazyMessageBus struct {
+	connect func() (MessageBus, error)
+	lock    sync.Mutex
+	bus     MessageBus
+	closed  bool
+}
+
+func (self *lazyMessageBus) get() (MessageBus, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if self.closed {
+		return nil, ErrMessageBusClosed
+	}
+	if self.bus == nil {
+		bus, err := self.connect()
+		if err != nil {
+			return nil, err
+		}
+		self.bus = bus
+	}
+	return self.bus, nil
+}
+
+func (self *lazyMessageBus) Publish(subject string, data []byte) error {
+	bus, err := self.get()
+	if err != nil {
+		return err
+	}
+	return bus.Publish(subject, data)
+}
+
+func (self *lazyMessageBus) Subscribe(subject string, handler BusHandler) (BusSubscription, error) {
+	bus, err := self.get()
+	if err != nil {
+		return nil, err
+	}
+	return bus.Subscribe(subject, handler)
+}
+
+func (self *lazyMessageBus) Close() error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	self.closed = true
+	if self.bus == nil {
+		return nil
+	}
+	return self.bus.Close()
+}
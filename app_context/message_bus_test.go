@@ -0,0 +1,196 @@
+package app_context
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMatchSubject(t *testing.T) {
+	tests := []struct {
+		pattern string
+		subject string
+		match   bool
+	}{
+		{"a.b", "a.b", true},
+		{"a.b", "a.c", false},
+		{"a.*", "a.c", true},
+		{"a.*", "a.c.d", false},
+		{"a.>", "a.c.d", true},
+		{"a.>", "a", false},
+		{"*.b", "a.b", true},
+	}
+
+	for _, test := range tests {
+		if m := matchSubject(test.pattern, test.subject); m != test.match {
+			t.Errorf("matchSubject(%s, %s) = %v", test.pattern, test.subject, m)
+		}
+	}
+}
+
+func TestMemoryMessageBus(t *testing.T) {
+	app_ctx, err := NewAppContext("message_bus_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	app_ctx.SetMessageBus(NewMemoryMessageBus())
+	bus := app_ctx.MessageBus()
+
+	var got []string
+	sub, err := bus.Subscribe("orders.*", func(msg *BusMessage) {
+		got = append(got, msg.Subject+"="+string(msg.Data))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bus.Publish("orders.created", []byte("1"))
+	bus.Publish("users.created", []byte("2"))
+	sub.Unsubscribe()
+	bus.Publish("orders.created", []byte("3"))
+
+	if len(got) != 1 || got[0] != "orders.created=1" {
+		t.Errorf("Unexpected messages: %+v", got)
+	}
+
+	app_ctx.Close()
+
+	if err := bus.Publish("orders.created", nil); err != ErrMessageBusClosed {
+		t.Errorf("Publish after Close didn't fail: %v", err)
+	}
+}
+
+type fakeNATSServer struct {
+	listener net.Listener
+	lock     sync.Mutex
+	subs     map[*bufio.Writer]map[string]string
+}
+
+func (self *fakeNATSServer) serve(conn net.Conn) {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	writer := bufio.NewWriter(conn)
+
+	self.lock.Lock()
+	self.subs[writer] = make(map[string]string)
+	fmt.Fprintf(writer, "INFO {\"max_payload\":1048576}\r\n")
+	writer.Flush()
+	self.lock.Unlock()
+
+	for {
+		line, err := readNATSLine(reader)
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		self.lock.Lock()
+		switch fields[0] {
+		case "PING":
+			writer.WriteString("PONG\r\n")
+			writer.Flush()
+		case "SUB":
+			self.subs[writer][fields[2]] = fields[1]
+		case "UNSUB":
+			delete(self.subs[writer], fields[1])
+		case "PUB":
+			size, _ := strconv.Atoi(fields[2])
+			payload := make([]byte, size+2)
+			io.ReadFull(reader, payload)
+			for w, subs := range self.subs {
+				for sid, pattern := range subs {
+					if matchSubject(pattern, fields[1]) {
+						fmt.Fprintf(w, "MSG %s %s %d\r\n%s", fields[1], sid, size, payload)
+						w.Flush()
+					}
+				}
+			}
+		}
+		self.lock.Unlock()
+	}
+}
+
+func startFakeNATSServer(t *testing.T) *fakeNATSServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := &fakeNATSServer{
+		listener: listener,
+		subs:     make(map[*bufio.Writer]map[string]string),
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(conn)
+		}
+	}()
+
+	return server
+}
+
+func TestNATSMessageBus(t *testing.T) {
+	server := startFakeNATSServer(t)
+	defer server.listener.Close()
+
+	os.Setenv("NATS_URL", "nats://"+server.listener.Addr().String())
+	defer os.Unsetenv("NATS_URL")
+
+	app_ctx, err := NewAppContext("message_bus_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	bus := app_ctx.MessageBus()
+	if _, ok := bus.(*natsMessageBus); !ok {
+		t.Fatalf("NATS_URL set but bus is %T", bus)
+	}
+
+	got := make(chan *BusMessage, 1)
+	if _, err := bus.Subscribe("events.>", func(msg *BusMessage) { got <- msg }); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := bus.Publish("events.user.created", []byte("hello\r\nworld")); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case msg := <-got:
+		if msg.Subject != "events.user.created" || string(msg.Data) != "hello\r\nworld" {
+			t.Errorf("Unexpected message: %+v", msg)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timed out waiting for message")
+	}
+
+	if err := bus.Publish("bad subject", nil); err == nil {
+		t.Error("Publish with a space in the subject should fail")
+	}
+
+	if err := app_ctx.Close(); err != nil {
+		t.Errorf("Close failed: %s", err)
+	}
+
+	if err := bus.Publish("events.x", nil); err != ErrMessageBusClosed {
+		t.Errorf("Publish after Close didn't fail: %v", err)
+	}
+}
@@ -0,0 +1,218 @@
+package app_context
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Migrations are files named <version>_<title>.up.sql, the same layout and
+// schema_migrations table golang-migrate uses, so either can manage a
+// database. Down migrations are ignored.
+var migrationFileRE = regexp.MustCompile(`^([0-9]+)_(.*)\.up\.sql$`)
+
+type migration struct {
+	version int64
+	name    string
+	path    string
+}
+
+func listMigrations(dir string) ([]*migration, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't read migrations directory: %s", err)
+	}
+
+	migrations := make([]*migration, 0)
+	seen := make(map[int64]string)
+
+	for _, f := range files {
+		m := migrationFileRE.FindStringSubmatch(f.Name())
+		if f.IsDir() || m == nil {
+			continue
+		}
+		version, err := strconv.ParseInt(m[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid migration version in %s: %s", f.Name(), err)
+		}
+		if other, ok := seen[version]; ok {
+			return nil, fmt.Errorf("Migrations %s and %s have the same version", other, f.Name())
+		}
+		seen[version] = f.Name()
+		migrations = append(migrations, &migration{
+			version: version,
+			name:    m[2],
+			path:    filepath.Join(dir, f.Name()),
+		})
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].version < migrations[j].version
+	})
+
+	return migrations, nil
+}
+
+type sqlQueryer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+func ensureMigrationsTable(ctx context.Context, q sqlQueryer) error {
+	_, err := q.ExecContext(
+		ctx,
+		"CREATE TABLE IF NOT EXISTS schema_migrations (version bigint NOT NULL PRIMARY KEY, dirty boolean NOT NULL)",
+	)
+	return err
+}
+
+func migrationVersion(ctx context.Context, q sqlQueryer) (int64, bool, error) {
+	var version int64
+	var dirty bool
+	err := q.QueryRowContext(ctx, "SELECT version, dirty FROM schema_migrations LIMIT 1").Scan(&version, &dirty)
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	}
+	return version, dirty, err
+}
+
+// migrationLockID keeps apps sharing a server from blocking each other
+func (self *baseAppContext) migrationLockID() int64 {
+	h := fnv.New64a()
+	h.Write([]byte("schema_migrations:" + self.appName))
+	return int64(h.Sum64())
+}
+
+func (self *baseAppContext) applyMigration(ctx context.Context, conn *sql.Conn, m *migration) error {
+	query, err := ioutil.ReadFile(m.path)
+	if err != nil {
+		return err
+	}
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, string(query)); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM schema_migrations"); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "INSERT INTO schema_migrations (version, dirty) VALUES ($1, false)", m.version); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// MigrateDB applies every migration in dir newer than the database's
+// current version, each in its own transaction. An advisory lock stops
+// replicas starting at the same time from racing.
+func (self *baseAppContext) MigrateDB(dir string) error {
+	db := self.DB()
+	if db == nil {
+		return errors.New("No database is configured")
+	}
+
+	migrations, err := listMigrations(dir)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+
+	conn, err := db.DB.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	lock_id := self.migrationLockID()
+	if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", lock_id); err != nil {
+		return fmt.Errorf("Error taking migration lock: %s", err)
+	}
+	defer conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", lock_id)
+
+	if err := ensureMigrationsTable(ctx, conn); err != nil {
+		return fmt.Errorf("Error creating schema_migrations: %s", err)
+	}
+
+	version, dirty, err := migrationVersion(ctx, conn)
+	if err != nil {
+		return fmt.Errorf("Error reading migration version: %s", err)
+	}
+	if dirty {
+		return fmt.Errorf("Database is dirty at version %d, fix it by hand", version)
+	}
+
+	applied := 0
+	for _, m := range migrations {
+		if m.version <= version {
+			continue
+		}
+
+		start := time.Now()
+		if err := self.applyMigration(ctx, conn, m); err != nil {
+			return fmt.Errorf("Error applying migration %d_%s: %s", m.version, m.name, err)
+		}
+		self.Logger().LogInfof(ctx, "Applied migration %d_%s in %s", m.version, m.name, time.Since(start))
+		applied++
+	}
+
+	if applied == 0 {
+		self.Logger().LogInfof(ctx, "Database is up to date at version %d", version)
+	}
+
+	return nil
+}
+
+// MigrationVersion returns the database's current migration version, or 0
+// if no migrations have been applied.
+func (self *baseAppContext) MigrationVersion() (int64, error) {
+	db := self.DB()
+	if db == nil {
+		return 0, errors.New("No database is configured")
+	}
+
+	ctx := context.Background()
+
+	var exists bool
+	if err := db.QueryRowContext(ctx, "SELECT to_regclass('schema_migrations') IS NOT NULL").Scan(&exists); err != nil {
+		return 0, err
+	}
+	if !exists {
+		return 0, nil
+	}
+
+	version, _, err := migrationVersion(ctx, db)
+	return version, err
+}
+
+// RUN_MIGRATIONS=true applies migrations from MIGRATIONS_DIR (default
+// "migrations") when the app context is created.
+func (self *baseAppContext) runMigrationsFromEnv() error {
+	run, _, err := self.getBoolFromEnv("RUN_MIGRATIONS")
+	if err != nil || !run {
+		return err
+	}
+
+	return self.MigrateDB(self.migrationsDir())
+}
+
+func (self *baseAppContext) migrationsDir() string {
+	if dir := self.getEnv("MIGRATIONS_DIR"); dir != "" {
+		return dir
+	}
+	return "migrations"
+}
@@ -0,0 +1,71 @@
+package app_context
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestListMigrations(t *testing.T) {
+	dir, err := ioutil.TempDir("", "migrate_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{
+		"10_add_index.up.sql",
+		"10_add_index.down.sql",
+		"2_create_users.up.sql",
+		"README.md",
+		"0001_init.up.sql",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("SELECT 1"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	migrations, err := listMigrations(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(migrations) != 3 {
+		t.Fatalf("Expected 3 migrations, got %d", len(migrations))
+	}
+	for i, expected := range []int64{1, 2, 10} {
+		if migrations[i].version != expected {
+			t.Errorf("Migration %d has version %d, expected %d", i, migrations[i].version, expected)
+		}
+	}
+	if migrations[1].name != "create_users" {
+		t.Errorf("Unexpected migration name: %s", migrations[1].name)
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, "02_dupe.up.sql"), []byte("SELECT 1"), 0600)
+	if _, err := listMigrations(dir); err == nil {
+		t.Error("Duplicate versions should fail")
+	}
+}
+
+func TestMigrateWithoutDB(t *testing.T) {
+	os.Unsetenv("DB_DSN")
+
+	app_ctx, err := NewAppContext("migrate_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err := app_ctx.MigrateDB("migrations"); err == nil {
+		t.Error("MigrateDB should fail without a database")
+	}
+
+	os.Setenv("RUN_MIGRATIONS", "true")
+	defer os.Unsetenv("RUN_MIGRATIONS")
+
+	if _, err := NewAppContext("migrate_test"); err == nil {
+		t.Error("RUN_MIGRATIONS=true should fail without a database")
+	}
+}
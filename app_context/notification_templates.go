@@ -0,0 +1,457 @@
+package app_context
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	html_template "html/template"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+)
+
+// ErrUnknownTemplate is returned when rendering a notification template
+// or version that isn't in the catalog
+var ErrUnknownTemplate = errors.New("Unknown notification template")
+
+// ChannelWebhook is the channel of webhook payload templates, alongside
+// ChannelEmail and ChannelSMS
+const ChannelWebhook = "webhook"
+
+// RenderedNotification is a notification template filled in. Which parts
+// are set depends on the template: subject, text and html for email, text
+// for SMS, body for webhooks.
+type RenderedNotification struct {
+	Channel string            `json:"channel"`
+	Name    string            `json:"name"`
+	Version int               `json:"version"`
+	Parts   map[string]string `json:"parts"`
+}
+
+// ToEmail sets email's Subject, Text and HTML from the rendered parts
+func (self *RenderedNotification) ToEmail(email *Email) *Email {
+	email.Subject = self.Parts["subject"]
+	email.Text = self.Parts["text"]
+	email.HTML = self.Parts["html"]
+	return email
+}
+
+// NotificationTemplateInfo describes a template in the catalog
+type NotificationTemplateInfo struct {
+	Channel  string   `json:"channel"`
+	Name     string   `json:"name"`
+	Versions []int    `json:"versions"`
+	Parts    []string `json:"parts"`
+	Source   string   `json:"source"`
+}
+
+// NotificationTemplateCatalog is the versioned templates notifications are
+// rendered from. A new version of a template is added alongside the old
+// ones, so a notification can be rendered again exactly as it was first
+// sent. Failed renders are counted in notification_template.render_errors
+// tagged with channel, name and version.
+type NotificationTemplateCatalog interface {
+	// Render fills in the latest version of name
+	Render(ctx context.Context, channel, name string, data interface{}) (*RenderedNotification, error)
+	RenderVersion(ctx context.Context, channel, name string, version int, data interface{}) (*RenderedNotification, error)
+	List() []*NotificationTemplateInfo
+	// Reload reads the templates again, keeping the current ones if
+	// that fails
+	Reload(ctx context.Context) error
+}
+
+type templateExecutor interface {
+	Execute(w io.Writer, data interface{}) error
+}
+
+type notificationTemplate struct {
+	channel string
+	name    string
+	version int
+	source  string
+	parts   map[string]templateExecutor
+}
+
+// parseTemplatePart parses the html part as HTML and anything else as
+// text. Missing keys are errors rather than "<no value>".
+func parseTemplatePart(name, part, source string) (templateExecutor, error) {
+	if part == "html" {
+		return html_template.New(name).Option("missingkey=error").Parse(source)
+	}
+	if part == "subject" {
+		source = strings.TrimSpace(source)
+	}
+	return template.New(name).Option("missingkey=error").Parse(source)
+}
+
+func (self *notificationTemplate) addPart(part, source string) error {
+	tmpl, err := parseTemplatePart(
+		fmt.Sprintf("%s/%s/v%d.%s", self.channel, self.name, self.version, part),
+		part,
+		source,
+	)
+	if err != nil {
+		return err
+	}
+	self.parts[part] = tmpl
+	return nil
+}
+
+// templateVersions is every version of a template, oldest first
+type templateVersions []*notificationTemplate
+
+// notificationTemplateSet is templates by channel/name
+type notificationTemplateSet map[string]templateVersions
+
+func (self notificationTemplateSet) get(channel, name string, version int) *notificationTemplate {
+	for _, tmpl := range self[channel+"/"+name] {
+		if tmpl.version == version {
+			return tmpl
+		}
+	}
+	return nil
+}
+
+func (self notificationTemplateSet) add(tmpl *notificationTemplate) error {
+	if existing := self.get(tmpl.channel, tmpl.name, tmpl.version); existing != nil {
+		return fmt.Errorf(
+			"Notification template %s/%s v%d is in both %s and %s",
+			tmpl.channel, tmpl.name, tmpl.version, existing.source, tmpl.source,
+		)
+	}
+	key := tmpl.channel + "/" + tmpl.name
+	versions := append(self[key], tmpl)
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i].version < versions[j].version
+	})
+	self[key] = versions
+	return nil
+}
+
+// loadNotificationTemplateFiles reads <dir>/<channel>/<name>/v<version>.<part>.tmpl
+func loadNotificationTemplateFiles(dir string, set notificationTemplateSet) error {
+	files, err := filepath.Glob(filepath.Join(dir, "*", "*", "v*.tmpl"))
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		if _, err := os.Stat(dir); err != nil {
+			return fmt.Errorf("Couldn't read NOTIFICATION_TEMPLATE_PATH: %s", err)
+		}
+	}
+
+	loaded := make(map[string]*notificationTemplate)
+	for _, path := range files {
+		rel, _ := filepath.Rel(dir, path)
+		dirs := strings.Split(filepath.ToSlash(rel), "/")
+		base := strings.TrimSuffix(dirs[2], ".tmpl")
+		i := strings.IndexByte(base, '.')
+		if i < 0 {
+			continue
+		}
+		version, err := strconv.Atoi(base[1:i])
+		if err != nil || version < 1 {
+			return fmt.Errorf("Invalid notification template version in %s", rel)
+		}
+
+		key := fmt.Sprintf("%s/%s/%d", dirs[0], dirs[1], version)
+		tmpl, ok := loaded[key]
+		if !ok {
+			tmpl = &notificationTemplate{
+				channel: dirs[0],
+				name:    dirs[1],
+				version: version,
+				source:  "file:" + filepath.Dir(path),
+				parts:   make(map[string]templateExecutor),
+			}
+			loaded[key] = tmpl
+		}
+
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if err := tmpl.addPart(base[i+1:], string(data)); err != nil {
+			return fmt.Errorf("Error parsing notification template %s: %s", rel, err)
+		}
+	}
+
+	for _, tmpl := range loaded {
+		if err := set.add(tmpl); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadNotificationTemplateRows reads the notification_templates table,
+// one row per part of each version
+func (self *notificationTemplateCatalog) loadNotificationTemplateRows(ctx context.Context, set notificationTemplateSet) error {
+	db := self.appctx.DBRead()
+	if db == nil {
+		return errors.New("NOTIFICATION_TEMPLATE_DB needs a database")
+	}
+	rows, err := db.QueryContext(
+		ctx,
+		`SELECT channel, name, version, part, source FROM notification_templates`,
+	)
+	if err != nil {
+		return fmt.Errorf("Error reading notification_templates: %s", err)
+	}
+	defer rows.Close()
+
+	loaded := make(map[string]*notificationTemplate)
+	for rows.Next() {
+		var channel, name, part, source string
+		var version int
+		if err := rows.Scan(&channel, &name, &version, &part, &source); err != nil {
+			return err
+		}
+		key := fmt.Sprintf("%s/%s/%d", channel, name, version)
+		tmpl, ok := loaded[key]
+		if !ok {
+			tmpl = &notificationTemplate{
+				channel: channel,
+				name:    name,
+				version: version,
+				source:  "db",
+				parts:   make(map[string]templateExecutor),
+			}
+			loaded[key] = tmpl
+		}
+		if err := tmpl.addPart(part, source); err != nil {
+			return fmt.Errorf("Error parsing notification template %s part %s: %s", key, part, err)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, tmpl := range loaded {
+		if err := set.add(tmpl); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type notificationTemplateCatalog struct {
+	appctx  *baseAppContext
+	path    string
+	fromDB  bool
+	lock    sync.RWMutex
+	set     notificationTemplateSet
+	loadErr string
+}
+
+func newNotificationTemplateCatalog(appctx *baseAppContext) *notificationTemplateCatalog {
+	return &notificationTemplateCatalog{
+		appctx: appctx,
+		set:    make(notificationTemplateSet),
+	}
+}
+
+func (self *notificationTemplateCatalog) Reload(ctx context.Context) error {
+	set := make(notificationTemplateSet)
+	err := func() error {
+		if self.path != "" {
+			if err := loadNotificationTemplateFiles(self.path, set); err != nil {
+				return err
+			}
+		}
+		if self.fromDB {
+			return self.loadNotificationTemplateRows(ctx, set)
+		}
+		return nil
+	}()
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if err != nil {
+		self.loadErr = err.Error()
+		return err
+	}
+	self.set = set
+	self.loadErr = ""
+	return nil
+}
+
+func (self *notificationTemplateCatalog) render(ctx context.Context, channel, name string, version int, data interface{}) (*RenderedNotification, error) {
+	self.lock.RLock()
+	var tmpl *notificationTemplate
+	if version == 0 {
+		if versions := self.set[channel+"/"+name]; len(versions) > 0 {
+			tmpl = versions[len(versions)-1]
+		}
+	} else {
+		tmpl = self.set.get(channel, name, version)
+	}
+	self.lock.RUnlock()
+
+	if tmpl == nil {
+		return nil, ErrUnknownTemplate
+	}
+
+	rendered := &RenderedNotification{
+		Channel: channel,
+		Name:    name,
+		Version: tmpl.version,
+		Parts:   make(map[string]string, len(tmpl.parts)),
+	}
+	var buf bytes.Buffer
+	for part, exec := range tmpl.parts {
+		buf.Reset()
+		if err := exec.Execute(&buf, data); err != nil {
+			self.appctx.MetricsClient().Incr("notification_template.render_errors", 1.0, map[string]string{
+				"channel": channel,
+				"name":    name,
+				"version": strconv.Itoa(tmpl.version),
+			})
+			return nil, fmt.Errorf("Error rendering %s of %s/%s v%d: %s", part, channel, name, tmpl.version, err)
+		}
+		rendered.Parts[part] = buf.String()
+	}
+	return rendered, nil
+}
+
+func (self *notificationTemplateCatalog) Render(ctx context.Context, channel, name string, data interface{}) (*RenderedNotification, error) {
+	return self.render(ctx, channel, name, 0, data)
+}
+
+func (self *notificationTemplateCatalog) RenderVersion(ctx context.Context, channel, name string, version int, data interface{}) (*RenderedNotification, error) {
+	if version < 1 {
+		return nil, ErrUnknownTemplate
+	}
+	return self.render(ctx, channel, name, version, data)
+}
+
+func (self *notificationTemplateCatalog) List() []*NotificationTemplateInfo {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+
+	infos := make([]*NotificationTemplateInfo, 0, len(self.set))
+	for _, versions := range self.set {
+		latest := versions[len(versions)-1]
+		info := &NotificationTemplateInfo{
+			Channel: latest.channel,
+			Name:    latest.name,
+			Source:  latest.source,
+		}
+		for _, tmpl := range versions {
+			info.Versions = append(info.Versions, tmpl.version)
+		}
+		for part := range latest.parts {
+			info.Parts = append(info.Parts, part)
+		}
+		sort.Strings(info.Parts)
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		if infos[i].Channel != infos[j].Channel {
+			return infos[i].Channel < infos[j].Channel
+		}
+		return infos[i].Name < infos[j].Name
+	})
+	return infos
+}
+
+func (self *notificationTemplateCatalog) status() map[string]interface{} {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	return map[string]interface{}{
+		"path":       self.path,
+		"db":         self.fromDB,
+		"templates":  len(self.set),
+		"last_error": self.loadErr,
+	}
+}
+
+type templatePreviewRequest struct {
+	Channel string          `json:"channel"`
+	Name    string          `json:"name"`
+	Version int             `json:"version"`
+	Data    json.RawMessage `json:"data"`
+}
+
+// notificationTemplatesAdminHandler serves /admin/templates:
+//
+//	GET                    the templates and their versions
+//	POST {"channel", "name", "version", "data"}
+//	                       render a template with data, the latest
+//	                       version if version is 0
+//
+// Every request needs ADMIN_TOKEN as a bearer token.
+func (self *baseAppContext) notificationTemplatesAdminHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !self.adminAuthorized(r) {
+			writeAdminError(w, http.StatusUnauthorized, "A valid ADMIN_TOKEN bearer token is required")
+			return
+		}
+
+		catalog := self.notifyTemplates
+		switch r.Method {
+		case "GET":
+			writeAdminJSON(w, http.StatusOK, catalog.List())
+		case "POST":
+			var req templatePreviewRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				writeAdminError(w, http.StatusBadRequest, "Invalid JSON: "+err.Error())
+				return
+			}
+			var data interface{}
+			if len(req.Data) > 0 {
+				if err := json.Unmarshal(req.Data, &data); err != nil {
+					writeAdminError(w, http.StatusBadRequest, "Invalid data: "+err.Error())
+					return
+				}
+			}
+			rendered, err := catalog.render(r.Context(), req.Channel, req.Name, req.Version, data)
+			if err == ErrUnknownTemplate {
+				writeAdminError(w, http.StatusNotFound, err.Error())
+				return
+			}
+			if err != nil {
+				writeAdminError(w, http.StatusUnprocessableEntity, err.Error())
+				return
+			}
+			writeAdminJSON(w, http.StatusOK, rendered)
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			writeAdminError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		}
+	})
+}
+
+func (self *baseAppContext) NotificationTemplates() NotificationTemplateCatalog {
+	return self.notifyTemplates
+}
+
+// NOTIFICATION_TEMPLATE_PATH is a directory of
+// <channel>/<name>/v<version>.<part>.tmpl files, eg.
+// email/welcome/v2.html.tmpl, and NOTIFICATION_TEMPLATE_DB=true also reads
+// the notification_templates table (channel, name, version, part,
+// source). Both are read at startup and again by Reload.
+func (self *baseAppContext) setNotificationTemplatesFromEnv() error {
+	catalog := self.notifyTemplates
+	catalog.path = self.getEnv("NOTIFICATION_TEMPLATE_PATH")
+
+	from_db, _, err := self.getBoolFromEnv("NOTIFICATION_TEMPLATE_DB")
+	if err != nil {
+		return err
+	}
+	catalog.fromDB = from_db
+
+	if catalog.path == "" && !catalog.fromDB {
+		return nil
+	}
+	return catalog.Reload(context.Background())
+}
@@ -0,0 +1,145 @@
+package app_context
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeTemplateFiles(t *testing.T, dir string, files map[string]string) {
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestNotificationTemplates(t *testing.T) {
+	dir := t.TempDir()
+	writeTemplateFiles(t, dir, map[string]string{
+		"email/welcome/v1.subject.tmpl": "Welcome\n",
+		"email/welcome/v1.text.tmpl":    "Hi {{.Name}}",
+		"email/welcome/v2.subject.tmpl": "Welcome, {{.Name}}\n",
+		"email/welcome/v2.text.tmpl":    "Hi {{.Name}}!",
+		"email/welcome/v2.html.tmpl":    "<p>Hi {{.Name}}!</p>",
+		"sms/code/v1.text.tmpl":         "Your code is {{.Code}}",
+	})
+
+	os.Setenv("NOTIFICATION_TEMPLATE_PATH", dir)
+	defer os.Unsetenv("NOTIFICATION_TEMPLATE_PATH")
+
+	app_ctx, err := NewAppContext("notification_templates_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer app_ctx.Close()
+
+	mcli := newCountingMetricsClient()
+	app_ctx.SetMetricsClient(mcli)
+	ctx := context.Background()
+	catalog := app_ctx.NotificationTemplates()
+
+	rendered, err := catalog.Render(ctx, ChannelEmail, "welcome", map[string]string{"Name": "<Bob>"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	email := rendered.ToEmail(&Email{})
+	if rendered.Version != 2 || email.Subject != "Welcome, <Bob>" || email.HTML != "<p>Hi &lt;Bob&gt;!</p>" {
+		t.Errorf("Unexpected render: %+v", rendered)
+	}
+
+	rendered, err = catalog.RenderVersion(ctx, ChannelEmail, "welcome", 1, map[string]string{"Name": "Bob"})
+	if err != nil || rendered.Parts["text"] != "Hi Bob" || rendered.Parts["html"] != "" {
+		t.Errorf("Unexpected v1 render: %+v, %v", rendered, err)
+	}
+
+	if _, err := catalog.RenderVersion(ctx, ChannelEmail, "welcome", 3, nil); err != ErrUnknownTemplate {
+		t.Errorf("Expected ErrUnknownTemplate, got %v", err)
+	}
+	if _, err := catalog.Render(ctx, ChannelSMS, "code", map[string]string{}); err == nil {
+		t.Error("Expected a missing key to fail the render")
+	}
+	if mcli.count("notification_template.render_errors") != 1 {
+		t.Errorf("Expected the failure to be counted, got %v", mcli.counts)
+	}
+
+	infos := catalog.List()
+	if len(infos) != 2 || infos[0].Name != "welcome" || len(infos[0].Versions) != 2 || infos[1].Channel != ChannelSMS {
+		t.Errorf("Unexpected templates: %+v", infos)
+	}
+
+	writeTemplateFiles(t, dir, map[string]string{"sms/code/v2.text.tmpl": "Code: {{.Code}}"})
+	if err := catalog.Reload(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if rendered, _ := catalog.Render(ctx, ChannelSMS, "code", map[string]string{"Code": "1234"}); rendered.Parts["text"] != "Code: 1234" {
+		t.Errorf("Expected the new version after reloading, got %+v", rendered)
+	}
+
+	writeTemplateFiles(t, dir, map[string]string{"sms/code/v3.text.tmpl": "{{.Code"})
+	if err := catalog.Reload(ctx); err == nil {
+		t.Error("Expected a parse error reloading")
+	}
+	if rendered, _ := catalog.Render(ctx, ChannelSMS, "code", map[string]string{"Code": "1"}); rendered.Version != 2 {
+		t.Errorf("Expected the templates to be kept after a failed reload, got %+v", rendered)
+	}
+}
+
+func TestNotificationTemplatesAdmin(t *testing.T) {
+	dir := t.TempDir()
+	writeTemplateFiles(t, dir, map[string]string{
+		"webhook/order_paid/v1.body.tmpl": `{"order": "{{.ID}}"}`,
+	})
+
+	os.Setenv("NOTIFICATION_TEMPLATE_PATH", dir)
+	os.Setenv("ADMIN_TOKEN", "admin-secret")
+	defer os.Unsetenv("NOTIFICATION_TEMPLATE_PATH")
+	defer os.Unsetenv("ADMIN_TOKEN")
+
+	app_ctx, err := NewAppContext("notification_templates_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer app_ctx.Close()
+
+	handler := app_ctx.(*baseAppContext).notificationTemplatesAdminHandler()
+	preview := func(token, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/admin/templates", strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := preview("wrong", `{}`); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without the admin token, got %d", w.Code)
+	}
+
+	w := preview("admin-secret", `{"channel": "webhook", "name": "order_paid", "data": {"ID": "o-1"}}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body)
+	}
+	var rendered RenderedNotification
+	json.NewDecoder(w.Body).Decode(&rendered)
+	if rendered.Parts["body"] != `{"order": "o-1"}` {
+		t.Errorf("Unexpected preview: %+v", rendered)
+	}
+
+	if w := preview("admin-secret", `{"channel": "webhook", "name": "order_paid", "data": {}}`); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected 422 for a failed render, got %d", w.Code)
+	}
+	if w := preview("admin-secret", `{"channel": "sms", "name": "order_paid"}`); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown template, got %d", w.Code)
+	}
+}
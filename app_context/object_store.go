@@ -0,0 +1,342 @@
+package app_context
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+type ObjectInfo struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
+}
+
+// ObjectStore is a bucket of files. Keys are relative to the prefix in
+// OBJECT_STORE_URL.
+type ObjectStore interface {
+	Put(ctx context.Context, key string, body io.Reader, content_type string) error
+	// Get returns ErrObjectNotFound if key doesn't exist
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	Delete(ctx context.Context, key string) error
+	List(ctx context.Context, prefix string) ([]*ObjectInfo, error)
+}
+
+var ErrObjectNotFound = errors.New("Object not found")
+
+var errNoObjectStore = errors.New("No object store is configured")
+
+type noopObjectStore struct{}
+
+func (self *noopObjectStore) Put(ctx context.Context, key string, body io.Reader, content_type string) error {
+	return errNoObjectStore
+}
+
+func (self *noopObjectStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	return nil, errNoObjectStore
+}
+
+func (self *noopObjectStore) Delete(ctx context.Context, key string) error {
+	return errNoObjectStore
+}
+
+func (self *noopObjectStore) List(ctx context.Context, prefix string) ([]*ObjectInfo, error) {
+	return nil, errNoObjectStore
+}
+
+// NewNOOPObjectStore returns a store that fails every call, so code using
+// one without OBJECT_STORE_URL set finds out rather than losing files
+func NewNOOPObjectStore() ObjectStore {
+	return &noopObjectStore{}
+}
+
+// fileObjectStore keeps objects as files under a directory, for local
+// development and tests
+type fileObjectStore struct {
+	root string
+}
+
+// path returns key's file, refusing keys that would escape the root
+func (self *fileObjectStore) path(key string) (string, error) {
+	clean := filepath.Clean("/" + key)
+	if clean == "/" || strings.HasPrefix(filepath.Base(clean), ".objstore-") {
+		return "", fmt.Errorf("Invalid object key '%s'", key)
+	}
+	return filepath.Join(self.root, clean), nil
+}
+
+func (self *fileObjectStore) Put(ctx context.Context, key string, body io.Reader, content_type string) error {
+	path, err := self.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	// Written aside and renamed so readers never see part of a file
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".objstore-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, body); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (self *fileObjectStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	path, err := self.path(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, ErrObjectNotFound
+	}
+	return f, err
+}
+
+func (self *fileObjectStore) Delete(ctx context.Context, key string) error {
+	path, err := self.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (self *fileObjectStore) List(ctx context.Context, prefix string) ([]*ObjectInfo, error) {
+	objects := make([]*ObjectInfo, 0)
+	err := filepath.Walk(self.root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == self.root {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if info.IsDir() || strings.HasPrefix(info.Name(), ".objstore-") {
+			return nil
+		}
+		rel, err := filepath.Rel(self.root, path)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if strings.HasPrefix(key, prefix) {
+			objects = append(objects, &ObjectInfo{Key: key, Size: info.Size(), LastModified: info.ModTime()})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Key < objects[j].Key
+	})
+	return objects, nil
+}
+
+// s3ObjectStore also serves gs:// buckets through GCS's S3 compatible API
+type s3ObjectStore struct {
+	svc    *s3.S3
+	bucket string
+	prefix string
+}
+
+// send runs req with ctx; the vendored SDK predates context support
+func sendWithContext(ctx context.Context, req *request.Request) error {
+	req.HTTPRequest = req.HTTPRequest.WithContext(ctx)
+	return req.Send()
+}
+
+func isS3NotFound(err error) bool {
+	if aerr, ok := err.(awserr.Error); ok {
+		switch aerr.Code() {
+		case "NoSuchKey", "NotFound":
+			return true
+		}
+	}
+	return false
+}
+
+func (self *s3ObjectStore) Put(ctx context.Context, key string, body io.Reader, content_type string) error {
+	seeker, ok := body.(io.ReadSeeker)
+	if !ok {
+		data, err := ioutil.ReadAll(body)
+		if err != nil {
+			return err
+		}
+		seeker = bytes.NewReader(data)
+	}
+
+	input := (&s3.PutObjectInput{}).
+		SetBucket(self.bucket).
+		SetKey(self.prefix + key).
+		SetBody(seeker)
+	if content_type != "" {
+		input.SetContentType(content_type)
+	}
+	req, _ := self.svc.PutObjectRequest(input)
+	return sendWithContext(ctx, req)
+}
+
+func (self *s3ObjectStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	req, out := self.svc.GetObjectRequest(
+		(&s3.GetObjectInput{}).SetBucket(self.bucket).SetKey(self.prefix + key),
+	)
+	if err := sendWithContext(ctx, req); err != nil {
+		if isS3NotFound(err) {
+			return nil, ErrObjectNotFound
+		}
+		return nil, err
+	}
+	return out.Body, nil
+}
+
+func (self *s3ObjectStore) Delete(ctx context.Context, key string) error {
+	req, _ := self.svc.DeleteObjectRequest(
+		(&s3.DeleteObjectInput{}).SetBucket(self.bucket).SetKey(self.prefix + key),
+	)
+	return sendWithContext(ctx, req)
+}
+
+// List uses the original ListObjects, which GCS supports as well as S3
+func (self *s3ObjectStore) List(ctx context.Context, prefix string) ([]*ObjectInfo, error) {
+	objects := make([]*ObjectInfo, 0)
+	input := (&s3.ListObjectsInput{}).SetBucket(self.bucket).SetPrefix(self.prefix + prefix)
+
+	for {
+		req, out := self.svc.ListObjectsRequest(input)
+		if err := sendWithContext(ctx, req); err != nil {
+			return nil, err
+		}
+
+		for _, obj := range out.Contents {
+			objects = append(objects, &ObjectInfo{
+				Key:          strings.TrimPrefix(aws.StringValue(obj.Key), self.prefix),
+				Size:         aws.Int64Value(obj.Size),
+				LastModified: aws.TimeValue(obj.LastModified),
+			})
+		}
+
+		if !aws.BoolValue(out.IsTruncated) || len(out.Contents) == 0 {
+			return objects, nil
+		}
+		marker := aws.StringValue(out.NextMarker)
+		if marker == "" {
+			marker = aws.StringValue(out.Contents[len(out.Contents)-1].Key)
+		}
+		input.SetMarker(marker)
+	}
+}
+
+func (self *baseAppContext) ObjectStore() ObjectStore {
+	self.componentsLock.RLock()
+	defer self.componentsLock.RUnlock()
+	return self.objectStore
+}
+
+func (self *baseAppContext) SetObjectStore(store ObjectStore) AppContext {
+	self.componentsLock.Lock()
+	defer self.componentsLock.Unlock()
+	self.objectStore = store
+	return self
+}
+
+// OBJECT_STORE_URL is one of:
+//
+//	s3://bucket/prefix?region=us-east-1
+//	gs://bucket/prefix
+//	file:///path/to/dir
+//
+// S3 uses the usual AWS credentials from the environment, and the region
+// from AWS_REGION if the URL doesn't give one. GCS needs HMAC keys in
+// GCS_HMAC_ACCESS_KEY_ID and GCS_HMAC_SECRET. OBJECT_STORE_ENDPOINT points
+// s3:// at another S3 compatible service, like minio.
+func (self *baseAppContext) setObjectStoreFromEnv() error {
+	store_url := self.getEnv("OBJECT_STORE_URL")
+	if store_url == "" {
+		return nil
+	}
+
+	u, err := url.Parse(store_url)
+	if err != nil {
+		return fmt.Errorf("Invalid OBJECT_STORE_URL: %s", err)
+	}
+
+	if u.Scheme == "file" {
+		if u.Path == "" {
+			return fmt.Errorf("OBJECT_STORE_URL needs a directory")
+		}
+		self.objectStore = &fileObjectStore{root: u.Path}
+		return nil
+	}
+
+	if u.Host == "" {
+		return fmt.Errorf("OBJECT_STORE_URL needs a bucket")
+	}
+	prefix := strings.TrimPrefix(u.Path, "/")
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+
+	config := &aws.Config{}
+	switch u.Scheme {
+	case "s3":
+		if region := u.Query().Get("region"); region != "" {
+			config.WithRegion(region)
+		}
+		if endpoint := self.getEnv("OBJECT_STORE_ENDPOINT"); endpoint != "" {
+			config.WithEndpoint(endpoint).WithS3ForcePathStyle(true)
+		}
+	case "gs":
+		access_key, secret := self.getEnv("GCS_HMAC_ACCESS_KEY_ID"), self.getEnv("GCS_HMAC_SECRET")
+		if access_key == "" || secret == "" {
+			return fmt.Errorf("gs:// OBJECT_STORE_URL needs GCS_HMAC_ACCESS_KEY_ID and GCS_HMAC_SECRET")
+		}
+		config.
+			WithRegion("auto").
+			WithEndpoint("https://storage.googleapis.com").
+			WithCredentials(credentials.NewStaticCredentials(access_key, secret, ""))
+	default:
+		return fmt.Errorf("Unsupported OBJECT_STORE_URL scheme '%s'", u.Scheme)
+	}
+
+	sess, err := session.NewSession()
+	if err != nil {
+		return fmt.Errorf("Error creating new aws session: %s", err)
+	}
+
+	self.objectStore = &s3ObjectStore{
+		svc:    s3.New(sess, config),
+		bucket: u.Host,
+		prefix: prefix,
+	}
+
+	return nil
+}
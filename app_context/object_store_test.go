@@ -0,0 +1,163 @@
+package app_context
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func testObjectStore(t *testing.T, store ObjectStore) {
+	ctx := context.Background()
+
+	if err := store.Put(ctx, "reports/a.csv", strings.NewReader("a,b"), "text/csv"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Put(ctx, "reports/b.csv", strings.NewReader("c,d"), "text/csv"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Put(ctx, "other.txt", strings.NewReader("x"), ""); err != nil {
+		t.Fatal(err)
+	}
+
+	body, err := store.Get(ctx, "reports/a.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadAll(body)
+	body.Close()
+	if string(data) != "a,b" {
+		t.Errorf("Unexpected object contents: %q", data)
+	}
+
+	if _, err := store.Get(ctx, "missing"); err != ErrObjectNotFound {
+		t.Errorf("Expected ErrObjectNotFound, got %v", err)
+	}
+
+	objects, err := store.List(ctx, "reports/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 2 || objects[0].Key != "reports/a.csv" || objects[1].Key != "reports/b.csv" || objects[0].Size != 3 {
+		t.Errorf("Unexpected objects: %+v", objects)
+	}
+
+	if err := store.Delete(ctx, "reports/a.csv"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get(ctx, "reports/a.csv"); err != ErrObjectNotFound {
+		t.Errorf("Expected the object to be deleted, got %v", err)
+	}
+}
+
+func TestFileObjectStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "object_store_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	os.Setenv("OBJECT_STORE_URL", "file://"+dir)
+	defer os.Unsetenv("OBJECT_STORE_URL")
+
+	app_ctx, err := NewAppContext("object_store_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer app_ctx.Close()
+
+	testObjectStore(t, app_ctx.ObjectStore())
+
+	// Keys can't escape the directory
+	if err := app_ctx.ObjectStore().Put(context.Background(), "../../etc/x", strings.NewReader(""), ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(dir + "/etc/x"); err != nil {
+		t.Errorf("Expected the key to stay under the root: %s", err)
+	}
+}
+
+// fakeS3 serves path style requests for one bucket
+type fakeS3 struct {
+	lock    sync.Mutex
+	objects map[string]string
+}
+
+func (self *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	key := strings.TrimPrefix(r.URL.Path, "/bucket/")
+	switch {
+	case r.Method == "PUT":
+		data, _ := ioutil.ReadAll(r.Body)
+		self.objects[key] = string(data)
+	case r.Method == "DELETE":
+		delete(self.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	case r.URL.Path == "/bucket/" || r.URL.Path == "/bucket":
+		prefix := r.URL.Query().Get("prefix")
+		fmt.Fprint(w, `<ListBucketResult><IsTruncated>false</IsTruncated>`)
+		for _, k := range []string{"uploads/other.txt", "uploads/reports/a.csv", "uploads/reports/b.csv"} {
+			if data, ok := self.objects[k]; ok && strings.HasPrefix(k, prefix) {
+				fmt.Fprintf(w, `<Contents><Key>%s</Key><Size>%d</Size></Contents>`, k, len(data))
+			}
+		}
+		fmt.Fprint(w, `</ListBucketResult>`)
+	default:
+		data, ok := self.objects[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `<Error><Code>NoSuchKey</Code><Message>Not found</Message></Error>`)
+			return
+		}
+		fmt.Fprint(w, data)
+	}
+}
+
+func TestS3ObjectStore(t *testing.T) {
+	server := httptest.NewServer(&fakeS3{objects: make(map[string]string)})
+	defer server.Close()
+
+	os.Setenv("OBJECT_STORE_URL", "s3://bucket/uploads?region=us-east-1")
+	os.Setenv("OBJECT_STORE_ENDPOINT", server.URL)
+	os.Setenv("AWS_ACCESS_KEY_ID", "key")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	defer os.Unsetenv("OBJECT_STORE_URL")
+	defer os.Unsetenv("OBJECT_STORE_ENDPOINT")
+	defer os.Unsetenv("AWS_ACCESS_KEY_ID")
+	defer os.Unsetenv("AWS_SECRET_ACCESS_KEY")
+
+	app_ctx, err := NewAppContext("object_store_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer app_ctx.Close()
+
+	testObjectStore(t, app_ctx.ObjectStore())
+}
+
+func TestObjectStoreFromEnv(t *testing.T) {
+	app_ctx, err := NewAppContext("object_store_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := app_ctx.ObjectStore().Put(context.Background(), "a", strings.NewReader(""), ""); err == nil {
+		t.Errorf("Expected the NOOP store to fail")
+	}
+	app_ctx.Close()
+
+	for _, store_url := range []string{"ftp://bucket", "s3://", "gs://bucket"} {
+		os.Setenv("OBJECT_STORE_URL", store_url)
+		if _, err := NewAppContext("object_store_test"); err == nil {
+			t.Errorf("Expected OBJECT_STORE_URL=%s to fail", store_url)
+		}
+	}
+	os.Unsetenv("OBJECT_STORE_URL")
+}
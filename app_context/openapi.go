@@ -0,0 +1,672 @@
+package app_context
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// maxValidatedResponse is the most of a response body that's kept to
+// validate; larger responses aren't validated
+const maxValidatedResponse = 1 << 20
+
+var openAPIMethods = []string{"get", "put", "post", "delete", "options", "head", "patch", "trace"}
+
+// OpenAPI checks requests against an OpenAPI 3 spec in JSON, from
+// OPENAPI_SPEC_PATH or openapi.json under JSON_SCHEMA_FILEPATH. Schemas
+// are checked as by SchemaRegistry(), and may $ref its files.
+//
+// Requests to operations in the spec with parameters or bodies that don't
+// match are answered with a 400. Responses are checked too with
+// OPENAPI_VALIDATE_RESPONSES, but as they've been sent by then, ones that
+// don't match are only logged and counted as openapi.response_errors.
+type OpenAPI interface {
+	Middleware(next http.Handler) http.Handler
+	// Handler serves the spec, unless OPENAPI_SERVE_SPEC is off
+	Handler() http.Handler
+	// Operations are the spec's operations, eg. "GET /orders/{id}"
+	Operations() []string
+}
+
+type openAPIParam struct {
+	name     string
+	in       string
+	required bool
+	schema   *jsonSchema
+}
+
+type openAPIOperation struct {
+	name     string
+	method   string
+	segments []string
+	params   []*openAPIParam
+	// bodies are the request body schemas by media type; a nil schema
+	// allows anything
+	bodies       map[string]*jsonSchema
+	bodyRequired bool
+	// responses are by status, "2XX" or "default", then media type
+	responses map[string]map[string]*jsonSchema
+}
+
+type openAPISpec struct {
+	raw        []byte
+	basePath   string
+	operations []*openAPIOperation
+}
+
+// openAPICompat rewrites OpenAPI 3.0's schema dialect into draft-07:
+// nullable becomes a "null" type, and boolean exclusiveMinimum and
+// exclusiveMaximum become numbers
+func openAPICompat(v interface{}) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if nullable, _ := v["nullable"].(bool); nullable {
+			if t, ok := v["type"].(string); ok {
+				v["type"] = []interface{}{t, "null"}
+			}
+		}
+		for _, bound := range []string{"Minimum", "Maximum"} {
+			exclusive, ok := v["exclusive"+bound].(bool)
+			if !ok {
+				continue
+			}
+			delete(v, "exclusive"+bound)
+			if limit, ok := v[strings.ToLower(bound)]; ok && exclusive {
+				v["exclusive"+bound] = limit
+				delete(v, strings.ToLower(bound))
+			}
+		}
+		for _, child := range v {
+			openAPICompat(child)
+		}
+	case []interface{}:
+		for _, child := range v {
+			openAPICompat(child)
+		}
+	}
+}
+
+// openAPIDeref follows local $refs of parameters, request bodies and
+// responses
+func openAPIDeref(doc interface{}, v interface{}) (map[string]interface{}, error) {
+	for i := 0; i < 10; i++ {
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, errors.New("Expected an object")
+		}
+		ref, ok := obj["$ref"].(string)
+		if !ok {
+			return obj, nil
+		}
+		if !strings.HasPrefix(ref, "#") {
+			return nil, fmt.Errorf("Only local $refs are supported here, not '%s'", ref)
+		}
+		if v, ok = resolvePointer(doc, ref[1:]); !ok {
+			return nil, fmt.Errorf("Nothing at $ref '%s'", ref)
+		}
+	}
+	return nil, errors.New("Too many nested $refs")
+}
+
+// loadOpenAPISpec compiles the spec at spec_path, with schemas that may
+// $ref those in schema_dir
+func loadOpenAPISpec(spec_path string, schema_dir string) (*openAPISpec, error) {
+	data, err := ioutil.ReadFile(spec_path)
+	if err != nil {
+		return nil, err
+	}
+	var doc map[string]interface{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("%s isn't valid JSON: %s", spec_path, err)
+	}
+	if version, _ := doc["openapi"].(string); !strings.HasPrefix(version, "3.") {
+		return nil, fmt.Errorf("%s isn't an OpenAPI 3 spec", spec_path)
+	}
+
+	compiler := &schemaCompiler{
+		docs:     make(map[string]interface{}),
+		compiled: make(map[string]*jsonSchema),
+	}
+	name := "openapi"
+	if schema_dir != "" {
+		if compiler.docs, err = readSchemaDocs(schema_dir); err != nil {
+			return nil, err
+		}
+		if rel, err := filepath.Rel(schema_dir, spec_path); err == nil && !strings.HasPrefix(rel, "..") {
+			name = strings.TrimSuffix(filepath.ToSlash(rel), ".json")
+		}
+	}
+	openAPICompat(doc)
+	compiler.docs[name] = doc
+
+	spec := &openAPISpec{raw: data}
+	if servers, _ := doc["servers"].([]interface{}); len(servers) > 0 {
+		server, _ := servers[0].(map[string]interface{})
+		server_url, _ := server["url"].(string)
+		if u, err := url.Parse(server_url); err == nil {
+			spec.basePath = strings.TrimSuffix(u.Path, "/")
+		}
+	}
+
+	compileSchema := func(v interface{}) (*jsonSchema, error) {
+		if v == nil {
+			return nil, nil
+		}
+		return compiler.compile(name, v)
+	}
+	compileContent := func(v interface{}) (map[string]*jsonSchema, error) {
+		content, _ := v.(map[string]interface{})
+		schemas := make(map[string]*jsonSchema, len(content))
+		for media_type, media := range content {
+			media_obj, _ := media.(map[string]interface{})
+			schema, err := compileSchema(media_obj["schema"])
+			if err != nil {
+				return nil, fmt.Errorf("%s schema: %s", media_type, err)
+			}
+			schemas[media_type] = schema
+		}
+		return schemas, nil
+	}
+
+	paths, _ := doc["paths"].(map[string]interface{})
+	for template, item_val := range paths {
+		item, err := openAPIDeref(doc, item_val)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", template, err)
+		}
+		for _, method := range openAPIMethods {
+			op_val, ok := item[method]
+			if !ok {
+				continue
+			}
+			op_obj, _ := op_val.(map[string]interface{})
+			op := &openAPIOperation{
+				name:      strings.ToUpper(method) + " " + template,
+				method:    strings.ToUpper(method),
+				segments:  strings.Split(strings.Trim(template, "/"), "/"),
+				responses: make(map[string]map[string]*jsonSchema),
+			}
+			fail := func(err error) (*openAPISpec, error) {
+				return nil, fmt.Errorf("%s: %s", op.name, err)
+			}
+
+			// Operation parameters override the path's
+			params := make(map[string]*openAPIParam)
+			var order []string
+			path_params, _ := item["parameters"].([]interface{})
+			op_params, _ := op_obj["parameters"].([]interface{})
+			for _, param_val := range append(append([]interface{}{}, path_params...), op_params...) {
+				param_obj, err := openAPIDeref(doc, param_val)
+				if err != nil {
+					return fail(err)
+				}
+				param := &openAPIParam{}
+				param.name, _ = param_obj["name"].(string)
+				param.in, _ = param_obj["in"].(string)
+				param.required, _ = param_obj["required"].(bool)
+				if param.schema, err = compileSchema(param_obj["schema"]); err != nil {
+					return fail(fmt.Errorf("Parameter '%s': %s", param.name, err))
+				}
+				key := param.in + ":" + param.name
+				if _, ok := params[key]; !ok {
+					order = append(order, key)
+				}
+				params[key] = param
+			}
+			for _, key := range order {
+				op.params = append(op.params, params[key])
+			}
+
+			if body_val, ok := op_obj["requestBody"]; ok {
+				body, err := openAPIDeref(doc, body_val)
+				if err != nil {
+					return fail(err)
+				}
+				op.bodyRequired, _ = body["required"].(bool)
+				if op.bodies, err = compileContent(body["content"]); err != nil {
+					return fail(fmt.Errorf("Request body %s", err))
+				}
+			}
+
+			responses, _ := op_obj["responses"].(map[string]interface{})
+			for status, resp_val := range responses {
+				resp, err := openAPIDeref(doc, resp_val)
+				if err != nil {
+					return fail(err)
+				}
+				if op.responses[strings.ToUpper(status)], err = compileContent(resp["content"]); err != nil {
+					return fail(fmt.Errorf("%s response %s", status, err))
+				}
+			}
+			spec.operations = append(spec.operations, op)
+		}
+	}
+	sort.Slice(spec.operations, func(i, j int) bool {
+		return spec.operations[i].name < spec.operations[j].name
+	})
+	return spec, nil
+}
+
+// match finds the operation for a request, preferring literal path
+// segments to parameters
+func (self *openAPISpec) match(method string, path string) (*openAPIOperation, map[string]string) {
+	if self.basePath != "" {
+		if !strings.HasPrefix(path, self.basePath+"/") && path != self.basePath {
+			return nil, nil
+		}
+		path = strings.TrimPrefix(path, self.basePath)
+	}
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+
+	var best *openAPIOperation
+	var best_params map[string]string
+	best_literals := -1
+	for _, op := range self.operations {
+		if op.method != method || len(op.segments) != len(segments) {
+			continue
+		}
+		params := make(map[string]string)
+		literals := 0
+		for i, segment := range op.segments {
+			if strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}") {
+				value, err := url.PathUnescape(segments[i])
+				if err != nil || value == "" {
+					literals = -1
+					break
+				}
+				params[segment[1:len(segment)-1]] = value
+			} else if segment == segments[i] {
+				literals++
+			} else {
+				literals = -1
+				break
+			}
+		}
+		if literals > best_literals {
+			best, best_params, best_literals = op, params, literals
+		}
+	}
+	return best, best_params
+}
+
+// openAPIParamValue converts a parameter to the type its schema expects,
+// leaving what doesn't convert as a string for the schema to reject
+func openAPIParamValue(schema *jsonSchema, values []string) interface{} {
+	for schema != nil && schema.ref != nil {
+		schema = schema.ref
+	}
+	t := ""
+	if schema != nil && len(schema.types) > 0 {
+		t = schema.types[0]
+	}
+	if t == "array" {
+		if len(values) == 1 {
+			values = strings.Split(values[0], ",")
+		}
+		items := make([]interface{}, len(values))
+		for i, value := range values {
+			items[i] = openAPIParamValue(schema.items, []string{value})
+		}
+		return items
+	}
+	value := values[0]
+	switch t {
+	case "integer", "number":
+		if _, err := strconv.ParseFloat(value, 64); err == nil {
+			return json.Number(value)
+		}
+	case "boolean":
+		if b, err := strconv.ParseBool(value); err == nil {
+			return b
+		}
+	}
+	return value
+}
+
+// mediaSchema finds the schema for media_type, exactly or by wildcard
+func mediaSchema(content map[string]*jsonSchema, media_type string) (*jsonSchema, bool) {
+	if schema, ok := content[media_type]; ok {
+		return schema, true
+	}
+	if slash := strings.Index(media_type, "/"); slash > 0 {
+		if schema, ok := content[media_type[:slash]+"/*"]; ok {
+			return schema, true
+		}
+	}
+	schema, ok := content["*/*"]
+	return schema, ok
+}
+
+func isJSONMediaType(media_type string) bool {
+	return media_type == "application/json" || strings.HasSuffix(media_type, "+json")
+}
+
+func validateJSONBody(schema *jsonSchema, ptr string, data []byte, errs *[]SchemaError) {
+	var doc interface{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&doc); err != nil {
+		*errs = append(*errs, SchemaError{Path: ptr, Message: "Invalid JSON: " + err.Error()})
+		return
+	}
+	schema.validate(ptr, doc, errs)
+}
+
+// validateRequest checks r's parameters and body, replacing the body so
+// it can be read again. The error is only set if the body is too large.
+func (self *openAPIOperation) validateRequest(r *http.Request, path_params map[string]string) ([]SchemaError, error) {
+	var errs []SchemaError
+	query := r.URL.Query()
+	for _, param := range self.params {
+		var values []string
+		switch param.in {
+		case "path":
+			if value, ok := path_params[param.name]; ok {
+				values = []string{value}
+			}
+		case "query":
+			values = query[param.name]
+		case "header":
+			values = r.Header[http.CanonicalHeaderKey(param.name)]
+		case "cookie":
+			if cookie, err := r.Cookie(param.name); err == nil {
+				values = []string{cookie.Value}
+			}
+		}
+		ptr := "/" + param.in + "/" + param.name
+		if len(values) == 0 {
+			if param.required || param.in == "path" {
+				errs = append(errs, SchemaError{Path: ptr, Message: "Required"})
+			}
+			continue
+		}
+		if param.schema != nil {
+			param.schema.validate(ptr, openAPIParamValue(param.schema, values), &errs)
+		}
+	}
+
+	if self.bodies == nil {
+		return errs, nil
+	}
+	var body []byte
+	if r.Body != nil {
+		var err error
+		if body, err = ioutil.ReadAll(r.Body); err != nil {
+			var too_large *http.MaxBytesError
+			if errors.As(err, &too_large) {
+				return errs, err
+			}
+			return append(errs, SchemaError{Path: "/body", Message: "Error reading body: " + err.Error()}), nil
+		}
+		r.Body.Close()
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	if len(body) == 0 {
+		if self.bodyRequired {
+			errs = append(errs, SchemaError{Path: "/body", Message: "Required"})
+		}
+		return errs, nil
+	}
+	media_type, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	schema, ok := mediaSchema(self.bodies, media_type)
+	if !ok {
+		return append(errs, SchemaError{Path: "/body", Message: fmt.Sprintf("Content type '%s' isn't accepted", media_type)}), nil
+	}
+	if schema != nil && isJSONMediaType(media_type) {
+		validateJSONBody(schema, "/body", body, &errs)
+	}
+	return errs, nil
+}
+
+func (self *openAPIOperation) validateResponse(status int, header http.Header, body []byte) []SchemaError {
+	code := strconv.Itoa(status)
+	content, ok := self.responses[code]
+	if !ok {
+		content, ok = self.responses[code[:1]+"XX"]
+	}
+	if !ok {
+		content, ok = self.responses["DEFAULT"]
+	}
+	if !ok {
+		if status >= 500 {
+			// Rarely documented, and reported anyway
+			return nil
+		}
+		return []SchemaError{{Message: fmt.Sprintf("Status %d isn't in the spec", status)}}
+	}
+	if len(content) == 0 || len(body) == 0 {
+		return nil
+	}
+	media_type, _, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	schema, ok := mediaSchema(content, media_type)
+	if !ok {
+		return []SchemaError{{Message: fmt.Sprintf("Content type '%s' isn't in the spec", media_type)}}
+	}
+	var errs []SchemaError
+	if schema != nil && isJSONMediaType(media_type) {
+		validateJSONBody(schema, "", body, &errs)
+	}
+	return errs
+}
+
+// openAPIRecorder keeps a copy of the response to validate
+type openAPIRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+	// truncated is set once the body is too large to keep
+	truncated bool
+}
+
+func (self *openAPIRecorder) WriteHeader(status int) {
+	if self.status == 0 {
+		self.status = status
+	}
+	self.ResponseWriter.WriteHeader(status)
+}
+
+func (self *openAPIRecorder) Write(b []byte) (int, error) {
+	if self.status == 0 {
+		self.status = http.StatusOK
+	}
+	if !self.truncated {
+		if self.body.Len()+len(b) > maxValidatedResponse {
+			self.truncated = true
+			self.body.Reset()
+		} else {
+			self.body.Write(b)
+		}
+	}
+	return self.ResponseWriter.Write(b)
+}
+
+func (self *openAPIRecorder) Flush() {
+	if flusher, ok := self.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+type openAPI struct {
+	appctx            *baseAppContext
+	path              string
+	spec              *openAPISpec
+	validateRequests  bool
+	validateResponses bool
+	serveSpec         bool
+	maxBodySize       int
+}
+
+func newOpenAPI(appctx *baseAppContext) *openAPI {
+	return &openAPI{
+		appctx:           appctx,
+		validateRequests: true,
+		serveSpec:        true,
+		maxBodySize:      1 << 20,
+	}
+}
+
+func (self *openAPI) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if self.spec == nil || (!self.validateRequests && !self.validateResponses) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		op, path_params := self.spec.match(r.Method, r.URL.Path)
+		if op == nil {
+			self.appctx.MetricsClient().Incr("openapi.unmatched", 1.0, nil)
+			next.ServeHTTP(w, r)
+			return
+		}
+		tags := map[string]string{"operation": op.name}
+
+		if self.validateRequests {
+			if op.bodies != nil && r.Body != nil {
+				r.Body = http.MaxBytesReader(w, r.Body, int64(self.maxBodySize))
+			}
+			errs, err := op.validateRequest(r, path_params)
+			if err != nil {
+				self.appctx.MetricsClient().Incr("openapi.request_errors", 1.0, tags)
+				writeHTTPError(self.appctx, self.appctx.ForRequest(r), w, &AppError{
+					Status:  http.StatusRequestEntityTooLarge,
+					Code:    "invalid_argument",
+					Message: fmt.Sprintf("Request body is larger than %d bytes", self.maxBodySize),
+					Err:     err,
+				})
+				return
+			}
+			if len(errs) > 0 {
+				self.appctx.MetricsClient().Incr("openapi.request_errors", 1.0, tags)
+				valid_err := &SchemaValidationError{Schema: op.name, Errors: errs}
+				msgs := make([]string, len(errs))
+				for i, err := range errs {
+					msgs[i] = err.Path + ": " + err.Message
+				}
+				writeHTTPError(self.appctx, self.appctx.ForRequest(r), w, &AppError{
+					Status:  http.StatusBadRequest,
+					Code:    "invalid_argument",
+					Message: "Request doesn't match the API spec: " + strings.Join(msgs, "; "),
+					Err:     valid_err,
+				})
+				return
+			}
+		}
+		if !self.validateResponses {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		rec := &openAPIRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.truncated {
+			return
+		}
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		if errs := op.validateResponse(rec.status, rec.Header(), rec.body.Bytes()); len(errs) > 0 {
+			self.appctx.MetricsClient().Incr("openapi.response_errors", 1.0, tags)
+			valid_err := &SchemaValidationError{Schema: fmt.Sprintf("%s %d", op.name, rec.status), Errors: errs}
+			self.appctx.ForRequest(r).Logger().LogWarnf(r.Context(), "Response doesn't match the API spec: %s", valid_err)
+		}
+	})
+}
+
+func (self *openAPI) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if self.spec == nil || !self.serveSpec {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(self.spec.raw)
+	})
+}
+
+func (self *openAPI) Operations() []string {
+	if self.spec == nil {
+		return nil
+	}
+	names := make([]string, len(self.spec.operations))
+	for i, op := range self.spec.operations {
+		names[i] = op.name
+	}
+	return names
+}
+
+func (self *openAPI) status() map[string]interface{} {
+	return map[string]interface{}{
+		"path":               self.path,
+		"operations":         len(self.Operations()),
+		"validate_requests":  self.validateRequests,
+		"validate_responses": self.validateResponses,
+		"serve_spec":         self.serveSpec,
+		"max_body_size":      self.maxBodySize,
+	}
+}
+
+func (self *baseAppContext) OpenAPI() OpenAPI {
+	return self.openAPI
+}
+
+// OPENAPI_SPEC_PATH is the spec, which must load if it's set; without it,
+// JSON_SCHEMA_FILEPATH's openapi.json is used if there is one. Requests
+// are validated unless OPENAPI_VALIDATE_REQUESTS is off, responses only
+// with OPENAPI_VALIDATE_RESPONSES, and OPENAPI_SERVE_SPEC (default on)
+// serves the spec from Handler(). Request bodies larger than
+// OPENAPI_MAX_BODY_SIZE (default 1MiB) are refused with a 413.
+func (self *baseAppContext) setOpenAPIFromEnv() error {
+	if validate, found, err := self.getBoolFromEnv("OPENAPI_VALIDATE_REQUESTS"); err != nil {
+		return err
+	} else if found {
+		self.openAPI.validateRequests = validate
+	}
+	var err error
+	if self.openAPI.validateResponses, _, err = self.getBoolFromEnv("OPENAPI_VALIDATE_RESPONSES"); err != nil {
+		return err
+	}
+	if serve, found, err := self.getBoolFromEnv("OPENAPI_SERVE_SPEC"); err != nil {
+		return err
+	} else if found {
+		self.openAPI.serveSpec = serve
+	}
+	if size, found, err := self.getIntFromEnv("OPENAPI_MAX_BODY_SIZE"); err != nil {
+		return err
+	} else if found {
+		if size <= 0 {
+			return errors.New("OPENAPI_MAX_BODY_SIZE must be > 0")
+		}
+		self.openAPI.maxBodySize = size
+	}
+
+	spec_path := self.getEnv("OPENAPI_SPEC_PATH")
+	if spec_path == "" {
+		if self.jsonSchemaFilePath == "" {
+			return nil
+		}
+		spec_path = filepath.Join(self.jsonSchemaFilePath, "openapi.json")
+		if _, err := os.Stat(spec_path); err != nil {
+			return nil
+		}
+	}
+	schema_dir := self.jsonSchemaFilePath
+	if _, err := os.Stat(schema_dir); schema_dir != "" && err != nil {
+		schema_dir = ""
+	}
+	spec, err := loadOpenAPISpec(spec_path, schema_dir)
+	if err != nil {
+		return fmt.Errorf("Invalid OpenAPI spec: %s", err)
+	}
+	self.openAPI.path = spec_path
+	self.openAPI.spec = spec
+	return nil
+}
@@ -0,0 +1,191 @@
+package app_context
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+const testOpenAPISpec = `{
+	"openapi": "3.0.3",
+	"info": {"title": "Orders", "version": "1"},
+	"servers": [{"url": "https://api.example.com/v1"}],
+	"paths": {
+		"/orders": {
+			"post": {
+				"requestBody": {"$ref": "#/components/requestBodies/NewOrder"},
+				"responses": {"201": {"description": "Created"}}
+			}
+		},
+		"/orders/recent": {
+			"get": {"responses": {"200": {"description": "Recent orders"}}}
+		},
+		"/orders/{id}": {
+			"parameters": [{"name": "id", "in": "path", "required": true, "schema": {"type": "integer", "minimum": 1}}],
+			"get": {
+				"parameters": [
+					{"name": "fields", "in": "query", "schema": {"type": "array", "items": {"enum": ["id", "total", "note"]}}},
+					{"name": "X-Tenant", "in": "header", "required": true, "schema": {"type": "string"}}
+				],
+				"responses": {
+					"200": {"description": "An order", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Order"}}}},
+					"404": {"description": "Not found"}
+				}
+			}
+		}
+	},
+	"components": {
+		"schemas": {
+			"Order": {
+				"type": "object",
+				"required": ["id", "total"],
+				"properties": {
+					"id": {"type": "integer"},
+					"total": {"$ref": "common.json#/definitions/money"},
+					"note": {"type": "string", "nullable": true},
+					"discount": {"type": "number", "minimum": 0, "exclusiveMinimum": true}
+				}
+			}
+		},
+		"requestBodies": {
+			"NewOrder": {
+				"required": true,
+				"content": {"application/json": {"schema": {
+					"type": "object",
+					"required": ["total"],
+					"properties": {"total": {"$ref": "common.json#/definitions/money"}}
+				}}}
+			}
+		}
+	}
+}`
+
+func TestOpenAPI(t *testing.T) {
+	dir := writeSchemas(t, map[string]string{
+		"common.json": `{"definitions": {
+			"money": {"type": "object", "required": ["amount", "currency"], "properties": {
+				"amount": {"type": "integer", "minimum": 0},
+				"currency": {"enum": ["USD", "EUR"]}
+			}}
+		}}`,
+		"openapi.json": testOpenAPISpec,
+	})
+	os.Setenv("JSON_SCHEMA_FILEPATH", dir)
+	os.Setenv("OPENAPI_VALIDATE_RESPONSES", "true")
+	os.Setenv("OPENAPI_MAX_BODY_SIZE", "64")
+	defer os.Unsetenv("JSON_SCHEMA_FILEPATH")
+	defer os.Unsetenv("OPENAPI_VALIDATE_RESPONSES")
+	defer os.Unsetenv("OPENAPI_MAX_BODY_SIZE")
+
+	app_ctx, err := NewAppContext("openapi_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer app_ctx.Close()
+
+	mcli := newCountingMetricsClient()
+	app_ctx.SetMetricsClient(mcli)
+
+	api := app_ctx.OpenAPI()
+	if ops := api.Operations(); strings.Join(ops, ",") != "GET /orders/recent,GET /orders/{id},POST /orders" {
+		t.Errorf("Unexpected operations: %v", ops)
+	}
+
+	var bodies []string
+	handler := api.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/v1/orders/1":
+			w.Write([]byte(`{"id": 1, "total": {"amount": 100, "currency": "USD"}, "note": null}`))
+		case "/v1/orders/2":
+			w.Write([]byte(`{"id": 2, "total": {"amount": 100}, "discount": 0}`))
+		case "/v1/orders":
+			w.WriteHeader(http.StatusCreated)
+		}
+	}))
+	serve := func(method string, path string, content_type string, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, bytes.NewReader([]byte(body)))
+		req.Header.Set("X-Tenant", "acme")
+		if content_type != "" {
+			req.Header.Set("Content-Type", content_type)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for _, tc := range []struct {
+		method, path, content_type, body string
+		status                           int
+		message                          string
+	}{
+		{"GET", "/v1/orders/1?fields=id,note", "", "", http.StatusOK, ""},
+		{"GET", "/v1/orders/recent", "", "", http.StatusOK, ""},
+		{"GET", "/v1/orders/abc", "", "", http.StatusBadRequest, "/path/id: Expected integer, got string"},
+		{"GET", "/v1/orders/0?fields=price", "", "", http.StatusBadRequest, "/query/fields/0"},
+		{"POST", "/v1/orders", "application/json", `{"total": {"amount": 5, "currency": "USD"}}`, http.StatusCreated, ""},
+		{"POST", "/v1/orders", "application/json", `{"total": {"amount": -5, "currency": "GBP"}}`, http.StatusBadRequest, "/body/total/amount"},
+		{"POST", "/v1/orders", "application/json", "", http.StatusBadRequest, "/body: Required"},
+		{"POST", "/v1/orders", "text/plain", "total", http.StatusBadRequest, "isn't accepted"},
+		{"POST", "/v1/orders", "application/json", `{"total": {"amount": 5, "currency": "USD"}, "note": "` + strings.Repeat("x", 64) + `"}`, http.StatusRequestEntityTooLarge, "larger than 64 bytes"},
+		// Not in the spec, so left to the app
+		{"DELETE", "/v1/orders/1", "", "", http.StatusOK, ""},
+		{"GET", "/health", "", "", http.StatusOK, ""},
+	} {
+		rec := serve(tc.method, tc.path, tc.content_type, tc.body)
+		if rec.Code != tc.status || !strings.Contains(rec.Body.String(), tc.message) {
+			t.Errorf("%s %s: expected %d with %q, got %d %s", tc.method, tc.path, tc.status, tc.message, rec.Code, rec.Body.String())
+		}
+	}
+	if len(bodies) != 5 || bodies[2] != `{"total": {"amount": 5, "currency": "USD"}}` {
+		t.Errorf("Expected the handler to read the validated body, got %q", bodies)
+	}
+	if mcli.count("openapi.request_errors") != 6 || mcli.count("openapi.unmatched") != 2 || mcli.count("openapi.response_errors") != 0 {
+		t.Errorf("Unexpected metrics: %v", mcli.counts)
+	}
+
+	// Responses are sent as they are, but counted
+	if rec := serve("GET", "/v1/orders/2", "", ""); rec.Code != http.StatusOK {
+		t.Errorf("Expected the response to be sent, got %d", rec.Code)
+	}
+	if mcli.count("openapi.response_errors") != 1 {
+		t.Errorf("Expected a response error, got %v", mcli.counts)
+	}
+
+	rec := httptest.NewRecorder()
+	api.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/openapi.json", nil))
+	var spec map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &spec); err != nil || spec["openapi"] != "3.0.3" {
+		t.Errorf("Expected the spec to be served, got %d %s", rec.Code, rec.Body.String())
+	}
+	app_ctx.(*baseAppContext).openAPI.serveSpec = false
+	rec = httptest.NewRecorder()
+	api.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/openapi.json", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 with OPENAPI_SERVE_SPEC off, got %d", rec.Code)
+	}
+}
+
+func TestOpenAPIInvalidSpec(t *testing.T) {
+	dir := writeSchemas(t, map[string]string{
+		"api.json": `{"openapi": "3.0.0", "paths": {"/a": {"get": {"parameters": [{"name": "x", "in": "query", "schema": {"type": "thing"}}]}}}}`,
+	})
+	os.Setenv("OPENAPI_SPEC_PATH", dir+"/api.json")
+	defer os.Unsetenv("OPENAPI_SPEC_PATH")
+
+	app_ctx, err := NewAppContext("openapi_test")
+	if err == nil {
+		app_ctx.Close()
+	}
+	if err == nil || !strings.Contains(err.Error(), "Unknown type 'thing'") {
+		t.Errorf("Expected an invalid spec to fail startup, got %v", err)
+	}
+}
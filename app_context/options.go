@@ -0,0 +1,117 @@
+package app_context
+
+import (
+	"os"
+)
+
+// Option changes how NewAppContext sets things up
+type Option func(*baseAppContext)
+
+// unprefixedEnv are settings that describe the deployment rather than the
+// app, so with an env prefix they fall back to the plain name
+var unprefixedEnv = map[string]bool{
+	"TILT_ENVIRONMENT": true,
+	"CODE_VERSION":     true,
+}
+
+// WithEnvPrefix reads every environment variable with prefix, eg. with
+// "MYAPP_", DB_DSN is read from MYAPP_DB_DSN, so several app contexts in
+// one process or colocated apps don't share settings by accident.
+// Unprefixed variables are ignored, except for TILT_ENVIRONMENT and
+// CODE_VERSION. APPCTX_CONFIG_FILE and profile keys aren't prefixed.
+func WithEnvPrefix(prefix string) Option {
+	return func(appctx *baseAppContext) {
+		appctx.envPrefix = prefix
+	}
+}
+
+// WithClock sets the clock before anything is started, unlike SetClock,
+// so tickers and timers started by NewAppContext use it too
+func WithClock(clock Clock) Option {
+	return func(appctx *baseAppContext) {
+		appctx.clock = clock
+	}
+}
+
+// WithRandomSeed seeds Rand and the IDs' random bits like RANDOM_SEED,
+// which still takes precedence so a failing run can be repeated. For
+// tests only: IDs would repeat across instances.
+func WithRandomSeed(seed int64) Option {
+	return func(appctx *baseAppContext) {
+		appctx.randomSeed = &seed
+	}
+}
+
+// WithEnv reads settings from env instead of the process environment, so
+// a test or an embedding program controls them without os.Setenv. The
+// .env files, APPCTX_CONFIG_FILE and profiles still apply.
+func WithEnv(env map[string]string) Option {
+	copied := make(map[string]string, len(env))
+	for name, val := range env {
+		copied[name] = val
+	}
+	return func(appctx *baseAppContext) {
+		appctx.env = copied
+	}
+}
+
+// EnvPrefix is the prefix environment variables are read with, if any
+func (self *baseAppContext) EnvPrefix() string {
+	return self.envPrefix
+}
+
+func (self *baseAppContext) prefixedLookup(lookup func(string) (string, bool), name string) (string, string, bool) {
+	if self.envPrefix != "" {
+		if val, found := lookup(self.envPrefix + name); found || !unprefixedEnv[name] {
+			return val, self.envPrefix + name, found
+		}
+	}
+	val, found := lookup(name)
+	return val, name, found
+}
+
+// processLookupEnv is os.LookupEnv, or a lookup in the WithEnv map
+func (self *baseAppContext) processLookupEnv(name string) (string, bool) {
+	if self.env != nil {
+		val, found := self.env[name]
+		return val, found
+	}
+	return os.LookupEnv(name)
+}
+
+// processEnviron is os.Environ, or the WithEnv map as name=value pairs
+func (self *baseAppContext) processEnviron() []string {
+	if self.env == nil {
+		return os.Environ()
+	}
+	environ := make([]string, 0, len(self.env))
+	for name, val := range self.env {
+		environ = append(environ, name+"="+val)
+	}
+	return environ
+}
+
+// osLookupEnv is os.LookupEnv with the env prefix applied. It also
+// returns the variable's full name.
+func (self *baseAppContext) osLookupEnv(name string) (string, string, bool) {
+	return self.prefixedLookup(self.processLookupEnv, name)
+}
+
+// dotEnvLookup is osLookupEnv for the .env files
+func (self *baseAppContext) dotEnvLookup(name string) (string, bool) {
+	val, _, found := self.prefixedLookup(func(name string) (string, bool) {
+		val, found := self.dotEnv[name]
+		return val, found
+	}, name)
+	return val, found
+}
+
+// osGetenv is for settings read before APPCTX_CONFIG_FILE: the environment,
+// and then the .env files
+func (self *baseAppContext) osGetenv(name string) string {
+	if val, _, found := self.osLookupEnv(name); found {
+		return val
+	}
+	val, _ := self.dotEnvLookup(name)
+	return val
+}
@@ -0,0 +1,148 @@
+package app_context
+
+import (
+	"context"
+	"encoding/base64"
+	"log"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestWithEnvPrefix(t *testing.T) {
+	key := make([]byte, 32)
+	enc_version, err := EncryptConfigValue(key, "v2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	os.Setenv("BASE_URL", "https://shared.example.com")
+	os.Setenv("MYAPP_BASE_URL", "https://myapp.example.com")
+	os.Setenv("MYAPP_SERVICE_PORT", "9123")
+	os.Setenv("TILT_ENVIRONMENT", "testing")
+	for _, name := range []string{"BASE_URL", "MYAPP_BASE_URL", "MYAPP_SERVICE_PORT", "MYAPP_CODE_VERSION", "MYAPP_APPCTX_CONFIG_KEY", "TILT_ENVIRONMENT"} {
+		defer os.Unsetenv(name)
+	}
+
+	plain, err := NewAppContext("options_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer plain.Close()
+	if url := plain.BaseExternalURL(); url != "https://shared.example.com" {
+		t.Errorf("Expected the plain BASE_URL without a prefix, got %s", url)
+	}
+
+	// Without a prefix every encrypted variable is decrypted, so this comes
+	// after the plain app context
+	os.Setenv("MYAPP_CODE_VERSION", enc_version)
+	os.Setenv("MYAPP_APPCTX_CONFIG_KEY", base64.StdEncoding.EncodeToString(key))
+
+	app_ctx, err := NewAppContext("options_test", WithEnvPrefix("MYAPP_"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer app_ctx.Close()
+
+	if url := app_ctx.BaseExternalURL(); url != "https://myapp.example.com" {
+		t.Errorf("Expected the prefixed BASE_URL, got %s", url)
+	}
+	if port := app_ctx.ServicePort(); port != 9123 {
+		t.Errorf("Expected the prefixed SERVICE_PORT, got %d", port)
+	}
+	if version := app_ctx.CodeVersion(); version != "v2" {
+		t.Errorf("Expected the prefixed, encrypted CODE_VERSION, got %s", version)
+	}
+	if env := app_ctx.TiltEnv(); env != "testing" {
+		t.Errorf("Expected TILT_ENVIRONMENT to fall back to the plain name, got %s", env)
+	}
+
+	// Another app context in the process doesn't see the prefixed values
+	other, err := NewAppContext("options_test", WithEnvPrefix("OTHER_"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer other.Close()
+	if url := other.BaseExternalURL(); url != "" {
+		t.Errorf("Expected no BASE_URL for OTHER_, got %s", url)
+	}
+}
+
+func TestWithClock(t *testing.T) {
+	clock := NewFakeClock(time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC))
+
+	app_ctx, err := NewAppContext("options_test", WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app_ctx.Close()
+
+	if app_ctx.Clock() != clock {
+		t.Fatal("Expected the fake clock")
+	}
+	app_ctx.Health().SetStatus("clock_test", nil)
+	for _, res := range app_ctx.Health().Check(context.Background()) {
+		if res.Name == "clock_test" && !res.CheckedAt.Equal(clock.Now()) {
+			t.Errorf("Expected health results to use the fake clock, got %s", res.CheckedAt)
+		}
+	}
+}
+
+func TestWithRandomSeed(t *testing.T) {
+	seeded := func() int64 {
+		app_ctx, err := NewAppContext("options_test", WithRandomSeed(7))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer app_ctx.Close()
+		return app_ctx.Rand().Int63()
+	}
+	if seeded() != seeded() {
+		t.Error("Expected WithRandomSeed to make Rand deterministic")
+	}
+
+	os.Setenv("RANDOM_SEED", "8")
+	defer os.Unsetenv("RANDOM_SEED")
+	if seeded() != newLockedRand(8).Int63() {
+		t.Error("Expected RANDOM_SEED to take precedence over WithRandomSeed")
+	}
+}
+
+func TestNewAppContextFromEnv(t *testing.T) {
+	key := make([]byte, 32)
+	enc_url, err := EncryptConfigValue(key, "https://secret.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	os.Setenv("SERVICE_PORT", "9000")
+	defer os.Unsetenv("SERVICE_PORT")
+
+	env := map[string]string{
+		"TILT_ENVIRONMENT":  "testing",
+		"BASE_URL":          enc_url,
+		"APPCTX_CONFIG_KEY": base64.StdEncoding.EncodeToString(key),
+		"CODE_VERSION":      "from-map",
+	}
+	app_ctx, err := NewAppContextFromEnv("options_test", env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app_ctx.Close()
+
+	// Changing the map afterwards has no effect
+	env["CODE_VERSION"] = "changed"
+
+	if url := app_ctx.BaseExternalURL(); url != "https://secret.example.com" {
+		t.Errorf("Expected the decrypted BASE_URL from the map, got %s", url)
+	}
+	if version := app_ctx.CodeVersion(); version != "from-map" {
+		t.Errorf("Expected CODE_VERSION from the map, got %s", version)
+	}
+	if port := app_ctx.ServicePort(); port == 9000 {
+		t.Error("The process environment shouldn't be read")
+	}
+	if val, _ := app_ctx.ConfigValue("TILT_ENVIRONMENT"); val != "testing" {
+		t.Errorf("Expected TILT_ENVIRONMENT from the map, got '%s'", val)
+	}
+}
@@ -0,0 +1,294 @@
+package app_context
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Outbox publishes events to MessageBus() only if the transaction that
+// made them commits. Add writes an event to the outbox_events table in
+// the caller's transaction, and the relay publishes what's committed,
+// oldest first, deleting events once they're sent. Events are published
+// at least once; a failed publish is retried with backoff, so events
+// that failed may be published after later ones.
+//
+// With OUTBOX_RELAY the relay runs as the outbox_relay worker on active
+// instances. It can also be run as a worker some other way:
+//
+//	appctx.Workers().Register("outbox", appctx.Outbox().Relay, WorkerOptions{ActiveOnly: true})
+type Outbox interface {
+	Add(ctx context.Context, tx *sql.Tx, subject string, payload []byte) error
+	// Relay publishes events until ctx is done
+	Relay(ctx context.Context) error
+	// Pending is how many events are waiting to be published, including
+	// ones that have given up
+	Pending(ctx context.Context) (int, error)
+}
+
+type outbox struct {
+	appctx       *baseAppContext
+	relay        bool
+	pollInterval time.Duration
+	batchSize    int
+	maxAttempts  int
+
+	lock  sync.Mutex
+	ready bool
+}
+
+func newOutbox(appctx *baseAppContext) *outbox {
+	return &outbox{
+		appctx:       appctx,
+		pollInterval: time.Second,
+		batchSize:    100,
+		maxAttempts:  10,
+	}
+}
+
+func (self *outbox) create(ctx context.Context, exec func(ctx context.Context, query string, args ...interface{}) (sql.Result, error)) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.ready {
+		return nil
+	}
+	if _, err := exec(ctx, `CREATE TABLE IF NOT EXISTS outbox_events (
+		id bigserial NOT NULL PRIMARY KEY,
+		subject text NOT NULL,
+		payload bytea NOT NULL,
+		attempts integer NOT NULL DEFAULT 0,
+		next_attempt_at timestamptz NOT NULL DEFAULT now(),
+		last_error text,
+		created_at timestamptz NOT NULL DEFAULT now()
+	)`); err != nil {
+		return fmt.Errorf("Error creating outbox_events: %s", err)
+	}
+	self.ready = true
+	return nil
+}
+
+func (self *outbox) Add(ctx context.Context, tx *sql.Tx, subject string, payload []byte) error {
+	if subject == "" {
+		return errors.New("Outbox events need a subject")
+	}
+	// Outside tx if we can, so rolling it back doesn't drop the table
+	exec := tx.ExecContext
+	if db := self.appctx.DBWrite(); db != nil {
+		exec = db.ExecContext
+	}
+	if err := self.create(ctx, exec); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "INSERT INTO outbox_events (subject, payload) VALUES ($1, $2)", subject, payload); err != nil {
+		return fmt.Errorf("Error adding to the outbox: %s", err)
+	}
+	self.appctx.MetricsClient().Incr("outbox.added", 1.0, map[string]string{"subject": subject})
+	return nil
+}
+
+// exists is whether outbox_events has been created, so the relay doesn't
+// create it in databases of apps that never use the outbox
+func (self *outbox) exists(ctx context.Context) (bool, error) {
+	self.lock.Lock()
+	ready := self.ready
+	self.lock.Unlock()
+	if ready {
+		return true, nil
+	}
+	var exists bool
+	if err := self.appctx.DBWrite().QueryRowContext(ctx, "SELECT to_regclass('outbox_events') IS NOT NULL").Scan(&exists); err != nil {
+		return false, err
+	}
+	if exists {
+		self.lock.Lock()
+		self.ready = true
+		self.lock.Unlock()
+	}
+	return exists, nil
+}
+
+// outboxRetryDelay is how long to wait before publishing an event again
+// after attempts failures: 1s doubling up to 10m
+func outboxRetryDelay(attempts int) time.Duration {
+	if attempts > 10 {
+		return 10 * time.Minute
+	}
+	delay := time.Second << uint(attempts-1)
+	if delay > 10*time.Minute {
+		delay = 10 * time.Minute
+	}
+	return delay
+}
+
+type outboxEvent struct {
+	id       int64
+	subject  string
+	payload  []byte
+	attempts int
+}
+
+// relayBatch publishes the next batch of due events, returning how many
+// it tried. Other instances' relays skip the events it has locked.
+func (self *outbox) relayBatch(ctx context.Context) (int, error) {
+	if self.appctx.DBWrite() == nil {
+		return 0, nil
+	}
+	if exists, err := self.exists(ctx); err != nil || !exists {
+		return 0, err
+	}
+
+	tried := 0
+	err := self.appctx.WithTx(ctx, func(tx *sql.Tx) error {
+		rows, err := tx.QueryContext(
+			ctx,
+			`SELECT id, subject, payload, attempts FROM outbox_events
+			WHERE next_attempt_at <= now() ORDER BY id LIMIT $1 FOR UPDATE SKIP LOCKED`,
+			self.batchSize,
+		)
+		if err != nil {
+			return err
+		}
+		var events []outboxEvent
+		for rows.Next() {
+			var event outboxEvent
+			if err := rows.Scan(&event.id, &event.subject, &event.payload, &event.attempts); err != nil {
+				rows.Close()
+				return err
+			}
+			events = append(events, event)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		tried = len(events)
+
+		mcli := self.appctx.MetricsClient()
+		bus := self.appctx.MessageBus()
+		for _, event := range events {
+			tags := map[string]string{"subject": event.subject}
+			if pub_err := bus.Publish(event.subject, event.payload); pub_err != nil {
+				attempts := event.attempts + 1
+				mcli.Incr("outbox.publish_errors", 1.0, tags)
+				if attempts >= self.maxAttempts {
+					// Left for someone to look at
+					mcli.Incr("outbox.dead", 1.0, tags)
+					self.appctx.Logger().LogErrorf(ctx, "Giving up publishing outbox event %d to '%s' after %d attempts: %s", event.id, event.subject, attempts, pub_err)
+					_, err = tx.ExecContext(
+						ctx,
+						"UPDATE outbox_events SET attempts = $2, next_attempt_at = 'infinity', last_error = $3 WHERE id = $1",
+						event.id, attempts, pub_err.Error(),
+					)
+				} else {
+					_, err = tx.ExecContext(
+						ctx,
+						"UPDATE outbox_events SET attempts = $2, next_attempt_at = now() + $3 * interval '1 millisecond', last_error = $4 WHERE id = $1",
+						event.id, attempts, outboxRetryDelay(attempts).Milliseconds(), pub_err.Error(),
+					)
+				}
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			if _, err := tx.ExecContext(ctx, "DELETE FROM outbox_events WHERE id = $1", event.id); err != nil {
+				return err
+			}
+			mcli.Incr("outbox.published", 1.0, tags)
+		}
+		return nil
+	})
+	return tried, err
+}
+
+func (self *outbox) Relay(ctx context.Context) error {
+	for {
+		n, err := self.relayBatch(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			self.appctx.Logger().LogWarnf(ctx, "Error relaying outbox events: %s", err)
+		}
+		if err == nil && n >= self.batchSize {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-self.appctx.Clock().After(self.pollInterval):
+		}
+	}
+}
+
+func (self *outbox) Pending(ctx context.Context) (int, error) {
+	db := self.appctx.DBWrite()
+	if db == nil {
+		return 0, errors.New("No database is configured")
+	}
+	if exists, err := self.exists(ctx); err != nil || !exists {
+		return 0, err
+	}
+	var count int
+	err := db.QueryRowContext(ctx, "SELECT count(*) FROM outbox_events").Scan(&count)
+	return count, err
+}
+
+func (self *outbox) status() map[string]interface{} {
+	return map[string]interface{}{
+		"relay":         self.relay,
+		"poll_interval": self.pollInterval.String(),
+		"batch_size":    self.batchSize,
+		"max_attempts":  self.maxAttempts,
+	}
+}
+
+func (self *baseAppContext) Outbox() Outbox {
+	return self.outbox
+}
+
+// OUTBOX_RELAY runs the relay as a worker, checking every
+// OUTBOX_POLL_INTERVAL (default 1s) for up to OUTBOX_BATCH_SIZE (default
+// 100) events to publish. OUTBOX_MAX_ATTEMPTS (default 10) is how many
+// times an event is tried before it's left in the table.
+func (self *baseAppContext) setOutboxFromEnv() error {
+	if interval, found, err := self.getDurationFromEnv("OUTBOX_POLL_INTERVAL"); err != nil {
+		return err
+	} else if found {
+		if interval <= 0 {
+			return errors.New("OUTBOX_POLL_INTERVAL must be > 0")
+		}
+		self.outbox.pollInterval = interval
+	}
+	if size, found, err := self.getIntFromEnv("OUTBOX_BATCH_SIZE"); err != nil {
+		return err
+	} else if found {
+		if size <= 0 {
+			return errors.New("OUTBOX_BATCH_SIZE must be > 0")
+		}
+		self.outbox.batchSize = size
+	}
+	if attempts, found, err := self.getIntFromEnv("OUTBOX_MAX_ATTEMPTS"); err != nil {
+		return err
+	} else if found {
+		if attempts <= 0 {
+			return errors.New("OUTBOX_MAX_ATTEMPTS must be > 0")
+		}
+		self.outbox.maxAttempts = attempts
+	}
+
+	var err error
+	if self.outbox.relay, _, err = self.getBoolFromEnv("OUTBOX_RELAY"); err != nil {
+		return err
+	}
+	if self.outbox.relay && !self.lambda {
+		return self.Workers().Register("outbox_relay", self.outbox.Relay, WorkerOptions{
+			Restart:    RestartAlways,
+			ActiveOnly: true,
+		})
+	}
+	return nil
+}
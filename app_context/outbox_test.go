@@ -0,0 +1,105 @@
+package app_context
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"log"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// failingMessageBus fails publishes to one subject
+type failingMessageBus struct {
+	MessageBus
+	fail string
+}
+
+func (self *failingMessageBus) Publish(subject string, data []byte) error {
+	if subject == self.fail {
+		return errors.New("Broker unavailable")
+	}
+	return self.MessageBus.Publish(subject, data)
+}
+
+func TestOutbox(t *testing.T) {
+	app_ctx, err := NewAppContext("outbox_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer app_ctx.Close()
+
+	mcli := newCountingMetricsClient()
+	app_ctx.SetMetricsClient(mcli)
+	db, err := app_ctx.(*baseAppContext).openDB("appctx_fake", "", "primary")
+	if err != nil {
+		t.Fatal(err)
+	}
+	app_ctx.SetDB(db)
+	defer app_ctx.SetDB(nil)
+
+	var lock sync.Mutex
+	var execs []string
+	var exec_args [][]driver.Value
+	fakeExecHook = func(query string, args []driver.Value) error {
+		lock.Lock()
+		defer lock.Unlock()
+		execs = append(execs, strings.Fields(query)[0])
+		exec_args = append(exec_args, args)
+		return nil
+	}
+	defer func() { fakeExecHook = nil }()
+
+	ctx := context.Background()
+	outbox := app_ctx.Outbox()
+	err = app_ctx.WithTx(ctx, func(tx *sql.Tx) error {
+		return outbox.Add(ctx, tx, "orders.created", []byte(`{"id": 1}`))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(execs) != 2 || execs[0] != "CREATE" || execs[1] != "INSERT" || exec_args[1][0] != "orders.created" {
+		t.Errorf("Unexpected queries: %v %v", execs, exec_args)
+	}
+
+	bus := NewMemoryMessageBus()
+	app_ctx.SetMessageBus(&failingMessageBus{MessageBus: bus, fail: "orders.failed"})
+	published := make(chan string, 2)
+	bus.Subscribe("orders.>", func(msg *BusMessage) {
+		published <- msg.Subject + " " + string(msg.Data)
+	})
+
+	fakeQueryHook = func(query string, args []driver.Value) [][]driver.Value {
+		if !strings.Contains(query, "FOR UPDATE SKIP LOCKED") {
+			return nil
+		}
+		return [][]driver.Value{
+			{int64(1), "orders.created", []byte(`{"id": 1}`), int64(0)},
+			{int64(2), "orders.failed", []byte(`{"id": 2}`), int64(9)},
+		}
+	}
+	defer func() { fakeQueryHook = nil }()
+
+	execs, exec_args = nil, nil
+	n, err := app_ctx.(*baseAppContext).outbox.relayBatch(ctx)
+	if err != nil || n != 2 {
+		t.Fatalf("Expected 2 events relayed, got %d: %v", n, err)
+	}
+	if msg := <-published; msg != `orders.created {"id": 1}` {
+		t.Errorf("Unexpected message: %s", msg)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if len(execs) != 2 || execs[0] != "DELETE" || execs[1] != "UPDATE" {
+		t.Fatalf("Unexpected queries: %v", execs)
+	}
+	if exec_args[0][0] != int64(1) || exec_args[1][0] != int64(2) || exec_args[1][1] != int64(10) {
+		t.Errorf("Unexpected query args: %v", exec_args)
+	}
+	if mcli.count("outbox.published") != 1 || mcli.count("outbox.publish_errors") != 1 || mcli.count("outbox.dead") != 1 {
+		t.Errorf("Unexpected metrics: %v", mcli.counts)
+	}
+}
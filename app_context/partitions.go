@@ -0,0 +1,338 @@
+package app_context
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	PartitionDaily   = "daily"
+	PartitionWeekly  = "weekly"
+	PartitionMonthly = "monthly"
+)
+
+// PartitionPolicy is how a range partitioned table's partitions are kept
+type PartitionPolicy struct {
+	// Interval is the range each partition covers: PartitionDaily,
+	// PartitionWeekly (starting Mondays) or PartitionMonthly, in UTC
+	Interval string
+	// Premake is how many partitions after the current one to keep
+	// created. The default is 3.
+	Premake int
+	// Retention drops partitions whose range ended more than Retention
+	// ago. Zero keeps them all.
+	Retention time.Duration
+	// Schedule is how often to check: a duration or a cron expression.
+	// The default is 1h.
+	Schedule string
+}
+
+type PartitionStatus struct {
+	Table     string
+	Policy    PartitionPolicy
+	Runs      int
+	Failures  int
+	Created   int
+	Dropped   int
+	LastRun   time.Time
+	LastError string
+}
+
+// PartitionManager creates upcoming partitions of time partitioned tables
+// and drops expired ones. Partitions it manages are named
+// <table>_p<start>, eg. events_p20261014 or events_p202610, in the table's
+// schema; other partitions are left alone. Like MatViews, maintenance
+// runs as scheduler jobs, named partitions:<table>, under an advisory
+// lock.
+type PartitionManager interface {
+	// Register maintains table, which may be schema qualified and must
+	// already be created with PARTITION BY RANGE on a date or timestamp
+	Register(table string, policy PartitionPolicy) error
+	// Maintain creates and drops table's partitions now
+	Maintain(ctx context.Context, table string) error
+	Tables() []PartitionStatus
+}
+
+var errPartitionsLocked = errors.New("Another instance is maintaining the partitions")
+
+type partitionedTable struct {
+	status PartitionStatus
+}
+
+type partitionManager struct {
+	appctx *baseAppContext
+	lock   sync.Mutex
+	tables map[string]*partitionedTable
+}
+
+func newPartitionManager(appctx *baseAppContext) *partitionManager {
+	return &partitionManager{appctx: appctx, tables: make(map[string]*partitionedTable)}
+}
+
+func partitionStart(interval string, t time.Time) time.Time {
+	t = t.UTC()
+	switch interval {
+	case PartitionWeekly:
+		t = t.AddDate(0, 0, -((int(t.Weekday()) + 6) % 7))
+		fallthrough
+	case PartitionDaily:
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	default:
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	}
+}
+
+func partitionNext(interval string, t time.Time) time.Time {
+	switch interval {
+	case PartitionDaily:
+		return t.AddDate(0, 0, 1)
+	case PartitionWeekly:
+		return t.AddDate(0, 0, 7)
+	default:
+		return t.AddDate(0, 1, 0)
+	}
+}
+
+func partitionSuffixFormat(interval string) string {
+	if interval == PartitionMonthly {
+		return "200601"
+	}
+	return "20060102"
+}
+
+// partitionPrefix is what the names of table's partitions start with
+func partitionPrefix(table string) string {
+	if i := strings.LastIndex(table, "."); i >= 0 {
+		table = table[i+1:]
+	}
+	return table + "_p"
+}
+
+// partitionName is the name, without the schema, of table's partition
+// starting at start
+func partitionName(table, interval string, start time.Time) string {
+	return partitionPrefix(table) + start.Format(partitionSuffixFormat(interval))
+}
+
+// qualifyPartition puts name in table's schema
+func qualifyPartition(table, name string) string {
+	if i := strings.LastIndex(table, "."); i >= 0 {
+		return table[:i+1] + name
+	}
+	return name
+}
+
+func (self *partitionManager) Register(table string, policy PartitionPolicy) error {
+	if table == "" {
+		return errors.New("Partitioned table name is required")
+	}
+	switch policy.Interval {
+	case PartitionDaily, PartitionWeekly, PartitionMonthly:
+	default:
+		return fmt.Errorf("Unknown partition interval '%s'", policy.Interval)
+	}
+	if policy.Premake < 0 || policy.Retention < 0 {
+		return errors.New("Partition Premake and Retention must be >= 0")
+	}
+	if policy.Premake == 0 {
+		policy.Premake = 3
+	}
+	if policy.Schedule == "" {
+		policy.Schedule = "1h"
+	}
+
+	self.lock.Lock()
+	if _, ok := self.tables[table]; ok {
+		self.lock.Unlock()
+		return fmt.Errorf("Partitioned table '%s' is already registered", table)
+	}
+	self.tables[table] = &partitionedTable{status: PartitionStatus{Table: table, Policy: policy}}
+	self.lock.Unlock()
+
+	job := func(ctx context.Context) error {
+		return self.Maintain(ctx, table)
+	}
+
+	sched := self.appctx.Scheduler()
+	var err error
+	if interval, perr := time.ParseDuration(policy.Schedule); perr == nil {
+		err = sched.Every("partitions:"+table, interval, job)
+	} else {
+		err = sched.Cron("partitions:"+table, policy.Schedule, job)
+	}
+	if err != nil {
+		self.lock.Lock()
+		delete(self.tables, table)
+		self.lock.Unlock()
+		return fmt.Errorf("Error scheduling maintenance of '%s': %s", table, err)
+	}
+	return nil
+}
+
+func (self *partitionManager) Maintain(ctx context.Context, table string) error {
+	self.lock.Lock()
+	pt, ok := self.tables[table]
+	self.lock.Unlock()
+	if !ok {
+		return fmt.Errorf("Unknown partitioned table '%s'", table)
+	}
+
+	start := time.Now()
+	created, dropped, err := self.maintain(ctx, table, pt.status.Policy)
+	if err == errPartitionsLocked {
+		return nil
+	}
+
+	result := "success"
+	if err != nil {
+		result = "failure"
+		err = fmt.Errorf("Error maintaining partitions of '%s': %s", table, err)
+	}
+	mcli := self.appctx.MetricsClient()
+	tags := map[string]string{"table": table}
+	mcli.Count("partitions.created", int64(created), 1.0, tags)
+	mcli.Count("partitions.dropped", int64(dropped), 1.0, tags)
+	mcli.TimingMS(
+		"partitions.maintain_duration_ms",
+		float64(time.Since(start))/float64(time.Millisecond),
+		1.0,
+		map[string]string{"table": table, "result": result},
+	)
+
+	self.lock.Lock()
+	pt.status.Runs++
+	pt.status.Created += created
+	pt.status.Dropped += dropped
+	pt.status.LastRun = self.appctx.Clock().Now()
+	pt.status.LastError = ""
+	if err != nil {
+		pt.status.Failures++
+		pt.status.LastError = err.Error()
+	}
+	self.lock.Unlock()
+
+	return err
+}
+
+func (self *partitionManager) maintain(ctx context.Context, table string, policy PartitionPolicy) (int, int, error) {
+	db := self.appctx.DBWrite()
+	if db == nil {
+		return 0, 0, errors.New("No database is configured")
+	}
+
+	conn, err := db.DB.Conn(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer conn.Close()
+
+	locked, unlock, err := tryAdvisoryLock(ctx, conn, self.appctx.advisoryLockID("partitions", table))
+	if err != nil {
+		return 0, 0, err
+	}
+	if !locked {
+		self.appctx.MetricsClient().Incr("partitions.skipped", 1.0, map[string]string{"table": table})
+		return 0, 0, errPartitionsLocked
+	}
+	defer unlock()
+
+	rows, err := conn.QueryContext(
+		ctx,
+		"SELECT c.relname FROM pg_inherits i JOIN pg_class c ON c.oid = i.inhrelid WHERE i.inhparent = $1::regclass",
+		quoteQualifiedIdentifier(table),
+	)
+	if err != nil {
+		return 0, 0, fmt.Errorf("Error listing partitions: %s", err)
+	}
+	existing := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return 0, 0, err
+		}
+		existing[name] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, 0, err
+	}
+
+	var created, dropped int
+	now := self.appctx.Clock().Now().UTC()
+
+	from := partitionStart(policy.Interval, now)
+	for i := 0; i <= policy.Premake; i++ {
+		to := partitionNext(policy.Interval, from)
+		name := partitionName(table, policy.Interval, from)
+		if !existing[name] {
+			query := fmt.Sprintf(
+				"CREATE TABLE IF NOT EXISTS %s PARTITION OF %s FOR VALUES FROM ('%s') TO ('%s')",
+				quoteQualifiedIdentifier(qualifyPartition(table, name)),
+				quoteQualifiedIdentifier(table),
+				from.Format("2006-01-02 15:04:05-07"),
+				to.Format("2006-01-02 15:04:05-07"),
+			)
+			if _, err := conn.ExecContext(ctx, query); err != nil {
+				return created, dropped, fmt.Errorf("Error creating %s: %s", name, err)
+			}
+			created++
+		}
+		from = to
+	}
+
+	if policy.Retention == 0 {
+		return created, dropped, nil
+	}
+
+	names := make([]string, 0, len(existing))
+	for name := range existing {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	prefix := partitionPrefix(table)
+	cutoff := now.Add(-policy.Retention)
+	for _, name := range names {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		start, err := time.Parse(partitionSuffixFormat(policy.Interval), name[len(prefix):])
+		if err != nil {
+			continue
+		}
+		if partitionNext(policy.Interval, start).After(cutoff) {
+			continue
+		}
+		query := "DROP TABLE IF EXISTS " + quoteQualifiedIdentifier(qualifyPartition(table, name))
+		if _, err := conn.ExecContext(ctx, query); err != nil {
+			return created, dropped, fmt.Errorf("Error dropping %s: %s", name, err)
+		}
+		dropped++
+	}
+
+	return created, dropped, nil
+}
+
+func (self *partitionManager) Tables() []PartitionStatus {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	statuses := make([]PartitionStatus, 0, len(self.tables))
+	for _, pt := range self.tables {
+		statuses = append(statuses, pt.status)
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Table < statuses[j].Table
+	})
+	return statuses
+}
+
+func (self *baseAppContext) Partitions() PartitionManager {
+	return self.partitions
+}
@@ -0,0 +1,110 @@
+package app_context
+
+import (
+	"context"
+	"database/sql/driver"
+	"log"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPartitionManager(t *testing.T) {
+	app_ctx, err := NewAppContext("partitions_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer app_ctx.Close()
+
+	app_ctx.SetClock(NewFakeClock(time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC)))
+
+	pm := app_ctx.Partitions()
+	policy := PartitionPolicy{Interval: PartitionDaily, Premake: 2, Retention: 48 * time.Hour}
+	if err := pm.Register("app.events", policy); err != nil {
+		t.Fatal(err)
+	}
+	if err := pm.Register("app.events", policy); err == nil {
+		t.Error("Expected registering a table twice to fail")
+	}
+	if err := pm.Register("other", PartitionPolicy{Interval: "hourly"}); err == nil {
+		t.Error("Expected an unknown interval to fail")
+	}
+
+	found := false
+	for _, job := range app_ctx.Scheduler().Jobs() {
+		found = found || job.Name == "partitions:app.events"
+	}
+	if !found {
+		t.Error("Expected a scheduler job for app.events")
+	}
+
+	db, err := app_ctx.(*baseAppContext).openDB("appctx_fake", "", "primary")
+	if err != nil {
+		t.Fatal(err)
+	}
+	app_ctx.SetDB(db)
+	defer app_ctx.SetDB(nil)
+
+	fakeQueryHook = func(query string, args []driver.Value) [][]driver.Value {
+		if !strings.Contains(query, "pg_inherits") {
+			return nil
+		}
+		return [][]driver.Value{
+			{"events_p20261010"},
+			{"events_p20261011"},
+			{"events_p20261012"},
+			{"events_p20261014"},
+			{"events_archive"},
+		}
+	}
+	defer func() { fakeQueryHook = nil }()
+
+	var lock sync.Mutex
+	var queries []string
+	fakeExecHook = func(query string, args []driver.Value) error {
+		lock.Lock()
+		defer lock.Unlock()
+		if !strings.Contains(query, "advisory") {
+			queries = append(queries, query)
+		}
+		return nil
+	}
+	defer func() { fakeExecHook = nil }()
+
+	if err := pm.Maintain(context.Background(), "app.events"); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		`CREATE TABLE IF NOT EXISTS "app"."events_p20261015" PARTITION OF "app"."events" FOR VALUES FROM ('2026-10-15 00:00:00+00') TO ('2026-10-16 00:00:00+00')`,
+		`CREATE TABLE IF NOT EXISTS "app"."events_p20261016" PARTITION OF "app"."events" FOR VALUES FROM ('2026-10-16 00:00:00+00') TO ('2026-10-17 00:00:00+00')`,
+		`DROP TABLE IF EXISTS "app"."events_p20261010"`,
+		`DROP TABLE IF EXISTS "app"."events_p20261011"`,
+	}
+	lock.Lock()
+	if strings.Join(queries, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Unexpected queries:\n%s", strings.Join(queries, "\n"))
+	}
+	lock.Unlock()
+
+	statuses := pm.Tables()
+	if len(statuses) != 1 || statuses[0].Created != 2 || statuses[0].Dropped != 2 || statuses[0].Runs != 1 {
+		t.Errorf("Unexpected status: %+v", statuses)
+	}
+}
+
+func TestPartitionStart(t *testing.T) {
+	// A Wednesday
+	now := time.Date(2026, 10, 14, 12, 30, 0, 0, time.UTC)
+	tests := map[string]string{
+		PartitionDaily:   "2026-10-14",
+		PartitionWeekly:  "2026-10-12",
+		PartitionMonthly: "2026-10-01",
+	}
+	for interval, expected := range tests {
+		if start := partitionStart(interval, now).Format("2006-01-02"); start != expected {
+			t.Errorf("Expected the %s partition to start %s, got %s", interval, expected, start)
+		}
+	}
+}
@@ -0,0 +1,244 @@
+package app_context
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// urlDefaultPorts are the ports dependencies listen on when their URL
+// doesn't give one
+var urlDefaultPorts = map[string]string{
+	"http":     "80",
+	"https":    "443",
+	"nats":     "4222",
+	"postgres": "5432",
+	"redis":    "6379",
+	"smtp":     "587",
+	"smtps":    "465",
+	"tls":      "4222",
+}
+
+type preflightCheck struct {
+	Name       string  `json:"name"`
+	Setting    string  `json:"setting"`
+	Target     string  `json:"target,omitempty"`
+	OK         bool    `json:"ok"`
+	DurationMS float64 `json:"duration_ms"`
+	Error      string  `json:"error,omitempty"`
+
+	network string
+}
+
+type preflightReport struct {
+	App    string            `json:"app"`
+	OK     bool              `json:"ok"`
+	Checks []*preflightCheck `json:"checks"`
+}
+
+func urlAddress(raw string) (string, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", err
+	}
+	if u.Hostname() == "" {
+		return "", fmt.Errorf("No host in '%s'", u.Redacted())
+	}
+	if port := u.Port(); port != "" {
+		return u.Host, nil
+	}
+	port, ok := urlDefaultPorts[u.Scheme]
+	if !ok {
+		return "", fmt.Errorf("No port in '%s'", u.Redacted())
+	}
+	return net.JoinHostPort(u.Hostname(), port), nil
+}
+
+// dsnAddress is where a Postgres DSN, as a URL or "host=... port=...",
+// connects to
+func dsnAddress(dsn string) (network, addr string, err error) {
+	if strings.Contains(dsn, "://") {
+		if dsn, err = pq.ParseURL(dsn); err != nil {
+			return "", "", err
+		}
+	}
+	host, port := "localhost", "5432"
+	for _, kv := range strings.Fields(dsn) {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		val := strings.Trim(parts[1], "'")
+		switch parts[0] {
+		case "host":
+			host = val
+		case "port":
+			port = val
+		}
+	}
+	if strings.HasPrefix(host, "/") {
+		return "unix", host + "/.s.PGSQL." + port, nil
+	}
+	return "tcp", net.JoinHostPort(host, port), nil
+}
+
+// preflightChecks lists the configured dependencies. A setting that can't
+// be parsed is a failed check rather than an error, so the report still
+// covers everything else.
+func (self *baseAppContext) preflightChecks() []*preflightCheck {
+	var checks []*preflightCheck
+	add := func(name, setting, network, target string, err error) {
+		check := &preflightCheck{Name: name, Setting: setting, Target: target, network: network}
+		if err != nil {
+			check.Error = fmt.Sprintf("Invalid %s: %s", setting, err)
+		}
+		checks = append(checks, check)
+	}
+	enabled := func(prefix string) bool {
+		disabled, _ := self.isDisabled(prefix)
+		return !disabled
+	}
+
+	for _, db := range []struct{ name, setting string }{{"db", "DB_DSN"}, {"db_replica", "DB_REPLICA_DSN"}} {
+		if dsn := self.getEnv(db.setting); dsn != "" {
+			network, addr, err := dsnAddress(dsn)
+			add(db.name, db.setting, network, addr, err)
+		}
+	}
+
+	urls := []struct{ name, setting, disable string }{
+		{"cache", "CACHE_REDIS_URL", ""},
+		{"rate_limit", "RATE_LIMIT_REDIS_URL", ""},
+		{"message_bus", "NATS_URL", "NATS"},
+		{"mailer", "SMTP_URL", ""},
+		{"remote_config", "REMOTE_CONFIG_URL", ""},
+		{"traffic_role", "TRAFFIC_ROLE_URL", ""},
+		{"auth_keys", "JWKS_URL", ""},
+	}
+	for _, u := range urls {
+		if u.disable != "" && !enabled(u.disable) {
+			continue
+		}
+		if raw := self.getEnv(u.setting); raw != "" {
+			addr, err := urlAddress(raw)
+			add(u.name, u.setting, "tcp", addr, err)
+		}
+	}
+
+	if enabled("KAFKA") {
+		for _, broker := range strings.Split(self.getEnv("KAFKA_BROKERS"), ",") {
+			if broker = strings.TrimSpace(broker); broker != "" {
+				_, _, err := net.SplitHostPort(broker)
+				add("kafka", "KAFKA_BROKERS", "tcp", broker, err)
+			}
+		}
+	}
+
+	// Metrics go over UDP, so all that can be checked is the host resolving
+	if addr := self.getEnv("METRICS_ADDR"); addr != "" && enabled("METRICS") {
+		host, _, err := net.SplitHostPort(addr)
+		add("metrics", "METRICS_ADDR", "dns", host, err)
+	}
+
+	return checks
+}
+
+func (self *preflightCheck) run(ctx context.Context) {
+	start := time.Now()
+	var err error
+	if self.network == "dns" {
+		_, err = net.DefaultResolver.LookupHost(ctx, self.Target)
+	} else {
+		var conn net.Conn
+		if conn, err = (&net.Dialer{}).DialContext(ctx, self.network, self.Target); err == nil {
+			conn.Close()
+		}
+	}
+	self.DurationMS = float64(time.Since(start)) / float64(time.Millisecond)
+	if err != nil {
+		self.Error = err.Error()
+		return
+	}
+	self.OK = true
+}
+
+// preflight checks every configured dependency at once, each within
+// timeout
+func (self *baseAppContext) preflight(ctx context.Context, timeout time.Duration) *preflightReport {
+	report := &preflightReport{App: self.appName, OK: true, Checks: self.preflightChecks()}
+
+	var wg sync.WaitGroup
+	for _, check := range report.Checks {
+		if check.Error != "" {
+			continue
+		}
+		wg.Add(1)
+		go func(check *preflightCheck) {
+			defer wg.Done()
+			check_ctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			check.run(check_ctx)
+		}(check)
+	}
+	wg.Wait()
+
+	for _, check := range report.Checks {
+		report.OK = report.OK && check.OK
+	}
+	return report
+}
+
+// preflightAppContext reads the settings the way NewAppContext would,
+// without setting anything up, and PREFLIGHT_TIMEOUT (default 5s)
+func preflightAppContext(app_name string, opts ...Option) (*baseAppContext, time.Duration, error) {
+	appctx, err := newEnvAppContext(app_name, opts...)
+	if err != nil {
+		return nil, 0, err
+	}
+	if err := appctx.setProfileFromEnv(); err != nil {
+		return nil, 0, err
+	}
+	if err := appctx.setCryptoFromEnv(); err != nil {
+		return nil, 0, err
+	}
+
+	timeout, found, err := appctx.getDurationFromEnv("PREFLIGHT_TIMEOUT")
+	if err != nil {
+		return nil, 0, err
+	}
+	if !found {
+		timeout = 5 * time.Second
+	} else if timeout <= 0 {
+		return nil, 0, errors.New("PREFLIGHT_TIMEOUT must be > 0")
+	}
+	return appctx, timeout, nil
+}
+
+// runPreflight is Run's --preflight mode. It writes a JSON report on
+// reaching each configured dependency to w, returning 0 only when all of
+// them could be.
+func runPreflight(app_name string, w io.Writer, opts ...Option) int {
+	appctx, timeout, err := preflightAppContext(app_name, opts...)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading settings: %s\n", err)
+		return 1
+	}
+
+	report := appctx.preflight(context.Background(), timeout)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(report); err != nil || !report.OK {
+		return 1
+	}
+	return 0
+}
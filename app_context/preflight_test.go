@@ -0,0 +1,98 @@
+package app_context
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"os"
+	"testing"
+)
+
+func TestDSNAddress(t *testing.T) {
+	for dsn, expected := range map[string]string{
+		"postgres://user:pw@db.internal/app?sslmode=disable": "db.internal:5432",
+		"postgres://db.internal:6432/app":                    "db.internal:6432",
+		"host=db.internal port=6543 dbname=app":              "db.internal:6543",
+		"dbname=app":                                         "localhost:5432",
+		"host=/var/run/postgresql dbname=app":                "/var/run/postgresql/.s.PGSQL.5432",
+	} {
+		if _, addr, err := dsnAddress(dsn); err != nil || addr != expected {
+			t.Errorf("%s: expected %s, got %s (%v)", dsn, expected, addr, err)
+		}
+	}
+}
+
+func TestPreflight(t *testing.T) {
+	up, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer up.Close()
+	down, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down_addr := down.Addr().String()
+	down.Close()
+
+	env := map[string]string{
+		"CACHE_REDIS_URL":   "redis://" + up.Addr().String(),
+		"KAFKA_BROKERS":     up.Addr().String() + "," + down_addr,
+		"NATS_URL":          "nats://" + down_addr,
+		"NATS_DISABLE":      "true",
+		"SMTP_URL":          "smtp://",
+		"METRICS_ADDR":      "localhost:8125",
+		"PREFLIGHT_TIMEOUT": "2s",
+	}
+	var buf bytes.Buffer
+	if code := runPreflight("preflight_test", &buf, WithEnv(env), WithDotEnv("")); code != 1 {
+		t.Errorf("Expected a failed preflight to exit 1, got %d", code)
+	}
+
+	var report struct {
+		App    string
+		OK     bool
+		Checks []struct {
+			Name, Setting, Target, Error string
+			OK                           bool
+		}
+	}
+	if err := json.Unmarshal(buf.Bytes(), &report); err != nil {
+		t.Fatalf("Invalid report: %s\n%s", err, buf.String())
+	}
+	if report.App != "preflight_test" || report.OK {
+		t.Errorf("Unexpected report: %s", buf.String())
+	}
+
+	results := make(map[string]bool)
+	for _, check := range report.Checks {
+		results[check.Setting+" "+check.Target] = check.OK
+	}
+	expected := map[string]bool{
+		"CACHE_REDIS_URL " + up.Addr().String(): true,
+		"KAFKA_BROKERS " + up.Addr().String():   true,
+		"KAFKA_BROKERS " + down_addr:            false,
+		"SMTP_URL ":                             false,
+		"METRICS_ADDR localhost":                true,
+	}
+	if len(results) != len(expected) {
+		t.Errorf("Expected %d checks, got %s", len(expected), buf.String())
+	}
+	for check, ok := range expected {
+		if got, found := results[check]; !found || got != ok {
+			t.Errorf("Expected %s to be ok=%v: %s", check, ok, buf.String())
+		}
+	}
+
+	ok_env := map[string]string{"CACHE_REDIS_URL": "redis://" + up.Addr().String()}
+	buf.Reset()
+	if code := runPreflight("preflight_test", &buf, WithEnv(ok_env), WithDotEnv("")); code != 0 {
+		t.Errorf("Expected a passing preflight to exit 0, got %d: %s", code, buf.String())
+	}
+
+	os.Setenv("PREFLIGHT_TIMEOUT", "0s")
+	defer os.Unsetenv("PREFLIGHT_TIMEOUT")
+	if code := runPreflight("preflight_test", &buf); code != 1 {
+		t.Errorf("Expected an invalid PREFLIGHT_TIMEOUT to exit 1, got %d", code)
+	}
+}
@@ -0,0 +1,143 @@
+package app_context
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+)
+
+// EnvProfile holds baseline values for env settings. A value from the
+// profile is only used when the variable isn't set in the environment, so
+// any key can be overridden individually.
+type EnvProfile map[string]string
+
+var envProfiles = map[string]EnvProfile{
+	"development": {
+		"ADMISSION_QUEUE_TIMEOUT": "5s",
+		"HTTP_ERROR_DETAILS":      "true",
+		"LOG_FORMAT":              "text",
+		"LOG_LEVEL":               "debug",
+		"OFFLINE_MODE":            "true",
+		"SELFTEST_TIMEOUT":        "30s",
+		"STRICT_CONFIG":           "false",
+		"SYNTHETIC_CHECK_TIMEOUT": "30s",
+		"TEMPLATE_RELOAD":         "true",
+	},
+	"testing": {
+		"HTTP_ERROR_DETAILS": "true",
+		"LOG_FORMAT":         "text",
+		"LOG_LEVEL":          "debug",
+		"OFFLINE_MODE":       "true",
+		"STRICT_CONFIG":      "false",
+	},
+	"staging": {
+		"HTTP_ERROR_DETAILS": "false",
+		"LOG_FORMAT":         "json",
+		"LOG_LEVEL":          "debug",
+		"OFFLINE_MODE":       "false",
+		"STRICT_CONFIG":      "true",
+	},
+	"production": {
+		"HTTP_ERROR_DETAILS": "false",
+		"LOG_FORMAT":         "json",
+		"LOG_LEVEL":          "info",
+		"OFFLINE_MODE":       "false",
+		"STRICT_CONFIG":      "true",
+	},
+}
+
+// Profile returns a copy of the defaults profile selected by TiltEnv(). It
+// is empty if PROFILE_DISABLE=true.
+func (self *baseAppContext) Profile() EnvProfile {
+	profile := make(EnvProfile, len(self.profile))
+	for k, v := range self.profile {
+		profile[k] = v
+	}
+	return profile
+}
+
+// OfflineMode is a hint that the app shouldn't expect to reach external
+// services, eg. when running on a laptop. It's on by default in
+// development and testing.
+func (self *baseAppContext) OfflineMode() bool {
+	return self.offlineMode
+}
+
+// StrictConfig makes questionable settings, like unknown values that would
+// otherwise be ignored, fail NewAppContext. It's on by default in staging
+// and production.
+func (self *baseAppContext) StrictConfig() bool {
+	return self.strictConfig
+}
+
+// lookupEnv is os.LookupEnv with the env prefix applied and encrypted
+// values decrypted, falling back to the .env files, REMOTE_CONFIG_URL,
+// APPCTX_CONFIG_FILE and then the profile. All settings should be read
+// through it.
+func (self *baseAppContext) lookupEnv(name string) (string, bool) {
+	self.envLookups.Store(name, struct{}{})
+	if val, env_name, found := self.osLookupEnv(name); found {
+		if plain, ok := self.decryptedEnv[env_name]; ok {
+			return plain, true
+		}
+		return val, true
+	}
+	if val, found := self.dotEnvLookup(name); found {
+		return val, true
+	}
+	if val, found := self.remoteConfig.get(name); found {
+		return val, true
+	}
+	if val, found := self.configFile[name]; found {
+		return val, true
+	}
+	val, found := self.profile[name]
+	return val, found
+}
+
+func (self *baseAppContext) getEnv(name string) string {
+	val, _ := self.lookupEnv(name)
+	return val
+}
+
+// ConfigFingerprint is a short hash of every setting the app context has
+// looked up and its current value, for telling whether two processes (or a
+// crash and a restart) ran with the same configuration. Values can't be
+// recovered from it.
+func (self *baseAppContext) ConfigFingerprint() string {
+	names := make([]string, 0)
+	self.envLookups.Range(func(name, _ interface{}) bool {
+		names = append(names, name.(string))
+		return true
+	})
+	sort.Strings(names)
+
+	h := sha256.New()
+	for _, name := range names {
+		if val, found := self.lookupEnv(name); found {
+			fmt.Fprintf(h, "%s=%s\n", name, val)
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+func (self *baseAppContext) setProfileFromEnv() error {
+	if disabled, err := self.isDisabled("PROFILE"); disabled {
+		return err
+	}
+
+	self.profile = envProfiles[self.tiltEnv]
+
+	var err error
+
+	if self.offlineMode, _, err = self.getBoolFromEnv("OFFLINE_MODE"); err != nil {
+		return err
+	}
+
+	if self.strictConfig, _, err = self.getBoolFromEnv("STRICT_CONFIG"); err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,137 @@
+package app_context
+
+import (
+	"log"
+	"os"
+	"testing"
+)
+
+// profileEnv is what the profile tests read or that the profiles and
+// STRICT_CONFIG change the meaning of
+var profileEnv = []string{
+	"TILT_ENVIRONMENT",
+	"PROFILE_DISABLE",
+	"LOG_LEVEL",
+	"LOG_FORMAT",
+	"OFFLINE_MODE",
+	"STRICT_CONFIG",
+	"METRICS_TAGS",
+	"ROLLBAR_ENVIRONMENT",
+}
+
+// clearEnv unsets names, returning a func that puts back what was there
+func clearEnv(names ...string) func() {
+	saved := make(map[string]string)
+	for _, name := range names {
+		if val, ok := os.LookupEnv(name); ok {
+			saved[name] = val
+		}
+		os.Unsetenv(name)
+	}
+	return func() {
+		for _, name := range names {
+			if val, ok := saved[name]; ok {
+				os.Setenv(name, val)
+			} else {
+				os.Unsetenv(name)
+			}
+		}
+	}
+}
+
+func TestProfileDefaults(t *testing.T) {
+	defer clearEnv(profileEnv...)()
+
+	os.Setenv("TILT_ENVIRONMENT", "production")
+
+	app_ctx, err := NewAppContext("profiles_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer app_ctx.Close()
+
+	if lvl := app_ctx.LogLevel(); lvl != LogLevelInfo {
+		t.Errorf("production log level should be info, not %s", lvl)
+	}
+	if app_ctx.OfflineMode() {
+		t.Error("production shouldn't be in offline mode")
+	}
+	if !app_ctx.StrictConfig() {
+		t.Error("production should have strict config")
+	}
+	if format := app_ctx.Profile()["LOG_FORMAT"]; format != "json" {
+		t.Errorf("production LOG_FORMAT should be json, not '%s'", format)
+	}
+
+	os.Setenv("TILT_ENVIRONMENT", "development")
+
+	dev_ctx, err := NewAppContext("profiles_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer dev_ctx.Close()
+
+	if !dev_ctx.OfflineMode() {
+		t.Error("development should be in offline mode")
+	}
+	if dev_ctx.StrictConfig() {
+		t.Error("development shouldn't have strict config")
+	}
+}
+
+func TestProfileOverride(t *testing.T) {
+	defer clearEnv(profileEnv...)()
+
+	os.Setenv("TILT_ENVIRONMENT", "production")
+	os.Setenv("LOG_LEVEL", "warn")
+	os.Setenv("STRICT_CONFIG", "false")
+
+	app_ctx, err := NewAppContext("profiles_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer app_ctx.Close()
+
+	if lvl := app_ctx.LogLevel(); lvl != LogLevelWarn {
+		t.Errorf("LOG_LEVEL=warn should override the profile, got %s", lvl)
+	}
+	if app_ctx.StrictConfig() {
+		t.Error("STRICT_CONFIG=false should override the profile")
+	}
+
+	os.Setenv("PROFILE_DISABLE", "true")
+
+	disabled_ctx, err := NewAppContext("profiles_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer disabled_ctx.Close()
+
+	if len(disabled_ctx.Profile()) != 0 {
+		t.Errorf("PROFILE_DISABLE=true but profile is %v", disabled_ctx.Profile())
+	}
+}
+
+func TestStrictConfig(t *testing.T) {
+	if disable, ok := os.LookupEnv("METRICS_DISABLE"); ok {
+		os.Unsetenv("METRICS_DISABLE")
+		defer os.Setenv("METRICS_DISABLE", disable)
+	}
+	os.Setenv("METRICS_TAGS", "novalue")
+	defer os.Unsetenv("METRICS_TAGS")
+
+	app_ctx, err := NewAppContext("profiles_test")
+	if err != nil {
+		t.Errorf("METRICS_TAGS entry without '=' should be allowed: %s", err)
+	} else {
+		app_ctx.Close()
+	}
+
+	os.Setenv("STRICT_CONFIG", "true")
+	defer os.Unsetenv("STRICT_CONFIG")
+
+	if app_ctx, err := NewAppContext("profiles_test"); err == nil {
+		app_ctx.Close()
+		t.Error("METRICS_TAGS entry without '=' should fail with STRICT_CONFIG")
+	}
+}
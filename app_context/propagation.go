@@ -0,0 +1,217 @@
+package app_context
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// A PropagationRule describes a context field that travels with a request:
+// read from and written to Header, attached to metrics as MetricTag, and
+// embedded in SQL comments when SQLComment is set.
+type PropagationRule struct {
+	Name       string
+	Header     string
+	MetricTag  string
+	SQLComment bool
+	Default    string
+}
+
+type FieldPropagation interface {
+	AddRule(rule PropagationRule)
+	Rules() []PropagationRule
+	Field(ctx context.Context, name string) string
+	// FromRequest copies propagated headers from an incoming request into ctx
+	FromRequest(ctx context.Context, r *http.Request) context.Context
+	// ToRequest sets propagated fields from ctx as headers on an outgoing request
+	ToRequest(ctx context.Context, r *http.Request)
+	MetricTags(ctx context.Context, tags map[string]string) map[string]string
+	SQLComment(ctx context.Context) string
+	Middleware(next http.Handler) http.Handler
+}
+
+type propagatedFields map[string]string
+
+type propagatedFieldsKey struct{}
+
+func WithField(ctx context.Context, name, value string) context.Context {
+	old, _ := ctx.Value(propagatedFieldsKey{}).(propagatedFields)
+	fields := make(propagatedFields, len(old)+1)
+	for k, v := range old {
+		fields[k] = v
+	}
+	fields[name] = value
+	return context.WithValue(ctx, propagatedFieldsKey{}, fields)
+}
+
+func FieldFromContext(ctx context.Context, name string) string {
+	if ctx == nil {
+		return ""
+	}
+	fields, _ := ctx.Value(propagatedFieldsKey{}).(propagatedFields)
+	return fields[name]
+}
+
+type fieldPropagation struct {
+	lock  sync.RWMutex
+	rules []PropagationRule
+}
+
+func (self *fieldPropagation) AddRule(rule PropagationRule) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	for i, existing := range self.rules {
+		if existing.Name == rule.Name {
+			self.rules[i] = rule
+			return
+		}
+	}
+	self.rules = append(self.rules, rule)
+}
+
+func (self *fieldPropagation) Rules() []PropagationRule {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+
+	rules := make([]PropagationRule, len(self.rules))
+	copy(rules, self.rules)
+	return rules
+}
+
+func (self *fieldPropagation) rule(name string) (PropagationRule, bool) {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+
+	for _, rule := range self.rules {
+		if rule.Name == name {
+			return rule, true
+		}
+	}
+	return PropagationRule{}, false
+}
+
+func (self *fieldPropagation) Field(ctx context.Context, name string) string {
+	if v := FieldFromContext(ctx, name); v != "" {
+		return v
+	}
+	if rule, ok := self.rule(name); ok {
+		return rule.Default
+	}
+	return ""
+}
+
+func (self *fieldPropagation) FromRequest(ctx context.Context, r *http.Request) context.Context {
+	for _, rule := range self.Rules() {
+		if rule.Header == "" {
+			continue
+		}
+		if v := r.Header.Get(rule.Header); v != "" {
+			ctx = WithField(ctx, rule.Name, v)
+		}
+	}
+	return ctx
+}
+
+func (self *fieldPropagation) ToRequest(ctx context.Context, r *http.Request) {
+	for _, rule := range self.Rules() {
+		if rule.Header == "" {
+			continue
+		}
+		if v := self.Field(ctx, rule.Name); v != "" {
+			r.Header.Set(rule.Header, v)
+		}
+	}
+}
+
+func (self *fieldPropagation) MetricTags(ctx context.Context, tags map[string]string) map[string]string {
+	new_tags := make(map[string]string, len(tags))
+	for k, v := range tags {
+		new_tags[k] = v
+	}
+	for _, rule := range self.Rules() {
+		if rule.MetricTag == "" {
+			continue
+		}
+		if v := self.Field(ctx, rule.Name); v != "" {
+			new_tags[rule.MetricTag] = v
+		}
+	}
+	return new_tags
+}
+
+// SQLComment returns a sqlcommenter-style comment, eg.
+// "/*cost_center='payments'*/", or "" if there is nothing to add.
+func (self *fieldPropagation) SQLComment(ctx context.Context) string {
+	parts := make([]string, 0)
+	for _, rule := range self.Rules() {
+		if !rule.SQLComment {
+			continue
+		}
+		if v := self.Field(ctx, rule.Name); v != "" {
+			parts = append(parts, fmt.Sprintf(
+				"%s='%s'",
+				url.QueryEscape(rule.Name),
+				url.QueryEscape(v),
+			))
+		}
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	sort.Strings(parts)
+	return "/*" + strings.Join(parts, ",") + "*/"
+}
+
+func (self *fieldPropagation) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(self.FromRequest(r.Context(), r)))
+	})
+}
+
+func (self *baseAppContext) FieldPropagation() FieldPropagation {
+	return self.fieldPropagation
+}
+
+// PROPAGATION_FIELDS is a comma separated list of name=Header entries.
+// Fields listed are also used as metric tags and in SQL comments.
+func (self *baseAppContext) setFieldPropagationFromEnv() error {
+	prop := &fieldPropagation{}
+
+	cc_header, ok := self.lookupEnv("COST_CENTER_HEADER")
+	if !ok {
+		cc_header = "X-Cost-Center"
+	}
+
+	prop.AddRule(PropagationRule{
+		Name:       "cost_center",
+		Header:     cc_header,
+		MetricTag:  "cost_center",
+		SQLComment: true,
+		Default:    self.getEnv("COST_CENTER"),
+	})
+
+	for _, kv := range strings.Split(self.getEnv("PROPAGATION_FIELDS"), ",") {
+		if kv = strings.TrimSpace(kv); len(kv) == 0 {
+			continue
+		}
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return fmt.Errorf("PROPAGATION_FIELDS entry '%s' should be name=Header", kv)
+		}
+		prop.AddRule(PropagationRule{
+			Name:       parts[0],
+			Header:     parts[1],
+			MetricTag:  parts[0],
+			SQLComment: true,
+		})
+	}
+
+	self.fieldPropagation = prop
+
+	return nil
+}
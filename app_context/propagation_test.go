@@ -0,0 +1,91 @@
+package app_context
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestCostCenterPropagation(t *testing.T) {
+	if disable, ok := os.LookupEnv("METRICS_DISABLE"); ok {
+		os.Unsetenv("METRICS_DISABLE")
+		defer os.Setenv("METRICS_DISABLE", disable)
+	}
+	os.Setenv("COST_CENTER", "platform")
+	defer os.Unsetenv("COST_CENTER")
+
+	app_ctx, err := NewAppContext("propagation_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer app_ctx.Close()
+
+	if cc := app_ctx.CostCenter(context.Background()); cc != "platform" {
+		t.Errorf("CostCenter didn't default to COST_CENTER: %s", cc)
+	}
+
+	if tags := app_ctx.MetricsClient().GetTags(); tags["cost_center"] != "platform" {
+		t.Errorf("metrics tags don't include cost_center: %+v", tags)
+	}
+
+	var req_ctx context.Context
+	handler := app_ctx.FieldPropagation().Middleware(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			req_ctx = r.Context()
+		},
+	))
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Cost-Center", "check'out")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	if cc := app_ctx.CostCenter(req_ctx); cc != "check'out" {
+		t.Errorf("CostCenter not read from header: %s", cc)
+	}
+
+	tags := app_ctx.FieldPropagation().MetricTags(req_ctx, map[string]string{"a": "b"})
+	if tags["cost_center"] != "check'out" || tags["a"] != "b" {
+		t.Errorf("MetricTags didn't add cost_center: %+v", tags)
+	}
+
+	if c := app_ctx.FieldPropagation().SQLComment(req_ctx); c != "/*cost_center='check%27out'*/" {
+		t.Errorf("Unexpected SQL comment: %s", c)
+	}
+
+	out, _ := http.NewRequest("GET", "http://example.com/", nil)
+	app_ctx.FieldPropagation().ToRequest(WithCostCenter(req_ctx, "search"), out)
+	if h := out.Header.Get("X-Cost-Center"); h != "search" {
+		t.Errorf("Outgoing header not set: %s", h)
+	}
+}
+
+func TestPropagationFieldsEnv(t *testing.T) {
+	os.Setenv("PROPAGATION_FIELDS", "team=X-Team")
+	defer os.Unsetenv("PROPAGATION_FIELDS")
+
+	app_ctx, err := NewAppContext("propagation_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer app_ctx.Close()
+
+	if n := len(app_ctx.FieldPropagation().Rules()); n != 2 {
+		t.Errorf("Expected 2 rules, got %d", n)
+	}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Team", "growth")
+	ctx := app_ctx.FieldPropagation().FromRequest(context.Background(), req)
+	if v := FieldFromContext(ctx, "team"); v != "growth" {
+		t.Errorf("team field not propagated: %s", v)
+	}
+
+	os.Setenv("PROPAGATION_FIELDS", "bogus")
+	if app_ctx, err := NewAppContext("propagation_test"); err == nil {
+		app_ctx.Close()
+		t.Error("app context should have failed with bad PROPAGATION_FIELDS")
+	}
+}
@@ -0,0 +1,232 @@
+package app_context
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// QueryCacheInvalidateSubject is where InvalidateTag tells other
+// instances to drop a tag, so a memory cache on each one stays in step
+const QueryCacheInvalidateSubject = "cache.invalidate"
+
+// queryCache stores results in the app's cache next to the version each
+// of their tags had. InvalidateTag gives a tag a new version, which makes
+// every entry stored under the old one a miss without having to find them.
+type queryCache struct {
+	appctx *baseAppContext
+
+	lock     sync.Mutex
+	inflight map[string]*queryCacheCall
+	// the bus subscribed to, so SetMessageBus gets a new subscription
+	bus BusSubscription
+	on  MessageBus
+}
+
+type queryCacheCall struct {
+	done  chan struct{}
+	value []byte
+	err   error
+}
+
+type queryCacheEntry struct {
+	Tags  map[string]string `json:"tags"`
+	Value json.RawMessage   `json:"value"`
+}
+
+type queryCacheInvalidation struct {
+	Tag     string `json:"tag"`
+	Version string `json:"version"`
+}
+
+func newQueryCache(appctx *baseAppContext) *queryCache {
+	return &queryCache{appctx: appctx, inflight: make(map[string]*queryCacheCall)}
+}
+
+func queryCacheKey(key string) string {
+	return "query:" + key
+}
+
+func queryCacheTagKey(tag string) string {
+	return "query_tag:" + tag
+}
+
+func (self *queryCache) cache() Cache {
+	self.appctx.componentsLock.RLock()
+	defer self.appctx.componentsLock.RUnlock()
+	return self.appctx.cache
+}
+
+// subscribe listens for other instances' invalidations on the current bus
+func (self *queryCache) subscribe() {
+	bus := self.appctx.MessageBus()
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.on == bus {
+		return
+	}
+	if self.bus != nil {
+		self.bus.Unsubscribe()
+		self.bus = nil
+	}
+	self.on = bus
+
+	sub, err := bus.Subscribe(QueryCacheInvalidateSubject, func(msg *BusMessage) {
+		var inv queryCacheInvalidation
+		if err := json.Unmarshal(msg.Data, &inv); err != nil || inv.Tag == "" {
+			return
+		}
+		self.setTagVersion(context.Background(), inv.Tag, inv.Version)
+	})
+	if err != nil {
+		self.appctx.Logger().LogErrorf(
+			context.Background(),
+			"Couldn't subscribe to query cache invalidations: %s",
+			err,
+		)
+		return
+	}
+	self.bus = sub
+}
+
+func (self *queryCache) setTagVersion(ctx context.Context, tag, version string) error {
+	return self.cache().Set(ctx, queryCacheTagKey(tag), []byte(version), 0)
+}
+
+// tagVersions looks up the current version of tags. With create, tags
+// without one get one, so an entry is never stored under a version that
+// an evicted tag could come back to.
+func (self *queryCache) tagVersions(ctx context.Context, tags []string, create bool) (map[string]string, error) {
+	versions := make(map[string]string, len(tags))
+	for _, tag := range tags {
+		value, err := self.cache().Get(ctx, queryCacheTagKey(tag))
+		if err == ErrCacheMiss && create {
+			value = []byte(self.appctx.IDGenerator().NewID())
+			err = self.setTagVersion(ctx, tag, string(value))
+		}
+		if err != nil && err != ErrCacheMiss {
+			return nil, err
+		}
+		versions[tag] = string(value)
+	}
+	return versions, nil
+}
+
+func (self *queryCache) get(ctx context.Context, key string) ([]byte, bool) {
+	data, err := self.cache().Get(ctx, queryCacheKey(key))
+	if err != nil {
+		if err != ErrCacheMiss {
+			self.appctx.Logger().LogWarnf(ctx, "Error reading cached query '%s': %s", key, err)
+		}
+		return nil, false
+	}
+
+	var entry queryCacheEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return nil, false
+	}
+
+	tags := make([]string, 0, len(entry.Tags))
+	for tag := range entry.Tags {
+		tags = append(tags, tag)
+	}
+	current, err := self.tagVersions(ctx, tags, false)
+	if err != nil {
+		return nil, false
+	}
+	for tag, version := range entry.Tags {
+		if current[tag] != version {
+			return nil, false
+		}
+	}
+	return entry.Value, true
+}
+
+func (self *queryCache) fill(ctx context.Context, key string, ttl time.Duration, tags []string, dest interface{}, fn func(context.Context) error) ([]byte, error) {
+	// Versions from before fn runs, so an invalidation during it wins
+	versions, verr := self.tagVersions(ctx, tags, true)
+
+	if err := fn(ctx); err != nil {
+		return nil, err
+	}
+	value, err := json.Marshal(dest)
+	if err != nil {
+		return nil, err
+	}
+
+	if verr != nil {
+		self.appctx.Logger().LogWarnf(ctx, "Not caching query '%s': %s", key, verr)
+		return value, nil
+	}
+	data, err := json.Marshal(&queryCacheEntry{Tags: versions, Value: value})
+	if err == nil {
+		err = self.cache().Set(ctx, queryCacheKey(key), data, ttl)
+	}
+	if err != nil {
+		self.appctx.Logger().LogWarnf(ctx, "Error caching query '%s': %s", key, err)
+	}
+	return value, nil
+}
+
+// CachedQuery fills dest, a pointer, with the result cached under key, or
+// if there isn't one, by calling fn and caching what it put in dest as
+// JSON for ttl. Callers waiting on the same key share one call to fn.
+// InvalidateTag with any of tags drops the result. Cache errors fall back
+// to calling fn.
+func (self *baseAppContext) CachedQuery(ctx context.Context, key string, ttl time.Duration, tags []string, dest interface{}, fn func(context.Context) error) error {
+	qc := self.queryCache
+	qc.subscribe()
+
+	if value, ok := qc.get(ctx, key); ok {
+		self.MetricsClient().Incr("query_cache.hits", 1.0, nil)
+		return json.Unmarshal(value, dest)
+	}
+	self.MetricsClient().Incr("query_cache.misses", 1.0, nil)
+
+	qc.lock.Lock()
+	if call, ok := qc.inflight[key]; ok {
+		qc.lock.Unlock()
+		select {
+		case <-call.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if call.err != nil {
+			return call.err
+		}
+		return json.Unmarshal(call.value, dest)
+	}
+	call := &queryCacheCall{done: make(chan struct{})}
+	qc.inflight[key] = call
+	qc.lock.Unlock()
+
+	call.value, call.err = qc.fill(ctx, key, ttl, tags, dest, fn)
+
+	qc.lock.Lock()
+	delete(qc.inflight, key)
+	qc.lock.Unlock()
+	close(call.done)
+
+	return call.err
+}
+
+// InvalidateTag drops every CachedQuery result stored with tag, here and,
+// through the message bus, on other instances
+func (self *baseAppContext) InvalidateTag(ctx context.Context, tag string) error {
+	qc := self.queryCache
+	qc.subscribe()
+
+	inv := &queryCacheInvalidation{Tag: tag, Version: self.IDGenerator().NewID()}
+	if err := qc.setTagVersion(ctx, tag, inv.Version); err != nil {
+		return err
+	}
+	self.MetricsClient().Incr("query_cache.invalidations", 1.0, nil)
+
+	data, err := json.Marshal(inv)
+	if err != nil {
+		return err
+	}
+	return self.MessageBus().Publish(QueryCacheInvalidateSubject, data)
+}
@@ -0,0 +1,113 @@
+package app_context
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type cachedUser struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+func TestCachedQuery(t *testing.T) {
+	// Two instances, each with its own memory cache, sharing a bus
+	bus := NewMemoryMessageBus()
+	instances := make([]AppContext, 2)
+	for i := range instances {
+		app_ctx, err := NewAppContext("query_cache_test")
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer app_ctx.Close()
+		app_ctx.SetMessageBus(bus)
+		instances[i] = app_ctx
+	}
+
+	ctx := context.Background()
+	var calls int32
+	load := func(app_ctx AppContext) *cachedUser {
+		var user cachedUser
+		err := app_ctx.CachedQuery(ctx, "user:1", time.Minute, []string{"user:1"}, &user, func(ctx context.Context) error {
+			n := atomic.AddInt32(&calls, 1)
+			user = cachedUser{ID: 1, Name: fmt.Sprintf("v%d", n)}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &user
+	}
+
+	if user := load(instances[0]); user.Name != "v1" {
+		t.Errorf("Unexpected user: %+v", user)
+	}
+	if user := load(instances[0]); user.Name != "v1" || calls != 1 {
+		t.Errorf("Expected a cached result, got %+v after %d calls", user, calls)
+	}
+	load(instances[1])
+	if calls != 2 {
+		t.Errorf("Expected the second instance to fill its own cache, got %d calls", calls)
+	}
+
+	// Either instance invalidating drops the result on both
+	if err := instances[1].InvalidateTag(ctx, "user:1"); err != nil {
+		t.Fatal(err)
+	}
+	if user := load(instances[0]); user.Name != "v3" {
+		t.Errorf("Expected a fresh result after invalidating, got %+v", user)
+	}
+	if user := load(instances[1]); user.Name != "v4" {
+		t.Errorf("Expected a fresh result after invalidating, got %+v", user)
+	}
+
+	// Errors aren't cached
+	var user cachedUser
+	fail := func(ctx context.Context) error { return errors.New("DB down") }
+	if err := instances[0].CachedQuery(ctx, "user:2", time.Minute, nil, &user, fail); err == nil {
+		t.Error("Expected fn's error")
+	}
+}
+
+func TestCachedQuerySharesCalls(t *testing.T) {
+	app_ctx, err := NewAppContext("query_cache_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer app_ctx.Close()
+
+	var calls int32
+	release := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var ids []int
+			err := app_ctx.CachedQuery(context.Background(), "ids", time.Minute, nil, &ids, func(ctx context.Context) error {
+				atomic.AddInt32(&calls, 1)
+				<-release
+				ids = []int{1, 2, 3}
+				return nil
+			})
+			if err != nil || len(ids) != 3 {
+				t.Errorf("Unexpected result: %v, %v", ids, err)
+			}
+		}()
+	}
+
+	waitFor(t, "the first call", func() bool { return atomic.LoadInt32(&calls) == 1 })
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if calls != 1 {
+		t.Errorf("Expected 1 call, got %d", calls)
+	}
+}
@@ -0,0 +1,377 @@
+package app_context
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimiter is a token bucket. Limits come from RATE_LIMIT_<NAME>, where
+// <NAME> is the limiter name uppercased with anything other than letters
+// and digits replaced by _. The value is a count per period, like 100/s,
+// 1000/m, 50/h or 5/10s, and the bucket holds RATE_LIMIT_<NAME>_BURST
+// tokens, the count by default. A limiter with no limit set allows
+// everything.
+//
+// With RATE_LIMIT_REDIS_URL set, buckets are kept in redis and shared by
+// every instance. If redis can't be reached, calls are allowed rather than
+// failing the caller.
+type RateLimiter interface {
+	Name() string
+	// Allow takes a token if one is available
+	Allow(ctx context.Context) bool
+	// Wait blocks until a token can be taken or ctx is done
+	Wait(ctx context.Context) error
+}
+
+type RateLimiterStatus struct {
+	Name    string `json:"name"`
+	Limit   string `json:"limit"`
+	Burst   int    `json:"burst"`
+	Backend string `json:"backend"`
+}
+
+// tokenBucket takes a token, or returns how long until one is available
+type tokenBucket interface {
+	take(ctx context.Context, rate float64, burst int) (time.Duration, error)
+}
+
+type localBucket struct {
+	now    func() time.Time
+	lock   sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func (self *localBucket) take(ctx context.Context, rate float64, burst int) (time.Duration, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	now := self.now()
+	if self.last.IsZero() {
+		self.tokens = float64(burst)
+	} else {
+		self.tokens = math.Min(float64(burst), self.tokens+now.Sub(self.last).Seconds()*rate)
+	}
+	self.last = now
+
+	if self.tokens >= 1 {
+		self.tokens--
+		return 0, nil
+	}
+	return time.Duration((1 - self.tokens) / rate * float64(time.Second)), nil
+}
+
+// redisBucketScript is the same algorithm as localBucket, using the redis
+// server's clock so instances' clocks don't have to agree. Times are in
+// microseconds.
+const redisBucketScript = `
+redis.replicate_commands()
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000000 + tonumber(t[2])
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local b = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(b[1])
+if tokens == nil then
+  tokens = burst
+else
+  tokens = math.min(burst, tokens + (now - tonumber(b[2])) * rate)
+end
+local wait = 0
+if tokens >= 1 then
+  tokens = tokens - 1
+else
+  wait = math.ceil((1 - tokens) / rate)
+end
+redis.call('HMSET', KEYS[1], 'tokens', tokens, 'ts', now)
+redis.call('PEXPIRE', KEYS[1], math.ceil(burst / rate / 1000) + 1000)
+return wait
+`
+
+type redisBucket struct {
+	client *redisClient
+	key    string
+}
+
+func (self *redisBucket) take(ctx context.Context, rate float64, burst int) (time.Duration, error) {
+	reply, err := self.client.do(
+		ctx,
+		"EVAL", redisBucketScript, "1", self.key,
+		strconv.FormatFloat(rate/1e6, 'g', -1, 64),
+		strconv.Itoa(burst),
+	)
+	if err != nil {
+		return 0, err
+	}
+	wait, ok := reply.(int64)
+	if !ok {
+		return 0, fmt.Errorf("Unexpected reply from rate limit script: %v", reply)
+	}
+	return time.Duration(wait) * time.Microsecond, nil
+}
+
+type rateLimiter struct {
+	appctx *baseAppContext
+	name   string
+	// lock guards limit, rate and burst, which can be tuned
+	lock  sync.Mutex
+	limit string
+	// tokens per second
+	rate    float64
+	burst   int
+	backend string
+	// nil if unlimited
+	bucket tokenBucket
+}
+
+func (self *rateLimiter) settings() (float64, int) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.rate, self.burst
+}
+
+func (self *rateLimiter) Name() string {
+	return self.name
+}
+
+// take returns 0 if a token was taken. Backend errors let the call through.
+func (self *rateLimiter) take(ctx context.Context) time.Duration {
+	if self.bucket == nil {
+		return 0
+	}
+
+	rate, burst := self.settings()
+	wait, err := self.bucket.take(ctx, rate, burst)
+	if err != nil {
+		self.appctx.Logger().LogErrorf(ctx, "Error checking rate limit '%s', allowing: %s", self.name, err)
+		self.appctx.MetricsClient().Incr("rate_limit.errors", 1.0, map[string]string{"limiter": self.name})
+		return 0
+	}
+
+	result := "allowed"
+	if wait > 0 {
+		result = "limited"
+	}
+	self.appctx.MetricsClient().Incr(
+		"rate_limit.requests",
+		1.0,
+		map[string]string{"limiter": self.name, "result": result},
+	)
+	return wait
+}
+
+func (self *rateLimiter) Allow(ctx context.Context) bool {
+	return self.take(ctx) == 0
+}
+
+func (self *rateLimiter) Wait(ctx context.Context) error {
+	for {
+		wait := self.take(ctx)
+		if wait == 0 {
+			return nil
+		}
+		timer := self.appctx.Clock().NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C():
+		}
+	}
+}
+
+func (self *rateLimiter) status() *RateLimiterStatus {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return &RateLimiterStatus{
+		Name:    self.name,
+		Limit:   self.limit,
+		Burst:   self.burst,
+		Backend: self.backend,
+	}
+}
+
+// parseRateLimit parses a count per period, like 100/s or 5/10s
+func parseRateLimit(limit string) (int, time.Duration, error) {
+	parts := strings.SplitN(limit, "/", 2)
+	if len(parts) != 2 {
+		return 0, 0, errors.New("Expected <count>/<period>")
+	}
+
+	count, err := parsePositiveInt(strings.TrimSpace(parts[0]))
+	if err != nil {
+		return 0, 0, fmt.Errorf("Invalid count: %s", err)
+	}
+
+	var period time.Duration
+	switch unit := strings.TrimSpace(parts[1]); unit {
+	case "s":
+		period = time.Second
+	case "m":
+		period = time.Minute
+	case "h":
+		period = time.Hour
+	default:
+		if period, err = time.ParseDuration(unit); err != nil {
+			return 0, 0, fmt.Errorf("Invalid period: %s", err)
+		}
+		if period <= 0 {
+			return 0, 0, errors.New("Period must be > 0")
+		}
+	}
+
+	return count, period, nil
+}
+
+type rateLimiters struct {
+	appctx   *baseAppContext
+	now      func() time.Time
+	redis    *redisClient
+	lock     sync.Mutex
+	limiters map[string]*rateLimiter
+}
+
+// newLimiter logs bad settings and leaves the limiter unlimited, since
+// callers have no way to handle them
+func (self *rateLimiters) newLimiter(name string) *rateLimiter {
+	limiter := &rateLimiter{appctx: self.appctx, name: name, backend: "none"}
+
+	env_name := "RATE_LIMIT_" + envName(name)
+	limiter.limit = self.appctx.getEnv(env_name)
+	if limiter.limit == "" {
+		return limiter
+	}
+
+	count, period, err := parseRateLimit(limiter.limit)
+	if err != nil {
+		self.appctx.Logger().LogErrorf(
+			context.Background(),
+			"Ignoring invalid %s '%s': %s",
+			env_name, limiter.limit, err,
+		)
+		return limiter
+	}
+	limiter.rate = float64(count) / period.Seconds()
+	limiter.burst = count
+
+	if val := self.appctx.getEnv(env_name + "_BURST"); val != "" {
+		if burst, err := parsePositiveInt(val); err != nil {
+			self.appctx.Logger().LogErrorf(
+				context.Background(),
+				"Ignoring invalid %s_BURST '%s': %s",
+				env_name, val, err,
+			)
+		} else {
+			limiter.burst = burst
+		}
+	}
+
+	if self.redis != nil {
+		limiter.backend = "redis"
+		limiter.bucket = &redisBucket{
+			client: self.redis,
+			key:    "rate_limit:" + self.appctx.appName + ":" + name,
+		}
+	} else {
+		limiter.backend = "local"
+		limiter.bucket = &localBucket{now: self.now}
+	}
+
+	// The limit can be tuned at runtime, reverting to the one above. An
+	// override's burst is its count.
+	if tun := self.appctx.tunables; tun != nil {
+		limit, rate, burst := limiter.limit, limiter.rate, limiter.burst
+		tun.Declare(env_name, func() {
+			limiter.lock.Lock()
+			defer limiter.lock.Unlock()
+			limiter.limit, limiter.rate, limiter.burst = limit, rate, burst
+			if val, ok := tun.Override(env_name); ok {
+				if count, period, err := parseRateLimit(val); err == nil {
+					limiter.limit = val
+					limiter.rate = float64(count) / period.Seconds()
+					limiter.burst = count
+				}
+			}
+		})
+	}
+
+	return limiter
+}
+
+func (self *rateLimiters) get(name string) *rateLimiter {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	limiter, ok := self.limiters[name]
+	if !ok {
+		limiter = self.newLimiter(name)
+		self.limiters[name] = limiter
+	}
+	return limiter
+}
+
+func (self *rateLimiters) Status() []*RateLimiterStatus {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	statuses := make([]*RateLimiterStatus, 0, len(self.limiters))
+	for _, limiter := range self.limiters {
+		statuses = append(statuses, limiter.status())
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Name < statuses[j].Name
+	})
+	return statuses
+}
+
+func (self *rateLimiters) close() {
+	if self != nil && self.redis != nil {
+		self.redis.close()
+	}
+}
+
+// RateLimiter returns the limiter called name, creating it from the
+// environment on first use
+func (self *baseAppContext) RateLimiter(name string) RateLimiter {
+	return self.rateLimiters.get(name)
+}
+
+// RATE_LIMIT_REDIS_URL (redis://[:password@]host[:port][/db]) shares
+// buckets between instances, with each redis call timing out after
+// RATE_LIMIT_REDIS_TIMEOUT (default 1s).
+func (self *baseAppContext) setRateLimitsFromEnv() error {
+	limiters := &rateLimiters{
+		appctx:   self,
+		now:      self.now,
+		limiters: make(map[string]*rateLimiter),
+	}
+
+	if redis_url := self.getEnv("RATE_LIMIT_REDIS_URL"); redis_url != "" {
+		timeout := time.Second
+		if d, found, err := self.getDurationFromEnv("RATE_LIMIT_REDIS_TIMEOUT"); err != nil {
+			return err
+		} else if found {
+			if d <= 0 {
+				return fmt.Errorf("RATE_LIMIT_REDIS_TIMEOUT must be > 0")
+			}
+			timeout = d
+		}
+
+		client, err := newRedisClient(redis_url, timeout)
+		if err != nil {
+			return fmt.Errorf("Invalid RATE_LIMIT_REDIS_URL: %s", err)
+		}
+		limiters.redis = client
+	}
+
+	self.rateLimiters = limiters
+
+	return nil
+}
@@ -0,0 +1,207 @@
+package app_context
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseRateLimit(t *testing.T) {
+	tests := []struct {
+		limit  string
+		count  int
+		period time.Duration
+	}{
+		{"100/s", 100, time.Second},
+		{"1000/m", 1000, time.Minute},
+		{"50/h", 50, time.Hour},
+		{"5/10s", 5, 10 * time.Second},
+	}
+	for _, test := range tests {
+		count, period, err := parseRateLimit(test.limit)
+		if err != nil || count != test.count || period != test.period {
+			t.Errorf("'%s': got %d/%s, %v", test.limit, count, period, err)
+		}
+	}
+
+	for _, limit := range []string{"100", "0/s", "x/s", "10/x", "10/-1s"} {
+		if _, _, err := parseRateLimit(limit); err == nil {
+			t.Errorf("'%s' should fail to parse", limit)
+		}
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	os.Setenv("RATE_LIMIT_EMAIL_SENDS", "2/s")
+	os.Setenv("RATE_LIMIT_SMS", "10/m")
+	os.Setenv("RATE_LIMIT_SMS_BURST", "1")
+	os.Setenv("RATE_LIMIT_BROKEN", "lots")
+	defer os.Unsetenv("RATE_LIMIT_EMAIL_SENDS")
+	defer os.Unsetenv("RATE_LIMIT_SMS")
+	defer os.Unsetenv("RATE_LIMIT_SMS_BURST")
+	defer os.Unsetenv("RATE_LIMIT_BROKEN")
+
+	app_ctx, err := NewAppContext("rate_limit_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer app_ctx.Close()
+
+	now := time.Now()
+	app_ctx.(*baseAppContext).rateLimiters.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	limiter := app_ctx.RateLimiter("email-sends")
+	if app_ctx.RateLimiter("email-sends") != limiter {
+		t.Errorf("Expected the same limiter for the same name")
+	}
+	if !limiter.Allow(ctx) || !limiter.Allow(ctx) {
+		t.Errorf("Expected the burst to be allowed")
+	}
+	if limiter.Allow(ctx) {
+		t.Errorf("Expected the third call to be limited")
+	}
+	now = now.Add(500 * time.Millisecond)
+	if !limiter.Allow(ctx) || limiter.Allow(ctx) {
+		t.Errorf("Expected one token after 500ms")
+	}
+
+	sms := app_ctx.RateLimiter("sms")
+	if !sms.Allow(ctx) || sms.Allow(ctx) {
+		t.Errorf("Expected a burst of 1")
+	}
+	wait_ctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if err := sms.Wait(wait_ctx); err != context.DeadlineExceeded {
+		t.Errorf("Expected Wait to time out, got %v", err)
+	}
+
+	for _, name := range []string{"unset", "broken"} {
+		for i := 0; i < 100; i++ {
+			if !app_ctx.RateLimiter(name).Allow(ctx) {
+				t.Fatalf("Expected '%s' to be unlimited", name)
+			}
+		}
+	}
+
+	statuses := app_ctx.(*baseAppContext).rateLimiters.Status()
+	if len(statuses) != 4 || statuses[1].Name != "email-sends" || statuses[1].Backend != "local" || statuses[2].Burst != 1 {
+		t.Errorf("Unexpected status: %+v", statuses)
+	}
+}
+
+// fakeRedis answers every command with the next of replies
+type fakeRedis struct {
+	listener net.Listener
+	lock     sync.Mutex
+	replies  []string
+	commands [][]string
+}
+
+func newFakeRedis(t *testing.T, replies ...string) *fakeRedis {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &fakeRedis{listener: listener, replies: replies}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(conn)
+		}
+	}()
+	return server
+}
+
+func (self *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		var n int
+		if _, err := fmt.Sscanf(line, "*%d", &n); err != nil {
+			return
+		}
+		args := make([]string, n)
+		for i := range args {
+			var size int
+			header, _ := r.ReadString('\n')
+			fmt.Sscanf(header, "$%d", &size)
+			arg := make([]byte, size+2)
+			if _, err := io.ReadFull(r, arg); err != nil {
+				return
+			}
+			args[i] = string(arg[:size])
+		}
+
+		self.lock.Lock()
+		self.commands = append(self.commands, args)
+		reply := "-ERR no more replies"
+		if len(self.replies) > 0 {
+			reply, self.replies = self.replies[0], self.replies[1:]
+		}
+		self.lock.Unlock()
+
+		conn.Write([]byte(reply + "\r\n"))
+	}
+}
+
+func TestRedisRateLimiter(t *testing.T) {
+	server := newFakeRedis(t, "+OK", ":0", ":250000")
+	defer server.listener.Close()
+
+	os.Setenv("RATE_LIMIT_REDIS_URL", "redis://:secret@"+server.listener.Addr().String())
+	os.Setenv("RATE_LIMIT_EMAIL_SENDS", "4/s")
+	defer os.Unsetenv("RATE_LIMIT_REDIS_URL")
+	defer os.Unsetenv("RATE_LIMIT_EMAIL_SENDS")
+
+	app_ctx, err := NewAppContext("rate_limit_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer app_ctx.Close()
+
+	mcli := newCountingMetricsClient()
+	app_ctx.SetMetricsClient(mcli)
+	ctx := context.Background()
+
+	limiter := app_ctx.RateLimiter("email-sends")
+	if !limiter.Allow(ctx) {
+		t.Errorf("Expected the first call to be allowed")
+	}
+	if limiter.Allow(ctx) {
+		t.Errorf("Expected the second call to be limited")
+	}
+
+	server.lock.Lock()
+	if len(server.commands) != 3 || server.commands[0][0] != "AUTH" || server.commands[0][1] != "secret" {
+		t.Errorf("Unexpected commands: %v", server.commands)
+	} else if eval := server.commands[1]; eval[0] != "EVAL" || eval[3] != "rate_limit:rate_limit_test:email-sends" || eval[5] != "4" {
+		t.Errorf("Unexpected EVAL: %v", eval[3:])
+	}
+	server.lock.Unlock()
+
+	// Errors let calls through
+	if !limiter.Allow(ctx) {
+		t.Errorf("Expected a redis error to allow the call")
+	}
+	if c := mcli.count("rate_limit.errors"); c != 1 {
+		t.Errorf("Expected 1 rate_limit.errors, got %d", c)
+	}
+	if c := mcli.count("rate_limit.requests"); c != 2 {
+		t.Errorf("Expected 2 rate_limit.requests, got %d", c)
+	}
+}
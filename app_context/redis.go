@@ -0,0 +1,194 @@
+package app_context
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// redisClient is the small part of the redis protocol the distributed rate
+// limiter needs, so that it doesn't pull in a client library.
+type redisClient struct {
+	addr     string
+	password string
+	db       int
+	timeout  time.Duration
+	idle     chan *redisConn
+}
+
+type redisConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// redisError is an error reply from the server. The connection is still
+// usable after one.
+type redisError string
+
+func (self redisError) Error() string {
+	return "Redis error: " + string(self)
+}
+
+// newRedisClient parses URLs like redis://:password@host:6379/2
+func newRedisClient(redis_url string, timeout time.Duration) (*redisClient, error) {
+	u, err := url.Parse(redis_url)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "redis" {
+		return nil, fmt.Errorf("Unsupported scheme '%s'", u.Scheme)
+	}
+
+	client := &redisClient{
+		addr:    u.Host,
+		timeout: timeout,
+		idle:    make(chan *redisConn, 8),
+	}
+	if u.Port() == "" {
+		client.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		client.password, _ = u.User.Password()
+	}
+	if path := strings.Trim(u.Path, "/"); path != "" {
+		if client.db, err = strconv.Atoi(path); err != nil {
+			return nil, fmt.Errorf("Invalid database '%s'", path)
+		}
+	}
+	return client, nil
+}
+
+func (self *redisClient) dial(ctx context.Context) (*redisConn, error) {
+	dialer := &net.Dialer{Timeout: self.timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", self.addr)
+	if err != nil {
+		return nil, err
+	}
+	rconn := &redisConn{conn: conn, r: bufio.NewReader(conn)}
+
+	if self.password != "" {
+		if _, err := rconn.do(self.timeout, "AUTH", self.password); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if self.db != 0 {
+		if _, err := rconn.do(self.timeout, "SELECT", strconv.Itoa(self.db)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return rconn, nil
+}
+
+// do sends a command and returns its reply: a string, an int64, nil or an
+// []interface{} of those
+func (self *redisClient) do(ctx context.Context, args ...string) (interface{}, error) {
+	var conn *redisConn
+	select {
+	case conn = <-self.idle:
+	default:
+		var err error
+		if conn, err = self.dial(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	reply, err := conn.do(self.timeout, args...)
+	if _, ok := err.(redisError); err != nil && !ok {
+		conn.conn.Close()
+		return nil, err
+	}
+
+	select {
+	case self.idle <- conn:
+	default:
+		conn.conn.Close()
+	}
+	return reply, err
+}
+
+func (self *redisClient) close() {
+	for {
+		select {
+		case conn := <-self.idle:
+			conn.conn.Close()
+		default:
+			return
+		}
+	}
+}
+
+func (self *redisConn) do(timeout time.Duration, args ...string) (interface{}, error) {
+	self.conn.SetDeadline(time.Now().Add(timeout))
+
+	var buf strings.Builder
+	fmt.Fprintf(&buf, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&buf, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := io.WriteString(self.conn, buf.String()); err != nil {
+		return nil, err
+	}
+	return self.readReply()
+}
+
+func (self *redisConn) readLine() (string, error) {
+	line, err := self.r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if !strings.HasSuffix(line, "\r\n") || len(line) < 3 {
+		return "", errors.New("Invalid redis reply")
+	}
+	return line[:len(line)-2], nil
+}
+
+func (self *redisConn) readReply() (interface{}, error) {
+	line, err := self.readLine()
+	if err != nil {
+		return nil, err
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(self.r, data); err != nil {
+			return nil, err
+		}
+		return string(data[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		values := make([]interface{}, n)
+		for i := range values {
+			// An error inside an array doesn't fail the whole reply
+			value, err := self.readReply()
+			if _, ok := err.(redisError); err != nil && !ok {
+				return nil, err
+			}
+			values[i] = value
+		}
+		return values, nil
+	}
+	return nil, fmt.Errorf("Invalid redis reply type '%c'", line[0])
+}
@@ -0,0 +1,470 @@
+package app_context
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ConfigReloadFunc is called with the names of the remote settings that
+// were added, changed or removed
+type ConfigReloadFunc func(changed []string)
+
+// remoteFetch reads every key under the prefix. index is what the last
+// fetch returned, so a Consul fetch can block until something changes.
+type remoteFetch func(ctx context.Context, index uint64) (map[string]string, uint64, error)
+
+// remoteConfig is settings kept in Consul or etcd. They're used for
+// anything not set in the environment or the .env files, and are watched
+// for changes for as long as the app runs.
+type remoteConfig struct {
+	appctx     *baseAppContext
+	lock       sync.RWMutex
+	values     map[string]string
+	encrypted  map[string]bool
+	callbacks  []ConfigReloadFunc
+	index      uint64
+	fetch      remoteFetch
+	blocking   bool
+	source     string
+	interval   time.Duration
+	reloads    int
+	lastReload time.Time
+	lastError  string
+	cancel     context.CancelFunc
+	stopChan   chan struct{}
+	doneChan   chan struct{}
+}
+
+func newRemoteConfig(appctx *baseAppContext) *remoteConfig {
+	return &remoteConfig{
+		appctx:    appctx,
+		values:    make(map[string]string),
+		encrypted: make(map[string]bool),
+	}
+}
+
+func (self *remoteConfig) get(name string) (string, bool) {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	val, found := self.values[name]
+	return val, found
+}
+
+// wasEncrypted is whether a remote setting was decrypted, so DumpConfig
+// can mask it
+func (self *remoteConfig) wasEncrypted(name string) bool {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	return self.encrypted[name]
+}
+
+// settingName turns a key under the prefix into a setting name, eg.
+// "db/max_open_conns" into DB_MAX_OPEN_CONNS
+func settingName(prefix, key string) string {
+	return envName(strings.Trim(strings.TrimPrefix(key, prefix), "/"))
+}
+
+type remoteValues struct {
+	values    map[string]string
+	encrypted map[string]bool
+	index     uint64
+}
+
+// load fetches the settings and decrypts them. Nothing is changed if that
+// fails.
+func (self *remoteConfig) load(ctx context.Context) (*remoteValues, error) {
+	self.lock.RLock()
+	index := self.index
+	self.lock.RUnlock()
+
+	values, index, err := self.fetch(ctx, index)
+	if err != nil {
+		return nil, err
+	}
+
+	encrypted := make(map[string]bool)
+	for name, value := range values {
+		if strings.HasPrefix(value, EncryptedValuePrefix) {
+			encrypted[name] = true
+		}
+	}
+	var key []byte
+	if err := self.appctx.decryptValues(values, &key); err != nil {
+		return nil, err
+	}
+
+	return &remoteValues{values: values, encrypted: encrypted, index: index}, nil
+}
+
+// apply swaps in values and calls the reload callbacks if anything
+// changed
+func (self *remoteConfig) apply(rv *remoteValues) {
+	self.lock.Lock()
+	values := rv.values
+
+	changed := make([]string, 0)
+	for name, val := range values {
+		if old, ok := self.values[name]; !ok || old != val {
+			changed = append(changed, name)
+		}
+	}
+	for name := range self.values {
+		if _, ok := values[name]; !ok {
+			changed = append(changed, name)
+		}
+	}
+	sort.Strings(changed)
+
+	self.values = values
+	self.encrypted = rv.encrypted
+	self.index = rv.index
+	if len(changed) == 0 {
+		self.lock.Unlock()
+		return
+	}
+	self.reloads++
+	self.lastReload = self.appctx.Clock().Now()
+	callbacks := append([]ConfigReloadFunc(nil), self.callbacks...)
+	self.lock.Unlock()
+
+	self.appctx.Logger().LogInfof(
+		context.Background(),
+		"Remote config changed from %s: %s",
+		self.source,
+		strings.Join(changed, ", "),
+	)
+	self.appctx.MetricsClient().Incr("remote_config.reloads", 1.0, nil)
+
+	for _, cb := range callbacks {
+		cb(changed)
+	}
+}
+
+func (self *remoteConfig) fail(err error) {
+	self.lock.Lock()
+	self.lastError = err.Error()
+	self.lock.Unlock()
+
+	self.appctx.Logger().LogWarnf(
+		context.Background(),
+		"Couldn't read remote config from %s: %s",
+		self.source,
+		err,
+	)
+	self.appctx.MetricsClient().Incr("remote_config.errors", 1.0, nil)
+}
+
+func (self *remoteConfig) start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	self.cancel = cancel
+	self.stopChan = make(chan struct{})
+	self.doneChan = make(chan struct{})
+
+	goLabeled("remote_config", func() {
+		defer close(self.doneChan)
+
+		for {
+			rv, err := self.load(ctx)
+			select {
+			case <-self.stopChan:
+				return
+			default:
+			}
+
+			if err != nil {
+				// Keep the current settings until the source is back
+				self.fail(err)
+			} else {
+				self.apply(rv)
+				// A blocking query only returns when something changed
+				// or the wait ran out, so it can go right back
+				if self.blocking {
+					continue
+				}
+			}
+
+			select {
+			case <-self.stopChan:
+				return
+			case <-self.appctx.Clock().After(self.interval):
+			}
+		}
+	})
+}
+
+func (self *remoteConfig) stop() {
+	if self.stopChan == nil {
+		return
+	}
+	close(self.stopChan)
+	self.cancel()
+	<-self.doneChan
+	self.stopChan = nil
+}
+
+func (self *remoteConfig) status() map[string]interface{} {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	return map[string]interface{}{
+		"source":      self.source,
+		"keys":        len(self.values),
+		"index":       self.index,
+		"reloads":     self.reloads,
+		"last_reload": self.lastReload,
+		"last_error":  self.lastError,
+	}
+}
+
+type consulKV struct {
+	Key   string
+	Value *string
+}
+
+// consulFetch reads prefix recursively with a blocking query: once there's
+// an index, Consul holds the request until the index moves or wait runs
+// out.
+func consulFetch(client *http.Client, base, prefix, token string, wait time.Duration) remoteFetch {
+	return func(ctx context.Context, index uint64) (map[string]string, uint64, error) {
+		query := url.Values{"recurse": {"true"}}
+		if index > 0 {
+			query.Set("index", strconv.FormatUint(index, 10))
+			query.Set("wait", fmt.Sprintf("%ds", int(wait/time.Second)))
+		}
+		req, err := http.NewRequest("GET", base+"/v1/kv/"+prefix+"?"+query.Encode(), nil)
+		if err != nil {
+			return nil, 0, err
+		}
+		req = req.WithContext(ctx)
+		if token != "" {
+			req.Header.Set("X-Consul-Token", token)
+		}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, 0, err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+			return nil, 0, fmt.Errorf("Consul returned %s", resp.Status)
+		}
+
+		new_index, err := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+		if err != nil {
+			return nil, 0, errors.New("Consul response has no X-Consul-Index")
+		}
+		// The index can go backwards, eg. after a snapshot restore, in
+		// which case Consul says to start over
+		if new_index < index {
+			new_index = 0
+		}
+
+		values := make(map[string]string)
+		if resp.StatusCode == http.StatusNotFound {
+			return values, new_index, nil
+		}
+
+		var kvs []consulKV
+		if err := json.NewDecoder(resp.Body).Decode(&kvs); err != nil {
+			return nil, 0, fmt.Errorf("Error decoding Consul response: %s", err)
+		}
+		for _, kv := range kvs {
+			// Folders have no value
+			if kv.Value == nil {
+				continue
+			}
+			val, err := base64.StdEncoding.DecodeString(*kv.Value)
+			if err != nil {
+				return nil, 0, fmt.Errorf("Error decoding value of %s: %s", kv.Key, err)
+			}
+			if name := settingName(prefix, kv.Key); name != "" {
+				values[name] = string(val)
+			}
+		}
+		return values, new_index, nil
+	}
+}
+
+type etcdRangeResponse struct {
+	Header struct {
+		Revision string `json:"revision"`
+	} `json:"header"`
+	Kvs []struct {
+		Key   string `json:"key"`
+		Value string `json:"value"`
+	} `json:"kvs"`
+}
+
+// etcdRangeEnd is the end of the range covering every key starting with
+// prefix
+func etcdRangeEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	// All keys
+	return "\x00"
+}
+
+// etcdFetch reads prefix through etcd's v3 JSON gateway. It's polled,
+// and the revision tells whether anything changed.
+func etcdFetch(client *http.Client, base, prefix, token string) remoteFetch {
+	return func(ctx context.Context, index uint64) (map[string]string, uint64, error) {
+		body, _ := json.Marshal(map[string]string{
+			"key":       base64.StdEncoding.EncodeToString([]byte(prefix)),
+			"range_end": base64.StdEncoding.EncodeToString([]byte(etcdRangeEnd(prefix))),
+		})
+		req, err := http.NewRequest("POST", base+"/v3/kv/range", bytes.NewReader(body))
+		if err != nil {
+			return nil, 0, err
+		}
+		req = req.WithContext(ctx)
+		req.Header.Set("Content-Type", "application/json")
+		if token != "" {
+			req.Header.Set("Authorization", token)
+		}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, 0, err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			msg, _ := ioutil.ReadAll(resp.Body)
+			return nil, 0, fmt.Errorf("etcd returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+		}
+
+		var rng etcdRangeResponse
+		if err := json.NewDecoder(resp.Body).Decode(&rng); err != nil {
+			return nil, 0, fmt.Errorf("Error decoding etcd response: %s", err)
+		}
+		revision, _ := strconv.ParseUint(rng.Header.Revision, 10, 64)
+
+		values := make(map[string]string)
+		for _, kv := range rng.Kvs {
+			key, err := base64.StdEncoding.DecodeString(kv.Key)
+			if err != nil {
+				return nil, 0, fmt.Errorf("Error decoding etcd key: %s", err)
+			}
+			val, err := base64.StdEncoding.DecodeString(kv.Value)
+			if err != nil {
+				return nil, 0, fmt.Errorf("Error decoding value of %s: %s", key, err)
+			}
+			if name := settingName(prefix, string(key)); name != "" {
+				values[name] = string(val)
+			}
+		}
+		return values, revision, nil
+	}
+}
+
+// OnConfigReload calls fn whenever settings from REMOTE_CONFIG_URL change.
+// Most settings are only read at startup, so this is for the app's own
+// settings, read again with ConfigValue.
+func (self *baseAppContext) OnConfigReload(fn ConfigReloadFunc) {
+	self.remoteConfig.lock.Lock()
+	defer self.remoteConfig.lock.Unlock()
+	self.remoteConfig.callbacks = append(self.remoteConfig.callbacks, fn)
+}
+
+// ConfigValue looks up a setting the way the app context reads its own:
+// the environment, the .env files, remote config, APPCTX_CONFIG_FILE and
+// then the profile
+func (self *baseAppContext) ConfigValue(name string) (string, bool) {
+	return self.lookupEnv(name)
+}
+
+// REMOTE_CONFIG_URL is consul://host:port/<prefix> or
+// etcd://host:port/<prefix>. Each key under the prefix is a setting, named
+// from the rest of the key, eg. <prefix>/db/max_open_conns sets
+// DB_MAX_OPEN_CONNS. Names aren't env prefixed; give each app its own
+// prefix instead. REMOTE_CONFIG_TLS=true uses https, and
+// REMOTE_CONFIG_TOKEN is a Consul ACL token or an etcd auth token. Consul
+// is watched with blocking queries, etcd is polled every
+// REMOTE_CONFIG_POLL_INTERVAL.
+func (self *baseAppContext) setRemoteConfigFromEnv() error {
+	rc := self.remoteConfig
+	rc.interval = 10 * time.Second
+
+	raw := self.getEnv("REMOTE_CONFIG_URL")
+	if raw == "" {
+		return nil
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil {
+		return fmt.Errorf("Couldn't parse REMOTE_CONFIG_URL: %s", err)
+	}
+	if u.Host == "" {
+		return errors.New("REMOTE_CONFIG_URL needs a host")
+	}
+
+	if interval, found, err := self.getDurationFromEnv("REMOTE_CONFIG_POLL_INTERVAL"); err != nil {
+		return err
+	} else if found {
+		if interval <= 0 {
+			return errors.New("REMOTE_CONFIG_POLL_INTERVAL must be > 0")
+		}
+		rc.interval = interval
+	}
+
+	use_tls, _, err := self.getBoolFromEnv("REMOTE_CONFIG_TLS")
+	if err != nil {
+		return err
+	}
+	scheme := "http"
+	if use_tls {
+		scheme = "https"
+	}
+	base := scheme + "://" + u.Host
+	prefix := strings.TrimPrefix(u.Path, "/")
+	token := self.getEnv("REMOTE_CONFIG_TOKEN")
+
+	switch u.Scheme {
+	case "consul":
+		// Consul's blocking queries wait at most 10m, and the client
+		// is given a bit longer than the wait
+		wait := 5 * time.Minute
+		client := &http.Client{Timeout: wait + wait/16 + 10*time.Second}
+		rc.fetch = consulFetch(client, base, prefix, token, wait)
+		rc.blocking = true
+	case "etcd":
+		client := &http.Client{Timeout: 30 * time.Second}
+		rc.fetch = etcdFetch(client, base, prefix, token)
+	default:
+		return fmt.Errorf("REMOTE_CONFIG_URL should be consul:// or etcd://, not %s://", u.Scheme)
+	}
+	rc.source = u.Scheme + "://" + u.Host + "/" + prefix
+
+	// Unlike tunables, these are settings the app may not be able to run
+	// without, so they have to be read at startup.
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	rv, err := rc.load(ctx)
+	if err != nil {
+		return fmt.Errorf("Couldn't read remote config from %s: %s", rc.source, err)
+	}
+	rc.values = rv.values
+	rc.encrypted = rv.encrypted
+	rc.index = rv.index
+
+	rc.start()
+
+	return nil
+}
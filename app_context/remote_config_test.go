@@ -0,0 +1,184 @@
+package app_context
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeKV is enough of Consul's and etcd's KV APIs for the watcher
+type fakeKV struct {
+	lock    sync.Mutex
+	index   uint64
+	kvs     map[string]string
+	changed chan struct{}
+}
+
+func newFakeKV(kvs map[string]string) *fakeKV {
+	return &fakeKV{index: 1, kvs: kvs, changed: make(chan struct{})}
+}
+
+func (self *fakeKV) set(key, value string) {
+	self.lock.Lock()
+	self.kvs[key] = value
+	self.index++
+	close(self.changed)
+	self.changed = make(chan struct{})
+	self.lock.Unlock()
+}
+
+func (self *fakeKV) consul(w http.ResponseWriter, r *http.Request) {
+	prefix := strings.TrimPrefix(r.URL.Path, "/v1/kv/")
+
+	self.lock.Lock()
+	index, changed := self.index, self.changed
+	self.lock.Unlock()
+
+	if r.URL.Query().Get("index") == strconv.FormatUint(index, 10) {
+		select {
+		case <-changed:
+		case <-time.After(time.Second):
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	kvs := []map[string]interface{}{{"Key": prefix + "db/", "Value": nil}}
+	for key, value := range self.kvs {
+		kvs = append(kvs, map[string]interface{}{
+			"Key":   prefix + key,
+			"Value": base64.StdEncoding.EncodeToString([]byte(value)),
+		})
+	}
+	w.Header().Set("X-Consul-Index", strconv.FormatUint(self.index, 10))
+	json.NewEncoder(w).Encode(kvs)
+}
+
+func (self *fakeKV) etcd(w http.ResponseWriter, r *http.Request) {
+	var req map[string]string
+	json.NewDecoder(r.Body).Decode(&req)
+	prefix, _ := base64.StdEncoding.DecodeString(req["key"])
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	kvs := make([]map[string]string, 0)
+	for key, value := range self.kvs {
+		kvs = append(kvs, map[string]string{
+			"key":   base64.StdEncoding.EncodeToString([]byte(string(prefix) + key)),
+			"value": base64.StdEncoding.EncodeToString([]byte(value)),
+		})
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"header": map[string]string{"revision": strconv.FormatUint(self.index, 10)},
+		"kvs":    kvs,
+	})
+}
+
+func testRemoteConfig(t *testing.T, scheme string, handler func(*fakeKV) http.HandlerFunc) {
+	kv := newFakeKV(map[string]string{
+		"base_url":            "http://remote",
+		"code_version":        "remote",
+		"db/max_open_conns":   "7",
+		"feature/new_billing": "false",
+	})
+	srv := httptest.NewServer(handler(kv))
+	defer srv.Close()
+
+	os.Setenv("REMOTE_CONFIG_URL", scheme+"://"+strings.TrimPrefix(srv.URL, "http://")+"/services/remote_test/")
+	defer os.Unsetenv("REMOTE_CONFIG_URL")
+	os.Setenv("REMOTE_CONFIG_POLL_INTERVAL", "10ms")
+	defer os.Unsetenv("REMOTE_CONFIG_POLL_INTERVAL")
+	os.Setenv("CODE_VERSION", "env")
+	defer os.Unsetenv("CODE_VERSION")
+
+	app_ctx, err := NewAppContext("remote_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer app_ctx.Close()
+
+	if url := app_ctx.BaseExternalURL(); url != "http://remote" {
+		t.Errorf("Expected BASE_URL from remote config, got %s", url)
+	}
+	if version := app_ctx.CodeVersion(); version != "env" {
+		t.Errorf("Expected the environment to override remote config, got %s", version)
+	}
+	if val, _ := app_ctx.ConfigValue("DB_MAX_OPEN_CONNS"); val != "7" {
+		t.Errorf("Expected nested keys to be named from their path, got '%s'", val)
+	}
+	if source := app_ctx.(*baseAppContext).envSource("BASE_URL"); source != "remote_config" {
+		t.Errorf("Expected BASE_URL's source to be remote_config, got %s", source)
+	}
+
+	reloads := make(chan []string, 1)
+	app_ctx.OnConfigReload(func(changed []string) {
+		reloads <- changed
+	})
+
+	kv.set("feature/new_billing", "true")
+
+	select {
+	case changed := <-reloads:
+		if !reflect.DeepEqual(changed, []string{"FEATURE_NEW_BILLING"}) {
+			t.Errorf("Unexpected changed settings: %v", changed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Reload callback wasn't called")
+	}
+	if val, _ := app_ctx.ConfigValue("FEATURE_NEW_BILLING"); val != "true" {
+		t.Errorf("Expected the reloaded value, got '%s'", val)
+	}
+}
+
+func TestRemoteConfigConsul(t *testing.T) {
+	testRemoteConfig(t, "consul", func(kv *fakeKV) http.HandlerFunc {
+		return kv.consul
+	})
+}
+
+func TestRemoteConfigEtcd(t *testing.T) {
+	testRemoteConfig(t, "etcd", func(kv *fakeKV) http.HandlerFunc {
+		return kv.etcd
+	})
+}
+
+func TestRemoteConfigUnavailable(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "no leader", http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	os.Setenv("REMOTE_CONFIG_URL", "consul://"+strings.TrimPrefix(srv.URL, "http://")+"/app")
+	defer os.Unsetenv("REMOTE_CONFIG_URL")
+
+	if _, err := NewAppContext("remote_test"); err == nil {
+		t.Error("Expected an error when remote config can't be read at startup")
+	}
+
+	os.Setenv("REMOTE_CONFIG_URL", "zookeeper://localhost/app")
+	if _, err := NewAppContext("remote_test"); err == nil {
+		t.Error("Expected an error for an unknown REMOTE_CONFIG_URL scheme")
+	}
+}
+
+func TestEtcdRangeEnd(t *testing.T) {
+	if end := etcdRangeEnd("app/"); end != "app0" {
+		t.Errorf("Expected app0, got %q", end)
+	}
+	if end := etcdRangeEnd("a\xff"); end != "b" {
+		t.Errorf("Expected b, got %q", end)
+	}
+}
@@ -0,0 +1,216 @@
+package app_context
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RequestAppContext is a view of the app context for a single HTTP request.
+// Its logger and rollbar notifications carry the request ID, method and
+// path.
+type RequestAppContext interface {
+	AppContext
+	// Context is the request's context with the request ID and
+	// propagated fields attached
+	Context() context.Context
+	Request() *http.Request
+	RequestID() string
+	// Finish records request.count and request.duration_ms, tagged with
+	// method and status. Only the first call has any effect.
+	Finish(status int) time.Duration
+	RespondJSON(w http.ResponseWriter, status int, payload interface{})
+	RespondError(w http.ResponseWriter, err error)
+}
+
+type requestIDKey struct{}
+
+func WithRequestID(ctx context.Context, request_id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, request_id)
+}
+
+func RequestIDFromContext(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	request_id, _ := ctx.Value(requestIDKey{}).(string)
+	return request_id
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	return hex.EncodeToString(b)
+}
+
+type requestAppContext struct {
+	*childAppContext
+	ctx        context.Context
+	request    *http.Request
+	requestID  string
+	start      time.Time
+	finishOnce sync.Once
+	elapsed    time.Duration
+}
+
+func (self *requestAppContext) Context() context.Context {
+	return self.ctx
+}
+
+func (self *requestAppContext) Request() *http.Request {
+	return self.request
+}
+
+func (self *requestAppContext) RequestID() string {
+	return self.requestID
+}
+
+func (self *requestAppContext) Finish(status int) time.Duration {
+	self.finishOnce.Do(func() {
+		self.elapsed = time.Since(self.start)
+
+		tags := self.FieldPropagation().MetricTags(self.ctx, map[string]string{
+			"method": self.request.Method,
+			"status": strconv.Itoa(status),
+		})
+
+		mcli := self.MetricsClient()
+		mcli.Incr("request.count", 1.0, tags)
+		mcli.TimingMS(
+			"request.duration_ms",
+			float64(self.elapsed)/float64(time.Millisecond),
+			1.0,
+			tags,
+		)
+	})
+	return self.elapsed
+}
+
+func newRequestAppContext(base *baseAppContext, component string, fields map[string]interface{}, r *http.Request) *requestAppContext {
+	ctx := WithReadYourWrites(base.FieldPropagation().FromRequest(r.Context(), r))
+
+	request_id := RequestIDFromContext(ctx)
+	if request_id == "" {
+		if request_id = r.Header.Get(base.requestIDHeader); request_id == "" {
+			request_id = base.IDGenerator().NewID()
+		}
+		ctx = WithRequestID(ctx, request_id)
+	}
+
+	fields = mergeFields(fields, map[string]interface{}{
+		"request_id": request_id,
+		"method":     r.Method,
+		"path":       r.URL.Path,
+	})
+
+	return &requestAppContext{
+		childAppContext: newChildAppContext(base, component, fields),
+		ctx:             ctx,
+		request:         r.WithContext(ctx),
+		requestID:       request_id,
+		start:           time.Now(),
+	}
+}
+
+// ForRequest returns a view of the context for handling r. The request ID
+// comes from r's context if already set, then the REQUEST_ID_HEADER header
+// (X-Request-ID by default), and is generated otherwise.
+func (self *baseAppContext) ForRequest(r *http.Request) RequestAppContext {
+	return newRequestAppContext(self, "", nil, r)
+}
+
+func (self *childAppContext) ForRequest(r *http.Request) RequestAppContext {
+	return newRequestAppContext(self.baseAppContext, self.component, self.fields, r)
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (self *statusRecorder) WriteHeader(status int) {
+	if self.status == 0 {
+		self.status = status
+	}
+	self.ResponseWriter.WriteHeader(status)
+}
+
+func (self *statusRecorder) Write(b []byte) (int, error) {
+	if self.status == 0 {
+		self.status = http.StatusOK
+	}
+	return self.ResponseWriter.Write(b)
+}
+
+func (self *statusRecorder) Flush() {
+	if flusher, ok := self.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack is for WebSockets; the status is recorded as 101
+func (self *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := self.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("The response can't be hijacked")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err == nil && self.status == 0 {
+		self.status = http.StatusSwitchingProtocols
+	}
+	return conn, rw, err
+}
+
+// RequestMiddleware runs ForRequest for every request, echoes the request ID
+// in the response headers and calls Finish when the handler returns.
+// Handlers calling ForRequest themselves get the same request ID. A
+// REQUEST_DEADLINE_HEADER header from the caller becomes the deadline of
+// the request's context.
+func (self *baseAppContext) RequestMiddleware(next http.Handler) http.Handler {
+	return requestMiddleware(self, self, next)
+}
+
+func (self *childAppContext) RequestMiddleware(next http.Handler) http.Handler {
+	return requestMiddleware(self.baseAppContext, self, next)
+}
+
+func requestMiddleware(base *baseAppContext, appctx AppContext, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if timeout, ok := base.requestTimeout(r); ok {
+			ctx, cancel := context.WithTimeout(r.Context(), timeout)
+			defer cancel()
+			r = r.WithContext(ctx)
+		}
+
+		reqctx := appctx.ForRequest(r)
+		w.Header().Set(base.requestIDHeader, reqctx.RequestID())
+
+		rec := &statusRecorder{ResponseWriter: w}
+		defer func() {
+			if rec.status == 0 {
+				rec.status = http.StatusOK
+			}
+			reqctx.Finish(rec.status)
+		}()
+
+		next.ServeHTTP(rec, reqctx.Request())
+	})
+}
+
+func (self *baseAppContext) setRequestIDHeaderFromEnv() error {
+	header, ok := self.lookupEnv("REQUEST_ID_HEADER")
+	if !ok || header == "" {
+		header = "X-Request-ID"
+	}
+	self.requestIDHeader = header
+	return nil
+}
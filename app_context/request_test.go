@@ -0,0 +1,145 @@
+package app_context
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/tilteng/go-logger/logger"
+	"github.com/tilteng/go-metrics/metrics"
+)
+
+type countingMetricsClient struct {
+	metrics.MetricsClient
+	lock   sync.Mutex
+	counts map[string]int
+	tags   map[string]map[string]string
+}
+
+func newCountingMetricsClient() *countingMetricsClient {
+	return &countingMetricsClient{
+		MetricsClient: metrics.NewNOOPClient(),
+		counts:        make(map[string]int),
+		tags:          make(map[string]map[string]string),
+	}
+}
+
+func (self *countingMetricsClient) Incr(name string, rate float64, tags map[string]string) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.counts[name]++
+	self.tags[name] = tags
+	return nil
+}
+
+func (self *countingMetricsClient) TimingMS(name string, value float64, rate float64, tags map[string]string) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.counts[name]++
+	self.tags[name] = tags
+	return nil
+}
+
+func (self *countingMetricsClient) Gauge(name string, value float64, rate float64, tags map[string]string) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.counts[name]++
+	return nil
+}
+
+func (self *countingMetricsClient) Histogram(name string, value float64, rate float64, tags map[string]string) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.counts[name]++
+	return nil
+}
+
+func (self *countingMetricsClient) count(name string) int {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.counts[name]
+}
+
+func TestForRequest(t *testing.T) {
+	app_ctx, err := NewAppContext("request_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	buf := &bytes.Buffer{}
+	app_ctx.SetLogger(logger.NewDefaultCtxLogger(NewLevelLogger(buf, LogLevelDebug, true)))
+	mcli := newCountingMetricsClient()
+	app_ctx.SetMetricsClient(mcli)
+
+	req := httptest.NewRequest("POST", "/orders", nil)
+	req.Header.Set("X-Request-ID", "abc123")
+
+	reqctx := app_ctx.ForRequest(req)
+	if id := reqctx.RequestID(); id != "abc123" {
+		t.Errorf("Request ID not taken from header: %s", id)
+	}
+	if id := RequestIDFromContext(reqctx.Request().Context()); id != "abc123" {
+		t.Errorf("Request ID not set on request context: %s", id)
+	}
+
+	reqctx.Logger().LogInfo(reqctx.Context(), "handling")
+
+	entry := map[string]interface{}{}
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("Log line isn't JSON: %s: %s", err, buf.String())
+	}
+	if entry["request_id"] != "abc123" || entry["method"] != "POST" || entry["path"] != "/orders" {
+		t.Errorf("Request fields missing from log entry: %+v", entry)
+	}
+
+	reqctx.Finish(201)
+	reqctx.Finish(500)
+	if n := mcli.counts["request.count"]; n != 1 {
+		t.Errorf("Finish should only record once, recorded %d times", n)
+	}
+	if tags := mcli.tags["request.count"]; tags["status"] != "201" || tags["method"] != "POST" {
+		t.Errorf("Unexpected request metric tags: %+v", tags)
+	}
+
+	other := app_ctx.ForRequest(httptest.NewRequest("GET", "/", nil))
+	if other.RequestID() == "" {
+		t.Error("Request ID should be generated when the header is missing")
+	}
+}
+
+func TestRequestMiddleware(t *testing.T) {
+	app_ctx, err := NewAppContext("request_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	mcli := newCountingMetricsClient()
+	app_ctx.SetMetricsClient(mcli)
+
+	var seen string
+	handler := app_ctx.RequestMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = app_ctx.ForRequest(r).RequestID()
+		w.WriteHeader(http.StatusTeapot)
+	}))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+
+	if seen == "" || w.Header().Get("X-Request-ID") != seen {
+		t.Errorf("Response request ID '%s' doesn't match handler's '%s'", w.Header().Get("X-Request-ID"), seen)
+	}
+	if tags := mcli.tags["request.count"]; tags["status"] != "418" {
+		t.Errorf("Middleware didn't record the response status: %+v", tags)
+	}
+
+	ctx := WithRequestID(context.Background(), "fromctx")
+	req := httptest.NewRequest("GET", "/", nil).WithContext(ctx)
+	if id := app_ctx.ForRequest(req).RequestID(); id != "fromctx" {
+		t.Errorf("Request ID from context should win: %s", id)
+	}
+}
@@ -0,0 +1,133 @@
+package app_context
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// gzipMinBytes is the smallest response body worth compressing
+const gzipMinBytes = 1024
+
+type responseMeta struct {
+	RequestID   string `json:"request_id,omitempty"`
+	CodeVersion string `json:"code_version,omitempty"`
+}
+
+func newResponseMeta(base *baseAppContext, reqctx RequestAppContext) *responseMeta {
+	return &responseMeta{RequestID: reqctx.RequestID(), CodeVersion: base.codeVersion}
+}
+
+type dataResponse struct {
+	Data interface{}   `json:"data"`
+	Meta *responseMeta `json:"meta"`
+}
+
+// acceptable returns whether the Accept header value allows any of types,
+// eg. "application/json"
+func acceptable(accept string, types ...string) bool {
+	if strings.TrimSpace(accept) == "" {
+		return true
+	}
+	for _, part := range strings.Split(accept, ",") {
+		fields := strings.Split(part, ";")
+		media := strings.ToLower(strings.TrimSpace(fields[0]))
+		if headerParamQ(fields[1:]) == 0 {
+			continue
+		}
+		for _, t := range types {
+			if media == t || media == "*/*" || (strings.HasSuffix(media, "/*") && strings.HasPrefix(t, strings.TrimSuffix(media, "*"))) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// headerParamQ is the q parameter of an Accept style header entry, 1 when
+// missing
+func headerParamQ(params []string) float64 {
+	for _, param := range params {
+		kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+		if len(kv) == 2 && strings.ToLower(kv[0]) == "q" {
+			q, err := strconv.ParseFloat(kv[1], 64)
+			if err != nil {
+				return 0
+			}
+			return q
+		}
+	}
+	return 1
+}
+
+func acceptsGzip(accept_encoding string) bool {
+	for _, part := range strings.Split(accept_encoding, ",") {
+		fields := strings.Split(part, ";")
+		coding := strings.ToLower(strings.TrimSpace(fields[0]))
+		if (coding == "gzip" || coding == "*") && headerParamQ(fields[1:]) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// writeEnvelope writes an encoded envelope, gzipped when r accepts it and
+// it's big enough to be worth it
+func writeEnvelope(r *http.Request, w http.ResponseWriter, status int, data []byte) {
+	hdr := w.Header()
+	hdr.Set("Content-Type", "application/json; charset=utf-8")
+	hdr.Set("X-Content-Type-Options", "nosniff")
+	hdr.Add("Vary", "Accept-Encoding")
+
+	if len(data) >= gzipMinBytes && r != nil && acceptsGzip(r.Header.Get("Accept-Encoding")) {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		if _, err := gz.Write(data); err == nil && gz.Close() == nil {
+			hdr.Set("Content-Encoding", "gzip")
+			data = buf.Bytes()
+		}
+	}
+
+	hdr.Set("Content-Length", strconv.Itoa(len(data)))
+	w.WriteHeader(status)
+	if r == nil || r.Method != "HEAD" {
+		w.Write(data)
+	}
+}
+
+var errNotAcceptable = NewAppError(http.StatusNotAcceptable, "not_acceptable", "Responses are only available as application/json")
+
+// RespondJSON writes payload in the standard envelope:
+//
+//	{"data": payload, "meta": {"request_id": "...", "code_version": "..."}}
+//
+// A request whose Accept header doesn't allow JSON gets a 406 instead, and
+// one that accepts gzip gets larger responses compressed. A 204 or 304
+// has no body. If payload can't be encoded, it's a 500 from RespondError.
+func (self *requestAppContext) RespondJSON(w http.ResponseWriter, status int, payload interface{}) {
+	if !acceptable(self.request.Header.Get("Accept"), "application/json") {
+		self.RespondError(w, errNotAcceptable)
+		return
+	}
+	if status == http.StatusNoContent || status == http.StatusNotModified {
+		w.WriteHeader(status)
+		return
+	}
+
+	data, err := json.Marshal(&dataResponse{Data: payload, Meta: newResponseMeta(self.baseAppContext, self)})
+	if err != nil {
+		self.RespondError(w, errInternal.Wrap(fmt.Errorf("Error encoding response: %s", err)))
+		return
+	}
+	writeEnvelope(self.request, w, status, data)
+}
+
+// RespondError is WriteHTTPError for this request: the error envelope
+// with the status and code ErrorCodes() gives err
+func (self *requestAppContext) RespondError(w http.ResponseWriter, err error) {
+	writeHTTPError(self.baseAppContext, self, w, err)
+}
@@ -0,0 +1,104 @@
+package app_context
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestRespondJSON(t *testing.T) {
+	os.Setenv("CODE_VERSION", "v1.2.3")
+	defer os.Unsetenv("CODE_VERSION")
+
+	app_ctx, err := NewAppContext("respond_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app_ctx.Close()
+
+	handler := app_ctx.HTTPMiddleware()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reqctx := app_ctx.ForRequest(r)
+		switch r.URL.Path {
+		case "/big":
+			reqctx.RespondJSON(w, http.StatusOK, map[string]string{"text": strings.Repeat("x", 2*gzipMinBytes)})
+		case "/bad":
+			reqctx.RespondJSON(w, http.StatusOK, func() {})
+		case "/error":
+			reqctx.RespondError(w, ErrObjectNotFound)
+		default:
+			reqctx.RespondJSON(w, http.StatusCreated, map[string]int{"id": 1})
+		}
+	}))
+
+	serve := func(path string, hdrs ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		for i := 0; i < len(hdrs); i += 2 {
+			req.Header.Set(hdrs[i], hdrs[i+1])
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	w := serve("/")
+	var resp struct {
+		Data map[string]int `json:"data"`
+		Meta responseMeta   `json:"meta"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusCreated || resp.Data["id"] != 1 {
+		t.Errorf("Unexpected response %d: %+v", w.Code, resp)
+	}
+	if resp.Meta.RequestID != w.Header().Get("X-Request-ID") || resp.Meta.CodeVersion != "v1.2.3" {
+		t.Errorf("Unexpected meta %+v", resp.Meta)
+	}
+	if w.Header().Get("Content-Encoding") != "" {
+		t.Error("Small responses shouldn't be compressed")
+	}
+
+	w = serve("/big", "Accept-Encoding", "br, gzip;q=0.5")
+	if w.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatal("Expected a gzipped response")
+	}
+	gz, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var big struct {
+		Data map[string]string `json:"data"`
+	}
+	if err := json.NewDecoder(gz).Decode(&big); err != nil || len(big.Data["text"]) != 2*gzipMinBytes {
+		t.Errorf("Couldn't decode the gzipped response: %v", err)
+	}
+
+	if w = serve("/big", "Accept-Encoding", "gzip;q=0"); w.Header().Get("Content-Encoding") != "" {
+		t.Error("gzip;q=0 shouldn't be compressed")
+	}
+
+	w = serve("/", "Accept", "text/html")
+	if body := decodeErrorResponse(t, w); w.Code != http.StatusNotAcceptable || body.Code != "not_acceptable" {
+		t.Errorf("Unexpected response %d: %+v", w.Code, body)
+	}
+	if w = serve("/", "Accept", "text/html, application/*;q=0.1"); w.Code != http.StatusCreated {
+		t.Errorf("Expected application/* to be acceptable, got %d", w.Code)
+	}
+
+	if w = serve("/bad"); w.Code != http.StatusInternalServerError {
+		t.Errorf("Expected an unencodable payload to be a 500, got %d", w.Code)
+	}
+
+	w = serve("/error")
+	var err_resp errorResponse
+	if err := json.NewDecoder(w.Body).Decode(&err_resp); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusNotFound || err_resp.Error.Code != "not_found" || err_resp.Meta == nil || err_resp.Meta.CodeVersion != "v1.2.3" {
+		t.Errorf("Unexpected response %d: %+v", w.Code, err_resp)
+	}
+}
@@ -0,0 +1,200 @@
+package app_context
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/comstud/go-rollbar/rollbar"
+)
+
+// rollbarPayload is what the environment says about the contents and
+// volume of rollbar notifications
+type rollbarPayload struct {
+	scrub       map[string]bool
+	maxItems    int
+	personField string
+
+	lock   sync.Mutex
+	window time.Time
+	sent   int
+}
+
+// scrubbed returns whether values named name are withheld from rollbar.
+// Names are compared case-insensitively.
+func (self *rollbarPayload) scrubbed(name string) bool {
+	if scrubbedHeaders[name] {
+		return true
+	}
+	return self != nil && self.scrub[strings.ToLower(name)]
+}
+
+// scrubCustom replaces scrubbed values in custom, and in any maps nested in
+// it, with "[scrubbed]"
+func (self *rollbarPayload) scrubCustom(custom map[string]interface{}) map[string]interface{} {
+	if self == nil || len(self.scrub) == 0 {
+		return custom
+	}
+	scrubbed := make(map[string]interface{}, len(custom))
+	for k, v := range custom {
+		if self.scrubbed(k) {
+			scrubbed[k] = "[scrubbed]"
+			continue
+		}
+		switch v := v.(type) {
+		case map[string]interface{}:
+			scrubbed[k] = self.scrubCustom(v)
+		case rollbar.CustomInfo:
+			scrubbed[k] = self.scrubCustom(v)
+		default:
+			scrubbed[k] = v
+		}
+	}
+	return scrubbed
+}
+
+// allow counts a notification against ROLLBAR_MAX_ITEMS, returning false
+// when this minute's are used up
+func (self *rollbarPayload) allow(now time.Time) bool {
+	if self == nil || self.maxItems == 0 {
+		return true
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if now.Sub(self.window) >= time.Minute {
+		self.window = now
+		self.sent = 0
+	}
+	if self.sent >= self.maxItems {
+		return false
+	}
+	self.sent++
+	return true
+}
+
+// scrubQuery replaces the values of scrubbed query parameters in raw
+func (self *baseAppContext) scrubQuery(raw string) string {
+	if self.rollbarPayload == nil || len(self.rollbarPayload.scrub) == 0 {
+		return raw
+	}
+	params := strings.Split(raw, "&")
+	for i, param := range params {
+		name := strings.SplitN(param, "=", 2)[0]
+		if unescaped, err := url.QueryUnescape(name); err == nil {
+			name = unescaped
+		}
+		if self.rollbarPayload.scrubbed(name) {
+			params[i] = url.QueryEscape(name) + "=%5Bscrubbed%5D"
+		}
+	}
+	return strings.Join(params, "&")
+}
+
+// person is who ctx's request was for, from the ROLLBAR_PERSON_FIELD
+// propagated field
+func (self *rollbarPayload) person(ctx context.Context) *rollbar.NotifierPerson {
+	if self == nil || self.personField == "" {
+		return nil
+	}
+	if id := FieldFromContext(ctx, self.personField); id != "" {
+		return &rollbar.NotifierPerson{ID: id}
+	}
+	return nil
+}
+
+func (self *rollbarPayload) status() map[string]interface{} {
+	if self == nil {
+		return nil
+	}
+	scrub := make([]string, 0, len(self.scrub))
+	for name := range self.scrub {
+		scrub = append(scrub, name)
+	}
+	sort.Strings(scrub)
+	return map[string]interface{}{
+		"scrub_fields": scrub,
+		"max_items":    self.maxItems,
+		"person_field": self.personField,
+	}
+}
+
+// setRollbarPayloadFromEnv reads the rollbar settings besides the client's
+// own, returning the ROLLBAR_CUSTOM_FIELDS to add to every notification:
+//
+//	ROLLBAR_SCRUB_FIELDS   comma separated names of custom data, header and
+//	                       query parameter values to scrub, on top of the
+//	                       credential headers that always are
+//	ROLLBAR_MAX_ITEMS      most notifications to send a minute, 0 for no
+//	                       limit. Those over it are counted in
+//	                       rollbar.dropped.
+//	ROLLBAR_PERSON_FIELD   propagated field, eg. a user ID, to report as
+//	                       the person affected
+//	ROLLBAR_CUSTOM_FIELDS  key=value,... custom data for every notification
+func (self *baseAppContext) setRollbarPayloadFromEnv() (rollbar.CustomInfo, error) {
+	payload := &rollbarPayload{
+		scrub:       make(map[string]bool),
+		personField: self.getEnv("ROLLBAR_PERSON_FIELD"),
+	}
+	for _, name := range strings.Split(self.getEnv("ROLLBAR_SCRUB_FIELDS"), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			payload.scrub[strings.ToLower(name)] = true
+		}
+	}
+
+	max_items, _, err := self.getIntFromEnv("ROLLBAR_MAX_ITEMS")
+	if err != nil {
+		return nil, err
+	}
+	if max_items < 0 {
+		return nil, errors.New("ROLLBAR_MAX_ITEMS must be >= 0")
+	}
+	payload.maxItems = max_items
+
+	custom := rollbar.CustomInfo{}
+	for _, kv := range strings.Split(self.getEnv("ROLLBAR_CUSTOM_FIELDS"), ",") {
+		if len(kv) == 0 {
+			continue
+		}
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 || len(parts[0]) == 0 {
+			return nil, fmt.Errorf("ROLLBAR_CUSTOM_FIELDS entry '%s' should be key=value", kv)
+		}
+		custom[parts[0]] = parts[1]
+	}
+
+	self.rollbarPayload = payload
+	return custom, nil
+}
+
+// reportAndLog logs err and, when rollbar is enabled, reports it with
+// extra as custom data
+func reportAndLog(ctx context.Context, base *baseAppContext, appctx AppContext, err error, extra map[string]interface{}, req *rollbar.NotifierRequest) {
+	if err == nil {
+		return
+	}
+	appctx.Logger().LogErrorf(ctx, "%s", err)
+	reporter := &errorReporter{base: base, appctx: appctx}
+	reporter.report(ctx, err, extra, req)
+}
+
+// ReportError logs err and reports it to rollbar, if enabled, with extra
+// as custom data
+func (self *baseAppContext) ReportError(err error, extra map[string]interface{}) {
+	reportAndLog(context.Background(), self, self, err, extra, nil)
+}
+
+func (self *childAppContext) ReportError(err error, extra map[string]interface{}) {
+	reportAndLog(context.Background(), self.baseAppContext, self, err, extra, nil)
+}
+
+// ReportError for a request includes the request and, with
+// ROLLBAR_PERSON_FIELD, who made it
+func (self *requestAppContext) ReportError(err error, extra map[string]interface{}) {
+	reportAndLog(self.ctx, self.baseAppContext, self, err, extra, self.notifierRequest(self.request))
+}
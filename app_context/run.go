@@ -0,0 +1,57 @@
+package app_context
+
+import (
+	"context"
+	"fmt"
+	"os"
+)
+
+type RunFunc func(AppContext) error
+
+func hasArg(args []string, arg string) bool {
+	for _, a := range args {
+		if a == arg {
+			return true
+		}
+	}
+	return false
+}
+
+// Run creates the app context, runs fn with it and closes it, returning a
+// process exit code. Usage:
+//
+//	os.Exit(app_context.Run("myapp", os.Args[1:], serve))
+//
+// If args contains --selftest, SelfTest is run instead of fn. A panic in fn
+// is saved as a crash report by HandleCrash. --preflight only checks that
+// the configured dependencies can be reached, printing a JSON report on
+// stdout, without creating the app context.
+func Run(app_name string, args []string, fn RunFunc, opts ...Option) int {
+	if hasArg(args, "--preflight") {
+		return runPreflight(app_name, os.Stdout, opts...)
+	}
+
+	appctx, err := NewAppContext(app_name, opts...)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error creating app context: %s\n", err)
+		return 1
+	}
+
+	defer appctx.Close()
+	defer appctx.HandleCrash()
+
+	if hasArg(args, "--selftest") {
+		if err := appctx.SelfTest(context.Background()); err != nil {
+			appctx.Logger().LogError(context.Background(), err)
+			return 1
+		}
+		return 0
+	}
+
+	if err := fn(appctx); err != nil {
+		appctx.Logger().LogError(context.Background(), err)
+		return 1
+	}
+
+	return 0
+}
@@ -0,0 +1,241 @@
+package app_context
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/comstud/go-rollbar/rollbar"
+)
+
+type SagaFunc func(ctx context.Context) error
+
+// Saga runs steps in order. If one fails, the compensations of the steps
+// that completed are run in reverse order to undo them. When a database is
+// configured, each run's progress is kept in the saga_runs table, so runs
+// left "running" or "compensation_failed" can be found and fixed up.
+//
+// Steps should be idempotent where they can: SagaIDFromContext gives a key
+// that's the same for every step of a run.
+type Saga struct {
+	appctx *baseAppContext
+	name   string
+	steps  []*sagaStep
+}
+
+type sagaStep struct {
+	name       string
+	do         SagaFunc
+	compensate SagaFunc
+}
+
+// SagaError is returned by Execute when a step fails. CompensationErrors
+// holds the errors of compensations that failed too, keyed by step name.
+type SagaError struct {
+	Saga               string
+	ID                 string
+	Step               string
+	Err                error
+	CompensationErrors map[string]error
+}
+
+func (self *SagaError) Error() string {
+	msg := fmt.Sprintf("Saga '%s' failed at step '%s': %s", self.Saga, self.Step, self.Err)
+	if len(self.CompensationErrors) > 0 {
+		failed := make([]string, 0, len(self.CompensationErrors))
+		for step, err := range self.CompensationErrors {
+			failed = append(failed, fmt.Sprintf("%s: %s", step, err))
+		}
+		msg += fmt.Sprintf(" (compensation failed for %s)", strings.Join(failed, ", "))
+	}
+	return msg
+}
+
+// Step adds a step. compensate may be nil for steps with nothing to undo.
+func (self *Saga) Step(name string, do SagaFunc, compensate SagaFunc) *Saga {
+	self.steps = append(self.steps, &sagaStep{name: name, do: do, compensate: compensate})
+	return self
+}
+
+type sagaIDKey struct{}
+
+func SagaIDFromContext(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	id, _ := ctx.Value(sagaIDKey{}).(string)
+	return id
+}
+
+type sagaRun struct {
+	ID        string
+	Name      string
+	Status    string
+	Step      string
+	Completed int
+	Error     string
+}
+
+type sagaStore interface {
+	save(ctx context.Context, run *sagaRun) error
+}
+
+// pgSagaStore keeps runs in the saga_runs table, created on first use.
+// Nothing is kept without a database.
+type pgSagaStore struct {
+	appctx *baseAppContext
+	lock   sync.Mutex
+	ready  bool
+}
+
+func (self *pgSagaStore) save(ctx context.Context, run *sagaRun) error {
+	db := self.appctx.DBWrite()
+	if db == nil {
+		return nil
+	}
+
+	self.lock.Lock()
+	if !self.ready {
+		if _, err := db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS saga_runs (
+			id text NOT NULL PRIMARY KEY,
+			name text NOT NULL,
+			status text NOT NULL,
+			step text NOT NULL,
+			completed integer NOT NULL,
+			error text,
+			started_at timestamptz NOT NULL DEFAULT now(),
+			updated_at timestamptz NOT NULL DEFAULT now()
+		)`); err != nil {
+			self.lock.Unlock()
+			return fmt.Errorf("Error creating saga_runs: %s", err)
+		}
+		self.ready = true
+	}
+	self.lock.Unlock()
+
+	var err_str sql.NullString
+	if run.Error != "" {
+		err_str = sql.NullString{String: run.Error, Valid: true}
+	}
+	_, err := db.ExecContext(
+		ctx,
+		`INSERT INTO saga_runs (id, name, status, step, completed, error) VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (id) DO UPDATE SET status = $3, step = $4, completed = $5, error = $6, updated_at = now()`,
+		run.ID, run.Name, run.Status, run.Step, run.Completed, err_str,
+	)
+	return err
+}
+
+// save records progress. Failing to doesn't stop the saga, which would
+// leave it half done.
+func (self *Saga) save(ctx context.Context, run *sagaRun) {
+	if err := self.appctx.sagas.save(ctx, run); err != nil {
+		self.appctx.Logger().LogErrorf(ctx, "Error saving progress of saga '%s' (%s): %s", self.name, run.ID, err)
+	}
+}
+
+func (self *Saga) call(ctx context.Context, step *sagaStep, fn SagaFunc, what string) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("Saga '%s' %s '%s' panicked: %v", self.name, what, step.name, r)
+		}
+	}()
+	return fn(ctx)
+}
+
+// Execute runs the steps, compensating if one fails. The error is a
+// *SagaError if a step failed.
+func (self *Saga) Execute(ctx context.Context) error {
+	if len(self.steps) == 0 {
+		return errors.New("Saga has no steps")
+	}
+
+	run := &sagaRun{ID: self.appctx.IDGenerator().NewID(), Name: self.name, Status: "running"}
+	ctx = context.WithValue(ctx, sagaIDKey{}, run.ID)
+	mcli := self.appctx.MetricsClient()
+
+	var failed *SagaError
+	for i, step := range self.steps {
+		run.Step = step.name
+		self.save(ctx, run)
+
+		start := time.Now()
+		err := self.call(ctx, step, step.do, "step")
+		result := "success"
+		if err != nil {
+			result = "failure"
+		}
+		mcli.TimingMS(
+			"saga.step_duration_ms",
+			float64(time.Since(start))/float64(time.Millisecond),
+			1.0,
+			map[string]string{"saga": self.name, "step": step.name, "result": result},
+		)
+
+		if err != nil {
+			failed = &SagaError{Saga: self.name, ID: run.ID, Step: step.name, Err: err}
+			break
+		}
+		run.Completed = i + 1
+	}
+
+	if failed == nil {
+		run.Status = "completed"
+		self.save(ctx, run)
+		mcli.Incr("saga.runs", 1.0, map[string]string{"saga": self.name, "result": run.Status})
+		return nil
+	}
+
+	self.appctx.Logger().LogWarnf(ctx, "%s, compensating %d step(s)", failed, run.Completed)
+	run.Status = "compensating"
+	run.Error = failed.Err.Error()
+	self.save(ctx, run)
+
+	for i := run.Completed - 1; i >= 0; i-- {
+		step := self.steps[i]
+		if step.compensate == nil {
+			continue
+		}
+		run.Step = step.name
+		err := self.call(ctx, step, step.compensate, "compensation for")
+		result := "success"
+		if err != nil {
+			result = "failure"
+			if failed.CompensationErrors == nil {
+				failed.CompensationErrors = make(map[string]error)
+			}
+			failed.CompensationErrors[step.name] = err
+		}
+		mcli.Incr(
+			"saga.compensations",
+			1.0,
+			map[string]string{"saga": self.name, "step": step.name, "result": result},
+		)
+	}
+
+	run.Status = "compensated"
+	if len(failed.CompensationErrors) > 0 {
+		// Someone has to clean this one up by hand
+		run.Status = "compensation_failed"
+		run.Error = failed.Error()
+		self.appctx.Logger().LogErrorf(ctx, "%s", failed)
+		self.appctx.reportError(failed, rollbar.CustomInfo{
+			"saga":    self.name,
+			"saga_id": run.ID,
+			"step":    failed.Step,
+		})
+	}
+	self.save(ctx, run)
+	mcli.Incr("saga.runs", 1.0, map[string]string{"saga": self.name, "result": run.Status})
+
+	return failed
+}
+
+// Saga starts defining a saga. name tags its metrics and saved runs.
+func (self *baseAppContext) Saga(name string) *Saga {
+	return &Saga{appctx: self, name: name}
+}
@@ -0,0 +1,107 @@
+package app_context
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"testing"
+)
+
+type memSagaStore struct {
+	lock  sync.Mutex
+	saves []sagaRun
+}
+
+func (self *memSagaStore) save(ctx context.Context, run *sagaRun) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.saves = append(self.saves, *run)
+	return nil
+}
+
+func (self *memSagaStore) last() sagaRun {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.saves[len(self.saves)-1]
+}
+
+func TestSaga(t *testing.T) {
+	app_ctx, err := NewAppContext("saga_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer app_ctx.Close()
+
+	store := &memSagaStore{}
+	app_ctx.(*baseAppContext).sagas = store
+	mcli := newCountingMetricsClient()
+	app_ctx.SetMetricsClient(mcli)
+
+	var calls []string
+	var ids []string
+	step := func(name string, err error) SagaFunc {
+		return func(ctx context.Context) error {
+			calls = append(calls, name)
+			ids = append(ids, SagaIDFromContext(ctx))
+			return err
+		}
+	}
+
+	err = app_ctx.Saga("order").
+		Step("reserve", step("reserve", nil), step("release", nil)).
+		Step("charge", step("charge", nil), step("refund", nil)).
+		Execute(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(calls) != 2 || ids[0] == "" || ids[0] != ids[1] {
+		t.Errorf("Unexpected calls: %v, ids %v", calls, ids)
+	}
+	if run := store.last(); run.Status != "completed" || run.Completed != 2 || run.ID != ids[0] {
+		t.Errorf("Unexpected saved run: %+v", run)
+	}
+
+	// ship fails: charge and reserve are undone in reverse
+	calls = nil
+	err = app_ctx.Saga("order").
+		Step("reserve", step("reserve", nil), step("release", nil)).
+		Step("notify", step("notify", nil), nil).
+		Step("charge", step("charge", nil), step("refund", nil)).
+		Step("ship", step("ship", errors.New("No stock")), step("unship", nil)).
+		Execute(context.Background())
+	saga_err, ok := err.(*SagaError)
+	if !ok || saga_err.Step != "ship" || saga_err.Err.Error() != "No stock" {
+		t.Fatalf("Expected a SagaError for ship, got %v", err)
+	}
+	expected := []string{"reserve", "notify", "charge", "ship", "refund", "release"}
+	if len(calls) != len(expected) {
+		t.Fatalf("Unexpected calls: %v", calls)
+	}
+	for i, call := range expected {
+		if calls[i] != call {
+			t.Errorf("Call %d was %s, expected %s", i, calls[i], call)
+		}
+	}
+	if run := store.last(); run.Status != "compensated" || run.Completed != 3 || run.Error != "No stock" {
+		t.Errorf("Unexpected saved run: %+v", run)
+	}
+	if c := mcli.count("saga.compensations"); c != 2 {
+		t.Errorf("Expected 2 saga.compensations, got %d", c)
+	}
+
+	err = app_ctx.Saga("order").
+		Step("reserve", step("reserve", nil), step("release", errors.New("Gone"))).
+		Step("charge", func(ctx context.Context) error { panic("boom") }, nil).
+		Execute(context.Background())
+	saga_err, ok = err.(*SagaError)
+	if !ok || saga_err.CompensationErrors["reserve"] == nil {
+		t.Fatalf("Expected a failed compensation, got %v", err)
+	}
+	if run := store.last(); run.Status != "compensation_failed" {
+		t.Errorf("Unexpected saved run: %+v", run)
+	}
+	if c := mcli.count("saga.runs"); c != 3 {
+		t.Errorf("Expected 3 saga.runs, got %d", c)
+	}
+}
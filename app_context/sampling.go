@@ -0,0 +1,283 @@
+package app_context
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FieldTransform anonymizes a field's value. row is the whole row as read,
+// for transforms that need other fields.
+type FieldTransform func(value interface{}, row map[string]interface{}) (interface{}, error)
+
+// SampleSpec is how a registered dataset is sampled. Only the fields named
+// in Keep or Transforms are written, so a field added to the dataset later
+// doesn't leak into samples until it's been looked at.
+type SampleSpec struct {
+	Dataset string
+	// Rate is the fraction of rows kept, default all of them
+	Rate float64
+	// Limit is the most rows kept, 0 for no limit
+	Limit int
+	// Keep are fields copied as they are
+	Keep       []string
+	Transforms map[string]FieldTransform
+	// Format defaults to jsonl
+	Format DataFormat
+	// Schedule, a duration like 24h or a cron expression, runs the sample
+	// as a scheduler job named sample:<dataset> on the leader only
+	Schedule string
+}
+
+// DataSampler writes anonymized samples of datasets to the object store,
+// under DATA_SAMPLE_PREFIX<dataset>/<transfer id>.<format>, for loading
+// into staging. Samples are DataTransfers of kind "sample".
+type DataSampler interface {
+	Register(spec SampleSpec) error
+	Sample(ctx context.Context, dataset string) (*DataTransfer, error)
+	// AnonymizeHash replaces values with a pseudonym: a keyed hash that's
+	// the same wherever the value appears, so it can still be joined on
+	AnonymizeHash() FieldTransform
+	// AnonymizeEmail replaces addresses with a pseudonym at example.com
+	AnonymizeEmail() FieldTransform
+}
+
+// AnonymizeRedact replaces values with "REDACTED"
+func AnonymizeRedact() FieldTransform {
+	return func(value interface{}, row map[string]interface{}) (interface{}, error) {
+		if value == nil {
+			return nil, nil
+		}
+		return "REDACTED", nil
+	}
+}
+
+// AnonymizeNull drops values
+func AnonymizeNull() FieldTransform {
+	return func(value interface{}, row map[string]interface{}) (interface{}, error) {
+		return nil, nil
+	}
+}
+
+// AnonymizeTruncateTime keeps times to the precision of d, eg. 24h for a
+// date of birth
+func AnonymizeTruncateTime(d time.Duration) FieldTransform {
+	return func(value interface{}, row map[string]interface{}) (interface{}, error) {
+		t, ok := value.(time.Time)
+		if !ok {
+			return value, nil
+		}
+		return t.UTC().Truncate(d), nil
+	}
+}
+
+type dataSample struct {
+	spec   SampleSpec
+	fields []DatasetField
+}
+
+type dataSampler struct {
+	appctx *baseAppContext
+	prefix string
+	secret []byte
+
+	lock    sync.Mutex
+	samples map[string]*dataSample
+}
+
+func newDataSampler(appctx *baseAppContext) *dataSampler {
+	return &dataSampler{
+		appctx:  appctx,
+		prefix:  "samples/",
+		samples: make(map[string]*dataSample),
+	}
+}
+
+// pseudonym is the same for the same value in every sample made with the
+// same DATA_SAMPLE_SECRET, so joins between samples still work
+func (self *dataSampler) pseudonym(value interface{}) string {
+	mac := hmac.New(sha256.New, self.secret)
+	fmt.Fprint(mac, exportValue(value))
+	return hex.EncodeToString(mac.Sum(nil))[:16]
+}
+
+func (self *dataSampler) AnonymizeHash() FieldTransform {
+	return func(value interface{}, row map[string]interface{}) (interface{}, error) {
+		if value == nil {
+			return nil, nil
+		}
+		return self.pseudonym(value), nil
+	}
+}
+
+func (self *dataSampler) AnonymizeEmail() FieldTransform {
+	return func(value interface{}, row map[string]interface{}) (interface{}, error) {
+		if value == nil {
+			return nil, nil
+		}
+		return self.pseudonym(strings.ToLower(fmt.Sprint(exportValue(value)))) + "@example.com", nil
+	}
+}
+
+func (self *dataSampler) Register(spec SampleSpec) error {
+	ds, err := self.appctx.datasets.dataset(spec.Dataset)
+	if err != nil {
+		return fmt.Errorf("Can't sample '%s': %s", spec.Dataset, err)
+	}
+	if spec.Rate < 0 || spec.Rate > 1 {
+		return fmt.Errorf("Sample rate for '%s' must be between 0 and 1", spec.Dataset)
+	}
+	if spec.Rate == 0 {
+		spec.Rate = 1
+	}
+	if spec.Format == "" {
+		spec.Format = DataFormatJSONL
+	}
+	if err := checkDataFormat(spec.Format); err != nil {
+		return err
+	}
+
+	// The dataset's fields that are kept or transformed, in its order
+	wanted := make(map[string]bool)
+	for _, name := range spec.Keep {
+		wanted[name] = true
+	}
+	for name := range spec.Transforms {
+		if wanted[name] {
+			return fmt.Errorf("Sample of '%s' both keeps and transforms '%s'", spec.Dataset, name)
+		}
+		wanted[name] = true
+	}
+	sample := &dataSample{spec: spec}
+	for _, field := range ds.Fields {
+		if wanted[field.Name] {
+			sample.fields = append(sample.fields, field)
+			delete(wanted, field.Name)
+		}
+	}
+	if len(wanted) > 0 {
+		missing := make([]string, 0, len(wanted))
+		for name := range wanted {
+			missing = append(missing, name)
+		}
+		sort.Strings(missing)
+		return fmt.Errorf("Dataset '%s' has no fields %s", spec.Dataset, strings.Join(missing, ", "))
+	}
+
+	self.lock.Lock()
+	if _, ok := self.samples[spec.Dataset]; ok {
+		self.lock.Unlock()
+		return fmt.Errorf("A sample of '%s' is already registered", spec.Dataset)
+	}
+	self.samples[spec.Dataset] = sample
+	self.lock.Unlock()
+
+	if spec.Schedule == "" {
+		return nil
+	}
+	job := func(ctx context.Context) error {
+		if !self.appctx.LeaderElection().IsLeader() {
+			return nil
+		}
+		_, err := self.Sample(ctx, spec.Dataset)
+		return err
+	}
+	sched := self.appctx.Scheduler()
+	if interval, perr := time.ParseDuration(spec.Schedule); perr == nil {
+		err = sched.Every("sample:"+spec.Dataset, interval, job)
+	} else {
+		err = sched.Cron("sample:"+spec.Dataset, spec.Schedule, job)
+	}
+	if err != nil {
+		self.lock.Lock()
+		delete(self.samples, spec.Dataset)
+		self.lock.Unlock()
+		return fmt.Errorf("Error scheduling samples of '%s': %s", spec.Dataset, err)
+	}
+	return nil
+}
+
+func (self *dataSampler) Sample(ctx context.Context, dataset string) (*DataTransfer, error) {
+	self.lock.Lock()
+	sample, ok := self.samples[dataset]
+	self.lock.Unlock()
+	if !ok {
+		return nil, ErrUnknownDataset
+	}
+	ds, err := self.appctx.datasets.dataset(dataset)
+	if err != nil {
+		return nil, err
+	}
+
+	spec := sample.spec
+	random := self.appctx.Rand()
+	kept := 0
+	filter := func(row map[string]interface{}) (map[string]interface{}, error) {
+		if spec.Limit > 0 && kept >= spec.Limit {
+			return nil, errEnoughRows
+		}
+		if spec.Rate < 1 && random.Float64() >= spec.Rate {
+			return nil, nil
+		}
+		out := make(map[string]interface{}, len(sample.fields))
+		for _, name := range spec.Keep {
+			out[name] = row[name]
+		}
+		for name, transform := range spec.Transforms {
+			value, err := transform(row[name], row)
+			if err != nil {
+				return nil, fmt.Errorf("Error anonymizing '%s': %s", name, err)
+			}
+			out[name] = value
+		}
+		kept++
+		return out, nil
+	}
+	return self.appctx.datasets.export(ctx, "sample", ds, spec.Format, self.prefix, sample.fields, filter)
+}
+
+func (self *dataSampler) status() map[string]interface{} {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	names := make([]string, 0, len(self.samples))
+	for name := range self.samples {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return map[string]interface{}{
+		"datasets": names,
+		"prefix":   self.prefix,
+	}
+}
+
+func (self *baseAppContext) DataSampler() DataSampler {
+	return self.sampler
+}
+
+// DATA_SAMPLE_PREFIX (default samples/) is where in the object store
+// samples go. DATA_SAMPLE_SECRET keys AnonymizeHash and AnonymizeEmail,
+// and should stay the same between runs so samples of different datasets
+// can be joined. Without it a random key is used, and pseudonyms only
+// match within a process.
+func (self *baseAppContext) setDataSamplerFromEnv() error {
+	if prefix, found := self.lookupEnv("DATA_SAMPLE_PREFIX"); found {
+		self.sampler.prefix = prefix
+	}
+	if secret := self.getEnv("DATA_SAMPLE_SECRET"); secret != "" {
+		self.sampler.secret = []byte(secret)
+		return nil
+	}
+	self.sampler.secret = make([]byte, 32)
+	if _, err := rand.Read(self.sampler.secret); err != nil {
+		return errors.New("Couldn't generate a sample secret")
+	}
+	return nil
+}
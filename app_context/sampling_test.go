@@ -0,0 +1,108 @@
+package app_context
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestDataSampler(t *testing.T) {
+	os.Setenv("DATA_SAMPLE_SECRET", "sample-secret")
+	defer os.Unsetenv("DATA_SAMPLE_SECRET")
+
+	app_ctx, err := NewAppContext("sampling_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer app_ctx.Close()
+
+	store := &fileObjectStore{root: t.TempDir()}
+	app_ctx.SetObjectStore(store)
+	db, err := app_ctx.(*baseAppContext).openDB("appctx_fake", "", "primary")
+	if err != nil {
+		t.Fatal(err)
+	}
+	app_ctx.SetDB(db)
+	defer app_ctx.SetDB(nil)
+
+	fakeQueryHook = func(query string, args []driver.Value) [][]driver.Value {
+		if query != "SELECT id, email, phone FROM users" {
+			return nil
+		}
+		return [][]driver.Value{
+			{int64(1), []byte("Ada@Example.org"), []byte("555-0100")},
+			{int64(2), []byte("grace@example.org"), []byte("555-0101")},
+			{int64(3), []byte("alan@example.org"), nil},
+		}
+	}
+	defer func() { fakeQueryHook = nil }()
+
+	err = app_ctx.Datasets().Register(Dataset{
+		Name: "users",
+		Fields: []DatasetField{
+			{Name: "n", Type: "integer"},
+			{Name: "n1", Type: "string"},
+			{Name: "n2", Type: "string"},
+		},
+		Query: "SELECT id, email, phone FROM users",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sampler := app_ctx.DataSampler()
+	if err := sampler.Register(SampleSpec{Dataset: "users", Keep: []string{"n", "ssn"}}); err == nil {
+		t.Error("Expected a field the dataset doesn't have to be refused")
+	}
+	err = sampler.Register(SampleSpec{
+		Dataset:    "users",
+		Limit:      2,
+		Keep:       []string{"n"},
+		Transforms: map[string]FieldTransform{"n1": sampler.AnonymizeEmail()},
+		Schedule:   "24h",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	jobs := app_ctx.Scheduler().Jobs()
+	if len(jobs) != 1 || jobs[0].Name != "sample:users" {
+		t.Errorf("Expected a scheduled sample, got %+v", jobs)
+	}
+
+	transfer, err := sampler.Sample(context.Background(), "users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if transfer.Kind != "sample" || transfer.Rows != 2 || !strings.HasPrefix(transfer.Key, "samples/users/") {
+		t.Errorf("Unexpected transfer: %+v", transfer)
+	}
+
+	body, err := store.Get(context.Background(), transfer.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadAll(body)
+	body.Close()
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected the limit to be kept to, got %q", data)
+	}
+	var row map[string]interface{}
+	json.Unmarshal([]byte(lines[0]), &row)
+	if _, ok := row["n2"]; ok || row["n"] != float64(1) {
+		t.Errorf("Expected only kept and transformed fields, got %v", row)
+	}
+	email, _ := row["n1"].(string)
+	if !strings.HasSuffix(email, "@example.com") || strings.Contains(email, "ada") {
+		t.Errorf("Expected an anonymized address, got %q", email)
+	}
+	// The same address gets the same pseudonym
+	if again, _ := sampler.AnonymizeEmail()("ada@example.org", nil); again != email {
+		t.Errorf("Expected %q, got %q", email, again)
+	}
+}
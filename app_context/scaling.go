@@ -0,0 +1,279 @@
+package app_context
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// KafkaLagReporter is implemented by KafkaConsumerGroups that can report
+// how far behind the group is, in messages, by topic. ScalingSignals
+// exports it as kafka.lag.
+type KafkaLagReporter interface {
+	Lag(ctx context.Context) (map[string]int64, error)
+}
+
+// SignalFunc measures work waiting to be done, eg. the length of a queue
+type SignalFunc func(ctx context.Context) (float64, error)
+
+// ScalingSignals are measures of queued work, for autoscaling on backlog
+// rather than CPU. Every SCALING_SIGNALS_INTERVAL each is sent as the
+// scaling.signal gauge, tagged with its name, and /scaling on the admin
+// port serves them for KEDA's metrics-api scaler:
+//
+//	GET /scaling                     {"signals": {"name": value, ...}, "collected_at": ...}
+//	GET /scaling?signal=kafka.lag    {"signal": "kafka.lag", "value": 1200}
+//
+// Built in signals, when what they measure is configured:
+//
+//	scheduler.tasks_due              one-shot tasks that are due and unclaimed
+//	scheduler.tasks_due_age_seconds  how long the oldest of them has been due
+//	cdc.slot_lag_bytes               WAL REPLICATION_SLOT hasn't consumed
+//	kafka.lag, kafka.lag.<topic>     with a KafkaLagReporter consumer group
+type ScalingSignals interface {
+	Register(name string, fn SignalFunc)
+	// Collect measures every signal now
+	Collect(ctx context.Context) map[string]float64
+}
+
+// signalSource is one or more signals. It returns nil when what it measures
+// isn't configured.
+type signalSource func(ctx context.Context) (map[string]float64, error)
+
+type scalingSignals struct {
+	appctx   *baseAppContext
+	interval time.Duration
+
+	lock        sync.Mutex
+	sources     map[string]signalSource
+	values      map[string]float64
+	collectedAt time.Time
+	collectLock sync.Mutex
+	stopChan    chan struct{}
+	doneChan    chan struct{}
+}
+
+func newScalingSignals(appctx *baseAppContext) *scalingSignals {
+	self := &scalingSignals{
+		appctx:   appctx,
+		interval: 15 * time.Second,
+		sources:  make(map[string]signalSource),
+	}
+	self.sources["builtin.scheduler"] = self.taskSignals
+	self.sources["builtin.cdc"] = self.cdcSignals
+	self.sources["builtin.kafka"] = self.kafkaSignals
+	return self
+}
+
+func (self *scalingSignals) Register(name string, fn SignalFunc) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.sources[name] = func(ctx context.Context) (map[string]float64, error) {
+		value, err := fn(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]float64{name: value}, nil
+	}
+}
+
+func (self *scalingSignals) taskSignals(ctx context.Context) (map[string]float64, error) {
+	sched := self.appctx.scheduler
+	if sched == nil {
+		return nil, nil
+	}
+	if _, ok := sched.tasks.(*pgTaskStore); ok && self.appctx.DBWrite() == nil {
+		return nil, nil
+	}
+	now := self.appctx.Clock().Now()
+	count, oldest, err := sched.tasks.backlog(ctx, now)
+	if err != nil {
+		return nil, err
+	}
+	age := 0.0
+	if count > 0 {
+		age = now.Sub(oldest).Seconds()
+	}
+	return map[string]float64{
+		"scheduler.tasks_due":             float64(count),
+		"scheduler.tasks_due_age_seconds": age,
+	}, nil
+}
+
+func (self *scalingSignals) cdcSignals(ctx context.Context) (map[string]float64, error) {
+	cdc := self.appctx.cdc
+	if cdc == nil || cdc.source != "postgres" {
+		return nil, nil
+	}
+	db := self.appctx.DBWrite()
+	if db == nil {
+		return nil, errors.New("CDC_SOURCE=postgres needs a database")
+	}
+	var lag float64
+	err := db.QueryRowContext(
+		ctx,
+		"SELECT COALESCE(pg_wal_lsn_diff(pg_current_wal_lsn(), confirmed_flush_lsn), 0) FROM pg_replication_slots WHERE slot_name = $1",
+		cdc.slot,
+	).Scan(&lag)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]float64{"cdc.slot_lag_bytes": lag}, nil
+}
+
+func (self *scalingSignals) kafkaSignals(ctx context.Context) (map[string]float64, error) {
+	if !self.appctx.kafkaEnabled {
+		return nil, nil
+	}
+	reporter, ok := self.appctx.kafkaConsumerGroup.(KafkaLagReporter)
+	if !ok {
+		return nil, nil
+	}
+	lags, err := reporter.Lag(ctx)
+	if err != nil {
+		return nil, err
+	}
+	values := map[string]float64{"kafka.lag": 0}
+	for topic, lag := range lags {
+		values["kafka.lag."+topic] = float64(lag)
+		values["kafka.lag"] += float64(lag)
+	}
+	return values, nil
+}
+
+func (self *scalingSignals) Collect(ctx context.Context) map[string]float64 {
+	self.collectLock.Lock()
+	defer self.collectLock.Unlock()
+
+	self.lock.Lock()
+	names := make([]string, 0, len(self.sources))
+	sources := make([]signalSource, 0, len(self.sources))
+	for name, source := range self.sources {
+		names = append(names, name)
+		sources = append(sources, source)
+	}
+	self.lock.Unlock()
+
+	mcli := self.appctx.MetricsClient()
+	values := make(map[string]float64)
+	for i, source := range sources {
+		found, err := source(ctx)
+		if err != nil {
+			mcli.Incr("scaling.signal_errors", 1.0, map[string]string{"source": names[i]})
+			self.appctx.Logger().LogWarnf(ctx, "Error measuring scaling signal '%s': %s", names[i], err)
+			continue
+		}
+		for name, value := range found {
+			values[name] = value
+		}
+	}
+
+	self.lock.Lock()
+	self.values = values
+	self.collectedAt = self.appctx.now()
+	self.lock.Unlock()
+	return values
+}
+
+// latest is the last collected values if they're fresher than interval,
+// otherwise newly collected ones
+func (self *scalingSignals) latest(ctx context.Context) (map[string]float64, time.Time) {
+	self.lock.Lock()
+	values, at := self.values, self.collectedAt
+	self.lock.Unlock()
+	if values != nil && self.interval > 0 && self.appctx.now().Sub(at) < self.interval {
+		return values, at
+	}
+	values = self.Collect(ctx)
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return values, self.collectedAt
+}
+
+func (self *scalingSignals) send() {
+	ctx, cancel := context.WithTimeout(context.Background(), self.interval)
+	defer cancel()
+
+	mcli := self.appctx.MetricsClient()
+	for name, value := range self.Collect(ctx) {
+		mcli.Gauge("scaling.signal", value, 1.0, map[string]string{"signal": name})
+	}
+}
+
+func (self *scalingSignals) start() {
+	stop_chan, done_chan := make(chan struct{}), make(chan struct{})
+	self.stopChan, self.doneChan = stop_chan, done_chan
+	// Real time, like the lifecycle heartbeats
+	ticker := NewRealClock().NewTicker(self.interval)
+	goLabeled("scaling_signals", func() {
+		defer close(done_chan)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop_chan:
+				return
+			case <-ticker.C():
+				self.send()
+			}
+		}
+	})
+}
+
+func (self *scalingSignals) stop() {
+	if self.stopChan != nil {
+		close(self.stopChan)
+		<-self.doneChan
+		self.stopChan = nil
+	}
+}
+
+func (self *scalingSignals) handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		values, at := self.latest(r.Context())
+		if name := r.URL.Query().Get("signal"); name != "" {
+			value, ok := values[name]
+			if !ok {
+				writeAdminError(w, http.StatusNotFound, "No such signal: "+name)
+				return
+			}
+			writeAdminJSON(w, http.StatusOK, map[string]interface{}{"signal": name, "value": value})
+			return
+		}
+		writeAdminJSON(w, http.StatusOK, map[string]interface{}{"signals": values, "collected_at": at})
+	})
+}
+
+func (self *scalingSignals) status() map[string]interface{} {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	names := make([]string, 0, len(self.values))
+	for name := range self.values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return map[string]interface{}{
+		"interval": self.interval.String(),
+		"signals":  names,
+	}
+}
+
+func (self *baseAppContext) ScalingSignals() ScalingSignals {
+	return self.scaling
+}
+
+// SCALING_SIGNALS_INTERVAL (default 15s) is how often scaling signals are
+// sent as metrics; 0 only measures them when /scaling is asked.
+func (self *baseAppContext) setScalingSignalsFromEnv() error {
+	if interval, found, err := self.getDurationFromEnv("SCALING_SIGNALS_INTERVAL"); err != nil {
+		return err
+	} else if found {
+		self.scaling.interval = interval
+	}
+	if self.scaling.interval > 0 && !self.lambda {
+		self.scaling.start()
+	}
+	return nil
+}
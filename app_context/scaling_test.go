@@ -0,0 +1,95 @@
+package app_context
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type lagKafkaConsumerGroup struct {
+	testKafkaConsumerGroup
+}
+
+func (self *lagKafkaConsumerGroup) Lag(ctx context.Context) (map[string]int64, error) {
+	return map[string]int64{"orders": 30, "payments": 12}, nil
+}
+
+func TestScalingSignals(t *testing.T) {
+	store := &memTaskStore{tasks: make(map[string]*memTask)}
+	app_ctx := newTaskTestContext(store)
+	defer app_ctx.Close()
+
+	base := app_ctx.(*baseAppContext)
+	base.kafkaEnabled = true
+	base.kafkaConsumerGroup = &lagKafkaConsumerGroup{}
+
+	mcli := newCountingMetricsClient()
+	app_ctx.SetMetricsClient(mcli)
+
+	now := app_ctx.Clock().Now()
+	store.add(context.Background(), "reminder:1", now.Add(-time.Minute))
+	store.add(context.Background(), "reminder:2", now.Add(-time.Second))
+	store.add(context.Background(), "reminder:3", now.Add(time.Hour))
+
+	signals := app_ctx.ScalingSignals()
+	signals.Register("imports.pending", func(ctx context.Context) (float64, error) {
+		return 7, nil
+	})
+	signals.Register("exports.pending", func(ctx context.Context) (float64, error) {
+		return 0, errors.New("unreachable")
+	})
+
+	values := signals.Collect(context.Background())
+	if values["scheduler.tasks_due"] != 2 || values["scheduler.tasks_due_age_seconds"] < 60 {
+		t.Errorf("Unexpected task signals: %v", values)
+	}
+	if values["kafka.lag"] != 42 || values["kafka.lag.orders"] != 30 {
+		t.Errorf("Unexpected kafka signals: %v", values)
+	}
+	if values["imports.pending"] != 7 {
+		t.Errorf("Expected the registered signal, got %v", values)
+	}
+	if _, ok := values["exports.pending"]; ok || mcli.count("scaling.signal_errors") != 1 {
+		t.Errorf("Expected the failing signal to be left out and counted, got %v", values)
+	}
+	if _, ok := values["cdc.slot_lag_bytes"]; ok {
+		t.Errorf("Expected no CDC signal without CDC_SOURCE, got %v", values)
+	}
+
+	handler := base.scaling.handler()
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/scaling?signal=kafka.lag", nil))
+	var single struct {
+		Signal string
+		Value  float64
+	}
+	json.NewDecoder(w.Body).Decode(&single)
+	if w.Code != http.StatusOK || single.Value != 42 {
+		t.Errorf("Unexpected signal response: %d %+v", w.Code, single)
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/scaling?signal=missing", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown signal, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/scaling", nil))
+	var all struct {
+		Signals map[string]float64
+	}
+	json.NewDecoder(w.Body).Decode(&all)
+	if len(all.Signals) != len(values) {
+		t.Errorf("Expected every signal, got %v", all.Signals)
+	}
+
+	base.scaling.send()
+	if mcli.count("scaling.signal") == 0 {
+		t.Errorf("Expected the signals to be sent as gauges, got %v", mcli.counts)
+	}
+}
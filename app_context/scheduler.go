@@ -0,0 +1,364 @@
+package app_context
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/comstud/go-rollbar/rollbar"
+)
+
+type JobFunc func(ctx context.Context) error
+
+type JobStatus struct {
+	Name      string
+	Schedule  string
+	Running   bool
+	Runs      int
+	Failures  int
+	LastRun   time.Time
+	NextRun   time.Time
+	LastError string
+}
+
+// Scheduler runs jobs periodically. A run is skipped if the previous one
+// is still going, or while the traffic role is standby.
+type Scheduler interface {
+	// Cron schedules fn using a cron expression, see ParseCron
+	Cron(name, spec string, fn JobFunc) error
+	Every(name string, interval time.Duration, fn JobFunc) error
+	// RunOnceAt adds a one-shot task that's stored in the database so it
+	// survives restarts, and runs once across all instances. A task whose
+	// instance dies running it is run again once SCHEDULER_TASK_LEASE has
+	// passed. Its kind is the part of name before the first ':'
+	// ("reminder:42" is a "reminder"), and fn becomes the handler for
+	// every task of that kind. Adding a task with a name that already
+	// exists, even one that has run, does nothing. Failed tasks aren't
+	// retried.
+	RunOnceAt(name string, at time.Time, fn JobFunc) error
+	RunAfter(name string, delay time.Duration, fn JobFunc) error
+	// HandleTasks sets the handler for one-shot tasks of kind, so tasks
+	// added before a restart run without having to add new ones.
+	HandleTasks(kind string, fn JobFunc)
+	Remove(name string) bool
+	Jobs() []JobStatus
+	// Stop stops scheduling new runs and waits up to
+	// SCHEDULER_SHUTDOWN_TIMEOUT for running jobs to finish.
+	Stop() error
+}
+
+var ErrSchedulerStopped = errors.New("Scheduler has been stopped")
+
+type scheduledJob struct {
+	sched    *scheduler
+	name     string
+	schedule Schedule
+	fn       JobFunc
+	stopChan chan struct{}
+	status   JobStatus
+}
+
+func (self *scheduledJob) tags(result string) map[string]string {
+	return map[string]string{"job": self.name, "result": result}
+}
+
+func (self *scheduledJob) call(ctx context.Context) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("Job '%s' panicked: %v", self.name, r)
+		}
+	}()
+	return self.fn(ctx)
+}
+
+func (self *scheduledJob) run() {
+	defer self.sched.running.Done()
+
+	appctx := self.sched.appctx
+	ctx := self.sched.ctx
+	start := time.Now()
+
+	appctx.Logger().LogDebugf(ctx, "Running job '%s'", self.name)
+
+	err := self.call(ctx)
+	duration := time.Since(start)
+
+	result := "success"
+	if err != nil {
+		result = "failure"
+		appctx.Logger().LogErrorf(ctx, "Job '%s' failed after %s: %s", self.name, duration, err)
+		appctx.reportError(err, rollbar.CustomInfo{"job": self.name})
+	} else {
+		appctx.Logger().LogDebugf(ctx, "Job '%s' finished in %s", self.name, duration)
+	}
+
+	mcli := appctx.MetricsClient()
+	mcli.Incr("scheduler.runs", 1.0, self.tags(result))
+	mcli.TimingMS(
+		"scheduler.run_duration_ms",
+		float64(duration)/float64(time.Millisecond),
+		1.0,
+		self.tags(result),
+	)
+
+	self.sched.lock.Lock()
+	self.status.Running = false
+	if err != nil {
+		self.status.Failures++
+		self.status.LastError = err.Error()
+	}
+	self.sched.lock.Unlock()
+}
+
+func (self *scheduledJob) skip(reason string) {
+	self.sched.appctx.MetricsClient().Incr(
+		"scheduler.skipped",
+		1.0,
+		map[string]string{"job": self.name, "reason": reason},
+	)
+}
+
+// trigger starts a run unless one is already going
+func (self *scheduledJob) trigger() {
+	if self.sched.appctx.TrafficRole() != TrafficRoleActive {
+		self.skip("standby")
+		return
+	}
+	if self.sched.appctx.consumers.Paused(self.name) {
+		self.skip("paused")
+		return
+	}
+
+	self.sched.lock.Lock()
+	if self.sched.ctx.Err() != nil {
+		self.sched.lock.Unlock()
+		return
+	}
+	if self.status.Running {
+		self.sched.lock.Unlock()
+		self.sched.appctx.Logger().LogWarnf(
+			self.sched.ctx,
+			"Skipping job '%s', the previous run is still going",
+			self.name,
+		)
+		self.skip("overlap")
+		return
+	}
+	self.status.Running = true
+	self.status.Runs++
+	self.status.LastRun = self.sched.appctx.Clock().Now()
+	self.sched.running.Add(1)
+	self.sched.lock.Unlock()
+
+	goLabeled("scheduler", self.run, "job", self.name)
+}
+
+func (self *scheduledJob) loop() {
+	for {
+		clock := self.sched.appctx.Clock()
+		next := self.schedule.Next(clock.Now())
+		if next.IsZero() {
+			self.sched.appctx.Logger().LogWarnf(
+				self.sched.ctx,
+				"Job '%s' will never run again",
+				self.name,
+			)
+			return
+		}
+
+		self.sched.lock.Lock()
+		self.status.NextRun = next
+		self.sched.lock.Unlock()
+
+		timer := clock.NewTimer(next.Sub(clock.Now()))
+		select {
+		case <-self.stopChan:
+			timer.Stop()
+			return
+		case <-self.sched.ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C():
+			self.trigger()
+		}
+	}
+}
+
+type scheduler struct {
+	appctx          *baseAppContext
+	lock            sync.Mutex
+	ctx             context.Context
+	cancel          context.CancelFunc
+	jobs            map[string]*scheduledJob
+	running         sync.WaitGroup
+	location        *time.Location
+	shutdownTimeout time.Duration
+
+	tasks            taskStore
+	taskHandlers     map[string]JobFunc
+	taskPollInterval time.Duration
+	taskLease        time.Duration
+	taskPolling      bool
+	taskWake         chan struct{}
+	// taskOwner is what this process claims tasks as
+	taskOwner string
+}
+
+func (self *scheduler) add(name string, schedule Schedule, fn JobFunc) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if self.ctx.Err() != nil {
+		return ErrSchedulerStopped
+	}
+	if _, ok := self.jobs[name]; ok {
+		return fmt.Errorf("Job '%s' is already scheduled", name)
+	}
+
+	job := &scheduledJob{
+		sched:    self,
+		name:     name,
+		schedule: schedule,
+		fn:       fn,
+		stopChan: make(chan struct{}),
+		status:   JobStatus{Name: name, Schedule: schedule.String()},
+	}
+	self.jobs[name] = job
+
+	goLabeled("scheduler", job.loop, "job", name)
+
+	return nil
+}
+
+func (self *scheduler) Cron(name, spec string, fn JobFunc) error {
+	schedule, err := ParseCron(spec, self.location)
+	if err != nil {
+		return err
+	}
+	return self.add(name, schedule, fn)
+}
+
+func (self *scheduler) Every(name string, interval time.Duration, fn JobFunc) error {
+	if interval <= 0 {
+		return errors.New("Interval must be > 0")
+	}
+	return self.add(name, &intervalSchedule{interval: interval}, fn)
+}
+
+// Remove unschedules a job. A run in progress isn't interrupted.
+func (self *scheduler) Remove(name string) bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	job, ok := self.jobs[name]
+	if ok {
+		close(job.stopChan)
+		delete(self.jobs, name)
+	}
+	return ok
+}
+
+func (self *scheduler) Jobs() []JobStatus {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	statuses := make([]JobStatus, 0, len(self.jobs))
+	for _, job := range self.jobs {
+		statuses = append(statuses, job.status)
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Name < statuses[j].Name
+	})
+	return statuses
+}
+
+func (self *scheduler) Stop() error {
+	if self == nil {
+		return nil
+	}
+
+	self.lock.Lock()
+	self.cancel()
+	self.lock.Unlock()
+
+	done := make(chan struct{})
+	goLabeled("scheduler", func() {
+		self.running.Wait()
+		close(done)
+	})
+
+	// Real time, so a stuck job can't hang Close under a fake clock
+	select {
+	case <-done:
+		return nil
+	case <-time.After(self.shutdownTimeout):
+		return fmt.Errorf("Scheduled jobs didn't finish within %s", self.shutdownTimeout)
+	}
+}
+
+func (self *baseAppContext) Scheduler() Scheduler {
+	return self.scheduler
+}
+
+// SCHEDULER_TIMEZONE sets the location cron expressions are evaluated in,
+// the local timezone by default. One-shot tasks are polled for every
+// SCHEDULER_TASK_POLL_INTERVAL (default 10s), and leased for
+// SCHEDULER_TASK_LEASE (default 5m) while they run.
+func (self *baseAppContext) setSchedulerFromEnv() error {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	sched := &scheduler{
+		appctx:          self,
+		ctx:             ctx,
+		cancel:          cancel,
+		jobs:            make(map[string]*scheduledJob),
+		location:        time.Local,
+		shutdownTimeout: 30 * time.Second,
+
+		tasks:            &pgTaskStore{appctx: self},
+		taskHandlers:     make(map[string]JobFunc),
+		taskPollInterval: 10 * time.Second,
+		taskLease:        5 * time.Minute,
+		taskOwner:        newTaskOwner(self.hostname),
+		taskWake:         make(chan struct{}, 1),
+	}
+
+	self.scheduler = sched
+
+	if tz := self.getEnv("SCHEDULER_TIMEZONE"); tz != "" {
+		loc, err := time.LoadLocation(tz)
+		if err != nil {
+			return fmt.Errorf("Invalid SCHEDULER_TIMEZONE: %s", err)
+		}
+		sched.location = loc
+	}
+
+	if timeout, found, err := self.getDurationFromEnv("SCHEDULER_SHUTDOWN_TIMEOUT"); err != nil {
+		return err
+	} else if found {
+		sched.shutdownTimeout = timeout
+	}
+
+	if interval, found, err := self.getDurationFromEnv("SCHEDULER_TASK_POLL_INTERVAL"); err != nil {
+		return err
+	} else if found {
+		if interval <= 0 {
+			return fmt.Errorf("SCHEDULER_TASK_POLL_INTERVAL must be > 0")
+		}
+		sched.taskPollInterval = interval
+	}
+
+	if lease, found, err := self.getDurationFromEnv("SCHEDULER_TASK_LEASE"); err != nil {
+		return err
+	} else if found {
+		if lease <= 0 {
+			return fmt.Errorf("SCHEDULER_TASK_LEASE must be > 0")
+		}
+		sched.taskLease = lease
+	}
+
+	return nil
+}
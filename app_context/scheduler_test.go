@@ -0,0 +1,117 @@
+package app_context
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseCron(t *testing.T) {
+	base := time.Date(2024, time.January, 31, 10, 17, 30, 0, time.UTC)
+
+	tests := []struct {
+		spec string
+		next time.Time
+	}{
+		{"*/15 * * * *", time.Date(2024, time.January, 31, 10, 30, 0, 0, time.UTC)},
+		{"0 * * * *", time.Date(2024, time.January, 31, 11, 0, 0, 0, time.UTC)},
+		{"@daily", time.Date(2024, time.February, 1, 0, 0, 0, 0, time.UTC)},
+		{"30 9 * * mon-fri", time.Date(2024, time.February, 1, 9, 30, 0, 0, time.UTC)},
+		{"0 0 29 feb *", time.Date(2024, time.February, 29, 0, 0, 0, 0, time.UTC)},
+		{"0 12 1 * 0", time.Date(2024, time.February, 1, 12, 0, 0, 0, time.UTC)},
+		{"0 12 * * 7", time.Date(2024, time.February, 4, 12, 0, 0, 0, time.UTC)},
+		{"5,10 10 31 1 *", time.Date(2025, time.January, 31, 10, 5, 0, 0, time.UTC)},
+		{"@every 90s", base.Add(90 * time.Second)},
+	}
+
+	for _, test := range tests {
+		sched, err := ParseCron(test.spec, time.UTC)
+		if err != nil {
+			t.Errorf("Error parsing '%s': %s", test.spec, err)
+			continue
+		}
+		if next := sched.Next(base); !next.Equal(test.next) {
+			t.Errorf("'%s': expected next run %s, got %s", test.spec, test.next, next)
+		}
+	}
+
+	for _, spec := range []string{"* * * *", "60 * * * *", "* * * * 8", "5-1 * * * *", "*/0 * * * *", "@every -1s"} {
+		if _, err := ParseCron(spec, time.UTC); err == nil {
+			t.Errorf("'%s' should fail to parse", spec)
+		}
+	}
+
+	sched, _ := ParseCron("0 0 30 2 *", time.UTC)
+	if next := sched.Next(base); !next.IsZero() {
+		t.Errorf("Impossible schedule should never run, got %s", next)
+	}
+}
+
+func TestSchedulerEvery(t *testing.T) {
+	app_ctx, err := NewAppContext("scheduler_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer app_ctx.Close()
+
+	var runs int32
+	err = app_ctx.Scheduler().Every("tick", 5*time.Millisecond, func(ctx context.Context) error {
+		if atomic.AddInt32(&runs, 1) == 1 {
+			return errors.New("first run fails")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, "job runs", func() bool { return atomic.LoadInt32(&runs) >= 3 })
+
+	jobs := app_ctx.Scheduler().Jobs()
+	if len(jobs) != 1 || jobs[0].Failures != 1 || jobs[0].LastError != "first run fails" {
+		t.Errorf("Unexpected job status: %+v", jobs)
+	}
+
+	if err := app_ctx.Scheduler().Every("tick", time.Second, nil); err == nil {
+		t.Error("Scheduling a duplicate job should fail")
+	}
+
+	if !app_ctx.Scheduler().Remove("tick") {
+		t.Error("Remove should find the job")
+	}
+
+	if err := app_ctx.Scheduler().Stop(); err != nil {
+		t.Errorf("Stop failed: %s", err)
+	}
+
+	if err := app_ctx.Scheduler().Every("late", time.Second, nil); err != ErrSchedulerStopped {
+		t.Errorf("Scheduling after Stop should fail with ErrSchedulerStopped, got %v", err)
+	}
+}
+
+func TestSchedulerSkipsStandby(t *testing.T) {
+	app_ctx, err := NewAppContext("scheduler_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer app_ctx.Close()
+
+	app_ctx.SetTrafficRole(TrafficRoleStandby)
+
+	var runs int32
+	app_ctx.Scheduler().Every("tick", 5*time.Millisecond, func(ctx context.Context) error {
+		atomic.AddInt32(&runs, 1)
+		return nil
+	})
+
+	time.Sleep(30 * time.Millisecond)
+	if n := atomic.LoadInt32(&runs); n != 0 {
+		t.Errorf("Job ran %d times while standby", n)
+	}
+
+	app_ctx.SetTrafficRole(TrafficRoleActive)
+	waitFor(t, "job run", func() bool { return atomic.LoadInt32(&runs) > 0 })
+}
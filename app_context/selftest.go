@@ -0,0 +1,182 @@
+package app_context
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type SelfTestFunc func(ctx context.Context) error
+
+type namedSelfTest struct {
+	name string
+	fn   SelfTestFunc
+}
+
+type selfTests struct {
+	lock  sync.Mutex
+	tests []*namedSelfTest
+}
+
+func (self *selfTests) register(name string, fn SelfTestFunc) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.tests = append(self.tests, &namedSelfTest{name: name, fn: fn})
+}
+
+func (self *selfTests) all() []*namedSelfTest {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	tests := make([]*namedSelfTest, len(self.tests))
+	copy(tests, self.tests)
+	return tests
+}
+
+// RegisterSelfTest adds a smoke test that SelfTest will run after the
+// built-in ones.
+func (self *baseAppContext) RegisterSelfTest(name string, fn SelfTestFunc) {
+	self.selfTests.register(name, fn)
+}
+
+func (self *baseAppContext) selfTestNonce() string {
+	return self.appName + "-" + strconv.FormatInt(time.Now().UnixNano(), 36)
+}
+
+func (self *baseAppContext) selfTestDB(ctx context.Context) error {
+	var one int
+	if err := self.DB().QueryRowContext(ctx, "SELECT 1").Scan(&one); err != nil {
+		return err
+	}
+	if one != 1 {
+		return fmt.Errorf("SELECT 1 returned %d", one)
+	}
+	return nil
+}
+
+func (self *baseAppContext) selfTestMessageBus(ctx context.Context) error {
+	subject := "selftest." + self.selfTestNonce()
+	got := make(chan struct{}, 1)
+
+	sub, err := self.MessageBus().Subscribe(subject, func(msg *BusMessage) {
+		select {
+		case got <- struct{}{}:
+		default:
+		}
+	})
+	if err != nil {
+		return err
+	}
+	defer sub.Unsubscribe()
+
+	if err := self.MessageBus().Publish(subject, []byte("selftest")); err != nil {
+		return err
+	}
+
+	select {
+	case <-got:
+		return nil
+	case <-ctx.Done():
+		return errors.New("Timed out waiting for published message")
+	}
+}
+
+func (self *baseAppContext) selfTestKafka(topic string) SelfTestFunc {
+	return func(ctx context.Context) error {
+		nonce := []byte(self.selfTestNonce())
+
+		consume_ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		got := make(chan struct{}, 1)
+		consume_err := make(chan error, 1)
+
+		goLabeled("self_test", func() {
+			consume_err <- self.kafkaConsumerGroup.Consume(
+				consume_ctx,
+				[]string{topic},
+				func(ctx context.Context, msg *KafkaMessage) error {
+					if string(msg.Value) == string(nonce) {
+						select {
+						case got <- struct{}{}:
+						default:
+						}
+					}
+					return nil
+				},
+			)
+		})
+
+		err := self.kafkaProducer.Produce(ctx, &KafkaMessage{Topic: topic, Value: nonce})
+		if err != nil {
+			return err
+		}
+
+		select {
+		case <-got:
+			return nil
+		case err := <-consume_err:
+			if err == nil {
+				err = errors.New("Consumer stopped before the message arrived")
+			}
+			return err
+		case <-ctx.Done():
+			return errors.New("Timed out waiting for produced message")
+		}
+	}
+}
+
+func (self *baseAppContext) builtinSelfTests() []*namedSelfTest {
+	tests := make([]*namedSelfTest, 0)
+
+	if self.DB() != nil {
+		tests = append(tests, &namedSelfTest{"db", self.selfTestDB})
+	}
+
+	if _, ok := self.MessageBus().(*noopMessageBus); !ok {
+		tests = append(tests, &namedSelfTest{"message_bus", self.selfTestMessageBus})
+	}
+
+	if topic := self.getEnv("SELFTEST_KAFKA_TOPIC"); self.kafkaEnabled && topic != "" {
+		tests = append(tests, &namedSelfTest{"kafka", self.selfTestKafka(topic)})
+	}
+
+	return tests
+}
+
+// SelfTest runs smoke tests against every configured dependency plus any
+// registered with RegisterSelfTest, logging each result. It returns an
+// error naming every test that failed.
+func (self *baseAppContext) SelfTest(ctx context.Context) error {
+	timeout := 10 * time.Second
+	if t, found, err := self.getDurationFromEnv("SELFTEST_TIMEOUT"); err != nil {
+		return err
+	} else if found {
+		timeout = t
+	}
+
+	failed := make([]string, 0)
+
+	for _, test := range append(self.builtinSelfTests(), self.selfTests.all()...) {
+		test_ctx, cancel := context.WithTimeout(ctx, timeout)
+		start := time.Now()
+		err := test.fn(test_ctx)
+		cancel()
+
+		if err != nil {
+			self.Logger().LogErrorf(ctx, "Self test '%s' failed: %s", test.name, err)
+			failed = append(failed, test.name+": "+err.Error())
+		} else {
+			self.Logger().LogInfof(ctx, "Self test '%s' passed in %s", test.name, time.Since(start))
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("Self tests failed: %s", strings.Join(failed, "; "))
+	}
+
+	return nil
+}
@@ -0,0 +1,66 @@
+package app_context
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+	"testing"
+)
+
+func TestSelfTest(t *testing.T) {
+	app_ctx, err := NewAppContext("selftest_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	app_ctx.SetMessageBus(NewMemoryMessageBus())
+
+	ran := false
+	app_ctx.RegisterSelfTest("custom", func(ctx context.Context) error {
+		ran = true
+		return nil
+	})
+
+	if err := app_ctx.SelfTest(context.Background()); err != nil {
+		t.Errorf("SelfTest failed: %s", err)
+	}
+
+	if !ran {
+		t.Error("Registered self test didn't run")
+	}
+
+	app_ctx.RegisterSelfTest("broken", func(ctx context.Context) error {
+		return errors.New("nope")
+	})
+
+	err = app_ctx.SelfTest(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "broken: nope") {
+		t.Errorf("SelfTest didn't report the failed test: %v", err)
+	}
+}
+
+func TestRunSelfTestArg(t *testing.T) {
+	ran := false
+	fn := func(app_ctx AppContext) error {
+		ran = true
+		return nil
+	}
+
+	if code := Run("selftest_test", []string{"--selftest"}, fn); code != 0 {
+		t.Errorf("Run --selftest returned %d", code)
+	}
+
+	if ran {
+		t.Error("Run --selftest ran the main func")
+	}
+
+	if code := Run("selftest_test", nil, fn); code != 0 || !ran {
+		t.Errorf("Run didn't run the main func: %d", code)
+	}
+
+	fail := func(app_ctx AppContext) error { return errors.New("failed") }
+	if code := Run("selftest_test", nil, fail); code != 1 {
+		t.Errorf("Run returned %d for a failing main func", code)
+	}
+}
@@ -0,0 +1,556 @@
+package app_context
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// serviceRegistration is what's registered for this instance
+type serviceRegistration struct {
+	ID        string   `json:"id"`
+	Name      string   `json:"name"`
+	Address   string   `json:"address"`
+	Port      int      `json:"port"`
+	Tags      []string `json:"tags,omitempty"`
+	HealthURL string   `json:"health_url"`
+	Version   string   `json:"version,omitempty"`
+}
+
+// serviceRegistrar registers and deregisters an instance with a discovery
+// backend
+type serviceRegistrar interface {
+	register(ctx context.Context, reg *serviceRegistration) error
+	deregister(ctx context.Context, reg *serviceRegistration) error
+}
+
+// serviceDiscovery is this instance's registration, made at startup and
+// removed when the app context is closed, before anything stops serving
+type serviceDiscovery struct {
+	appctx     *baseAppContext
+	lock       sync.Mutex
+	registrar  serviceRegistrar
+	source     string
+	reg        *serviceRegistration
+	registered bool
+}
+
+func (self *serviceDiscovery) register(ctx context.Context) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if err := self.registrar.register(ctx, self.reg); err != nil {
+		return fmt.Errorf("Couldn't register with %s: %s", self.source, err)
+	}
+	self.registered = true
+	self.appctx.Logger().LogInfof(
+		context.Background(),
+		"Registered %s as %s on %s:%d with %s",
+		self.reg.Name,
+		self.reg.ID,
+		self.reg.Address,
+		self.reg.Port,
+		self.source,
+	)
+	return nil
+}
+
+// deregister takes the instance out of discovery. It's best effort: a
+// backend that can't be reached is left to expire the registration.
+func (self *serviceDiscovery) deregister() {
+	if self == nil {
+		return
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if !self.registered {
+		return
+	}
+	self.registered = false
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := self.registrar.deregister(ctx, self.reg); err != nil {
+		self.appctx.Logger().LogWarnf(
+			context.Background(),
+			"Couldn't deregister %s from %s: %s",
+			self.reg.ID,
+			self.source,
+			err,
+		)
+		self.appctx.MetricsClient().Incr("service_discovery.errors", 1.0, nil)
+	}
+}
+
+func (self *serviceDiscovery) status() map[string]interface{} {
+	if self == nil {
+		return nil
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return map[string]interface{}{
+		"source":       self.source,
+		"registration": self.reg,
+		"registered":   self.registered,
+	}
+}
+
+// consulRegistrar registers with the local Consul agent, which runs the
+// health check and drops the service if it stays critical
+type consulRegistrar struct {
+	client        *http.Client
+	base          string
+	token         string
+	checkInterval time.Duration
+}
+
+func (self *consulRegistrar) put(ctx context.Context, path string, body interface{}) error {
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest("PUT", self.base+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	if self.token != "" {
+		req.Header.Set("X-Consul-Token", self.token)
+	}
+
+	resp, err := self.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("Consul returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+func (self *consulRegistrar) register(ctx context.Context, reg *serviceRegistration) error {
+	meta := map[string]string{}
+	if reg.Version != "" {
+		meta["version"] = reg.Version
+	}
+	return self.put(ctx, "/v1/agent/service/register", map[string]interface{}{
+		"ID":      reg.ID,
+		"Name":    reg.Name,
+		"Address": reg.Address,
+		"Port":    reg.Port,
+		"Tags":    reg.Tags,
+		"Meta":    meta,
+		"Check": map[string]interface{}{
+			"HTTP":     reg.HealthURL,
+			"Interval": self.checkInterval.String(),
+			"Timeout":  (self.checkInterval / 2).String(),
+			// Instances that die without deregistering are removed
+			// by Consul eventually
+			"DeregisterCriticalServiceAfter": "10m",
+		},
+	})
+}
+
+func (self *consulRegistrar) deregister(ctx context.Context, reg *serviceRegistration) error {
+	return self.put(ctx, "/v1/agent/service/deregister/"+url.PathEscape(reg.ID), nil)
+}
+
+// DNS message constants used for RFC 2136 updates
+const (
+	dnsTypeA     = 1
+	dnsTypeSOA   = 6
+	dnsTypePTR   = 12
+	dnsTypeTXT   = 16
+	dnsTypeAAAA  = 28
+	dnsTypeSRV   = 33
+	dnsClassIN   = 1
+	dnsClassNone = 254
+	dnsClassAny  = 255
+	dnsOpUpdate  = 5
+)
+
+// dnsSDRegistrar registers a DNS-SD instance (RFC 6763) in zone with
+// dynamic updates (RFC 2136) sent to server: a PTR from the service type
+// to the instance, and the instance's SRV and TXT records. An IP address
+// also gets an A or AAAA record for the SRV target.
+type dnsSDRegistrar struct {
+	server  string
+	zone    string
+	ttl     time.Duration
+	timeout time.Duration
+}
+
+// dnsRecord is a resource record in the update section
+type dnsRecord struct {
+	name  string
+	rtype uint16
+	class uint16
+	ttl   uint32
+	data  []byte
+}
+
+// dnsName encodes name uncompressed
+func dnsName(name string) ([]byte, error) {
+	var buf bytes.Buffer
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if label == "" || len(label) > 63 {
+			return nil, fmt.Errorf("Invalid DNS name: %s", name)
+		}
+		buf.WriteByte(byte(len(label)))
+		buf.WriteString(label)
+	}
+	buf.WriteByte(0)
+	if buf.Len() > 255 {
+		return nil, fmt.Errorf("DNS name too long: %s", name)
+	}
+	return buf.Bytes(), nil
+}
+
+// dnsLabel makes s usable as a single DNS label
+func dnsLabel(s string) string {
+	label := strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '-' {
+			return r
+		}
+		return '-'
+	}, s)
+	if len(label) > 63 {
+		label = label[:63]
+	}
+	return label
+}
+
+// names are the service type, instance and SRV target names for reg, and
+// the target's address record if it needs one
+func (self *dnsSDRegistrar) names(reg *serviceRegistration) (string, string, string, *dnsRecord) {
+	service := "_" + dnsLabel(reg.Name) + "._tcp." + self.zone
+	instance := dnsLabel(reg.ID) + "." + service
+
+	ip := net.ParseIP(reg.Address)
+	if ip == nil {
+		return service, instance, reg.Address, nil
+	}
+	target := dnsLabel(reg.ID) + "." + self.zone
+	if ip4 := ip.To4(); ip4 != nil {
+		return service, instance, target, &dnsRecord{name: target, rtype: dnsTypeA, data: ip4}
+	}
+	return service, instance, target, &dnsRecord{name: target, rtype: dnsTypeAAAA, data: ip.To16()}
+}
+
+func (self *dnsSDRegistrar) register(ctx context.Context, reg *serviceRegistration) error {
+	service, instance, target, addr := self.names(reg)
+	ttl := uint32(self.ttl / time.Second)
+
+	instance_name, err := dnsName(instance)
+	if err != nil {
+		return err
+	}
+	target_name, err := dnsName(target)
+	if err != nil {
+		return err
+	}
+
+	srv := make([]byte, 6, 6+len(target_name))
+	binary.BigEndian.PutUint16(srv[4:], uint16(reg.Port))
+	srv = append(srv, target_name...)
+
+	txt := []string{"health=" + reg.HealthURL}
+	if reg.Version != "" {
+		txt = append(txt, "version="+reg.Version)
+	}
+	if len(reg.Tags) > 0 {
+		txt = append(txt, "tags="+strings.Join(reg.Tags, ","))
+	}
+	var txt_data []byte
+	for _, s := range txt {
+		if len(s) > 255 {
+			s = s[:255]
+		}
+		txt_data = append(append(txt_data, byte(len(s))), s...)
+	}
+
+	// Deleting the instance's RRsets first replaces anything left by a
+	// previous run with the same ID
+	records := []*dnsRecord{
+		{name: instance, rtype: dnsTypeSRV, class: dnsClassAny},
+		{name: instance, rtype: dnsTypeTXT, class: dnsClassAny},
+		{name: service, rtype: dnsTypePTR, class: dnsClassIN, ttl: ttl, data: instance_name},
+		{name: instance, rtype: dnsTypeSRV, class: dnsClassIN, ttl: ttl, data: srv},
+		{name: instance, rtype: dnsTypeTXT, class: dnsClassIN, ttl: ttl, data: txt_data},
+	}
+	if addr != nil {
+		records = append(records,
+			&dnsRecord{name: addr.name, rtype: addr.rtype, class: dnsClassAny},
+			&dnsRecord{name: addr.name, rtype: addr.rtype, class: dnsClassIN, ttl: ttl, data: addr.data},
+		)
+	}
+	return self.update(ctx, records)
+}
+
+func (self *dnsSDRegistrar) deregister(ctx context.Context, reg *serviceRegistration) error {
+	service, instance, _, addr := self.names(reg)
+
+	instance_name, err := dnsName(instance)
+	if err != nil {
+		return err
+	}
+
+	// Only this instance's PTR goes; the others stay
+	records := []*dnsRecord{
+		{name: service, rtype: dnsTypePTR, class: dnsClassNone, data: instance_name},
+		{name: instance, rtype: dnsTypeSRV, class: dnsClassAny},
+		{name: instance, rtype: dnsTypeTXT, class: dnsClassAny},
+	}
+	if addr != nil {
+		records = append(records, &dnsRecord{name: addr.name, rtype: addr.rtype, class: dnsClassAny})
+	}
+	return self.update(ctx, records)
+}
+
+// updateMessage builds an UPDATE of zone with records as its update
+// section
+func (self *dnsSDRegistrar) updateMessage(id uint16, records []*dnsRecord) ([]byte, error) {
+	msg := make([]byte, 12)
+	binary.BigEndian.PutUint16(msg[0:], id)
+	binary.BigEndian.PutUint16(msg[2:], dnsOpUpdate<<11)
+	binary.BigEndian.PutUint16(msg[4:], 1)
+	binary.BigEndian.PutUint16(msg[8:], uint16(len(records)))
+
+	zone, err := dnsName(self.zone)
+	if err != nil {
+		return nil, err
+	}
+	msg = append(msg, zone...)
+	msg = append(msg, 0, dnsTypeSOA, 0, dnsClassIN)
+
+	for _, rr := range records {
+		name, err := dnsName(rr.name)
+		if err != nil {
+			return nil, err
+		}
+		var fixed [10]byte
+		binary.BigEndian.PutUint16(fixed[0:], rr.rtype)
+		binary.BigEndian.PutUint16(fixed[2:], rr.class)
+		binary.BigEndian.PutUint32(fixed[4:], rr.ttl)
+		binary.BigEndian.PutUint16(fixed[8:], uint16(len(rr.data)))
+		msg = append(append(append(msg, name...), fixed[:]...), rr.data...)
+	}
+	return msg, nil
+}
+
+// dnsRcodes are the update errors a server is likely to return
+var dnsRcodes = map[int]string{
+	1:  "FORMERR",
+	2:  "SERVFAIL",
+	3:  "NXDOMAIN",
+	4:  "NOTIMP",
+	5:  "REFUSED",
+	9:  "NOTAUTH",
+	10: "NOTZONE",
+}
+
+func (self *dnsSDRegistrar) update(ctx context.Context, records []*dnsRecord) error {
+	id := uint16(rand.Intn(1 << 16))
+	msg, err := self.updateMessage(id, records)
+	if err != nil {
+		return err
+	}
+
+	dialer := &net.Dialer{}
+	conn, err := dialer.DialContext(ctx, "udp", self.server)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	deadline := time.Now().Add(self.timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetDeadline(deadline)
+
+	if _, err := conn.Write(msg); err != nil {
+		return err
+	}
+
+	resp := make([]byte, 512)
+	for {
+		n, err := conn.Read(resp)
+		if err != nil {
+			return err
+		}
+		// Anything that isn't the reply to this update is ignored
+		if n < 12 || binary.BigEndian.Uint16(resp[0:]) != id || resp[2]&0x80 == 0 {
+			continue
+		}
+		if rcode := int(resp[3] & 0x0f); rcode != 0 {
+			name, ok := dnsRcodes[rcode]
+			if !ok {
+				name = strconv.Itoa(rcode)
+			}
+			return fmt.Errorf("DNS update of %s failed: %s", self.zone, name)
+		}
+		return nil
+	}
+}
+
+// healthURL is where the service's health is checked: the admin server's
+// /healthz when it's listening, otherwise path on the service port
+func (self *baseAppContext) healthURL(address, path string) string {
+	port := strconv.Itoa(self.servicePort)
+	if addr := self.admin.Addr(); addr != "" {
+		if _, admin_port, err := net.SplitHostPort(addr); err == nil {
+			port = admin_port
+			path = "/healthz"
+		}
+	}
+	return "http://" + net.JoinHostPort(address, port) + path
+}
+
+func (self *baseAppContext) resetServiceDiscovery() {
+	self.serviceDiscovery = nil
+}
+
+// SERVICE_DISCOVERY_URL registers the service on SERVICE_PORT at startup
+// and deregisters it on Close. It's consul://host:port for a Consul agent,
+// or dnssd://server:port/<zone> for DNS-SD records added to <zone> with
+// dynamic updates. SERVICE_DISCOVERY_NAME (the app name by default) and
+// SERVICE_DISCOVERY_TAGS describe the service, and SERVICE_DISCOVERY_ADDRESS
+// is where it's reached, by default the pod IP on Kubernetes or the
+// hostname. It's health checked at SERVICE_DISCOVERY_HEALTH_PATH (default
+// /healthz), on the admin server when that's listening.
+// SERVICE_DISCOVERY_TLS=true and SERVICE_DISCOVERY_TOKEN are for Consul's
+// API, SERVICE_DISCOVERY_CHECK_INTERVAL (default 10s) is how often Consul
+// checks, and SERVICE_DISCOVERY_TTL (default 60s) is the DNS records' TTL.
+func (self *baseAppContext) setServiceDiscoveryFromEnv() error {
+	raw := self.getEnv("SERVICE_DISCOVERY_URL")
+	if raw == "" || self.lambda {
+		return nil
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil {
+		return fmt.Errorf("Couldn't parse SERVICE_DISCOVERY_URL: %s", err)
+	}
+	if u.Host == "" {
+		return errors.New("SERVICE_DISCOVERY_URL needs a host")
+	}
+	if self.servicePort <= 0 {
+		return errors.New("SERVICE_DISCOVERY_URL needs SERVICE_PORT")
+	}
+
+	address := self.getEnv("SERVICE_DISCOVERY_ADDRESS")
+	if address == "" && self.kubernetes != nil {
+		address = self.kubernetes.PodIP
+	}
+	if address == "" {
+		address = self.hostname
+	}
+
+	health_path := self.getEnv("SERVICE_DISCOVERY_HEALTH_PATH")
+	if health_path == "" {
+		health_path = "/healthz"
+	} else if !strings.HasPrefix(health_path, "/") {
+		return errors.New("SERVICE_DISCOVERY_HEALTH_PATH must start with /")
+	}
+
+	reg := &serviceRegistration{
+		Name:      self.getEnv("SERVICE_DISCOVERY_NAME"),
+		Address:   address,
+		Port:      self.servicePort,
+		HealthURL: self.healthURL(address, health_path),
+		Version:   self.codeVersion,
+	}
+	if reg.Name == "" {
+		reg.Name = self.appName
+	}
+	reg.ID = reg.Name + "-" + self.hostname + "-" + strconv.Itoa(reg.Port)
+	if tags := self.getEnv("SERVICE_DISCOVERY_TAGS"); tags != "" {
+		for _, tag := range strings.Split(tags, ",") {
+			if tag = strings.TrimSpace(tag); tag != "" {
+				reg.Tags = append(reg.Tags, tag)
+			}
+		}
+	}
+
+	sd := &serviceDiscovery{appctx: self, reg: reg}
+
+	switch u.Scheme {
+	case "consul":
+		use_tls, _, err := self.getBoolFromEnv("SERVICE_DISCOVERY_TLS")
+		if err != nil {
+			return err
+		}
+		scheme := "http"
+		if use_tls {
+			scheme = "https"
+		}
+		interval := 10 * time.Second
+		if d, found, err := self.getDurationFromEnv("SERVICE_DISCOVERY_CHECK_INTERVAL"); err != nil {
+			return err
+		} else if found {
+			if d < time.Second {
+				return errors.New("SERVICE_DISCOVERY_CHECK_INTERVAL must be >= 1s")
+			}
+			interval = d
+		}
+		sd.registrar = &consulRegistrar{
+			client:        &http.Client{Timeout: 10 * time.Second},
+			base:          scheme + "://" + u.Host,
+			token:         self.getEnv("SERVICE_DISCOVERY_TOKEN"),
+			checkInterval: interval,
+		}
+		sd.source = "consul://" + u.Host
+	case "dnssd":
+		zone := strings.Trim(u.Path, "/")
+		if zone == "" {
+			return errors.New("SERVICE_DISCOVERY_URL needs a zone, eg. dnssd://ns1:53/svc.example.com")
+		}
+		server := u.Host
+		if u.Port() == "" {
+			server = net.JoinHostPort(u.Hostname(), "53")
+		}
+		ttl := time.Minute
+		if d, found, err := self.getDurationFromEnv("SERVICE_DISCOVERY_TTL"); err != nil {
+			return err
+		} else if found {
+			if d < time.Second {
+				return errors.New("SERVICE_DISCOVERY_TTL must be >= 1s")
+			}
+			ttl = d
+		}
+		sd.registrar = &dnsSDRegistrar{server: server, zone: zone, ttl: ttl, timeout: 5 * time.Second}
+		sd.source = "dnssd://" + server + "/" + zone
+	default:
+		return fmt.Errorf("SERVICE_DISCOVERY_URL should be consul:// or dnssd://, not %s://", u.Scheme)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	if err := sd.register(ctx); err != nil {
+		return err
+	}
+	self.serviceDiscovery = sd
+
+	return nil
+}
@@ -0,0 +1,196 @@
+package app_context
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestServiceDiscoveryConsul(t *testing.T) {
+	var lock sync.Mutex
+	var registered map[string]interface{}
+	var deregistered string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		if r.Method != "PUT" || r.Header.Get("X-Consul-Token") != "secret" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		switch {
+		case r.URL.Path == "/v1/agent/service/register":
+			json.NewDecoder(r.Body).Decode(&registered)
+		case strings.HasPrefix(r.URL.Path, "/v1/agent/service/deregister/"):
+			deregistered = strings.TrimPrefix(r.URL.Path, "/v1/agent/service/deregister/")
+		}
+	}))
+	defer srv.Close()
+
+	for name, value := range map[string]string{
+		"SERVICE_DISCOVERY_URL":     "consul://" + strings.TrimPrefix(srv.URL, "http://"),
+		"SERVICE_DISCOVERY_TOKEN":   "secret",
+		"SERVICE_DISCOVERY_TAGS":    "api, v2",
+		"SERVICE_DISCOVERY_ADDRESS": "10.1.2.3",
+		"SERVICE_PORT":              "8080",
+	} {
+		os.Setenv(name, value)
+		defer os.Unsetenv(name)
+	}
+
+	app_ctx, err := NewAppContext("discovery_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	lock.Lock()
+	id, _ := registered["ID"].(string)
+	if registered["Name"] != "discovery_test" || registered["Address"] != "10.1.2.3" || registered["Port"] != 8080.0 {
+		t.Errorf("Unexpected registration: %v", registered)
+	}
+	if tags, _ := registered["Tags"].([]interface{}); len(tags) != 2 || tags[1] != "v2" {
+		t.Errorf("Unexpected tags: %v", registered["Tags"])
+	}
+	check, _ := registered["Check"].(map[string]interface{})
+	if check["HTTP"] != "http://10.1.2.3:8080/healthz" {
+		t.Errorf("Unexpected health check: %v", check)
+	}
+	lock.Unlock()
+
+	app_ctx.Close()
+
+	lock.Lock()
+	defer lock.Unlock()
+	if id == "" || deregistered != id {
+		t.Errorf("Expected %s to be deregistered, got '%s'", id, deregistered)
+	}
+}
+
+// dnsUpdateRecord is a record read back from an update message
+type dnsUpdateRecord struct {
+	name  string
+	rtype uint16
+	class uint16
+}
+
+func readDNSName(msg []byte, off int) (string, int) {
+	labels := []string{}
+	for msg[off] != 0 {
+		n := int(msg[off])
+		labels = append(labels, string(msg[off+1:off+1+n]))
+		off += 1 + n
+	}
+	return strings.Join(labels, "."), off + 1
+}
+
+// fakeDNSUpdates answers every update with NOERROR, sending what it
+// received on the returned channel
+func fakeDNSUpdates(t *testing.T) (string, chan []dnsUpdateRecord) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	updates := make(chan []dnsUpdateRecord, 2)
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			msg := buf[:n]
+			_, off := readDNSName(msg, 12)
+			off += 4
+			records := []dnsUpdateRecord{}
+			for i := 0; i < int(binary.BigEndian.Uint16(msg[8:])); i++ {
+				var rr dnsUpdateRecord
+				rr.name, off = readDNSName(msg, off)
+				rr.rtype = binary.BigEndian.Uint16(msg[off:])
+				rr.class = binary.BigEndian.Uint16(msg[off+2:])
+				off += 10 + int(binary.BigEndian.Uint16(msg[off+8:]))
+				records = append(records, rr)
+			}
+			updates <- records
+
+			resp := append([]byte(nil), msg[:12]...)
+			resp[2] |= 0x80
+			conn.WriteTo(resp, addr)
+		}
+	}()
+	return conn.LocalAddr().String(), updates
+}
+
+func TestServiceDiscoveryDNSSD(t *testing.T) {
+	server, updates := fakeDNSUpdates(t)
+
+	for name, value := range map[string]string{
+		"SERVICE_DISCOVERY_URL":     "dnssd://" + server + "/svc.example.com",
+		"SERVICE_DISCOVERY_NAME":    "orders",
+		"SERVICE_DISCOVERY_ADDRESS": "10.1.2.3",
+		"SERVICE_PORT":              "8080",
+	} {
+		os.Setenv(name, value)
+		defer os.Unsetenv(name)
+	}
+
+	app_ctx, err := NewAppContext("discovery_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	added := map[uint16]string{}
+	for _, rr := range <-updates {
+		if rr.class == dnsClassIN {
+			added[rr.rtype] = rr.name
+		}
+	}
+	if added[dnsTypePTR] != "_orders._tcp.svc.example.com" {
+		t.Errorf("Unexpected PTR: %v", added)
+	}
+	if !strings.HasSuffix(added[dnsTypeSRV], "._orders._tcp.svc.example.com") || added[dnsTypeTXT] != added[dnsTypeSRV] {
+		t.Errorf("Unexpected instance records: %v", added)
+	}
+	if added[dnsTypeA] == "" {
+		t.Errorf("Expected an A record for the SRV target: %v", added)
+	}
+
+	app_ctx.Close()
+
+	for _, rr := range <-updates {
+		if rr.class == dnsClassIN {
+			t.Errorf("Expected deregistering to only delete, got %+v", rr)
+		}
+		if rr.rtype == dnsTypePTR && rr.class != dnsClassNone {
+			t.Errorf("Expected only this instance's PTR to be deleted, got %+v", rr)
+		}
+	}
+}
+
+func TestServiceDiscoveryFromEnv(t *testing.T) {
+	os.Setenv("SERVICE_DISCOVERY_URL", "consul://localhost:8500")
+	defer os.Unsetenv("SERVICE_DISCOVERY_URL")
+
+	if _, err := NewAppContext("discovery_test"); err == nil {
+		t.Error("Expected an error without SERVICE_PORT")
+	}
+
+	os.Setenv("SERVICE_PORT", "8080")
+	defer os.Unsetenv("SERVICE_PORT")
+	os.Setenv("SERVICE_DISCOVERY_URL", "eureka://localhost")
+	if _, err := NewAppContext("discovery_test"); err == nil {
+		t.Error("Expected an error for an unknown SERVICE_DISCOVERY_URL scheme")
+	}
+
+	os.Setenv("SERVICE_DISCOVERY_URL", "dnssd://localhost")
+	if _, err := NewAppContext("discovery_test"); err == nil {
+		t.Error("Expected an error for dnssd:// without a zone")
+	}
+}
@@ -0,0 +1,223 @@
+package app_context
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrUnknownService is returned by ServiceRegistry.Get for a service with
+// no SERVICE_<NAME>_URL
+var ErrUnknownService = errors.New("Unknown service")
+
+// ServiceClient calls one downstream service. Its HTTPClient is
+// HTTPClient's, with the service's own timeout and retries, tagged with
+// the service in metrics, and behind the service's circuit breaker: 5xx
+// responses and connection errors count as failures, and while the
+// breaker is open requests fail with ErrBreakerOpen without being sent.
+type ServiceClient interface {
+	Name() string
+	BaseURL() string
+	HTTPClient() *http.Client
+	// NewRequest makes a request for path, relative to the base URL
+	NewRequest(ctx context.Context, method, path string, body io.Reader) (*http.Request, error)
+}
+
+type ServiceStatus struct {
+	Name       string        `json:"name"`
+	BaseURL    string        `json:"base_url"`
+	Timeout    time.Duration `json:"timeout"`
+	MaxRetries int           `json:"max_retries"`
+	Breaker    string        `json:"breaker"`
+}
+
+// ServiceRegistry hands out one client per downstream service. A service
+// is declared with SERVICE_<NAME>_URL, its base URL, where <NAME> is the
+// service name uppercased with anything other than letters and digits
+// replaced by _. SERVICE_<NAME>_TIMEOUT and SERVICE_<NAME>_MAX_RETRIES
+// override HTTP_CLIENT_TIMEOUT and HTTP_CLIENT_MAX_RETRIES, and the
+// breaker, named after the service, is configured like any other.
+type ServiceRegistry interface {
+	Get(name string) (ServiceClient, error)
+	Status() []*ServiceStatus
+}
+
+// breakerTransport records each request's result in a circuit breaker
+type breakerTransport struct {
+	breaker CircuitBreaker
+	inner   http.RoundTripper
+}
+
+func (self *breakerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	done, err := self.breaker.Allow()
+	if err != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, err
+	}
+
+	resp, err := self.inner.RoundTrip(req)
+	switch {
+	case err != nil && req.Context().Err() == context.Canceled:
+		// The caller gave up, which says nothing about the service
+		done(nil)
+	case err != nil:
+		done(err)
+	case resp.StatusCode >= 500:
+		done(fmt.Errorf("Service returned %s", resp.Status))
+	default:
+		done(nil)
+	}
+	return resp, err
+}
+
+type serviceClient struct {
+	name       string
+	baseURL    *url.URL
+	client     *http.Client
+	maxRetries int
+	breaker    CircuitBreaker
+}
+
+func (self *serviceClient) Name() string {
+	return self.name
+}
+
+func (self *serviceClient) BaseURL() string {
+	return self.baseURL.String()
+}
+
+func (self *serviceClient) HTTPClient() *http.Client {
+	return self.client
+}
+
+func (self *serviceClient) NewRequest(ctx context.Context, method, path string, body io.Reader) (*http.Request, error) {
+	ref, err := url.Parse(strings.TrimPrefix(path, "/"))
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(method, self.baseURL.ResolveReference(ref).String(), body)
+	if err != nil {
+		return nil, err
+	}
+	return req.WithContext(ctx), nil
+}
+
+func (self *serviceClient) status() *ServiceStatus {
+	return &ServiceStatus{
+		Name:       self.name,
+		BaseURL:    self.BaseURL(),
+		Timeout:    self.client.Timeout,
+		MaxRetries: self.maxRetries,
+		Breaker:    self.breaker.State().String(),
+	}
+}
+
+type serviceRegistry struct {
+	appctx  *baseAppContext
+	lock    sync.Mutex
+	clients map[string]*serviceClient
+}
+
+func newServiceRegistry(appctx *baseAppContext) *serviceRegistry {
+	return &serviceRegistry{
+		appctx:  appctx,
+		clients: make(map[string]*serviceClient),
+	}
+}
+
+func (self *serviceRegistry) newClient(name string) (*serviceClient, error) {
+	prefix := "SERVICE_" + envName(name) + "_"
+
+	raw := self.appctx.getEnv(prefix + "URL")
+	if raw == "" {
+		return nil, ErrUnknownService
+	}
+	base, err := url.Parse(raw)
+	if err != nil || base.Host == "" || (base.Scheme != "http" && base.Scheme != "https") {
+		return nil, fmt.Errorf("%sURL must be an http or https URL, not '%s'", prefix, raw)
+	}
+	// Paths are resolved relative to the base URL, so it's treated as a
+	// directory
+	if !strings.HasSuffix(base.Path, "/") {
+		base.Path += "/"
+	}
+
+	default_transport := self.appctx.httpClient.Transport.(*instrumentedTransport)
+	timeout := self.appctx.httpClient.Timeout
+	if val := self.appctx.getEnv(prefix + "TIMEOUT"); val != "" {
+		if timeout, err = time.ParseDuration(val); err != nil || timeout < 0 {
+			return nil, fmt.Errorf("Invalid %sTIMEOUT: %s", prefix, val)
+		}
+	}
+	max_retries := default_transport.maxRetries
+	if val := self.appctx.getEnv(prefix + "MAX_RETRIES"); val != "" {
+		if max_retries, err = strconv.Atoi(val); err != nil || max_retries < 0 {
+			return nil, fmt.Errorf("Invalid %sMAX_RETRIES: %s", prefix, val)
+		}
+	}
+
+	breaker := self.appctx.CircuitBreakers().Get(name)
+	return &serviceClient{
+		name:       name,
+		baseURL:    base,
+		maxRetries: max_retries,
+		breaker:    breaker,
+		client: &http.Client{
+			Timeout: timeout,
+			Transport: &breakerTransport{
+				breaker: breaker,
+				// Connections are pooled with HTTPClient's
+				inner: &instrumentedTransport{
+					appctx:     self.appctx,
+					inner:      default_transport.inner,
+					service:    name,
+					maxRetries: max_retries,
+					minBackoff: default_transport.minBackoff,
+				},
+			},
+		},
+	}, nil
+}
+
+func (self *serviceRegistry) Get(name string) (ServiceClient, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	client, ok := self.clients[name]
+	if !ok {
+		var err error
+		if client, err = self.newClient(name); err != nil {
+			return nil, err
+		}
+		self.clients[name] = client
+	}
+	return client, nil
+}
+
+func (self *serviceRegistry) Status() []*ServiceStatus {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	statuses := make([]*ServiceStatus, 0, len(self.clients))
+	for _, client := range self.clients {
+		statuses = append(statuses, client.status())
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Name < statuses[j].Name
+	})
+	return statuses
+}
+
+func (self *baseAppContext) Services() ServiceRegistry {
+	return self.services
+}
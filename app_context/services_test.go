@@ -0,0 +1,114 @@
+package app_context
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+)
+
+func TestServices(t *testing.T) {
+	var lock sync.Mutex
+	paths := []string{}
+	failing := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		paths = append(paths, r.URL.Path)
+		if failing {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	for name, value := range map[string]string{
+		"SERVICE_PAYMENTS_URL":              server.URL + "/api/v1",
+		"SERVICE_PAYMENTS_MAX_RETRIES":      "0",
+		"CIRCUIT_BREAKER_PAYMENTS_FAILURES": "2",
+	} {
+		os.Setenv(name, value)
+		defer os.Unsetenv(name)
+	}
+
+	app_ctx, err := NewAppContext("services_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer app_ctx.Close()
+
+	mcli := newCountingMetricsClient()
+	app_ctx.SetMetricsClient(mcli)
+
+	if _, err := app_ctx.Services().Get("billing"); err != ErrUnknownService {
+		t.Errorf("Expected ErrUnknownService, got %v", err)
+	}
+
+	payments, err := app_ctx.Services().Get("payments")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := app_ctx.Services().Get("payments"); again != payments {
+		t.Error("Expected the same client for the same service")
+	}
+
+	do := func() error {
+		req, err := payments.NewRequest(context.Background(), "GET", "/charges/1", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := payments.HTTPClient().Do(req)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+
+	if err := do(); err != nil {
+		t.Fatal(err)
+	}
+	if paths[0] != "/api/v1/charges/1" {
+		t.Errorf("Expected the path relative to the base URL, got %s", paths[0])
+	}
+	if mcli.count("http_client.requests") != 1 {
+		t.Errorf("Expected the request to be counted, got %v", mcli.counts)
+	}
+
+	lock.Lock()
+	failing = true
+	lock.Unlock()
+	for i := 0; i < 2; i++ {
+		if err := do(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := do(); !errors.Is(err, ErrBreakerOpen) {
+		t.Errorf("Expected the breaker to open after 2 failures, got %v", err)
+	}
+	if len(paths) != 3 {
+		t.Errorf("Expected nothing to be sent with the breaker open, got %v", paths)
+	}
+
+	statuses := app_ctx.Services().Status()
+	if len(statuses) != 1 || statuses[0].Breaker != "open" || statuses[0].MaxRetries != 0 {
+		t.Errorf("Unexpected status: %+v", statuses[0])
+	}
+}
+
+func TestServicesInvalidURL(t *testing.T) {
+	os.Setenv("SERVICE_LEDGER_URL", "ledger:8080")
+	defer os.Unsetenv("SERVICE_LEDGER_URL")
+
+	app_ctx, err := NewAppContext("services_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer app_ctx.Close()
+
+	if _, err := app_ctx.Services().Get("ledger"); err == nil || err == ErrUnknownService {
+		t.Errorf("Expected an invalid URL error, got %v", err)
+	}
+}
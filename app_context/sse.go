@@ -0,0 +1,307 @@
+package app_context
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SSEEvent is one server-sent event. Retry tells clients how long to wait
+// before reconnecting.
+type SSEEvent struct {
+	ID    string
+	Event string
+	Data  []byte
+	Retry time.Duration
+}
+
+// sseFieldNewlines are stripped from ID and Event, which can't span lines
+// without starting fields of their own
+var sseFieldNewlines = strings.NewReplacer("\r", "", "\n", "")
+
+func (self *SSEEvent) encode() []byte {
+	var buf bytes.Buffer
+	if id := sseFieldNewlines.Replace(self.ID); id != "" {
+		buf.WriteString("id: " + id + "\n")
+	}
+	if event := sseFieldNewlines.Replace(self.Event); event != "" {
+		buf.WriteString("event: " + event + "\n")
+	}
+	if self.Retry > 0 {
+		buf.WriteString("retry: " + strconv.FormatInt(int64(self.Retry/time.Millisecond), 10) + "\n")
+	}
+	for _, line := range strings.Split(string(self.Data), "\n") {
+		buf.WriteString("data: " + strings.TrimSuffix(line, "\r") + "\n")
+	}
+	buf.WriteString("\n")
+	return buf.Bytes()
+}
+
+// SSEBroadcaster streams published events to subscribers over
+// text/event-stream responses, with a comment every
+// SSE_HEARTBEAT_INTERVAL so proxies keep idle streams open. A subscriber
+// with SSE_BUFFER events waiting is disconnected rather than holding up
+// publishing; EventSource clients reconnect by themselves. Streams end
+// when the app context is closed.
+//
+// Metrics: sse.subscribers (gauge), sse.connects, sse.disconnects,
+// sse.events_sent, sse.slow_subscribers and sse.connection_duration_ms.
+type SSEBroadcaster interface {
+	// Handler subscribes each request to topics, or without any, to the
+	// request's topic query parameters that AuthorizeTopics allows:
+	//
+	//	http.Handle("/events", appctx.SSE().Handler("prices"))
+	Handler(topics ...string) http.Handler
+	// AuthorizeTopics sets the check for topics from query parameters.
+	// Until it's set, a Handler without topics refuses every request.
+	AuthorizeTopics(fn func(r *http.Request, topic string) bool)
+	// Publish queues event for topic's subscribers, returning how many
+	Publish(topic string, event SSEEvent) int
+	Subscribers(topic string) int
+}
+
+type sseSubscriber struct {
+	topics   map[string]bool
+	events   chan []byte
+	slow     chan struct{}
+	slowOnce sync.Once
+}
+
+type sseBroadcaster struct {
+	appctx     *baseAppContext
+	heartbeat  time.Duration
+	bufferSize int
+
+	lock        sync.Mutex
+	authorize   func(r *http.Request, topic string) bool
+	subscribers map[*sseSubscriber]struct{}
+	sent        int64
+	closed      bool
+	doneChan    chan struct{}
+}
+
+func newSSEBroadcaster(appctx *baseAppContext) *sseBroadcaster {
+	return &sseBroadcaster{
+		appctx:      appctx,
+		heartbeat:   15 * time.Second,
+		bufferSize:  64,
+		subscribers: make(map[*sseSubscriber]struct{}),
+		doneChan:    make(chan struct{}),
+	}
+}
+
+func (self *sseBroadcaster) subscribe(topics []string) (*sseSubscriber, error) {
+	sub := &sseSubscriber{
+		topics: make(map[string]bool, len(topics)),
+		events: make(chan []byte, self.bufferSize),
+		slow:   make(chan struct{}),
+	}
+	for _, topic := range topics {
+		sub.topics[topic] = true
+	}
+
+	self.lock.Lock()
+	if self.closed {
+		self.lock.Unlock()
+		return nil, errors.New("Shutting down")
+	}
+	self.subscribers[sub] = struct{}{}
+	count := len(self.subscribers)
+	self.lock.Unlock()
+
+	mcli := self.appctx.MetricsClient()
+	mcli.Incr("sse.connects", 1.0, nil)
+	mcli.Gauge("sse.subscribers", float64(count), 1.0, nil)
+	return sub, nil
+}
+
+func (self *sseBroadcaster) unsubscribe(sub *sseSubscriber, start time.Time) {
+	self.lock.Lock()
+	delete(self.subscribers, sub)
+	count := len(self.subscribers)
+	self.lock.Unlock()
+
+	mcli := self.appctx.MetricsClient()
+	mcli.Incr("sse.disconnects", 1.0, nil)
+	mcli.Gauge("sse.subscribers", float64(count), 1.0, nil)
+	mcli.TimingMS("sse.connection_duration_ms", float64(time.Since(start))/float64(time.Millisecond), 1.0, nil)
+}
+
+func (self *sseBroadcaster) AuthorizeTopics(fn func(r *http.Request, topic string) bool) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.authorize = fn
+}
+
+// queryTopics are the topic query parameters, if AuthorizeTopics allows
+// every one of them
+func (self *sseBroadcaster) queryTopics(r *http.Request) ([]string, error) {
+	self.lock.Lock()
+	authorize := self.authorize
+	self.lock.Unlock()
+
+	topics := r.URL.Query()["topic"]
+	for _, topic := range topics {
+		if authorize == nil || !authorize(r, topic) {
+			return nil, fmt.Errorf("Not allowed to subscribe to '%s'", topic)
+		}
+	}
+	return topics, nil
+}
+
+func (self *sseBroadcaster) Handler(topics ...string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "Streaming isn't supported", http.StatusInternalServerError)
+			return
+		}
+		sub_topics := topics
+		if len(sub_topics) == 0 {
+			var err error
+			if sub_topics, err = self.queryTopics(r); err != nil {
+				http.Error(w, err.Error(), http.StatusForbidden)
+				return
+			}
+		}
+		if len(sub_topics) == 0 {
+			http.Error(w, "No topics to subscribe to", http.StatusBadRequest)
+			return
+		}
+		sub, err := self.subscribe(sub_topics)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		start := time.Now()
+		defer self.unsubscribe(sub, start)
+
+		header := w.Header()
+		header.Set("Content-Type", "text/event-stream")
+		header.Set("Cache-Control", "no-cache")
+		header.Set("Connection", "keep-alive")
+		// For nginx, which buffers otherwise
+		header.Set("X-Accel-Buffering", "no")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		ticker := self.appctx.Clock().NewTicker(self.heartbeat)
+		defer ticker.Stop()
+		mcli := self.appctx.MetricsClient()
+		for {
+			var data []byte
+			select {
+			case <-r.Context().Done():
+				return
+			case <-self.doneChan:
+				return
+			case <-sub.slow:
+				return
+			case <-ticker.C():
+				data = []byte(": heartbeat\n\n")
+			case data = <-sub.events:
+				mcli.Incr("sse.events_sent", 1.0, nil)
+				self.lock.Lock()
+				self.sent++
+				self.lock.Unlock()
+			}
+			if _, err := w.Write(data); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	})
+}
+
+func (self *sseBroadcaster) list(topic string) []*sseSubscriber {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	subs := make([]*sseSubscriber, 0, len(self.subscribers))
+	for sub := range self.subscribers {
+		if sub.topics[topic] {
+			subs = append(subs, sub)
+		}
+	}
+	return subs
+}
+
+func (self *sseBroadcaster) Publish(topic string, event SSEEvent) int {
+	data := event.encode()
+	queued := 0
+	for _, sub := range self.list(topic) {
+		select {
+		case sub.events <- data:
+			queued++
+		default:
+			sub.slowOnce.Do(func() {
+				self.appctx.MetricsClient().Incr("sse.slow_subscribers", 1.0, map[string]string{"topic": topic})
+				close(sub.slow)
+			})
+		}
+	}
+	return queued
+}
+
+func (self *sseBroadcaster) Subscribers(topic string) int {
+	return len(self.list(topic))
+}
+
+// close ends every stream and refuses new ones
+func (self *sseBroadcaster) close() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if !self.closed {
+		self.closed = true
+		close(self.doneChan)
+	}
+}
+
+func (self *sseBroadcaster) status() map[string]interface{} {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	topics := make(map[string]int)
+	for sub := range self.subscribers {
+		for topic := range sub.topics {
+			topics[topic]++
+		}
+	}
+	return map[string]interface{}{
+		"subscribers":        len(self.subscribers),
+		"topics":             topics,
+		"events_sent":        self.sent,
+		"heartbeat_interval": self.heartbeat.String(),
+		"buffer_size":        self.bufferSize,
+	}
+}
+
+func (self *baseAppContext) SSE() SSEBroadcaster {
+	return self.sse
+}
+
+// SSE_HEARTBEAT_INTERVAL (default 15s) is how often idle streams get a
+// comment, and SSE_BUFFER (default 64) how many events may wait for a
+// subscriber before it's disconnected.
+func (self *baseAppContext) setSSEFromEnv() error {
+	if interval, found, err := self.getDurationFromEnv("SSE_HEARTBEAT_INTERVAL"); err != nil {
+		return err
+	} else if found {
+		if interval <= 0 {
+			return errors.New("SSE_HEARTBEAT_INTERVAL must be > 0")
+		}
+		self.sse.heartbeat = interval
+	}
+	if size, found, err := self.getIntFromEnv("SSE_BUFFER"); err != nil {
+		return err
+	} else if found {
+		if size <= 0 {
+			return errors.New("SSE_BUFFER must be > 0")
+		}
+		self.sse.bufferSize = size
+	}
+	return nil
+}
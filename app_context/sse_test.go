@@ -0,0 +1,183 @@
+package app_context
+
+import (
+	"bufio"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSSE(t *testing.T) {
+	os.Setenv("SSE_HEARTBEAT_INTERVAL", "20ms")
+	defer os.Unsetenv("SSE_HEARTBEAT_INTERVAL")
+
+	app_ctx, err := NewAppContext("sse_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	closed := false
+	defer func() {
+		if !closed {
+			app_ctx.Close()
+		}
+	}()
+
+	mcli := newCountingMetricsClient()
+	app_ctx.SetMetricsClient(mcli)
+
+	sse := app_ctx.SSE()
+	mux := http.NewServeMux()
+	mux.Handle("/prices", sse.Handler("prices"))
+	mux.Handle("/events", sse.Handler())
+	server := httptest.NewServer(app_ctx.HTTPMiddleware()(mux))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/prices")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Errorf("Unexpected content type: %s", resp.Header.Get("Content-Type"))
+	}
+	waitFor(t, "the subscriber", func() bool {
+		return sse.Subscribers("prices") == 1
+	})
+
+	reader := bufio.NewReader(resp.Body)
+	readEvent := func() string {
+		var lines []string
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			if line == "\n" {
+				return strings.Join(lines, "")
+			}
+			lines = append(lines, line)
+		}
+	}
+
+	if event := readEvent(); event != ": heartbeat\n" {
+		t.Errorf("Expected a heartbeat, got %q", event)
+	}
+	if n := sse.Publish("prices", SSEEvent{ID: "7", Event: "tick", Data: []byte("a\nb"), Retry: 2 * time.Second}); n != 1 {
+		t.Errorf("Expected 1 subscriber, got %d", n)
+	}
+	if n := sse.Publish("news", SSEEvent{Data: []byte("x")}); n != 0 {
+		t.Errorf("Expected no subscribers, got %d", n)
+	}
+	event := readEvent()
+	for event == ": heartbeat\n" {
+		event = readEvent()
+	}
+	if event != "id: 7\nevent: tick\nretry: 2000\ndata: a\ndata: b\n" {
+		t.Errorf("Unexpected event: %q", event)
+	}
+
+	// Topics from the query need AuthorizeTopics
+	if resp, err := http.Get(server.URL + "/events?topic=prices"); err != nil || resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected 403 without AuthorizeTopics, got %v %v", resp, err)
+	}
+	sse.AuthorizeTopics(func(r *http.Request, topic string) bool {
+		return topic == "news"
+	})
+	if resp, err := http.Get(server.URL + "/events?topic=news&topic=prices"); err != nil || resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected 403 for a topic that isn't allowed, got %v %v", resp, err)
+	}
+	if resp, err := http.Get(server.URL + "/events"); err != nil || resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected 400 without topics, got %v %v", resp, err)
+	}
+	news, err := http.Get(server.URL + "/events?topic=news")
+	if err != nil || news.StatusCode != http.StatusOK {
+		t.Fatalf("Expected an allowed topic to subscribe, got %v %v", news, err)
+	}
+	news.Body.Close()
+
+	// Streams end with the app context
+	app_ctx.Close()
+	closed = true
+	if _, err := ioutil.ReadAll(reader); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the subscriber to go", func() bool {
+		return sse.Subscribers("prices") == 0 && sse.Subscribers("news") == 0
+	})
+	if mcli.count("sse.connects") != 2 || mcli.count("sse.disconnects") != 2 || mcli.count("sse.events_sent") != 1 {
+		t.Errorf("Unexpected metrics: %v", mcli.counts)
+	}
+}
+
+func TestSSEEventFields(t *testing.T) {
+	// Newlines in ID and Event can't start fields of their own
+	event := SSEEvent{ID: "7\ndata: injected", Event: "tick\r\nretry: 1", Data: []byte("a")}
+	if encoded := string(event.encode()); encoded != "id: 7data: injected\nevent: tickretry: 1\ndata: a\n\n" {
+		t.Errorf("Unexpected event: %q", encoded)
+	}
+}
+
+func TestSSEHeartbeatClock(t *testing.T) {
+	clock := NewFakeClock(time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC))
+	app_ctx, err := NewAppContext("sse_test", WithClock(clock))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer app_ctx.Close()
+
+	clock.lock.Lock()
+	waiters := len(clock.waiters)
+	clock.lock.Unlock()
+
+	server := httptest.NewServer(app_ctx.SSE().Handler("prices"))
+	defer server.Close()
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	// The heartbeat ticker
+	clock.BlockUntil(waiters + 1)
+	clock.Advance(15 * time.Second)
+	line, err := bufio.NewReader(resp.Body).ReadString('\n')
+	if err != nil || line != ": heartbeat\n" {
+		t.Errorf("Expected a heartbeat from the app context's clock, got %q %v", line, err)
+	}
+}
+
+func TestSSESlowSubscriber(t *testing.T) {
+	os.Setenv("SSE_BUFFER", "1")
+	defer os.Unsetenv("SSE_BUFFER")
+
+	app_ctx, err := NewAppContext("sse_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer app_ctx.Close()
+
+	mcli := newCountingMetricsClient()
+	app_ctx.SetMetricsClient(mcli)
+
+	sse := app_ctx.(*baseAppContext).sse
+	sub, err := sse.subscribe([]string{"a", "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sse.Publish("b", SSEEvent{Data: []byte("1")}) != 1 || sse.Publish("a", SSEEvent{Data: []byte("2")}) != 0 {
+		t.Error("Expected the second event not to fit")
+	}
+	select {
+	case <-sub.slow:
+	default:
+		t.Error("Expected the subscriber to be disconnected")
+	}
+	if mcli.count("sse.slow_subscribers") != 1 {
+		t.Errorf("Unexpected metrics: %v", mcli.counts)
+	}
+}
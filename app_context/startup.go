@@ -0,0 +1,144 @@
+package app_context
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/comstud/go-rollbar/rollbar"
+	"github.com/tilteng/go-metrics/metrics"
+)
+
+// StartupError is what NewAppContext returns when a setup step fails.
+// Error is the step's error; Report adds what had been set up so far.
+type StartupError struct {
+	AppName string
+	// Step is the failed setup step, if it was a timed one
+	Step string
+	Err  error
+	// Completed steps in order, with how long each took
+	Completed []string
+	Durations map[string]time.Duration
+	// Degraded components, with why they failed to start
+	Degraded map[string]string
+}
+
+func (self *StartupError) Error() string {
+	return self.Err.Error()
+}
+
+// Report is a multi line summary of the failure for logs and panics
+func (self *StartupError) Report() string {
+	var buf strings.Builder
+	fmt.Fprintf(&buf, "App context '%s' failed to start: %s\n", self.AppName, self.Err)
+	if self.Step != "" {
+		fmt.Fprintf(&buf, "  failed step: %s\n", self.Step)
+	}
+	if len(self.Completed) > 0 {
+		steps := make([]string, 0, len(self.Completed))
+		for _, name := range self.Completed {
+			steps = append(steps, fmt.Sprintf("%s (%s)", name, self.Durations[name]))
+		}
+		fmt.Fprintf(&buf, "  completed steps: %s\n", strings.Join(steps, ", "))
+	}
+	if len(self.Degraded) > 0 {
+		names := make([]string, 0, len(self.Degraded))
+		for name := range self.Degraded {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(&buf, "  degraded: %s: %s\n", name, self.Degraded[name])
+		}
+	}
+	return buf.String()
+}
+
+func (self *baseAppContext) startupError(err error) *StartupError {
+	completed := make([]string, 0, len(self.initOrder))
+	for _, name := range self.initOrder {
+		if name != self.initFailed {
+			completed = append(completed, name)
+		}
+	}
+	return &StartupError{
+		AppName:   self.appName,
+		Step:      self.initFailed,
+		Err:       err,
+		Completed: completed,
+		Durations: self.initDurations,
+		Degraded:  self.degraded,
+	}
+}
+
+// MustNewAppContext is NewAppContext for main packages, panicking with the
+// StartupError's report if it fails
+func MustNewAppContext(app_name string, opts ...Option) AppContext {
+	appctx, err := NewAppContext(app_name, opts...)
+	if err != nil {
+		if serr, ok := err.(*StartupError); ok {
+			panic(serr.Report())
+		}
+		panic(err)
+	}
+	return appctx
+}
+
+// optionalInit is timeInit for dependencies the app can run without. With
+// ALLOW_DEGRADED_START=true, a failure is logged and recorded in Degraded,
+// reset puts back the NOOP component, and startup carries on.
+func (self *baseAppContext) optionalInit(name string, fn func() error, reset func()) error {
+	err := self.timeInit(name, fn)
+	if err == nil {
+		return nil
+	}
+
+	allow, _, allow_err := self.getBoolFromEnv("ALLOW_DEGRADED_START")
+	if allow_err != nil {
+		return allow_err
+	}
+	if !allow {
+		return err
+	}
+
+	reset()
+	self.initFailed = ""
+	if self.degraded == nil {
+		self.degraded = make(map[string]string)
+	}
+	self.degraded[name] = err.Error()
+	self.Logger().LogWarnf(context.Background(), "Starting without %s: %s", name, err)
+
+	return nil
+}
+
+func (self *baseAppContext) resetMetricsClient() {
+	self.metricsClient = metrics.NewNOOPClient()
+	self.metricsEnabled = false
+}
+
+func (self *baseAppContext) resetRollbarClient() {
+	self.rollbarClient = rollbar.NewNOOPClient()
+	self.rollbarEnabled = false
+	self.rollbarPayload = nil
+}
+
+func (self *baseAppContext) resetCache() {
+	self.cache = NewNOOPCache()
+}
+
+func (self *baseAppContext) resetMessageBus() {
+	self.messageBus = NewNOOPMessageBus()
+}
+
+// Degraded returns the optional components that failed to start under
+// ALLOW_DEGRADED_START, with their errors. They're NOOPs instead.
+func (self *baseAppContext) Degraded() map[string]string {
+	degraded := make(map[string]string, len(self.degraded))
+	for name, err := range self.degraded {
+		degraded[name] = err
+	}
+	return degraded
+}
@@ -0,0 +1,110 @@
+package app_context
+
+import (
+	"context"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestStartupError(t *testing.T) {
+	os.Setenv("CACHE_BACKEND", "bogus")
+	defer os.Unsetenv("CACHE_BACKEND")
+
+	_, err := NewAppContext("startup_test")
+	serr, ok := err.(*StartupError)
+	if !ok {
+		t.Fatalf("Expected a StartupError, got %v", err)
+	}
+	if serr.Step != "cache" || !strings.Contains(serr.Error(), "Unknown CACHE_BACKEND") {
+		t.Errorf("Unexpected error: %+v", serr)
+	}
+	if len(serr.Completed) == 0 || serr.Completed[0] != "config" {
+		t.Errorf("Unexpected completed steps: %v", serr.Completed)
+	}
+	for _, name := range serr.Completed {
+		if name == "cache" {
+			t.Error("The failed step shouldn't be listed as completed")
+		}
+	}
+
+	defer func() {
+		r := recover()
+		report, _ := r.(string)
+		if !strings.Contains(report, "failed step: cache") || !strings.Contains(report, "completed steps: config") {
+			t.Errorf("Unexpected panic: %v", r)
+		}
+	}()
+	MustNewAppContext("startup_test")
+}
+
+func TestDegradedStart(t *testing.T) {
+	os.Setenv("CACHE_BACKEND", "bogus")
+	os.Setenv("ALLOW_DEGRADED_START", "true")
+	defer os.Unsetenv("CACHE_BACKEND")
+	defer os.Unsetenv("ALLOW_DEGRADED_START")
+
+	app_ctx, err := NewAppContext("startup_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer app_ctx.Close()
+
+	degraded := app_ctx.Degraded()
+	if len(degraded) != 1 || !strings.Contains(degraded["cache"], "Unknown CACHE_BACKEND") {
+		t.Errorf("Unexpected degraded components: %v", degraded)
+	}
+	if _, err := app_ctx.Cache().Get(context.Background(), "key"); err != ErrCacheMiss {
+		t.Errorf("Expected the NOOP cache, got %v", err)
+	}
+
+	for _, info := range app_ctx.(*baseAppContext).describeSubsystems() {
+		if info.Name == "cache" && info.Source != "degraded" {
+			t.Errorf("Expected the cache to show as degraded, got %s", info.Source)
+		}
+	}
+
+	// Required components still fail
+	os.Setenv("OBJECT_STORE_URL", "ftp://bucket")
+	defer os.Unsetenv("OBJECT_STORE_URL")
+	if _, err := NewAppContext("startup_test"); err == nil {
+		t.Error("Expected a bad OBJECT_STORE_URL to fail even in degraded mode")
+	}
+}
+
+func TestStartupErrorCloses(t *testing.T) {
+	// A free port, so it can be checked after
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	os.Setenv("ADMIN_PORT", strconv.Itoa(port))
+	defer os.Unsetenv("ADMIN_PORT")
+	os.Setenv("ADMIN_BIND", "127.0.0.1")
+	defer os.Unsetenv("ADMIN_BIND")
+	// Fails after the admin server has started, for want of SERVICE_PORT
+	os.Setenv("SERVICE_DISCOVERY_URL", "http://consul:8500")
+	defer os.Unsetenv("SERVICE_DISCOVERY_URL")
+	if v, ok := os.LookupEnv("SERVICE_PORT"); ok {
+		os.Unsetenv("SERVICE_PORT")
+		defer os.Setenv("SERVICE_PORT", v)
+	}
+
+	_, err = NewAppContext("startup_test")
+	serr, ok := err.(*StartupError)
+	if !ok || serr.Step != "service_discovery" {
+		t.Fatalf("Expected service discovery to fail, got %v", err)
+	}
+
+	l, err = net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	if err != nil {
+		t.Fatalf("Expected the admin port to be released: %s", err)
+	}
+	l.Close()
+}
@@ -0,0 +1,240 @@
+package app_context
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/comstud/go-rollbar/rollbar"
+	"github.com/lib/pq"
+)
+
+type State string
+
+// Transition is one state change, handed to hooks before it's applied
+type Transition struct {
+	Machine string
+	ID      string
+	Event   string
+	From    State
+	To      State
+	// Tx is the transaction the new state is saved in by Apply, nil for Fire
+	Tx *sql.Tx
+}
+
+// TransitionHook runs before a transition is applied. Returning an error
+// stops it.
+type TransitionHook func(ctx context.Context, t *Transition) error
+
+// IllegalTransitionError is returned when an event isn't allowed from the
+// current state
+type IllegalTransitionError struct {
+	Machine string
+	ID      string
+	Event   string
+	From    State
+}
+
+func (self *IllegalTransitionError) Error() string {
+	return fmt.Sprintf("%s %s: can't %s from state '%s'", self.Machine, self.ID, self.Event, self.From)
+}
+
+// ErrStateConflict is returned by StateStore.Save when the state changed
+// since it was loaded
+var ErrStateConflict = errors.New("State was changed concurrently")
+
+// StateStore loads and saves the state of machines by ID within a
+// transaction
+type StateStore interface {
+	Load(ctx context.Context, tx *sql.Tx, id string) (State, error)
+	Save(ctx context.Context, tx *sql.Tx, id string, from, to State) error
+}
+
+type dbStateStore struct {
+	table       string
+	idColumn    string
+	stateColumn string
+}
+
+// NewDBStateStore keeps states in state_column of an existing table, so
+// status columns can be moved onto a StateMachine without a migration.
+// Rows are locked while a transition is applied.
+func NewDBStateStore(table, id_column, state_column string) StateStore {
+	return &dbStateStore{
+		table:       pq.QuoteIdentifier(table),
+		idColumn:    pq.QuoteIdentifier(id_column),
+		stateColumn: pq.QuoteIdentifier(state_column),
+	}
+}
+
+func (self *dbStateStore) Load(ctx context.Context, tx *sql.Tx, id string) (State, error) {
+	var state string
+	err := tx.QueryRowContext(
+		ctx,
+		fmt.Sprintf("SELECT %s FROM %s WHERE %s = $1 FOR UPDATE", self.stateColumn, self.table, self.idColumn),
+		id,
+	).Scan(&state)
+	return State(state), err
+}
+
+func (self *dbStateStore) Save(ctx context.Context, tx *sql.Tx, id string, from, to State) error {
+	res, err := tx.ExecContext(
+		ctx,
+		fmt.Sprintf(
+			"UPDATE %s SET %s = $1 WHERE %s = $2 AND %s = $3",
+			self.table, self.stateColumn, self.idColumn, self.stateColumn,
+		),
+		string(to), id, string(from),
+	)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n != 1 {
+		return ErrStateConflict
+	}
+	return nil
+}
+
+// StateMachine holds the transitions allowed between states. Define it
+// once at startup; it's safe for concurrent use once defined.
+//
+// Applied transitions are counted in state_machine.transitions and
+// published on the message bus as JSON to
+// state_machine.<machine>.<event>. Illegal ones are counted in
+// state_machine.illegal_transitions and reported.
+type StateMachine struct {
+	appctx *baseAppContext
+	name   string
+	// event -> from -> to
+	transitions map[string]map[State]State
+	hooks       []TransitionHook
+}
+
+// Transition lets event move the machine from any of the from states to
+// to. Defining the same event twice from a state panics.
+func (self *StateMachine) Transition(event string, to State, from ...State) *StateMachine {
+	by_from, ok := self.transitions[event]
+	if !ok {
+		by_from = make(map[State]State)
+		self.transitions[event] = by_from
+	}
+	for _, state := range from {
+		if _, ok := by_from[state]; ok {
+			panic(fmt.Sprintf("%s: '%s' from '%s' is already defined", self.name, event, state))
+		}
+		by_from[state] = to
+	}
+	return self
+}
+
+func (self *StateMachine) OnTransition(hook TransitionHook) *StateMachine {
+	self.hooks = append(self.hooks, hook)
+	return self
+}
+
+// Can returns whether event is allowed from state
+func (self *StateMachine) Can(from State, event string) bool {
+	_, ok := self.transitions[event][from]
+	return ok
+}
+
+// transition reports illegal transitions unless tx is set, in which case
+// WithTx reports the error it fails with
+func (self *StateMachine) transition(ctx context.Context, tx *sql.Tx, id string, from State, event string) (*Transition, error) {
+	to, ok := self.transitions[event][from]
+	if !ok {
+		err := &IllegalTransitionError{Machine: self.name, ID: id, Event: event, From: from}
+		self.appctx.Logger().LogWarnf(ctx, "%s", err)
+		self.appctx.MetricsClient().Incr(
+			"state_machine.illegal_transitions",
+			1.0,
+			map[string]string{"machine": self.name, "event": event, "from": string(from)},
+		)
+		if tx == nil {
+			self.appctx.reportError(err, rollbar.CustomInfo{
+				"machine": self.name,
+				"id":      id,
+				"event":   event,
+				"from":    string(from),
+			})
+		}
+		return nil, err
+	}
+
+	t := &Transition{Machine: self.name, ID: id, Event: event, From: from, To: to, Tx: tx}
+	for _, hook := range self.hooks {
+		if err := hook(ctx, t); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+func (self *StateMachine) applied(ctx context.Context, t *Transition) {
+	self.appctx.MetricsClient().Incr(
+		"state_machine.transitions",
+		1.0,
+		map[string]string{"machine": self.name, "event": t.Event, "from": string(t.From), "to": string(t.To)},
+	)
+
+	data, _ := json.Marshal(map[string]interface{}{
+		"machine":    t.Machine,
+		"id":         t.ID,
+		"event":      t.Event,
+		"from":       t.From,
+		"to":         t.To,
+		"request_id": RequestIDFromContext(ctx),
+		"at":         self.appctx.Clock().Now().UTC(),
+	})
+	subject := "state_machine." + self.name + "." + t.Event
+	if err := self.appctx.MessageBus().Publish(subject, data); err != nil {
+		self.appctx.Logger().LogErrorf(ctx, "Error publishing %s: %s", subject, err)
+	}
+}
+
+// Fire checks event is allowed from the caller's current state and runs the
+// hooks, leaving saving the new state to the caller.
+func (self *StateMachine) Fire(ctx context.Context, id string, from State, event string) (*Transition, error) {
+	t, err := self.transition(ctx, nil, id, from, event)
+	if err != nil {
+		return nil, err
+	}
+	self.applied(ctx, t)
+	return t, nil
+}
+
+// Apply loads id's state from store, checks event is allowed, runs the
+// hooks and saves the new state, all in one transaction with WithTx. Hooks
+// may run more than once if the transaction is retried.
+func (self *StateMachine) Apply(ctx context.Context, store StateStore, id string, event string) (*Transition, error) {
+	var t *Transition
+	err := self.appctx.WithTx(ctx, func(tx *sql.Tx) error {
+		from, err := store.Load(ctx, tx, id)
+		if err != nil {
+			return err
+		}
+		if t, err = self.transition(ctx, tx, id, from, event); err != nil {
+			return err
+		}
+		return store.Save(ctx, tx, id, from, t.To)
+	})
+	if err != nil {
+		return nil, err
+	}
+	self.applied(ctx, t)
+	return t, nil
+}
+
+// StateMachine starts defining a state machine. name tags its metrics and
+// events.
+func (self *baseAppContext) StateMachine(name string) *StateMachine {
+	return &StateMachine{
+		appctx:      self,
+		name:        name,
+		transitions: make(map[string]map[State]State),
+	}
+}
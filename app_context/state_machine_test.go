@@ -0,0 +1,113 @@
+package app_context
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"testing"
+)
+
+type memStateStore map[string]State
+
+func (self memStateStore) Load(ctx context.Context, tx *sql.Tx, id string) (State, error) {
+	state, ok := self[id]
+	if !ok {
+		return "", sql.ErrNoRows
+	}
+	return state, nil
+}
+
+func (self memStateStore) Save(ctx context.Context, tx *sql.Tx, id string, from, to State) error {
+	if self[id] != from {
+		return ErrStateConflict
+	}
+	self[id] = to
+	return nil
+}
+
+func TestStateMachine(t *testing.T) {
+	app_ctx, err := NewAppContext("state_machine_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer app_ctx.Close()
+
+	app_ctx.SetMessageBus(NewMemoryMessageBus())
+	mcli := newCountingMetricsClient()
+	app_ctx.SetMetricsClient(mcli)
+
+	db, err := app_ctx.(*baseAppContext).openDB("appctx_fake", "", "primary")
+	if err != nil {
+		t.Fatal(err)
+	}
+	app_ctx.SetDB(db)
+
+	var events []map[string]interface{}
+	app_ctx.MessageBus().Subscribe("state_machine.order.>", func(msg *BusMessage) {
+		var event map[string]interface{}
+		json.Unmarshal(msg.Data, &event)
+		events = append(events, event)
+	})
+
+	var hooked []*Transition
+	machine := app_ctx.StateMachine("order").
+		Transition("pay", "paid", "pending").
+		Transition("ship", "shipped", "paid").
+		Transition("cancel", "cancelled", "pending", "paid").
+		OnTransition(func(ctx context.Context, tr *Transition) error {
+			if tr.To == "shipped" && tr.ID == "no-address" {
+				return errors.New("No address")
+			}
+			hooked = append(hooked, tr)
+			return nil
+		})
+
+	if !machine.Can("paid", "cancel") || machine.Can("shipped", "cancel") {
+		t.Errorf("Unexpected Can results")
+	}
+
+	tr, err := machine.Fire(context.Background(), "1", "pending", "pay")
+	if err != nil || tr.To != "paid" || tr.Tx != nil {
+		t.Fatalf("Unexpected Fire result: %+v, %v", tr, err)
+	}
+
+	store := memStateStore{"2": "paid", "no-address": "paid"}
+	tr, err = machine.Apply(context.Background(), store, "2", "ship")
+	if err != nil || store["2"] != "shipped" || tr.Tx == nil {
+		t.Fatalf("Unexpected Apply result: %+v, %v", tr, err)
+	}
+
+	_, err = machine.Apply(context.Background(), store, "2", "cancel")
+	if illegal, ok := err.(*IllegalTransitionError); !ok || illegal.From != "shipped" {
+		t.Errorf("Expected an IllegalTransitionError, got %v", err)
+	}
+	if _, err := machine.Fire(context.Background(), "3", "shipped", "pay"); err == nil {
+		t.Errorf("Expected an illegal transition")
+	}
+
+	if _, err := machine.Apply(context.Background(), store, "no-address", "ship"); err == nil || store["no-address"] != "paid" {
+		t.Errorf("Expected the hook to stop the transition, got %v", err)
+	}
+
+	if len(hooked) != 2 {
+		t.Errorf("Expected 2 hooked transitions, got %d", len(hooked))
+	}
+	if len(events) != 2 || events[1]["id"] != "2" || events[1]["from"] != "paid" || events[1]["to"] != "shipped" {
+		t.Errorf("Unexpected events: %v", events)
+	}
+	if c := mcli.count("state_machine.transitions"); c != 2 {
+		t.Errorf("Expected 2 transitions, got %d", c)
+	}
+	if c := mcli.count("state_machine.illegal_transitions"); c != 2 {
+		t.Errorf("Expected 2 illegal transitions, got %d", c)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("Expected defining a transition twice to panic")
+		}
+	}()
+	machine.Transition("pay", "paid", "pending")
+}
@@ -1,6 +1,7 @@
 package app_context
 
 import (
+	"errors"
 	"time"
 
 	"github.com/shirou/gopsutil/net"
@@ -8,6 +9,7 @@ import (
 )
 
 func (self *baseAppContext) sendNetworkStats(previous *metrics.ProcStats, current *metrics.ProcStats) {
+	mcli := self.MetricsClient()
 	delta := current.Timestamp.Sub(previous.Timestamp).Seconds()
 
 	for i, counters := range current.IOCounters {
@@ -31,54 +33,54 @@ func (self *baseAppContext) sendNetworkStats(previous *metrics.ProcStats, curren
 
 		prefix := "proc_stats.net." + counters.Name
 
-		self.metricsClient.Histogram(
+		mcli.Histogram(
 			prefix+".bytes_sent",
 			float64(counters.BytesSent-prev_counters.BytesSent),
 			delta,
 			nil,
 		)
 
-		self.metricsClient.Histogram(
+		mcli.Histogram(
 			prefix+".bytes_recv",
 			float64(counters.BytesRecv-prev_counters.BytesRecv),
 			delta,
 			nil,
 		)
 
-		self.metricsClient.Histogram(
+		mcli.Histogram(
 			prefix+".packets_sent",
 			float64(counters.PacketsSent-prev_counters.PacketsSent),
 			delta,
 			nil,
 		)
 
-		self.metricsClient.Histogram(
+		mcli.Histogram(
 			prefix+".packets_recv",
 			float64(counters.PacketsRecv-prev_counters.PacketsRecv),
 			delta,
 			nil,
 		)
 
-		self.metricsClient.Count(
+		mcli.Count(
 			prefix+".num_errors_out",
 			int64(counters.Errout-prev_counters.Errout),
 			delta,
 			nil,
 		)
-		self.metricsClient.Count(
+		mcli.Count(
 			prefix+".num_errors_in",
 			int64(counters.Errin-prev_counters.Errin),
 			delta,
 			nil,
 		)
 
-		self.metricsClient.Count(
+		mcli.Count(
 			prefix+".num_dropped_out",
 			int64(counters.Dropout-prev_counters.Dropout),
 			delta,
 			nil,
 		)
-		self.metricsClient.Count(
+		mcli.Count(
 			prefix+".num_dropped_in",
 			int64(counters.Dropin-prev_counters.Dropin),
 			delta,
@@ -88,90 +90,106 @@ func (self *baseAppContext) sendNetworkStats(previous *metrics.ProcStats, curren
 }
 
 func (self *baseAppContext) sendMemStats(previous *metrics.ProcStats, current *metrics.ProcStats) {
+	mcli := self.MetricsClient()
 	delta := current.Timestamp.Sub(previous.Timestamp).Seconds()
 
-	self.metricsClient.Histogram(
+	mcli.Histogram(
 		"proc_stats.mem.alloc.non_freed_bytes",
 		float64(current.MemStats.Alloc),
 		delta,
 		nil,
 	)
 
-	self.metricsClient.Histogram(
+	mcli.Histogram(
 		"proc_stats.mem.alloc.total_bytes",
 		float64(current.MemStats.Alloc),
 		delta,
 		nil,
 	)
 
-	self.metricsClient.Count(
+	mcli.Count(
 		"proc_stats.mem.alloc.count",
 		int64(current.MemStats.Mallocs-previous.MemStats.Mallocs),
 		delta,
 		nil,
 	)
 
-	self.metricsClient.Histogram(
+	mcli.Histogram(
 		"proc_stats.mem.heap.bytes_alloc",
 		float64(current.MemStats.HeapAlloc),
 		delta,
 		nil,
 	)
 
-	self.metricsClient.Histogram(
+	mcli.Histogram(
 		"proc_stats.mem.heap.bytes_in_use",
 		float64(current.MemStats.HeapInuse),
 		delta,
 		nil,
 	)
 
-	self.metricsClient.Histogram(
+	mcli.Histogram(
 		"proc_stats.mem.heap.bytes_released",
 		float64(current.MemStats.HeapReleased),
 		delta,
 		nil,
 	)
 
-	self.metricsClient.Histogram(
+	mcli.Gauge(
+		"proc_stats.mem.heap.bytes_sys",
+		float64(current.MemStats.HeapSys),
+		delta,
+		nil,
+	)
+
+	mcli.Histogram(
 		"proc_stats.mem.heap.num_objects",
 		float64(current.MemStats.HeapObjects),
 		delta,
 		nil,
 	)
 
-	self.metricsClient.Histogram(
+	mcli.Histogram(
 		"proc_stats.mem.gc.pause_ms",
 		float64((current.MemStats.PauseTotalNs-previous.MemStats.PauseTotalNs))/float64(time.Millisecond),
 		delta,
 		nil,
 	)
 
-	self.metricsClient.Count(
+	mcli.Count(
 		"proc_stats.mem.gc.count",
 		int64(current.MemStats.NumGC)-int64(previous.MemStats.NumGC),
 		delta,
 		nil,
 	)
+
+	mcli.Gauge(
+		"proc_stats.mem.gc.next_target_bytes",
+		float64(current.MemStats.NextGC),
+		delta,
+		nil,
+	)
 }
 
 func (self *baseAppContext) sendCPUStats(previous *metrics.ProcStats, current *metrics.ProcStats) {
+	mcli := self.MetricsClient()
 	delta := current.Timestamp.Sub(previous.Timestamp).Seconds()
 
-	self.metricsClient.Gauge(
+	mcli.Gauge(
 		"proc_stats.num_cpus",
 		float64(current.NumCPUs),
 		delta,
 		nil,
 	)
 
-	self.metricsClient.Histogram(
+	mcli.Histogram(
 		"proc_stats.cpu.user_percent",
 		100.0*(current.CPUTimes.User-previous.CPUTimes.User),
 		delta,
 		nil,
 	)
 
-	self.metricsClient.Histogram(
+	mcli.Histogram(
 		"proc_stats.cpu.sys_percent",
 		100.0*(current.CPUTimes.System-previous.CPUTimes.System),
 		delta,
@@ -184,6 +202,8 @@ func (self *baseAppContext) SendStats(previous *metrics.ProcStats, current *metr
 		return
 	}
 
+	mcli := self.MetricsClient()
+
 	self.sendCPUStats(previous, current)
 	self.sendMemStats(previous, current)
 	self.sendNetworkStats(previous, current)
@@ -192,7 +212,7 @@ func (self *baseAppContext) SendStats(previous *metrics.ProcStats, current *metr
 
 	if db := self.DB(); db != nil {
 		db_stats := db.Stats()
-		self.metricsClient.Gauge(
+		mcli.Gauge(
 			"proc_stats.db.num_connections",
 			float64(db_stats.OpenConnections),
 			delta,
@@ -200,17 +220,38 @@ func (self *baseAppContext) SendStats(previous *metrics.ProcStats, current *metr
 		)
 	}
 
-	self.metricsClient.Histogram(
+	mcli.Histogram(
 		"proc_stats.num_goroutines",
 		float64(current.NumGoRoutines),
 		delta,
 		nil,
 	)
 
-	self.metricsClient.Gauge(
+	mcli.Gauge(
 		"proc_stats.files.num_open",
 		float64(current.NumFDs),
 		delta,
 		nil,
 	)
 }
+
+// RUNTIME_METRICS=true starts the stats sender with the app context, so the
+// runtime, process and DB pool stats are sent every
+// RUNTIME_METRICS_INTERVAL (default 1s, also used by StartStatsSender)
+// until Close.
+func (self *baseAppContext) setRuntimeMetricsFromEnv() error {
+	if interval, found, err := self.getDurationFromEnv("RUNTIME_METRICS_INTERVAL"); err != nil {
+		return err
+	} else if found {
+		if interval <= 0 {
+			return errors.New("RUNTIME_METRICS_INTERVAL must be > 0")
+		}
+		self.statsInterval = interval
+	}
+
+	enabled, _, err := self.getBoolFromEnv("RUNTIME_METRICS")
+	if err != nil || !enabled {
+		return err
+	}
+	return self.StartStatsSender()
+}
@@ -2,6 +2,7 @@ package app_context
 
 import (
 	"log"
+	"os"
 	"testing"
 )
 
@@ -41,3 +42,37 @@ func TestStatsSender(t *testing.T) {
 		t.Errorf("Stopping stats sender failed when running: %+v", err)
 	}
 }
+
+func TestRuntimeMetrics(t *testing.T) {
+	os.Setenv("RUNTIME_METRICS", "true")
+	os.Setenv("RUNTIME_METRICS_INTERVAL", "10ms")
+	// Another test may leave it set
+	os.Setenv("METRICS_DISABLE", "false")
+	defer os.Unsetenv("RUNTIME_METRICS")
+	defer os.Unsetenv("RUNTIME_METRICS_INTERVAL")
+	defer os.Unsetenv("METRICS_DISABLE")
+
+	app_ctx, err := NewAppContext("stats_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	mcli := newCountingMetricsClient()
+	app_ctx.SetMetricsClient(mcli)
+
+	waitFor(t, "runtime metrics", func() bool {
+		return mcli.count("proc_stats.mem.gc.next_target_bytes") >= 2
+	})
+
+	if err := app_ctx.Close(); err != nil {
+		t.Fatalf("Close failed: %s", err)
+	}
+	if err := app_ctx.StopStatsSender(); err == nil {
+		t.Error("Stats sender still running after Close")
+	}
+
+	os.Setenv("RUNTIME_METRICS_INTERVAL", "0s")
+	if _, err := NewAppContext("stats_test"); err == nil {
+		t.Error("RUNTIME_METRICS_INTERVAL=0s didn't fail")
+	}
+}
@@ -0,0 +1,577 @@
+package app_context
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// Channels a SuppressionList keeps addresses for
+const (
+	ChannelEmail = "email"
+	ChannelSMS   = "sms"
+)
+
+// Reasons an address is suppressed by the webhook handlers
+const (
+	SuppressionBounce      = "bounce"
+	SuppressionComplaint   = "complaint"
+	SuppressionUnsubscribe = "unsubscribe"
+)
+
+// Suppression is an address nothing may be sent to on a channel
+type Suppression struct {
+	Channel   string    `json:"channel"`
+	Address   string    `json:"address"`
+	Reason    string    `json:"reason"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// SuppressionList is the addresses that mustn't be sent to: hard bounces,
+// complaints and unsubscribes. Mailer skips suppressed recipients, and
+// anything else that sends, eg. SMS, should check Suppressed first.
+// Addresses are compared case insensitively for email, and ignoring
+// spaces, dashes, dots and parentheses for SMS.
+type SuppressionList interface {
+	// Add suppresses address, replacing the reason if it already is
+	Add(ctx context.Context, channel, address, reason string) error
+	Remove(ctx context.Context, channel, address string) error
+	// Get returns nil if address isn't suppressed
+	Get(ctx context.Context, channel, address string) (*Suppression, error)
+	// Suppressed returns those of addresses that are suppressed
+	Suppressed(ctx context.Context, channel string, addresses []string) (map[string]bool, error)
+	// SESWebhookHandler takes SES bounce and complaint notifications
+	// delivered by SNS, confirming the SNS subscription
+	SESWebhookHandler() http.Handler
+	// SendGridWebhookHandler takes SendGrid's event webhook
+	SendGridWebhookHandler() http.Handler
+}
+
+// normalizeAddress is the form addresses are stored in
+func normalizeAddress(channel, address string) string {
+	address = strings.TrimSpace(address)
+	switch channel {
+	case ChannelEmail:
+		return strings.ToLower(address)
+	case ChannelSMS:
+		return strings.Map(func(r rune) rune {
+			switch r {
+			case ' ', '-', '.', '(', ')':
+				return -1
+			}
+			return r
+		}, address)
+	}
+	return address
+}
+
+// suppressionStore keeps normalized suppressions. get returns those of
+// addresses that are suppressed.
+type suppressionStore interface {
+	add(ctx context.Context, s *Suppression) error
+	remove(ctx context.Context, channel, address string) error
+	get(ctx context.Context, channel string, addresses []string) (map[string]*Suppression, error)
+}
+
+type memorySuppressionStore struct {
+	lock         sync.Mutex
+	suppressions map[string]*Suppression
+}
+
+func (self *memorySuppressionStore) add(ctx context.Context, s *Suppression) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	copied := *s
+	self.suppressions[s.Channel+":"+s.Address] = &copied
+	return nil
+}
+
+func (self *memorySuppressionStore) remove(ctx context.Context, channel, address string) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	delete(self.suppressions, channel+":"+address)
+	return nil
+}
+
+func (self *memorySuppressionStore) get(ctx context.Context, channel string, addresses []string) (map[string]*Suppression, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	found := make(map[string]*Suppression)
+	for _, address := range addresses {
+		if s, ok := self.suppressions[channel+":"+address]; ok {
+			copied := *s
+			found[address] = &copied
+		}
+	}
+	return found, nil
+}
+
+// pgSuppressionStore keeps suppressions in the suppressions table,
+// created on first use
+type pgSuppressionStore struct {
+	appctx *baseAppContext
+	lock   sync.Mutex
+	ready  bool
+}
+
+func (self *pgSuppressionStore) db(ctx context.Context) (*sqlx.DB, error) {
+	db := self.appctx.DBWrite()
+	if db == nil {
+		return nil, errors.New("No database for suppressions")
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if !self.ready {
+		if _, err := db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS suppressions (
+			channel text NOT NULL,
+			address text NOT NULL,
+			reason text NOT NULL,
+			created_at timestamptz NOT NULL,
+			PRIMARY KEY (channel, address)
+		)`); err != nil {
+			return nil, fmt.Errorf("Error creating suppressions: %s", err)
+		}
+		self.ready = true
+	}
+	return db, nil
+}
+
+func (self *pgSuppressionStore) add(ctx context.Context, s *Suppression) error {
+	db, err := self.db(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = db.ExecContext(
+		ctx,
+		`INSERT INTO suppressions (channel, address, reason, created_at) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (channel, address) DO UPDATE SET reason = $3`,
+		s.Channel, s.Address, s.Reason, s.CreatedAt,
+	)
+	return err
+}
+
+func (self *pgSuppressionStore) remove(ctx context.Context, channel, address string) error {
+	db, err := self.db(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = db.ExecContext(ctx, `DELETE FROM suppressions WHERE channel = $1 AND address = $2`, channel, address)
+	return err
+}
+
+func (self *pgSuppressionStore) get(ctx context.Context, channel string, addresses []string) (map[string]*Suppression, error) {
+	db, err := self.db(ctx)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.QueryContext(
+		ctx,
+		`SELECT address, reason, created_at FROM suppressions WHERE channel = $1 AND address = ANY($2)`,
+		channel, pq.Array(addresses),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	found := make(map[string]*Suppression)
+	for rows.Next() {
+		s := &Suppression{Channel: channel}
+		if err := rows.Scan(&s.Address, &s.Reason, &s.CreatedAt); err != nil {
+			return nil, err
+		}
+		found[s.Address] = s
+	}
+	return found, rows.Err()
+}
+
+// redisSuppressionStore keeps each channel's suppressions in a hash of
+// address to JSON. Keys aren't prefixed with the app name, so every app
+// using the same redis shares them.
+type redisSuppressionStore struct {
+	client *redisClient
+}
+
+type redisSuppression struct {
+	Reason    string    `json:"reason"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (self *redisSuppressionStore) key(channel string) string {
+	return "suppressions:" + channel
+}
+
+func (self *redisSuppressionStore) add(ctx context.Context, s *Suppression) error {
+	data, _ := json.Marshal(&redisSuppression{Reason: s.Reason, CreatedAt: s.CreatedAt})
+	_, err := self.client.do(ctx, "HSET", self.key(s.Channel), s.Address, string(data))
+	return err
+}
+
+func (self *redisSuppressionStore) remove(ctx context.Context, channel, address string) error {
+	_, err := self.client.do(ctx, "HDEL", self.key(channel), address)
+	return err
+}
+
+func (self *redisSuppressionStore) get(ctx context.Context, channel string, addresses []string) (map[string]*Suppression, error) {
+	found := make(map[string]*Suppression)
+	if len(addresses) == 0 {
+		return found, nil
+	}
+	reply, err := self.client.do(ctx, append([]string{"HMGET", self.key(channel)}, addresses...)...)
+	if err != nil {
+		return nil, err
+	}
+	values, ok := reply.([]interface{})
+	if !ok || len(values) != len(addresses) {
+		return nil, errors.New("Unexpected HMGET reply")
+	}
+	for i, value := range values {
+		data, ok := value.(string)
+		if !ok {
+			continue
+		}
+		var rs redisSuppression
+		if err := json.Unmarshal([]byte(data), &rs); err != nil {
+			return nil, fmt.Errorf("Error decoding suppression of %s: %s", addresses[i], err)
+		}
+		found[addresses[i]] = &Suppression{
+			Channel:   channel,
+			Address:   addresses[i],
+			Reason:    rs.Reason,
+			CreatedAt: rs.CreatedAt,
+		}
+	}
+	return found, nil
+}
+
+type suppressionList struct {
+	appctx       *baseAppContext
+	backend      string
+	webhookToken string
+
+	lock  sync.Mutex
+	store suppressionStore
+}
+
+func newSuppressionList(appctx *baseAppContext) *suppressionList {
+	return &suppressionList{appctx: appctx}
+}
+
+// storeFor picks the store on first use when there's no
+// SUPPRESSION_BACKEND, since a database may be given with SetDB after
+// startup
+func (self *suppressionList) storeFor() suppressionStore {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.store == nil {
+		if self.appctx.DBWrite() != nil {
+			self.store = &pgSuppressionStore{appctx: self.appctx}
+		} else {
+			self.store = &memorySuppressionStore{suppressions: make(map[string]*Suppression)}
+		}
+	}
+	return self.store
+}
+
+func (self *suppressionList) Add(ctx context.Context, channel, address, reason string) error {
+	s := &Suppression{
+		Channel:   channel,
+		Address:   normalizeAddress(channel, address),
+		Reason:    reason,
+		CreatedAt: self.appctx.now(),
+	}
+	if s.Address == "" {
+		return errors.New("Can't suppress an empty address")
+	}
+	if err := self.storeFor().add(ctx, s); err != nil {
+		return fmt.Errorf("Error suppressing %s address: %s", channel, err)
+	}
+	self.appctx.MetricsClient().Incr("suppression.added", 1.0, map[string]string{"channel": channel, "reason": reason})
+	return nil
+}
+
+func (self *suppressionList) Remove(ctx context.Context, channel, address string) error {
+	if err := self.storeFor().remove(ctx, channel, normalizeAddress(channel, address)); err != nil {
+		return fmt.Errorf("Error removing suppressed %s address: %s", channel, err)
+	}
+	self.appctx.MetricsClient().Incr("suppression.removed", 1.0, map[string]string{"channel": channel})
+	return nil
+}
+
+func (self *suppressionList) Get(ctx context.Context, channel, address string) (*Suppression, error) {
+	normalized := normalizeAddress(channel, address)
+	found, err := self.storeFor().get(ctx, channel, []string{normalized})
+	if err != nil {
+		return nil, fmt.Errorf("Error checking suppressions: %s", err)
+	}
+	return found[normalized], nil
+}
+
+func (self *suppressionList) Suppressed(ctx context.Context, channel string, addresses []string) (map[string]bool, error) {
+	normalized := make([]string, len(addresses))
+	for i, address := range addresses {
+		normalized[i] = normalizeAddress(channel, address)
+	}
+	found, err := self.storeFor().get(ctx, channel, normalized)
+	if err != nil {
+		return nil, fmt.Errorf("Error checking suppressions: %s", err)
+	}
+	suppressed := make(map[string]bool)
+	for i, address := range addresses {
+		if _, ok := found[normalized[i]]; ok {
+			suppressed[address] = true
+		}
+	}
+	return suppressed, nil
+}
+
+// webhookAuthorized checks for SUPPRESSION_WEBHOOK_TOKEN as the token
+// query parameter or the basic auth password, which SNS and SendGrid can
+// both be given in the webhook URL. Without the setting nothing is
+// authorized.
+func (self *suppressionList) webhookAuthorized(r *http.Request) bool {
+	if self.webhookToken == "" {
+		return false
+	}
+	token := r.URL.Query().Get("token")
+	if _, password, ok := r.BasicAuth(); ok {
+		token = password
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(self.webhookToken)) == 1
+}
+
+// ingest adds each of addresses, returning how many were added
+func (self *suppressionList) ingest(ctx context.Context, addresses []string, reason string) (int, error) {
+	for i, address := range addresses {
+		if err := self.Add(ctx, ChannelEmail, address, reason); err != nil {
+			return i, err
+		}
+	}
+	return len(addresses), nil
+}
+
+func (self *suppressionList) webhookHandler(parse func(*http.Request) (map[string][]string, error)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			writeAdminError(w, http.StatusMethodNotAllowed, "Only POST is allowed")
+			return
+		}
+		if !self.webhookAuthorized(r) {
+			writeAdminError(w, http.StatusUnauthorized, "A valid SUPPRESSION_WEBHOOK_TOKEN is required")
+			return
+		}
+
+		by_reason, err := parse(r)
+		if err != nil {
+			writeAdminError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		added := 0
+		for reason, addresses := range by_reason {
+			n, err := self.ingest(r.Context(), addresses, reason)
+			added += n
+			if err != nil {
+				self.appctx.Logger().LogErrorf(r.Context(), "Error ingesting suppressions: %s", err)
+				// Providers retry on errors
+				writeAdminError(w, http.StatusServiceUnavailable, "Couldn't save suppressions")
+				return
+			}
+		}
+		writeAdminJSON(w, http.StatusOK, map[string]int{"added": added})
+	})
+}
+
+type snsMessage struct {
+	Type         string
+	Message      string
+	SubscribeURL string
+}
+
+type sesRecipient struct {
+	EmailAddress string `json:"emailAddress"`
+}
+
+type sesNotification struct {
+	// notificationType for SES notifications, eventType for event
+	// publishing
+	NotificationType string `json:"notificationType"`
+	EventType        string `json:"eventType"`
+	Bounce           struct {
+		BounceType        string         `json:"bounceType"`
+		BouncedRecipients []sesRecipient `json:"bouncedRecipients"`
+	} `json:"bounce"`
+	Complaint struct {
+		ComplainedRecipients []sesRecipient `json:"complainedRecipients"`
+	} `json:"complaint"`
+}
+
+// confirmSNSSubscription visits the subscription's confirmation URL, which
+// must be an https URL of AWS's
+func (self *suppressionList) confirmSNSSubscription(ctx context.Context, raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || u.Scheme != "https" || !strings.HasSuffix(u.Hostname(), ".amazonaws.com") {
+		return fmt.Errorf("Invalid SubscribeURL '%s'", raw)
+	}
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := self.appctx.HTTPClient().Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Confirming the SNS subscription returned %s", resp.Status)
+	}
+	return nil
+}
+
+// parseSES finds permanent bounces and complaints. Transient bounces are
+// left alone, as a later send may well succeed.
+func (self *suppressionList) parseSES(r *http.Request) (map[string][]string, error) {
+	var msg snsMessage
+	if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+		return nil, fmt.Errorf("Invalid SNS message: %s", err)
+	}
+
+	by_reason := make(map[string][]string)
+	switch msg.Type {
+	case "SubscriptionConfirmation":
+		if err := self.confirmSNSSubscription(r.Context(), msg.SubscribeURL); err != nil {
+			return nil, err
+		}
+		return by_reason, nil
+	case "Notification":
+	default:
+		return by_reason, nil
+	}
+
+	var n sesNotification
+	if err := json.Unmarshal([]byte(msg.Message), &n); err != nil {
+		return nil, fmt.Errorf("Invalid SES notification: %s", err)
+	}
+	kind := n.NotificationType
+	if kind == "" {
+		kind = n.EventType
+	}
+	switch kind {
+	case "Bounce":
+		if n.Bounce.BounceType == "Permanent" {
+			for _, rcpt := range n.Bounce.BouncedRecipients {
+				by_reason[SuppressionBounce] = append(by_reason[SuppressionBounce], rcpt.EmailAddress)
+			}
+		}
+	case "Complaint":
+		for _, rcpt := range n.Complaint.ComplainedRecipients {
+			by_reason[SuppressionComplaint] = append(by_reason[SuppressionComplaint], rcpt.EmailAddress)
+		}
+	}
+	return by_reason, nil
+}
+
+type sendgridEvent struct {
+	Email string `json:"email"`
+	Event string `json:"event"`
+	Type  string `json:"type"`
+}
+
+// parseSendGrid finds bounces, spam reports and unsubscribes. A bounce
+// event with type "blocked" is a temporary rejection and is left alone.
+func (self *suppressionList) parseSendGrid(r *http.Request) (map[string][]string, error) {
+	var events []sendgridEvent
+	if err := json.NewDecoder(r.Body).Decode(&events); err != nil {
+		return nil, fmt.Errorf("Invalid SendGrid events: %s", err)
+	}
+
+	by_reason := make(map[string][]string)
+	for _, ev := range events {
+		reason := ""
+		switch ev.Event {
+		case "bounce":
+			if ev.Type != "blocked" {
+				reason = SuppressionBounce
+			}
+		case "spamreport":
+			reason = SuppressionComplaint
+		case "unsubscribe", "group_unsubscribe":
+			reason = SuppressionUnsubscribe
+		}
+		if reason != "" && ev.Email != "" {
+			by_reason[reason] = append(by_reason[reason], ev.Email)
+		}
+	}
+	return by_reason, nil
+}
+
+func (self *suppressionList) SESWebhookHandler() http.Handler {
+	return self.webhookHandler(self.parseSES)
+}
+
+func (self *suppressionList) SendGridWebhookHandler() http.Handler {
+	return self.webhookHandler(self.parseSendGrid)
+}
+
+func (self *suppressionList) close() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if store, ok := self.store.(*redisSuppressionStore); ok {
+		store.client.close()
+	}
+}
+
+func (self *suppressionList) status() map[string]interface{} {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return map[string]interface{}{
+		"backend": self.backend,
+		"store":   typeName(self.store),
+		"webhook": self.webhookToken != "",
+	}
+}
+
+func (self *baseAppContext) Suppressions() SuppressionList {
+	return self.suppressions
+}
+
+// SUPPRESSION_BACKEND is postgres, redis (with SUPPRESSION_REDIS_URL) or
+// memory. By default suppressions are kept in the database if there is one
+// and otherwise only in memory. SUPPRESSION_WEBHOOK_TOKEN enables the
+// webhook handlers.
+func (self *baseAppContext) setSuppressionsFromEnv() error {
+	sl := self.suppressions
+	sl.webhookToken = self.getEnv("SUPPRESSION_WEBHOOK_TOKEN")
+
+	switch sl.backend = self.getEnv("SUPPRESSION_BACKEND"); sl.backend {
+	case "":
+	case "postgres":
+		sl.store = &pgSuppressionStore{appctx: self}
+	case "memory":
+		sl.store = &memorySuppressionStore{suppressions: make(map[string]*Suppression)}
+	case "redis":
+		redis_url := self.getEnv("SUPPRESSION_REDIS_URL")
+		if redis_url == "" {
+			return errors.New("SUPPRESSION_REDIS_URL is required with SUPPRESSION_BACKEND=redis")
+		}
+		client, err := newRedisClient(redis_url, time.Second)
+		if err != nil {
+			return fmt.Errorf("Invalid SUPPRESSION_REDIS_URL: %s", err)
+		}
+		sl.store = &redisSuppressionStore{client: client}
+	default:
+		return fmt.Errorf("Unknown SUPPRESSION_BACKEND '%s'", sl.backend)
+	}
+	return nil
+}
@@ -0,0 +1,212 @@
+package app_context
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+// recordingMailTransport keeps the recipients of each send
+type recordingMailTransport struct {
+	sends [][]string
+	to    [][]string
+}
+
+func (self *recordingMailTransport) name() string {
+	return "recording"
+}
+
+func (self *recordingMailTransport) send(ctx context.Context, from string, recipients []string, email *Email) error {
+	self.sends = append(self.sends, recipients)
+	self.to = append(self.to, email.To)
+	return nil
+}
+
+func TestSuppressions(t *testing.T) {
+	app_ctx, err := NewAppContext("suppression_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer app_ctx.Close()
+
+	mcli := newCountingMetricsClient()
+	app_ctx.SetMetricsClient(mcli)
+	ctx := context.Background()
+	sl := app_ctx.Suppressions()
+
+	if err := sl.Add(ctx, ChannelEmail, " Bounced@Example.com", SuppressionBounce); err != nil {
+		t.Fatal(err)
+	}
+	if err := sl.Add(ctx, ChannelSMS, "+1 (555) 010-0000", SuppressionUnsubscribe); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := sl.Get(ctx, ChannelEmail, "bounced@example.com")
+	if err != nil || s == nil || s.Reason != SuppressionBounce {
+		t.Errorf("Expected the bounce, got %+v, %v", s, err)
+	}
+	if s, _ := sl.Get(ctx, ChannelEmail, "other@example.com"); s != nil {
+		t.Errorf("Expected nothing, got %+v", s)
+	}
+	suppressed, err := sl.Suppressed(ctx, ChannelSMS, []string{"+15550100000", "+15550100001"})
+	if err != nil || len(suppressed) != 1 || !suppressed["+15550100000"] {
+		t.Errorf("Unexpected SMS suppressions: %v, %v", suppressed, err)
+	}
+
+	transport := &recordingMailTransport{}
+	app_ctx.(*baseAppContext).mailer.transport = transport
+	err = app_ctx.Mailer().Send(ctx, &Email{
+		From:    "noreply@example.com",
+		To:      []string{"Someone <BOUNCED@example.com>", "ok@example.com"},
+		Bcc:     []string{"hidden@example.com"},
+		Subject: "Hello",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(transport.sends) != 1 || strings.Join(transport.sends[0], ",") != "ok@example.com,hidden@example.com" {
+		t.Errorf("Expected the suppressed recipient to be left out, got %v", transport.sends)
+	}
+	if len(transport.to[0]) != 1 || transport.to[0][0] != "ok@example.com" {
+		t.Errorf("Expected the suppressed recipient to be left out of To, got %v", transport.to)
+	}
+
+	err = app_ctx.Mailer().Send(ctx, &Email{
+		From:    "noreply@example.com",
+		To:      []string{"bounced@example.com"},
+		Subject: "Hello",
+	})
+	if err != nil || len(transport.sends) != 1 {
+		t.Errorf("Expected nothing to be sent, got %v, %v", transport.sends, err)
+	}
+	if mcli.count("mail.suppressed") != 2 {
+		t.Errorf("Expected 2 suppressed recipients, got %v", mcli.counts)
+	}
+
+	if err := sl.Remove(ctx, ChannelEmail, "bounced@EXAMPLE.com"); err != nil {
+		t.Fatal(err)
+	}
+	if s, _ := sl.Get(ctx, ChannelEmail, "bounced@example.com"); s != nil {
+		t.Errorf("Expected the suppression to be removed, got %+v", s)
+	}
+}
+
+func TestSuppressionWebhooks(t *testing.T) {
+	os.Setenv("SUPPRESSION_WEBHOOK_TOKEN", "hook-secret")
+	defer os.Unsetenv("SUPPRESSION_WEBHOOK_TOKEN")
+
+	app_ctx, err := NewAppContext("suppression_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer app_ctx.Close()
+	sl := app_ctx.Suppressions()
+
+	post := func(handler http.Handler, target, body string) int {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("POST", target, strings.NewReader(body)))
+		return w.Code
+	}
+
+	events := `[
+		{"email": "hard@example.com", "event": "bounce", "type": "bounce"},
+		{"email": "soft@example.com", "event": "bounce", "type": "blocked"},
+		{"email": "spam@example.com", "event": "spamreport"},
+		{"email": "opened@example.com", "event": "open"}
+	]`
+	if code := post(sl.SendGridWebhookHandler(), "/hooks/sendgrid", events); code != http.StatusUnauthorized {
+		t.Errorf("Expected a request without the token to be refused, got %d", code)
+	}
+	if code := post(sl.SendGridWebhookHandler(), "/hooks/sendgrid?token=hook-secret", events); code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", code)
+	}
+
+	ses, _ := json.Marshal(map[string]interface{}{
+		"notificationType": "Complaint",
+		"complaint": map[string]interface{}{
+			"complainedRecipients": []map[string]string{{"emailAddress": "ses@example.com"}},
+		},
+	})
+	sns, _ := json.Marshal(map[string]string{"Type": "Notification", "Message": string(ses)})
+	if code := post(sl.SESWebhookHandler(), "/hooks/ses?token=hook-secret", string(sns)); code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", code)
+	}
+
+	suppressed, err := sl.Suppressed(context.Background(), ChannelEmail, []string{
+		"hard@example.com",
+		"soft@example.com",
+		"spam@example.com",
+		"opened@example.com",
+		"ses@example.com",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(suppressed) != 3 || !suppressed["hard@example.com"] || !suppressed["spam@example.com"] || !suppressed["ses@example.com"] {
+		t.Errorf("Unexpected suppressions: %v", suppressed)
+	}
+
+	confirm, _ := json.Marshal(map[string]string{
+		"Type":         "SubscriptionConfirmation",
+		"SubscribeURL": "http://attacker.example.com/",
+	})
+	if code := post(sl.SESWebhookHandler(), "/hooks/ses?token=hook-secret", string(confirm)); code != http.StatusBadRequest {
+		t.Errorf("Expected a SubscribeURL outside AWS to be refused, got %d", code)
+	}
+}
+
+func TestRedisSuppressions(t *testing.T) {
+	server := newFakeRedis(t, ":1", "*2\r\n$-1\r\n$55\r\n{\"reason\":\"bounce\",\"created_at\":\"2020-01-01T00:00:00Z\"}")
+	defer server.listener.Close()
+
+	os.Setenv("SUPPRESSION_BACKEND", "redis")
+	os.Setenv("SUPPRESSION_REDIS_URL", "redis://"+server.listener.Addr().String())
+	defer os.Unsetenv("SUPPRESSION_BACKEND")
+	defer os.Unsetenv("SUPPRESSION_REDIS_URL")
+
+	app_ctx, err := NewAppContext("suppression_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer app_ctx.Close()
+
+	ctx := context.Background()
+	if err := app_ctx.Suppressions().Add(ctx, ChannelEmail, "A@example.com", SuppressionBounce); err != nil {
+		t.Fatal(err)
+	}
+	suppressed, err := app_ctx.Suppressions().Suppressed(ctx, ChannelEmail, []string{"b@example.com", "A@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(suppressed) != 1 || !suppressed["A@example.com"] {
+		t.Errorf("Unexpected suppressions: %v", suppressed)
+	}
+
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	if hset := server.commands[0]; hset[0] != "HSET" || hset[1] != "suppressions:email" || hset[2] != "a@example.com" {
+		t.Errorf("Unexpected HSET: %v", hset)
+	}
+	if hmget := server.commands[1]; len(hmget) != 4 || hmget[0] != "HMGET" || hmget[3] != "a@example.com" {
+		t.Errorf("Unexpected HMGET: %v", hmget)
+	}
+}
+
+func TestSuppressionBackendFromEnv(t *testing.T) {
+	os.Setenv("SUPPRESSION_BACKEND", "dynamo")
+	defer os.Unsetenv("SUPPRESSION_BACKEND")
+
+	if _, err := NewAppContext("suppression_test"); err == nil {
+		t.Error("Expected an error for an unknown SUPPRESSION_BACKEND")
+	}
+
+	os.Setenv("SUPPRESSION_BACKEND", "redis")
+	if _, err := NewAppContext("suppression_test"); err == nil {
+		t.Error("Expected an error for redis without SUPPRESSION_REDIS_URL")
+	}
+}
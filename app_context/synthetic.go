@@ -0,0 +1,219 @@
+package app_context
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+type SyntheticCheckFunc func(ctx context.Context) error
+
+type SyntheticCheckRunner interface {
+	Register(name string, interval time.Duration, check SyntheticCheckFunc) error
+	Start() error
+	Stop() error
+	Results() []*HealthResult
+}
+
+type syntheticCheck struct {
+	name     string
+	interval time.Duration
+	check    SyntheticCheckFunc
+}
+
+type syntheticCheckRunner struct {
+	appctx   *baseAppContext
+	timeout  time.Duration
+	lock     sync.Mutex
+	checks   []*syntheticCheck
+	results  map[string]*HealthResult
+	running  bool
+	stopChan chan struct{}
+	wg       sync.WaitGroup
+}
+
+func (self *syntheticCheckRunner) healthName(name string) string {
+	return "synthetic:" + name
+}
+
+func (self *syntheticCheckRunner) Register(name string, interval time.Duration, check SyntheticCheckFunc) error {
+	if interval <= 0 {
+		return errors.New("Synthetic check interval must be > 0")
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	for _, c := range self.checks {
+		if c.name == name {
+			return fmt.Errorf("Synthetic check '%s' is already registered", name)
+		}
+	}
+
+	sc := &syntheticCheck{name: name, interval: interval, check: check}
+	self.checks = append(self.checks, sc)
+
+	if self.running {
+		self.startCheck(sc)
+	}
+
+	return nil
+}
+
+func (self *syntheticCheckRunner) runCheck(sc *syntheticCheck) {
+	ctx, cancel := context.WithTimeout(context.Background(), self.timeout)
+	defer cancel()
+
+	start := time.Now()
+	err := sc.check(ctx)
+	duration := time.Since(start)
+
+	tags := map[string]string{"check": sc.name, "result": "success"}
+	if err != nil {
+		tags["result"] = "failure"
+		self.appctx.Logger().LogWarnf(ctx, "Synthetic check '%s' failed: %s", sc.name, err)
+	}
+
+	mcli := self.appctx.MetricsClient()
+	mcli.Incr("synthetic.checks", 1.0, tags)
+	mcli.TimingMS(
+		"synthetic.check_duration_ms",
+		float64(duration)/float64(time.Millisecond),
+		1.0,
+		tags,
+	)
+
+	self.appctx.Health().SetStatus(self.healthName(sc.name), err)
+
+	self.lock.Lock()
+	self.results[sc.name] = newHealthResult(sc.name, err, self.appctx.Clock().Now())
+	self.lock.Unlock()
+}
+
+// must be called with lock held
+func (self *syntheticCheckRunner) startCheck(sc *syntheticCheck) {
+	stop_chan := self.stopChan
+	self.wg.Add(1)
+	goLabeled("synthetic_checks", func() {
+		defer self.wg.Done()
+		for {
+			self.runCheck(sc)
+			select {
+			case <-stop_chan:
+				return
+			case <-self.appctx.Clock().After(sc.interval):
+			}
+		}
+	}, "check", sc.name)
+}
+
+func (self *syntheticCheckRunner) Start() error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if self.running {
+		return errors.New("Synthetic check runner is already running")
+	}
+
+	self.stopChan = make(chan struct{})
+	for _, sc := range self.checks {
+		self.startCheck(sc)
+	}
+	self.running = true
+
+	return nil
+}
+
+func (self *syntheticCheckRunner) Stop() error {
+	if self == nil {
+		return errors.New("Synthetic check runner isn't running")
+	}
+
+	self.lock.Lock()
+	if !self.running {
+		self.lock.Unlock()
+		return errors.New("Synthetic check runner isn't running")
+	}
+	close(self.stopChan)
+	self.running = false
+	self.lock.Unlock()
+
+	self.wg.Wait()
+
+	return nil
+}
+
+func (self *syntheticCheckRunner) Results() []*HealthResult {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	results := make([]*HealthResult, 0, len(self.checks))
+	for _, sc := range self.checks {
+		if res, ok := self.results[sc.name]; ok {
+			res_copy := *res
+			results = append(results, &res_copy)
+		}
+	}
+	return results
+}
+
+// HTTPSyntheticCheck returns a check that GETs url and expects expect_status
+func HTTPSyntheticCheck(url string, expect_status int) SyntheticCheckFunc {
+	return func(ctx context.Context) error {
+		req, err := http.NewRequest("GET", url, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != expect_status {
+			return fmt.Errorf("GET %s returned %d, expected %d", url, resp.StatusCode, expect_status)
+		}
+		return nil
+	}
+}
+
+// SQLSyntheticCheck returns a check that runs a canary query against db
+func SQLSyntheticCheck(db *sqlx.DB, query string, args ...interface{}) SyntheticCheckFunc {
+	return func(ctx context.Context) error {
+		if db == nil {
+			return errors.New("No DB configured")
+		}
+		rows, err := db.QueryContext(ctx, query, args...)
+		if err != nil {
+			return err
+		}
+		rows.Close()
+		return rows.Err()
+	}
+}
+
+func (self *baseAppContext) SyntheticChecks() SyntheticCheckRunner {
+	return self.syntheticChecks
+}
+
+func (self *baseAppContext) setSyntheticChecksFromEnv() error {
+	runner := &syntheticCheckRunner{
+		appctx:  self,
+		timeout: 10 * time.Second,
+		results: make(map[string]*HealthResult),
+	}
+
+	if timeout, found, err := self.getDurationFromEnv("SYNTHETIC_CHECK_TIMEOUT"); err != nil {
+		return err
+	} else if found {
+		runner.timeout = timeout
+	}
+
+	self.syntheticChecks = runner
+
+	return nil
+}
@@ -0,0 +1,94 @@
+package app_context
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHealthRegistry(t *testing.T) {
+	app_ctx, err := NewAppContext("synthetic_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	health := app_ctx.Health()
+	health.Register("db", func(ctx context.Context) error { return nil })
+	health.SetStatus("consumer", nil)
+
+	if !health.Healthy(context.Background()) {
+		t.Error("Health should be ok")
+	}
+
+	health.SetStatus("consumer", errors.New("wedged"))
+
+	rec := httptest.NewRecorder()
+	health.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/health", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("Unhealthy handler didn't return 503: %d", rec.Code)
+	}
+
+	results := health.Check(context.Background())
+	if len(results) != 2 || results[0].Name != "consumer" || results[0].Error != "wedged" {
+		t.Errorf("Unexpected results: %+v", results)
+	}
+}
+
+func TestSyntheticChecks(t *testing.T) {
+	app_ctx, err := NewAppContext("synthetic_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/ok" {
+				w.WriteHeader(http.StatusNotFound)
+			}
+		},
+	))
+	defer server.Close()
+
+	runner := app_ctx.SyntheticChecks()
+
+	if err := runner.Register("ok", time.Hour, HTTPSyntheticCheck(server.URL+"/ok", 200)); err != nil {
+		t.Fatal(err)
+	}
+	if err := runner.Register("ok", time.Hour, nil); err == nil {
+		t.Error("Registering a duplicate check should fail")
+	}
+
+	if err := runner.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := runner.Register("missing", time.Hour, HTTPSyntheticCheck(server.URL+"/missing", 200)); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for len(runner.Results()) < 2 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	results := runner.Results()
+	if len(results) != 2 || !results[0].Healthy || results[1].Healthy {
+		t.Errorf("Unexpected results: %+v", results)
+	}
+
+	if app_ctx.Health().Healthy(context.Background()) {
+		t.Error("Failed synthetic check wasn't reported to the health registry")
+	}
+
+	if err := app_ctx.Close(); err != nil {
+		t.Errorf("Close failed: %s", err)
+	}
+
+	if err := runner.Stop(); err == nil {
+		t.Error("Stop should fail after Close stopped the runner")
+	}
+}
@@ -0,0 +1,408 @@
+package app_context
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/comstud/go-rollbar/rollbar"
+)
+
+type taskNameKey struct{}
+
+// errTaskLeaseLost is returned by renew and finish when another instance
+// has claimed the task since
+var errTaskLeaseLost = errors.New("Task lease lost")
+
+// newTaskOwner is what this process claims tasks as. The hostname alone
+// isn't enough, eg. for two processes on one host.
+func newTaskOwner(hostname string) string {
+	return fmt.Sprintf("%s:%d:%s", hostname, os.Getpid(), newLockToken()[:8])
+}
+
+// TaskNameFromContext returns the full name of the one-shot task being run
+func TaskNameFromContext(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	name, _ := ctx.Value(taskNameKey{}).(string)
+	return name
+}
+
+func taskKind(name string) string {
+	if i := strings.IndexByte(name, ':'); i >= 0 {
+		return name[:i]
+	}
+	return name
+}
+
+type taskStore interface {
+	// add does nothing if a task called name already exists
+	add(ctx context.Context, name string, at time.Time) error
+	due(ctx context.Context, now time.Time, limit int) ([]string, error)
+	// backlog is how many tasks are due and unclaimed, and when the
+	// oldest of them was due
+	backlog(ctx context.Context, now time.Time) (int, time.Time, error)
+	// claim leases the task to owner until lease. It returns false if
+	// another instance holds a lease that hasn't run out, or the task
+	// has finished.
+	claim(ctx context.Context, name string, owner string, now time.Time, lease time.Time) (bool, error)
+	// renew extends owner's lease on a task that's still running, or
+	// returns errTaskLeaseLost
+	renew(ctx context.Context, name string, owner string, lease time.Time) error
+	// finish records the result if owner still has the task claimed, or
+	// returns errTaskLeaseLost
+	finish(ctx context.Context, name string, owner string, task_err error) error
+}
+
+// pgTaskStore keeps tasks in the scheduled_tasks table, created on first
+// use. A claimed task is leased until locked_until, so one whose instance
+// died running it is claimed again once the lease runs out.
+type pgTaskStore struct {
+	appctx *baseAppContext
+	lock   sync.Mutex
+	ready  bool
+}
+
+func (self *pgTaskStore) db(ctx context.Context) (*sql.DB, error) {
+	db := self.appctx.DBWrite()
+	if db == nil {
+		return nil, errors.New("No database is configured")
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if !self.ready {
+		if _, err := db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS scheduled_tasks (
+			name text NOT NULL PRIMARY KEY,
+			run_at timestamptz NOT NULL,
+			claimed_by text,
+			claimed_at timestamptz,
+			locked_until timestamptz,
+			finished_at timestamptz,
+			error text
+		)`); err != nil {
+			return nil, fmt.Errorf("Error creating scheduled_tasks: %s", err)
+		}
+		if _, err := db.ExecContext(
+			ctx,
+			"ALTER TABLE scheduled_tasks ADD COLUMN IF NOT EXISTS locked_until timestamptz",
+		); err != nil {
+			return nil, fmt.Errorf("Error adding scheduled_tasks.locked_until: %s", err)
+		}
+		if _, err := db.ExecContext(
+			ctx,
+			"CREATE INDEX IF NOT EXISTS scheduled_tasks_unfinished ON scheduled_tasks (run_at) WHERE finished_at IS NULL",
+		); err != nil {
+			return nil, fmt.Errorf("Error creating scheduled_tasks index: %s", err)
+		}
+		self.ready = true
+	}
+	return db.DB, nil
+}
+
+// pgTaskDue matches unfinished tasks due by $1 that aren't leased
+const pgTaskDue = "finished_at IS NULL AND run_at <= $1 AND (locked_until IS NULL OR locked_until <= $1)"
+
+func (self *pgTaskStore) add(ctx context.Context, name string, at time.Time) error {
+	db, err := self.db(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = db.ExecContext(
+		ctx,
+		"INSERT INTO scheduled_tasks (name, run_at) VALUES ($1, $2) ON CONFLICT (name) DO NOTHING",
+		name, at,
+	)
+	return err
+}
+
+func (self *pgTaskStore) due(ctx context.Context, now time.Time, limit int) ([]string, error) {
+	db, err := self.db(ctx)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.QueryContext(
+		ctx,
+		"SELECT name FROM scheduled_tasks WHERE "+pgTaskDue+" ORDER BY run_at LIMIT $2",
+		now, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	names := make([]string, 0)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
+func (self *pgTaskStore) backlog(ctx context.Context, now time.Time) (int, time.Time, error) {
+	db, err := self.db(ctx)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	var count int
+	var oldest *time.Time
+	err = db.QueryRowContext(
+		ctx,
+		"SELECT count(*), min(run_at) FROM scheduled_tasks WHERE "+pgTaskDue,
+		now,
+	).Scan(&count, &oldest)
+	if err != nil || oldest == nil {
+		return count, time.Time{}, err
+	}
+	return count, *oldest, nil
+}
+
+func (self *pgTaskStore) claim(ctx context.Context, name string, owner string, now time.Time, lease time.Time) (bool, error) {
+	db, err := self.db(ctx)
+	if err != nil {
+		return false, err
+	}
+	res, err := db.ExecContext(
+		ctx,
+		`UPDATE scheduled_tasks SET claimed_by = $2, claimed_at = $3, locked_until = $4
+		WHERE name = $1 AND finished_at IS NULL AND (locked_until IS NULL OR locked_until <= $3)`,
+		name, owner, now, lease,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+func (self *pgTaskStore) renew(ctx context.Context, name string, owner string, lease time.Time) error {
+	db, err := self.db(ctx)
+	if err != nil {
+		return err
+	}
+	res, err := db.ExecContext(
+		ctx,
+		"UPDATE scheduled_tasks SET locked_until = $3 WHERE name = $1 AND claimed_by = $2 AND finished_at IS NULL",
+		name, owner, lease,
+	)
+	return taskLeaseResult(res, err)
+}
+
+// taskLeaseResult is errTaskLeaseLost for an update of a task owned by
+// someone else
+func taskLeaseResult(res sql.Result, err error) error {
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return errTaskLeaseLost
+	}
+	return nil
+}
+
+func (self *pgTaskStore) finish(ctx context.Context, name string, owner string, task_err error) error {
+	db, err := self.db(ctx)
+	if err != nil {
+		return err
+	}
+	var err_str sql.NullString
+	if task_err != nil {
+		err_str = sql.NullString{String: task_err.Error(), Valid: true}
+	}
+	res, err := db.ExecContext(
+		ctx,
+		"UPDATE scheduled_tasks SET finished_at = now(), locked_until = NULL, error = $3 WHERE name = $1 AND claimed_by = $2",
+		name, owner, err_str,
+	)
+	return taskLeaseResult(res, err)
+}
+
+func (self *scheduler) HandleTasks(kind string, fn JobFunc) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.taskHandlers[kind] = fn
+	self.startTaskPollerLocked()
+}
+
+func (self *scheduler) RunOnceAt(name string, at time.Time, fn JobFunc) error {
+	if self.ctx.Err() != nil {
+		return ErrSchedulerStopped
+	}
+
+	if err := self.tasks.add(self.ctx, name, at); err != nil {
+		return fmt.Errorf("Error adding task '%s': %s", name, err)
+	}
+
+	self.HandleTasks(taskKind(name), fn)
+
+	// Don't wait for the next poll if it's due before then
+	clock := self.appctx.Clock()
+	if until := at.Sub(clock.Now()); until < self.taskPollInterval {
+		clock.AfterFunc(until, self.wakeTaskPoller)
+	}
+	return nil
+}
+
+func (self *scheduler) RunAfter(name string, delay time.Duration, fn JobFunc) error {
+	return self.RunOnceAt(name, self.appctx.Clock().Now().Add(delay), fn)
+}
+
+func (self *scheduler) wakeTaskPoller() {
+	select {
+	case self.taskWake <- struct{}{}:
+	default:
+	}
+}
+
+// must be called with lock held
+func (self *scheduler) startTaskPollerLocked() {
+	if self.taskPolling || self.ctx.Err() != nil {
+		return
+	}
+	self.taskPolling = true
+
+	goLabeled("scheduler", func() {
+		ticker := self.appctx.Clock().NewTicker(self.taskPollInterval)
+		defer ticker.Stop()
+		for {
+			self.runDueTasks()
+			select {
+			case <-self.ctx.Done():
+				return
+			case <-ticker.C():
+			case <-self.taskWake:
+			}
+		}
+	}, "job", "one_shot_tasks")
+}
+
+func (self *scheduler) runDueTasks() {
+	// Leave them for the active instance
+	if self.appctx.TrafficRole() != TrafficRoleActive {
+		return
+	}
+
+	names, err := self.tasks.due(self.ctx, self.appctx.Clock().Now(), 100)
+	if err != nil {
+		if self.ctx.Err() == nil {
+			self.appctx.Logger().LogErrorf(self.ctx, "Error looking up due tasks: %s", err)
+		}
+		return
+	}
+
+	for _, name := range names {
+		self.lock.Lock()
+		fn := self.taskHandlers[taskKind(name)]
+		self.lock.Unlock()
+		if fn == nil {
+			// Another instance, or a later HandleTasks, can run it
+			continue
+		}
+
+		now := self.appctx.Clock().Now()
+		claimed, err := self.tasks.claim(self.ctx, name, self.taskOwner, now, now.Add(self.taskLease))
+		if err != nil {
+			self.appctx.Logger().LogErrorf(self.ctx, "Error claiming task '%s': %s", name, err)
+			continue
+		}
+		if !claimed {
+			continue
+		}
+
+		self.lock.Lock()
+		if self.ctx.Err() != nil {
+			self.lock.Unlock()
+			return
+		}
+		self.running.Add(1)
+		self.lock.Unlock()
+
+		name := name
+		goLabeled("scheduler", func() {
+			self.runTask(name, fn)
+		}, "job", taskKind(name))
+	}
+}
+
+func (self *scheduler) runTask(name string, fn JobFunc) {
+	defer self.running.Done()
+
+	appctx := self.appctx
+	ctx, cancel := context.WithCancel(context.WithValue(self.ctx, taskNameKey{}, name))
+	defer cancel()
+	start := time.Now()
+
+	// Keep the lease while fn runs, so no other instance takes the task,
+	// and stop fn if another has anyway
+	renew_ctx, stop_renewing := context.WithCancel(context.Background())
+	goLabeled("scheduler", func() {
+		self.renewTask(renew_ctx, name, cancel)
+	}, "job", taskKind(name))
+
+	err := func() (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("Task '%s' panicked: %v", name, r)
+			}
+		}()
+		return fn(ctx)
+	}()
+	stop_renewing()
+	duration := time.Since(start)
+
+	result := "success"
+	if err != nil {
+		result = "failure"
+		appctx.Logger().LogErrorf(ctx, "Task '%s' failed after %s: %s", name, duration, err)
+		appctx.reportError(err, rollbar.CustomInfo{"task": name})
+	} else {
+		appctx.Logger().LogDebugf(ctx, "Task '%s' finished in %s", name, duration)
+	}
+
+	appctx.MetricsClient().Incr(
+		"scheduler.task_runs",
+		1.0,
+		map[string]string{"task": taskKind(name), "result": result},
+	)
+
+	// Record it even if the scheduler is stopping
+	if finish_err := self.tasks.finish(context.Background(), name, self.taskOwner, err); finish_err == errTaskLeaseLost {
+		appctx.Logger().LogWarnf(ctx, "Task '%s' was claimed by another instance, so its result isn't recorded", name)
+	} else if finish_err != nil {
+		appctx.Logger().LogErrorf(ctx, "Error marking task '%s' finished: %s", name, finish_err)
+	}
+}
+
+// renewTask extends the lease on a running task every third of
+// SCHEDULER_TASK_LEASE until ctx is done, calling lost if another
+// instance has claimed the task
+func (self *scheduler) renewTask(ctx context.Context, name string, lost func()) {
+	clock := self.appctx.Clock()
+	ticker := clock.NewTicker(self.taskLease / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+		}
+		lease := clock.Now().Add(self.taskLease)
+		if err := self.tasks.renew(ctx, name, self.taskOwner, lease); err == errTaskLeaseLost {
+			self.appctx.Logger().LogErrorf(ctx, "Lost the lease on task '%s', cancelling it", name)
+			lost()
+			return
+		} else if err != nil && ctx.Err() == nil {
+			self.appctx.Logger().LogWarnf(ctx, "Error renewing the lease on task '%s': %s", name, err)
+		}
+	}
+}
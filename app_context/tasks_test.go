@@ -0,0 +1,313 @@
+package app_context
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type memTask struct {
+	runAt       time.Time
+	owner       string
+	lockedUntil time.Time
+	done        bool
+	err         string
+}
+
+func (self *memTask) due(now time.Time) bool {
+	return !self.done && !self.runAt.After(now) && !self.lockedUntil.After(now)
+}
+
+// memTaskStore stands in for scheduled_tasks and can be shared by several
+// app contexts, like instances sharing a database
+type memTaskStore struct {
+	lock  sync.Mutex
+	tasks map[string]*memTask
+}
+
+func (self *memTaskStore) add(ctx context.Context, name string, at time.Time) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if _, ok := self.tasks[name]; !ok {
+		self.tasks[name] = &memTask{runAt: at}
+	}
+	return nil
+}
+
+func (self *memTaskStore) due(ctx context.Context, now time.Time, limit int) ([]string, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	names := make([]string, 0)
+	for name, task := range self.tasks {
+		if task.due(now) {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+func (self *memTaskStore) backlog(ctx context.Context, now time.Time) (int, time.Time, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	count, oldest := 0, time.Time{}
+	for _, task := range self.tasks {
+		if task.due(now) {
+			if count == 0 || task.runAt.Before(oldest) {
+				oldest = task.runAt
+			}
+			count++
+		}
+	}
+	return count, oldest, nil
+}
+
+func (self *memTaskStore) claim(ctx context.Context, name string, owner string, now time.Time, lease time.Time) (bool, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	task := self.tasks[name]
+	if task.done || task.lockedUntil.After(now) {
+		return false, nil
+	}
+	task.owner = owner
+	task.lockedUntil = lease
+	return true, nil
+}
+
+func (self *memTaskStore) renew(ctx context.Context, name string, owner string, lease time.Time) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	task := self.tasks[name]
+	if task.owner != owner || task.done {
+		return errTaskLeaseLost
+	}
+	task.lockedUntil = lease
+	return nil
+}
+
+func (self *memTaskStore) finish(ctx context.Context, name string, owner string, task_err error) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.tasks[name].owner != owner {
+		return errTaskLeaseLost
+	}
+	self.tasks[name].done = true
+	self.tasks[name].lockedUntil = time.Time{}
+	if task_err != nil {
+		self.tasks[name].err = task_err.Error()
+	}
+	return nil
+}
+
+func (self *memTaskStore) task(name string) memTask {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return *self.tasks[name]
+}
+
+func newTaskTestContext(store taskStore) AppContext {
+	app_ctx, err := NewAppContext("tasks_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	app_ctx.(*baseAppContext).scheduler.tasks = store
+	return app_ctx
+}
+
+func TestOneShotTasks(t *testing.T) {
+	os.Setenv("SCHEDULER_TASK_POLL_INTERVAL", "5ms")
+	defer os.Unsetenv("SCHEDULER_TASK_POLL_INTERVAL")
+
+	store := &memTaskStore{tasks: make(map[string]*memTask)}
+
+	// Two instances handling the same kind
+	var lock sync.Mutex
+	runs := map[string]int{}
+	handler := func(ctx context.Context) error {
+		lock.Lock()
+		defer lock.Unlock()
+		runs[TaskNameFromContext(ctx)]++
+		return nil
+	}
+	app_ctx := newTaskTestContext(store)
+	defer app_ctx.Close()
+	other := newTaskTestContext(store)
+	defer other.Close()
+	other.Scheduler().HandleTasks("reminder", handler)
+
+	for _, name := range []string{"reminder:1", "reminder:2", "reminder:3"} {
+		if err := app_ctx.Scheduler().RunAfter(name, 10*time.Millisecond, handler); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Already exists, so its time and handler don't change
+	app_ctx.Scheduler().RunAfter("reminder:1", time.Hour, handler)
+
+	waitFor(t, "tasks to finish", func() bool {
+		return store.task("reminder:1").done && store.task("reminder:2").done && store.task("reminder:3").done
+	})
+	lock.Lock()
+	for name, n := range runs {
+		if n != 1 {
+			t.Errorf("Task '%s' ran %d times", name, n)
+		}
+	}
+	lock.Unlock()
+
+	// Adding it again after it ran does nothing
+	app_ctx.Scheduler().RunAfter("reminder:1", 0, handler)
+	time.Sleep(20 * time.Millisecond)
+	lock.Lock()
+	if runs["reminder:1"] != 1 {
+		t.Errorf("Finished task ran again")
+	}
+	lock.Unlock()
+
+	err := app_ctx.Scheduler().RunAfter("broken", 0, func(ctx context.Context) error {
+		return errors.New("Failed")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "failed task", func() bool { return store.task("broken").done })
+	if task := store.task("broken"); task.err != "Failed" {
+		t.Errorf("Expected the error to be recorded, got '%s'", task.err)
+	}
+}
+
+func TestOneShotTasksSurviveRestart(t *testing.T) {
+	os.Setenv("SCHEDULER_TASK_POLL_INTERVAL", "5ms")
+	defer os.Unsetenv("SCHEDULER_TASK_POLL_INTERVAL")
+
+	store := &memTaskStore{tasks: make(map[string]*memTask)}
+
+	var runs int32
+	handler := func(ctx context.Context) error {
+		atomic.AddInt32(&runs, 1)
+		return nil
+	}
+
+	app_ctx := newTaskTestContext(store)
+	if err := app_ctx.Scheduler().RunAfter("reminder:1", 30*time.Millisecond, handler); err != nil {
+		t.Fatal(err)
+	}
+	app_ctx.Close()
+
+	restarted := newTaskTestContext(store)
+	defer restarted.Close()
+	restarted.Scheduler().HandleTasks("reminder", handler)
+
+	waitFor(t, "task after restart", func() bool { return atomic.LoadInt32(&runs) == 1 })
+}
+
+func TestOneShotTasksLease(t *testing.T) {
+	os.Setenv("SCHEDULER_TASK_POLL_INTERVAL", "5ms")
+	os.Setenv("SCHEDULER_TASK_LEASE", "30ms")
+	defer os.Unsetenv("SCHEDULER_TASK_POLL_INTERVAL")
+	defer os.Unsetenv("SCHEDULER_TASK_LEASE")
+
+	store := &memTaskStore{tasks: make(map[string]*memTask)}
+
+	// An instance claims a task and crashes before finishing it
+	now := time.Now()
+	store.add(context.Background(), "reminder:1", now)
+	if claimed, _ := store.claim(context.Background(), "reminder:1", "crashed", now, now.Add(30*time.Millisecond)); !claimed {
+		t.Fatal("Expected to claim the task")
+	}
+
+	var lock sync.Mutex
+	runs := map[string]int{}
+	handler := func(ctx context.Context) error {
+		lock.Lock()
+		runs[TaskNameFromContext(ctx)]++
+		lock.Unlock()
+		// Outlasts the lease, which is renewed while it runs
+		time.Sleep(100 * time.Millisecond)
+		return nil
+	}
+
+	app_ctx := newTaskTestContext(store)
+	defer app_ctx.Close()
+	other := newTaskTestContext(store)
+	defer other.Close()
+	app_ctx.Scheduler().HandleTasks("reminder", handler)
+	other.Scheduler().HandleTasks("reminder", handler)
+
+	waitFor(t, "the task to run again", func() bool { return store.task("reminder:1").done })
+	if err := app_ctx.Scheduler().RunAfter("reminder:2", 0, handler); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the long task", func() bool { return store.task("reminder:2").done })
+
+	lock.Lock()
+	defer lock.Unlock()
+	if runs["reminder:1"] != 1 || runs["reminder:2"] != 1 {
+		t.Errorf("Expected each task to run once, got %v", runs)
+	}
+}
+
+func TestOneShotTasksLeaseLost(t *testing.T) {
+	os.Setenv("SCHEDULER_TASK_POLL_INTERVAL", "5ms")
+	os.Setenv("SCHEDULER_TASK_LEASE", "30ms")
+	defer os.Unsetenv("SCHEDULER_TASK_POLL_INTERVAL")
+	defer os.Unsetenv("SCHEDULER_TASK_LEASE")
+
+	store := &memTaskStore{tasks: make(map[string]*memTask)}
+	app_ctx := newTaskTestContext(store)
+	defer app_ctx.Close()
+	other := newTaskTestContext(store)
+	defer other.Close()
+
+	// Processes on the same host still claim tasks as themselves
+	owner := app_ctx.(*baseAppContext).scheduler.taskOwner
+	if owner == other.(*baseAppContext).scheduler.taskOwner || !strings.HasPrefix(owner, app_ctx.Hostname()+":") {
+		t.Errorf("Expected a task owner unique to the process, got '%s'", owner)
+	}
+
+	started := make(chan struct{})
+	cancelled := make(chan struct{})
+	err := app_ctx.Scheduler().RunAfter("reminder:1", 0, func(ctx context.Context) error {
+		close(started)
+		<-ctx.Done()
+		close(cancelled)
+		return ctx.Err()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-started
+
+	// Someone else claims it, as if the lease had run out while this
+	// instance was stalled
+	later := time.Now().Add(time.Hour)
+	if claimed, _ := store.claim(context.Background(), "reminder:1", "other", later, later); !claimed {
+		t.Fatal("Expected to claim the task")
+	}
+
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the task to be cancelled when its lease was lost")
+	}
+	time.Sleep(20 * time.Millisecond)
+	if task := store.task("reminder:1"); task.done || task.owner != "other" {
+		t.Errorf("Expected the new claimant's task to be left alone, got %+v", task)
+	}
+}
+
+func TestOneShotTasksNeedDB(t *testing.T) {
+	app_ctx, err := NewAppContext("tasks_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer app_ctx.Close()
+
+	if err := app_ctx.Scheduler().RunAfter("reminder:1", time.Hour, nil); err == nil {
+		t.Error("Expected RunAfter to fail without a database")
+	}
+}
@@ -0,0 +1,281 @@
+package app_context
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	html_template "html/template"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// ErrNoTemplate is returned when executing a template that isn't in
+// TEMPLATE_PATH
+var ErrNoTemplate = errors.New("No such template")
+
+// Templates is the html/template and text/template files under
+// TEMPLATE_PATH, parsed once at startup. Each is named by its path
+// relative to TEMPLATE_PATH, eg. "users/show.html". Files ending in .html
+// or .htm are HTML templates and the rest are text templates; each kind
+// shares one set, so any template can include another of its kind with
+// {{template "layouts/header.html" .}} and {{define}} names are shared.
+//
+// With TEMPLATE_RELOAD=true, the default in development, changed files are
+// parsed again before executing, at most once a second.
+type Templates interface {
+	Execute(w io.Writer, name string, data interface{}) error
+	// Render executes name into a buffer and writes it as the response
+	// with status, so a failed template doesn't leave a half written
+	// page. A failure is written with WriteHTTPError.
+	Render(w http.ResponseWriter, r *http.Request, status int, name string, data interface{})
+	Names() []string
+}
+
+// WithTemplateFuncs adds funcs to Templates' html and text templates. It's
+// an Option because functions must be known before the files are parsed.
+func WithTemplateFuncs(funcs map[string]interface{}) Option {
+	return func(appctx *baseAppContext) {
+		if appctx.templateFuncs == nil {
+			appctx.templateFuncs = make(map[string]interface{})
+		}
+		for name, fn := range funcs {
+			appctx.templateFuncs[name] = fn
+		}
+	}
+}
+
+func isHTMLTemplate(name string) bool {
+	ext := strings.ToLower(filepath.Ext(name))
+	return ext == ".html" || ext == ".htm"
+}
+
+// parsedTemplates is one parse of TEMPLATE_PATH
+type parsedTemplates struct {
+	html    *html_template.Template
+	text    *template.Template
+	names   []string
+	modTime time.Time
+	count   int
+}
+
+// templateFiles is every file under dir, by name, with the newest
+// modification time among them
+func templateFiles(dir string) (map[string]string, time.Time, error) {
+	files := make(map[string]string)
+	var newest time.Time
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			// Editors' and VCS directories
+			if path != dir && strings.HasPrefix(info.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if strings.HasPrefix(info.Name(), ".") {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		files[filepath.ToSlash(rel)] = path
+		if info.ModTime().After(newest) {
+			newest = info.ModTime()
+		}
+		return nil
+	})
+	return files, newest, err
+}
+
+func parseTemplates(dir string, funcs map[string]interface{}) (*parsedTemplates, error) {
+	files, newest, err := templateFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	parsed := &parsedTemplates{
+		html:    html_template.New("").Funcs(html_template.FuncMap(funcs)),
+		text:    template.New("").Funcs(template.FuncMap(funcs)),
+		names:   make([]string, 0, len(files)),
+		modTime: newest,
+		count:   len(files),
+	}
+	for name, path := range files {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if isHTMLTemplate(name) {
+			_, err = parsed.html.New(name).Parse(string(data))
+		} else {
+			_, err = parsed.text.New(name).Parse(string(data))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing template %s: %s", name, err)
+		}
+		parsed.names = append(parsed.names, name)
+	}
+	sort.Strings(parsed.names)
+	return parsed, nil
+}
+
+type templates struct {
+	appctx *baseAppContext
+	dir    string
+	funcs  map[string]interface{}
+	reload bool
+
+	lock        sync.Mutex
+	parsed      *parsedTemplates
+	lastChecked time.Time
+	reloads     int
+	lastError   string
+}
+
+func newTemplates(appctx *baseAppContext) *templates {
+	return &templates{
+		appctx: appctx,
+		parsed: &parsedTemplates{
+			html: html_template.New(""),
+			text: template.New(""),
+		},
+	}
+}
+
+func (self *templates) load() error {
+	parsed, err := parseTemplates(self.dir, self.funcs)
+	if err != nil {
+		return err
+	}
+	self.parsed = parsed
+	return nil
+}
+
+// current reparses the templates if reloading is on and a file was added,
+// removed or changed. A template that no longer parses keeps the last good
+// ones in use and is logged.
+func (self *templates) current() *parsedTemplates {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if !self.reload || time.Since(self.lastChecked) < time.Second {
+		return self.parsed
+	}
+	self.lastChecked = time.Now()
+
+	files, newest, err := templateFiles(self.dir)
+	if err == nil && len(files) == self.parsed.count && !newest.After(self.parsed.modTime) {
+		return self.parsed
+	}
+	if err == nil {
+		err = self.load()
+	}
+	if err != nil {
+		if err.Error() != self.lastError {
+			self.appctx.Logger().LogErrorf(context.Background(), "Error reloading templates: %s", err)
+		}
+		self.lastError = err.Error()
+		return self.parsed
+	}
+	self.reloads++
+	self.lastError = ""
+	self.appctx.Logger().LogDebugf(context.Background(), "Reloaded templates from %s", self.dir)
+	return self.parsed
+}
+
+func (self *templates) Execute(w io.Writer, name string, data interface{}) error {
+	parsed := self.current()
+
+	var err error
+	if isHTMLTemplate(name) {
+		tmpl := parsed.html.Lookup(name)
+		if tmpl == nil {
+			return ErrNoTemplate
+		}
+		err = tmpl.Execute(w, data)
+	} else {
+		tmpl := parsed.text.Lookup(name)
+		if tmpl == nil {
+			return ErrNoTemplate
+		}
+		err = tmpl.Execute(w, data)
+	}
+	if err != nil {
+		self.appctx.MetricsClient().Incr("template.errors", 1.0, map[string]string{"template": name})
+	}
+	return err
+}
+
+func (self *templates) Render(w http.ResponseWriter, r *http.Request, status int, name string, data interface{}) {
+	var buf bytes.Buffer
+	if err := self.Execute(&buf, name, data); err != nil {
+		self.appctx.Logger().LogErrorf(r.Context(), "Error rendering template %s: %s", name, err)
+		self.appctx.WriteHTTPError(w, r, err)
+		return
+	}
+
+	if w.Header().Get("Content-Type") == "" {
+		content_type := "text/plain; charset=utf-8"
+		if isHTMLTemplate(name) {
+			content_type = "text/html; charset=utf-8"
+		}
+		w.Header().Set("Content-Type", content_type)
+	}
+	w.WriteHeader(status)
+	w.Write(buf.Bytes())
+}
+
+func (self *templates) Names() []string {
+	return append([]string(nil), self.current().names...)
+}
+
+func (self *templates) status() map[string]interface{} {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return map[string]interface{}{
+		"path":       self.dir,
+		"reload":     self.reload,
+		"templates":  len(self.parsed.names),
+		"reloads":    self.reloads,
+		"last_error": self.lastError,
+	}
+}
+
+func (self *baseAppContext) Templates() Templates {
+	return self.templates
+}
+
+// TEMPLATE_PATH is the directory Templates are read from. Without it there
+// are no templates. TEMPLATE_RELOAD=true parses changed files again.
+func (self *baseAppContext) setTemplatesFromEnv() error {
+	tmpls := self.templates
+	tmpls.dir = self.getEnv("TEMPLATE_PATH")
+	tmpls.funcs = self.templateFuncs
+	if tmpls.dir == "" {
+		return nil
+	}
+
+	reload, _, err := self.getBoolFromEnv("TEMPLATE_RELOAD")
+	if err != nil {
+		return err
+	}
+	tmpls.reload = reload
+	tmpls.lastChecked = time.Now()
+
+	if err := tmpls.load(); err != nil {
+		return fmt.Errorf("Error loading TEMPLATE_PATH: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package app_context
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTemplates(t *testing.T) {
+	dir := t.TempDir()
+	writeTemplateFiles(t, dir, map[string]string{
+		"layouts/header.html": `{{define "title"}}<title>{{.Title}}</title>{{end}}`,
+		"users/show.html":     `{{template "title" .}}<p>{{shout .Name}}</p>`,
+		"users/show.txt":      `Name: {{.Name}}`,
+		".users.swp":          `{{`,
+	})
+
+	os.Setenv("TEMPLATE_PATH", dir)
+	os.Setenv("TEMPLATE_RELOAD", "false")
+	defer os.Unsetenv("TEMPLATE_PATH")
+	defer os.Unsetenv("TEMPLATE_RELOAD")
+
+	app_ctx, err := NewAppContext("templates_test", WithTemplateFuncs(map[string]interface{}{
+		"shout": strings.ToUpper,
+	}))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer app_ctx.Close()
+
+	tmpls := app_ctx.Templates()
+	if names := strings.Join(tmpls.Names(), ","); names != "layouts/header.html,users/show.html,users/show.txt" {
+		t.Errorf("Unexpected templates: %s", names)
+	}
+
+	data := map[string]string{"Title": "Bob", "Name": "<bob>"}
+	var buf bytes.Buffer
+	if err := tmpls.Execute(&buf, "users/show.html", data); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "<title>Bob</title><p>&lt;BOB&gt;</p>" {
+		t.Errorf("Unexpected html: %s", buf.String())
+	}
+
+	buf.Reset()
+	if err := tmpls.Execute(&buf, "users/show.txt", data); err != nil || buf.String() != "Name: <bob>" {
+		t.Errorf("Unexpected text: %s, %v", buf.String(), err)
+	}
+
+	if err := tmpls.Execute(&buf, "users/missing.html", data); err != ErrNoTemplate {
+		t.Errorf("Expected ErrNoTemplate, got %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	tmpls.Render(w, httptest.NewRequest("GET", "/users/1", nil), http.StatusCreated, "users/show.html", data)
+	if w.Code != http.StatusCreated || w.Header().Get("Content-Type") != "text/html; charset=utf-8" {
+		t.Errorf("Unexpected response: %d %v", w.Code, w.Header())
+	}
+
+	writeTemplateFiles(t, dir, map[string]string{"users/index.html": "users"})
+	app_ctx.(*baseAppContext).templates.lastChecked = time.Time{}
+	if len(tmpls.Names()) != 3 {
+		t.Errorf("Expected the templates not to be reloaded, got %v", tmpls.Names())
+	}
+}
+
+func TestTemplatesReload(t *testing.T) {
+	dir := t.TempDir()
+	writeTemplateFiles(t, dir, map[string]string{"index.html": "v1"})
+
+	os.Setenv("TEMPLATE_PATH", dir)
+	os.Setenv("TEMPLATE_RELOAD", "true")
+	defer os.Unsetenv("TEMPLATE_PATH")
+	defer os.Unsetenv("TEMPLATE_RELOAD")
+
+	app_ctx, err := NewAppContext("templates_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer app_ctx.Close()
+
+	tmpls := app_ctx.(*baseAppContext).templates
+	render := func() string {
+		tmpls.lastChecked = time.Time{}
+		var buf bytes.Buffer
+		tmpls.Execute(&buf, "index.html", nil)
+		return buf.String()
+	}
+
+	writeTemplateFiles(t, dir, map[string]string{"index.html": "v2"})
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(dir+"/index.html", future, future)
+	if out := render(); out != "v2" {
+		t.Errorf("Expected the changed template, got %q", out)
+	}
+
+	writeTemplateFiles(t, dir, map[string]string{"broken.html": "{{"})
+	if out := render(); out != "v2" {
+		t.Errorf("Expected the last good templates to be kept, got %q", out)
+	}
+	if tmpls.status()["last_error"] == "" {
+		t.Error("Expected the parse error in the status")
+	}
+
+	if _, err := NewAppContext("templates_test"); err == nil {
+		t.Error("Expected a broken template to fail NewAppContext")
+	}
+}
@@ -0,0 +1,321 @@
+package app_context
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var tlsClientAuth = map[string]tls.ClientAuthType{
+	"none":            tls.NoClientCert,
+	"request":         tls.RequestClientCert,
+	"verify_if_given": tls.VerifyClientCertIfGiven,
+	"require":         tls.RequireAndVerifyClientCert,
+}
+
+// tlsCert is a certificate and key pair that's reloaded when either file
+// changes, so renewed certificates are picked up without a restart
+type tlsCert struct {
+	certFile  string
+	keyFile   string
+	lock      sync.RWMutex
+	cert      *tls.Certificate
+	modTime   time.Time
+	notAfter  time.Time
+	lastError string
+}
+
+// TLSCertStatus is a certificate TLSConfig is serving, for Introspect
+type TLSCertStatus struct {
+	Name      string    `json:"name"`
+	CertFile  string    `json:"cert_file"`
+	NotAfter  time.Time `json:"not_after"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+func (self *tlsCert) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, path := range []string{self.certFile, self.keyFile} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return latest, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// load reads the pair if it changed since the last load, returning whether
+// it did
+func (self *tlsCert) load() (bool, error) {
+	mod_time, err := self.latestModTime()
+	if err == nil {
+		self.lock.RLock()
+		unchanged := self.cert != nil && mod_time.Equal(self.modTime)
+		self.lock.RUnlock()
+		if unchanged {
+			return false, nil
+		}
+	}
+
+	var cert tls.Certificate
+	var leaf *x509.Certificate
+	if err == nil {
+		cert, err = tls.LoadX509KeyPair(self.certFile, self.keyFile)
+	}
+	if err == nil {
+		leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if err != nil {
+		// Keep serving the last good pair, eg. while a renewal has only
+		// written one of the files
+		self.lastError = err.Error()
+		return false, err
+	}
+	cert.Leaf = leaf
+	self.cert = &cert
+	self.modTime = mod_time
+	self.notAfter = leaf.NotAfter
+	self.lastError = ""
+	return true, nil
+}
+
+func (self *tlsCert) current() *tls.Certificate {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	return self.cert
+}
+
+type tlsConfigs struct {
+	appctx   *baseAppContext
+	lock     sync.Mutex
+	certs    map[string]*tlsCert
+	interval time.Duration
+	stopChan chan struct{}
+	doneChan chan struct{}
+}
+
+func newTLSConfigs(appctx *baseAppContext) *tlsConfigs {
+	return &tlsConfigs{
+		appctx:   appctx,
+		certs:    make(map[string]*tlsCert),
+		interval: time.Minute,
+	}
+}
+
+// setting looks up TLS_<NAME>_<setting>, then TLS_<setting>
+func (self *tlsConfigs) setting(name, setting string) string {
+	if name != "" {
+		if val, found := self.appctx.lookupEnv("TLS_" + envName(name) + "_" + setting); found {
+			return val
+		}
+	}
+	return self.appctx.getEnv("TLS_" + setting)
+}
+
+// cert returns the shared certificate for name, loading it and starting
+// the reloader the first time
+func (self *tlsConfigs) cert(name, cert_file, key_file string) (*tlsCert, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if cert, ok := self.certs[name]; ok && cert.certFile == cert_file && cert.keyFile == key_file {
+		return cert, nil
+	}
+
+	cert := &tlsCert{certFile: cert_file, keyFile: key_file}
+	if _, err := cert.load(); err != nil {
+		return nil, err
+	}
+	self.certs[name] = cert
+	self.sendExpiry(name, cert)
+
+	if self.stopChan == nil {
+		self.start()
+	}
+	return cert, nil
+}
+
+func (self *tlsConfigs) sendExpiry(name string, cert *tlsCert) {
+	cert.lock.RLock()
+	not_after := cert.notAfter
+	cert.lock.RUnlock()
+
+	self.appctx.MetricsClient().Gauge(
+		"tls.cert_expiry_seconds",
+		not_after.Sub(self.appctx.Clock().Now()).Seconds(),
+		1.0,
+		map[string]string{"tls_config": name},
+	)
+}
+
+func (self *tlsConfigs) reload() {
+	self.lock.Lock()
+	certs := make(map[string]*tlsCert, len(self.certs))
+	for name, cert := range self.certs {
+		certs[name] = cert
+	}
+	self.lock.Unlock()
+
+	for name, cert := range certs {
+		reloaded, err := cert.load()
+		if err != nil {
+			self.appctx.Logger().LogErrorf(context.Background(), "Error reloading TLS certificate %s: %s", cert.certFile, err)
+			self.appctx.MetricsClient().Incr("tls.cert_reload", 1.0, map[string]string{"tls_config": name, "result": "error"})
+		} else if reloaded {
+			self.appctx.Logger().LogInfof(context.Background(), "Reloaded TLS certificate %s", cert.certFile)
+			self.appctx.MetricsClient().Incr("tls.cert_reload", 1.0, map[string]string{"tls_config": name, "result": "ok"})
+		}
+		self.sendExpiry(name, cert)
+	}
+}
+
+// must be called with lock held
+func (self *tlsConfigs) start() {
+	interval := self.interval
+	if d, found, err := self.appctx.getDurationFromEnv("TLS_RELOAD_INTERVAL"); err == nil && found && d > 0 {
+		interval = d
+	}
+
+	self.stopChan = make(chan struct{})
+	self.doneChan = make(chan struct{})
+	stop_chan, done_chan := self.stopChan, self.doneChan
+
+	goLabeled("tls_reload", func() {
+		defer close(done_chan)
+
+		ticker := self.appctx.Clock().NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop_chan:
+				return
+			case <-ticker.C():
+				self.reload()
+			}
+		}
+	})
+}
+
+func (self *tlsConfigs) stop() {
+	self.lock.Lock()
+	stop_chan, done_chan := self.stopChan, self.doneChan
+	self.stopChan = nil
+	self.lock.Unlock()
+
+	if stop_chan == nil {
+		return
+	}
+	close(stop_chan)
+	<-done_chan
+}
+
+func (self *tlsConfigs) Status() []*TLSCertStatus {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	statuses := make([]*TLSCertStatus, 0, len(self.certs))
+	for name, cert := range self.certs {
+		cert.lock.RLock()
+		statuses = append(statuses, &TLSCertStatus{
+			Name:      name,
+			CertFile:  cert.certFile,
+			NotAfter:  cert.notAfter,
+			LastError: cert.lastError,
+		})
+		cert.lock.RUnlock()
+	}
+	return statuses
+}
+
+// TLSConfig builds a *tls.Config for servers and clients alike from
+// TLS_<NAME>_<setting>, falling back to TLS_<setting> (only those for
+// name ""):
+//
+//	CERT_FILE, KEY_FILE  certificate presented to peers, reloaded when
+//	                     the files change (checked every
+//	                     TLS_RELOAD_INTERVAL, default 1m)
+//	CA_FILE              PEM CAs trusted for servers and client certs,
+//	                     instead of the system pool
+//	MIN_VERSION          1.0, 1.1, 1.2 (default) or 1.3
+//	CLIENT_AUTH          none (default), request, verify_if_given or
+//	                     require, for servers
+//	SERVER_NAME          name to verify servers as, for clients
+//
+// Each call returns a new config, so callers can change it, eg. to set
+// NextProtos; the certificate is shared.
+func (self *baseAppContext) TLSConfig(name string) (*tls.Config, error) {
+	configs := self.tlsConfigs
+	cfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: configs.setting(name, "SERVER_NAME"),
+	}
+
+	if ver := configs.setting(name, "MIN_VERSION"); ver != "" {
+		min_version, ok := tlsVersions[ver]
+		if !ok {
+			return nil, fmt.Errorf("Invalid TLS MIN_VERSION '%s'", ver)
+		}
+		cfg.MinVersion = min_version
+	}
+
+	if auth := configs.setting(name, "CLIENT_AUTH"); auth != "" {
+		client_auth, ok := tlsClientAuth[auth]
+		if !ok {
+			return nil, fmt.Errorf("Invalid TLS CLIENT_AUTH '%s'", auth)
+		}
+		cfg.ClientAuth = client_auth
+	}
+
+	if ca_file := configs.setting(name, "CA_FILE"); ca_file != "" {
+		data, err := ioutil.ReadFile(ca_file)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading TLS CA file: %s", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("No certificates found in %s", ca_file)
+		}
+		cfg.RootCAs = pool
+		cfg.ClientCAs = pool
+	}
+
+	cert_file := configs.setting(name, "CERT_FILE")
+	key_file := configs.setting(name, "KEY_FILE")
+	if (cert_file == "") != (key_file == "") {
+		return nil, errors.New("TLS CERT_FILE and KEY_FILE must be set together")
+	}
+	if cert_file != "" {
+		cert, err := configs.cert(name, cert_file, key_file)
+		if err != nil {
+			return nil, fmt.Errorf("Error loading TLS certificate: %s", err)
+		}
+		cfg.GetCertificate = func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return cert.current(), nil
+		}
+		cfg.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return cert.current(), nil
+		}
+	}
+
+	return cfg, nil
+}
@@ -0,0 +1,194 @@
+package app_context
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	crypto_rand "crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), crypto_rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(crypto_rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue writes a certificate for localhost with serial to cert_file and
+// key_file
+func (self *testCA) issue(t *testing.T, serial int64, cert_file, key_file string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), crypto_rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(crypto_rand.Reader, tmpl, self.cert, &key.PublicKey, self.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key_der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(cert_file, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(key_file, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: key_der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	ca_file := filepath.Join(dir, "ca.pem")
+	cert_file := filepath.Join(dir, "cert.pem")
+	key_file := filepath.Join(dir, "key.pem")
+	if err := ioutil.WriteFile(ca_file, ca.pem, 0600); err != nil {
+		t.Fatal(err)
+	}
+	ca.issue(t, 100, cert_file, key_file)
+
+	os.Setenv("TLS_CA_FILE", ca_file)
+	os.Setenv("TLS_API_CERT_FILE", cert_file)
+	os.Setenv("TLS_API_KEY_FILE", key_file)
+	os.Setenv("TLS_API_CLIENT_AUTH", "require")
+	os.Setenv("TLS_CLIENT_SERVER_NAME", "localhost")
+	os.Setenv("TLS_CLIENT_CERT_FILE", cert_file)
+	os.Setenv("TLS_CLIENT_KEY_FILE", key_file)
+	for _, name := range []string{"TLS_CA_FILE", "TLS_API_CERT_FILE", "TLS_API_KEY_FILE", "TLS_API_CLIENT_AUTH", "TLS_CLIENT_SERVER_NAME", "TLS_CLIENT_CERT_FILE", "TLS_CLIENT_KEY_FILE"} {
+		defer os.Unsetenv(name)
+	}
+
+	app_ctx, err := NewAppContext("tls_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app_ctx.Close()
+
+	server_cfg, err := app_ctx.TLSConfig("api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if server_cfg.MinVersion != tls.VersionTLS12 || server_cfg.ClientAuth != tls.RequireAndVerifyClientCert {
+		t.Errorf("Unexpected server config: %+v", server_cfg)
+	}
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	srv.TLS = server_cfg
+	srv.StartTLS()
+	defer srv.Close()
+
+	client_cfg, err := app_ctx.TLSConfig("client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: client_cfg}}
+
+	serial := func() int64 {
+		resp, err := client.Get(srv.URL)
+		if err != nil {
+			t.Fatalf("Request failed: %s", err)
+		}
+		resp.Body.Close()
+		client.CloseIdleConnections()
+		return resp.TLS.PeerCertificates[0].SerialNumber.Int64()
+	}
+	if got := serial(); got != 100 {
+		t.Errorf("Expected serial 100, got %d", got)
+	}
+
+	// A renewal writes new files; the next connection gets them
+	ca.issue(t, 101, cert_file, key_file)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(cert_file, later, later)
+	os.Chtimes(key_file, later, later)
+	app_ctx.(*baseAppContext).tlsConfigs.reload()
+
+	if got := serial(); got != 101 {
+		t.Errorf("Expected the reloaded serial 101, got %d", got)
+	}
+
+	// A half written renewal keeps the old pair
+	ioutil.WriteFile(key_file, []byte("garbage"), 0600)
+	later = later.Add(time.Minute)
+	os.Chtimes(key_file, later, later)
+	app_ctx.(*baseAppContext).tlsConfigs.reload()
+	if got := serial(); got != 101 {
+		t.Errorf("Expected serial 101 to be kept, got %d", got)
+	}
+	for _, status := range app_ctx.(*baseAppContext).tlsConfigs.Status() {
+		if status.LastError == "" {
+			t.Errorf("Expected reload error for %s", status.Name)
+		}
+	}
+}
+
+func TestTLSConfigInvalid(t *testing.T) {
+	app_ctx, err := NewAppContext("tls_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app_ctx.Close()
+
+	cfg, err := app_ctx.TLSConfig("")
+	if err != nil || cfg.MinVersion != tls.VersionTLS12 || cfg.GetCertificate != nil {
+		t.Errorf("Expected a default config, got %+v, %v", cfg, err)
+	}
+
+	os.Setenv("TLS_BAD_MIN_VERSION", "1.4")
+	defer os.Unsetenv("TLS_BAD_MIN_VERSION")
+	if _, err := app_ctx.TLSConfig("bad"); err == nil {
+		t.Error("Expected an invalid MIN_VERSION to fail")
+	}
+
+	os.Setenv("TLS_HALF_CERT_FILE", "cert.pem")
+	defer os.Unsetenv("TLS_HALF_CERT_FILE")
+	if _, err := app_ctx.TLSConfig("half"); err == nil {
+		t.Error("Expected CERT_FILE without KEY_FILE to fail")
+	}
+}
@@ -0,0 +1,232 @@
+package app_context
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+type TrafficRole string
+
+const (
+	TrafficRoleActive  TrafficRole = "active"
+	TrafficRoleStandby TrafficRole = "standby"
+)
+
+type TrafficRoleCallback func(old_role, new_role TrafficRole)
+
+func ParseTrafficRole(s string) (TrafficRole, error) {
+	switch role := TrafficRole(strings.ToLower(strings.TrimSpace(s))); role {
+	case TrafficRoleActive, TrafficRoleStandby:
+		return role, nil
+	}
+	return TrafficRoleActive, fmt.Errorf("Unknown traffic role: '%s'", s)
+}
+
+type trafficRoleWatcher struct {
+	appctx    *baseAppContext
+	lock      sync.Mutex
+	role      TrafficRole
+	callbacks []TrafficRoleCallback
+	read      func(ctx context.Context) (string, error)
+	source    string
+	interval  time.Duration
+	stopChan  chan struct{}
+	doneChan  chan struct{}
+}
+
+func (self *trafficRoleWatcher) get() TrafficRole {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.role
+}
+
+func (self *trafficRoleWatcher) set(role TrafficRole) {
+	self.lock.Lock()
+	old_role := self.role
+	if old_role == role {
+		self.lock.Unlock()
+		return
+	}
+	self.role = role
+	callbacks := make([]TrafficRoleCallback, len(self.callbacks))
+	copy(callbacks, self.callbacks)
+	self.lock.Unlock()
+
+	self.appctx.Logger().LogInfof(
+		context.Background(),
+		"Traffic role changed from %s to %s",
+		old_role,
+		role,
+	)
+
+	self.sendGauge(role)
+
+	for _, cb := range callbacks {
+		cb(old_role, role)
+	}
+}
+
+func (self *trafficRoleWatcher) sendGauge(role TrafficRole) {
+	active := 0.0
+	if role == TrafficRoleActive {
+		active = 1.0
+	}
+	self.appctx.MetricsClient().Gauge("traffic_role.active", active, 1.0, nil)
+}
+
+func (self *trafficRoleWatcher) onChange(cb TrafficRoleCallback) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.callbacks = append(self.callbacks, cb)
+}
+
+func (self *trafficRoleWatcher) poll() {
+	ctx, cancel := context.WithTimeout(context.Background(), self.interval)
+	defer cancel()
+
+	str, err := self.read(ctx)
+	if err == nil {
+		var role TrafficRole
+		if role, err = ParseTrafficRole(str); err == nil {
+			self.set(role)
+			return
+		}
+	}
+
+	// Keep the current role if the source is unavailable
+	self.appctx.Logger().LogWarnf(
+		ctx,
+		"Couldn't read traffic role from %s: %s",
+		self.source,
+		err,
+	)
+}
+
+func (self *trafficRoleWatcher) start() {
+	self.stopChan = make(chan struct{})
+	self.doneChan = make(chan struct{})
+
+	goLabeled("traffic_role", func() {
+		defer close(self.doneChan)
+		for {
+			select {
+			case <-self.stopChan:
+				return
+			case <-self.appctx.Clock().After(self.interval):
+				self.poll()
+			}
+		}
+	})
+}
+
+func (self *trafficRoleWatcher) stop() {
+	if self == nil || self.stopChan == nil {
+		return
+	}
+	close(self.stopChan)
+	<-self.doneChan
+	self.stopChan = nil
+}
+
+func readTrafficRoleFile(path string) func(ctx context.Context) (string, error) {
+	return func(ctx context.Context) (string, error) {
+		data, err := ioutil.ReadFile(path)
+		return string(data), err
+	}
+}
+
+func readTrafficRoleURL(url string) func(ctx context.Context) (string, error) {
+	return func(ctx context.Context) (string, error) {
+		req, err := http.NewRequest("GET", url, nil)
+		if err != nil {
+			return "", err
+		}
+		resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return "", fmt.Errorf("GET %s returned %d", url, resp.StatusCode)
+		}
+		data, err := ioutil.ReadAll(resp.Body)
+		return string(data), err
+	}
+}
+
+// TrafficRole returns whether this replica should be serving (active) or
+// idling (standby). Standby replicas should keep health checks green but
+// pause consumers and scheduled work.
+func (self *baseAppContext) TrafficRole() TrafficRole {
+	return self.trafficRole.get()
+}
+
+func (self *baseAppContext) SetTrafficRole(role TrafficRole) {
+	self.trafficRole.set(role)
+}
+
+func (self *baseAppContext) OnTrafficRoleChange(cb TrafficRoleCallback) {
+	self.trafficRole.onChange(cb)
+}
+
+// TRAFFIC_ROLE sets the initial role. TRAFFIC_ROLE_FILE or TRAFFIC_ROLE_URL
+// name a source polled every TRAFFIC_ROLE_POLL_INTERVAL for changes.
+func (self *baseAppContext) setTrafficRoleFromEnv() error {
+	watcher := &trafficRoleWatcher{
+		appctx:   self,
+		role:     TrafficRoleActive,
+		interval: 5 * time.Second,
+	}
+
+	self.trafficRole = watcher
+
+	if s := self.getEnv("TRAFFIC_ROLE"); s != "" {
+		role, err := ParseTrafficRole(s)
+		if err != nil {
+			return err
+		}
+		watcher.role = role
+	}
+
+	if interval, found, err := self.getDurationFromEnv("TRAFFIC_ROLE_POLL_INTERVAL"); err != nil {
+		return err
+	} else if found {
+		if interval == 0 {
+			return fmt.Errorf("TRAFFIC_ROLE_POLL_INTERVAL must be > 0")
+		}
+		watcher.interval = interval
+	}
+
+	file := self.getEnv("TRAFFIC_ROLE_FILE")
+	url := self.getEnv("TRAFFIC_ROLE_URL")
+
+	switch {
+	case file != "" && url != "":
+		return fmt.Errorf("Only one of TRAFFIC_ROLE_FILE and TRAFFIC_ROLE_URL may be set")
+	case file != "":
+		watcher.read = readTrafficRoleFile(file)
+		watcher.source = file
+	case url != "":
+		watcher.read = readTrafficRoleURL(url)
+		watcher.source = url
+	default:
+		return nil
+	}
+
+	str, err := watcher.read(context.Background())
+	if err != nil {
+		return fmt.Errorf("Couldn't read traffic role from %s: %s", watcher.source, err)
+	}
+	if watcher.role, err = ParseTrafficRole(str); err != nil {
+		return err
+	}
+
+	watcher.start()
+
+	return nil
+}
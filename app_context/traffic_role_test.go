@@ -0,0 +1,96 @@
+package app_context
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTrafficRoleEnv(t *testing.T) {
+	os.Unsetenv("TRAFFIC_ROLE")
+
+	app_ctx, err := NewAppContext("traffic_role_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if role := app_ctx.TrafficRole(); role != TrafficRoleActive {
+		t.Errorf("Default traffic role is not active: %s", role)
+	}
+
+	os.Setenv("TRAFFIC_ROLE", "standby")
+	defer os.Unsetenv("TRAFFIC_ROLE")
+
+	app_ctx, err = NewAppContext("traffic_role_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if role := app_ctx.TrafficRole(); role != TrafficRoleStandby {
+		t.Errorf("TRAFFIC_ROLE=standby but role is %s", role)
+	}
+
+	var changes []TrafficRole
+	app_ctx.OnTrafficRoleChange(func(old_role, new_role TrafficRole) {
+		changes = append(changes, new_role)
+	})
+
+	app_ctx.SetTrafficRole(TrafficRoleActive)
+	app_ctx.SetTrafficRole(TrafficRoleActive)
+
+	if len(changes) != 1 || changes[0] != TrafficRoleActive {
+		t.Errorf("Unexpected change callbacks: %+v", changes)
+	}
+
+	os.Setenv("TRAFFIC_ROLE", "primary")
+	if _, err := NewAppContext("traffic_role_test"); err == nil {
+		t.Error("app context should have failed with unknown TRAFFIC_ROLE")
+	}
+}
+
+func TestTrafficRoleFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "traffic_role_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "role")
+	ioutil.WriteFile(path, []byte("standby\n"), 0644)
+
+	os.Setenv("TRAFFIC_ROLE_FILE", path)
+	os.Setenv("TRAFFIC_ROLE_POLL_INTERVAL", "5ms")
+	defer func() {
+		os.Unsetenv("TRAFFIC_ROLE_FILE")
+		os.Unsetenv("TRAFFIC_ROLE_POLL_INTERVAL")
+	}()
+
+	app_ctx, err := NewAppContext("traffic_role_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer app_ctx.Close()
+
+	if role := app_ctx.TrafficRole(); role != TrafficRoleStandby {
+		t.Errorf("Role wasn't read from file: %s", role)
+	}
+
+	changed := make(chan TrafficRole, 1)
+	app_ctx.OnTrafficRoleChange(func(old_role, new_role TrafficRole) {
+		changed <- new_role
+	})
+
+	ioutil.WriteFile(path, []byte("active"), 0644)
+
+	select {
+	case role := <-changed:
+		if role != TrafficRoleActive {
+			t.Errorf("Changed to unexpected role: %s", role)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timed out waiting for role change")
+	}
+}
@@ -0,0 +1,521 @@
+package app_context
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tilteng/go-s3-config/s3config"
+)
+
+// A ParamOverride sets Param to Value until ExpiresAt. It applies to
+// instances whose hostname is listed in Instances, or which fall in the
+// first Percent of a stable per-param bucketing of hostnames. With neither
+// set, it applies everywhere.
+type ParamOverride struct {
+	Param     string    `json:"param"`
+	Value     string    `json:"value"`
+	Instances []string  `json:"instances,omitempty"`
+	Percent   float64   `json:"percent,omitempty"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type paramOverrides struct {
+	Overrides []ParamOverride `json:"overrides"`
+}
+
+// Tunables are operational parameters, like timeouts and pool sizes, that
+// can be temporarily overridden from a remote document, or on one instance
+// with Set or the admin server's /admin/tunables, while the app is
+// running. Only declared params, or ones listed in TUNABLE_PARAMS, are
+// overridden. Overrides revert automatically when they expire.
+type Tunables interface {
+	// Declare makes param tunable. onChange, if not nil, is called
+	// whenever its override is applied or reverted.
+	Declare(param string, onChange func())
+	Override(param string) (string, bool)
+	// The typed getters return the override's value, or def if there
+	// is no override or it doesn't parse.
+	Duration(param string, def time.Duration) time.Duration
+	Float(param string, def float64) float64
+	Int(param string, def int) int
+	Active() []ParamOverride
+	// Params are the tunable params, sorted
+	Params() []string
+	// Set overrides param on this instance only, ahead of the remote
+	// document, until ttl passes. The change is logged and kept in Audit
+	// with actor and reason.
+	Set(param, value string, ttl time.Duration, actor, reason string) error
+	// Revert drops a Set override early, returning false if there wasn't
+	// one
+	Revert(param, actor, reason string) bool
+	// Audit is the latest Set, Revert and expiry of local overrides,
+	// oldest first
+	Audit() []TunableChange
+}
+
+// TunableChange is an entry in Tunables().Audit(). Action is "set",
+// "revert" or "expire".
+type TunableChange struct {
+	Param     string    `json:"param"`
+	Action    string    `json:"action"`
+	Value     string    `json:"value,omitempty"`
+	ExpiresAt time.Time `json:"expires_at,omitempty"`
+	Actor     string    `json:"actor,omitempty"`
+	Reason    string    `json:"reason,omitempty"`
+	At        time.Time `json:"at"`
+}
+
+// maxTunableAudit is how many changes Audit keeps
+const maxTunableAudit = 100
+
+type tunables struct {
+	appctx    *baseAppContext
+	lock      sync.Mutex
+	allowed   map[string][]func()
+	overrides []ParamOverride
+	local     map[string]ParamOverride // from Set, by param
+	active    map[string]ParamOverride
+	defaults  map[string]float64 // last passed to the typed getters
+	audit     []TunableChange
+	read      func() (*paramOverrides, error)
+	source    string
+	interval  time.Duration
+	stopChan  chan struct{}
+	doneChan  chan struct{}
+}
+
+// inBucket hashes hostname per param, so the same instances are picked
+// each time but different params pick different instances.
+func inBucket(param, hostname string, percent float64) bool {
+	h := fnv.New32a()
+	h.Write([]byte(param + ":" + hostname))
+	return float64(h.Sum32()%10000)/100.0 < percent
+}
+
+func (self *tunables) matches(o ParamOverride) bool {
+	if len(o.Instances) == 0 && o.Percent <= 0 {
+		return true
+	}
+	for _, instance := range o.Instances {
+		if instance == self.appctx.hostname {
+			return true
+		}
+	}
+	return o.Percent > 0 && inBucket(o.Param, self.appctx.hostname, o.Percent)
+}
+
+// evaluate recomputes which overrides apply and calls onChange for params
+// that changed.
+func (self *tunables) evaluate(now time.Time) {
+	self.lock.Lock()
+
+	active := make(map[string]ParamOverride)
+	for param, o := range self.local {
+		if !now.Before(o.ExpiresAt) {
+			delete(self.local, param)
+			self.addAudit(TunableChange{Param: param, Action: "expire", Value: o.Value, At: now})
+			continue
+		}
+		active[param] = o
+	}
+	for _, o := range self.overrides {
+		if _, ok := self.allowed[o.Param]; !ok {
+			continue
+		}
+		if !now.Before(o.ExpiresAt) || !self.matches(o) {
+			continue
+		}
+		if _, ok := active[o.Param]; !ok {
+			active[o.Param] = o
+		}
+	}
+
+	changed := make([]string, 0)
+	for param, o := range active {
+		if old, ok := self.active[param]; !ok || old.Value != o.Value {
+			changed = append(changed, param)
+		}
+	}
+	for param := range self.active {
+		if _, ok := active[param]; !ok {
+			changed = append(changed, param)
+		}
+	}
+	sort.Strings(changed)
+
+	self.active = active
+
+	callbacks := make([]func(), 0)
+	for _, param := range changed {
+		if o, ok := active[param]; ok {
+			self.appctx.Logger().LogInfof(
+				context.Background(),
+				"Tunable %s overridden to '%s' until %s",
+				param,
+				o.Value,
+				o.ExpiresAt.Format(time.RFC3339),
+			)
+		} else {
+			self.appctx.Logger().LogInfof(context.Background(), "Tunable %s override reverted", param)
+		}
+		callbacks = append(callbacks, self.allowed[param]...)
+	}
+
+	num_active := len(active)
+	self.lock.Unlock()
+
+	if len(changed) > 0 {
+		self.appctx.MetricsClient().Gauge("tunables.active_overrides", float64(num_active), 1.0, nil)
+	}
+
+	for _, cb := range callbacks {
+		cb()
+	}
+
+	// After the callbacks, which read their defaults
+	for _, param := range changed {
+		self.sendValue(param)
+	}
+}
+
+// sendValue reports what a numeric param is now, its override or
+// otherwise its default. Durations are in seconds.
+func (self *tunables) sendValue(param string) {
+	self.lock.Lock()
+	val, found := self.defaults[param]
+	if o, ok := self.active[param]; ok {
+		if f, err := strconv.ParseFloat(o.Value, 64); err == nil {
+			val, found = f, true
+		} else if d, err := time.ParseDuration(o.Value); err == nil {
+			val, found = d.Seconds(), true
+		}
+	}
+	self.lock.Unlock()
+
+	if found {
+		self.appctx.MetricsClient().Gauge("tunables.value", val, 1.0, map[string]string{"param": param})
+	}
+}
+
+// must be called with lock held
+func (self *tunables) addAudit(change TunableChange) {
+	if len(self.audit) >= maxTunableAudit {
+		self.audit = append(self.audit[:0], self.audit[1:]...)
+	}
+	self.audit = append(self.audit, change)
+
+	self.appctx.Logger().LogInfof(
+		context.Background(),
+		"Tunable %s %s by '%s': value '%s', reason '%s'",
+		change.Param, change.Action, change.Actor, change.Value, change.Reason,
+	)
+	self.appctx.MetricsClient().Incr("tunables.changes", 1.0, map[string]string{
+		"param":  change.Param,
+		"action": change.Action,
+	})
+}
+
+func (self *tunables) Params() []string {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	params := make([]string, 0, len(self.allowed))
+	for param := range self.allowed {
+		params = append(params, param)
+	}
+	sort.Strings(params)
+	return params
+}
+
+func (self *tunables) Set(param, value string, ttl time.Duration, actor, reason string) error {
+	if ttl <= 0 {
+		return fmt.Errorf("A TTL is required, so the override reverts")
+	}
+
+	now := self.appctx.Clock().Now()
+	self.lock.Lock()
+	if _, ok := self.allowed[param]; !ok {
+		self.lock.Unlock()
+		return fmt.Errorf("'%s' isn't tunable", param)
+	}
+	o := ParamOverride{Param: param, Value: value, ExpiresAt: now.Add(ttl)}
+	self.local[param] = o
+	self.addAudit(TunableChange{
+		Param:     param,
+		Action:    "set",
+		Value:     value,
+		ExpiresAt: o.ExpiresAt,
+		Actor:     actor,
+		Reason:    reason,
+		At:        now,
+	})
+	self.lock.Unlock()
+
+	self.evaluate(now)
+	return nil
+}
+
+func (self *tunables) Revert(param, actor, reason string) bool {
+	now := self.appctx.Clock().Now()
+	self.lock.Lock()
+	o, ok := self.local[param]
+	if ok {
+		delete(self.local, param)
+		self.addAudit(TunableChange{Param: param, Action: "revert", Value: o.Value, Actor: actor, Reason: reason, At: now})
+	}
+	self.lock.Unlock()
+
+	if ok {
+		self.evaluate(now)
+	}
+	return ok
+}
+
+func (self *tunables) Audit() []TunableChange {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return append([]TunableChange(nil), self.audit...)
+}
+
+func (self *tunables) setDefault(param string, def float64) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.defaults[param] = def
+}
+
+func (self *tunables) Declare(param string, onChange func()) {
+	self.lock.Lock()
+	if onChange != nil {
+		self.allowed[param] = append(self.allowed[param], onChange)
+	} else if _, ok := self.allowed[param]; !ok {
+		self.allowed[param] = nil
+	}
+	self.lock.Unlock()
+
+	self.evaluate(self.appctx.Clock().Now())
+}
+
+func (self *tunables) Override(param string) (string, bool) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	o, ok := self.active[param]
+	return o.Value, ok
+}
+
+func (self *tunables) Duration(param string, def time.Duration) time.Duration {
+	self.setDefault(param, def.Seconds())
+	if s, ok := self.Override(param); ok {
+		if d, err := time.ParseDuration(s); err == nil && d >= 0 {
+			return d
+		}
+	}
+	return def
+}
+
+func (self *tunables) Float(param string, def float64) float64 {
+	self.setDefault(param, def)
+	if s, ok := self.Override(param); ok {
+		if f, err := strconv.ParseFloat(s, 64); err == nil {
+			return f
+		}
+	}
+	return def
+}
+
+func (self *tunables) Int(param string, def int) int {
+	self.setDefault(param, float64(def))
+	if s, ok := self.Override(param); ok {
+		if n, err := strconv.Atoi(s); err == nil {
+			return n
+		}
+	}
+	return def
+}
+
+func (self *tunables) Active() []ParamOverride {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	active := make([]ParamOverride, 0, len(self.active))
+	for _, o := range self.active {
+		active = append(active, o)
+	}
+	sort.Slice(active, func(i, j int) bool {
+		return active[i].Param < active[j].Param
+	})
+	return active
+}
+
+func (self *tunables) fetch() error {
+	doc, err := self.read()
+	if err != nil {
+		return err
+	}
+
+	overrides := make([]ParamOverride, 0, len(doc.Overrides))
+	for _, o := range doc.Overrides {
+		// Overrides must revert on their own
+		if o.Param == "" || o.ExpiresAt.IsZero() {
+			self.appctx.Logger().LogWarnf(
+				context.Background(),
+				"Ignoring tunable override without a param or expires_at: %+v",
+				o,
+			)
+			continue
+		}
+		overrides = append(overrides, o)
+	}
+
+	self.lock.Lock()
+	self.overrides = overrides
+	self.lock.Unlock()
+
+	return nil
+}
+
+func (self *tunables) start() {
+	self.stopChan = make(chan struct{})
+	self.doneChan = make(chan struct{})
+
+	goLabeled("tunables", func() {
+		defer close(self.doneChan)
+
+		// Expiry is checked every second, independent of polling
+		clock := self.appctx.Clock()
+		ticker := clock.NewTicker(time.Second)
+		defer ticker.Stop()
+		last_fetch := clock.Now()
+
+		for {
+			select {
+			case <-self.stopChan:
+				return
+			case now := <-ticker.C():
+				if now.Sub(last_fetch) >= self.interval {
+					last_fetch = now
+					if err := self.fetch(); err != nil {
+						// Keep the current overrides, they still expire
+						self.appctx.Logger().LogWarnf(
+							context.Background(),
+							"Couldn't read tunables from %s: %s",
+							self.source,
+							err,
+						)
+					}
+				}
+				self.evaluate(now)
+			}
+		}
+	})
+}
+
+func (self *tunables) stop() {
+	if self == nil || self.stopChan == nil {
+		return
+	}
+	close(self.stopChan)
+	<-self.doneChan
+	self.stopChan = nil
+}
+
+func readTunablesFile(path string) func() (*paramOverrides, error) {
+	return func() (*paramOverrides, error) {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		doc := &paramOverrides{}
+		if err := json.Unmarshal(data, doc); err != nil {
+			return nil, fmt.Errorf("Error decoding json: %s", err)
+		}
+		return doc, nil
+	}
+}
+
+func readTunablesS3(region, bucket, key string) func() (*paramOverrides, error) {
+	return func() (*paramOverrides, error) {
+		doc := &paramOverrides{}
+		if err := s3config.FetchConfig(region, bucket, key, doc); err != nil {
+			return nil, err
+		}
+		return doc, nil
+	}
+}
+
+func (self *baseAppContext) Tunables() Tunables {
+	return self.tunables
+}
+
+// APPCTX_S3_TUNABLES (region::bucket::key) or TUNABLES_FILE name a JSON
+// document of {"overrides": [...]}, polled every TUNABLES_POLL_INTERVAL.
+func (self *baseAppContext) setTunablesFromEnv() error {
+	t := &tunables{
+		appctx:   self,
+		allowed:  make(map[string][]func()),
+		local:    make(map[string]ParamOverride),
+		active:   make(map[string]ParamOverride),
+		defaults: make(map[string]float64),
+		interval: 30 * time.Second,
+	}
+
+	self.tunables = t
+
+	for _, param := range strings.Split(self.getEnv("TUNABLE_PARAMS"), ",") {
+		if param = strings.TrimSpace(param); param != "" {
+			t.allowed[param] = nil
+		}
+	}
+
+	if interval, found, err := self.getDurationFromEnv("TUNABLES_POLL_INTERVAL"); err != nil {
+		return err
+	} else if found {
+		if interval == 0 {
+			return fmt.Errorf("TUNABLES_POLL_INTERVAL must be > 0")
+		}
+		t.interval = interval
+	}
+
+	s3loc := self.getEnv("APPCTX_S3_TUNABLES")
+	file := self.getEnv("TUNABLES_FILE")
+
+	switch {
+	case s3loc != "" && file != "":
+		return fmt.Errorf("Only one of APPCTX_S3_TUNABLES and TUNABLES_FILE may be set")
+	case s3loc != "":
+		locparts := strings.Split(s3loc, "::")
+		if len(locparts) != 3 {
+			return fmt.Errorf("APPCTX_S3_TUNABLES should be: region::bucket::key")
+		}
+		t.read = readTunablesS3(locparts[0], locparts[1], locparts[2])
+		t.source = "s3://" + locparts[1] + "/" + locparts[2]
+	case file != "":
+		t.read = readTunablesFile(file)
+		t.source = file
+	default:
+		return nil
+	}
+
+	// Not being able to read the overrides at startup isn't fatal, the
+	// app just runs with its configured values.
+	if err := t.fetch(); err != nil {
+		self.logger.LogWarnf(
+			context.Background(),
+			"Couldn't read tunables from %s: %s",
+			t.source,
+			err,
+		)
+	}
+	t.evaluate(t.appctx.Clock().Now())
+
+	t.start()
+
+	return nil
+}
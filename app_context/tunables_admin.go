@@ -0,0 +1,112 @@
+package app_context
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type tunableSetRequest struct {
+	Param  string `json:"param"`
+	Value  string `json:"value"`
+	TTL    string `json:"ttl"`
+	Actor  string `json:"actor"`
+	Reason string `json:"reason"`
+}
+
+type tunablesResponse struct {
+	Params []string        `json:"params"`
+	Active []ParamOverride `json:"active"`
+	Audit  []TunableChange `json:"audit"`
+}
+
+// adminAuthorized checks r for "Authorization: Bearer <ADMIN_TOKEN>".
+// Without ADMIN_TOKEN nothing is authorized.
+func (self *baseAppContext) adminAuthorized(r *http.Request) bool {
+	if self.adminToken == "" {
+		return false
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(self.adminToken)) == 1
+}
+
+func writeAdminJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeAdminError(w http.ResponseWriter, status int, msg string) {
+	writeAdminJSON(w, status, map[string]string{"error": msg})
+}
+
+// tunablesAdminHandler serves /admin/tunables, for changing tunables on
+// this instance during an incident:
+//
+//	GET                    params, active overrides and the audit log
+//	POST {"param", "value", "ttl", "actor", "reason"}
+//	                       override param until ttl (at most
+//	                       TUNABLES_ADMIN_MAX_TTL, default 4h) passes
+//	DELETE ?param=&actor=&reason=
+//	                       revert an override made with POST
+//
+// Every request needs ADMIN_TOKEN as a bearer token, and changes need a
+// reason.
+func (self *baseAppContext) tunablesAdminHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !self.adminAuthorized(r) {
+			writeAdminError(w, http.StatusUnauthorized, "A valid ADMIN_TOKEN bearer token is required")
+			return
+		}
+
+		tun := self.Tunables()
+		switch r.Method {
+		case "GET":
+		case "POST":
+			var req tunableSetRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				writeAdminError(w, http.StatusBadRequest, "Invalid JSON: "+err.Error())
+				return
+			}
+			ttl, err := time.ParseDuration(req.TTL)
+			if err != nil || ttl <= 0 {
+				writeAdminError(w, http.StatusBadRequest, "ttl must be a duration > 0, eg. 15m")
+				return
+			}
+			if ttl > self.tunablesMaxTTL {
+				writeAdminError(w, http.StatusBadRequest, "ttl is longer than TUNABLES_ADMIN_MAX_TTL "+self.tunablesMaxTTL.String())
+				return
+			}
+			if req.Reason == "" {
+				writeAdminError(w, http.StatusBadRequest, "A reason is required")
+				return
+			}
+			if err := tun.Set(req.Param, req.Value, ttl, req.Actor, req.Reason); err != nil {
+				writeAdminError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+		case "DELETE":
+			q := r.URL.Query()
+			if q.Get("reason") == "" {
+				writeAdminError(w, http.StatusBadRequest, "A reason is required")
+				return
+			}
+			if !tun.Revert(q.Get("param"), q.Get("actor"), q.Get("reason")) {
+				writeAdminError(w, http.StatusNotFound, "No override of '"+q.Get("param")+"' to revert")
+				return
+			}
+		default:
+			w.Header().Set("Allow", "GET, POST, DELETE")
+			writeAdminError(w, http.StatusMethodNotAllowed, "Method not allowed")
+			return
+		}
+
+		writeAdminJSON(w, http.StatusOK, &tunablesResponse{
+			Params: tun.Params(),
+			Active: tun.Active(),
+			Audit:  tun.Audit(),
+		})
+	})
+}
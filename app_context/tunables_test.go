@@ -0,0 +1,210 @@
+package app_context
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTunablesOverrides(t *testing.T) {
+	hostname, _ := os.Hostname()
+	expires := time.Now().Add(time.Hour)
+
+	doc := paramOverrides{Overrides: []ParamOverride{
+		{Param: "ADMISSION_QUEUE_TIMEOUT", Value: "250ms", ExpiresAt: expires},
+		{Param: "SAMPLE_RATE", Value: "0.5", Instances: []string{"not-" + hostname}, ExpiresAt: expires},
+		{Param: "SAMPLE_RATE", Value: "0.25", Percent: 100, ExpiresAt: expires},
+		{Param: "POOL_SIZE", Value: "8", Instances: []string{hostname}, ExpiresAt: expires},
+		{Param: "POOL_SIZE", Value: "4", ExpiresAt: expires},
+		{Param: "STALE", Value: "1", ExpiresAt: time.Now().Add(-time.Minute)},
+		{Param: "NO_EXPIRY", Value: "1"},
+		{Param: "UNDECLARED", Value: "1", ExpiresAt: expires},
+	}}
+
+	data, _ := json.Marshal(doc)
+
+	dir, err := ioutil.TempDir("", "tunables_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "tunables.json")
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	os.Setenv("TUNABLES_FILE", path)
+	defer os.Unsetenv("TUNABLES_FILE")
+	os.Setenv("TUNABLE_PARAMS", "SAMPLE_RATE,POOL_SIZE,STALE,NO_EXPIRY")
+	defer os.Unsetenv("TUNABLE_PARAMS")
+	os.Setenv("ADMISSION_QUEUE_TIMEOUT", "2s")
+	defer os.Unsetenv("ADMISSION_QUEUE_TIMEOUT")
+
+	app_ctx, err := NewAppContext("tunables_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer app_ctx.Close()
+
+	tun := app_ctx.Tunables()
+
+	if rate := tun.Float("SAMPLE_RATE", 1.0); rate != 0.25 {
+		t.Errorf("Expected percent override of 0.25, got %v", rate)
+	}
+	if size := tun.Int("POOL_SIZE", 2); size != 8 {
+		t.Errorf("Instance override should win, got %d", size)
+	}
+	for _, param := range []string{"STALE", "NO_EXPIRY", "UNDECLARED"} {
+		if v, ok := tun.Override(param); ok {
+			t.Errorf("%s shouldn't be overridden, got '%s'", param, v)
+		}
+	}
+
+	ctrl := app_ctx.Admission().(*admissionController)
+	if ctrl.queueTimeout != 250*time.Millisecond {
+		t.Errorf("Admission queue timeout not tuned: %s", ctrl.queueTimeout)
+	}
+
+	if n := len(tun.Active()); n != 3 {
+		t.Errorf("Expected 3 active overrides, got %d: %+v", n, tun.Active())
+	}
+
+	// Everything expires. Stop the poller so it can't re-apply them.
+	tun.(*tunables).stop()
+	tun.(*tunables).evaluate(expires.Add(time.Second))
+
+	if len(tun.Active()) != 0 {
+		t.Errorf("Overrides should have expired: %+v", tun.Active())
+	}
+	if ctrl.queueTimeout != 2*time.Second {
+		t.Errorf("Admission queue timeout not reverted: %s", ctrl.queueTimeout)
+	}
+}
+
+func TestInBucket(t *testing.T) {
+	in := 0
+	for i := 0; i < 1000; i++ {
+		if inBucket("param", "host-"+strconv.Itoa(i), 10) {
+			in++
+		}
+	}
+	if in < 50 || in > 150 {
+		t.Errorf("10%% bucketing picked %d of 1000 hosts", in)
+	}
+	if inBucket("param", "host", 0) || !inBucket("param", "host", 100) {
+		t.Error("0% and 100% should pick none and all hosts")
+	}
+}
+
+func TestTunablesAdmin(t *testing.T) {
+	os.Setenv("ADMIN_TOKEN", "letmein")
+	defer os.Unsetenv("ADMIN_TOKEN")
+	os.Setenv("CIRCUIT_BREAKER_PAYMENTS_FAILURES", "3")
+	defer os.Unsetenv("CIRCUIT_BREAKER_PAYMENTS_FAILURES")
+	os.Setenv("RATE_LIMIT_SIGNUPS", "10/s")
+	defer os.Unsetenv("RATE_LIMIT_SIGNUPS")
+
+	clock := NewFakeClock(time.Now())
+	app_ctx, err := NewAppContext("tunables_test", WithClock(clock))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer app_ctx.Close()
+
+	mcli := newCountingMetricsClient()
+	app_ctx.SetMetricsClient(mcli)
+
+	breaker := app_ctx.CircuitBreakers().Get("payments").(*circuitBreaker)
+	limiter := app_ctx.RateLimiter("signups").(*rateLimiter)
+	handler := app_ctx.(*baseAppContext).tunablesAdminHandler()
+
+	call := func(method, target, body, token string) (int, tunablesResponse) {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		var resp tunablesResponse
+		json.NewDecoder(w.Body).Decode(&resp)
+		return w.Code, resp
+	}
+
+	if code, _ := call("GET", "/admin/tunables", "", "wrong"); code != http.StatusUnauthorized {
+		t.Errorf("Expected a bad token to be rejected, got %d", code)
+	}
+
+	code, resp := call("GET", "/admin/tunables", "", "letmein")
+	if code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", code)
+	}
+	params := strings.Join(resp.Params, ",")
+	for _, param := range []string{"ADMISSION_MAX_CONCURRENCY", "CIRCUIT_BREAKER_PAYMENTS_FAILURES", "CIRCUIT_BREAKER_PAYMENTS_OPEN_TIMEOUT", "RATE_LIMIT_SIGNUPS"} {
+		if !strings.Contains(params, param) {
+			t.Errorf("Expected %s to be tunable: %s", param, params)
+		}
+	}
+
+	for _, body := range []string{
+		`{"param": "CIRCUIT_BREAKER_PAYMENTS_FAILURES", "value": "20", "reason": "flaky provider"}`,
+		`{"param": "CIRCUIT_BREAKER_PAYMENTS_FAILURES", "value": "20", "ttl": "48h", "reason": "flaky provider"}`,
+		`{"param": "CIRCUIT_BREAKER_PAYMENTS_FAILURES", "value": "20", "ttl": "10m"}`,
+		`{"param": "NOT_TUNABLE", "value": "1", "ttl": "10m", "reason": "test"}`,
+	} {
+		if code, _ := call("POST", "/admin/tunables", body, "letmein"); code != http.StatusBadRequest {
+			t.Errorf("Expected %s to be rejected, got %d", body, code)
+		}
+	}
+
+	code, resp = call("POST", "/admin/tunables", `{"param": "CIRCUIT_BREAKER_PAYMENTS_FAILURES", "value": "20", "ttl": "10m", "actor": "oncall", "reason": "flaky provider"}`, "letmein")
+	if code != http.StatusOK || len(resp.Active) != 1 {
+		t.Fatalf("Expected the override to be active, got %d: %+v", code, resp)
+	}
+	if status := breaker.status(); status.Threshold != 20 {
+		t.Errorf("Expected the breaker threshold to be tuned to 20, got %d", status.Threshold)
+	}
+	if mcli.count("tunables.value") == 0 {
+		t.Error("Expected a tunables.value gauge")
+	}
+
+	call("POST", "/admin/tunables", `{"param": "RATE_LIMIT_SIGNUPS", "value": "100/s", "ttl": "1m", "reason": "launch"}`, "letmein")
+	if rate, burst := limiter.settings(); rate != 100 || burst != 100 {
+		t.Errorf("Expected the rate limit to be tuned, got %v/%d", rate, burst)
+	}
+
+	// The breaker override is reverted by hand, the rate limit's expires
+	if code, _ := call("DELETE", "/admin/tunables?param=CIRCUIT_BREAKER_PAYMENTS_FAILURES&actor=oncall&reason=fixed", "", "letmein"); code != http.StatusOK {
+		t.Errorf("Expected the revert to work, got %d", code)
+	}
+	if status := breaker.status(); status.Threshold != 3 {
+		t.Errorf("Expected the breaker threshold to revert to 3, got %d", status.Threshold)
+	}
+
+	clock.Advance(2 * time.Minute)
+	tun := app_ctx.Tunables().(*tunables)
+	tun.evaluate(clock.Now())
+	if rate, burst := limiter.settings(); rate != 10 || burst != 10 {
+		t.Errorf("Expected the rate limit to revert, got %v/%d", rate, burst)
+	}
+
+	actions := []string{}
+	for _, change := range tun.Audit() {
+		actions = append(actions, change.Param+":"+change.Action)
+	}
+	expected := "CIRCUIT_BREAKER_PAYMENTS_FAILURES:set,RATE_LIMIT_SIGNUPS:set,CIRCUIT_BREAKER_PAYMENTS_FAILURES:revert,RATE_LIMIT_SIGNUPS:expire"
+	if strings.Join(actions, ",") != expected {
+		t.Errorf("Unexpected audit log: %v", actions)
+	}
+	if audit := tun.Audit(); audit[0].Actor != "oncall" || audit[0].Reason != "flaky provider" {
+		t.Errorf("Audit should have the actor and reason: %+v", audit[0])
+	}
+}
@@ -0,0 +1,103 @@
+package app_context
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/comstud/go-rollbar/rollbar"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// isRetryableTxError is true for postgres serialization failures and
+// deadlocks, which succeed if the whole transaction is run again
+func isRetryableTxError(err error) bool {
+	if pq_err, ok := err.(*pq.Error); ok {
+		return pq_err.Code == "40001" || pq_err.Code == "40P01"
+	}
+	return false
+}
+
+func (self *baseAppContext) runTx(ctx context.Context, db *sqlx.DB, fn func(tx *sql.Tx) error) (err error) {
+	tx, err := db.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			tx.Rollback()
+			panic(r)
+		}
+	}()
+
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// WithTx runs fn in a transaction on DBWrite, committing if it returns nil
+// and rolling back otherwise. When the transaction fails with a
+// serialization failure or deadlock, fn is run again in a new transaction
+// up to DB_TX_MAX_RETRIES (default 3) times, so fn must not have side
+// effects outside the transaction. Other failures are logged and reported
+// to rollbar before being returned.
+func (self *baseAppContext) WithTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	db := self.DBWrite()
+	if db == nil {
+		return errors.New("No database is configured")
+	}
+
+	backoff := 10 * time.Millisecond
+
+	for attempt := 0; ; attempt++ {
+		err := self.runTx(ctx, db, fn)
+		if err == nil {
+			return nil
+		}
+
+		if !isRetryableTxError(err) || ctx.Err() != nil {
+			self.Logger().LogErrorf(ctx, "Transaction failed: %s", err)
+			if ctx.Err() == nil {
+				self.reportError(err, rollbar.CustomInfo{"attempts": attempt + 1})
+			}
+			return err
+		}
+
+		if attempt >= self.txMaxRetries {
+			self.Logger().LogErrorf(ctx, "Transaction failed after %d attempts: %s", attempt+1, err)
+			self.reportError(err, rollbar.CustomInfo{"attempts": attempt + 1})
+			return err
+		}
+
+		self.MetricsClient().Incr("db.tx_retries", 1.0, nil)
+		self.Logger().LogDebugf(ctx, "Retrying transaction after: %s", err)
+
+		// Jitter keeps conflicting transactions from retrying in lockstep
+		sleep := backoff/2 + time.Duration(self.Rand().Int63n(int64(backoff)))
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-self.Clock().After(sleep):
+		}
+		backoff *= 2
+	}
+}
+
+func (self *baseAppContext) setTxMaxRetriesFromEnv() error {
+	self.txMaxRetries = 3
+	if n, found, err := self.getIntFromEnv("DB_TX_MAX_RETRIES"); err != nil {
+		return err
+	} else if found {
+		if n < 0 {
+			return errors.New("DB_TX_MAX_RETRIES must be >= 0")
+		}
+		self.txMaxRetries = n
+	}
+	return nil
+}
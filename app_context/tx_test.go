@@ -0,0 +1,90 @@
+package app_context
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"log"
+	"os"
+	"testing"
+
+	"github.com/lib/pq"
+)
+
+func TestWithTx(t *testing.T) {
+	os.Setenv("DB_TX_MAX_RETRIES", "2")
+	defer os.Unsetenv("DB_TX_MAX_RETRIES")
+
+	app_ctx, err := NewAppContext("tx_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer app_ctx.Close()
+
+	ctx := context.Background()
+	if err := app_ctx.WithTx(ctx, func(tx *sql.Tx) error { return nil }); err == nil {
+		t.Error("WithTx should fail without a database")
+	}
+
+	db, err := app_ctx.(*baseAppContext).openDB("appctx_fake", "", "primary")
+	if err != nil {
+		t.Fatal(err)
+	}
+	app_ctx.SetDB(db)
+	defer app_ctx.SetDB(nil)
+
+	conflicts := 0
+	fakeExecHook = func(query string, args []driver.Value) error {
+		if query == "CONFLICT" && conflicts > 0 {
+			conflicts--
+			return &pq.Error{Code: "40001"}
+		}
+		return nil
+	}
+	defer func() { fakeExecHook = nil }()
+
+	runs := 0
+	conflicting := func(tx *sql.Tx) error {
+		runs++
+		_, err := tx.Exec("CONFLICT")
+		return err
+	}
+
+	conflicts = 2
+	if err := app_ctx.WithTx(ctx, conflicting); err != nil {
+		t.Errorf("Expected success after retries: %s", err)
+	}
+	if runs != 3 {
+		t.Errorf("Expected 3 runs, got %d", runs)
+	}
+
+	runs, conflicts = 0, 5
+	err = app_ctx.WithTx(ctx, conflicting)
+	if pq_err, ok := err.(*pq.Error); !ok || pq_err.Code != "40001" {
+		t.Errorf("Expected the serialization failure once retries ran out, got %v", err)
+	}
+	if runs != 3 {
+		t.Errorf("Expected 3 runs, got %d", runs)
+	}
+
+	runs = 0
+	failure := errors.New("Not retryable")
+	if err := app_ctx.WithTx(ctx, func(tx *sql.Tx) error {
+		runs++
+		return failure
+	}); err != failure || runs != 1 {
+		t.Errorf("Other errors shouldn't be retried: %v after %d runs", err, runs)
+	}
+
+	func() {
+		defer func() {
+			if r := recover(); r != "kaboom" {
+				t.Errorf("Panic should propagate, got %v", r)
+			}
+		}()
+		app_ctx.WithTx(ctx, func(tx *sql.Tx) error {
+			panic("kaboom")
+		})
+	}()
+}
@@ -0,0 +1,240 @@
+package app_context
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/comstud/go-rollbar/rollbar"
+)
+
+// Watchdog catches background loops that have silently wedged. Components
+// call Beat regularly; one that misses its timeout has all goroutine stacks
+// logged, is reported to rollbar and is marked unhealthy as
+// "watchdog:<name>" until it beats again.
+type Watchdog interface {
+	// Watch sets the timeout for name. Beat on a name that isn't watched
+	// yet starts watching it with WATCHDOG_TIMEOUT.
+	Watch(name string, timeout time.Duration)
+	Unwatch(name string)
+	Beat(name string)
+	Status() []*WatchdogStatus
+}
+
+type WatchdogStatus struct {
+	Name     string        `json:"name"`
+	Timeout  time.Duration `json:"timeout"`
+	LastBeat time.Time     `json:"last_beat"`
+	Stalled  bool          `json:"stalled"`
+	Stalls   int           `json:"stalls"`
+}
+
+type watchdog struct {
+	appctx         *baseAppContext
+	defaultTimeout time.Duration
+	checkInterval  time.Duration
+	lock           sync.Mutex
+	components     map[string]*WatchdogStatus
+	stopChan       chan struct{}
+	doneChan       chan struct{}
+}
+
+func (self *watchdog) healthName(name string) string {
+	return "watchdog:" + name
+}
+
+// must be called with lock held
+func (self *watchdog) watchLocked(name string, timeout time.Duration) *WatchdogStatus {
+	status, ok := self.components[name]
+	if !ok {
+		status = &WatchdogStatus{Name: name, LastBeat: self.appctx.Clock().Now()}
+		self.components[name] = status
+		self.appctx.Health().SetStatus(self.healthName(name), nil)
+	}
+	status.Timeout = timeout
+
+	if self.stopChan == nil {
+		self.start()
+	}
+
+	return status
+}
+
+func (self *watchdog) Watch(name string, timeout time.Duration) {
+	if timeout <= 0 {
+		timeout = self.defaultTimeout
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.watchLocked(name, timeout)
+}
+
+func (self *watchdog) Unwatch(name string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if _, ok := self.components[name]; ok {
+		delete(self.components, name)
+		self.appctx.Health().Unregister(self.healthName(name))
+	}
+}
+
+func (self *watchdog) Beat(name string) {
+	self.lock.Lock()
+	status, ok := self.components[name]
+	if !ok {
+		status = self.watchLocked(name, self.defaultTimeout)
+	}
+	status.LastBeat = self.appctx.Clock().Now()
+	recovered := status.Stalled
+	status.Stalled = false
+	self.lock.Unlock()
+
+	if recovered {
+		self.appctx.Health().SetStatus(self.healthName(name), nil)
+		self.appctx.Logger().LogInfof(context.Background(), "Watchdog: '%s' is beating again", name)
+	}
+}
+
+func (self *watchdog) Status() []*WatchdogStatus {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	statuses := make([]*WatchdogStatus, 0, len(self.components))
+	for _, status := range self.components {
+		status_copy := *status
+		statuses = append(statuses, &status_copy)
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Name < statuses[j].Name
+	})
+	return statuses
+}
+
+func (self *watchdog) check(now time.Time) {
+	self.lock.Lock()
+	stalled := make([]WatchdogStatus, 0)
+	for _, status := range self.components {
+		if !status.Stalled && now.Sub(status.LastBeat) > status.Timeout {
+			status.Stalled = true
+			status.Stalls++
+			stalled = append(stalled, *status)
+		}
+	}
+	self.lock.Unlock()
+
+	if len(stalled) == 0 {
+		return
+	}
+
+	stacks := allStacks()
+	for _, status := range stalled {
+		self.stalled(&status, now, stacks)
+	}
+}
+
+func (self *watchdog) stalled(status *WatchdogStatus, now time.Time, stacks string) {
+	since := now.Sub(status.LastBeat)
+	err := fmt.Errorf("Watchdog: no heartbeat from '%s' in %s", status.Name, since.Truncate(time.Millisecond))
+
+	self.appctx.Logger().LogErrorf(context.Background(), "%s, goroutines:\n%s", err, stacks)
+	self.appctx.Health().SetStatus(self.healthName(status.Name), err)
+	self.appctx.MetricsClient().Incr("watchdog.stalls", 1.0, map[string]string{"component": status.Name})
+	self.appctx.reportError(err, rollbar.CustomInfo{
+		"component":  status.Name,
+		"timeout":    status.Timeout.String(),
+		"last_beat":  status.LastBeat,
+		"goroutines": stacks,
+	})
+}
+
+func allStacks() string {
+	buf := make([]byte, 64*1024)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) || len(buf) >= 16*1024*1024 {
+			return string(buf[:n])
+		}
+		buf = make([]byte, len(buf)*2)
+	}
+}
+
+// must be called with lock held
+func (self *watchdog) start() {
+	self.stopChan = make(chan struct{})
+	self.doneChan = make(chan struct{})
+
+	stop_chan, done_chan := self.stopChan, self.doneChan
+	goLabeled("watchdog", func() {
+		defer close(done_chan)
+		ticker := self.appctx.Clock().NewTicker(self.checkInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop_chan:
+				return
+			case now := <-ticker.C():
+				self.check(now)
+			}
+		}
+	})
+}
+
+func (self *watchdog) stop() {
+	if self == nil {
+		return
+	}
+
+	self.lock.Lock()
+	stop_chan, done_chan := self.stopChan, self.doneChan
+	self.stopChan = nil
+	self.lock.Unlock()
+
+	if stop_chan == nil {
+		return
+	}
+	close(stop_chan)
+	<-done_chan
+}
+
+func (self *baseAppContext) Watchdog() Watchdog {
+	return self.watchdog
+}
+
+// WATCHDOG_TIMEOUT (default 1m) is the timeout for components that Beat
+// without calling Watch first. Deadlines are checked every
+// WATCHDOG_CHECK_INTERVAL (default 1s).
+func (self *baseAppContext) setWatchdogFromEnv() error {
+	wd := &watchdog{
+		appctx:         self,
+		defaultTimeout: time.Minute,
+		checkInterval:  time.Second,
+		components:     make(map[string]*WatchdogStatus),
+	}
+
+	if timeout, found, err := self.getDurationFromEnv("WATCHDOG_TIMEOUT"); err != nil {
+		return err
+	} else if found {
+		if timeout <= 0 {
+			return fmt.Errorf("WATCHDOG_TIMEOUT must be > 0")
+		}
+		wd.defaultTimeout = timeout
+	}
+
+	if interval, found, err := self.getDurationFromEnv("WATCHDOG_CHECK_INTERVAL"); err != nil {
+		return err
+	} else if found {
+		if interval <= 0 {
+			return fmt.Errorf("WATCHDOG_CHECK_INTERVAL must be > 0")
+		}
+		wd.checkInterval = interval
+	}
+
+	self.watchdog = wd
+
+	return nil
+}
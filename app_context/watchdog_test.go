@@ -0,0 +1,89 @@
+package app_context
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tilteng/go-logger/logger"
+)
+
+// syncBuffer is a bytes.Buffer safe to log to from other goroutines
+type syncBuffer struct {
+	lock sync.Mutex
+	buf  bytes.Buffer
+}
+
+func (self *syncBuffer) Write(p []byte) (int, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.buf.Write(p)
+}
+
+func (self *syncBuffer) String() string {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.buf.String()
+}
+
+func TestWatchdog(t *testing.T) {
+	os.Setenv("WATCHDOG_CHECK_INTERVAL", "10ms")
+	defer os.Unsetenv("WATCHDOG_CHECK_INTERVAL")
+
+	app_ctx, err := NewAppContext("watchdog_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer app_ctx.Close()
+
+	buf := &syncBuffer{}
+	app_ctx.SetLogger(logger.NewDefaultCtxLogger(NewLevelLogger(buf, LogLevelDebug, true)))
+	mcli := newCountingMetricsClient()
+	app_ctx.SetMetricsClient(mcli)
+
+	wd := app_ctx.Watchdog()
+	wd.Watch("consumer", 50*time.Millisecond)
+	wd.Beat("implicit")
+
+	ctx := context.Background()
+	if !app_ctx.Health().Healthy(ctx) {
+		t.Fatalf("Should start healthy: %+v", app_ctx.Health().Check(ctx))
+	}
+
+	// "implicit" has the default 1m timeout, so only consumer stalls
+	waitFor(t, "consumer to stall", func() bool {
+		return mcli.count("watchdog.stalls") > 0
+	})
+	if app_ctx.Health().Healthy(ctx) {
+		t.Error("Stalled component should be unhealthy")
+	}
+
+	for _, status := range wd.Status() {
+		if status.Stalled != (status.Name == "consumer") {
+			t.Errorf("Unexpected status: %+v", status)
+		}
+	}
+	if n := mcli.count("watchdog.stalls"); n != 1 {
+		t.Errorf("Expected 1 watchdog.stalls, got %d", n)
+	}
+	if out := buf.String(); !strings.Contains(out, "no heartbeat from 'consumer'") || !strings.Contains(out, "goroutine ") {
+		t.Errorf("Stall wasn't logged with stacks: %s", out)
+	}
+
+	wd.Beat("consumer")
+	if !app_ctx.Health().Healthy(ctx) {
+		t.Errorf("Beat should restore health: %+v", app_ctx.Health().Check(ctx))
+	}
+
+	wd.Unwatch("consumer")
+	for _, res := range app_ctx.Health().Check(ctx) {
+		if res.Name == "watchdog:consumer" {
+			t.Error("Unwatch should remove the health status")
+		}
+	}
+}
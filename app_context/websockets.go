@@ -0,0 +1,661 @@
+package app_context
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WebSocket close codes
+const (
+	WebSocketCloseNormal          = 1000
+	WebSocketCloseGoingAway       = 1001
+	WebSocketCloseProtocolError   = 1002
+	WebSocketClosePolicyViolation = 1008
+	WebSocketCloseTooBig          = 1009
+)
+
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xa
+
+	webSocketGUID         = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	webSocketWriteTimeout = 10 * time.Second
+)
+
+var (
+	ErrWebSocketClosed = errors.New("The WebSocket is closed")
+	ErrWebSocketSlow   = errors.New("The WebSocket's send buffer is full")
+)
+
+// webSocketCloseError is a reason to close the connection with code
+type webSocketCloseError struct {
+	code   int
+	reason string
+}
+
+func (self *webSocketCloseError) Error() string {
+	return fmt.Sprintf("WebSocket closed with %d: %s", self.code, self.reason)
+}
+
+type WebSocketStats struct {
+	MessagesIn  int64 `json:"messages_in"`
+	MessagesOut int64 `json:"messages_out"`
+	BytesIn     int64 `json:"bytes_in"`
+	BytesOut    int64 `json:"bytes_out"`
+}
+
+type webSocketFrame struct {
+	opcode byte
+	data   []byte
+}
+
+// WebSocketConn is an upgraded connection, registered with the hub until
+// it's closed. Sends are queued and written in the background, while Read
+// must be called, from one goroutine at a time, to answer pings and see
+// the client go away.
+type WebSocketConn struct {
+	ID          string
+	RemoteAddr  string
+	Path        string
+	ConnectedAt time.Time
+
+	hub       *webSocketHub
+	conn      net.Conn
+	reader    *bufio.Reader
+	ctx       context.Context
+	cancel    context.CancelFunc
+	send      chan webSocketFrame
+	writeLock sync.Mutex
+
+	lock   sync.Mutex
+	topics map[string]bool
+	closed bool
+	stats  WebSocketStats
+}
+
+// Context is done once the connection is closed
+func (self *WebSocketConn) Context() context.Context {
+	return self.ctx
+}
+
+func (self *WebSocketConn) Stats() WebSocketStats {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.stats
+}
+
+// Join subscribes the connection to Publish()es to topic
+func (self *WebSocketConn) Join(topic string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.topics[topic] = true
+}
+
+func (self *WebSocketConn) Leave(topic string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	delete(self.topics, topic)
+}
+
+func (self *WebSocketConn) inTopic(topic string) bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.topics[topic]
+}
+
+// Send queues a text message. A client too slow to keep up with
+// WEBSOCKET_SEND_BUFFER messages is disconnected rather than holding up
+// everyone else's broadcasts.
+func (self *WebSocketConn) Send(data []byte) error {
+	return self.queue(wsText, data)
+}
+
+func (self *WebSocketConn) SendBinary(data []byte) error {
+	return self.queue(wsBinary, data)
+}
+
+func (self *WebSocketConn) SendJSON(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return self.queue(wsText, data)
+}
+
+func (self *WebSocketConn) queue(opcode byte, data []byte) error {
+	self.lock.Lock()
+	closed := self.closed
+	self.lock.Unlock()
+	if closed {
+		return ErrWebSocketClosed
+	}
+	select {
+	case self.send <- webSocketFrame{opcode: opcode, data: data}:
+		return nil
+	default:
+		self.hub.appctx.MetricsClient().Incr("websocket.slow_consumers", 1.0, nil)
+		// Not here, so a broadcast doesn't wait on its write timeout
+		go self.closeWith(WebSocketClosePolicyViolation, "Too slow")
+		return ErrWebSocketSlow
+	}
+}
+
+// Read returns the next message from the client. It returns io.EOF once
+// the client has closed the connection, and ErrWebSocketClosed if it was
+// closed here.
+func (self *WebSocketConn) Read() ([]byte, error) {
+	var message []byte
+	started := false
+	for {
+		// Clients answer the pings well within this
+		self.conn.SetReadDeadline(time.Now().Add(2 * self.hub.pingInterval))
+		fin, opcode, payload, err := self.readFrame()
+		if err == nil {
+			switch opcode {
+			case wsPing:
+				err = self.writeFrame(wsPong, payload)
+			case wsPong:
+			case wsClose:
+				self.closeWith(WebSocketCloseNormal, "")
+				return nil, io.EOF
+			case wsText, wsBinary:
+				if started {
+					err = &webSocketCloseError{WebSocketCloseProtocolError, "Expected a continuation frame"}
+				}
+				started, message = true, payload
+			case wsContinuation:
+				if !started {
+					err = &webSocketCloseError{WebSocketCloseProtocolError, "Unexpected continuation frame"}
+				} else if message = append(message, payload...); int64(len(message)) > self.hub.maxMessageSize {
+					err = &webSocketCloseError{WebSocketCloseTooBig, "Message too big"}
+				}
+			default:
+				err = &webSocketCloseError{WebSocketCloseProtocolError, fmt.Sprintf("Unknown opcode %d", opcode)}
+			}
+		}
+		if err != nil {
+			self.lock.Lock()
+			closed := self.closed
+			self.lock.Unlock()
+			if closed {
+				return nil, ErrWebSocketClosed
+			}
+			if close_err, ok := err.(*webSocketCloseError); ok {
+				self.closeWith(close_err.code, close_err.reason)
+				return nil, err
+			}
+			self.closeWith(WebSocketCloseGoingAway, "")
+			if err == io.EOF {
+				return nil, io.EOF
+			}
+			return nil, fmt.Errorf("Error reading from WebSocket: %s", err)
+		}
+		if started && fin && opcode < wsClose {
+			self.lock.Lock()
+			self.stats.MessagesIn++
+			self.stats.BytesIn += int64(len(message))
+			self.lock.Unlock()
+			self.hub.appctx.MetricsClient().Incr("websocket.messages_in", 1.0, nil)
+			return message, nil
+		}
+	}
+}
+
+func (self *WebSocketConn) readFrame() (bool, byte, []byte, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(self.reader, header[:]); err != nil {
+		return false, 0, nil, err
+	}
+	fin := header[0]&0x80 != 0
+	opcode := header[0] & 0x0f
+	if header[0]&0x70 != 0 {
+		return false, 0, nil, &webSocketCloseError{WebSocketCloseProtocolError, "No extensions were negotiated"}
+	}
+	if header[1]&0x80 == 0 {
+		return false, 0, nil, &webSocketCloseError{WebSocketCloseProtocolError, "Client frames must be masked"}
+	}
+
+	n := uint64(header[1] & 0x7f)
+	switch n {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(self.reader, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		n = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(self.reader, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		n = binary.BigEndian.Uint64(ext[:])
+	}
+	if opcode >= wsClose && (n > 125 || !fin) {
+		return false, 0, nil, &webSocketCloseError{WebSocketCloseProtocolError, "Invalid control frame"}
+	}
+	if n > uint64(self.hub.maxMessageSize) {
+		return false, 0, nil, &webSocketCloseError{WebSocketCloseTooBig, "Message too big"}
+	}
+
+	var mask [4]byte
+	if _, err := io.ReadFull(self.reader, mask[:]); err != nil {
+		return false, 0, nil, err
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(self.reader, payload); err != nil {
+		return false, 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return fin, opcode, payload, nil
+}
+
+func (self *WebSocketConn) writeFrame(opcode byte, payload []byte) error {
+	frame := make([]byte, 2, 10+len(payload))
+	frame[0] = 0x80 | opcode
+	switch n := len(payload); {
+	case n < 126:
+		frame[1] = byte(n)
+	case n <= 0xffff:
+		frame[1] = 126
+		frame = frame[:4]
+		binary.BigEndian.PutUint16(frame[2:], uint16(n))
+	default:
+		frame[1] = 127
+		frame = frame[:10]
+		binary.BigEndian.PutUint64(frame[2:], uint64(n))
+	}
+	frame = append(frame, payload...)
+
+	self.writeLock.Lock()
+	defer self.writeLock.Unlock()
+	self.conn.SetWriteDeadline(time.Now().Add(webSocketWriteTimeout))
+	_, err := self.conn.Write(frame)
+	return err
+}
+
+// writeLoop writes queued messages and pings until the connection closes
+func (self *WebSocketConn) writeLoop() {
+	ticker := NewRealClock().NewTicker(self.hub.pingInterval)
+	defer ticker.Stop()
+	mcli := self.hub.appctx.MetricsClient()
+	for {
+		var err error
+		select {
+		case <-self.ctx.Done():
+			return
+		case frame := <-self.send:
+			if err = self.writeFrame(frame.opcode, frame.data); err == nil {
+				self.lock.Lock()
+				self.stats.MessagesOut++
+				self.stats.BytesOut += int64(len(frame.data))
+				self.lock.Unlock()
+				mcli.Incr("websocket.messages_out", 1.0, nil)
+			}
+		case <-ticker.C():
+			err = self.writeFrame(wsPing, nil)
+		}
+		if err != nil {
+			self.closeWith(WebSocketCloseGoingAway, "")
+			return
+		}
+	}
+}
+
+// Close says goodbye to the client and closes the connection
+func (self *WebSocketConn) Close() error {
+	return self.closeWith(WebSocketCloseNormal, "")
+}
+
+func (self *WebSocketConn) closeWith(code int, reason string) error {
+	self.lock.Lock()
+	if self.closed {
+		self.lock.Unlock()
+		return nil
+	}
+	self.closed = true
+	stats := self.stats
+	self.lock.Unlock()
+
+	self.cancel()
+	payload := make([]byte, 2, 2+len(reason))
+	binary.BigEndian.PutUint16(payload, uint16(code))
+	// The client may well be gone already
+	self.writeFrame(wsClose, append(payload, reason...))
+	err := self.conn.Close()
+
+	self.hub.remove(self)
+	mcli := self.hub.appctx.MetricsClient()
+	tags := map[string]string{"code": fmt.Sprint(code)}
+	mcli.Incr("websocket.disconnects", 1.0, tags)
+	mcli.TimingMS("websocket.connection_duration_ms", float64(time.Since(self.ConnectedAt))/float64(time.Millisecond), 1.0, nil)
+	mcli.Histogram("websocket.connection_messages", float64(stats.MessagesIn+stats.MessagesOut), 1.0, nil)
+	return err
+}
+
+// WebSocketHub upgrades requests to WebSockets and keeps track of the
+// connections, so they can be broadcast to and are closed with the app
+// context. Browsers may only connect from the request's own host or from
+// WEBSOCKET_ALLOWED_ORIGINS.
+//
+// Metrics: websocket.connections (gauge), websocket.connects,
+// websocket.disconnects (tagged by close code), websocket.messages_in,
+// websocket.messages_out, websocket.slow_consumers,
+// websocket.connection_duration_ms and websocket.connection_messages.
+type WebSocketHub interface {
+	// Upgrade completes the handshake, or answers with an error and
+	// returns it
+	Upgrade(w http.ResponseWriter, r *http.Request) (*WebSocketConn, error)
+	// Handler upgrades each request and calls fn with the connection,
+	// closing it when fn returns:
+	//
+	//	http.Handle("/ws", appctx.WebSockets().Handler(func(ctx context.Context, conn *WebSocketConn) {
+	//		conn.Join("prices")
+	//		for {
+	//			if _, err := conn.Read(); err != nil {
+	//				return
+	//			}
+	//		}
+	//	}))
+	Handler(fn func(ctx context.Context, conn *WebSocketConn)) http.Handler
+	// Broadcast sends to every connection, returning how many it was
+	// queued for
+	Broadcast(data []byte) int
+	// Publish sends to connections that have joined topic
+	Publish(topic string, data []byte) int
+	Conn(id string) *WebSocketConn
+	Count() int
+}
+
+type webSocketHub struct {
+	appctx         *baseAppContext
+	allowedOrigins []string
+	maxConns       int
+	maxMessageSize int64
+	sendBuffer     int
+	pingInterval   time.Duration
+
+	lock   sync.Mutex
+	conns  map[string]*WebSocketConn
+	closed bool
+}
+
+func newWebSocketHub(appctx *baseAppContext) *webSocketHub {
+	return &webSocketHub{
+		appctx:         appctx,
+		maxMessageSize: 1 << 20,
+		sendBuffer:     64,
+		pingInterval:   30 * time.Second,
+		conns:          make(map[string]*WebSocketConn),
+	}
+}
+
+// headerHasToken is whether the comma separated header has token,
+// ignoring case
+func headerHasToken(header http.Header, name string, token string) bool {
+	for _, value := range header[name] {
+		for _, t := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// originAllowed lets through clients that aren't browsers, which send no
+// Origin
+func (self *webSocketHub) originAllowed(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	for _, allowed := range self.allowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+func (self *webSocketHub) Upgrade(w http.ResponseWriter, r *http.Request) (*WebSocketConn, error) {
+	fail := func(status int, msg string) (*WebSocketConn, error) {
+		http.Error(w, msg, status)
+		return nil, errors.New(msg)
+	}
+	if r.Method != "GET" || !headerHasToken(r.Header, "Connection", "upgrade") || !headerHasToken(r.Header, "Upgrade", "websocket") {
+		return fail(http.StatusBadRequest, "Expected a WebSocket upgrade")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		return fail(http.StatusUpgradeRequired, "Unsupported WebSocket version")
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		return fail(http.StatusBadRequest, "Missing Sec-WebSocket-Key")
+	}
+	if !self.originAllowed(r) {
+		return fail(http.StatusForbidden, "Origin not allowed")
+	}
+	self.lock.Lock()
+	closed, full := self.closed, self.maxConns > 0 && len(self.conns) >= self.maxConns
+	self.lock.Unlock()
+	if closed || full {
+		self.appctx.MetricsClient().Incr("websocket.rejected", 1.0, nil)
+		return fail(http.StatusServiceUnavailable, "Too many WebSocket connections")
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		return fail(http.StatusInternalServerError, "The response can't be hijacked")
+	}
+	net_conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return fail(http.StatusInternalServerError, err.Error())
+	}
+	sum := sha1.Sum([]byte(key + webSocketGUID))
+	net_conn.SetWriteDeadline(time.Now().Add(webSocketWriteTimeout))
+	if _, err := net_conn.Write([]byte(
+		"HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: " +
+			base64.StdEncoding.EncodeToString(sum[:]) + "\r\n\r\n",
+	)); err != nil {
+		net_conn.Close()
+		return nil, fmt.Errorf("Error upgrading to a WebSocket: %s", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	conn := &WebSocketConn{
+		ID:          self.appctx.IDGenerator().NewID(),
+		RemoteAddr:  r.RemoteAddr,
+		Path:        r.URL.Path,
+		ConnectedAt: time.Now(),
+		hub:         self,
+		conn:        net_conn,
+		reader:      rw.Reader,
+		ctx:         ctx,
+		cancel:      cancel,
+		send:        make(chan webSocketFrame, self.sendBuffer),
+		topics:      make(map[string]bool),
+	}
+	self.lock.Lock()
+	self.conns[conn.ID] = conn
+	count := len(self.conns)
+	self.lock.Unlock()
+
+	mcli := self.appctx.MetricsClient()
+	mcli.Incr("websocket.connects", 1.0, nil)
+	mcli.Gauge("websocket.connections", float64(count), 1.0, nil)
+	goLabeled("websocket_writer", conn.writeLoop, "path", conn.Path)
+	return conn, nil
+}
+
+func (self *webSocketHub) Handler(fn func(ctx context.Context, conn *WebSocketConn)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := self.Upgrade(w, r)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		fn(conn.Context(), conn)
+	})
+}
+
+func (self *webSocketHub) remove(conn *WebSocketConn) {
+	self.lock.Lock()
+	delete(self.conns, conn.ID)
+	count := len(self.conns)
+	self.lock.Unlock()
+	self.appctx.MetricsClient().Gauge("websocket.connections", float64(count), 1.0, nil)
+}
+
+func (self *webSocketHub) list() []*WebSocketConn {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	conns := make([]*WebSocketConn, 0, len(self.conns))
+	for _, conn := range self.conns {
+		conns = append(conns, conn)
+	}
+	return conns
+}
+
+func (self *webSocketHub) Broadcast(data []byte) int {
+	sent := 0
+	for _, conn := range self.list() {
+		if conn.Send(data) == nil {
+			sent++
+		}
+	}
+	return sent
+}
+
+func (self *webSocketHub) Publish(topic string, data []byte) int {
+	sent := 0
+	for _, conn := range self.list() {
+		if conn.inTopic(topic) && conn.Send(data) == nil {
+			sent++
+		}
+	}
+	return sent
+}
+
+func (self *webSocketHub) Conn(id string) *WebSocketConn {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.conns[id]
+}
+
+func (self *webSocketHub) Count() int {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return len(self.conns)
+}
+
+// close tells every client the server is going away, and refuses new
+// connections
+func (self *webSocketHub) close() {
+	self.lock.Lock()
+	self.closed = true
+	self.lock.Unlock()
+	for _, conn := range self.list() {
+		conn.closeWith(WebSocketCloseGoingAway, "Server shutting down")
+	}
+}
+
+func (self *webSocketHub) status() map[string]interface{} {
+	conns := self.list()
+	paths := make(map[string]int)
+	var totals WebSocketStats
+	for _, conn := range conns {
+		paths[conn.Path]++
+		stats := conn.Stats()
+		totals.MessagesIn += stats.MessagesIn
+		totals.MessagesOut += stats.MessagesOut
+		totals.BytesIn += stats.BytesIn
+		totals.BytesOut += stats.BytesOut
+	}
+	origins := append([]string(nil), self.allowedOrigins...)
+	sort.Strings(origins)
+	return map[string]interface{}{
+		"connections":      len(conns),
+		"paths":            paths,
+		"totals":           totals,
+		"allowed_origins":  origins,
+		"max_connections":  self.maxConns,
+		"max_message_size": self.maxMessageSize,
+		"ping_interval":    self.pingInterval.String(),
+	}
+}
+
+func (self *baseAppContext) WebSockets() WebSocketHub {
+	return self.webSockets
+}
+
+// WEBSOCKET_ALLOWED_ORIGINS is a comma separated list of origins, or *,
+// that browsers may connect from besides the request's host.
+// WEBSOCKET_MAX_CONNECTIONS (default unlimited) caps connections to this
+// instance, WEBSOCKET_MAX_MESSAGE_SIZE (default 1MiB) the bytes in a
+// message from a client, and WEBSOCKET_SEND_BUFFER (default 64) the
+// messages queued for one before it's disconnected. Clients are pinged
+// every WEBSOCKET_PING_INTERVAL (default 30s).
+func (self *baseAppContext) setWebSocketsFromEnv() error {
+	for _, origin := range strings.Split(self.getEnv("WEBSOCKET_ALLOWED_ORIGINS"), ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			self.webSockets.allowedOrigins = append(self.webSockets.allowedOrigins, origin)
+		}
+	}
+	if n, found, err := self.getIntFromEnv("WEBSOCKET_MAX_CONNECTIONS"); err != nil {
+		return err
+	} else if found {
+		if n < 0 {
+			return errors.New("WEBSOCKET_MAX_CONNECTIONS must be >= 0")
+		}
+		self.webSockets.maxConns = n
+	}
+	if size, found, err := self.getIntFromEnv("WEBSOCKET_MAX_MESSAGE_SIZE"); err != nil {
+		return err
+	} else if found {
+		if size <= 0 {
+			return errors.New("WEBSOCKET_MAX_MESSAGE_SIZE must be > 0")
+		}
+		self.webSockets.maxMessageSize = int64(size)
+	}
+	if size, found, err := self.getIntFromEnv("WEBSOCKET_SEND_BUFFER"); err != nil {
+		return err
+	} else if found {
+		if size <= 0 {
+			return errors.New("WEBSOCKET_SEND_BUFFER must be > 0")
+		}
+		self.webSockets.sendBuffer = size
+	}
+	if interval, found, err := self.getDurationFromEnv("WEBSOCKET_PING_INTERVAL"); err != nil {
+		return err
+	} else if found {
+		if interval <= 0 {
+			return errors.New("WEBSOCKET_PING_INTERVAL must be > 0")
+		}
+		self.webSockets.pingInterval = interval
+	}
+	return nil
+}
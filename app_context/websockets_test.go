@@ -0,0 +1,176 @@
+package app_context
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type testWebSocketClient struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func dialTestWebSocket(t *testing.T, server *httptest.Server, origin string) (*testWebSocketClient, *http.Response) {
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := "GET /ws HTTP/1.1\r\nHost: " + server.Listener.Addr().String() +
+		"\r\nUpgrade: websocket\r\nConnection: keep-alive, Upgrade\r\nSec-WebSocket-Version: 13" +
+		"\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n"
+	if origin != "" {
+		req += "Origin: " + origin + "\r\n"
+	}
+	if _, err := conn.Write([]byte(req + "\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testWebSocketClient{conn: conn, reader: reader}, resp
+}
+
+func (self *testWebSocketClient) write(t *testing.T, opcode byte, payload []byte) {
+	mask := []byte{1, 2, 3, 4}
+	frame := []byte{0x80 | opcode, 0x80 | byte(len(payload))}
+	frame = append(frame, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	if _, err := self.conn.Write(frame); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (self *testWebSocketClient) read(t *testing.T) (byte, []byte) {
+	var header [2]byte
+	if _, err := io.ReadFull(self.reader, header[:]); err != nil {
+		t.Fatal(err)
+	}
+	payload := make([]byte, header[1]&0x7f)
+	if _, err := io.ReadFull(self.reader, payload); err != nil {
+		t.Fatal(err)
+	}
+	return header[0] & 0x0f, payload
+}
+
+func TestWebSockets(t *testing.T) {
+	app_ctx, err := NewAppContext("websockets_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer app_ctx.Close()
+
+	mcli := newCountingMetricsClient()
+	app_ctx.SetMetricsClient(mcli)
+
+	read_errs := make(chan error, 1)
+	hub := app_ctx.WebSockets()
+	handler := hub.Handler(func(ctx context.Context, conn *WebSocketConn) {
+		conn.Join("prices")
+		for {
+			msg, err := conn.Read()
+			if err != nil {
+				read_errs <- err
+				return
+			}
+			conn.SendJSON(map[string]string{"echo": string(msg)})
+		}
+	})
+	server := httptest.NewServer(app_ctx.HTTPMiddleware()(handler))
+	defer server.Close()
+
+	client, resp := dialTestWebSocket(t, server, "")
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("Unexpected handshake: %d %v", resp.StatusCode, resp.Header)
+	}
+
+	client.write(t, wsText, []byte("hello"))
+	if opcode, payload := client.read(t); opcode != wsText || string(payload) != `{"echo":"hello"}` {
+		t.Errorf("Unexpected reply: %d %s", opcode, payload)
+	}
+	client.write(t, wsPing, []byte("are you there"))
+	if opcode, payload := client.read(t); opcode != wsPong || string(payload) != "are you there" {
+		t.Errorf("Expected a pong, got %d %s", opcode, payload)
+	}
+
+	if n := hub.Publish("prices", []byte("42")); n != 1 {
+		t.Errorf("Expected 1 subscriber, got %d", n)
+	}
+	if n := hub.Publish("news", []byte("none")); n != 0 {
+		t.Errorf("Expected no subscribers, got %d", n)
+	}
+	if _, payload := client.read(t); string(payload) != "42" {
+		t.Errorf("Unexpected publish: %s", payload)
+	}
+	if hub.Count() != 1 {
+		t.Fatalf("Expected 1 connection, got %d", hub.Count())
+	}
+
+	client.write(t, wsClose, []byte{0x03, 0xe8})
+	if err := <-read_errs; err != io.EOF {
+		t.Errorf("Expected io.EOF, got %v", err)
+	}
+	if opcode, payload := client.read(t); opcode != wsClose || binary.BigEndian.Uint16(payload) != WebSocketCloseNormal {
+		t.Errorf("Expected the close to be echoed, got %d %v", opcode, payload)
+	}
+	waitFor(t, "the connection to be removed", func() bool {
+		return hub.Count() == 0
+	})
+	if mcli.count("websocket.messages_in") != 1 || mcli.count("websocket.messages_out") != 2 || mcli.count("websocket.disconnects") != 1 {
+		t.Errorf("Unexpected metrics: %v", mcli.counts)
+	}
+
+	// Browsers on other sites aren't let in
+	if _, resp := dialTestWebSocket(t, server, "https://evil.example.com"); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected 403 for another origin, got %d", resp.StatusCode)
+	}
+	if resp, err := http.Get(server.URL + "/ws"); err != nil || resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected 400 without an upgrade, got %v %v", resp, err)
+	}
+}
+
+func TestWebSocketsCloseWithAppContext(t *testing.T) {
+	app_ctx, err := NewAppContext("websockets_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	upgraded := make(chan *WebSocketConn, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := app_ctx.WebSockets().Upgrade(w, r)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		upgraded <- conn
+	}))
+	defer server.Close()
+
+	client, _ := dialTestWebSocket(t, server, "")
+	conn := <-upgraded
+	app_ctx.Close()
+
+	opcode, payload := client.read(t)
+	if opcode != wsClose || binary.BigEndian.Uint16(payload) != WebSocketCloseGoingAway || !strings.Contains(string(payload), "shutting down") {
+		t.Errorf("Expected going away, got %d %s", opcode, payload)
+	}
+	if err := conn.Send([]byte("late")); err != ErrWebSocketClosed {
+		t.Errorf("Expected ErrWebSocketClosed, got %v", err)
+	}
+	select {
+	case <-conn.Context().Done():
+	default:
+		t.Error("Expected the connection's context to be done")
+	}
+}
@@ -0,0 +1,384 @@
+package app_context
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/comstud/go-rollbar/rollbar"
+)
+
+type WorkerFunc func(ctx context.Context) error
+
+type RestartPolicy int
+
+const (
+	// RestartOnFailure restarts a worker that returned an error or
+	// panicked, but not one that returned nil.
+	RestartOnFailure RestartPolicy = iota
+	RestartAlways
+	RestartNever
+)
+
+type WorkerOptions struct {
+	Restart RestartPolicy
+	// The delay before a restart starts at MinBackoff and doubles after
+	// each consecutive failure, up to MaxBackoff, give or take half for
+	// jitter from Rand. Defaults are 1s and 1m.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// ActiveOnly workers are cancelled while the traffic role is standby
+	// and started again when it becomes active.
+	ActiveOnly bool
+}
+
+type WorkerStatus struct {
+	Name      string
+	Running   bool
+	Runs      int
+	Failures  int
+	LastError string
+}
+
+// WorkerManager supervises named background loops. Workers start as soon as
+// they're registered and are stopped by Close.
+type WorkerManager interface {
+	Register(name string, fn WorkerFunc, opts WorkerOptions) error
+	Status() []WorkerStatus
+	// Stop cancels every worker and waits up to WORKERS_SHUTDOWN_TIMEOUT
+	// for them to return.
+	Stop() error
+}
+
+var ErrWorkersStopped = errors.New("Workers have been stopped")
+
+type worker struct {
+	mgr    *workerManager
+	name   string
+	fn     WorkerFunc
+	opts   WorkerOptions
+	done   chan struct{}
+	status WorkerStatus
+}
+
+func (self *worker) tags() map[string]string {
+	return map[string]string{"worker": self.name}
+}
+
+func (self *worker) setRunning(running bool) {
+	self.mgr.lock.Lock()
+	defer self.mgr.lock.Unlock()
+	self.status.Running = running
+	if running {
+		self.status.Runs++
+	}
+}
+
+func (self *worker) setFailed(err error) {
+	self.mgr.lock.Lock()
+	defer self.mgr.lock.Unlock()
+	self.status.Failures++
+	self.status.LastError = err.Error()
+}
+
+func (self *worker) runOnce(ctx context.Context) (panicked bool, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("Worker '%s' panicked: %v", self.name, r)
+			panicked = true
+			self.mgr.appctx.reportError(err, rollbar.CustomInfo{"worker": self.name})
+		}
+	}()
+	return false, self.fn(ctx)
+}
+
+// runnable is false while the worker is paused, or ActiveOnly and the
+// traffic role is standby
+func (self *worker) runnable() bool {
+	if self.opts.ActiveOnly && self.mgr.appctx.TrafficRole() != TrafficRoleActive {
+		return false
+	}
+	return !self.mgr.appctx.consumers.Paused(self.name)
+}
+
+// run calls fn once, cancelling it early if the worker stops being
+// runnable.
+func (self *worker) run() (bool, error) {
+	ctx, cancel := context.WithCancel(self.mgr.ctx)
+	defer cancel()
+
+	goLabeled("workers", func() {
+		for {
+			changed := self.mgr.roleChanged()
+			if !self.runnable() {
+				cancel()
+				return
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-changed:
+			}
+		}
+	}, "worker", self.name)
+
+	self.setRunning(true)
+	defer self.setRunning(false)
+
+	start := time.Now()
+	mcli := self.mgr.appctx.MetricsClient()
+	mcli.Incr("worker.starts", 1.0, self.tags())
+
+	panicked, err := self.runOnce(ctx)
+
+	mcli.TimingMS(
+		"worker.run_duration_ms",
+		float64(time.Since(start))/float64(time.Millisecond),
+		1.0,
+		self.tags(),
+	)
+
+	return panicked, err
+}
+
+// waitUntilRunnable returns false if the manager is stopped first
+func (self *worker) waitUntilRunnable() bool {
+	for {
+		changed := self.mgr.roleChanged()
+		if self.runnable() {
+			return self.mgr.ctx.Err() == nil
+		}
+		select {
+		case <-self.mgr.ctx.Done():
+			return false
+		case <-changed:
+		}
+	}
+}
+
+func (self *worker) supervise() {
+	defer close(self.done)
+
+	log := self.mgr.appctx.Logger()
+	backoff := self.opts.MinBackoff
+
+	clock := self.mgr.appctx.Clock()
+	for self.waitUntilRunnable() {
+		start := clock.Now()
+		panicked, err := self.run()
+
+		if self.mgr.ctx.Err() != nil {
+			return
+		}
+
+		if !self.runnable() {
+			if self.mgr.appctx.consumers.Paused(self.name) {
+				log.LogInfof(context.Background(), "Worker '%s' paused", self.name)
+			} else {
+				log.LogInfof(context.Background(), "Worker '%s' paused for standby", self.name)
+			}
+			continue
+		}
+
+		if err != nil {
+			reason := "error"
+			if panicked {
+				reason = "panic"
+			}
+			tags := self.tags()
+			tags["reason"] = reason
+			self.mgr.appctx.MetricsClient().Incr("worker.failures", 1.0, tags)
+			self.setFailed(err)
+			log.LogErrorf(context.Background(), "Worker '%s' failed: %s", self.name, err)
+		}
+
+		switch self.opts.Restart {
+		case RestartNever:
+			return
+		case RestartOnFailure:
+			if err == nil {
+				return
+			}
+		}
+
+		// A worker that ran for a while before failing isn't crash looping
+		if clock.Now().Sub(start) > self.opts.MaxBackoff {
+			backoff = self.opts.MinBackoff
+		}
+
+		// Jitter keeps workers that failed together, eg. when a
+		// dependency went away, from all retrying at the same moment
+		delay := backoff/2 + time.Duration(self.mgr.appctx.Rand().Int63n(int64(backoff)))
+		log.LogInfof(context.Background(), "Restarting worker '%s' in %s", self.name, delay)
+
+		select {
+		case <-self.mgr.ctx.Done():
+			return
+		case <-clock.After(delay):
+		}
+
+		if backoff *= 2; backoff > self.opts.MaxBackoff {
+			backoff = self.opts.MaxBackoff
+		}
+	}
+}
+
+type workerManager struct {
+	appctx          *baseAppContext
+	lock            sync.Mutex
+	ctx             context.Context
+	cancel          context.CancelFunc
+	workers         map[string]*worker
+	roleChan        chan struct{}
+	shutdownTimeout time.Duration
+}
+
+func (self *workerManager) roleChanged() <-chan struct{} {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.roleChan
+}
+
+func (self *workerManager) onTrafficRoleChange(old_role, new_role TrafficRole) {
+	self.wake()
+}
+
+// wake has workers check again whether they should be running, after the
+// traffic role changed or one was paused or resumed
+func (self *workerManager) wake() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	close(self.roleChan)
+	self.roleChan = make(chan struct{})
+}
+
+func (self *workerManager) Register(name string, fn WorkerFunc, opts WorkerOptions) error {
+	if opts.MinBackoff <= 0 {
+		opts.MinBackoff = time.Second
+	}
+	if opts.MaxBackoff < opts.MinBackoff {
+		opts.MaxBackoff = time.Minute
+		if opts.MaxBackoff < opts.MinBackoff {
+			opts.MaxBackoff = opts.MinBackoff
+		}
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if self.ctx.Err() != nil {
+		return ErrWorkersStopped
+	}
+	if _, ok := self.workers[name]; ok {
+		return fmt.Errorf("Worker '%s' is already registered", name)
+	}
+
+	w := &worker{
+		mgr:    self,
+		name:   name,
+		fn:     fn,
+		opts:   opts,
+		done:   make(chan struct{}),
+		status: WorkerStatus{Name: name},
+	}
+	self.workers[name] = w
+
+	goLabeled("workers", w.supervise, "worker", name)
+
+	return nil
+}
+
+func (self *workerManager) Status() []WorkerStatus {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	statuses := make([]WorkerStatus, 0, len(self.workers))
+	for _, w := range self.workers {
+		statuses = append(statuses, w.status)
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Name < statuses[j].Name
+	})
+	return statuses
+}
+
+func (self *workerManager) Stop() error {
+	if self == nil {
+		return nil
+	}
+
+	self.lock.Lock()
+	self.cancel()
+	workers := make([]*worker, 0, len(self.workers))
+	for _, w := range self.workers {
+		workers = append(workers, w)
+	}
+	self.lock.Unlock()
+
+	// Real time, like Scheduler's Stop
+	timer := time.NewTimer(self.shutdownTimeout)
+	defer timer.Stop()
+
+	expired := false
+	stuck := make([]string, 0)
+
+	for _, w := range workers {
+		if !expired {
+			select {
+			case <-w.done:
+				continue
+			case <-timer.C:
+				expired = true
+			}
+		}
+		select {
+		case <-w.done:
+		default:
+			stuck = append(stuck, w.name)
+		}
+	}
+
+	if len(stuck) > 0 {
+		sort.Strings(stuck)
+		return fmt.Errorf(
+			"Workers didn't stop within %s: %s",
+			self.shutdownTimeout,
+			strings.Join(stuck, ", "),
+		)
+	}
+
+	return nil
+}
+
+func (self *baseAppContext) Workers() WorkerManager {
+	return self.workers
+}
+
+func (self *baseAppContext) setWorkersFromEnv() error {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	mgr := &workerManager{
+		appctx:          self,
+		ctx:             ctx,
+		cancel:          cancel,
+		workers:         make(map[string]*worker),
+		roleChan:        make(chan struct{}),
+		shutdownTimeout: 30 * time.Second,
+	}
+
+	self.workers = mgr
+
+	if timeout, found, err := self.getDurationFromEnv("WORKERS_SHUTDOWN_TIMEOUT"); err != nil {
+		return err
+	} else if found {
+		mgr.shutdownTimeout = timeout
+	}
+
+	self.OnTrafficRoleChange(mgr.onTrafficRoleChange)
+
+	return nil
+}
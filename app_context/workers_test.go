@@ -0,0 +1,124 @@
+package app_context
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestWorkersRestartAndPanic(t *testing.T) {
+	app_ctx, err := NewAppContext("workers_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer app_ctx.Close()
+
+	var runs int32
+	err = app_ctx.Workers().Register("flaky", func(ctx context.Context) error {
+		switch atomic.AddInt32(&runs, 1) {
+		case 1:
+			return errors.New("boom")
+		case 2:
+			panic("kaboom")
+		}
+		<-ctx.Done()
+		return nil
+	}, WorkerOptions{MinBackoff: time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, "third run", func() bool { return atomic.LoadInt32(&runs) >= 3 })
+
+	status := app_ctx.Workers().Status()
+	if len(status) != 1 || status[0].Failures != 2 || status[0].Runs != 3 {
+		t.Errorf("Unexpected worker status: %+v", status)
+	}
+
+	if err := app_ctx.Workers().Register("flaky", nil, WorkerOptions{}); err == nil {
+		t.Error("Registering a duplicate worker should fail")
+	}
+
+	if err := app_ctx.Close(); err != nil {
+		t.Errorf("Close failed: %s", err)
+	}
+
+	if s := app_ctx.Workers().Status(); s[0].Running {
+		t.Error("Worker still running after Close")
+	}
+
+	if err := app_ctx.Workers().Register("late", nil, WorkerOptions{}); err != ErrWorkersStopped {
+		t.Errorf("Register after Close should fail with ErrWorkersStopped, got %v", err)
+	}
+}
+
+func TestWorkersShutdownTimeout(t *testing.T) {
+	os.Setenv("WORKERS_SHUTDOWN_TIMEOUT", "10ms")
+	defer os.Unsetenv("WORKERS_SHUTDOWN_TIMEOUT")
+
+	app_ctx, err := NewAppContext("workers_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	release := make(chan struct{})
+	defer close(release)
+
+	app_ctx.Workers().Register("stubborn", func(ctx context.Context) error {
+		<-release
+		return nil
+	}, WorkerOptions{})
+
+	waitFor(t, "worker start", func() bool { return app_ctx.Workers().Status()[0].Running })
+
+	if err := app_ctx.Workers().Stop(); err == nil {
+		t.Error("Stop should fail when a worker ignores cancellation")
+	}
+}
+
+func TestWorkersActiveOnly(t *testing.T) {
+	app_ctx, err := NewAppContext("workers_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer app_ctx.Close()
+
+	app_ctx.SetTrafficRole(TrafficRoleStandby)
+
+	var running int32
+	app_ctx.Workers().Register("consumer", func(ctx context.Context) error {
+		atomic.StoreInt32(&running, 1)
+		<-ctx.Done()
+		atomic.StoreInt32(&running, 0)
+		return nil
+	}, WorkerOptions{Restart: RestartAlways, ActiveOnly: true})
+
+	time.Sleep(20 * time.Millisecond)
+	if atomic.LoadInt32(&running) != 0 {
+		t.Fatal("ActiveOnly worker started while standby")
+	}
+
+	app_ctx.SetTrafficRole(TrafficRoleActive)
+	waitFor(t, "worker start", func() bool { return atomic.LoadInt32(&running) == 1 })
+
+	app_ctx.SetTrafficRole(TrafficRoleStandby)
+	waitFor(t, "worker pause", func() bool { return atomic.LoadInt32(&running) == 0 })
+
+	if s := app_ctx.Workers().Status(); s[0].Failures != 0 {
+		t.Errorf("Pausing for standby shouldn't count as a failure: %+v", s)
+	}
+}
@@ -0,0 +1,52 @@
+package app_context
+
+// AppContextWrapper is the base for decorators: embed it, override the
+// methods to change, and everything else, including methods added to
+// AppContext later, goes to the inner context.
+//
+//	type billingAppContext struct {
+//		*app_context.AppContextWrapper
+//	}
+//
+//	func (self *billingAppContext) MetricsClient() metrics.MetricsClient {
+//		return withTags(self.Inner().MetricsClient(), billingTags)
+//	}
+//
+//	func newBillingAppContext(inner app_context.AppContext) app_context.AppContext {
+//		return &billingAppContext{app_context.NewAppContextWrapper(inner, newBillingAppContext)}
+//	}
+//
+// Set* methods return the inner context, so calls chained from them
+// aren't decorated. ForRequest contexts aren't rewrapped either.
+type AppContextWrapper struct {
+	AppContext
+	rewrap func(AppContext) AppContext
+}
+
+// NewAppContextWrapper wraps inner. rewrap, normally the decorator's own
+// constructor, decorates the contexts WithComponent and WithFields derive,
+// so they keep the decorator's behavior. With a nil rewrap they're the
+// inner context's.
+func NewAppContextWrapper(inner AppContext, rewrap func(AppContext) AppContext) *AppContextWrapper {
+	return &AppContextWrapper{AppContext: inner, rewrap: rewrap}
+}
+
+// Inner is the wrapped context, for overrides to call through to
+func (self *AppContextWrapper) Inner() AppContext {
+	return self.AppContext
+}
+
+func (self *AppContextWrapper) derived(inner AppContext) AppContext {
+	if self.rewrap == nil {
+		return inner
+	}
+	return self.rewrap(inner)
+}
+
+func (self *AppContextWrapper) WithComponent(component string) AppContext {
+	return self.derived(self.AppContext.WithComponent(component))
+}
+
+func (self *AppContextWrapper) WithFields(fields map[string]interface{}) AppContext {
+	return self.derived(self.AppContext.WithFields(fields))
+}
@@ -0,0 +1,63 @@
+package app_context
+
+import (
+	"log"
+	"testing"
+
+	"github.com/tilteng/go-metrics/metrics"
+)
+
+// subsystemAppContext tags every metric with the subsystem
+type subsystemAppContext struct {
+	*AppContextWrapper
+}
+
+func newSubsystemAppContext(inner AppContext) AppContext {
+	return &subsystemAppContext{NewAppContextWrapper(inner, newSubsystemAppContext)}
+}
+
+func (self *subsystemAppContext) MetricsClient() metrics.MetricsClient {
+	return &prefixedMetricsClient{
+		inner: self.Inner().MetricsClient(),
+		tags:  map[string]string{"subsystem": "billing"},
+	}
+}
+
+func TestAppContextWrapper(t *testing.T) {
+	app_ctx, err := NewAppContext("wrapper_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer app_ctx.Close()
+
+	mcli := newCountingMetricsClient()
+	app_ctx.SetMetricsClient(mcli)
+
+	wrapped := newSubsystemAppContext(app_ctx)
+	if wrapped.AppName() != "wrapper_test" {
+		t.Errorf("AppName wasn't forwarded: %s", wrapped.AppName())
+	}
+
+	wrapped.MetricsClient().Incr("direct", 1.0, nil)
+	wrapped.WithComponent("invoices").MetricsClient().Incr("component", 1.0, nil)
+	wrapped.WithFields(map[string]interface{}{"invoice": 1}).MetricsClient().Incr("fields", 1.0, nil)
+
+	for _, name := range []string{"direct", "invoices.component", "fields"} {
+		if tags := mcli.tags[name]; tags["subsystem"] != "billing" {
+			t.Errorf("Metric '%s' wasn't decorated: %+v", name, tags)
+		}
+	}
+
+	var found *subsystemAppContext
+	if !As(wrapped.WithComponent("invoices"), &found) {
+		t.Error("Expected derived contexts to be wrapped too")
+	}
+
+	plain := NewAppContextWrapper(app_ctx, nil)
+	if plain.Inner() != app_ctx {
+		t.Error("Inner isn't the wrapped context")
+	}
+	if _, ok := plain.WithComponent("plain").(*AppContextWrapper); ok {
+		t.Error("Without rewrap derived contexts should be the inner context's")
+	}
+}
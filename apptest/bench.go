@@ -0,0 +1,198 @@
+package apptest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"testing"
+
+	"github.com/tilteng/go-app-context/app_context"
+)
+
+// BenchResult is one benchmark's numbers, as kept in a baseline file
+type BenchResult struct {
+	Name        string  `json:"name"`
+	NsPerOp     float64 `json:"ns_per_op"`
+	AllocsPerOp int64   `json:"allocs_per_op"`
+	BytesPerOp  int64   `json:"bytes_per_op"`
+}
+
+// Baseline is earlier results, by benchmark name
+type Baseline map[string]BenchResult
+
+// Regression is a benchmark that got slower, or allocates more, than its
+// baseline allows
+type Regression struct {
+	Name     string
+	Baseline BenchResult
+	Current  BenchResult
+}
+
+func (self Regression) String() string {
+	return fmt.Sprintf(
+		"%s: %.0f ns/op, %d allocs/op (baseline %.0f ns/op, %d allocs/op)",
+		self.Name,
+		self.Current.NsPerOp,
+		self.Current.AllocsPerOp,
+		self.Baseline.NsPerOp,
+		self.Baseline.AllocsPerOp,
+	)
+}
+
+// Benchmarks are the app context's hot paths: accessors, request
+// middleware, sending metrics and, if there's a database, a query through
+// DBRead. Use them from a Benchmark function with b.Run, or through
+// RunBenchmarks.
+func Benchmarks(appctx app_context.AppContext) map[string]func(*testing.B) {
+	benchmarks := map[string]func(*testing.B){
+		"accessors": func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				appctx.Logger()
+				appctx.MetricsClient()
+				appctx.RollbarClient()
+				appctx.Cache()
+				appctx.DB()
+			}
+		},
+		"derived_context": func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				appctx.WithComponent("bench").MetricsClient()
+			}
+		},
+		"middleware": func(b *testing.B) {
+			handler := appctx.RequestMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusNoContent)
+			}))
+			req := httptest.NewRequest("GET", "/bench", nil)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				handler.ServeHTTP(httptest.NewRecorder(), req)
+			}
+		},
+		"metrics": func(b *testing.B) {
+			mcli := appctx.MetricsClient()
+			tags := map[string]string{"bench": "true"}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				mcli.Incr("apptest.bench", 1.0, tags)
+			}
+		},
+	}
+
+	if appctx.DB() != nil {
+		benchmarks["db_query"] = func(b *testing.B) {
+			ctx := context.Background()
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				var one int
+				if err := appctx.DBReadContext(ctx).QueryRowContext(ctx, "SELECT 1").Scan(&one); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	}
+
+	return benchmarks
+}
+
+// RunBenchmarks runs Benchmarks with testing.Benchmark, so it works from a
+// test without -bench. Results are sorted by name.
+func RunBenchmarks(appctx app_context.AppContext) []BenchResult {
+	benchmarks := Benchmarks(appctx)
+
+	names := make([]string, 0, len(benchmarks))
+	for name := range benchmarks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	results := make([]BenchResult, 0, len(names))
+	for _, name := range names {
+		res := testing.Benchmark(benchmarks[name])
+		results = append(results, BenchResult{
+			Name:        name,
+			NsPerOp:     float64(res.T.Nanoseconds()) / float64(res.N),
+			AllocsPerOp: res.AllocsPerOp(),
+			BytesPerOp:  res.AllocedBytesPerOp(),
+		})
+	}
+	return results
+}
+
+// LoadBaseline reads a baseline file written by SaveBaseline
+func LoadBaseline(path string) (Baseline, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var results []BenchResult
+	if err := json.Unmarshal(data, &results); err != nil {
+		return nil, fmt.Errorf("Error decoding %s: %s", path, err)
+	}
+	baseline := make(Baseline, len(results))
+	for _, res := range results {
+		baseline[res.Name] = res
+	}
+	return baseline, nil
+}
+
+// SaveBaseline writes results to path as JSON
+func SaveBaseline(path string, results []BenchResult) error {
+	data, err := json.MarshalIndent(results, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// CompareBaseline returns the results that are more than tolerance (eg.
+// 0.2 for 20%) slower than their baseline, or allocate more. Benchmarks
+// missing from the baseline are skipped.
+func CompareBaseline(results []BenchResult, baseline Baseline, tolerance float64) []Regression {
+	regressions := make([]Regression, 0)
+	for _, res := range results {
+		base, ok := baseline[res.Name]
+		if !ok {
+			continue
+		}
+		if res.NsPerOp > base.NsPerOp*(1+tolerance) || res.AllocsPerOp > base.AllocsPerOp {
+			regressions = append(regressions, Regression{Name: res.Name, Baseline: base, Current: res})
+		}
+	}
+	return regressions
+}
+
+// CheckRegressions runs the benchmarks against appctx and fails t for each
+// regression from the baseline at path. If the file doesn't exist yet, or
+// APPTEST_UPDATE_BASELINE=true, it's written instead. Timings vary between
+// machines, so keep one baseline per CI runner type and a generous
+// tolerance.
+func CheckRegressions(t *testing.T, appctx app_context.AppContext, path string, tolerance float64) {
+	t.Helper()
+
+	results := RunBenchmarks(appctx)
+
+	baseline, err := LoadBaseline(path)
+	if os.IsNotExist(err) || os.Getenv("APPTEST_UPDATE_BASELINE") == "true" {
+		if err := SaveBaseline(path, results); err != nil {
+			t.Fatalf("Error writing baseline: %s", err)
+		}
+		t.Logf("Wrote benchmark baseline to %s", path)
+		return
+	} else if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, reg := range CompareBaseline(results, baseline, tolerance) {
+		t.Errorf("Performance regression: %s", reg)
+	}
+}
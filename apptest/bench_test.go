@@ -0,0 +1,62 @@
+package apptest
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/tilteng/go-app-context/app_context"
+)
+
+func BenchmarkAppContext(b *testing.B) {
+	appctx, err := app_context.NewAppContext("apptest", app_context.WithDotEnv(""))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer appctx.Close()
+
+	for name, bench := range Benchmarks(appctx) {
+		b.Run(name, bench)
+	}
+}
+
+func TestCompareBaseline(t *testing.T) {
+	baseline := Baseline{
+		"fast":   {Name: "fast", NsPerOp: 100, AllocsPerOp: 1},
+		"allocs": {Name: "allocs", NsPerOp: 100, AllocsPerOp: 1},
+		"slow":   {Name: "slow", NsPerOp: 100, AllocsPerOp: 1},
+	}
+	results := []BenchResult{
+		{Name: "fast", NsPerOp: 115, AllocsPerOp: 1},
+		{Name: "allocs", NsPerOp: 90, AllocsPerOp: 2},
+		{Name: "slow", NsPerOp: 130, AllocsPerOp: 1},
+		{Name: "new", NsPerOp: 1000, AllocsPerOp: 10},
+	}
+
+	regressions := CompareBaseline(results, baseline, 0.2)
+	if len(regressions) != 2 || regressions[0].Name != "allocs" || regressions[1].Name != "slow" {
+		t.Errorf("Expected allocs and slow to regress, got %v", regressions)
+	}
+}
+
+func TestBaselineFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "apptest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "baseline.json")
+	results := []BenchResult{{Name: "accessors", NsPerOp: 42.5, AllocsPerOp: 0, BytesPerOp: 0}}
+	if err := SaveBaseline(path, results); err != nil {
+		t.Fatal(err)
+	}
+	baseline, err := LoadBaseline(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if baseline["accessors"] != results[0] {
+		t.Errorf("Baseline didn't round trip: %+v", baseline)
+	}
+}
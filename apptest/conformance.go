@@ -0,0 +1,203 @@
+// Package apptest checks that an AppContext behaves the way code written
+// against app_context expects, for apps that wrap or reimplement the
+// interface, and benchmarks it so upgrades that slow things down are
+// caught.
+package apptest
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/tilteng/go-app-context/app_context"
+)
+
+// accessors are the getters that must never return nil: with nothing
+// configured they return NOOP implementations
+func accessors(appctx app_context.AppContext) map[string]func() interface{} {
+	return map[string]func() interface{}{
+		"Admin":                 func() interface{} { return appctx.Admin() },
+		"Admission":             func() interface{} { return appctx.Admission() },
+		"AuditLogger":           func() interface{} { return appctx.AuditLogger() },
+		"AuthKeys":              func() interface{} { return appctx.AuthKeys() },
+		"Cache":                 func() interface{} { return appctx.Cache() },
+		"CDC":                   func() interface{} { return appctx.CDC() },
+		"Checkpoint":            func() interface{} { return appctx.Checkpoint("apptest") },
+		"CircuitBreakers":       func() interface{} { return appctx.CircuitBreakers() },
+		"Clock":                 func() interface{} { return appctx.Clock() },
+		"Crypto":                func() interface{} { return appctx.Crypto() },
+		"ConfigSummary":         func() interface{} { return appctx.ConfigSummary(true) },
+		"Consumers":             func() interface{} { return appctx.Consumers() },
+		"DataSampler":           func() interface{} { return appctx.DataSampler() },
+		"Datasets":              func() interface{} { return appctx.Datasets() },
+		"ErrorCodes":            func() interface{} { return appctx.ErrorCodes() },
+		"ErrorReporter":         func() interface{} { return appctx.ErrorReporter() },
+		"FieldPropagation":      func() interface{} { return appctx.FieldPropagation() },
+		"GoldenSignals":         func() interface{} { return appctx.GoldenSignals() },
+		"Health":                func() interface{} { return appctx.Health() },
+		"HTTPClient":            func() interface{} { return appctx.HTTPClient() },
+		"IDGenerator":           func() interface{} { return appctx.IDGenerator() },
+		"Jobs":                  func() interface{} { return appctx.Jobs() },
+		"KafkaConsumerGroup":    func() interface{} { return appctx.KafkaConsumerGroup() },
+		"KafkaProducer":         func() interface{} { return appctx.KafkaProducer() },
+		"LeaderElection":        func() interface{} { return appctx.LeaderElection() },
+		"Localizer":             func() interface{} { return appctx.Localizer() },
+		"Locks":                 func() interface{} { return appctx.Locks() },
+		"Logger":                func() interface{} { return appctx.Logger() },
+		"Mailer":                func() interface{} { return appctx.Mailer() },
+		"MatViews":              func() interface{} { return appctx.MatViews() },
+		"MessageBus":            func() interface{} { return appctx.MessageBus() },
+		"MetricsClient":         func() interface{} { return appctx.MetricsClient() },
+		"NotificationTemplates": func() interface{} { return appctx.NotificationTemplates() },
+		"ObjectStore":           func() interface{} { return appctx.ObjectStore() },
+		"OpenAPI":               func() interface{} { return appctx.OpenAPI() },
+		"Outbox":                func() interface{} { return appctx.Outbox() },
+		"Partitions":            func() interface{} { return appctx.Partitions() },
+		"Rand":                  func() interface{} { return appctx.Rand() },
+		"RollbarClient":         func() interface{} { return appctx.RollbarClient() },
+		"ScalingSignals":        func() interface{} { return appctx.ScalingSignals() },
+		"SchemaRegistry":        func() interface{} { return appctx.SchemaRegistry() },
+		"Scheduler":             func() interface{} { return appctx.Scheduler() },
+		"Services":              func() interface{} { return appctx.Services() },
+		"SSE":                   func() interface{} { return appctx.SSE() },
+		"Suppressions":          func() interface{} { return appctx.Suppressions() },
+		"SyntheticChecks":       func() interface{} { return appctx.SyntheticChecks() },
+		"Templates":             func() interface{} { return appctx.Templates() },
+		"Tunables":              func() interface{} { return appctx.Tunables() },
+		"VersionHandler":        func() interface{} { return appctx.VersionHandler() },
+		"Watchdog":              func() interface{} { return appctx.Watchdog() },
+		"WebSockets":            func() interface{} { return appctx.WebSockets() },
+		"Workers":               func() interface{} { return appctx.Workers() },
+	}
+}
+
+// isNil is also true for a typed nil pointer in an interface
+func isNil(v interface{}) bool {
+	if v == nil {
+		return true
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Ptr, reflect.Map, reflect.Slice, reflect.Func, reflect.Chan, reflect.Interface:
+		return rv.IsNil()
+	}
+	return false
+}
+
+func checkAccessors(t *testing.T, appctx app_context.AppContext) {
+	t.Helper()
+	for name, get := range accessors(appctx) {
+		if isNil(get()) {
+			t.Errorf("%s() returned nil", name)
+		}
+	}
+}
+
+// RunAppContextConformance runs subtests that appctx, typically a wrapper
+// around one from NewAppContext, keeps the guarantees callers rely on:
+// accessors never return nil, the NOOP fallbacks are safe to use, accessors
+// and derived contexts can be used from many goroutines, and Close can be
+// called more than once. Run it with -race. It closes appctx last, so
+// pass a context made for the test.
+func RunAppContextConformance(t *testing.T, appctx app_context.AppContext) {
+	t.Run("Accessors", func(t *testing.T) {
+		checkAccessors(t, appctx)
+		if appctx.AppName() == "" {
+			t.Error("AppName() is empty")
+		}
+		if appctx.TiltEnv() == "" {
+			t.Error("TiltEnv() is empty")
+		}
+	})
+
+	t.Run("NOOPFallbacks", func(t *testing.T) {
+		ctx := context.Background()
+
+		// Whatever is configured, these must be callable without
+		// checking MetricsEnabled, RollbarEnabled and so on first
+		appctx.MetricsClient().Incr("apptest.conformance", 1.0, nil)
+		appctx.Logger().LogDebugf(ctx, "apptest: conformance check")
+
+		key := fmt.Sprintf("apptest:missing:%d", appctx.Rand().Int63())
+		if _, err := appctx.Cache().Get(ctx, key); err != app_context.ErrCacheMiss {
+			t.Errorf("Expected ErrCacheMiss for a missing key, got %v", err)
+		}
+
+		for _, res := range appctx.Health().Check(ctx) {
+			if res == nil {
+				t.Error("Health().Check() returned a nil result")
+			}
+		}
+	})
+
+	t.Run("As", func(t *testing.T) {
+		var found app_context.AppContext
+		if !app_context.As(appctx, &found) || found != appctx {
+			t.Error("As didn't match the app context itself")
+		}
+		// An app context's As must return false for what it doesn't
+		// offer, not panic or match everything
+		var missing interface{ NotACapability() }
+		if appctx.As(&missing) {
+			t.Error("As matched a capability nothing implements")
+		}
+	})
+
+	t.Run("DerivedContexts", func(t *testing.T) {
+		derived := map[string]app_context.AppContext{
+			"WithComponent": appctx.WithComponent("apptest"),
+			"WithFields":    appctx.WithFields(map[string]interface{}{"apptest": true}),
+		}
+		for name, child := range derived {
+			if child == nil {
+				t.Errorf("%s returned nil", name)
+				continue
+			}
+			if child.AppName() != appctx.AppName() {
+				t.Errorf("%s changed the app name to '%s'", name, child.AppName())
+			}
+			checkAccessors(t, child)
+		}
+	})
+
+	t.Run("ConcurrentAccessors", func(t *testing.T) {
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				for j := 0; j < 20; j++ {
+					for _, get := range accessors(appctx) {
+						get()
+					}
+					child := appctx.WithComponent(fmt.Sprintf("apptest%d", i))
+					child.Logger()
+					child.MetricsClient()
+					appctx.ConfigFingerprint()
+					appctx.LogLevel()
+				}
+			}(i)
+		}
+		wg.Wait()
+	})
+
+	t.Run("Close", func(t *testing.T) {
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				appctx.Close()
+			}()
+		}
+		wg.Wait()
+
+		if err := appctx.Close(); err != nil {
+			t.Errorf("Closing again returned an error: %s", err)
+		}
+		// Code that's still shutting down may use it
+		checkAccessors(t, appctx)
+	})
+}
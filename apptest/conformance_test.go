@@ -0,0 +1,40 @@
+package apptest
+
+import (
+	"testing"
+
+	"github.com/tilteng/go-app-context/app_context"
+)
+
+func TestConformance(t *testing.T) {
+	appctx, err := app_context.NewAppContext("apptest", app_context.WithDotEnv(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	RunAppContextConformance(t, appctx)
+}
+
+// wrapped is how apps usually extend the interface
+type wrapped struct {
+	app_context.AppContext
+}
+
+func TestConformanceWrapped(t *testing.T) {
+	appctx, err := app_context.NewAppContext("apptest", app_context.WithDotEnv(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	RunAppContextConformance(t, &wrapped{appctx})
+}
+
+func TestConformanceAppContextWrapper(t *testing.T) {
+	appctx, err := app_context.NewAppContext("apptest", app_context.WithDotEnv(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rewrap func(app_context.AppContext) app_context.AppContext
+	rewrap = func(inner app_context.AppContext) app_context.AppContext {
+		return app_context.NewAppContextWrapper(inner, rewrap)
+	}
+	RunAppContextConformance(t, rewrap(appctx))
+}
@@ -0,0 +1,59 @@
+package testctx
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tilteng/go-app-context/app_context"
+)
+
+// blockTimeout is how long AdvanceWhenWaiting waits for goroutines to
+// start waiting on the clock
+var blockTimeout = 5 * time.Second
+
+// WithFakeClock gives the app context a FakeClock starting at start, set
+// before anything is started so the scheduler, retries, cache TTLs, rate
+// limiters and heartbeats all run on it
+func WithFakeClock(start time.Time) Option {
+	return func(cfg *config) {
+		cfg.appOptions = append(cfg.appOptions, app_context.WithClock(app_context.NewFakeClock(start)))
+	}
+}
+
+// FakeClock is appctx's FakeClock. It fails t if appctx isn't using one.
+func FakeClock(t testing.TB, appctx app_context.AppContext) *app_context.FakeClock {
+	t.Helper()
+	clock, ok := appctx.Clock().(*app_context.FakeClock)
+	if !ok {
+		t.Fatalf("App context's clock is a %T, not a FakeClock; use WithFakeClock", appctx.Clock())
+	}
+	return clock
+}
+
+// Advance moves appctx's fake clock forward by d
+func Advance(t testing.TB, appctx app_context.AppContext, d time.Duration) {
+	t.Helper()
+	FakeClock(t, appctx).Advance(d)
+}
+
+// AdvanceWhenWaiting waits until n timers or tickers are waiting on
+// appctx's fake clock, then moves it forward by d, so the goroutines that
+// should fire are sure to be asleep first. It fails t if they don't start
+// waiting within a few seconds.
+func AdvanceWhenWaiting(t testing.TB, appctx app_context.AppContext, n int, d time.Duration) {
+	t.Helper()
+	clock := FakeClock(t, appctx)
+
+	waiting := make(chan struct{})
+	go func() {
+		clock.BlockUntil(n)
+		close(waiting)
+	}()
+
+	select {
+	case <-waiting:
+	case <-time.After(blockTimeout):
+		t.Fatalf("Fewer than %d timers started waiting on the clock", n)
+	}
+	clock.Advance(d)
+}
@@ -0,0 +1,396 @@
+package testctx
+
+import (
+	"bufio"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tilteng/go-app-context/app_context"
+)
+
+// Dependency is a service tests need running, started in a docker
+// container unless ReuseEnv names an environment variable with the address
+// of one that's already running
+type Dependency struct {
+	Name  string
+	Image string
+	// Port is the container port to publish, eg. "5432/tcp"
+	Port string
+	// HostPort publishes the service on a free host port, the same inside
+	// the container, for services like Kafka that advertise their
+	// address. "{port}" in Env is replaced with it.
+	HostPort bool
+	Env      []string
+	Args     []string
+	// ReuseEnv is eg. TEST_DB_DSN: its value is used as Address instead
+	// of starting a container
+	ReuseEnv string
+	// Address turns the published host:port into what Ready and Settings
+	// are given, eg. a DSN
+	Address func(hostport string) string
+	// Ready returns nil once the service accepts connections
+	Ready func(addr string) error
+	// Settings are the app context settings that point at addr
+	Settings func(addr string) map[string]string
+}
+
+// Postgres is a throwaway postgres server. Set TEST_DB_DSN to use an
+// existing one.
+func Postgres() Dependency {
+	return Dependency{
+		Name:     "postgres",
+		Image:    "postgres:13-alpine",
+		Port:     "5432/tcp",
+		Env:      []string{"POSTGRES_USER=test", "POSTGRES_PASSWORD=test", "POSTGRES_DB=test"},
+		ReuseEnv: "TEST_DB_DSN",
+		Address: func(hostport string) string {
+			return "postgres://test:test@" + hostport + "/test?sslmode=disable"
+		},
+		Ready: func(dsn string) error {
+			db, err := sql.Open("postgres", dsn)
+			if err != nil {
+				return err
+			}
+			defer db.Close()
+			return db.Ping()
+		},
+		Settings: func(dsn string) map[string]string {
+			return map[string]string{"DB_DSN": dsn}
+		},
+	}
+}
+
+// Redis is a throwaway redis server, used as the cache. Set TEST_REDIS_URL
+// to use an existing one.
+func Redis() Dependency {
+	return Dependency{
+		Name:     "redis",
+		Image:    "redis:6-alpine",
+		Port:     "6379/tcp",
+		ReuseEnv: "TEST_REDIS_URL",
+		Address: func(hostport string) string {
+			return "redis://" + hostport + "/0"
+		},
+		Ready: func(redis_url string) error {
+			u, err := url.Parse(redis_url)
+			if err != nil {
+				return err
+			}
+			conn, err := net.DialTimeout("tcp", u.Host, time.Second)
+			if err != nil {
+				return err
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(time.Second))
+			if _, err := conn.Write([]byte("PING\r\n")); err != nil {
+				return err
+			}
+			line, err := bufio.NewReader(conn).ReadString('\n')
+			if err != nil {
+				return err
+			}
+			if !strings.HasPrefix(line, "+PONG") {
+				return fmt.Errorf("Unexpected reply to PING: %s", strings.TrimSpace(line))
+			}
+			return nil
+		},
+		Settings: func(redis_url string) map[string]string {
+			return map[string]string{"CACHE_BACKEND": "redis", "CACHE_REDIS_URL": redis_url}
+		},
+	}
+}
+
+// Kafka is a single throwaway Kafka broker, in KRaft mode so there's no
+// zookeeper. Set TEST_KAFKA_BROKERS to use existing brokers.
+func Kafka() Dependency {
+	return Dependency{
+		Name:     "kafka",
+		Image:    "bitnami/kafka:3.4",
+		HostPort: true,
+		Env: []string{
+			"KAFKA_CFG_NODE_ID=0",
+			"KAFKA_CFG_PROCESS_ROLES=controller,broker",
+			"KAFKA_CFG_CONTROLLER_QUORUM_VOTERS=0@localhost:9093",
+			"KAFKA_CFG_LISTENERS=PLAINTEXT://:{port},CONTROLLER://:9093",
+			"KAFKA_CFG_ADVERTISED_LISTENERS=PLAINTEXT://127.0.0.1:{port}",
+			"KAFKA_CFG_LISTENER_SECURITY_PROTOCOL_MAP=CONTROLLER:PLAINTEXT,PLAINTEXT:PLAINTEXT",
+			"KAFKA_CFG_CONTROLLER_LISTENER_NAMES=CONTROLLER",
+		},
+		ReuseEnv: "TEST_KAFKA_BROKERS",
+		Address: func(hostport string) string {
+			return hostport
+		},
+		Ready: func(brokers string) error {
+			conn, err := net.DialTimeout("tcp", strings.Split(brokers, ",")[0], time.Second)
+			if err != nil {
+				return err
+			}
+			return conn.Close()
+		},
+		Settings: func(brokers string) map[string]string {
+			return map[string]string{"KAFKA_BROKERS": brokers}
+		},
+	}
+}
+
+type runningDep struct {
+	dep         Dependency
+	containerID string
+	addr        string
+}
+
+// Dependencies are services started by StartDependencies
+type Dependencies struct {
+	lock    sync.Mutex
+	running []*runningDep
+}
+
+// readyTimeout is how long a container has to start accepting connections
+var readyTimeout = 2 * time.Minute
+
+func docker(args ...string) (string, error) {
+	out, err := exec.Command("docker", args...).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("docker %s: %s: %s", args[0], err, strings.TrimSpace(string(out)))
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// DockerAvailable is whether the docker CLI is installed and can reach a
+// daemon
+func DockerAvailable() bool {
+	if _, err := exec.LookPath("docker"); err != nil {
+		return false
+	}
+	_, err := docker("info", "--format", "{{.ServerVersion}}")
+	return err == nil
+}
+
+func freePort() (int, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
+
+func startContainer(dep Dependency) (*runningDep, error) {
+	args := []string{"run", "-d", "--label", "testctx=" + dep.Name}
+
+	env := dep.Env
+	if dep.HostPort {
+		port, err := freePort()
+		if err != nil {
+			return nil, err
+		}
+		host_port := strconv.Itoa(port)
+		args = append(args, "-p", "127.0.0.1:"+host_port+":"+host_port)
+		dep.Port = host_port + "/tcp"
+		env = make([]string, len(dep.Env))
+		for i, e := range dep.Env {
+			env[i] = strings.Replace(e, "{port}", host_port, -1)
+		}
+	} else {
+		args = append(args, "-p", "127.0.0.1::"+strings.TrimSuffix(dep.Port, "/tcp"))
+	}
+
+	for _, e := range env {
+		args = append(args, "-e", e)
+	}
+	args = append(args, dep.Image)
+	args = append(args, dep.Args...)
+
+	id, err := docker(args...)
+	if err != nil {
+		return nil, err
+	}
+	rd := &runningDep{dep: dep, containerID: id}
+
+	hostport, err := docker("port", id, dep.Port)
+	if err != nil {
+		rd.remove()
+		return nil, err
+	}
+	// One line per address family
+	hostport = strings.Split(hostport, "\n")[0]
+	rd.addr = dep.Address(hostport)
+
+	return rd, nil
+}
+
+func (self *runningDep) remove() error {
+	if self.containerID == "" {
+		return nil
+	}
+	_, err := docker("rm", "-f", "-v", self.containerID)
+	return err
+}
+
+func (self *runningDep) waitReady() error {
+	if self.dep.Ready == nil {
+		return nil
+	}
+	deadline := time.Now().Add(readyTimeout)
+	for {
+		err := self.dep.Ready(self.addr)
+		if err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%s isn't ready after %s: %s", self.dep.Name, readyTimeout, err)
+		}
+		time.Sleep(250 * time.Millisecond)
+	}
+}
+
+// StartDependencies starts deps, or uses the running ones their ReuseEnv
+// point at, and waits until they're ready. Close removes the containers,
+// so in a TestMain, start them once for the whole package.
+func StartDependencies(deps ...Dependency) (*Dependencies, error) {
+	self := &Dependencies{}
+
+	for _, dep := range deps {
+		var rd *runningDep
+		if addr := os.Getenv(dep.ReuseEnv); dep.ReuseEnv != "" && addr != "" {
+			rd = &runningDep{dep: dep, addr: addr}
+		} else {
+			var err error
+			if rd, err = startContainer(dep); err != nil {
+				self.Close()
+				return nil, fmt.Errorf("Error starting %s: %s", dep.Name, err)
+			}
+		}
+		self.running = append(self.running, rd)
+
+		if err := rd.waitReady(); err != nil {
+			self.Close()
+			return nil, err
+		}
+	}
+
+	return self, nil
+}
+
+// RequireDependencies is StartDependencies for a single test: t is skipped
+// if docker isn't available (and nothing is reused), and the containers are
+// removed when it finishes
+func RequireDependencies(t testing.TB, deps ...Dependency) *Dependencies {
+	t.Helper()
+
+	need_docker := false
+	for _, dep := range deps {
+		if dep.ReuseEnv == "" || os.Getenv(dep.ReuseEnv) == "" {
+			need_docker = true
+		}
+	}
+	if need_docker && !DockerAvailable() {
+		t.Skip("Docker isn't available")
+	}
+
+	d, err := StartDependencies(deps...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := d.Close(); err != nil {
+			t.Errorf("Error removing containers: %s", err)
+		}
+	})
+	return d
+}
+
+// Address is where the dependency named name is, eg. a DSN for Postgres()
+func (self *Dependencies) Address(name string) string {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for _, rd := range self.running {
+		if rd.dep.Name == name {
+			return rd.addr
+		}
+	}
+	return ""
+}
+
+// Settings are the app context settings for every dependency
+func (self *Dependencies) Settings() map[string]string {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	settings := make(map[string]string)
+	for _, rd := range self.running {
+		if rd.dep.Settings == nil {
+			continue
+		}
+		for name, val := range rd.dep.Settings(rd.addr) {
+			settings[name] = val
+		}
+	}
+	return settings
+}
+
+// Close removes the containers that were started, returning the first
+// error. Reused services are left alone.
+func (self *Dependencies) Close() error {
+	self.lock.Lock()
+	running := self.running
+	self.running = nil
+	self.lock.Unlock()
+
+	var first_err error
+	for i := len(running) - 1; i >= 0; i-- {
+		if err := running[i].remove(); err != nil && first_err == nil {
+			first_err = err
+		}
+	}
+	return first_err
+}
+
+// writeDotEnv writes settings as a .env file in dir
+func writeDotEnv(dir string, settings map[string]string) error {
+	names := make([]string, 0, len(settings))
+	for name := range settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf strings.Builder
+	for _, name := range names {
+		if strings.ContainsAny(settings[name], "\n'") {
+			return errors.New("Can't write " + name + " to .env")
+		}
+		buf.WriteString(name + "='" + settings[name] + "'\n")
+	}
+	return ioutil.WriteFile(filepath.Join(dir, ".env"), []byte(buf.String()), 0600)
+}
+
+// WithDependencies points the app context at deps. They're passed as .env
+// settings, so the environment still overrides them.
+func WithDependencies(deps *Dependencies) Option {
+	return func(cfg *config) {
+		cfg.deps = deps
+	}
+}
+
+func (self *config) dependencyOptions(t testing.TB) []app_context.Option {
+	if self.deps == nil {
+		return nil
+	}
+	dir := t.TempDir()
+	if err := writeDotEnv(dir, self.deps.Settings()); err != nil {
+		t.Fatalf("Error writing dependency settings: %s", err)
+	}
+	return []app_context.Option{app_context.WithDotEnv(dir)}
+}
@@ -0,0 +1,160 @@
+package testctx
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// DBSnapshot is a saved copy of a database, kept as a Postgres template
+// database. Cloning a template is a file copy, so it's much quicker than
+// migrating and loading fixtures for each test.
+type DBSnapshot struct {
+	// Name is the template database's name
+	Name string
+	dsn  string
+}
+
+var dsnDBNameRE = regexp.MustCompile(`(^|\s)dbname=('[^']*'|\S*)`)
+
+// withDBName is dsn, a URL or key=value DSN, pointed at database name
+func withDBName(dsn, name string) (string, error) {
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		parsed, err := pq.ParseURL(dsn)
+		if err != nil {
+			return "", err
+		}
+		dsn = parsed
+	}
+	if dsnDBNameRE.MatchString(dsn) {
+		return dsnDBNameRE.ReplaceAllString(dsn, "${1}dbname="+name), nil
+	}
+	return strings.TrimSpace(dsn + " dbname=" + name), nil
+}
+
+func randomSuffix() string {
+	buf := make([]byte, 4)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// adminExec runs query on the postgres database of the server at dsn.
+// CREATE and DROP DATABASE can't run in the database they copy or drop.
+func adminExec(dsn string, query string, args ...interface{}) error {
+	admin_dsn, err := withDBName(dsn, "postgres")
+	if err != nil {
+		return err
+	}
+	db, err := sql.Open("postgres", admin_dsn)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	_, err = db.Exec(query, args...)
+	return err
+}
+
+// Snapshot saves the database dsn points to, schema and data, as the
+// template database name, replacing an older snapshot of that name.
+// Postgres won't copy a database other sessions are connected to, so take
+// it after migrating and loading fixtures and before opening it anywhere
+// else.
+func Snapshot(dsn, name string) (*DBSnapshot, error) {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, err
+	}
+	var source string
+	err = db.QueryRow("SELECT current_database()").Scan(&source)
+	db.Close()
+	if err != nil {
+		return nil, fmt.Errorf("Error finding the database to snapshot: %s", err)
+	}
+
+	snap := &DBSnapshot{Name: name, dsn: dsn}
+	if err := snap.Drop(); err != nil {
+		return nil, err
+	}
+	query := fmt.Sprintf("CREATE DATABASE %s TEMPLATE %s", pq.QuoteIdentifier(name), pq.QuoteIdentifier(source))
+	if err := adminExec(dsn, query); err != nil {
+		return nil, fmt.Errorf("Error snapshotting %s: %s", source, err)
+	}
+	return snap, nil
+}
+
+// Restore replaces the database dsn points to with the snapshot. Like
+// Snapshot, nothing else can be connected to it.
+func (self *DBSnapshot) Restore(dsn string) error {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return err
+	}
+	var target string
+	err = db.QueryRow("SELECT current_database()").Scan(&target)
+	db.Close()
+	if err != nil {
+		return fmt.Errorf("Error finding the database to restore: %s", err)
+	}
+
+	if err := dropDatabase(self.dsn, target); err != nil {
+		return err
+	}
+	query := fmt.Sprintf("CREATE DATABASE %s TEMPLATE %s", pq.QuoteIdentifier(target), pq.QuoteIdentifier(self.Name))
+	if err := adminExec(self.dsn, query); err != nil {
+		return fmt.Errorf("Error restoring %s: %s", target, err)
+	}
+	return nil
+}
+
+// Clone creates a new database from the snapshot and opens it. The
+// database is closed and dropped when t finishes.
+func (self *DBSnapshot) Clone(t testing.TB) *sqlx.DB {
+	t.Helper()
+
+	name := self.Name + "_" + randomSuffix()
+	query := fmt.Sprintf("CREATE DATABASE %s TEMPLATE %s", pq.QuoteIdentifier(name), pq.QuoteIdentifier(self.Name))
+	if err := adminExec(self.dsn, query); err != nil {
+		t.Fatalf("Error cloning snapshot %s: %s", self.Name, err)
+	}
+	t.Cleanup(func() {
+		if err := dropDatabase(self.dsn, name); err != nil {
+			t.Errorf("Error dropping %s: %s", name, err)
+		}
+	})
+
+	dsn, err := withDBName(self.dsn, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := sqlx.Open("postgres", dsn)
+	if err != nil {
+		t.Fatalf("Error opening %s: %s", name, err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	return db
+}
+
+// Drop drops the template database
+func (self *DBSnapshot) Drop() error {
+	return dropDatabase(self.dsn, self.Name)
+}
+
+func dropDatabase(dsn, name string) error {
+	// Stray sessions, eg. from a pool that wasn't closed, would block it
+	terminate := "SELECT pg_terminate_backend(pid) FROM pg_stat_activity WHERE datname = $1 AND pid <> pg_backend_pid()"
+	if err := adminExec(dsn, terminate, name); err != nil {
+		return fmt.Errorf("Error disconnecting from %s: %s", name, err)
+	}
+	if err := adminExec(dsn, "DROP DATABASE IF EXISTS "+pq.QuoteIdentifier(name)); err != nil {
+		return fmt.Errorf("Error dropping %s: %s", name, err)
+	}
+	return nil
+}
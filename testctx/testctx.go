@@ -0,0 +1,90 @@
+// Package testctx sets up app contexts for tests: closed when the test
+// finishes, without .env files, and optionally with a database of their
+// own cloned from a DBSnapshot, so tests that need data don't step on
+// each other. Rand is seeded and the seed logged, so a run that failed
+// because of it can be repeated with RANDOM_SEED. Dependencies runs the Postgres, Redis and Kafka they need
+// in throwaway docker containers.
+package testctx
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/tilteng/go-app-context/app_context"
+)
+
+type config struct {
+	appName    string
+	appOptions []app_context.Option
+	deps       *Dependencies
+	seed       *int64
+	snapshot   *DBSnapshot
+}
+
+type Option func(*config)
+
+// WithAppName sets the app name, "test" by default
+func WithAppName(app_name string) Option {
+	return func(cfg *config) {
+		cfg.appName = app_name
+	}
+}
+
+// WithAppOptions passes opts on to NewAppContext
+func WithAppOptions(opts ...app_context.Option) Option {
+	return func(cfg *config) {
+		cfg.appOptions = append(cfg.appOptions, opts...)
+	}
+}
+
+// WithRandomSeed seeds Rand and IDs with seed instead of one picked per
+// test
+func WithRandomSeed(seed int64) Option {
+	return func(cfg *config) {
+		cfg.seed = &seed
+	}
+}
+
+// WithSnapshot gives the app context a new database cloned from snap,
+// which is dropped when the test finishes
+func WithSnapshot(snap *DBSnapshot) Option {
+	return func(cfg *config) {
+		cfg.snapshot = snap
+	}
+}
+
+// New creates an app context that's closed when t finishes. Failures to
+// set it up fail t.
+func New(t testing.TB, opts ...Option) app_context.AppContext {
+	t.Helper()
+
+	cfg := &config{appName: "test"}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+
+	app_opts := append([]app_context.Option{app_context.WithDotEnv("")}, cfg.dependencyOptions(t)...)
+	if seed := os.Getenv("RANDOM_SEED"); seed != "" {
+		t.Logf("Random seed %s, from RANDOM_SEED", seed)
+	} else {
+		seed := time.Now().UnixNano()
+		if cfg.seed != nil {
+			seed = *cfg.seed
+		}
+		t.Logf("Random seed %d; RANDOM_SEED=%d repeats this run", seed, seed)
+		app_opts = append(app_opts, app_context.WithRandomSeed(seed))
+	}
+	app_opts = append(app_opts, cfg.appOptions...)
+	appctx, err := app_context.NewAppContext(cfg.appName, app_opts...)
+	if err != nil {
+		t.Fatalf("Error creating app context: %s", err)
+	}
+	t.Cleanup(func() { appctx.Close() })
+
+	if cfg.snapshot != nil {
+		appctx.SetDB(cfg.snapshot.Clone(t))
+	}
+
+	return appctx
+}
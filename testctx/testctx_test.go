@@ -0,0 +1,142 @@
+package testctx
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestNew(t *testing.T) {
+	appctx := New(t, WithAppName("testctx_test"))
+	if appctx.AppName() != "testctx_test" {
+		t.Errorf("Unexpected app name: %s", appctx.AppName())
+	}
+	if appctx.DB() != nil {
+		t.Error("Expected no database without a snapshot")
+	}
+}
+
+func TestWithDBName(t *testing.T) {
+	tests := map[string]string{
+		"postgres://app:pw@localhost:5432/app_test?sslmode=disable": "dbname=other host=localhost password=pw port=5432 sslmode=disable user=app",
+		"host=localhost dbname=app_test sslmode=disable":            "host=localhost dbname=other sslmode=disable",
+		"host=localhost": "host=localhost dbname=other",
+	}
+	for dsn, expected := range tests {
+		if got, err := withDBName(dsn, "other"); err != nil || got != expected {
+			t.Errorf("Expected %s to become %s, got %s (%v)", dsn, expected, got, err)
+		}
+	}
+}
+
+// TestSnapshot needs a Postgres database it can copy, and permission to
+// create databases, in TEST_DB_DSN
+func TestSnapshot(t *testing.T) {
+	dsn := os.Getenv("TEST_DB_DSN")
+	if dsn == "" {
+		t.Skip("TEST_DB_DSN isn't set")
+	}
+
+	snap, err := Snapshot(dsn, "testctx_snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snap.Drop()
+
+	for i := 0; i < 2; i++ {
+		appctx := New(t, WithSnapshot(snap))
+		db := appctx.DB()
+		var count int
+		if err := db.Get(&count, "SELECT count(*) FROM pg_tables WHERE tablename = 'testctx_rows'"); err != nil {
+			t.Fatal(err)
+		}
+		if count != 0 {
+			t.Errorf("Expected a clean clone, found the table from a previous test")
+		}
+		if _, err := db.Exec("CREATE TABLE testctx_rows (id int)"); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestWithDependencies(t *testing.T) {
+	os.Setenv("TESTCTX_FAKE_URL", "http://fake:8000")
+	defer os.Unsetenv("TESTCTX_FAKE_URL")
+
+	fake := Dependency{
+		Name:     "fake",
+		ReuseEnv: "TESTCTX_FAKE_URL",
+		Settings: func(addr string) map[string]string {
+			return map[string]string{"BASE_URL": addr}
+		},
+	}
+	deps := RequireDependencies(t, fake)
+	if addr := deps.Address("fake"); addr != "http://fake:8000" {
+		t.Errorf("Expected the reused address, got %s", addr)
+	}
+
+	appctx := New(t, WithDependencies(deps))
+	if url := appctx.BaseExternalURL(); url != "http://fake:8000" {
+		t.Errorf("Expected BASE_URL from the dependency, got %s", url)
+	}
+}
+
+// TestDependencies starts real containers, so it's skipped without docker
+func TestDependencies(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Starts containers")
+	}
+	deps := RequireDependencies(t, Postgres(), Redis())
+
+	appctx := New(t, WithDependencies(deps))
+	if err := appctx.DB().Ping(); err != nil {
+		t.Errorf("Couldn't reach postgres: %s", err)
+	}
+	if err := appctx.Cache().Set(context.Background(), "testctx", []byte("1"), time.Minute); err != nil {
+		t.Errorf("Couldn't reach redis: %s", err)
+	}
+}
+
+func TestFakeClock(t *testing.T) {
+	start := time.Date(2026, 10, 14, 9, 0, 0, 0, time.UTC)
+	appctx := New(t, WithFakeClock(start))
+
+	ran := make(chan time.Time, 1)
+	err := appctx.Scheduler().Every("testctx_clock", time.Hour, func(ctx context.Context) error {
+		ran <- appctx.Clock().Now()
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-ran:
+		t.Fatal("Job ran before the clock moved")
+	default:
+	}
+
+	AdvanceWhenWaiting(t, appctx, 1, time.Hour)
+	select {
+	case at := <-ran:
+		if !at.Equal(start.Add(time.Hour)) {
+			t.Errorf("Expected the job to run at %s, ran at %s", start.Add(time.Hour), at)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Job didn't run after advancing the clock")
+	}
+}
+
+func TestRandomSeed(t *testing.T) {
+	start := time.Date(2026, 10, 14, 9, 0, 0, 0, time.UTC)
+	first := New(t, WithRandomSeed(42), WithFakeClock(start))
+	second := New(t, WithRandomSeed(42), WithFakeClock(start))
+
+	if first.Rand().Int63() != second.Rand().Int63() {
+		t.Error("Expected the same seed to give the same random numbers")
+	}
+	if id := first.IDGenerator().NewID(); id != second.IDGenerator().NewID() {
+		t.Errorf("Expected the same seed and clock to give the same IDs, got %s", id)
+	}
+}